@@ -0,0 +1,138 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Permission of an API client. Every permission includes the ones below it
+type apiPermission int
+
+const (
+	apiPermissionNone    apiPermission = iota
+	apiPermissionRead                  // Query canvases and recordings
+	apiPermissionControl               // Start and stop recordings and replays
+)
+
+// An API token, stored in the configuration at .api.Tokens
+type apiServerToken struct {
+	Name       string // Only used in log messages
+	Token      string
+	Permission string // "read" or "control"
+}
+
+func parseAPIPermission(s string) (apiPermission, error) {
+	switch s {
+	case "read":
+		return apiPermissionRead, nil
+	case "control":
+		return apiPermissionControl, nil
+	}
+	return apiPermissionNone, fmt.Errorf("Unknown permission %q", s)
+}
+
+// Decides what API clients are allowed to do.
+//
+// Without any tokens, only clients on the same machine are accepted, with all permissions.
+// Otherwise every client has to send a token, local or not.
+type apiAuth struct {
+	tokens []apiServerToken
+	perms  []apiPermission
+}
+
+// Creates the authentication from the settings. Tokens with invalid settings are ignored
+func newAPIAuth(tokens []apiServerToken) *apiAuth {
+	a := &apiAuth{}
+	for _, t := range tokens {
+		perm, err := parseAPIPermission(t.Permission)
+		if err != nil {
+			apiLog.Errorf("Ignoring API token %q: %v", t.Name, err)
+			continue
+		}
+		if t.Token == "" {
+			apiLog.Errorf("Ignoring API token %q: Token is empty", t.Name)
+			continue
+		}
+		a.tokens = append(a.tokens, t)
+		a.perms = append(a.perms, perm)
+	}
+	return a
+}
+
+// Returns the permission of a client with the given token and remote address ("host:port")
+func (a *apiAuth) permission(token, remoteAddr string) apiPermission {
+	if len(a.tokens) == 0 {
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return apiPermissionControl
+		}
+		return apiPermissionNone
+	}
+
+	for i, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return a.perms[i]
+		}
+	}
+	return apiPermissionNone
+}
+
+// Returns the token of a HTTP request.
+// It can be sent as bearer token, as user or password of basic authentication (e.g. "http://token@host/"), or as token query parameter for browsers and WebSockets.
+func apiRequestToken(r *http.Request) string {
+	if user, password, ok := r.BasicAuth(); ok {
+		if password != "" {
+			return password
+		}
+		return user
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// Returns the current authentication of the API server
+func (as *apiServer) getAuth() *apiAuth {
+	as.authMutex.RLock()
+	defer as.authMutex.RUnlock()
+	return as.auth
+}
+
+// Wraps the handler, so it's only called for clients with the given permission
+func (as *apiServer) authorize(perm apiPermission, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := apiRequestToken(r)
+		switch {
+		case as.getAuth().permission(token, r.RemoteAddr) >= perm:
+			handler(w, r)
+		case token == "":
+			w.Header().Set("WWW-Authenticate", `Basic realm="D3pixelbot"`)
+			http.Error(w, "Missing API token", http.StatusUnauthorized)
+		default:
+			http.Error(w, "API token doesn't have the needed permission", http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_apiAuth(t *testing.T) {
+	local := newAPIAuth(nil)
+	if perm := local.permission("", "127.0.0.1:1234"); perm != apiPermissionControl {
+		t.Errorf("Local client without tokens got permission %v, want %v", perm, apiPermissionControl)
+	}
+	if perm := local.permission("", "[::1]:1234"); perm != apiPermissionControl {
+		t.Errorf("Local IPv6 client without tokens got permission %v, want %v", perm, apiPermissionControl)
+	}
+	if perm := local.permission("", "192.168.1.10:1234"); perm != apiPermissionNone {
+		t.Errorf("Remote client without tokens got permission %v, want %v", perm, apiPermissionNone)
+	}
+
+	a := newAPIAuth([]apiServerToken{
+		{Name: "Dashboard", Token: "reader", Permission: "read"},
+		{Name: "Scripts", Token: "controller", Permission: "control"},
+		{Name: "Invalid", Token: "invalid", Permission: "admin"},
+	})
+	tests := []struct {
+		token, remoteAddr string
+		want              apiPermission
+	}{
+		{"reader", "192.168.1.10:1234", apiPermissionRead},
+		{"controller", "192.168.1.10:1234", apiPermissionControl},
+		{"invalid", "192.168.1.10:1234", apiPermissionNone},
+		{"", "127.0.0.1:1234", apiPermissionNone},
+		{"wrong", "127.0.0.1:1234", apiPermissionNone},
+	}
+	for _, tt := range tests {
+		if perm := a.permission(tt.token, tt.remoteAddr); perm != tt.want {
+			t.Errorf("Token %q from %v got permission %v, want %v", tt.token, tt.remoteAddr, perm, tt.want)
+		}
+	}
+}
+
+func Test_apiServerAuthorize(t *testing.T) {
+	as := newAPIServer()
+	defer as.Close()
+	as.auth = newAPIAuth([]apiServerToken{
+		{Token: "reader", Permission: "read"},
+		{Token: "controller", Permission: "control"},
+	})
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	server := httptest.NewServer(as.authorize(apiPermissionControl, ok))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+		want   int
+	}{
+		{"Without token", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"Bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer controller") }, http.StatusOK},
+		{"Basic user", func(r *http.Request) { r.SetBasicAuth("controller", "") }, http.StatusOK},
+		{"Basic password", func(r *http.Request) { r.SetBasicAuth("user", "controller") }, http.StatusOK},
+		{"Query", func(r *http.Request) { r.URL.RawQuery = "token=controller" }, http.StatusOK},
+		{"Read only", func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader") }, http.StatusForbidden},
+		{"Wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		tt.modify(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v: Request failed: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%v: Got status %v, want %v", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A game with its name, as it is listed by the API
+type apiGame struct {
+	ShortName string `json:"shortName"`
+	Name      string `json:"name"`
+}
+
+// Returns all games that can be connected to, sorted by their short name
+func apiListGames() []apiGame {
+	games := []apiGame{}
+	for shortName, connectionType := range connectionTypes {
+		games = append(games, apiGame{shortName, connectionType.Name})
+	}
+	sort.Slice(games, func(i, j int) bool { return games[i].ShortName < games[j].ShortName })
+
+	return games
+}
+
+// State of a game or replay that is opened by the API
+type apiGameStatus struct {
+	ShortName     string     `json:"shortName"`
+	Name          string     `json:"name"`
+	OnlinePlayers int        `json:"onlinePlayers"`
+	Recording     bool       `json:"recording"`
+	DroppedEvents uint64     `json:"droppedEvents,omitempty"` // Events the recorder dropped, because the disk couldn't keep up
+	ReplayTime    *time.Time `json:"replayTime,omitempty"`    // Only set for replays
+
+	DroppedChunkRequests uint64 `json:"droppedChunkRequests,omitempty"` // Chunk download requests the connection couldn't keep up with, they are retried
+}
+
+// Returns the state of all opened games and replays, sorted by their short name
+func (as *apiServer) getStatus() []apiGameStatus {
+	as.gamesMutex.Lock()
+	defer as.gamesMutex.Unlock()
+
+	result := []apiGameStatus{}
+	for shortName, game := range as.games {
+		status := apiGameStatus{
+			ShortName:     shortName,
+			Name:          game.Connection.getName(),
+			OnlinePlayers: game.Connection.getOnlinePlayers(),
+			Recording:     game.Recorder != nil,
+
+			DroppedChunkRequests: game.Canvas.getDroppedChunkRequests(),
+		}
+		if dropper, ok := game.Recorder.(canvasRecorderDropper); ok {
+			status.DroppedEvents = dropper.getDroppedEvents()
+		}
+		if _, ok := game.Connection.(connectionReplay); ok {
+			if t, err := game.Canvas.getTime(); err == nil {
+				status.ReplayTime = &t
+			}
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ShortName < result[j].ShortName })
+
+	return result
+}
+
+// Returns the recordings of all games, grouped by their directory name
+func apiListRecordings() map[string][]canvasDiskReaderRecording {
+	result := map[string][]canvasDiskReaderRecording{}
+
+	dirs, _ := ioutil.ReadDir(dataPath(getPaths().Recordings))
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		cdr := canvasDiskReaderFor(dir.Name())
+		recs, err := cdr.refreshRecordings()
+		if err != nil || len(recs) == 0 {
+			continue
+		}
+		result[dir.Name()] = recs
+	}
+
+	return result
+}
+
+// Checks that a short name from a remote caller is the short name of a game, or the directory of recorded games.
+// Anything else, like paths of clips or URLs, could point anywhere.
+func apiCheckShortName(shortName string) error {
+	if _, ok := connectionTypes[shortName]; ok {
+		return nil
+	}
+	if shortName == "" || shortName == "." || shortName == ".." || strings.ContainsAny(shortName, `/\:`) {
+		return fmt.Errorf("Invalid game %q", shortName)
+	}
+	if info, err := os.Stat(dataPath(getPaths().Recordings, shortName)); err != nil || !info.IsDir() {
+		return fmt.Errorf("Unknown game %q", shortName)
+	}
+	return nil
+}
+
+// Checks that a file name from a remote caller stays inside of the exports directory.
+// Absolute paths and paths with ".." are rejected.
+func apiCheckFileName(fileName string) error {
+	if fileName == "" {
+		return fmt.Errorf("Missing fileName")
+	}
+	if filepath.IsAbs(fileName) || filepath.VolumeName(fileName) != "" || strings.HasPrefix(fileName, "/") || strings.HasPrefix(fileName, `\`) {
+		return fmt.Errorf("File name %q must be relative to the exports directory", fileName)
+	}
+	for _, part := range strings.FieldsFunc(fileName, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return fmt.Errorf("File name %q must not contain \"..\"", fileName)
+		}
+	}
+	return nil
+}
+
+// Returns the path of a file name from a remote caller inside of the exports directory, and creates the directories of it.
+// See apiCheckFileName.
+func apiExportFileName(fileName string) (string, error) {
+	if err := apiCheckFileName(fileName); err != nil {
+		return "", err
+	}
+
+	path := dataPath(getPaths().Exports, filepath.FromSlash(fileName))
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return "", fmt.Errorf("Can't create directory for %v: %v", path, err)
+	}
+	return path, nil
+}
+
+// Queues an export of a remote caller, see exportJobManager.add.
+// fileName is relative to the exports directory.
+func apiQueueExport(kind, shortName string, opts exportOptions, params exportJobParams, fileName string) (int, error) {
+	if err := apiCheckShortName(shortName); err != nil {
+		return 0, err
+	}
+	path, err := apiExportFileName(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return exportJobs.add(kind, shortName, opts, params, path)
+}
+
+// Returns the image of a canvas rectangle.
+// The rectangle is downloaded if needed, valid is false if that didn't happen in time.
+func (as *apiServer) getImage(shortName string, rect image.Rectangle, cancel <-chan struct{}) (img *image.RGBA, valid bool, err error) {
+	if rect.Empty() || rect.Dx()*rect.Dy() > apiServerMaxImagePixels {
+		return nil, false, fmt.Errorf("Rectangle %v is empty or too large", rect)
+	}
+
+	game, err := as.getGame(shortName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	valid = game.request(rect, cancel)
+
+	img, err = game.Canvas.getImageCopy(rect, false, true)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return img, valid, nil
+}
+
+// Writes rect of a game or open replay as PNG file, scaled to size.
+// fileName is relative to the exports directory, see apiExportFileName.
+// The rectangle is downloaded if needed, it fails if that didn't happen in time.
+func (as *apiServer) saveImage(shortName string, rect image.Rectangle, size pixelSize, fileName string) error {
+	if rect.Empty() {
+		return fmt.Errorf("Rectangle %v is empty", rect)
+	}
+
+	fileName, err := apiExportFileName(fileName)
+	if err != nil {
+		return err
+	}
+
+	game, err := as.getGame(shortName)
+	if err != nil {
+		return err
+	}
+
+	if !game.request(rect, nil) {
+		return fmt.Errorf("Rectangle %v of %v couldn't be downloaded in time", rect, shortName)
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+
+	return game.Canvas.writeImage(file, rect, size)
+}
+
+// Returns the color of a single pixel, or nil if there is no data.
+// The pixel is downloaded if needed, valid is false if that didn't happen in time.
+func (as *apiServer) getPixel(shortName string, pos image.Point, cancel <-chan struct{}) (col *color.NRGBA, valid bool, err error) {
+	game, err := as.getGame(shortName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	valid = game.request(image.Rectangle{pos, pos.Add(image.Point{1, 1})}, cancel)
+
+	if c, err := game.Canvas.getPixel(pos); err == nil {
+		nrgba := color.NRGBAModel.Convert(c).(color.NRGBA)
+		if nrgba.A > 0 {
+			col = &nrgba
+		}
+	}
+
+	return col, valid, nil
+}
+
+// A change of a pixel from the history of an opened game
+type apiPixelChange struct {
+	Time      time.Time `json:"time"`
+	Color     string    `json:"color"`               // Hex color like #RRGGBB
+	ColorName string    `json:"colorName,omitempty"` // Name of the color, see paletteNames
+	Author    string    `json:"author,omitempty"`
+}
+
+// Returns the last changes of a single pixel of an opened game, the newest first.
+// The game has to be opened with PixelHistory set in the chunk policy
+func (as *apiServer) getPixelHistory(shortName string, pos image.Point) ([]apiPixelChange, error) {
+	game, err := as.getGame(shortName)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := game.Canvas.getPixelHistory(pos)
+	if err != nil {
+		return nil, err
+	}
+
+	names := getPaletteNames(conf, shortName)
+	result := make([]apiPixelChange, 0, len(changes))
+	for _, change := range changes {
+		result = append(result, apiPixelChange{
+			Time:      change.Time,
+			Color:     fmt.Sprintf("#%02X%02X%02X", change.Color.R, change.Color.G, change.Color.B),
+			ColorName: names.name(change.Color),
+			Author:    change.Author,
+		})
+	}
+
+	return result, nil
+}
+
+// Starts recording the given rectangles of a game into a new file in recordings/<game>/.
+// If the game is already recorded, only the rectangles are changed, the settings apply to the next recording.
+func (as *apiServer) startRecording(shortName string, rects []image.Rectangle, settings canvasRecorderSettings) error {
+	if strings.HasPrefix(shortName, "replay-") {
+		return fmt.Errorf("Can't record replay %q", shortName)
+	}
+
+	game, err := as.getGame(shortName)
+	if err != nil {
+		return err
+	}
+
+	as.gamesMutex.Lock()
+	defer as.gamesMutex.Unlock()
+
+	if as.gamesClosed {
+		return fmt.Errorf("Can't record %q, the games are closed", shortName)
+	}
+	if game.Recorder == nil {
+		if game.Recorder, err = game.Canvas.newCanvasRecorder(shortName, settings); err != nil {
+			return err
+		}
+	}
+
+	return game.Recorder.setListeningRects(rects)
+}
+
+// Stops recording a game
+func (as *apiServer) stopRecording(shortName string) error {
+	as.gamesMutex.Lock()
+	defer as.gamesMutex.Unlock()
+
+	game, ok := as.games[shortName]
+	if !ok || game.Recorder == nil {
+		return fmt.Errorf("%q isn't recorded", shortName)
+	}
+
+	game.Recorder.Close()
+	game.Recorder = nil
+
+	return nil
+}
+
+// Announces a pixel that is placed in a game, so that the time until it comes back from the game is measured, see latencyProbe.
+// If placed is zero, the current time is used
+func (as *apiServer) announcePlacement(shortName string, pos image.Point, col color.Color, placed time.Time) error {
+	if strings.HasPrefix(shortName, "replay-") {
+		return fmt.Errorf("Can't measure the latency of replay %q", shortName)
+	}
+
+	game, err := as.getGame(shortName)
+	if err != nil {
+		return err
+	}
+
+	as.gamesMutex.Lock()
+	if as.gamesClosed {
+		as.gamesMutex.Unlock()
+		return fmt.Errorf("Can't measure the latency of %q, the games are closed", shortName)
+	}
+	if game.Latency == nil {
+		if game.Latency, err = game.Canvas.newLatencyProbe(shortName); err != nil {
+			as.gamesMutex.Unlock()
+			return err
+		}
+	}
+	lp := game.Latency
+	as.gamesMutex.Unlock()
+
+	return lp.announce(pos, col, placed)
+}
+
+// Returns the latencies of the placements that were announced for a game
+func (as *apiServer) getLatency(shortName string) (latencyReport, error) {
+	as.gamesMutex.Lock()
+	var lp *latencyProbe
+	if game, ok := as.games[shortName]; ok {
+		lp = game.Latency
+	}
+	as.gamesMutex.Unlock()
+	if lp == nil {
+		return latencyReport{}, fmt.Errorf("No placements were announced for %q", shortName)
+	}
+
+	return lp.report(), nil
+}
+
+// Returns the pixels per minute of the regions of a game since the given time, see canvasStatistics.
+// The game is opened if needed, which starts counting.
+func (as *apiServer) getStatistics(shortName string, since time.Time) (map[string][]canvasStatisticsSample, error) {
+	game, err := as.getGame(shortName)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := getCanvasStatistics(game.Connection.getShortName())
+	if err != nil {
+		return nil, err
+	}
+
+	return st.getSeries(since, time.Now()), nil
+}
+
+// Returns the changes of the live heatmap of a game within window, by pixel or chunk. See canvasHeatmap.
+// An empty rect returns the whole canvas, a window of 0 the whole window of the heatmap.
+func (as *apiServer) getHeatmap(shortName string, rect image.Rectangle, window time.Duration) ([]canvasHeatmapEntry, error) {
+	game, err := as.getGame(shortName)
+	if err != nil {
+		return nil, err
+	}
+
+	hm, err := getCanvasHeatmap(game.Connection.getShortName())
+	if err != nil {
+		return nil, err
+	}
+
+	return hm.getEntries(rect, window, time.Now())
+}
+
+// Renders the live heatmap of a game within window as image of rect, with transparent pixels where nothing changed.
+// ramp is the name of a color ramp, or a list of colors. See parseHeatmapRamp().
+func (as *apiServer) getHeatmapImage(shortName string, rect image.Rectangle, window time.Duration, ramp string) (*image.NRGBA, error) {
+	if rect.Empty() || rect.Dx()*rect.Dy() > apiServerMaxImagePixels {
+		return nil, fmt.Errorf("Rectangle %v is empty or too large", rect)
+	}
+	colorRamp, err := parseHeatmapRamp(ramp)
+	if err != nil {
+		return nil, err
+	}
+
+	game, err := as.getGame(shortName)
+	if err != nil {
+		return nil, err
+	}
+
+	hm, err := getCanvasHeatmap(game.Connection.getShortName())
+	if err != nil {
+		return nil, err
+	}
+
+	ha, err := hm.getAccumulator(rect, window, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return ha.image(colorRamp), nil
+}
+
+// Opens the recordings of a game for playback.
+// The replay can be queried like a game with the short name "replay-<game>", which is returned.
+func (as *apiServer) openReplay(shortName string) (string, error) {
+	con, can, err := newCanvasDiskReader(shortName)
+	if err != nil {
+		return "", err
+	}
+	replayName := con.getShortName()
+
+	as.gamesMutex.Lock()
+	defer as.gamesMutex.Unlock()
+
+	if _, ok := as.games[replayName]; ok {
+		con.Close()
+		return replayName, nil
+	}
+	if as.gamesClosed {
+		con.Close()
+		return "", fmt.Errorf("Can't open %q, the games are closed", replayName)
+	}
+
+	game := &apiServerGame{
+		Connection: con,
+		Canvas:     can,
+		rects:      map[image.Rectangle]time.Time{},
+	}
+	if err := can.subscribeListener(game, false); err != nil {
+		con.Close()
+		return "", err
+	}
+	as.games[replayName] = game
+
+	return replayName, nil
+}
+
+// Seeks an open replay to the given point in time
+func (as *apiServer) setReplayTime(replayName string, t time.Time) error {
+	as.gamesMutex.Lock()
+	defer as.gamesMutex.Unlock()
+
+	game, ok := as.games[replayName]
+	if !ok {
+		return fmt.Errorf("Replay %q isn't open", replayName)
+	}
+	con, ok := game.Connection.(connectionReplay)
+	if !ok {
+		return fmt.Errorf("%q isn't a replay", replayName)
+	}
+
+	return con.setReplayTime(t)
+}
+
+// Closes an open replay
+func (as *apiServer) closeReplay(replayName string) error {
+	as.gamesMutex.Lock()
+	defer as.gamesMutex.Unlock()
+
+	game, ok := as.games[replayName]
+	if !ok {
+		return fmt.Errorf("Replay %q isn't open", replayName)
+	}
+	if _, ok := game.Connection.(connectionReplay); !ok {
+		return fmt.Errorf("%q isn't a replay", replayName)
+	}
+
+	game.close()
+	delete(as.games, replayName)
+
+	return nil
+}
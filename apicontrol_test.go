@@ -0,0 +1,147 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+func Test_apiServerReplay(t *testing.T) {
+	useTestRecordingsDir(t)
+
+	// Unlike writeTestRecording, seek to a point in time where the recording is still valid
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	cdw, err := can.newCanvasDiskWriter("Test-APIControl", 0)
+	if err != nil {
+		t.Fatalf("Can't create canvas disk writer: %v", err)
+	}
+	rect, pos := image.Rect(0, 0, 64, 64), image.Point{1, 2}
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+	can.setPixel(pos, pixelcanvasioPalette[5])
+	time.Sleep(50 * time.Millisecond)
+	frameTime := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	cdw.Close()
+	can.Close()
+
+	if recs := apiListRecordings()["Test-APIControl"]; len(recs) == 0 {
+		t.Errorf("Recording isn't listed")
+	}
+
+	as := newAPIServer()
+	defer as.Close()
+
+	replayName, err := as.openReplay("Test-APIControl")
+	if err != nil {
+		t.Fatalf("Can't open replay: %v", err)
+	}
+	if err := as.setReplayTime(replayName, frameTime); err != nil {
+		t.Fatalf("Can't seek replay: %v", err)
+	}
+
+	col, valid, err := as.getPixel(replayName, pos, nil)
+	if err != nil {
+		t.Fatalf("Can't get pixel: %v", err)
+	}
+	want := color.NRGBAModel.Convert(pixelcanvasioPalette[5])
+	if !valid || col == nil || *col != want {
+		t.Errorf("Got pixel %v (valid: %v), want %v", col, valid, want)
+	}
+
+	if err := as.closeReplay(replayName); err != nil {
+		t.Errorf("Can't close replay: %v", err)
+	}
+	if err := as.closeReplay(replayName); err == nil {
+		t.Errorf("Closing replay twice succeeded, but it should fail")
+	}
+}
+
+func Test_apiServerRecording(t *testing.T) {
+	useTestRecordingsDir(t)
+	registerAPIServerTestGame()
+	defer delete(connectionTypes, "apitest")
+
+	as := newAPIServer()
+	defer as.Close()
+
+	if err := as.startRecording("apitest", []image.Rectangle{image.Rect(0, 0, 64, 64)}, canvasRecorderSettings{}); err != nil {
+		t.Fatalf("Can't start recording: %v", err)
+	}
+	if err := as.stopRecording("apitest"); err != nil {
+		t.Errorf("Can't stop recording: %v", err)
+	}
+	if err := as.stopRecording("apitest"); err == nil {
+		t.Errorf("Stopping recording twice succeeded, but it should fail")
+	}
+}
+
+func Test_apiServerShutdown(t *testing.T) {
+	useTestRecordingsDir(t)
+	registerAPIServerTestGame()
+	defer delete(connectionTypes, "apitest")
+
+	as := newAPIServer()
+	sc := newShutdownCoordinator()
+	sc.register("API server", as.shutdownStages())
+
+	if err := as.startRecording("apitest", []image.Rectangle{image.Rect(0, 0, 64, 64)}, canvasRecorderSettings{}); err != nil {
+		t.Fatalf("Can't start recording: %v", err)
+	}
+	game, _ := as.getGame("apitest")
+	fileName := game.Recorder.(*canvasDiskWriter).File.Name()
+
+	// All pixels that were set before the shutdown are recorded
+	for i := 0; i < 100; i++ {
+		game.Canvas.setPixel(image.Point{i % 64, i / 64}, pixelcanvasioPalette[5])
+	}
+	sc.run(10 * time.Second)
+
+	if _, err := as.getGame("apitest"); err == nil {
+		t.Errorf("Opened game after the shutdown")
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Can't open recording: %v", err)
+	}
+	defer f.Close()
+	r, err := recording.NewReader(f)
+	if err != nil {
+		t.Fatalf("Can't read recording: %v", err)
+	}
+	defer r.Close()
+	pixels := 0
+	for {
+		_, event, err := r.Next()
+		if err != nil {
+			break
+		}
+		if _, ok := event.(recording.SetPixel); ok {
+			pixels++
+		}
+	}
+	if pixels != 100 {
+		t.Errorf("Recording contains %v pixels, want 100", pixels)
+	}
+}
@@ -0,0 +1,84 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Maximum size of webhook request bodies
+const apiHookMaxBodySize = 1 << 20
+
+// Webhooks, and the methods of the control socket they call.
+// The names are used in the URL, e.g. /hooks/start-recording.
+var apiHooks = map[string]string{
+	"start-recording": "startRecording",
+	"stop-recording":  "stopRecording",
+	"export":          "queueExport",
+	"export-status":   "getExport",
+	"status":          "status",
+}
+
+// Serves /hooks/<name>, so external schedulers and chat bots can trigger actions.
+//
+// Hooks are called with POST, and take the same JSON params as the corresponding method of the control socket as body.
+// The result is sent as {"result": ...}, errors as {"error": "..."} with an error status code.
+// All hooks need the control permission.
+func (as *apiServer) serveHook(w http.ResponseWriter, r *http.Request) {
+	methodName, ok := apiHooks[strings.TrimPrefix(r.URL.Path, "/hooks/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Hooks must be called with POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, apiHookMaxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var params json.RawMessage
+	if len(strings.TrimSpace(string(body))) > 0 {
+		params = body
+	}
+
+	result, err := controlSocketMethods[methodName](as, params)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if _, ok := err.(controlSocketError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	}
+
+	apiLog.Infof("Webhook %v was called by %v", r.URL.Path, r.RemoteAddr)
+	apiServerWriteJSON(w, struct {
+		Result interface{} `json:"result"`
+	}{result})
+}
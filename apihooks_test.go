@@ -0,0 +1,116 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_apiServerHooks(t *testing.T) {
+	registerAPIServerTestGame()
+	defer delete(connectionTypes, "apitest")
+
+	defer setPathSettings(getPaths())
+	paths := getPaths()
+	paths.Exports, paths.Recordings = t.TempDir(), t.TempDir()
+	setPathSettings(paths)
+
+	as := newAPIServer()
+	defer as.Close()
+	server := httptest.NewServer(as.handler())
+	defer server.Close()
+
+	call := func(hook, body string) (int, map[string]interface{}) {
+		resp, err := http.Post(server.URL+"/hooks/"+hook, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Can't call hook %v: %v", hook, err)
+		}
+		defer resp.Body.Close()
+		result := map[string]interface{}{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	if status, _ := call("start-recording", `{"game": "apitest", "rects": ["0,0,64,64"]}`); status != http.StatusOK {
+		t.Errorf("Starting recording returned status %v", status)
+	}
+	if status := as.getStatus(); len(status) != 1 || !status[0].Recording {
+		t.Errorf("Game isn't recorded after calling the hook")
+	}
+	if status, _ := call("stop-recording", `{"game": "apitest"}`); status != http.StatusOK {
+		t.Errorf("Stopping recording returned status %v", status)
+	}
+	if status, result := call("stop-recording", `{"game": "apitest"}`); status != http.StatusInternalServerError || result["error"] == nil {
+		t.Errorf("Stopping recording twice returned status %v and %v", status, result)
+	}
+	if status, _ := call("start-recording", `{"game": "apitest", "rects": ["invalid"]}`); status != http.StatusBadRequest {
+		t.Errorf("Invalid params returned status %v, want %v", status, http.StatusBadRequest)
+	}
+	if status, _ := call("unknown", ``); status != http.StatusNotFound {
+		t.Errorf("Unknown hook returned status %v, want %v", status, http.StatusNotFound)
+	}
+
+	resp, err := http.Get(server.URL + "/hooks/status")
+	if err != nil {
+		t.Fatalf("Can't call hook: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned status %v, want %v", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	// Nothing outside of the exports directory can be written, and only known games can be exported
+	for _, body := range []string{
+		`{"kind": "events", "game": "apitest", "rect": "0,0,8,8", "fileName": "../escape.csv"}`,
+		`{"kind": "events", "game": "apitest", "rect": "0,0,8,8", "fileName": "sub/../../escape.csv"}`,
+		`{"kind": "events", "game": "apitest", "rect": "0,0,8,8", "fileName": "` + filepath.ToSlash(filepath.Join(t.TempDir(), "escape.csv")) + `"}`,
+		`{"kind": "events", "game": "../apitest", "rect": "0,0,8,8", "fileName": "escape.csv"}`,
+		`{"kind": "events", "game": "Test-HooksUnknown", "rect": "0,0,8,8", "fileName": "escape.csv"}`,
+	} {
+		if status, _ := call("export", body); status != http.StatusBadRequest {
+			t.Errorf("Export with %v returned status %v, want %v", body, status, http.StatusBadRequest)
+		}
+	}
+
+	// The recording from above is exported into the exports directory
+	status, result := call("export", `{"kind": "events", "game": "apitest", "rect": "0,0,8,8", "fileName": "events/apitest.csv"}`)
+	if status != http.StatusOK {
+		t.Fatalf("Queuing export returned status %v and %v", status, result)
+	}
+	id := int(result["result"].(map[string]interface{})["id"].(float64))
+	for i := 0; i < 100; i++ {
+		_, result = call("export-status", fmt.Sprintf(`{"id": %d}`, id))
+		if state := result["result"].(map[string]interface{})["state"]; state == string(exportJobFinished) || state == string(exportJobFailed) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := result["result"].(map[string]interface{})["state"]; state != string(exportJobFinished) {
+		t.Errorf("Export is %v, want %v", state, exportJobFinished)
+	}
+	if _, err := os.Stat(filepath.Join(paths.Exports, "events", "apitest.csv")); err != nil {
+		t.Errorf("Export isn't in the exports directory: %v", err)
+	}
+}
@@ -0,0 +1,801 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var apiLog = moduleLog("api")
+
+// Settings of the API server, stored in the configuration at .api
+type apiServerSettings struct {
+	Address string // The API is served on this address, e.g. ":8081". The server is disabled if this is empty
+
+	Tokens []apiServerToken // Accepted API tokens. Without tokens, only local clients are accepted
+}
+
+const (
+	apiServerMaxImagePixels = 4096 * 4096     // Maximum size of requested image rectangles
+	apiServerMaxPatternSize = 1 << 20         // Maximum size of pattern images in bytes
+	apiServerRectTimeout    = 1 * time.Minute // Requested rectangles are kept up to date for this long
+	apiServerValidTimeout   = 10 * time.Second
+)
+
+// Embedded HTTP server that lets scripts and dashboards query the canvases of a running instance.
+//
+// Endpoints:
+//
+//	/api/games                                 List of available games
+//	/api/canvas/<game>/info                    Chunk layout and online players as JSON
+//	/api/canvas/<game>/image?rect=x1,y1,x2,y2  PNG image of a canvas rectangle
+//	/api/canvas/<game>/pixel?x=&y=             Color of a single pixel as JSON
+//	/api/canvas/<game>/search?rect=&tolerance= Occurrences of the POSTed pattern image as JSON, see searchTemplate
+//	/api/canvas/<game>/events?format=          WebSocket stream of canvas events, see apiServerEvents
+//	/api/recordings                            List of recordings of all games as JSON
+//	/api/recordings/<game>                     List of recordings of a single game as JSON
+//	/api/recordings/<game>/<file>.pixrec       Recording file, with support for range requests
+//	/api/sync/<game>/...                       Chunk checksums and clips for other instances, see canvasSyncFromPeer
+//	/hooks/<name>                              Webhooks that trigger actions, see apiHooks
+//
+// Clients need the permission to read, webhooks the permission to control, see apiAuth.
+// Games are connected to when they are first requested, and stay connected until the server is closed.
+// Recording and playback can be controlled with the methods in apicontrol.go.
+type apiServer struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	gamesMutex  sync.Mutex
+	games       map[string]*apiServerGame
+	gamesClosed bool // Set once the shutdown closes the games, no games are opened afterwards
+
+	authMutex sync.RWMutex
+	auth      *apiAuth
+
+	settingsChan chan apiServerSettings
+	quitChan     chan struct{}
+	waitGroup    sync.WaitGroup
+}
+
+// A game connection opened by the API server.
+// It's subscribed as listener, so the canvas downloads all recently requested rectangles.
+type apiServerGame struct {
+	Connection connection
+	Canvas     *canvas
+	Recorder   canvasRecorder // Only set while the game is recorded
+	Latency    *latencyProbe  // Only set once a placement was announced
+
+	rectsMutex sync.Mutex
+	rects      map[image.Rectangle]time.Time // Recently requested rectangles, and when they were requested last
+}
+
+func newAPIServer() *apiServer {
+	as := &apiServer{
+		games:        map[string]*apiServerGame{},
+		auth:         newAPIAuth(nil),
+		settingsChan: make(chan apiServerSettings),
+		quitChan:     make(chan struct{}),
+	}
+
+	as.waitGroup.Add(1)
+	go func() {
+		defer as.waitGroup.Done()
+
+		var server *http.Server
+		stop := func() {
+			if server != nil {
+				server.Close()
+				server = nil
+			}
+		}
+		defer stop()
+
+		for {
+			select {
+			case settings := <-as.settingsChan:
+				stop()
+				as.authMutex.Lock()
+				as.auth = newAPIAuth(settings.Tokens)
+				as.authMutex.Unlock()
+				var err error
+				if settings.Address != "" {
+					if server, err = as.serve(settings.Address); err != nil {
+						apiLog.Errorf("Can't start API server: %v", err)
+					}
+				}
+			case <-as.quitChan:
+				return
+			}
+		}
+	}()
+
+	return as
+}
+
+// Changes the settings of the API server, the server is restarted if needed
+func (as *apiServer) setSettings(settings apiServerSettings) error {
+	as.ClosedMutex.RLock()
+	defer as.ClosedMutex.RUnlock()
+	if as.Closed {
+		return fmt.Errorf("API server is closed")
+	}
+
+	as.settingsChan <- settings
+
+	return nil
+}
+
+// Returns the HTTP handler of all API endpoints
+func (as *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/games", as.authorize(apiPermissionRead, as.serveGames))
+	mux.HandleFunc("/api/dashboard", as.authorize(apiPermissionRead, as.serveDashboard))
+	mux.HandleFunc("/api/canvas/", as.authorize(apiPermissionRead, as.serveCanvas))
+	mux.HandleFunc("/api/recordings", as.authorize(apiPermissionRead, as.serveRecordings))
+	mux.HandleFunc("/api/recordings/", as.authorize(apiPermissionRead, as.serveGameRecordings))
+	mux.HandleFunc("/api/sync/", as.authorize(apiPermissionRead, as.serveSync))
+	mux.HandleFunc("/api/statistics/", as.authorize(apiPermissionRead, as.serveStatistics))
+	mux.HandleFunc("/api/heatmap/", as.authorize(apiPermissionRead, as.serveHeatmap))
+	mux.HandleFunc("/api/pixelindex/", as.authorize(apiPermissionRead, as.serveIndexedPixel))
+	mux.HandleFunc("/hooks/", as.authorize(apiPermissionControl, as.serveHook))
+	return mux
+}
+
+// Starts a HTTP server on addr, that serves the API
+func (as *apiServer) serve(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: as.handler()}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			apiLog.Errorf("API server failed: %v", err)
+		}
+	}()
+
+	return server, nil
+}
+
+// Returns the connection of the given game, it's created if it doesn't exist yet
+func (as *apiServer) getGame(shortName string) (*apiServerGame, error) {
+	as.gamesMutex.Lock()
+	defer as.gamesMutex.Unlock()
+
+	if game, ok := as.games[shortName]; ok {
+		return game, nil
+	}
+	if as.gamesClosed {
+		return nil, fmt.Errorf("Can't open %q, the games are closed", shortName)
+	}
+
+	connectionType, ok := connectionTypes[shortName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown game %q", shortName)
+	}
+
+	con, can := connectionType.FunctionNew()
+	game := &apiServerGame{
+		Connection: con,
+		Canvas:     can,
+		rects:      map[image.Rectangle]time.Time{},
+	}
+	if err := can.subscribeListener(game, false); err != nil {
+		con.Close()
+		return nil, err
+	}
+	as.games[shortName] = game
+
+	return game, nil
+}
+
+// Registers the rectangle at the canvas, and waits until it's valid or the timeout is reached.
+// Returns false if the rectangle didn't become valid in time.
+func (game *apiServerGame) request(rect image.Rectangle, cancel <-chan struct{}) bool {
+	if err := game.register(rect); err != nil {
+		return false
+	}
+
+	return game.Canvas.waitValid(rect, apiServerValidTimeout, cancel)
+}
+
+// Registers the rectangle at the canvas, so it's downloaded and kept up to date for apiServerRectTimeout
+func (game *apiServerGame) register(rect image.Rectangle) error {
+	game.rectsMutex.Lock()
+	now := time.Now()
+	game.rects[rect] = now
+	rects := []image.Rectangle{}
+	for r, t := range game.rects {
+		if now.Sub(t) > apiServerRectTimeout {
+			delete(game.rects, r)
+			continue
+		}
+		rects = append(rects, r)
+	}
+	game.rectsMutex.Unlock()
+
+	return game.Canvas.registerRects(game, rects)
+}
+
+func (as *apiServer) serveGames(w http.ResponseWriter, r *http.Request) {
+	apiServerWriteJSON(w, apiListGames())
+}
+
+// Serves the state of all open connections and recordings at /api/dashboard
+func (as *apiServer) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	apiServerWriteJSON(w, getDashboard())
+}
+
+// Serves /api/canvas/<game>/info, /api/canvas/<game>/image, /api/canvas/<game>/pixel, /api/canvas/<game>/history, /api/canvas/<game>/search, /api/canvas/<game>/failures, /api/canvas/<game>/stats, /api/canvas/<game>/latency and /api/canvas/<game>/events
+func (as *apiServer) serveCanvas(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/canvas/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	shortName, endpoint := parts[0], parts[1]
+	if endpoint != "info" && endpoint != "image" && endpoint != "pixel" && endpoint != "history" && endpoint != "search" && endpoint != "failures" && endpoint != "stats" && endpoint != "latency" && endpoint != "events" {
+		http.NotFound(w, r)
+		return
+	}
+
+	game, err := as.getGame(shortName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch endpoint {
+	case "info":
+		apiServerWriteJSON(w, apiCanvasInfo{
+			ChunkSize:     game.Canvas.ChunkSize,
+			Origin:        game.Canvas.Origin,
+			Rect:          game.Canvas.Rect,
+			OnlinePlayers: game.Connection.getOnlinePlayers(),
+		})
+	case "image":
+		as.serveImage(w, r, shortName)
+	case "pixel":
+		as.servePixel(w, r, shortName)
+	case "history":
+		as.servePixelHistory(w, r, shortName)
+	case "search":
+		as.serveSearch(w, r, shortName)
+	case "failures":
+		apiServerWriteJSON(w, game.Canvas.getDownloadFailures())
+	case "stats":
+		apiServerWriteJSON(w, game.Canvas.stats())
+	case "latency":
+		report, err := as.getLatency(shortName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		apiServerWriteJSON(w, report)
+	case "events":
+		as.serveEvents(w, r, game)
+	}
+}
+
+// Serves the pixels per minute of the regions of a game at /api/statistics/<game>.
+// The optional parameter since limits the series to the time after it, in RFC 3339 format.
+func (as *apiServer) serveStatistics(w http.ResponseWriter, r *http.Request) {
+	shortName := strings.TrimPrefix(r.URL.Path, "/api/statistics/")
+	if shortName == "" || strings.Contains(shortName, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	since := time.Time{}
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid time %q: %v", s, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	series, err := as.getStatistics(shortName, since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	apiServerWriteJSON(w, series)
+}
+
+// Serves the live heatmap of a game at /api/heatmap/<game>, see canvasHeatmap.
+// The parameter rect selects the area, window the duration before now like "1h".
+// It's a PNG with the color ramp of the parameter ramp, or the counts as JSON with format=json. Only JSON allows to leave out rect.
+func (as *apiServer) serveHeatmap(w http.ResponseWriter, r *http.Request) {
+	shortName := strings.TrimPrefix(r.URL.Path, "/api/heatmap/")
+	if shortName == "" || strings.Contains(shortName, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	var window time.Duration
+	if s := query.Get("window"); s != "" {
+		var err error
+		if window, err = time.ParseDuration(s); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid window %q: %v", s, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var rect image.Rectangle
+	if s := query.Get("rect"); s != "" || query.Get("format") != "json" {
+		var err error
+		if rect, err = parseRectangle(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if query.Get("format") == "json" {
+		entries, err := as.getHeatmap(shortName, rect, window)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		apiServerWriteJSON(w, entries)
+		return
+	}
+
+	img, err := as.getHeatmapImage(shortName, rect, window, query.Get("ramp"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	png.Encode(w, &image.NRGBA{Pix: img.Pix, Stride: img.Stride, Rect: img.Rect.Sub(img.Rect.Min)})
+}
+
+// Serves the color and changes of a single pixel from the pixel index, see pixelIndex.query
+func (as *apiServer) serveIndexedPixel(w http.ResponseWriter, r *http.Request) {
+	shortName := strings.TrimPrefix(r.URL.Path, "/api/pixelindex/")
+	if shortName == "" || strings.Contains(shortName, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	x, errX := strconv.Atoi(query.Get("x"))
+	y, errY := strconv.Atoi(query.Get("y"))
+	if errX != nil || errY != nil {
+		http.Error(w, "Parameters x and y must be integers", http.StatusBadRequest)
+		return
+	}
+	t := time.Time{}
+	if s := query.Get("time"); s != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid time %q: %v", s, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	pi, err := openPixelIndex(shortName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	result, err := pi.query(image.Point{x, y}, t, query.Get("history") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	apiServerWriteJSON(w, result)
+}
+
+// Layout of a canvas, as it is served at /api/canvas/<game>/info
+type apiCanvasInfo struct {
+	ChunkSize     pixelSize
+	Origin        image.Point
+	Rect          image.Rectangle
+	OnlinePlayers int
+}
+
+func (as *apiServer) serveImage(w http.ResponseWriter, r *http.Request, shortName string) {
+	rect, err := parseRectangle(r.URL.Query().Get("rect"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, valid, err := as.getImage(shortName, rect, r.Context().Done())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Canvas-Valid", strconv.FormatBool(valid))
+	png.Encode(w, &image.RGBA{Pix: img.Pix, Stride: img.Stride, Rect: img.Rect.Sub(img.Rect.Min)})
+}
+
+func (as *apiServer) servePixel(w http.ResponseWriter, r *http.Request, shortName string) {
+	query := r.URL.Query()
+	x, errX := strconv.Atoi(query.Get("x"))
+	y, errY := strconv.Atoi(query.Get("y"))
+	if errX != nil || errY != nil {
+		http.Error(w, "Parameters x and y must be integers", http.StatusBadRequest)
+		return
+	}
+
+	col, valid, err := as.getPixel(shortName, image.Point{x, y}, r.Context().Done())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pixel := struct {
+		X         int    `json:"x"`
+		Y         int    `json:"y"`
+		Color     string `json:"color,omitempty"`     // Hex color like #RRGGBB, empty if there is no data
+		ColorName string `json:"colorName,omitempty"` // Name of the color, see paletteNames
+		Index     *int   `json:"index,omitempty"`     // Index of the color in the palette of the game, if it's known
+		Valid     bool   `json:"valid"`
+	}{X: x, Y: y, Valid: valid}
+	if col != nil {
+		pixel.Color = fmt.Sprintf("#%02X%02X%02X", col.R, col.G, col.B)
+		pixel.ColorName = getPaletteNames(conf, shortName).name(col)
+		if game, err := as.getGame(shortName); err == nil {
+			if index := game.Canvas.Palette.getIndex(col); index >= 0 {
+				pixel.Index = &index
+			}
+		}
+	}
+
+	apiServerWriteJSON(w, pixel)
+}
+
+// Serves the last changes of a single pixel, the newest first
+func (as *apiServer) servePixelHistory(w http.ResponseWriter, r *http.Request, shortName string) {
+	query := r.URL.Query()
+	x, errX := strconv.Atoi(query.Get("x"))
+	y, errY := strconv.Atoi(query.Get("y"))
+	if errX != nil || errY != nil {
+		http.Error(w, "Parameters x and y must be integers", http.StatusBadRequest)
+		return
+	}
+
+	changes, err := as.getPixelHistory(shortName, image.Point{x, y})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	apiServerWriteJSON(w, changes)
+}
+
+// Searches the canvas for the pattern image in the body of a POST request.
+// Without rect, all loaded chunks are searched.
+func (as *apiServer) serveSearch(w http.ResponseWriter, r *http.Request, shortName string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "The pattern must be sent as POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	rect := image.Rectangle{}
+	if s := query.Get("rect"); s != "" {
+		var err error
+		if rect, err = parseRectangle(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	tolerance, maxMatches := 0.0, 0
+	if s := query.Get("tolerance"); s != "" {
+		var err error
+		if tolerance, err = strconv.ParseFloat(s, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid tolerance %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("max"); s != "" {
+		var err error
+		if maxMatches, err = strconv.Atoi(s); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid maximum number of matches %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, apiServerMaxPatternSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Can't read pattern: %v", err), http.StatusBadRequest)
+		return
+	}
+	pattern, err := templateDecodeImage(data, 0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Can't decode pattern: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	matches, err := as.searchTemplate(shortName, rect, pattern, tolerance, maxMatches, r.Context().Done())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	apiServerWriteJSON(w, matches)
+}
+
+// Lists the recordings of all games, grouped by their directory name
+func (as *apiServer) serveRecordings(w http.ResponseWriter, r *http.Request) {
+	type recording struct {
+		FileName  string    `json:"fileName"`
+		StartTime time.Time `json:"startTime"`
+		EndTime   time.Time `json:"endTime"`
+	}
+
+	result := map[string][]recording{}
+	for shortName, recs := range apiListRecordings() {
+		list := []recording{}
+		for _, rec := range recs {
+			list = append(list, recording{filepath.Base(rec.FileName), rec.StartTime, rec.EndTime})
+		}
+		result[shortName] = list
+	}
+
+	apiServerWriteJSON(w, result)
+}
+
+// Lists the recordings of a single game, or serves a recording file.
+// Other instances use this to play back recordings remotely, see canvasDiskReaderFor.
+func (as *apiServer) serveGameRecordings(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/recordings/"), "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, `\:`) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	switch len(parts) {
+	case 1:
+		cdr := canvasDiskReaderFor(parts[0])
+		recs, err := cdr.refreshRecordings()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		type recording struct {
+			FileName  string    `json:"fileName"`
+			StartTime time.Time `json:"startTime"`
+			EndTime   time.Time `json:"endTime"`
+		}
+		list := []recording{}
+		for _, rec := range recs {
+			list = append(list, recording{filepath.Base(rec.FileName), rec.StartTime, rec.EndTime})
+		}
+		apiServerWriteJSON(w, list)
+
+	case 2:
+		if filepath.Ext(parts[1]) != ".pixrec" {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(dataPath(getPaths().Recordings, parts[0], parts[1]))
+		if os.IsNotExist(err) && getRecordingObjectStorage() != nil {
+			// The recording may have been moved to the object storage, pass it through without range support
+			as.serveStoredRecording(w, r, parts[0], parts[1])
+			return
+		}
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The file may still be written to, so the size is only a snapshot
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, parts[1], stat.ModTime(), io.NewSectionReader(f, 0, stat.Size()))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Passes through a recording from the object storage
+func (as *apiServer) serveStoredRecording(w http.ResponseWriter, r *http.Request, shortName, fileName string) {
+	names, err := recordingStorageLocal{}.listRecordings(shortName)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	for _, name := range names {
+		if path.Base(filepath.ToSlash(name)) != fileName {
+			continue
+		}
+		f, err := openRecordingFile(name, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if _, err := io.Copy(w, f); err != nil {
+			apiLog.Warnf("Can't pass through recording %v: %v", name, err)
+		}
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+func apiServerWriteJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		apiLog.Warnf("Can't write API response: %v", err)
+	}
+}
+
+// Parses a rectangle in the form "x1,y1,x2,y2", with x2 and y2 being exclusive
+func parseRectangle(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("Rectangle %q must be in the form x1,y1,x2,y2", s)
+	}
+	values := [4]int{}
+	for i, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return image.Rectangle{}, fmt.Errorf("Rectangle %q contains invalid number %q", s, part)
+		}
+		values[i] = value
+	}
+	return image.Rect(values[0], values[1], values[2], values[3]), nil
+}
+
+// Formats a rectangle in the form "x1,y1,x2,y2", see parseRectangle
+func formatRectangle(rect image.Rectangle) string {
+	return fmt.Sprintf("%d,%d,%d,%d", rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y)
+}
+
+func (game *apiServerGame) handleInvalidateAll() error {
+	return nil
+}
+
+func (game *apiServerGame) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (game *apiServerGame) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (game *apiServerGame) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+
+func (game *apiServerGame) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	return nil
+}
+
+func (game *apiServerGame) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (game *apiServerGame) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (game *apiServerGame) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Close stops the server, and closes all game connections opened by it
+func (as *apiServer) Close() {
+	as.ClosedMutex.Lock()
+	defer as.ClosedMutex.Unlock()
+	if as.Closed {
+		return
+	}
+	as.Closed = true
+
+	close(as.quitChan)
+	as.waitGroup.Wait()
+
+	as.gamesMutex.Lock()
+	defer as.gamesMutex.Unlock()
+	for shortName, game := range as.games {
+		game.close()
+		delete(as.games, shortName)
+	}
+}
+
+// Closes one stage of all games, see shutdownCoordinator.
+// Afterwards, no games are opened anymore.
+func (as *apiServer) closeGames(stage shutdownStage) {
+	as.gamesMutex.Lock()
+	defer as.gamesMutex.Unlock()
+
+	as.gamesClosed = true
+	for shortName, game := range as.games {
+		game.closeStage(stage)
+		if stage == shutdownCanvases {
+			game.Canvas.Close() // Usually closed by its connection already
+			delete(as.games, shortName)
+		}
+	}
+}
+
+// Returns the functions that close the games and the server in the stages of the shutdown
+func (as *apiServer) shutdownStages() map[shutdownStage]func() {
+	return map[shutdownStage]func(){
+		shutdownConnections: func() { as.closeGames(shutdownConnections) },
+		shutdownRecorders:   func() { as.closeGames(shutdownRecorders) },
+		shutdownCanvases:    func() { as.closeGames(shutdownCanvases) },
+		shutdownServers:     as.Close,
+	}
+}
+
+// Closes the connection of the game, and stops recording afterwards, so the recorder gets all events
+func (game *apiServerGame) close() {
+	for stage := shutdownStage(0); stage < shutdownServers; stage++ {
+		game.closeStage(stage)
+	}
+}
+
+func (game *apiServerGame) closeStage(stage shutdownStage) {
+	switch stage {
+	case shutdownConnections:
+		game.Connection.Close()
+	case shutdownRecorders:
+		if game.Recorder != nil {
+			game.Recorder.Close()
+			game.Recorder = nil
+		}
+	case shutdownCanvases:
+		if game.Latency != nil {
+			game.Latency.Close()
+		}
+		game.Canvas.unsubscribeListener(game)
+	}
+}
@@ -0,0 +1,122 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type apiServerTestConnection struct {
+	Canvas *canvas
+}
+
+func (con *apiServerTestConnection) getShortName() string  { return "apitest" }
+func (con *apiServerTestConnection) getName() string       { return "API test" }
+func (con *apiServerTestConnection) getOnlinePlayers() int { return 0 }
+func (con *apiServerTestConnection) Close()                { con.Canvas.Close() }
+
+// Registers the game "apitest", with a single chunk at 0,0 that contains one pixel at 3,4
+func registerAPIServerTestGame() {
+	connectionTypes["apitest"] = connectionType{
+		Name: "API test",
+		FunctionNew: func() (connection, *canvas) {
+			can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+			rect := image.Rect(0, 0, 64, 64)
+			img := image.NewPaletted(rect, pixelcanvasioPalette)
+			img.SetColorIndex(3, 4, 5)
+			can.signalDownload(rect)
+			can.setImage(img, false, false)
+			return &apiServerTestConnection{Canvas: can}, can
+		},
+	}
+}
+
+func Test_apiServer(t *testing.T) {
+	registerAPIServerTestGame()
+	defer delete(connectionTypes, "apitest")
+
+	as := newAPIServer()
+	defer as.Close()
+
+	server := httptest.NewServer(as.handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/canvas/apitest/image?rect=2,2,10,12")
+	if err != nil {
+		t.Fatalf("Can't request image: %v", err)
+	}
+	img, err := png.Decode(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Can't decode image: %v", err)
+	}
+	if want := image.Rect(0, 0, 8, 10); img.Bounds() != want {
+		t.Errorf("Image has bounds %v, want %v", img.Bounds(), want)
+	}
+	if resp.Header.Get("X-Canvas-Valid") != "true" {
+		t.Errorf("Image is marked as invalid")
+	}
+
+	resp, err = http.Get(server.URL + "/api/canvas/apitest/pixel?x=3&y=4")
+	if err != nil {
+		t.Fatalf("Can't request pixel: %v", err)
+	}
+	pixel := struct {
+		Color string
+		Valid bool
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&pixel)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Can't decode pixel: %v", err)
+	}
+	if want := "#E50000"; pixel.Color != want || !pixel.Valid {
+		t.Errorf("Got pixel %+v, want color %v", pixel, want)
+	}
+
+	for _, path := range []string{"/api/canvas/unknown/image?rect=0,0,1,1", "/api/canvas/apitest/image?rect=0,0", "/api/canvas/apitest/pixel?x=a"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Can't request %v: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("Request of %v succeeded, but it should fail", path)
+		}
+	}
+}
+
+func Test_parseRectangle(t *testing.T) {
+	rect, err := parseRectangle("-10, 20,30,40")
+	if err != nil {
+		t.Fatalf("Can't parse rectangle: %v", err)
+	}
+	if want := image.Rect(-10, 20, 30, 40); rect != want {
+		t.Errorf("Got %v, want %v", rect, want)
+	}
+
+	for _, s := range []string{"", "1,2,3", "1,2,3,x"} {
+		if _, err := parseRectangle(s); err == nil {
+			t.Errorf("Parsing %q succeeded, but it should fail", s)
+		}
+	}
+}
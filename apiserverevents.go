@@ -0,0 +1,300 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Maximum number of queued messages per WebSocket client.
+// Clients that can't keep up are disconnected, so they don't stall the canvas.
+const apiServerEventsQueueSize = 1000
+
+var apiServerUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true }, // Allow web viewers from any origin, the API is read only
+}
+
+// A WebSocket client subscribed to the events of a canvas.
+//
+// The canvas manages virtual chunks for the client, the same way as for the canvas window.
+// Events are sent as JSON text frames, with the same fields as the events of the canvas window.
+// The client sends {"Type": "RegisterRects", "Rects": [...]} to choose the areas it wants to receive.
+//
+// With the binary format, the BGRA data of SetImage events is sent as binary frame that directly follows the JSON frame.
+// Otherwise it is embedded as base64 encoded "Array" field.
+type apiServerEvents struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas *canvas
+	Binary bool
+
+	conn     *websocket.Conn
+	sendChan chan interface{} // Queue of messages, either map[string]interface{} or []byte for binary frames
+}
+
+// Serves /api/canvas/<game>/events?format=json|binary
+func (as *apiServer) serveEvents(w http.ResponseWriter, r *http.Request, game *apiServerGame) {
+	binaryFormat := false
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+	case "binary":
+		binaryFormat = true
+	default:
+		http.Error(w, fmt.Sprintf("Unknown format %q", r.URL.Query().Get("format")), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := apiServerUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade already responded with an error
+	}
+	defer conn.Close()
+
+	ase := &apiServerEvents{
+		Canvas:   game.Canvas,
+		Binary:   binaryFormat,
+		conn:     conn,
+		sendChan: make(chan interface{}, memoryQueueSize(apiServerEventsQueueSize)),
+	}
+
+	if err := game.Canvas.subscribeListener(ase, true); err != nil {
+		apiLog.Errorf("Can't subscribe to canvas: %v", err)
+		return
+	}
+	defer ase.Close()
+	defer game.Canvas.Palette.subscribe(ase.handlePaletteChange)()
+
+	// Write messages until the queue is closed, or the API server stops
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		var err error
+		for {
+			select {
+			case msg, ok := <-ase.sendChan:
+				if !ok {
+					return
+				}
+				switch msg := msg.(type) {
+				case []byte:
+					err = conn.WriteMessage(websocket.BinaryMessage, msg)
+				default:
+					err = conn.WriteJSON(msg)
+				}
+				if err != nil {
+					conn.Close() // Stops the reading loop below
+					return
+				}
+			case <-as.quitChan:
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	// Read rectangle registrations until the connection is closed
+	for {
+		request := struct {
+			Type  string
+			Rects []image.Rectangle
+		}{}
+		if err := conn.ReadJSON(&request); err != nil {
+			break
+		}
+		switch request.Type {
+		case "RegisterRects":
+			for _, rect := range request.Rects {
+				if rect.Dx()*rect.Dy() > apiServerMaxImagePixels {
+					ase.send(map[string]interface{}{"Type": "Error", "Error": fmt.Sprintf("Rectangle %v is too large", rect)})
+					request.Rects = nil
+					break
+				}
+			}
+			if request.Rects != nil {
+				game.Canvas.registerRects(ase, request.Rects)
+			}
+		default:
+			ase.send(map[string]interface{}{"Type": "Error", "Error": fmt.Sprintf("Unknown request type %q", request.Type)})
+		}
+	}
+
+	ase.Close()
+	<-writerDone
+}
+
+// Queues a message without blocking. If the queue is full, the client is disconnected
+func (ase *apiServerEvents) send(msgs ...interface{}) error {
+	ase.ClosedMutex.RLock()
+	defer ase.ClosedMutex.RUnlock()
+	if ase.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	for _, msg := range msgs {
+		select {
+		case ase.sendChan <- msg:
+		default:
+			ase.conn.Close() // Reading loop will clean up
+			return fmt.Errorf("Event queue of WebSocket client is full")
+		}
+	}
+
+	return nil
+}
+
+func (ase *apiServerEvents) sendRect(eventType string, rect image.Rectangle, vcIDs []int) error {
+	return ase.send(map[string]interface{}{
+		"Type":   eventType,
+		"X":      rect.Min.X,
+		"Y":      rect.Min.Y,
+		"Width":  rect.Dx(),
+		"Height": rect.Dy(),
+		"VcIDs":  vcIDs,
+	})
+}
+
+func (ase *apiServerEvents) handleInvalidateAll() error {
+	return ase.send(map[string]interface{}{"Type": "InvalidateAll"})
+}
+
+func (ase *apiServerEvents) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return ase.sendRect("InvalidateRect", rect, vcIDs)
+}
+
+func (ase *apiServerEvents) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return ase.sendRect("RevalidateRect", rect, vcIDs)
+}
+
+func (ase *apiServerEvents) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	imageArray := imageToBGRAArray(img)
+	headerArray := [12]byte{'B', 'G', 'R', 'A'}
+	binary.BigEndian.PutUint32(headerArray[4:8], uint32(img.Bounds().Dx()))
+	binary.BigEndian.PutUint32(headerArray[8:12], uint32(img.Bounds().Dy()))
+	array := append(headerArray[:], imageArray...)
+	putBuffer(imageArray)
+
+	msg := map[string]interface{}{
+		"Type":   "SetImage",
+		"X":      img.Bounds().Min.X,
+		"Y":      img.Bounds().Min.Y,
+		"Width":  img.Bounds().Dx(),
+		"Height": img.Bounds().Dy(),
+		"Valid":  valid,
+		"VcIDs":  vcIDs,
+	}
+
+	if ase.Binary {
+		return ase.send(msg, array)
+	}
+	msg["Array"] = array
+	return ase.send(msg)
+}
+
+func (ase *apiServerEvents) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	return ase.handleSetPixelIndex(pos, color, -1, vcID)
+}
+
+// Pixels have the index of their color in the palette of the game, if it's known
+func (ase *apiServerEvents) handleSetPixelIndex(pos image.Point, color color.Color, index int, vcID int) error {
+	r, g, b, a := color.RGBA()
+
+	msg := map[string]interface{}{
+		"Type": "SetPixel",
+		"X":    pos.X,
+		"Y":    pos.Y,
+		"R":    r >> 8,
+		"G":    g >> 8,
+		"B":    b >> 8,
+		"A":    a >> 8,
+		"VcID": vcID,
+	}
+	if index >= 0 {
+		msg["Index"] = index
+	}
+	return ase.send(msg)
+}
+
+func (ase *apiServerEvents) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return ase.sendRect("SignalDownload", rect, vcIDs)
+}
+
+func (ase *apiServerEvents) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	type chunk struct {
+		Rect image.Rectangle
+		VcID int
+	}
+
+	createIDs := []chunk{}
+	for rect, id := range create {
+		createIDs = append(createIDs, chunk{rect, id})
+	}
+
+	removeIDs := []int{}
+	for _, id := range remove {
+		removeIDs = append(removeIDs, id)
+	}
+
+	return ase.send(map[string]interface{}{
+		"Type":   "ChunksChange",
+		"Create": createIDs,
+		"Remove": removeIDs,
+	})
+}
+
+func (ase *apiServerEvents) handleSetTime(t time.Time) error {
+	return ase.send(map[string]interface{}{
+		"Type": "SetTime",
+		"Time": t,
+	})
+}
+
+// Close unsubscribes from the canvas, and stops the writing goroutine after all queued messages are sent
+// Sends {"Type": "PaletteChange", "Added": [...], "Palette": [...]}, with colors in hex notation
+func (ase *apiServerEvents) handlePaletteChange(change canvasPaletteChange) {
+	added, palette := []string{}, []string{}
+	for _, c := range change.Added {
+		added = append(added, paletteHex(c))
+	}
+	for _, c := range change.Palette {
+		palette = append(palette, paletteHex(color.RGBAModel.Convert(c).(color.RGBA)))
+	}
+
+	ase.send(map[string]interface{}{"Type": "PaletteChange", "Added": added, "Palette": palette})
+}
+
+func (ase *apiServerEvents) Close() {
+	ase.ClosedMutex.Lock()
+	if ase.Closed {
+		ase.ClosedMutex.Unlock()
+		return
+	}
+	ase.Closed = true
+	ase.ClosedMutex.Unlock()
+
+	// Unsubscribe without holding the lock, as the canvas may wait for a handler that wants to read the closed state
+	ase.Canvas.unsubscribeListener(ase)
+	close(ase.sendChan)
+}
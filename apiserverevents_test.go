@@ -0,0 +1,90 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func Test_apiServerEvents(t *testing.T) {
+	registerAPIServerTestGame()
+	defer delete(connectionTypes, "apitest")
+
+	as := newAPIServer()
+	defer as.Close()
+
+	server := httptest.NewServer(as.handler())
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/canvas/apitest/events?format=binary"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Can't connect to %v: %v", url, err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	request := map[string]interface{}{"Type": "RegisterRects", "Rects": []image.Rectangle{image.Rect(0, 0, 10, 10)}}
+	if err := conn.WriteJSON(request); err != nil {
+		t.Fatalf("Can't register rectangles: %v", err)
+	}
+
+	// Wait for the image of the registered chunk, the chunk must be created before
+	created := false
+	for {
+		event := struct {
+			Type   string
+			Width  int
+			Height int
+			Create []struct{ VcID int }
+		}{}
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("Can't read event: %v", err)
+		}
+		if event.Type == "ChunksChange" {
+			created = len(event.Create) == 1
+		}
+		if event.Type != "SetImage" {
+			continue
+		}
+		if !created {
+			t.Fatalf("Got image before the chunk was created")
+		}
+
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Can't read image data: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("Image data has message type %v, want binary", messageType)
+		}
+		if want := 12 + event.Width*event.Height*4; len(data) != want || string(data[:4]) != "BGRA" {
+			t.Fatalf("Image data has length %v, want %v", len(data), want)
+		}
+		if width := binary.BigEndian.Uint32(data[4:8]); int(width) != event.Width {
+			t.Errorf("Image data has width %v, want %v", width, event.Width)
+		}
+		break
+	}
+}
@@ -0,0 +1,223 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// Benchmarks of the canvas pipeline, run with "go test -run - -bench . -benchmem"
+
+// Listener that ignores all events
+type testNullListener struct{}
+
+func (l testNullListener) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+func (l testNullListener) handleInvalidateAll() error                                    { return nil }
+func (l testNullListener) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error  { return nil }
+func (l testNullListener) handleSetImage(img image.Image, valid bool, vcIDs []int) error { return nil }
+func (l testNullListener) handleSignalDownload(rect image.Rectangle, vcIDs []int) error  { return nil }
+func (l testNullListener) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error  { return nil }
+func (l testNullListener) handleSetTime(t time.Time) error                               { return nil }
+func (l testNullListener) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	return nil
+}
+
+// Returns a canvas with valid chunks in rect
+func benchmarkCanvas(rect image.Rectangle) *canvas {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+	return can
+}
+
+func Benchmark_canvasSetPixel(b *testing.B) {
+	can := benchmarkCanvas(image.Rect(0, 0, 1024, 1024))
+	defer can.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		can.setPixel(image.Point{i % 1024, (i / 1024) % 1024}, pixelcanvasioPalette[i%len(pixelcanvasioPalette)])
+	}
+}
+
+// Sets the same pixels as Benchmark_canvasSetPixel, in batches of 256
+func Benchmark_canvasSetPixels(b *testing.B) {
+	can := benchmarkCanvas(image.Rect(0, 0, 1024, 1024))
+	defer can.Close()
+
+	pixels := make([]pixelUpdate, 0, 256)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pixels = append(pixels, pixelUpdate{Pos: image.Point{i % 1024, (i / 1024) % 1024}, Color: pixelcanvasioPalette[i%len(pixelcanvasioPalette)]})
+		if len(pixels) == cap(pixels) || i == b.N-1 {
+			can.setPixels(pixels)
+			pixels = pixels[:0]
+		}
+	}
+}
+
+func Benchmark_canvasSetImage(b *testing.B) {
+	can := benchmarkCanvas(image.Rect(0, 0, 64, 64))
+	defer can.Close()
+
+	img := image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		can.invalidateRect(img.Rect)
+		can.signalDownload(img.Rect)
+		if err := can.setImage(img, false, false); err != nil {
+			b.Fatalf("Can't set image: %v", err)
+		}
+	}
+}
+
+// Measures the delivery of pixels to several listeners, until all of them got every event
+func Benchmark_canvasBroadcast(b *testing.B) {
+	for _, listeners := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("%v listeners", listeners), func(b *testing.B) {
+			can := benchmarkCanvas(image.Rect(0, 0, 1024, 1024))
+			defer can.Close()
+
+			ls := []*testNullListener{}
+			for i := 0; i < listeners; i++ {
+				l := &testNullListener{}
+				can.subscribeListener(l, false)
+				ls = append(ls, l)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				can.setPixel(image.Point{i % 1024, (i / 1024) % 1024}, pixelcanvasioPalette[5])
+			}
+			for _, l := range ls {
+				can.unsubscribeListener(l) // Waits until all events are delivered
+			}
+		})
+	}
+}
+
+func Benchmark_canvasSetPixelVirtualChunks(b *testing.B) {
+	rect := image.Rect(0, 0, 1024, 1024)
+	can := benchmarkCanvas(rect)
+	defer can.Close()
+
+	for i := 0; i < 4; i++ {
+		l := &testChunkListener{chunks: map[image.Rectangle]int{}, pixelVCID: map[image.Point]int{}}
+		can.subscribeListener(l, true)
+		can.registerRects(l, []image.Rectangle{rect})
+		defer can.unsubscribeListener(l)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		can.setPixel(image.Point{i % 1024, (i / 1024) % 1024}, pixelcanvasioPalette[5])
+	}
+}
+
+// Measures recording pixels, until they are written to disk
+func Benchmark_canvasDiskWriter(b *testing.B) {
+	can := benchmarkCanvas(image.Rect(0, 0, 1024, 1024))
+	defer can.Close()
+
+	cdw, err := can.newCanvasDiskWriter("Test-Benchmark", 0)
+	if err != nil {
+		b.Fatalf("Can't create canvas disk writer: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(cdw.File.Name()))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		can.setPixel(image.Point{i % 1024, (i / 1024) % 1024}, pixelcanvasioPalette[i%len(pixelcanvasioPalette)])
+	}
+	cdw.Close()
+	b.ReportMetric(float64(cdw.getDroppedEvents()), "dropped")
+}
+
+func Benchmark_canvasDiskDecoder(b *testing.B) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-benchmark-decoder")
+	if err != nil {
+		b.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const events = 2000
+	fileName := testDecoderRecording(b, dir, events)
+
+	// Reads and decodes everything in the calling goroutine
+	b.Run("Sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			f, err := os.Open(fileName)
+			if err != nil {
+				b.Fatalf("Can't open recording: %v", err)
+			}
+			zipReader, err := gzip.NewReader(f)
+			if err != nil {
+				b.Fatalf("Can't decompress recording: %v", err)
+			}
+			canvasDiskReaderParseHeader(zipReader)
+			for {
+				if _, _, err := canvasDiskReaderReadEvent(zipReader); err == io.EOF {
+					break
+				} else if err != nil {
+					b.Fatalf("Can't read event: %v", err)
+				}
+			}
+			zipReader.Close()
+			f.Close()
+		}
+		b.ReportMetric(float64(events*b.N)/b.Elapsed().Seconds(), "events/s")
+	})
+
+	b.Run("Parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			d, err := openCanvasDiskDecoder(fileName, runtime.NumCPU())
+			if err != nil {
+				b.Fatalf("Can't open recording: %v", err)
+			}
+			for {
+				if _, _, err := d.next(); err == io.EOF {
+					break
+				} else if err != nil {
+					b.Fatalf("Can't read event: %v", err)
+				}
+			}
+			d.Close()
+		}
+		b.ReportMetric(float64(events*b.N)/b.Elapsed().Seconds(), "events/s")
+	})
+}
@@ -0,0 +1,63 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"math/bits"
+	"sync"
+)
+
+// Pools of pixel buffers, one for each power of two capacity.
+// Images are copied for every SetImage event, reusing their buffers keeps the garbage collector calm during download bursts.
+var bufferPools [bits.UintSize]sync.Pool
+
+// Returns a buffer of length n, that may contain old data.
+// It can be handed back with putBuffer, once nothing refers to it anymore.
+func getBuffer(n int) []byte {
+	if n <= 0 {
+		return []byte{}
+	}
+	class := bits.Len(uint(n - 1))
+	if buf, ok := bufferPools[class].Get().(*[]byte); ok {
+		return (*buf)[:n]
+	}
+	return make([]byte, n, 1<<class)
+}
+
+// Hands a buffer back to the pool of its capacity, it's reused with its whole capacity.
+// Buffers with a capacity that isn't a power of two are ignored, other buffers are pooled even if they didn't come from getBuffer.
+// The buffer must not be used afterwards.
+func putBuffer(buf []byte) {
+	c := cap(buf)
+	if c == 0 || c&(c-1) != 0 {
+		return
+	}
+	buf = buf[:c]
+	bufferPools[bits.Len(uint(c-1))].Put(&buf)
+}
+
+// Hands the pixel buffer of an image back to the pools.
+// Only for images that are referenced by nobody else, including sub images that share the buffer.
+func releaseImage(img image.Image) {
+	switch img := img.(type) {
+	case *image.RGBA:
+		putBuffer(img.Pix)
+	case *image.Paletted:
+		putBuffer(img.Pix)
+	}
+}
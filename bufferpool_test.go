@@ -0,0 +1,40 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"testing"
+)
+
+func Test_bufferPools(t *testing.T) {
+	for _, n := range []int{0, 1, 3, 4096, 5000} {
+		buf := getBuffer(n)
+		if len(buf) != n {
+			t.Errorf("Buffer has length %v, want %v", len(buf), n)
+		}
+		if c := cap(buf); c < n || c&(c-1) != 0 && n > 0 {
+			t.Errorf("Buffer of length %v has capacity %v, want a power of two", n, c)
+		}
+		putBuffer(buf)
+	}
+
+	// Buffers of other capacities are ignored
+	putBuffer(make([]byte, 5000))
+	if buf := getBuffer(5000); cap(buf) != 8192 {
+		t.Errorf("Got buffer with capacity %v, want 8192", cap(buf))
+	}
+}
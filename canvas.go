@@ -21,10 +21,14 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var canvasLog = moduleLog("canvas")
+
 type canvasEventInvalidateAll struct{}
 
 type canvasEventInvalidateRect struct {
@@ -36,8 +40,15 @@ type canvasEventSetImage struct {
 }
 
 type canvasEventSetPixel struct {
-	Pos   image.Point
-	Color color.Color
+	Pos    image.Point
+	Color  color.Color
+	Index  int    // Index of the color in the known palette of the game, or -1. Only set by the canvas, events of recordings always have -1
+	Author string // Identifier of the user that placed the pixel, empty if the game doesn't report it
+}
+
+// Pixels that were set together with setPixels, in their order
+type canvasEventSetPixels struct {
+	Pixels []canvasEventSetPixel
 }
 
 type canvasEventSignalDownload struct {
@@ -48,13 +59,36 @@ type canvasEventRevalidate struct {
 	Rect image.Rectangle
 }
 
+type canvasEventDownloadFailed struct {
+	Rect     image.Rectangle // Rectangle of a single chunk
+	Failures int             // Failed downloads in a row
+	Reason   string
+}
+
 type canvasEventListenerSubscribe struct {
 	Listener         canvasListener
 	UseVirtualChunks bool
+	Filter           canvasEventMask
+	Done             chan struct{} // Closed when the listener got its initial events
 }
 
 type canvasEventListenerUnsubscribe struct {
 	Listener canvasListener
+	Done     chan struct{} // Closed when the listener got all of its events
+}
+
+// Sent by the dispatcher of a listener, whose handlers failed canvasListenerMaxErrors times in a row
+type canvasEventListenerFailed struct {
+	Listener   canvasListener
+	Dispatcher *canvasDispatcher
+	Err        error
+}
+
+// Sent by the dispatcher of a listener, after it dropped events of the given area
+type canvasEventListenerResync struct {
+	Listener   canvasListener
+	Dispatcher *canvasDispatcher
+	Rect       image.Rectangle
 }
 
 type canvasEventListenerRects struct {
@@ -78,314 +112,648 @@ type canvasListener interface {
 	handleSetTime(t time.Time) error
 }
 
+// Classes of canvas events, listeners can opt out of the ones they don't need with subscribeListenerFiltered.
+// Changes of virtual chunks are always sent.
+type canvasEventMask uint32
+
+const (
+	canvasEventMaskPixels    canvasEventMask = 1 << iota // canvasEventSetPixel and canvasEventSetPixels
+	canvasEventMaskImages                                // canvasEventSetImage, including the initial images
+	canvasEventMaskValidity                              // canvasEventInvalidateAll, canvasEventInvalidateRect and canvasEventRevalidate
+	canvasEventMaskDownloads                             // canvasEventSignalDownload and canvasEventDownloadFailed
+	canvasEventMaskTime                                  // canvasEventSetTime, including the initial time
+
+	canvasEventMaskAll = canvasEventMaskPixels | canvasEventMaskImages | canvasEventMaskValidity | canvasEventMaskDownloads | canvasEventMaskTime
+)
+
 type canvasListenerState struct {
 	Rects                 []image.Rectangle       // Rectangles that the listener needs to be kept up to do date with. The canvas will keep those rectangles in sync with the game
-	VirtualChunks         map[image.Rectangle]int // Chunk rectangles with IDs that the listener knows of, only used when UseVirtualChunks is set
+	VirtualChunks         map[chunkCoordinate]int // IDs of the chunks that the listener knows of, only used when UseVirtualChunks is set. Only rebuilt when the rectangles change
 	VirtualChunkIDCounter int                     // Counter for new chunk IDs
 	UseVirtualChunks      bool                    // True: Let the canvas manage chunks for the listener
+	Filter                canvasEventMask         // Classes of events that are forwarded to the listener
+	Dispatcher            *canvasDispatcher       // Calls the handlers of the listener
+
+	// Chunk rectangles of Rects and their bounds, cached for the chunk size and origin they were computed with
+	chunkRects          []chunkRectangle
+	chunkBounds         chunkRectangle
+	chunkSize           pixelSize
+	chunkOrigin         image.Point
+	chunkRectsOutOfDate bool
+}
+
+// Returns the chunk rectangles of the listener rectangles, and their bounds.
+// They are only computed again when the rectangles, the chunk size or the origin change.
+func (state *canvasListenerState) getChunkRects(size pixelSize, origin image.Point) ([]chunkRectangle, chunkRectangle) {
+	if !state.chunkRectsOutOfDate && state.chunkSize == size && state.chunkOrigin == origin {
+		return state.chunkRects, state.chunkBounds
+	}
+
+	state.chunkRects, state.chunkBounds = state.chunkRects[:0], chunkRectangle{}
+	for _, rect := range state.Rects {
+		chunkRect := size.getOuterChunkRect(rect, origin)
+		state.chunkRects = append(state.chunkRects, chunkRect)
+		state.chunkBounds.Rectangle = state.chunkBounds.Union(chunkRect.Rectangle)
+	}
+	state.chunkSize, state.chunkOrigin, state.chunkRectsOutOfDate = size, origin, false
+
+	return state.chunkRects, state.chunkBounds
+}
+
+const canvasRectQueryWorkers = 4 // Number of goroutines that query the chunks of registered rectangles
+
+// Queue of rectangles whose chunks will be queried, and downloaded if needed.
+// Rectangles that are already queued are ignored, so overlapping registrations don't pile up.
+type rectQueryQueue struct {
+	sync.Mutex
+
+	pending map[image.Rectangle]struct{}
+	order   []image.Rectangle
+
+	Signal chan struct{} // Receives an element while there are queued rectangles
+}
+
+func newRectQueryQueue() *rectQueryQueue {
+	return &rectQueryQueue{
+		pending: map[image.Rectangle]struct{}{},
+		Signal:  make(chan struct{}, 1),
+	}
 }
 
+// Queues the rectangle, if it isn't queued already. This never blocks
+func (q *rectQueryQueue) push(rect image.Rectangle) {
+	q.Lock()
+	defer q.Unlock()
+
+	if _, ok := q.pending[rect]; ok {
+		return
+	}
+	q.pending[rect] = struct{}{}
+	q.order = append(q.order, rect)
+
+	q.signal()
+}
+
+// Removes the oldest rectangle from the queue, and signals again if there are more
+func (q *rectQueryQueue) pop() (image.Rectangle, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.order) == 0 {
+		return image.Rectangle{}, false
+	}
+	rect := q.order[0]
+	q.order = q.order[1:]
+	delete(q.pending, rect)
+
+	if len(q.order) > 0 {
+		q.signal()
+	}
+
+	return rect, true
+}
+
+func (q *rectQueryQueue) signal() {
+	select {
+	case q.Signal <- struct{}{}:
+	default:
+	}
+}
+
+// Interval in which dropped chunk download requests are sent again
+const canvasChunkRetryInterval = time.Second
+
 type canvas struct {
+	droppedRequests  uint64              // Number of chunk download requests that didn't fit into ChunkRequestChan. Accessed atomically, keep it first for alignment
+	overflowedEvents uint64              // Number of events that didn't fit into EventChan. Accessed atomically
+	counters         canvasStatsCounters // Pixels and events sent to the broadcaster, see stats. Starts with atomically accessed counters, keep it after the other ones for alignment
+
 	sync.RWMutex
 	Closed      bool
 	ClosedMutex sync.RWMutex
 
 	ChunkSize pixelSize
 	Origin    image.Point     // Offset of the chunks in pixels. Positive values move the chunks to the top left.
-	Rect      image.Rectangle // Valid area of the canvas // TODO: Enforce canvas limit
+	Rect      image.Rectangle // Valid area of the canvas. Chunks are only created if they overlap it, pixels outside of it are rejected
 	Chunks    map[chunkCoordinate]*chunk
 
 	Time time.Time
 
-	EventChan        chan interface{} // Forwards incoming canvasEvent* events to the goroutine
+	Authors bool // Set if the game reports who placed pixels, only then recordings store authors
+
+	Palette    *canvasPaletteTracker // Known palette of the game, detects colors that don't match it
+	applyMutex sync.RWMutex          // Read locked while changes are applied to several chunks, getConsistentSnapshot locks it to freeze them
+	Clock      *serverClock          // Clock of the game server, recordings use it to time events
+
+	keptRects []image.Rectangle   // Rectangles registered by all listeners, kept up to date by the broadcaster
+	recorders int                 // Number of subscribed recorders, kept up to date by the broadcaster
+	listeners int                 // Number of subscribed listeners, kept up to date by the broadcaster
+	spill     *canvasSpill        // Storage of cold chunks, nil if spilling isn't enabled
+	history   *canvasPixelHistory // Limits of the last changes of every pixel, which are kept by the chunks. Nil if the history isn't enabled
+
+	EventChan        chan interface{} // Forwards incoming canvasEvent* events to the goroutine. Only sent to by sendEvent, while holding a read lock of ClosedMutex
 	ChunkRequestChan chan *chunk      // Chunk download requests that go to the game connection
+	overflow         canvasOverflow   // Events that didn't fit into EventChan, depending on the overflow policy
+
+	listenerQueueSize int // Number of events that can wait for each listener, before the overflow policy applies
+
+	retryMutex  sync.Mutex
+	retryChunks map[*chunk]struct{} // Chunks whose download requests were dropped, they are sent again after canvasChunkRetryInterval
+
+	closedChan chan struct{} // Closed when the broadcaster stopped, and all listeners got their events
 }
 
 func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectangle) (*canvas, <-chan *chunk) {
+	policy := getChunkPolicy()
 	can := &canvas{
-		ChunkSize:        chunkSize,
-		Origin:           origin,
-		Rect:             canvasRect,
-		Chunks:           make(map[chunkCoordinate]*chunk),
-		EventChan:        make(chan interface{}), // TODO: Determine optimal chan size (Add waitGroup when channel buffering is enabled!)
-		ChunkRequestChan: make(chan *chunk, 500),
+		ChunkSize:         chunkSize,
+		Origin:            origin,
+		Rect:              canvasRect,
+		Chunks:            make(map[chunkCoordinate]*chunk),
+		EventChan:         make(chan interface{}, memoryQueueSize(policy.getEventQueueSize())),
+		ChunkRequestChan:  make(chan *chunk, policy.RequestQueueSize),
+		overflow:          newCanvasOverflow(policy.EventOverflow),
+		listenerQueueSize: memoryQueueSize(policy.getListenerQueueSize()),
+		retryChunks:       map[*chunk]struct{}{},
+		closedChan:        make(chan struct{}),
+		Palette:           newCanvasPaletteTracker(),
+		Clock:             newServerClock(),
+	}
+	if policy.PixelHistory > 0 {
+		can.history = newCanvasPixelHistory(policy.PixelHistory, policy.getPixelHistoryLimit())
 	}
 
 	handleChunk := func(chunk *chunk, resetTime bool) {
-		switch chunk.getQueryState(resetTime) {
+		switch chunk.getQueryState(resetTime, can.getChunkIdleTimeout(chunk)) {
 		case chunkDelete:
 			can.Lock()
 			delete(can.Chunks, can.ChunkSize.getChunkCoord(chunk.Rect.Min, can.Origin))
 			can.Unlock()
 		case chunkDownload:
 			select {
-			case can.ChunkRequestChan <- chunk: // Try to send a chunk request to the connection. If it fails --> bleh, retry next time
+			case can.ChunkRequestChan <- chunk: // Try to send a chunk request to the connection
 			default:
+				// The connection can't keep up, remember the chunk so it's requested again soon
+				if dropped := atomic.AddUint64(&can.droppedRequests, 1); dropped%1000 == 1 {
+					canvasLog.Warnf("Game connection can't keep up with chunk requests, dropped %v so far", dropped)
+				}
+				can.retryMutex.Lock()
+				can.retryChunks[chunk] = struct{}{}
+				can.retryMutex.Unlock()
+			}
+		}
+	}
+
+	// Requests the dropped chunks again, if they still exist and need to be downloaded
+	retryChunks := func() {
+		can.retryMutex.Lock()
+		chunks := can.retryChunks
+		can.retryChunks = map[*chunk]struct{}{}
+		can.retryMutex.Unlock()
+
+		for chunk := range chunks {
+			can.RLock()
+			exists := can.Chunks[can.ChunkSize.getChunkCoord(chunk.Rect.Min, can.Origin)] == chunk
+			can.RUnlock()
+			if exists {
+				handleChunk(chunk, false)
 			}
 		}
 	}
 
-	rectQueryChan := make(chan image.Rectangle)
+	rectQueries := newRectQueryQueue()
+	rectQueryQuit := make(chan struct{})
+
+	// Workers that query the chunks of rectangles from the queue, and request downloads of them
+	for i := 0; i < canvasRectQueryWorkers; i++ {
+		go crashRun("Chunk query worker of canvas", true, func() {
+			for {
+				select {
+				case <-rectQueries.Signal:
+					rect, ok := rectQueries.pop()
+					if !ok {
+						continue
+					}
+					chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
+					chunks, err := can.getChunks(chunkRect, true, true)
+					if err == nil {
+						for _, chunk := range chunks {
+							handleChunk(chunk, true)
+						}
+					}
+				case <-rectQueryQuit:
+					return
+				}
+			}
+		})
+	}
 
 	// Goroutine that handles chunk downloading (Queries the game connection for chunks)
-	go func() {
+	go crashRun("Chunk downloader of canvas", true, func() {
 		ticker := time.NewTicker(10 * time.Second)
 		defer ticker.Stop()
+		retryTicker := time.NewTicker(canvasChunkRetryInterval)
+		defer retryTicker.Stop()
 
 		for {
 			select {
-			case rect, ok := <-rectQueryChan:
-				if !ok {
-					// Close goroutine, as the channel is gone
-					return
-				}
-				chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
-				chunks, err := can.getChunks(chunkRect, true, true)
-				if err == nil {
-					for _, chunk := range chunks {
-						handleChunk(chunk, true)
-					}
-				}
+			case <-rectQueryQuit:
+				return
 			case <-ticker.C: // Query all chunks for state changes regularly
 				chunks := can.getAllChunks()
+				throttle := newBackgroundThrottle(backgroundThrottleInterval)
 				for _, chunk := range chunks {
 					handleChunk(chunk, false) // Handle chunks, but don't reset their timer
+					throttle.step()
 				}
-
+				can.enforceMemoryLimit(getChunkPolicy().getMemoryLimit())
+			case <-retryTicker.C: // Don't let dropped requests wait for the next query of all chunks
+				retryChunks()
 			}
 		}
-	}()
+	})
 
-	// Gets the list of virtual chunks that intersect with a given rectangle
-	getVirtualChunks := func(state *canvasListenerState, rect image.Rectangle, createNew bool) map[image.Rectangle]int {
-		vcs := map[image.Rectangle]int{}
-		chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
-		for iy := chunkRect.Min.Y; iy < chunkRect.Max.Y; iy++ {
-			for ix := chunkRect.Min.X; ix < chunkRect.Max.X; ix++ {
-				min := image.Point{ix*can.ChunkSize.X - can.Origin.X, iy*can.ChunkSize.Y - can.Origin.X}
-				max := min.Add(image.Point{can.ChunkSize.X, can.ChunkSize.Y})
-
-				vc := image.Rectangle{
-					Min: min,
-					Max: max,
-				}
-
-				vcID, ok := state.VirtualChunks[vc] // Get ID from already existing virtual chunk
+	// Gets the pixel rectangle of the virtual chunk at the given chunk coordinate
+	getVirtualChunkRect := func(coord chunkCoordinate) image.Rectangle {
+		min := image.Point{coord.X*can.ChunkSize.X - can.Origin.X, coord.Y*can.ChunkSize.Y - can.Origin.Y}
+		max := min.Add(image.Point{can.ChunkSize.X, can.ChunkSize.Y})
 
-				if ok {
-					vcs[vc] = vcID
-					continue
-				}
+		return image.Rectangle{
+			Min: min,
+			Max: max,
+		}
+	}
 
-				if createNew {
-					vcID = state.VirtualChunkIDCounter
-					state.VirtualChunkIDCounter++
-					vcs[vc] = vcID
+	// Appends the IDs of the virtual chunks that intersect with a given chunk rectangle to vcIDs
+	appendVirtualChunkIDs := func(vcIDs []int, state *canvasListenerState, chunkRect chunkRectangle) []int {
+		_, bounds := state.getChunkRects(can.ChunkSize, can.Origin)
+		chunkRect.Rectangle = chunkRect.Intersect(bounds.Rectangle) // Virtual chunks only exist inside of the listener rectangles
+		for iy := chunkRect.Min.Y; iy < chunkRect.Max.Y; iy++ {
+			for ix := chunkRect.Min.X; ix < chunkRect.Max.X; ix++ {
+				if vcID, ok := state.VirtualChunks[chunkCoordinate{ix, iy}]; ok {
+					vcIDs = append(vcIDs, vcID)
 				}
 			}
 		}
-		return vcs
+		return vcIDs
 	}
 
 	// Goroutine that handles event broadcasting to listeners
 	// It can directly broadcast events from the EventChan, or it can create new events for specific listeners.
 	// If requested (by the UseVirtualChunks flag) the goroutine will handle all the creation and deletion of (virtual) chunks for the listener.
+	// The events are handed to the dispatcher of each listener, which calls the handlers in its own goroutine.
 	go func() {
 		ticker := time.NewTicker(1 * time.Minute)
 		defer ticker.Stop()
-		listeners := map[canvasListener]*canvasListenerState{} // Events get forwarded to these listeners
-		defer close(rectQueryChan)
+		listeners := map[canvasListener]*canvasListenerState{}  // Events get forwarded to these listeners
+		failedListeners := map[canvasListener]<-chan struct{}{} // Listeners that were unsubscribed because of errors, the channel is closed after their handleClose call
+		defer close(rectQueryQuit)
+		defer func() {
+			// Drain all dispatchers, before acknowledging that the canvas is closed
+			dones := make([]<-chan struct{}, 0, len(listeners)+len(failedListeners))
+			for _, state := range listeners {
+				dones = append(dones, state.Dispatcher.close())
+			}
+			for _, done := range failedListeners {
+				dones = append(dones, done)
+			}
+			for _, done := range dones {
+				<-done
+			}
+			close(can.closedChan)
+		}()
+
+		// Updates the rectangles and recorders that the chunk policy is based on
+		updateRetention := func() {
+			rects, recorders := []image.Rectangle{}, 0
+			for l, state := range listeners {
+				if _, ok := l.(canvasRecorder); ok {
+					recorders++
+				}
+				rects = append(rects, state.Rects...)
+			}
+			can.Lock()
+			can.keptRects, can.recorders, can.listeners = rects, recorders, len(listeners)
+			can.Unlock()
+		}
 
-		for {
-			select {
-			case event, ok := <-can.EventChan:
-				if !ok {
-					// Close goroutine, as the channel is gone
-					log.Trace("Canvas event broadcaster closed")
-					return
+		// Forwards a rectangle event of the given class to all listeners that want it, with the virtual chunks it affects
+		var vcIDsBuffer []int // Reused for every event, only the result is copied
+		broadcastRect := func(e interface{}, class canvasEventMask, rect image.Rectangle, valid bool) {
+			chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin) // Once for all listeners
+			for _, state := range listeners {
+				if state.Filter&class == 0 {
+					continue
 				}
-				switch event := event.(type) {
-				case canvasEventSetPixel:
-					//log.Tracef("pixel %v\n", event.Pos)
-					for listener, state := range listeners {
-						if !state.UseVirtualChunks {
-							listener.handleSetPixel(event.Pos, event.Color, 0)
-							continue
+				if !state.UseVirtualChunks {
+					state.Dispatcher.push(canvasListenerEvent{Event: e, VCIDs: canvasNoVCIDs, Valid: valid})
+					continue
+				}
+				vcIDsBuffer = appendVirtualChunkIDs(vcIDsBuffer[:0], state, chunkRect)
+				if len(vcIDsBuffer) > 0 {
+					vcIDs := make([]int, len(vcIDsBuffer)) // The listener may keep the slice
+					copy(vcIDs, vcIDsBuffer)
+					state.Dispatcher.push(canvasListenerEvent{Event: e, VCIDs: vcIDs, Valid: valid})
+				}
+			}
+		}
+
+		// The listeners are kept when the loop crashes and restarts, only the event that caused the crash is lost
+		crashRun("Broadcaster of canvas", true, func() {
+			overflow, overflowSignaled := []interface{}(nil), true // Events taken from the overflow are handled before anything else. Check it after restarts, as the signal may be lost
+			for {
+				var e interface{}
+				if len(overflow) > 0 {
+					e, overflow = overflow[0], overflow[1:]
+				} else {
+					select {
+					case event, ok := <-can.EventChan:
+						if !ok {
+							// Close goroutine, as the channel is gone
+							canvasLog.Trace("Canvas event broadcaster closed")
+							return
 						}
-						vcs := getVirtualChunks(state, image.Rectangle{event.Pos, event.Pos.Add(image.Point{1, 1})}, false)
-						for _, vc := range vcs { // Assume that at most one virtual chunk is returned
-							//log.Tracef("pixel %v at vcID %v\n", event.Pos, vc)
-							listener.handleSetPixel(event.Pos, event.Color, vc)
-							break
+						e = event
+					case <-can.overflow.Signal:
+						overflowSignaled = true
+					case <-ticker.C: // Query all rects every minute
+						for _, state := range listeners {
+							for _, rect := range state.Rects {
+								rectQueries.push(rect) // Async download request
+							}
 						}
 					}
-				case canvasEventSetImage:
-					for listener, state := range listeners {
-						if !state.UseVirtualChunks {
-							listener.handleSetImage(event.Image, true, []int{})
+				}
+
+				// The overflow is newer than everything in the queue, so only take it once the queue is empty
+				if overflowSignaled && len(overflow) == 0 && len(can.EventChan) == 0 {
+					overflowSignaled = false
+					overflow = can.takeOverflow()
+				}
+				if e == nil {
+					continue
+				}
+
+				switch event := e.(type) {
+				case canvasEventSetPixel:
+					//canvasLog.Tracef("pixel %v\n", event.Pos)
+					coord := can.ChunkSize.getChunkCoord(event.Pos, can.Origin) // Once for all listeners
+					for _, state := range listeners {
+						if state.Filter&canvasEventMaskPixels == 0 {
 							continue
 						}
-						vcs := getVirtualChunks(state, event.Image.Bounds(), false)
-						if len(vcs) > 0 {
-							vcsSlice := []int{}
-							for _, vc := range vcs {
-								vcsSlice = append(vcsSlice, vc)
-							}
-							listener.handleSetImage(event.Image, true, vcsSlice)
-						}
-					}
-				case canvasEventInvalidateRect:
-					for listener, state := range listeners {
 						if !state.UseVirtualChunks {
-							listener.handleInvalidateRect(event.Rect, []int{})
+							state.Dispatcher.push(canvasListenerEvent{Event: e})
 							continue
 						}
-						vcs := getVirtualChunks(state, event.Rect, false)
-						if len(vcs) > 0 {
-							vcsSlice := []int{}
-							for _, vc := range vcs {
-								vcsSlice = append(vcsSlice, vc)
-							}
-							listener.handleInvalidateRect(event.Rect, vcsSlice)
+						if _, bounds := state.getChunkRects(can.ChunkSize, can.Origin); !image.Point(coord).In(bounds.Rectangle) {
+							continue // Outside of the listener rectangles, no need to look it up
+						}
+						if vcID, ok := state.VirtualChunks[coord]; ok {
+							//canvasLog.Tracef("pixel %v at vcID %v\n", event.Pos, vcID)
+							state.Dispatcher.push(canvasListenerEvent{Event: e, VCID: vcID})
 						}
 					}
-				case canvasEventInvalidateAll:
-					for listener := range listeners {
-						listener.handleInvalidateAll()
-					}
-				case canvasEventRevalidate:
-					for listener, state := range listeners {
-						if !state.UseVirtualChunks {
-							listener.handleRevalidateRect(event.Rect, []int{})
+				case canvasEventSetPixels:
+					for _, state := range listeners {
+						if state.Filter&canvasEventMaskPixels == 0 {
 							continue
 						}
-						vcs := getVirtualChunks(state, event.Rect, false)
-						if len(vcs) > 0 {
-							vcsSlice := []int{}
-							for _, vc := range vcs {
-								vcsSlice = append(vcsSlice, vc)
-							}
-							listener.handleRevalidateRect(event.Rect, vcsSlice)
-						}
-					}
-				case canvasEventSignalDownload:
-					for listener, state := range listeners {
 						if !state.UseVirtualChunks {
-							listener.handleSignalDownload(event.Rect, []int{})
+							state.Dispatcher.push(canvasListenerEvent{Event: e, VCIDs: canvasNoVCIDs})
 							continue
 						}
-						vcs := getVirtualChunks(state, event.Rect, false)
-						if len(vcs) > 0 {
-							vcsSlice := []int{}
-							for _, vc := range vcs {
-								vcsSlice = append(vcsSlice, vc)
+						// Only the pixels inside of the virtual chunks of the listener, with one ID per pixel
+						_, bounds := state.getChunkRects(can.ChunkSize, can.Origin)
+						var filtered canvasEventSetPixels
+						var vcIDs []int
+						for _, pixel := range event.Pixels {
+							coord := can.ChunkSize.getChunkCoord(pixel.Pos, can.Origin)
+							if !image.Point(coord).In(bounds.Rectangle) {
+								continue
 							}
-							listener.handleSignalDownload(event.Rect, vcsSlice)
+							if vcID, ok := state.VirtualChunks[coord]; ok {
+								filtered.Pixels = append(filtered.Pixels, pixel)
+								vcIDs = append(vcIDs, vcID)
+							}
+						}
+						if len(filtered.Pixels) > 0 {
+							state.Dispatcher.push(canvasListenerEvent{Event: filtered, VCIDs: vcIDs})
 						}
 					}
+				case canvasEventSetImage:
+					broadcastRect(e, canvasEventMaskImages, event.Image.Bounds(), true)
+				case canvasEventInvalidateRect:
+					broadcastRect(e, canvasEventMaskValidity, event.Rect, false)
+				case canvasEventInvalidateAll:
+					for _, state := range listeners {
+						if state.Filter&canvasEventMaskValidity != 0 {
+							state.Dispatcher.push(canvasListenerEvent{Event: e})
+						}
+					}
+				case canvasEventRevalidate:
+					broadcastRect(e, canvasEventMaskValidity, event.Rect, false)
+				case canvasEventDownloadFailed:
+					broadcastRect(e, canvasEventMaskDownloads, event.Rect, false)
+				case canvasEventSignalDownload:
+					broadcastRect(e, canvasEventMaskDownloads, event.Rect, false)
 				case canvasEventSetTime:
-					for listener := range listeners {
-						listener.handleSetTime(event.Time)
+					for _, state := range listeners {
+						if state.Filter&canvasEventMaskTime != 0 {
+							state.Dispatcher.push(canvasListenerEvent{Event: e})
+						}
 					}
 				case canvasEventListenerSubscribe:
-					//log.Tracef("Listener %v subscribed", event.Listener)
-					listeners[event.Listener] = &canvasListenerState{
+					//canvasLog.Tracef("Listener %v subscribed", event.Listener)
+					state := &canvasListenerState{
 						UseVirtualChunks:      event.UseVirtualChunks,
+						Filter:                event.Filter,
 						VirtualChunkIDCounter: 1,
 					}
+					if oldState, ok := listeners[event.Listener]; ok {
+						state.Dispatcher = oldState.Dispatcher // Keep the event order when a listener subscribes again
+					} else {
+						state.Dispatcher = newCanvasDispatcher(event.Listener, can.listenerQueueSize, can.overflow.Policy, can.failListener, can.resyncListener)
+					}
+					delete(failedListeners, event.Listener)
+					listeners[event.Listener] = state
+					updateRetention()
 
 					// If the canvas doesn't handle the listeners chunks, just send all chunks for initialization
-					if !event.UseVirtualChunks {
+					if !event.UseVirtualChunks && state.Filter&canvasEventMaskImages != 0 {
 						chunks := can.getAllChunks()
 						for _, chunk := range chunks {
-							img, valid, _, err := chunk.getImageCopy(false)
+							img, valid, _, err := chunk.getImage(false)
 							if err == nil {
-								event.Listener.handleSetImage(img, valid, []int{})
+								state.Dispatcher.pushAlways(canvasListenerEvent{Event: canvasEventSetImage{Image: img.Image}, VCIDs: canvasNoVCIDs, Valid: valid}) // Not released, as listeners may keep the image
 							}
 						}
 					}
 
-					t, err := can.getTime()
-					if err == nil {
-						event.Listener.handleSetTime(t)
+					// Don't use getTime(), it would wait for ClosedMutex while Close() waits for this goroutine
+					if state.Filter&canvasEventMaskTime != 0 {
+						can.RLock()
+						t := can.Time
+						can.RUnlock()
+						state.Dispatcher.push(canvasListenerEvent{Event: canvasEventSetTime{Time: t}})
 					}
+					state.Dispatcher.push(canvasListenerEvent{Event: canvasEventDelivered{Done: event.Done}})
 
 				case canvasEventListenerUnsubscribe:
-					//log.Tracef("Listener %v unsubscribed", event.Listener)
+					//canvasLog.Tracef("Listener %v unsubscribed", event.Listener)
+					if state, ok := listeners[event.Listener]; ok {
+						delete(listeners, event.Listener)
+						updateRetention()
+						go func(done <-chan struct{}) {
+							<-done
+							close(event.Done)
+						}(state.Dispatcher.close())
+					} else if done, ok := failedListeners[event.Listener]; ok {
+						delete(failedListeners, event.Listener)
+						go func() {
+							<-done
+							close(event.Done)
+						}()
+					} else {
+						close(event.Done)
+					}
+				case canvasEventListenerFailed:
+					state, ok := listeners[event.Listener]
+					if !ok || state.Dispatcher != event.Dispatcher {
+						break // Already unsubscribed
+					}
+					canvasLog.Warnf("Unsubscribing listener %T, after %v handler calls failed in a row: %v", event.Listener, canvasListenerMaxErrors, event.Err)
 					delete(listeners, event.Listener)
+					updateRetention()
+					closed := make(chan struct{})
+					failedListeners[event.Listener] = closed
+					go func(done <-chan struct{}) {
+						defer close(closed)
+						<-done
+						if cl, ok := event.Listener.(canvasCloseListener); ok {
+							crashProtect(fmt.Sprintf("Dispatcher of listener %T", event.Listener), true, func() {
+								cl.handleClose(event.Err)
+							})
+						}
+					}(state.Dispatcher.close())
+				case canvasEventListenerResync:
+					state, ok := listeners[event.Listener]
+					if !ok || state.Dispatcher != event.Dispatcher {
+						break // Already unsubscribed
+					}
+
+					// Replace the dropped events by an invalidation and the current images of their area
+					if state.Filter&canvasEventMaskValidity != 0 {
+						vcIDs := canvasNoVCIDs
+						if state.UseVirtualChunks {
+							vcIDs = appendVirtualChunkIDs(nil, state, can.ChunkSize.getOuterChunkRect(event.Rect, can.Origin))
+						}
+						if len(vcIDs) > 0 || !state.UseVirtualChunks {
+							state.Dispatcher.pushAlways(canvasListenerEvent{Event: canvasEventInvalidateRect{Rect: event.Rect}, VCIDs: vcIDs})
+						}
+					}
+					if state.Filter&canvasEventMaskImages == 0 {
+						break
+					}
+					for _, chunk := range can.getAllChunks() {
+						if !chunk.Rect.Overlaps(event.Rect) {
+							continue
+						}
+						vcIDs := canvasNoVCIDs
+						if state.UseVirtualChunks {
+							vcID, ok := state.VirtualChunks[can.ChunkSize.getChunkCoord(chunk.Rect.Min, can.Origin)]
+							if !ok {
+								continue
+							}
+							vcIDs = []int{vcID}
+						}
+						if img, valid, _, err := chunk.getImage(true); err == nil {
+							state.Dispatcher.pushAlways(canvasListenerEvent{Event: canvasEventSetImage{Image: img.Image}, VCIDs: vcIDs, Valid: valid}) // Not released, as listeners may keep the image
+						}
+					}
 				case canvasEventListenerRects:
 					state, ok := listeners[event.Listener]
 					if ok {
-						//log.Tracef("Listener %v changed rects to %v", event.Listener, event.Rects)
+						//canvasLog.Tracef("Listener %v changed rects to %v", event.Listener, event.Rects)
 
 						state.Rects = event.Rects
+						state.chunkRectsOutOfDate = true
+						updateRetention()
 
 						// Make download query for rects
 						for _, rect := range state.Rects {
-							go func(rect image.Rectangle) { rectQueryChan <- rect }(rect) // Async download request
+							rectQueries.push(rect) // Async download request
 						}
 
 						if !state.UseVirtualChunks {
 							break
 						}
 
-						// Get or create chunk rects that are intersecting with the listener rectangles
-						neededChunks := map[image.Rectangle]int{}
-						for _, rect := range state.Rects {
-							tempChunks := getVirtualChunks(state, rect, true)
-							for k, v := range tempChunks {
-								neededChunks[k] = v
-							}
-						}
-
-						// Handle chunk rects, that are missing on the listeners side
+						// Get or create the chunks that are intersecting with the listener rectangles.
+						// Chunks that are missing on the listeners side get new IDs
+						neededChunks := make(map[chunkCoordinate]int, len(state.VirtualChunks))
 						createChunks := map[image.Rectangle]int{}
-						for k, v := range neededChunks {
-							if _, ok := state.VirtualChunks[k]; !ok {
-								createChunks[k] = v
+						createCoords := []chunkCoordinate{}
+						chunkRects, _ := state.getChunkRects(can.ChunkSize, can.Origin)
+						for _, chunkRect := range chunkRects {
+							for iy := chunkRect.Min.Y; iy < chunkRect.Max.Y; iy++ {
+								for ix := chunkRect.Min.X; ix < chunkRect.Max.X; ix++ {
+									coord := chunkCoordinate{ix, iy}
+									if _, ok := neededChunks[coord]; ok {
+										continue
+									}
+									if vcID, ok := state.VirtualChunks[coord]; ok {
+										neededChunks[coord] = vcID
+										continue
+									}
+									vcID := state.VirtualChunkIDCounter
+									state.VirtualChunkIDCounter++
+									neededChunks[coord] = vcID
+									createChunks[getVirtualChunkRect(coord)] = vcID
+									createCoords = append(createCoords, coord)
+								}
 							}
 						}
 
-						// Handle chunk rects, that are not needed anymore on the listeners side
+						// Handle chunks, that are not needed anymore on the listeners side
 						removeChunks := map[image.Rectangle]int{}
-						for k, v := range state.VirtualChunks {
-							if _, ok := neededChunks[k]; !ok {
-								removeChunks[k] = v
+						for coord, vcID := range state.VirtualChunks {
+							if _, ok := neededChunks[coord]; !ok {
+								removeChunks[getVirtualChunkRect(coord)] = vcID
 							}
 						}
 
 						state.VirtualChunks = neededChunks
 
 						if len(createChunks) > 0 || len(removeChunks) > 0 {
-							event.Listener.handleChunksChange(createChunks, removeChunks)
+							state.Dispatcher.push(canvasListenerEvent{Event: canvasEventChunksChange{Create: createChunks, Remove: removeChunks}})
 						}
 
 						// Additionally send images for the new chunks if possible
-						for rect, id := range createChunks {
-							chunkCoord := can.ChunkSize.getChunkCoord(rect.Min, can.Origin)
+						if state.Filter&canvasEventMaskImages == 0 {
+							break
+						}
+						for _, chunkCoord := range createCoords {
+							id := neededChunks[chunkCoord]
 							chunk, err := can.getChunk(chunkCoord, false)
 							if err == nil {
-								img, valid, _, err := chunk.getImageCopy(false)
+								img, valid, _, err := chunk.getImage(false)
 								if err == nil {
-									event.Listener.handleSetImage(img, valid, []int{id})
+									state.Dispatcher.pushAlways(canvasListenerEvent{Event: canvasEventSetImage{Image: img.Image}, VCIDs: []int{id}, Valid: valid}) // Not released, as listeners may keep the image
 								}
 							}
 						}
 
 					}
 				default:
-					log.Panicf("Unknown event occurred: %T", event)
-				}
-			case <-ticker.C: // Query all rects every minute
-				for _, state := range listeners {
-					for _, rect := range state.Rects {
-						go func(rect image.Rectangle) { rectQueryChan <- rect }(rect) // Async download request
-					}
+					canvasLog.Panicf("Unknown event occurred: %T", event)
 				}
 			}
-		}
+		})
 	}()
 
+	memoryRegisterCanvas(can)
+
 	return can, can.ChunkRequestChan
 }
 
@@ -398,33 +766,100 @@ func newCanvas(chunkSize pixelSize, origin image.Point, canvasRect image.Rectang
 //
 // If that flag is false, the canvas will send all events to the listener.
 // Furthermore it will send the images of all known chunks on subscription.
+//
+// This returns after the listener got its initial events.
+// Don't call this function from the handlers of the listener, or while holding a lock they need, or it will cause a deadlock.
 func (can *canvas) subscribeListener(l canvasListener, useVirtualChunks bool) error {
+	return can.subscribeListenerFiltered(l, useVirtualChunks, canvasEventMaskAll)
+}
+
+// Subscribes a listener like subscribeListener, but only forwards the classes of events in filter.
+// The handlers of the other events are never called, which saves dispatching events that would be ignored anyway.
+func (can *canvas) subscribeListenerFiltered(l canvasListener, useVirtualChunks bool, filter canvasEventMask) error {
 	can.ClosedMutex.RLock()
-	defer can.ClosedMutex.RUnlock()
 	if can.Closed {
+		can.ClosedMutex.RUnlock()
 		return fmt.Errorf("Canvas is closed")
 	}
 
 	// Forward event to broadcaster goroutine, even if there isn't a chunk.
-	can.EventChan <- canvasEventListenerSubscribe{
+	// Wait until the initial events are delivered, so that changes afterwards aren't part of the initial images
+	done := make(chan struct{})
+	can.sendEvent(canvasEventListenerSubscribe{
 		Listener:         l,
 		UseVirtualChunks: useVirtualChunks,
-	}
+		Filter:           filter,
+		Done:             done,
+	})
+	can.ClosedMutex.RUnlock()
+
+	<-done
 
 	return nil
 }
 
+// Tells the broadcaster to unsubscribe the listener of the dispatcher, whose handlers failed too often.
+// This is called by the dispatcher, and doesn't wait for the broadcaster.
+func (can *canvas) failListener(d *canvasDispatcher, err error) {
+	go func() {
+		can.ClosedMutex.RLock()
+		defer can.ClosedMutex.RUnlock()
+		if can.Closed {
+			return // The dispatcher is drained by Close anyway
+		}
+
+		can.sendEvent(canvasEventListenerFailed{
+			Listener:   d.listener,
+			Dispatcher: d,
+			Err:        err,
+		})
+	}()
+}
+
+// Tells the broadcaster to send the current state of rect to the listener of the dispatcher, which dropped events of that area.
+// This is called by the dispatcher, and doesn't wait for the broadcaster.
+func (can *canvas) resyncListener(d *canvasDispatcher, rect image.Rectangle, dropped int) {
+	if overflowed := atomic.AddUint64(&can.overflowedEvents, uint64(dropped)); overflowed == uint64(dropped) || (overflowed-uint64(dropped))/1000 != overflowed/1000 {
+		canvasLog.Warnf("Listener %T can't keep up, %v events overflowed so far (Policy %v)", d.listener, overflowed, can.overflow.Policy)
+	}
+
+	go func() {
+		can.ClosedMutex.RLock()
+		defer can.ClosedMutex.RUnlock()
+		if can.Closed {
+			return
+		}
+
+		can.sendEvent(canvasEventListenerResync{
+			Listener:   d.listener,
+			Dispatcher: d,
+			Rect:       rect,
+		})
+	}()
+}
+
+// Unsubscribes a listener, and waits until it got all events that were sent before.
+// If the canvas is closed, this waits until all listeners got their events.
+// Either way, the handlers of the listener aren't called anymore after this returns.
+//
+// Don't call this function from the handlers of the listener, or while holding a lock they need, or it will cause a deadlock.
 func (can *canvas) unsubscribeListener(l canvasListener) error {
 	can.ClosedMutex.RLock()
-	defer can.ClosedMutex.RUnlock()
 	if can.Closed {
+		can.ClosedMutex.RUnlock()
+		<-can.closedChan
 		return fmt.Errorf("Canvas is closed")
 	}
 
 	// Forward event to broadcaster goroutine, even if there isn't a chunk.
-	can.EventChan <- canvasEventListenerUnsubscribe{
+	done := make(chan struct{})
+	can.sendEvent(canvasEventListenerUnsubscribe{
 		Listener: l,
-	}
+		Done:     done,
+	})
+	can.ClosedMutex.RUnlock()
+
+	<-done // Wait outside of the lock, the canvas may be closed meanwhile
 
 	return nil
 }
@@ -434,6 +869,7 @@ func (can *canvas) unsubscribeListener(l canvasListener) error {
 // This function will silently fail if the listener isn't subscribed already.
 //
 // Don't call this function from the same context that handles events, or it will cause a deadlock.
+// The rectangles are clipped to the valid area of the canvas, rectangles outside of it are ignored.
 func (can *canvas) registerRects(l canvasListener, rects []image.Rectangle) error {
 	can.ClosedMutex.RLock()
 	defer can.ClosedMutex.RUnlock()
@@ -441,11 +877,18 @@ func (can *canvas) registerRects(l canvasListener, rects []image.Rectangle) erro
 		return fmt.Errorf("Canvas is closed")
 	}
 
+	clipped := make([]image.Rectangle, 0, len(rects))
+	for _, rect := range rects {
+		if rect = rect.Canon().Intersect(can.Rect); !rect.Empty() {
+			clipped = append(clipped, rect)
+		}
+	}
+
 	// Forward event to broadcaster goroutine, even if there isn't a chunk.
-	can.EventChan <- canvasEventListenerRects{
+	can.sendEvent(canvasEventListenerRects{
 		Listener: l,
-		Rects:    rects,
-	}
+		Rects:    clipped,
+	})
 
 	return nil
 }
@@ -456,23 +899,52 @@ func (can *canvas) getChunk(coord chunkCoordinate, createIfNonexistent bool) (*c
 		defer can.Unlock()
 	} else {
 		can.RLock()
-		defer can.RUnlock()
+		chunk, ok := can.Chunks[coord]
+		spill := can.spill
+		can.RUnlock()
+		if ok {
+			if spill != nil {
+				atomic.StoreUint32(&chunk.accessed, 1)
+			}
+			return chunk, nil
+		}
+		if spill == nil {
+			return nil, fmt.Errorf("Chunk at %v does not exist", coord)
+		}
+
+		// The chunk may be spilled, loading it back modifies the map
+		can.Lock()
+		defer can.Unlock()
 	}
 
 	chunk, ok := can.Chunks[coord]
 	if ok {
+		if can.spill != nil {
+			atomic.StoreUint32(&chunk.accessed, 1)
+		}
 		return chunk, nil
 	}
 
+	min := image.Point{coord.X*can.ChunkSize.X - can.Origin.X, coord.Y*can.ChunkSize.Y - can.Origin.Y}
+	max := min.Add(image.Point{can.ChunkSize.X, can.ChunkSize.Y})
+	rect := image.Rectangle{
+		Min: min,
+		Max: max,
+	}
+
+	if can.spill != nil {
+		if chunk := can.spill.load(coord, rect); chunk != nil {
+			chunk.accessed = 1
+			can.Chunks[coord] = chunk
+			return chunk, nil
+		}
+	}
+
 	if createIfNonexistent {
-		min := image.Point{coord.X*can.ChunkSize.X - can.Origin.X, coord.Y*can.ChunkSize.Y - can.Origin.X}
-		max := min.Add(image.Point{can.ChunkSize.X, can.ChunkSize.Y})
-		chunk := newChunk(
-			image.Rectangle{
-				Min: min,
-				Max: max,
-			},
-		)
+		if !rect.Overlaps(can.Rect) {
+			return nil, fmt.Errorf("Chunk at %v is outside of the canvas %v", coord, can.Rect)
+		}
+		chunk := newChunk(rect)
 
 		can.Chunks[coord] = chunk
 
@@ -482,15 +954,16 @@ func (can *canvas) getChunk(coord chunkCoordinate, createIfNonexistent bool) (*c
 	return nil, fmt.Errorf("Chunk at %v does not exist", coord)
 }
 
+// Returns the chunks of the given rectangle, limited to the chunks that overlap the valid area of the canvas
 func (can *canvas) getChunks(rect chunkRectangle, createIfNonexistent, ignoreNonexistent bool) ([]*chunk, error) {
-	rectTemp := rect.Canon()
+	rectTemp := rect.Canon().Intersect(can.ChunkSize.getOuterChunkRect(can.Rect, can.Origin).Rectangle)
 	chunks := []*chunk{}
 
 	for iy := rectTemp.Min.Y; iy < rectTemp.Max.Y; iy++ {
 		for ix := rectTemp.Min.X; ix < rectTemp.Max.X; ix++ {
 			chunk, err := can.getChunk(chunkCoordinate{ix, iy}, createIfNonexistent)
 			if err != nil && ignoreNonexistent == false {
-				// This assumes that there can only be an error when createIfNonexistent == false
+				// This assumes that there can only be an error when createIfNonexistent == false, as the rectangle is limited to the valid area
 				// So it will never abort while it creates missing chunks
 				return nil, fmt.Errorf("Can't get all chunks: %v", err)
 			}
@@ -515,6 +988,124 @@ func (can *canvas) getAllChunks() []*chunk {
 	return chunks
 }
 
+// Returns the bounds of all chunks that have image data
+func (can *canvas) getLoadedRect() image.Rectangle {
+	rect := image.Rectangle{}
+	for _, chunk := range can.getAllChunks() {
+		chunk.RLock()
+		if _, empty := chunk.Image.(*image.Rectangle); !empty && chunk.Image != nil {
+			rect = rect.Union(chunk.Rect)
+		}
+		chunk.RUnlock()
+	}
+
+	return rect
+}
+
+// Returns the time after which the chunk can be deleted when it's invalid and not queried, according to the chunk policy.
+// 0 means that the chunk is kept.
+func (can *canvas) getChunkIdleTimeout(chu *chunk) time.Duration {
+	policy := getChunkPolicy()
+
+	can.RLock()
+	defer can.RUnlock()
+
+	if policy.KeepRecorded && can.recorders > 0 {
+		return 0
+	}
+	if policy.KeepInRects {
+		for _, rect := range can.keptRects {
+			if rect.Overlaps(chu.Rect) {
+				return 0
+			}
+		}
+	}
+
+	return policy.getIdleTimeout()
+}
+
+// Returns the approximate memory used by all chunks in bytes
+func (can *canvas) getMemoryUsage() int64 {
+	var size int64
+	for _, chunk := range can.getAllChunks() {
+		chunkSize, _ := chunk.getMemoryUsage()
+		size += chunkSize
+	}
+	return size
+}
+
+// Minimum time since a chunk was queried last, before it can be evicted by the soft limit of the memory accountant.
+// Chunks of registered rectangles are queried every minute, so they are never evicted
+const canvasEvictMinAge = 2 * time.Minute
+
+// Deletes chunks that weren't queried for at least minAge, least recently queried first, until at least the given number of bytes is freed.
+// The rectangles of the chunks are invalidated, so listeners know that they aren't kept up to date anymore.
+//
+// Returns the number of freed bytes.
+func (can *canvas) evictChunks(bytes int64, minAge time.Duration) int64 {
+	can.ClosedMutex.RLock()
+	defer can.ClosedMutex.RUnlock()
+	if can.Closed {
+		return 0
+	}
+
+	type candidate struct {
+		chunk     *chunk
+		size      int64
+		queryTime time.Time
+	}
+	candidates := []candidate{}
+	for _, chunk := range can.getAllChunks() {
+		size, queryTime := chunk.getMemoryUsage()
+		if !queryTime.Add(minAge).After(time.Now()) {
+			candidates = append(candidates, candidate{chunk, size, queryTime})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].queryTime.Before(candidates[j].queryTime) })
+
+	var freed int64
+	for _, c := range candidates {
+		if freed >= bytes {
+			break
+		}
+
+		coord := can.ChunkSize.getChunkCoord(c.chunk.Rect.Min, can.Origin)
+		can.Lock()
+		if can.Chunks[coord] != c.chunk {
+			can.Unlock()
+			continue // Already deleted meanwhile
+		}
+		delete(can.Chunks, coord)
+		can.Unlock()
+
+		can.sendEvent(canvasEventInvalidateRect{Rect: c.chunk.Rect})
+		freed += c.size
+	}
+
+	return freed
+}
+
+// Evicts the least recently queried chunks, until the chunks of the canvas use at most limit bytes.
+// Unlike the soft limit of the memory accountant, this also evicts chunks of viewed or recorded rectangles.
+// Those are downloaded again once they are queried.
+//
+// Returns the number of freed bytes.
+func (can *canvas) enforceMemoryLimit(limit int64) int64 {
+	if limit <= 0 {
+		return 0
+	}
+	usage := can.getMemoryUsage()
+	if usage <= limit {
+		return 0
+	}
+
+	freed := can.evictChunks(usage-limit, 0)
+	if freed > 0 {
+		canvasLog.Infof("Evicted %.1f MiB of chunks, as the canvas used %.1f MiB of the limit of %.1f MiB", float64(freed)/(1<<20), float64(usage)/(1<<20), float64(limit)/(1<<20))
+	}
+	return freed
+}
+
 func (can *canvas) getPixel(pos image.Point) (color.Color, error) {
 	chunkCoord := can.ChunkSize.getChunkCoord(pos, can.Origin)
 
@@ -526,30 +1117,60 @@ func (can *canvas) getPixel(pos image.Point) (color.Color, error) {
 	return chunk.getPixel(pos)
 }
 
+// Returns the index of the color of a pixel in the known palette of the game.
+// Fails if there is no known palette, or if the color isn't part of it.
 func (can *canvas) getPixelIndex(pos image.Point) (uint8, error) {
-	chunkCoord := can.ChunkSize.getChunkCoord(pos, can.Origin)
+	col, err := can.getPixel(pos)
+	if err != nil {
+		return 0, err
+	}
 
-	chunk, err := can.getChunk(chunkCoord, false)
+	index := can.Palette.getIndex(col)
+	if index < 0 || index > 255 {
+		return 0, fmt.Errorf("Color %v at %v is not part of the palette", paletteHex(color.RGBAModel.Convert(col).(color.RGBA)), pos)
+	}
+
+	return uint8(index), nil
+}
+
+// Sets a pixel to the color of the given index of the known palette of the game
+func (can *canvas) setPixelIndex(pos image.Point, index uint8) error {
+	col, err := can.Palette.getColor(int(index))
 	if err != nil {
-		return 0, fmt.Errorf("Can't get chunk at %v: %v", pos, err)
+		return err
 	}
 
-	return chunk.getPixelIndex(pos)
+	return can.setPixel(pos, col)
 }
 
 func (can *canvas) setPixel(pos image.Point, col color.Color) error {
+	return can.setPixelAuthor(pos, col, "")
+}
+
+// Sets a pixel like setPixel, together with the identifier of the user that placed it.
+// The author is passed on to listeners, recordings and the pixel history
+func (can *canvas) setPixelAuthor(pos image.Point, col color.Color, author string) error {
 	can.ClosedMutex.RLock()
 	defer can.ClosedMutex.RUnlock()
 	if can.Closed {
 		return fmt.Errorf("Canvas is closed")
 	}
+	if !pos.In(can.Rect) {
+		return fmt.Errorf("Position %v is outside of the canvas %v", pos, can.Rect)
+	}
+
+	rgba := color.RGBAModel.Convert(col).(color.RGBA)
+	can.Palette.check(rgba)
+	index := can.Palette.getIndex(col) // Unknown colors were just added, so this only fails without known palette
 
 	// Forward event to broadcaster goroutine, even if there isn't a chunk. But send it after the chunk has been updated
 	defer func() {
-		can.EventChan <- canvasEventSetPixel{
-			Pos:   pos,
-			Color: col,
-		}
+		can.sendEvent(canvasEventSetPixel{
+			Pos:    pos,
+			Color:  col,
+			Index:  index,
+			Author: author,
+		})
 	}()
 
 	chunkCoord := can.ChunkSize.getChunkCoord(pos, can.Origin)
@@ -559,11 +1180,115 @@ func (can *canvas) setPixel(pos image.Point, col color.Color) error {
 		return fmt.Errorf("Can't get chunk at %v: %v", chunkCoord, err)
 	}
 
+	if can.history != nil {
+		can.addPixelChange(chunk, pos, rgba, author, can.now())
+	}
+
+	can.applyMutex.RLock()
+	defer can.applyMutex.RUnlock()
+
 	return chunk.setPixel(pos, col)
 }
 
+// Pixel of a batch of setPixels
+type pixelUpdate struct {
+	Pos    image.Point
+	Color  color.Color
+	Author string // Identifier of the user that placed the pixel, empty if the game doesn't report it
+}
+
+// Sets many pixels at once, e.g. for bursts of pixel updates of a game connection.
+// The chunks are looked up under a single lock, every chunk is locked once, and listeners get a single event.
+//
+// Pixels outside of the canvas or without chunk are skipped, the first error is returned after all other pixels are set.
+// The slice can be reused after the call returns.
+func (can *canvas) setPixels(pixels []pixelUpdate) error {
+	can.ClosedMutex.RLock()
+	defer can.ClosedMutex.RUnlock()
+	if can.Closed {
+		return fmt.Errorf("Canvas is closed")
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	var firstErr error
+	colors := make([]color.RGBA, 0, len(pixels))
+	for _, pixel := range pixels {
+		colors = append(colors, color.RGBAModel.Convert(pixel.Color).(color.RGBA))
+	}
+	can.Palette.check(colors...)
+
+	var now time.Time
+	if can.history != nil {
+		now = can.now()
+	}
+
+	// Group the pixels by chunk, in their order
+	event := canvasEventSetPixels{Pixels: make([]canvasEventSetPixel, 0, len(pixels))}
+	byChunk := map[chunkCoordinate][]pixelUpdate{}
+	var coords []chunkCoordinate
+	for i, pixel := range pixels {
+		if !pixel.Pos.In(can.Rect) {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Position %v is outside of the canvas %v", pixel.Pos, can.Rect)
+			}
+			continue
+		}
+		coord := can.ChunkSize.getChunkCoord(pixel.Pos, can.Origin)
+		if _, ok := byChunk[coord]; !ok {
+			coords = append(coords, coord)
+		}
+		byChunk[coord] = append(byChunk[coord], pixel)
+		event.Pixels = append(event.Pixels, canvasEventSetPixel{Pos: pixel.Pos, Color: pixel.Color, Index: can.Palette.getIndex(colors[i]), Author: pixel.Author})
+	}
+
+	// Forward event to broadcaster goroutine, even if there are no chunks. But send it after the chunks have been updated
+	defer func() {
+		if len(event.Pixels) > 0 {
+			can.sendEvent(event)
+		}
+	}()
+
+	chunks := make([]*chunk, len(coords))
+	can.RLock()
+	for i, coord := range coords {
+		chunks[i] = can.Chunks[coord]
+	}
+	spill := can.spill
+	can.RUnlock()
+
+	can.applyMutex.RLock()
+	defer can.applyMutex.RUnlock() // Before the event is sent
+
+	for i, coord := range coords {
+		chunk := chunks[i]
+		if chunk == nil && spill != nil {
+			chunk, _ = can.getChunk(coord, false) // The chunk may be spilled
+		} else if chunk != nil && spill != nil {
+			atomic.StoreUint32(&chunk.accessed, 1)
+		}
+		if chunk == nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Can't get chunk at %v: Chunk does not exist", coord)
+			}
+			continue
+		}
+		if can.history != nil {
+			for _, pixel := range byChunk[coord] {
+				can.addPixelChange(chunk, pixel.Pos, color.RGBAModel.Convert(pixel.Color).(color.RGBA), pixel.Author, now)
+			}
+		}
+		if err := chunk.setPixels(byChunk[coord]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
 // Will update the canvas with the given image.
-// Only chunks that are fully inside the image will be updated.
+// Only chunks that are fully inside the image will be updated, images that don't overlap the valid area of the canvas are rejected.
 // Chunks that have their download flag not set, will be ignored.
 //
 // This will validate the chunks, reset their download flag and replay any pixel events that happened while downloading.
@@ -575,35 +1300,57 @@ func (can *canvas) setImage(img image.Image, createIfNonexistent, ignoreNonexist
 		return fmt.Errorf("Canvas is closed")
 	}
 
+	if !img.Bounds().Overlaps(can.Rect) {
+		return fmt.Errorf("Image at %v is outside of the canvas %v", img.Bounds(), can.Rect)
+	}
+
 	chunkRect := can.ChunkSize.getInnerChunkRect(img.Bounds(), can.Origin)
 	chunks, err := can.getChunks(chunkRect, createIfNonexistent, ignoreNonexistent)
 	if err != nil {
 		return fmt.Errorf("Can't get chunks from rectangle %v: %v", img.Bounds(), err)
 	}
 
-	// Copy image, because the chunks will use a subimage of this copy. Otherwise the original image will be edited
-	imgCopy, err := copyImage(img)
+	// Chunks are stored paletted, RGBA images are only used if they have too many colors.
+	// The chunks copy their part of it, so it can be reused by the next event afterwards
+	imgCopy, err := copyImagePaletted(img)
 	if err != nil {
 		return fmt.Errorf("Can't copy image at %v: %v", img.Bounds(), err)
 	}
+	can.Palette.checkImage(imgCopy)
+	if rgba, ok := imgCopy.(*image.RGBA); ok && getChunkPolicy().PalettedOnly {
+		imgCopy = copyImagePalettedNearest(rgba)
+		releaseImage(rgba)
+	}
+	if paletted, ok := imgCopy.(*image.Paletted); ok {
+		can.Palette.remapImage(paletted) // Chunks use the indices of the game palette, if possible
+	}
+	defer releaseImage(imgCopy)
 
+	// Apply the image to all chunks at once, before any events are sent
+	events := make([]interface{}, 0, len(chunks))
+	can.applyMutex.RLock()
 	for _, chunk := range chunks {
 		resultImg, err := chunk.setImage(imgCopy)
 		if err != nil {
 			//return fmt.Errorf("Could not draw image at %v: %v", img.Bounds(), err)
 			continue
 		}
-		// Forward event to broadcaster goroutine. It needs to be sent after chunk manipulation to keep everything in sync
 		if resultImg != nil {
-			can.EventChan <- canvasEventSetImage{
+			events = append(events, canvasEventSetImage{
 				Image: resultImg,
-			}
+			})
 		} else {
-			can.EventChan <- canvasEventRevalidate{
+			events = append(events, canvasEventRevalidate{
 				Rect: chunk.Rect,
-			}
+			})
 		}
 	}
+	can.applyMutex.RUnlock()
+
+	// Forward events to broadcaster goroutine. They need to be sent after chunk manipulation to keep everything in sync
+	for _, event := range events {
+		can.sendEvent(event)
+	}
 
 	return nil
 }
@@ -611,13 +1358,13 @@ func (can *canvas) setImage(img image.Image, createIfNonexistent, ignoreNonexist
 // Get RGBA image of the given rectangle.
 // The resulting image can be in an inconsistent state when some chunks change while it's generated.
 // But each chunk itself will be consistent.
-// To get consistent updates, you should rather subscribe to the canvas change broadcast.
+// To get consistent updates, you should rather subscribe to the canvas change broadcast, or use getConsistentSnapshot.
 // If ignoreNonexistent is set to true, non existent chunks will be drawn transparent.
 // If onlyIfValid is set to true, the function will fail if there are invalid chunks inside.
 // If onlyIfValid is set to false, invalid chunks will be drawn transparent or with older data.
 func (can *canvas) getImageCopy(rect image.Rectangle, onlyIfValid, ignoreNonexistent bool) (*image.RGBA, error) {
 	chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
-	chunks, err := can.getChunks(chunkRect, false, ignoreNonexistent)
+	chunks, err := can.peekChunks(chunkRect, ignoreNonexistent) // Spilled chunks are streamed from disk, instead of loading them back
 	if err != nil {
 		return nil, fmt.Errorf("Can't get chunks from rectangle %v: %v", rect, err)
 	}
@@ -625,9 +1372,10 @@ func (can *canvas) getImageCopy(rect image.Rectangle, onlyIfValid, ignoreNonexis
 	img := image.NewRGBA(rect)
 
 	for _, chunk := range chunks {
-		imgCopy, _, _, err := chunk.getImageCopy(onlyIfValid)
+		chunkImg, _, _, err := chunk.getImage(onlyIfValid)
 		if err == nil {
-			draw.Draw(img, rect, imgCopy, rect.Min, draw.Over)
+			draw.Draw(img, rect, chunkImg.Image, rect.Min, draw.Over)
+			chunkImg.release()
 		} else if onlyIfValid {
 			return nil, fmt.Errorf("Can't get chunk image at %v: %v", chunk.Rect, err)
 		}
@@ -636,6 +1384,75 @@ func (can *canvas) getImageCopy(rect image.Rectangle, onlyIfValid, ignoreNonexis
 	return img, nil
 }
 
+// Returns the content of the given rectangle at a single point in time, for exports and analysis.
+//
+// Unlike getImageCopy, changes are frozen while the chunk images are retained, so no change is applied to some chunks but not to others.
+// The images are shared with the chunks, which copy them before they are modified again. So changes only wait for a moment.
+// Non existent chunks are drawn transparent, if onlyIfValid is set to true, the function fails if there are invalid chunks inside.
+//
+// The result is paletted, if all chunks share the same palette and cover the rectangle. Otherwise it's RGBA.
+func (can *canvas) getConsistentSnapshot(rect image.Rectangle, onlyIfValid bool) (image.Image, error) {
+	chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
+
+	handles := []*chunkImage{}
+	defer func() {
+		for _, handle := range handles {
+			handle.release()
+		}
+	}()
+
+	can.applyMutex.Lock()
+	chunks, err := can.peekChunks(chunkRect, true)
+	if err != nil {
+		can.applyMutex.Unlock()
+		return nil, fmt.Errorf("Can't get chunks from rectangle %v: %v", rect, err)
+	}
+	for _, chunk := range chunks {
+		handle, _, _, err := chunk.getImage(onlyIfValid)
+		if err != nil {
+			if onlyIfValid {
+				can.applyMutex.Unlock()
+				return nil, fmt.Errorf("Can't get chunk image at %v: %v", chunk.Rect, err)
+			}
+			continue
+		}
+		handles = append(handles, handle)
+	}
+	can.applyMutex.Unlock()
+
+	// Check if the result can be paletted
+	var palette color.Palette
+	covered := 0
+	for i, handle := range handles {
+		img, ok := handle.Image.(*image.Paletted)
+		if !ok || i > 0 && !isPaletteEqual(palette, img.Palette) {
+			palette = nil
+			break
+		}
+		palette = img.Palette
+		covered += rect.Intersect(img.Rect).Dx() * rect.Intersect(img.Rect).Dy()
+	}
+
+	if palette != nil && covered == rect.Dx()*rect.Dy() {
+		img := image.NewPaletted(rect, append(color.Palette(nil), palette...))
+		for _, handle := range handles {
+			src := handle.Image.(*image.Paletted)
+			r := rect.Intersect(src.Rect)
+			for iy := r.Min.Y; iy < r.Max.Y; iy++ {
+				copy(img.Pix[img.PixOffset(r.Min.X, iy):img.PixOffset(r.Max.X, iy)], src.Pix[src.PixOffset(r.Min.X, iy):src.PixOffset(r.Max.X, iy)])
+			}
+		}
+		return img, nil
+	}
+
+	img := image.NewRGBA(rect)
+	for _, handle := range handles {
+		draw.Draw(img, rect, handle.Image, rect.Min, draw.Over)
+	}
+
+	return img, nil
+}
+
 // Invalidates all chunks the rectangle intersects with.
 // This will only affect existing chunks.
 //
@@ -649,9 +1466,9 @@ func (can *canvas) invalidateRect(rect image.Rectangle) error {
 
 	// Forward event to broadcaster goroutine. But send after chunks have been invalidated
 	defer func() {
-		can.EventChan <- canvasEventInvalidateRect{
+		can.sendEvent(canvasEventInvalidateRect{
 			Rect: rect,
-		}
+		})
 	}()
 
 	chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
@@ -660,6 +1477,9 @@ func (can *canvas) invalidateRect(rect image.Rectangle) error {
 		return fmt.Errorf("Can't get chunks from rectangle %v: %v", rect, err)
 	}
 
+	can.applyMutex.RLock()
+	defer can.applyMutex.RUnlock() // Before the event is sent
+
 	for _, chunk := range chunks {
 		chunk.invalidateImage()
 	}
@@ -679,9 +1499,9 @@ func (can *canvas) revalidateRect(rect image.Rectangle) error {
 
 	// Forward event to broadcaster goroutine. But send after chunks have been revalidated
 	defer func() {
-		can.EventChan <- canvasEventRevalidate{
+		can.sendEvent(canvasEventRevalidate{
 			Rect: rect,
-		}
+		})
 	}()
 
 	chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
@@ -690,6 +1510,9 @@ func (can *canvas) revalidateRect(rect image.Rectangle) error {
 		return fmt.Errorf("Can't get chunks from rectangle %v: %v", rect, err)
 	}
 
+	can.applyMutex.RLock()
+	defer can.applyMutex.RUnlock() // Before the event is sent
+
 	for _, chunk := range chunks {
 		chunk.revalidate()
 	}
@@ -710,16 +1533,27 @@ func (can *canvas) invalidateAll() error {
 
 	chunks := can.getAllChunks()
 
+	can.applyMutex.RLock()
 	for _, chunk := range chunks {
 		chunk.invalidateImage()
 	}
+	can.applyMutex.RUnlock()
+	if spill := can.getSpill(); spill != nil {
+		spill.invalidateAll()
+	}
 
 	// Forward event to broadcaster goroutine
-	can.EventChan <- canvasEventInvalidateAll{}
+	can.sendEvent(canvasEventInvalidateAll{})
 
 	return nil
 }
 
+// Returns the number of chunk download requests that were dropped, because the game connection couldn't keep up.
+// Dropped requests are sent again after canvasChunkRetryInterval.
+func (can *canvas) getDroppedChunkRequests() uint64 {
+	return atomic.LoadUint64(&can.droppedRequests)
+}
+
 // Sets the current time of the canvas
 func (can *canvas) setTime(t time.Time) error {
 	can.ClosedMutex.RLock()
@@ -733,13 +1567,45 @@ func (can *canvas) setTime(t time.Time) error {
 	can.Unlock()
 
 	// Forward event to broadcaster goroutine
-	can.EventChan <- canvasEventSetTime{
+	can.sendEvent(canvasEventSetTime{
 		Time: t,
-	}
+	})
 
 	return nil
 }
 
+// Returns the time that changes of the canvas happen at.
+// That's the time set by replays or mirrored canvases, otherwise the time of the game server
+func (can *canvas) now() time.Time {
+	can.RLock()
+	t := can.Time
+	can.RUnlock()
+	if !t.IsZero() {
+		return t
+	}
+
+	return can.Clock.now()
+}
+
+// Returns the last changes of the pixel at pos, the newest first.
+// Changes are only kept if PixelHistory of the chunk policy was set when the canvas was created.
+// They are kept by the chunk of the pixel, so there are none if it was deleted or evicted since.
+func (can *canvas) getPixelHistory(pos image.Point) ([]canvasPixelChange, error) {
+	if can.history == nil {
+		return nil, fmt.Errorf("Pixel history is not enabled, see PixelHistory at chunks in the configuration")
+	}
+	if !pos.In(can.Rect) {
+		return nil, fmt.Errorf("Position %v is outside of the canvas %v", pos, can.Rect)
+	}
+
+	chunk, err := can.getChunk(can.ChunkSize.getChunkCoord(pos, can.Origin), false)
+	if err != nil {
+		return []canvasPixelChange{}, nil
+	}
+
+	return chunk.getPixelChanges(pos), nil
+}
+
 // Gets the current time of the canvas
 func (can *canvas) getTime() (time.Time, error) {
 	can.ClosedMutex.RLock()
@@ -763,7 +1629,29 @@ func (can *canvas) isValid(rect image.Rectangle) bool {
 	}
 
 	for _, chunk := range chunks {
-		if !chunk.Valid {
+		if !chunk.isValid() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Waits until all chunks intersecting with rect are valid and existent, or until the timeout is reached.
+// Returns false if that didn't happen in time, or if cancel was closed.
+//
+// This doesn't request any chunks, someone has to register the rectangle as listener rectangle for them to be downloaded.
+func (can *canvas) waitValid(rect image.Rectangle, timeout time.Duration, cancel <-chan struct{}) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timeoutChan := time.After(timeout)
+
+	for !can.isValid(rect) {
+		select {
+		case <-ticker.C:
+		case <-timeoutChan:
+			return false
+		case <-cancel:
 			return false
 		}
 	}
@@ -782,18 +1670,23 @@ func (can *canvas) isValid(rect image.Rectangle) bool {
 //
 // For some game APIs it may not be necessary, as they send data serially.
 // But signalDownload() must always be used, because otherwise the canvas would retrigger the download several times in a row on an invalid chunk.
+//
+// The rectangle is clipped to the valid area of the canvas.
 func (can *canvas) signalDownload(rect image.Rectangle) ([]*chunk, error) {
 	can.ClosedMutex.RLock()
 	defer can.ClosedMutex.RUnlock()
 	if can.Closed {
 		return nil, fmt.Errorf("Canvas is closed")
 	}
+	if rect = rect.Canon().Intersect(can.Rect); rect.Empty() {
+		return nil, fmt.Errorf("Rectangle is outside of the canvas %v", can.Rect)
+	}
 
 	// Forward event to broadcaster goroutine. But send after chunks have been flagged
 	defer func() {
-		can.EventChan <- canvasEventSignalDownload{
+		can.sendEvent(canvasEventSignalDownload{
 			Rect: rect,
-		}
+		})
 	}()
 
 	chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
@@ -813,12 +1706,99 @@ func (can *canvas) signalDownload(rect image.Rectangle) ([]*chunk, error) {
 	return downloading, nil
 }
 
-func (can *canvas) Close() {
+// Signals that the download of the chunks in rect failed, so they can be downloaded again after a backoff.
+// Only chunks that are still downloading are affected.
+func (can *canvas) signalDownloadFailed(rect image.Rectangle, reason error) error {
 	can.ClosedMutex.RLock()
-	can.Closed = true // Prevent any new events from happening
-	can.ClosedMutex.RUnlock()
+	defer can.ClosedMutex.RUnlock()
+	if can.Closed {
+		return fmt.Errorf("Canvas is closed")
+	}
+
+	chunkRect := can.ChunkSize.getOuterChunkRect(rect, can.Origin)
+	chunks, err := can.getChunks(chunkRect, false, true)
+	if err != nil {
+		return fmt.Errorf("Can't get chunks from rectangle %v: %v", rect, err)
+	}
 
-	close(can.EventChan) // This will stop the goroutine after all events are processed
+	for _, chunk := range chunks {
+		failures := chunk.signalDownloadFailed(reason.Error())
+		if failures == 0 {
+			continue
+		}
+		if failures == chunkDownloadPersistentFailures {
+			canvasLog.Warnf("Download of chunk %v failed %v times in a row: %v", chunk.Rect, failures, reason)
+		}
+		can.sendEvent(canvasEventDownloadFailed{
+			Rect:     chunk.Rect,
+			Failures: failures,
+			Reason:   reason.Error(),
+		})
+	}
+
+	return nil
+}
+
+// A chunk whose last download failed
+type chunkDownloadFailure struct {
+	Rect       image.Rectangle `json:"rect"`
+	Failures   int             `json:"failures"` // Failed downloads in a row
+	Reason     string          `json:"reason"`   // Error of the last failed download
+	Time       time.Time       `json:"time"`     // Time of the last failed download
+	RetryTime  time.Time       `json:"retryTime"`
+	Persistent bool            `json:"persistent"` // Set once the downloads failed chunkDownloadPersistentFailures times in a row
+}
+
+// Returns the chunks whose last download failed, the ones with the most failures first
+func (can *canvas) getDownloadFailures() []chunkDownloadFailure {
+	result := []chunkDownloadFailure{}
+	for _, chunk := range can.getAllChunks() {
+		failures, reason, last, retry := chunk.getDownloadFailures()
+		if failures == 0 {
+			continue
+		}
+		result = append(result, chunkDownloadFailure{
+			Rect:       chunk.Rect,
+			Failures:   failures,
+			Reason:     reason,
+			Time:       last,
+			RetryTime:  retry,
+			Persistent: failures >= chunkDownloadPersistentFailures,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Failures != result[j].Failures {
+			return result[i].Failures > result[j].Failures
+		}
+		return result[i].Rect.Min.Y < result[j].Rect.Min.Y || result[i].Rect.Min.Y == result[j].Rect.Min.Y && result[i].Rect.Min.X < result[j].Rect.Min.X
+	})
+
+	return result
+}
+
+// Close stops the canvas, and returns after all listeners got the events that were sent before.
+// It's safe to call this several times, or concurrently.
+//
+// Don't call this function from the handlers of a listener, or it will cause a deadlock.
+func (can *canvas) Close() {
+	can.ClosedMutex.Lock()
+	if can.Closed {
+		can.ClosedMutex.Unlock()
+		<-can.closedChan
+		return
+	}
+	can.Closed = true // Prevent any new events from happening. Senders hold the read lock, so none of them is in the middle of sending
+	can.ClosedMutex.Unlock()
+
+	memoryUnregisterCanvas(can)
+
+	can.overflow.WaitGroup.Wait() // The broadcaster takes the overflow once it processed everything before it
+	close(can.EventChan)          // This will stop the goroutine after all events are processed
+	<-can.closedChan
+
+	if spill := can.getSpill(); spill != nil {
+		spill.close()
+	}
 
 	return
 }
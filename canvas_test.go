@@ -17,11 +17,404 @@
 package main
 
 import (
+	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test_newCanvas(t *testing.T) {
 	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
 	defer can.Close()
 }
+
+func Test_rectQueryQueue(t *testing.T) {
+	q := newRectQueryQueue()
+
+	a, b := image.Rect(0, 0, 64, 64), image.Rect(64, 0, 128, 64)
+	for i := 0; i < 1000; i++ {
+		q.push(a)
+		q.push(b)
+	}
+
+	for _, want := range []image.Rectangle{a, b} {
+		select {
+		case <-q.Signal:
+		default:
+			t.Fatalf("Queue didn't signal pending rectangle %v", want)
+		}
+		if got, ok := q.pop(); !ok || got != want {
+			t.Errorf("pop() = %v, %v, want %v", got, ok, want)
+		}
+	}
+
+	select {
+	case <-q.Signal:
+		t.Errorf("Empty queue signaled")
+	default:
+	}
+	if _, ok := q.pop(); ok {
+		t.Errorf("Empty queue returned a rectangle")
+	}
+
+	// Popped rectangles can be queued again
+	q.push(a)
+	if got, ok := q.pop(); !ok || got != a {
+		t.Errorf("pop() = %v, %v, want %v", got, ok, a)
+	}
+}
+
+// Listener that records its virtual chunks and the chunk IDs of set pixels
+type testChunkListener struct {
+	sync.Mutex
+	chunks    map[image.Rectangle]int
+	pixelVCID map[image.Point]int
+}
+
+func (l *testChunkListener) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	l.Lock()
+	defer l.Unlock()
+	for rect := range remove {
+		delete(l.chunks, rect)
+	}
+	for rect, id := range create {
+		l.chunks[rect] = id
+	}
+	return nil
+}
+func (l *testChunkListener) handleInvalidateAll() error                                   { return nil }
+func (l *testChunkListener) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error { return nil }
+func (l *testChunkListener) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+func (l *testChunkListener) handleSignalDownload(rect image.Rectangle, vcIDs []int) error { return nil }
+func (l *testChunkListener) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error { return nil }
+func (l *testChunkListener) handleSetTime(t time.Time) error                              { return nil }
+
+func (l *testChunkListener) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	l.Lock()
+	defer l.Unlock()
+	l.pixelVCID[pos] = vcID
+	return nil
+}
+
+func Test_canvasVirtualChunks(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	l := &testChunkListener{chunks: map[image.Rectangle]int{}, pixelVCID: map[image.Point]int{}}
+	can.subscribeListener(l, true)
+
+	// Overlapping rectangles share their chunks
+	can.registerRects(l, []image.Rectangle{image.Rect(0, 0, 100, 10), image.Rect(10, 0, 20, 10)})
+	can.registerRects(l, []image.Rectangle{image.Rect(0, 0, 100, 10), image.Rect(64, 64, 65, 65)})
+
+	for _, pos := range []image.Point{{1, 1}, {70, 5}, {64, 64}, {200, 200}} {
+		can.setPixel(pos, pixelcanvasioPalette[5])
+	}
+
+	can.unsubscribeListener(l)
+
+	want := map[image.Rectangle]int{image.Rect(0, 0, 64, 64): 1, image.Rect(64, 0, 128, 64): 2, image.Rect(64, 64, 128, 128): 3}
+	if len(l.chunks) != len(want) {
+		t.Fatalf("Listener has chunks %v, want %v", l.chunks, want)
+	}
+	for rect, id := range want {
+		if l.chunks[rect] != id {
+			t.Errorf("Chunk %v has ID %v, want %v", rect, l.chunks[rect], id)
+		}
+	}
+
+	wantPixels := map[image.Point]int{{1, 1}: 1, {70, 5}: 2, {64, 64}: 3} // Pixels outside of the chunks aren't sent
+	if len(l.pixelVCID) != len(wantPixels) {
+		t.Fatalf("Listener got pixels %v, want %v", l.pixelVCID, wantPixels)
+	}
+	for pos, id := range wantPixels {
+		if l.pixelVCID[pos] != id {
+			t.Errorf("Pixel %v has chunk ID %v, want %v", pos, l.pixelVCID[pos], id)
+		}
+	}
+}
+
+func Test_canvasRect(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-100, -100, 100, 100))
+	defer can.Close()
+
+	// Only chunks that overlap the canvas are created
+	if _, err := can.signalDownload(image.Rect(-1000, -1000, 1000, 1000)); err != nil {
+		t.Fatalf("Can't signal download: %v", err)
+	}
+	if chunks := can.getAllChunks(); len(chunks) != 16 {
+		t.Errorf("Canvas has %v chunks, want 16", len(chunks))
+	}
+	if _, err := can.signalDownload(image.Rect(500, 500, 600, 600)); err == nil {
+		t.Errorf("Signalled download outside of the canvas")
+	}
+	if _, err := can.getChunk(chunkCoordinate{10, 10}, true); err == nil {
+		t.Errorf("Created chunk outside of the canvas")
+	}
+	if chunks := can.getAllChunks(); len(chunks) != 16 {
+		t.Errorf("Canvas has %v chunks, want 16", len(chunks))
+	}
+
+	if err := can.setImage(image.NewPaletted(image.Rect(1000, 1000, 1064, 1064), pixelcanvasioPalette), true, false); err == nil {
+		t.Errorf("Set image outside of the canvas")
+	}
+	if err := can.setImage(image.NewPaletted(image.Rect(-128, -128, 128, 128), pixelcanvasioPalette), false, false); err != nil {
+		t.Errorf("Can't set image that overlaps the canvas: %v", err)
+	}
+
+	if err := can.setPixel(image.Point{100, 0}, pixelcanvasioPalette[5]); err == nil {
+		t.Errorf("Set pixel outside of the canvas")
+	}
+	if err := can.setPixel(image.Point{99, -100}, pixelcanvasioPalette[5]); err != nil {
+		t.Errorf("Can't set pixel inside of the canvas: %v", err)
+	}
+
+	// Listener rectangles are clipped
+	l := &testChunkListener{chunks: map[image.Rectangle]int{}, pixelVCID: map[image.Point]int{}}
+	can.subscribeListener(l, true)
+	can.registerRects(l, []image.Rectangle{image.Rect(90, 90, 1000000, 1000000), image.Rect(200, 200, 300, 300)})
+	can.unsubscribeListener(l)
+	if len(l.chunks) != 1 || l.chunks[image.Rect(64, 64, 128, 128)] == 0 {
+		t.Errorf("Listener has chunks %v, want only the one at %v", l.chunks, image.Rect(64, 64, 128, 128))
+	}
+}
+
+func Test_canvasListenerStateChunkRects(t *testing.T) {
+	state := &canvasListenerState{Rects: []image.Rectangle{image.Rect(0, 0, 100, 10), image.Rect(-10, 64, 0, 65)}}
+
+	chunkRects, bounds := state.getChunkRects(pixelSize{64, 64}, image.Point{})
+	if len(chunkRects) != 2 || chunkRects[0] != (chunkRectangle{image.Rect(0, 0, 2, 1)}) || chunkRects[1] != (chunkRectangle{image.Rect(-1, 1, 0, 2)}) {
+		t.Errorf("Chunk rectangles = %v", chunkRects)
+	}
+	if bounds != (chunkRectangle{image.Rect(-1, 0, 2, 2)}) {
+		t.Errorf("Chunk bounds = %v, want %v", bounds, image.Rect(-1, 0, 2, 2))
+	}
+
+	// The cache is kept until the rectangles or the chunk grid change
+	state.Rects = []image.Rectangle{image.Rect(0, 0, 1, 1)}
+	if _, bounds := state.getChunkRects(pixelSize{64, 64}, image.Point{}); bounds != (chunkRectangle{image.Rect(-1, 0, 2, 2)}) {
+		t.Errorf("Chunk bounds were computed again without being out of date: %v", bounds)
+	}
+	state.chunkRectsOutOfDate = true
+	if _, bounds := state.getChunkRects(pixelSize{64, 64}, image.Point{}); bounds != (chunkRectangle{image.Rect(0, 0, 1, 1)}) {
+		t.Errorf("Chunk bounds after changing the rectangles = %v, want %v", bounds, image.Rect(0, 0, 1, 1))
+	}
+	if _, bounds := state.getChunkRects(pixelSize{64, 64}, image.Point{64, 0}); bounds != (chunkRectangle{image.Rect(1, 0, 2, 1)}) {
+		t.Errorf("Chunk bounds after changing the origin = %v, want %v", bounds, image.Rect(1, 0, 2, 1))
+	}
+	if _, bounds := state.getChunkRects(pixelSize{1, 1}, image.Point{}); bounds != (chunkRectangle{image.Rect(0, 0, 1, 1)}) {
+		t.Errorf("Chunk bounds after changing the chunk size = %v, want %v", bounds, image.Rect(0, 0, 1, 1))
+	}
+	state.Rects = []image.Rectangle{image.Rect(0, 0, 2, 2)}
+	if _, bounds := state.getChunkRects(pixelSize{2, 2}, image.Point{1, 1}); bounds != (chunkRectangle{image.Rect(0, 0, 2, 2)}) {
+		t.Errorf("Chunk bounds after changing the chunk size and origin = %v, want %v", bounds, image.Rect(0, 0, 2, 2))
+	}
+}
+
+func Test_canvasChunkRequestRetry(t *testing.T) {
+	defer setChunkPolicy(getChunkPolicy())
+	setChunkPolicy(chunkPolicySettings{IdleTimeout: "5m", RequestQueueSize: 1})
+
+	can, requests := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	l := &testNullListener{}
+	can.subscribeListener(l, false)
+	defer can.unsubscribeListener(l)
+	can.registerRects(l, []image.Rectangle{image.Rect(0, 0, 128, 128)})
+
+	// Only one request fits into the queue, the others are dropped and retried before the regular query of all chunks
+	received := map[image.Rectangle]bool{}
+	timeout := time.After(5 * time.Second)
+	for len(received) < 4 {
+		select {
+		case chunk := <-requests:
+			received[chunk.Rect] = true
+			chunk.Lock()
+			chunk.Downloading = true // Like a connection that is downloading the chunk
+			chunk.Unlock()
+		case <-timeout:
+			t.Fatalf("Got requests for %v chunks, want 4", len(received))
+		}
+	}
+
+	if dropped := can.getDroppedChunkRequests(); dropped == 0 {
+		t.Errorf("No chunk requests were dropped")
+	}
+}
+
+// Listener that records the failed chunk downloads it's told about
+type testDownloadFailureListener struct {
+	testNullListener
+
+	sync.Mutex
+	failures map[image.Rectangle]int
+}
+
+func (l *testDownloadFailureListener) handleDownloadFailed(rect image.Rectangle, failures int, reason string, persistent bool, vcIDs []int) error {
+	l.Lock()
+	defer l.Unlock()
+
+	l.failures[rect] = failures
+	return nil
+}
+
+func Test_canvasDownloadFailures(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	l := &testDownloadFailureListener{failures: map[image.Rectangle]int{}}
+	can.subscribeListener(l, false)
+	defer can.unsubscribeListener(l)
+
+	if _, err := can.signalDownload(image.Rect(0, 0, 128, 64)); err != nil {
+		t.Fatalf("Can't signal download: %v", err)
+	}
+	if err := can.signalDownloadFailed(image.Rect(0, 0, 128, 64), fmt.Errorf("Got status %q", "503 Service Unavailable")); err != nil {
+		t.Fatalf("Can't signal failed download: %v", err)
+	}
+
+	failures := can.getDownloadFailures()
+	if len(failures) != 2 || failures[0].Rect != image.Rect(0, 0, 64, 64) || failures[0].Failures != 1 || failures[0].Persistent {
+		t.Errorf("Got failures %v, want two chunks that failed once", failures)
+	}
+
+	waitFor(t, 5*time.Second, "the listener to get the failures", func() bool {
+		l.Lock()
+		defer l.Unlock()
+		return len(l.failures) == 2
+	})
+}
+
+// Recorder that ignores all events
+type testRecorder struct {
+	testNullListener
+}
+
+func (r *testRecorder) setListeningRects(rects []image.Rectangle) error { return nil }
+func (r *testRecorder) Close()                                          {}
+
+func Test_canvasChunkPolicy(t *testing.T) {
+	defer setChunkPolicy(getChunkPolicy())
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	inside, outside := newChunk(image.Rect(0, 0, 64, 64)), newChunk(image.Rect(640, 0, 704, 64))
+
+	viewer := &testChunkListener{chunks: map[image.Rectangle]int{}, pixelVCID: map[image.Point]int{}}
+	if err := can.subscribeListener(viewer, true); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+	defer can.unsubscribeListener(viewer)
+	can.registerRects(viewer, []image.Rectangle{image.Rect(0, 0, 128, 128)})
+
+	// Subscribing waits until the broadcaster has handled everything before
+	recorder := &testRecorder{}
+	if err := can.subscribeListener(recorder, false); err != nil {
+		t.Fatalf("Can't subscribe recorder: %v", err)
+	}
+
+	tests := []struct {
+		policy          chunkPolicySettings
+		inside, outside time.Duration
+	}{
+		{chunkPolicySettings{IdleTimeout: "5m"}, 5 * time.Minute, 5 * time.Minute},
+		{chunkPolicySettings{IdleTimeout: "0"}, 0, 0},
+		{chunkPolicySettings{IdleTimeout: "1m", KeepInRects: true}, 0, time.Minute},
+		{chunkPolicySettings{IdleTimeout: "1m", KeepRecorded: true}, 0, 0},
+	}
+
+	for _, test := range tests {
+		setChunkPolicy(test.policy)
+		if got := can.getChunkIdleTimeout(inside); got != test.inside {
+			t.Errorf("Idle timeout of chunk inside of rects with %+v = %v, want %v", test.policy, got, test.inside)
+		}
+		if got := can.getChunkIdleTimeout(outside); got != test.outside {
+			t.Errorf("Idle timeout of chunk outside of rects with %+v = %v, want %v", test.policy, got, test.outside)
+		}
+	}
+
+	// Without recorders, chunks are deleted again
+	if err := can.unsubscribeListener(recorder); err != nil {
+		t.Fatalf("Can't unsubscribe recorder: %v", err)
+	}
+	setChunkPolicy(chunkPolicySettings{IdleTimeout: "1m", KeepRecorded: true})
+	if got := can.getChunkIdleTimeout(outside); got != time.Minute {
+		t.Errorf("Idle timeout without recorders = %v, want %v", got, time.Minute)
+	}
+}
+
+func Test_canvasConsistentSnapshot(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+	can.Palette.setPalette(pixelcanvasioPalette)
+
+	rect := image.Rect(0, 0, 128, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+	can.setPixel(image.Point{20, 20}, pixelcanvasioPalette[5])
+
+	// Chunks with the same palette result in a paletted image
+	snapshotRect := image.Rect(10, 10, 100, 50)
+	img, err := can.getConsistentSnapshot(snapshotRect, true)
+	if err != nil {
+		t.Fatalf("Can't get snapshot: %v", err)
+	}
+	if _, ok := img.(*image.Paletted); !ok {
+		t.Errorf("Snapshot is %T, want *image.Paletted", img)
+	}
+	want, _ := can.getImageCopy(snapshotRect, true, false)
+	rgba := image.NewRGBA(snapshotRect)
+	draw.Draw(rgba, snapshotRect, img, snapshotRect.Min, draw.Src)
+	if !compareImages(rgba, want) {
+		t.Errorf("Snapshot differs from the copy of the canvas")
+	}
+
+	// Missing chunks are transparent, and the result is RGBA
+	img, err = can.getConsistentSnapshot(image.Rect(100, 0, 200, 10), false)
+	if err != nil {
+		t.Fatalf("Can't get snapshot: %v", err)
+	}
+	if rgba, ok := img.(*image.RGBA); !ok || rgba.RGBAAt(150, 5).A != 0 || rgba.RGBAAt(110, 5) != pixelcanvasioPalette[0] {
+		t.Errorf("Got %T with %v at the missing chunk, want *image.RGBA with transparency", img, img.At(150, 5))
+	}
+
+	can.invalidateRect(image.Rect(64, 0, 65, 1))
+	if _, err := can.getConsistentSnapshot(snapshotRect, true); err == nil {
+		t.Errorf("Snapshot of an invalid chunk didn't fail")
+	}
+	can.revalidateRect(image.Rect(64, 0, 65, 1))
+
+	// Batches of pixels are never half visible
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			col := pixelcanvasioPalette[i%len(pixelcanvasioPalette)]
+			can.setPixels([]pixelUpdate{{Pos: image.Point{0, 0}, Color: col}, {Pos: image.Point{64, 0}, Color: col}, {Pos: image.Point{0, 63}, Color: col}, {Pos: image.Point{64, 63}, Color: col}})
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		img, err := can.getConsistentSnapshot(image.Rect(0, 0, 128, 64), true)
+		if err != nil {
+			t.Fatalf("Can't get snapshot: %v", err)
+		}
+		if a, b := img.At(0, 0), img.At(64, 63); color.RGBAModel.Convert(a) != color.RGBAModel.Convert(b) {
+			t.Fatalf("Snapshot contains half of a batch: %v and %v", a, b)
+		}
+	}
+	close(quit)
+	<-done
+}
@@ -0,0 +1,130 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"time"
+)
+
+// Recordings at a point in time, one side of a diff
+type canvasDiffSource struct {
+	Name string    // Short name of a game, address of a remote instance or clip file. See canvasDiskReaderFor()
+	Time time.Time // Zero for the end of the recordings
+}
+
+// Parses a source in the form "<recordings>@<RFC3339 time>". Without time, the end of the recordings is used
+func parseCanvasDiffSource(s string) (canvasDiffSource, error) {
+	// Addresses may contain an @ as well, so only split at the last one if a time follows
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		if t, err := time.Parse(time.RFC3339, s[i+1:]); err == nil {
+			s = s[:i]
+			if s == "" {
+				return canvasDiffSource{}, fmt.Errorf("Missing recordings in front of the time")
+			}
+			return canvasDiffSource{Name: s, Time: t}, nil
+		}
+	}
+	if s == "" {
+		return canvasDiffSource{}, fmt.Errorf("Missing recordings")
+	}
+	return canvasDiffSource{Name: s}, nil
+}
+
+func (src canvasDiffSource) String() string {
+	if src.Time.IsZero() {
+		return src.Name
+	}
+	return src.Name + "@" + src.Time.Format(time.RFC3339)
+}
+
+// Returns the image of the given rectangle of the source, and the point in time it shows
+func (src canvasDiffSource) getImage(rect image.Rectangle) (*image.RGBA, time.Time, error) {
+	cfe, err := newCanvasFrameExtractor(src.Name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer cfe.Close()
+
+	t := src.Time
+	if t.IsZero() {
+		_, t = cfe.getTimeRange()
+		t = t.Add(-time.Nanosecond) // The end time itself isn't part of the recordings
+	}
+
+	img, err := cfe.getFrame(t, rect)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("Can't get image of %v: %v", src, err)
+	}
+	return img, t, nil
+}
+
+// Result of a comparison of two canvas images.
+// Pixels without data are transparent, they are only compared if both sides have data.
+type canvasDiffSummary struct {
+	A, B          string          // Sources of the images
+	TimeA, TimeB  time.Time       // Points in time of the images
+	Rect          image.Rectangle // Compared rectangle
+	Pixels        int             // Number of pixels in the rectangle
+	Equal         int             // Pixels with data on both sides, that are equal
+	Different     int             // Pixels with data on both sides, that differ
+	OnlyA, OnlyB  int             // Pixels that only have data on one side
+	Missing       int             // Pixels without data on both sides
+	DifferentRect image.Rectangle // Bounds of all differing pixels, including the ones with data on one side only
+}
+
+// Compares two images of the same rectangle pixel by pixel.
+//
+// Returns the summary and an image of the differences:
+// Equal pixels are darkened, differing ones are red, and pixels with data on one side only are magenta.
+func canvasDiff(a, b *image.RGBA) (canvasDiffSummary, *image.RGBA) {
+	rect := a.Rect.Intersect(b.Rect)
+	summary := canvasDiffSummary{Rect: rect, Pixels: rect.Dx() * rect.Dy()}
+	diff := image.NewRGBA(rect)
+
+	for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+		for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+			ca, cb := a.RGBAAt(ix, iy), b.RGBAAt(ix, iy)
+			var c color.RGBA
+			switch {
+			case ca.A == 0 && cb.A == 0:
+				summary.Missing++
+				continue
+			case cb.A == 0:
+				summary.OnlyA++
+				c = color.RGBA{255, 0, 255, 255}
+			case ca.A == 0:
+				summary.OnlyB++
+				c = color.RGBA{255, 0, 255, 255}
+			case ca == cb:
+				summary.Equal++
+				diff.SetRGBA(ix, iy, color.RGBA{ca.R / 3, ca.G / 3, ca.B / 3, ca.A})
+				continue
+			default:
+				summary.Different++
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			diff.SetRGBA(ix, iy, c)
+			summary.DifferentRect = summary.DifferentRect.Union(image.Rect(ix, iy, ix+1, iy+1))
+		}
+	}
+
+	return summary, diff
+}
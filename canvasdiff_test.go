@@ -0,0 +1,116 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func Test_parseCanvasDiffSource(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    canvasDiffSource
+		wantErr bool
+	}{
+		{"pixelcanvas.io", canvasDiffSource{Name: "pixelcanvas.io"}, false},
+		{"pixelcanvas.io@2019-06-14T12:00:00Z", canvasDiffSource{Name: "pixelcanvas.io", Time: time.Date(2019, 6, 14, 12, 0, 0, 0, time.UTC)}, false},
+		{"http://user@host:8081", canvasDiffSource{Name: "http://user@host:8081"}, false},
+		{"http://user@host:8081@2019-06-14T12:00:00Z", canvasDiffSource{Name: "http://user@host:8081", Time: time.Date(2019, 6, 14, 12, 0, 0, 0, time.UTC)}, false},
+		{"@2019-06-14T12:00:00Z", canvasDiffSource{}, true},
+		{"", canvasDiffSource{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCanvasDiffSource(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCanvasDiffSource(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got.Name != tt.want.Name || !got.Time.Equal(tt.want.Time) {
+			t.Errorf("parseCanvasDiffSource(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func Test_canvasDiff(t *testing.T) {
+	rect := image.Rect(10, 10, 14, 12)
+	a, b := image.NewRGBA(rect), image.NewRGBA(rect)
+	white, black := color.RGBA{255, 255, 255, 255}, color.RGBA{0, 0, 0, 255}
+
+	// Row 10: equal, different, only a, missing
+	a.SetRGBA(10, 10, white)
+	b.SetRGBA(10, 10, white)
+	a.SetRGBA(11, 10, white)
+	b.SetRGBA(11, 10, black)
+	a.SetRGBA(12, 10, white)
+	// Row 11: only b, equal, equal, equal
+	b.SetRGBA(10, 11, black)
+	for ix := 11; ix < 14; ix++ {
+		a.SetRGBA(ix, 11, black)
+		b.SetRGBA(ix, 11, black)
+	}
+
+	summary, diff := canvasDiff(a, b)
+
+	want := canvasDiffSummary{Rect: rect, Pixels: 8, Equal: 4, Different: 1, OnlyA: 1, OnlyB: 1, Missing: 1, DifferentRect: image.Rect(10, 10, 13, 12)}
+	if summary != want {
+		t.Errorf("canvasDiff() = %+v, want %+v", summary, want)
+	}
+
+	if got, want := diff.RGBAAt(11, 10), (color.RGBA{255, 0, 0, 255}); got != want {
+		t.Errorf("Differing pixel = %v, want %v", got, want)
+	}
+	if got, want := diff.RGBAAt(12, 10), (color.RGBA{255, 0, 255, 255}); got != want {
+		t.Errorf("Pixel only in a = %v, want %v", got, want)
+	}
+	if got, want := diff.RGBAAt(10, 10), (color.RGBA{85, 85, 85, 255}); got != want {
+		t.Errorf("Equal pixel = %v, want %v", got, want)
+	}
+	if got := diff.RGBAAt(13, 10); got.A != 0 {
+		t.Errorf("Missing pixel = %v, want transparent", got)
+	}
+}
+
+func Test_canvasDiffSource(t *testing.T) {
+	rect, _, _ := writeTestRecording(t, "Test-Diff")
+
+	// The end of the recordings compared with itself
+	src := canvasDiffSource{Name: "Test-Diff"}
+	imgA, _, err := src.getImage(rect)
+	if err != nil {
+		t.Fatalf("Can't get image of %v: %v", src, err)
+	}
+	imgB, _, err := src.getImage(rect)
+	if err != nil {
+		t.Fatalf("Can't get image of %v: %v", src, err)
+	}
+	if summary, _ := canvasDiff(imgA, imgB); summary.Equal != summary.Pixels {
+		t.Errorf("canvasDiff() = %+v, want all %v pixels equal", summary, summary.Pixels)
+	}
+
+	// Before the recordings start there is no data
+	before := canvasDiffSource{Name: "Test-Diff", Time: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)}
+	imgB, _, err = before.getImage(rect)
+	if err != nil {
+		t.Fatalf("Can't get image of %v: %v", before, err)
+	}
+	if summary, _ := canvasDiff(imgA, imgB); summary.OnlyA != summary.Pixels {
+		t.Errorf("canvasDiff() = %+v, want all %v pixels only in a", summary, summary.Pixels)
+	}
+}
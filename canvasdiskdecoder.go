@@ -0,0 +1,187 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// Number of events that are handed from the reading goroutine to the consumer at once
+const canvasDiskDecoderBatchSize = 64
+
+// Number of batches that are read ahead of the consumer
+const canvasDiskDecoderQueueSize = 16
+
+type canvasDiskDecoderResult struct {
+	Time  time.Time
+	Event interface{}
+	Err   error
+}
+
+type canvasDiskDecoderBatch struct {
+	results []canvasDiskDecoderResult
+	decoded sync.WaitGroup // Waits until a worker decoded the images of the batch
+}
+
+// Reads the events of a recording ahead, while they are applied somewhere else.
+//
+// One goroutine reads the events in order, the images of SetImage events are decoded by several workers at the same time.
+// Events are returned in the order of the recording, no matter which image is decoded first.
+type canvasDiskDecoder struct {
+	FileName    string
+	StartTime   time.Time
+	ChunkSize   pixelSize
+	ChunkOrigin image.Point
+
+	file      io.ReadCloser
+	zipReader *gzip.Reader
+
+	batches   chan *canvasDiskDecoderBatch // Batches in the order of the recording
+	batch     *canvasDiskDecoderBatch      // Batch that is currently consumed
+	index     int                          // Index of the next result in batch
+	quitChan  chan struct{}
+	waitGroup sync.WaitGroup
+}
+
+// Opens the recording and reads its header. The events are decoded ahead from here on.
+// workers is the number of goroutines that decode images, replays use all CPUs while background work uses its share of them.
+func openCanvasDiskDecoder(fileName string, workers int) (*canvasDiskDecoder, error) {
+	file, err := openRecordingFile(fileName, false)
+	if err != nil {
+		return nil, err
+	}
+	zipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Can't decompress %v: %v", fileName, err)
+	}
+	startTime, chunkSize, chunkOrigin, err := canvasDiskReaderParseHeader(zipReader)
+	if err != nil {
+		zipReader.Close()
+		file.Close()
+		return nil, fmt.Errorf("Can't read header of %v: %v", fileName, err)
+	}
+
+	d := &canvasDiskDecoder{
+		FileName:    fileName,
+		StartTime:   startTime,
+		ChunkSize:   chunkSize,
+		ChunkOrigin: chunkOrigin,
+		file:        file,
+		zipReader:   zipReader,
+		batches:     make(chan *canvasDiskDecoderBatch, memoryQueueSize(canvasDiskDecoderQueueSize)),
+		quitChan:    make(chan struct{}),
+	}
+
+	jobs := make(chan *canvasDiskDecoderBatch, memoryQueueSize(canvasDiskDecoderQueueSize))
+
+	// Workers that decode the images of whole batches
+	for i := 0; i < workers; i++ {
+		d.waitGroup.Add(1)
+		go func() {
+			defer d.waitGroup.Done()
+			for batch := range jobs {
+				for i, result := range batch.results {
+					if raw, ok := result.Event.(recording.RawImage); ok {
+						setImage, err := raw.Decode()
+						if err != nil {
+							batch.results[i] = canvasDiskDecoderResult{Time: result.Time, Err: err}
+							continue
+						}
+						batch.results[i].Event = canvasEventSetImage{Image: setImage.Image}
+					}
+				}
+				batch.decoded.Done()
+			}
+		}()
+	}
+
+	// Goroutine that reads the events in order, until the end of the recording or an error
+	d.waitGroup.Add(1)
+	go func() {
+		defer d.waitGroup.Done()
+		defer close(d.batches)
+		defer close(jobs)
+
+		batch := &canvasDiskDecoderBatch{results: make([]canvasDiskDecoderResult, 0, canvasDiskDecoderBatchSize)}
+		for {
+			t, event, err := recording.ReadRawEvent(zipReader)
+			if _, ok := event.(recording.RawImage); !ok && err == nil {
+				event, err = canvasDiskReaderConvertEvent(event)
+			}
+			batch.results = append(batch.results, canvasDiskDecoderResult{Time: t, Event: event, Err: err}) // Images are decoded by the workers
+
+			if err == nil && len(batch.results) < canvasDiskDecoderBatchSize {
+				continue
+			}
+
+			batch.decoded.Add(1)
+			select {
+			case jobs <- batch:
+			case <-d.quitChan:
+				return
+			}
+			select {
+			case d.batches <- batch:
+			case <-d.quitChan:
+				return
+			}
+			if err != nil {
+				return
+			}
+			batch = &canvasDiskDecoderBatch{results: make([]canvasDiskDecoderResult, 0, canvasDiskDecoderBatchSize)}
+		}
+	}()
+
+	return d, nil
+}
+
+// Returns the next event of the recording, like canvasDiskReaderReadEvent.
+// io.EOF is returned at the end of the recording, io.ErrUnexpectedEOF if it's cut off.
+func (d *canvasDiskDecoder) next() (time.Time, interface{}, error) {
+	if d.batch == nil || d.index >= len(d.batch.results) {
+		batch, ok := <-d.batches
+		if !ok {
+			return time.Time{}, nil, io.EOF
+		}
+		batch.decoded.Wait()
+		d.batch, d.index = batch, 0
+	}
+
+	r := d.batch.results[d.index]
+	d.batch.results[d.index] = canvasDiskDecoderResult{} // Don't keep images alive
+	d.index++
+
+	return r.Time, r.Event, r.Err
+}
+
+// Stops decoding, and closes the recording
+func (d *canvasDiskDecoder) Close() {
+	close(d.quitChan)
+	d.waitGroup.Wait()
+
+	d.zipReader.Close()
+	d.file.Close()
+}
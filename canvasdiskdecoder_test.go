@@ -0,0 +1,130 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+// Writes a recording with alternating images and pixels, and returns its file name
+func testDecoderRecording(t testing.TB, dir string, events int) string {
+	fileName := filepath.Join(dir, "decoder.pixrec")
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatalf("Can't create recording: %v", err)
+	}
+	defer f.Close()
+
+	startTime := time.Unix(0, 1560513600000000000)
+	w, err := recording.NewWriter(f, "Test", recording.Header{Time: startTime, ChunkSize: image.Point{64, 64}})
+	if err != nil {
+		t.Fatalf("Can't create writer: %v", err)
+	}
+	for i := 0; i < events; i++ {
+		var event interface{} = recording.SetPixel{Pos: image.Point{i, 0}, Color: color.RGBA{uint8(i), 0, 0, 255}}
+		if i%2 == 0 {
+			img := image.NewPaletted(image.Rect(i*64, 0, i*64+64, 64), pixelcanvasioPalette)
+			img.SetColorIndex(i*64, 0, uint8(i%len(pixelcanvasioPalette)))
+			event = recording.SetImage{Image: img}
+		}
+		if err := w.WriteEvent(startTime.Add(time.Duration(i)*time.Second), event); err != nil {
+			t.Fatalf("Can't write event: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Can't close writer: %v", err)
+	}
+
+	return fileName
+}
+
+func Test_canvasDiskDecoder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-test-decoder")
+	if err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const events = 500
+	fileName := testDecoderRecording(t, dir, events)
+
+	d, err := openCanvasDiskDecoder(fileName, 4)
+	if err != nil {
+		t.Fatalf("Can't open recording: %v", err)
+	}
+	defer d.Close()
+
+	if d.ChunkSize != (pixelSize{64, 64}) {
+		t.Errorf("Decoder has chunk size %v, want 64x64", d.ChunkSize)
+	}
+
+	// Events arrive in the order of the recording, no matter in which order the images are decoded
+	for i := 0; i < events; i++ {
+		eventTime, event, err := d.next()
+		if err != nil {
+			t.Fatalf("Can't read event %v: %v", i, err)
+		}
+		if want := d.StartTime.Add(time.Duration(i) * time.Second); !eventTime.Equal(want) {
+			t.Fatalf("Event %v has time %v, want %v", i, eventTime, want)
+		}
+		switch event := event.(type) {
+		case canvasEventSetImage:
+			if i%2 != 0 || event.Image.Bounds().Min.X != i*64 {
+				t.Fatalf("Event %v is an image at %v", i, event.Image.Bounds())
+			}
+		case canvasEventSetPixel:
+			if i%2 != 1 || event.Pos.X != i {
+				t.Fatalf("Event %v is a pixel at %v", i, event.Pos)
+			}
+		default:
+			t.Fatalf("Event %v has unexpected type %T", i, event)
+		}
+	}
+
+	if _, _, err := d.next(); err != io.EOF {
+		t.Errorf("Got error %v at the end, want %v", err, io.EOF)
+	}
+}
+
+func Test_canvasDiskDecoderClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-test-decoder")
+	if err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := testDecoderRecording(t, dir, 2000)
+
+	// Closing in the middle of the recording stops the goroutines that read ahead
+	d, err := openCanvasDiskDecoder(fileName, 4)
+	if err != nil {
+		t.Fatalf("Can't open recording: %v", err)
+	}
+	if _, _, err := d.next(); err != nil {
+		t.Fatalf("Can't read event: %v", err)
+	}
+	d.Close()
+}
@@ -17,26 +17,24 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"image"
-	"image/color"
 	"io"
-	"io/ioutil"
 	"math"
-	"os"
-	"path/filepath"
+	"path"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 
-	_ "golang.org/x/image/bmp"
+	"github.com/Dadido3/D3pixelbot/recording"
 
 	gzip "github.com/klauspost/pgzip"
 )
 
 type canvasDiskReader struct {
 	ShortName string
+	Storage   recordingStorage
 
 	ChunkSize   pixelSize
 	ChunkOrigin image.Point
@@ -52,12 +50,36 @@ type canvasDiskReaderRecording struct {
 	StartTime, EndTime time.Time
 }
 
-func newCanvasDiskReader(shortName string) (connection, *canvas, error) {
+// Returns a reader for the recordings of name, without reading anything yet.
+//
+// name is either the short name of a game, the URL of the recordings of a game served by the API server of another instance, or the path to a clip file.
+// For example "http://192.168.1.10:8081/api/recordings/pixelcanvasio" or "clips/fight.pixclip".
+func canvasDiskReaderFor(name string) *canvasDiskReader {
 	cdr := &canvasDiskReader{
-		ShortName: shortName,
+		ShortName: name,
+		Storage:   recordingStorageLocal{},
 		TimeChan:  make(chan time.Time, 1),
 	}
 
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		u := strings.TrimSuffix(name, "/")
+		cdr.ShortName = path.Base(u)
+		cdr.Storage = recordingStorageHTTP{URL: strings.TrimSuffix(u, "/"+cdr.ShortName)}
+	} else if isCanvasClip(name) {
+		info, err := readCanvasClipInfo(name)
+		if err != nil {
+			recordingLog.Warnf("Can't read clip %v: %v", name, err)
+		}
+		cdr.ShortName = info.Game
+		cdr.Storage = recordingStorageClip{FileName: name, Info: info}
+	}
+
+	return cdr
+}
+
+func newCanvasDiskReader(shortName string) (connection, *canvas, error) {
+	cdr := canvasDiskReaderFor(shortName)
+
 	var err error
 	cdr.Recordings, err = cdr.refreshRecordings()
 	if err != nil {
@@ -71,271 +93,287 @@ func newCanvasDiskReader(shortName string) (connection, *canvas, error) {
 	cdr.TimeChan <- cdr.Recordings[0].StartTime
 
 	cdr.Canvas, _ = newCanvas(cdr.ChunkSize, cdr.ChunkOrigin, image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32))
+	if limit := getExportSettings().SpillLimit; limit > 0 {
+		if err := cdr.Canvas.enableSpill(int64(limit) << 20); err != nil {
+			recordingLog.Warnf("Replaying %v without spilling chunks: %v", shortName, err)
+		}
+	}
 
 	cdr.QuitWaitGroup.Add(1)
 	go func() {
 		defer cdr.QuitWaitGroup.Done()
-		ticker := time.NewTicker(100 * time.Millisecond) // Ticker for sending time update events to the canvas
-		defer ticker.Stop()
-
-		defer log.Tracef("Closed replay goroutine of %v", shortName)
-
-		destTime, ok := <-cdr.TimeChan // Destination time and channel state
-		var replayTime time.Time
-
-		// Run while channel is open
-		for ok {
-			// Get recording file where current time is inside its time interval
-			var rec canvasDiskReaderRecording
-			found := false
-			for _, recording := range cdr.Recordings {
-				if !destTime.Before(recording.StartTime) && destTime.Before(recording.EndTime) {
-					rec = recording
-					found = true
-					break
-				}
-			}
-
-			if !found {
-				cdr.Canvas.setTime(destTime)
-				destTime, ok = <-cdr.TimeChan
-				continue
-			}
-
-			// Blocks while destTime < newReplayTime
-			// Returns false when a (new) recording should be (re)opened
-			waitTime := func(newReplayTime time.Time) bool {
-				// Get next point in time
-				select {
-				case destTime, ok = <-cdr.TimeChan:
-					if !ok {
-						return false // Close goroutine
-					}
-					// Check if destination time is outside of the recording's time range
-					if destTime.Before(rec.StartTime) || !destTime.Before(rec.EndTime) {
-						return false
+		// After a crash, the replay starts over with the next destination time
+		crashRun(fmt.Sprintf("Replay of %v", shortName), true, func() {
+			ticker := time.NewTicker(100 * time.Millisecond) // Ticker for sending time update events to the canvas
+			defer ticker.Stop()
+
+			defer recordingLog.Tracef("Closed replay goroutine of %v", shortName)
+
+			destTime, ok := <-cdr.TimeChan // Destination time and channel state
+			var replayTime time.Time
+			applied := 0 // Number of applied events, to check regularly whether chunks have to be spilled
+
+			// Run while channel is open
+			for ok {
+				// Get recording file where current time is inside its time interval
+				var rec canvasDiskReaderRecording
+				found := false
+				for _, recording := range cdr.Recordings {
+					if !destTime.Before(recording.StartTime) && destTime.Before(recording.EndTime) {
+						rec = recording
+						found = true
+						break
 					}
-					// Check if destination time is before replayTime
-					if destTime.Before(replayTime) {
-						return false
-					}
-				default:
 				}
 
-				// Block as long as destTime is < newReplayTime
-				for destTime.Before(newReplayTime) {
-					cdr.Canvas.setTime(destTime) // Output current time when waiting
-
+				if !found {
+					cdr.Canvas.setTime(destTime)
 					destTime, ok = <-cdr.TimeChan
-					if !ok {
-						return false // Close goroutine
-					}
-					// Check if destination time is outside of the recording's time range
-					if destTime.Before(rec.StartTime) || !destTime.Before(rec.EndTime) {
-						return false
-					}
-					// Check if destination time is before replayTime
-					if destTime.Before(replayTime) {
-						return false
-					}
+					continue
 				}
 
-				replayTime = newReplayTime
-				select {
-				case <-ticker.C:
-					cdr.Canvas.setTime(replayTime) // Send out time update every xxx ms
-				default:
-				}
+				// Blocks while destTime < newReplayTime
+				// Returns false when a (new) recording should be (re)opened
+				waitTime := func(newReplayTime time.Time) bool {
+					// Get next point in time
+					select {
+					case destTime, ok = <-cdr.TimeChan:
+						if !ok {
+							return false // Close goroutine
+						}
+						// Check if destination time is outside of the recording's time range
+						if destTime.Before(rec.StartTime) || !destTime.Before(rec.EndTime) {
+							return false
+						}
+						// Check if destination time is before replayTime
+						if destTime.Before(replayTime) {
+							return false
+						}
+					default:
+					}
 
-				return true
-			}
+					// Block as long as destTime is < newReplayTime
+					for destTime.Before(newReplayTime) {
+						cdr.Canvas.setTime(destTime) // Output current time when waiting
+
+						destTime, ok = <-cdr.TimeChan
+						if !ok {
+							return false // Close goroutine
+						}
+						// Check if destination time is outside of the recording's time range
+						if destTime.Before(rec.StartTime) || !destTime.Before(rec.EndTime) {
+							return false
+						}
+						// Check if destination time is before replayTime
+						if destTime.Before(replayTime) {
+							return false
+						}
+					}
 
-			// Open and read recording. In a function, so defer works inside the loop
-			func() {
-				// Invalidate all on file close
-				defer cdr.Canvas.invalidateAll()
+					replayTime = newReplayTime
+					select {
+					case <-ticker.C:
+						cdr.Canvas.setTime(replayTime) // Send out time update every xxx ms
+					default:
+					}
 
-				// Found valid recording, read it
-				fileName := rec.FileName
-				log.Debugf("Open recording %v", fileName)
-				file, err := os.Open(fileName)
-				if err != nil {
-					log.Warnf("Can't open file %v: %v", fileName, err)
-					waitTime(rec.EndTime)
-					return
+					return true
 				}
-				defer file.Close()
-				zipReader, err := gzip.NewReader(file)
-				if err != nil {
-					log.Warnf("Can't decompress %v: %v", fileName, err)
-					waitTime(rec.EndTime)
-					return
-				}
-				defer zipReader.Close()
 
-				var chunkSize pixelSize
-				var chunkOrigin image.Point
-				replayTime, chunkSize, chunkOrigin, err = canvasDiskReaderParseHeader(zipReader)
-				if err != nil {
-					log.Warn(err)
-					waitTime(rec.EndTime)
-					return
-				}
-				if cdr.Canvas.ChunkSize != chunkSize {
-					log.Warnf("Chunk size differs in recording %v. From %v to %v. Seperate this and similar files from the others to play it", fileName, cdr.Canvas.ChunkSize, chunkSize)
-					waitTime(rec.EndTime)
-					return
-				}
-				if cdr.Canvas.Origin != chunkOrigin {
-					log.Warnf("Origin differs in recording %v. From %v to %v. Seperate this and similar files from the others to play it", fileName, cdr.Canvas.Origin, chunkOrigin)
-					waitTime(rec.EndTime)
-					return
-				}
+				// Open and read recording. In a function, so defer works inside the loop
+				func() {
+					// Invalidate all on file close
+					defer cdr.Canvas.invalidateAll()
 
-				// Loop that retrieves all the events until replayTime >= destTime
-				for {
-					// Read and send events
-					var dataType uint8
-					var binTime int64
-					err := binary.Read(zipReader, binary.LittleEndian, &dataType)
+					// Found valid recording, read it
+					fileName := rec.FileName
+					recordingLog.Debugf("Open recording %v", fileName)
+					decoder, err := openCanvasDiskDecoder(fileName, runtime.NumCPU())
 					if err != nil {
-						log.Warnf("Error while reading file %v: %v", fileName, err)
+						recordingLog.Warnf("Can't open recording %v: %v", fileName, err)
 						waitTime(rec.EndTime)
 						return
 					}
-					err = binary.Read(zipReader, binary.LittleEndian, &binTime)
-					if err != nil {
-						log.Warnf("Error while reading file %v: %v", fileName, err)
+					defer decoder.Close()
+
+					replayTime = decoder.StartTime
+					chunkSize, chunkOrigin := decoder.ChunkSize, decoder.ChunkOrigin
+					if cdr.Canvas.ChunkSize != chunkSize {
+						recordingLog.Warnf("Chunk size differs in recording %v. From %v to %v. Seperate this and similar files from the others to play it", fileName, cdr.Canvas.ChunkSize, chunkSize)
 						waitTime(rec.EndTime)
 						return
 					}
-
-					// Block until time is progressed enough. Or if another file needs to be loaded (on false)
-					if !waitTime(time.Unix(0, binTime)) {
+					if cdr.Canvas.Origin != chunkOrigin {
+						recordingLog.Warnf("Origin differs in recording %v. From %v to %v. Seperate this and similar files from the others to play it", fileName, cdr.Canvas.Origin, chunkOrigin)
+						waitTime(rec.EndTime)
 						return
 					}
 
-					switch dataType {
-					case 10: // SetPixel
-						var dat struct {
-							X, Y    int32
-							R, G, B uint8
-						}
-						err := binary.Read(zipReader, binary.LittleEndian, &dat)
+					// Loop that retrieves all the events until replayTime >= destTime
+					for {
+						eventTime, event, err := decoder.next()
 						if err != nil {
-							log.Warnf("Error while reading file %v: %v", fileName, err)
+							recordingLog.Warnf("Error while reading file %v: %v", fileName, err)
 							waitTime(rec.EndTime)
 							return
 						}
-						cdr.Canvas.setPixel(image.Point{int(dat.X), int(dat.Y)}, color.RGBA{dat.R, dat.G, dat.B, 255})
 
-					case 20: // InvalidateRect
-						var dat struct {
-							MinX, MinY, MaxX, MaxY int32
-						}
-						err := binary.Read(zipReader, binary.LittleEndian, &dat)
-						if err != nil {
-							log.Warnf("Error while reading file %v: %v", fileName, err)
-							waitTime(rec.EndTime)
+						// Block until time is progressed enough. Or if another file needs to be loaded (on false)
+						if !waitTime(eventTime) {
 							return
 						}
-						cdr.Canvas.invalidateRect(image.Rect(int(dat.MinX), int(dat.MinY), int(dat.MaxX), int(dat.MaxY)))
 
-					case 21: // InvalidateAll
-						cdr.Canvas.invalidateAll()
+						canvasDiskReaderApplyEvent(cdr.Canvas, event)
 
-					case 22: // RevalidateRect
-						var dat struct {
-							MinX, MinY, MaxX, MaxY int32
+						if applied++; applied%canvasSpillCheckInterval == 0 {
+							if _, err := cdr.Canvas.spillColdChunks(); err != nil {
+								recordingLog.Warnf("Can't spill chunks of %v: %v", shortName, err)
+							}
 						}
-						err := binary.Read(zipReader, binary.LittleEndian, &dat)
-						if err != nil {
-							log.Warnf("Error while reading file %v: %v", fileName, err)
-							waitTime(rec.EndTime)
-							return
-						}
-						cdr.Canvas.revalidateRect(image.Rect(int(dat.MinX), int(dat.MinY), int(dat.MaxX), int(dat.MaxY)))
+					}
+				}()
+			}
+		})
+	}()
 
-					case 30: // SetImage
-						var dat struct {
-							X, Y int32
-							Size uint32
-						}
-						err := binary.Read(zipReader, binary.LittleEndian, &dat)
-						if err != nil {
-							log.Warnf("Error while reading file %v: %v", fileName, err)
-							waitTime(rec.EndTime)
-							return
-						}
-						rawBytes := make([]byte, dat.Size)
-						_, err = io.ReadFull(zipReader, rawBytes)
-						if err != nil {
-							log.Warnf("Error while reading file %v: %v", fileName, err)
-							waitTime(rec.EndTime)
-							return
-						}
-						img, imageFormat, err := image.Decode(bytes.NewBuffer(rawBytes))
-						if err != nil {
-							log.Warnf("Error while reading %v image from %v: %v", imageFormat, fileName, err)
-							waitTime(rec.EndTime)
-							return
-						}
+	return cdr, cdr.Canvas, nil
+}
 
-						// Move image to X and Y
-						switch img := img.(type) {
-						case *image.Paletted:
-							img.Rect = img.Rect.Add(image.Point{int(dat.X), int(dat.Y)})
-						case *image.RGBA:
-							img.Rect = img.Rect.Add(image.Point{int(dat.X), int(dat.Y)})
-						default:
-							log.Warnf("Unknown internal image type %T in %v", img, fileName)
-						}
+// Reads the header of a decompressed recording, see recording.ReadHeader
+func canvasDiskReaderParseHeader(reader io.Reader) (time.Time, pixelSize, image.Point, error) {
+	h, err := recording.ReadHeader(reader)
+	if err != nil {
+		return time.Time{}, pixelSize{}, image.Point{}, err
+	}
 
-						cdr.Canvas.signalDownload(img.Bounds())
-						cdr.Canvas.setImage(img, false, true)
+	return h.Time, pixelSize(h.ChunkSize), h.Origin, nil
+}
 
-					default:
-						log.Warnf("Found invalid data type %v in %v", dataType, fileName)
-						waitTime(rec.EndTime)
-						return
+// Reads the next event from a recording.
+// The event is returned as one of the canvasEvent* types, together with its point in time.
+//
+// Use a canvasDiskDecoder to read whole recordings, it decodes images in parallel.
+func canvasDiskReaderReadEvent(reader io.Reader) (time.Time, interface{}, error) {
+	t, event, err := recording.ReadEvent(reader)
+	if err != nil {
+		return t, nil, err
+	}
 
-					}
-				}
-			}()
+	event, err = canvasDiskReaderConvertEvent(event)
+	return t, event, err
+}
+
+// Converts an event of the recording package into one of the canvasEvent* types
+func canvasDiskReaderConvertEvent(event interface{}) (interface{}, error) {
+	switch event := event.(type) {
+	case recording.SetPixel:
+		return canvasEventSetPixel{Pos: event.Pos, Color: event.Color, Index: -1, Author: event.Author}, nil
+	case recording.InvalidateRect:
+		return canvasEventInvalidateRect{Rect: event.Rect}, nil
+	case recording.InvalidateAll:
+		return canvasEventInvalidateAll{}, nil
+	case recording.RevalidateRect:
+		return canvasEventRevalidate{Rect: event.Rect}, nil
+	case recording.SetImage:
+		return canvasEventSetImage{Image: event.Image}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown event type %T", event)
+}
+
+// Applies a recorded event to the given canvas.
+// Images are handled like finished downloads, so the affected chunks will be created if needed.
+func canvasDiskReaderApplyEvent(can *canvas, event interface{}) error {
+	switch event := event.(type) {
+	case canvasEventSetPixel:
+		return can.setPixelAuthor(event.Pos, event.Color, event.Author)
+	case canvasEventInvalidateRect:
+		return can.invalidateRect(event.Rect)
+	case canvasEventInvalidateAll:
+		return can.invalidateAll()
+	case canvasEventRevalidate:
+		return can.revalidateRect(event.Rect)
+	case canvasEventSetImage:
+		if _, err := can.signalDownload(event.Image.Bounds()); err != nil {
+			return err
 		}
-	}()
+		return can.setImage(event.Image, false, true)
+	}
 
-	return cdr, cdr.Canvas, nil
+	return fmt.Errorf("Can't apply event of type %T", event)
 }
 
-func canvasDiskReaderParseHeader(reader io.Reader) (time.Time, pixelSize, image.Point, error) {
-	var dat struct {
-		MagicNumber             [4]byte
-		Version                 uint16 // File format version
-		Time                    int64
-		ChunkWidth, ChunkHeight uint32
-		OriginX, OriginY        int32  // Origin/Offset of the chunks
-		_                       uint32 // Reserved // TODO: Somehow store endTime here
-		_                       uint32 // Reserved
-		_                       uint32 // Reserved
-		_                       uint32 // Reserved
-		_                       uint32 // Reserved
-		_                       uint32 // Reserved
+// Reads all events of the recordings that are inside the time range from startTime (inclusive) to endTime (exclusive), and passes them to fn.
+// Cut off recordings are read up to the point where they end.
+//
+// The next recording is opened and decoded ahead, while the events of the current one are passed to fn.
+func canvasDiskReaderForEachEvent(recs []canvasDiskReaderRecording, startTime, endTime time.Time, fn func(t time.Time, event interface{}) error) error {
+	selected := []canvasDiskReaderRecording{}
+	for _, rec := range recs {
+		if rec.EndTime.After(startTime) && rec.StartTime.Before(endTime) {
+			selected = append(selected, rec)
+		}
 	}
-	err := binary.Read(reader, binary.LittleEndian, &dat)
-	if err != nil {
-		return time.Time{}, pixelSize{}, image.Point{}, fmt.Errorf("Error while reading file: %v", err)
+
+	type opened struct {
+		decoder *canvasDiskDecoder
+		err     error
 	}
+	open := func(rec canvasDiskReaderRecording) opened {
+		decoder, err := openCanvasDiskDecoder(rec.FileName, getBackgroundSettings().getWorkers())
+		return opened{decoder, err}
+	}
+
+	throttle := newBackgroundThrottle(backgroundThrottleInterval)
 
-	if dat.MagicNumber != [4]byte{'P', 'R', 'E', 'C'} {
-		return time.Time{}, pixelSize{}, image.Point{}, fmt.Errorf("Wrong file format")
+	var next opened
+	if len(selected) > 0 {
+		next = open(selected[0])
 	}
+	defer func() {
+		if next.decoder != nil {
+			next.decoder.Close()
+		}
+	}()
+
+	for i, rec := range selected {
+		current := next
+		next = opened{}
+		if i+1 < len(selected) {
+			next = open(selected[i+1])
+		}
+
+		if err := func() error {
+			if current.err != nil {
+				return current.err
+			}
+			defer current.decoder.Close()
 
-	if dat.Version > 1 {
-		return time.Time{}, pixelSize{}, image.Point{}, fmt.Errorf("Version is newer")
+			for {
+				eventTime, event, err := current.decoder.next()
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("Error while reading recording %v: %v", rec.FileName, err)
+				}
+				if !eventTime.Before(endTime) {
+					return nil
+				}
+				if eventTime.Before(startTime) {
+					continue
+				}
+				if err := fn(eventTime, event); err != nil {
+					return err
+				}
+				throttle.step()
+			}
+		}(); err != nil {
+			return err
+		}
 	}
 
-	return time.Unix(0, dat.Time), pixelSize{int(dat.ChunkWidth), int(dat.ChunkHeight)}, image.Point{int(dat.OriginX), int(dat.OriginY)}, nil
+	return nil
 }
 
 func (cdr *canvasDiskReader) setReplayTime(t time.Time) error {
@@ -355,43 +393,32 @@ func (cdr *canvasDiskReader) setReplayTime(t time.Time) error {
 
 // Creates list of recordings
 func (cdr *canvasDiskReader) refreshRecordings() ([]canvasDiskReaderRecording, error) {
-	fileDirectory := filepath.Join(wd, "recordings", cdr.ShortName)
-	files, err := ioutil.ReadDir(fileDirectory)
+	fileNames, err := cdr.Storage.listRecordings(cdr.ShortName)
 	if err != nil {
-		return nil, fmt.Errorf("Can't read from %v", fileDirectory)
+		return nil, err
 	}
 
-	// Filter pixrec files
-	tempFiles := []os.FileInfo{}
-	for _, f := range files {
-		if filepath.Ext(f.Name()) == ".pixrec" {
-			tempFiles = append(tempFiles, f)
-		}
-	}
-	files = tempFiles
-
 	recs := []canvasDiskReaderRecording{}
 
 	// Get info of all recordings
-	for i, file := range files {
-		fileName := filepath.Join(fileDirectory, file.Name())
-		f, err := os.Open(fileName)
+	for _, fileName := range fileNames {
+		f, err := openRecordingFile(fileName, true)
 		if err != nil {
-			log.Warnf("Can't open recording %v", fileName)
+			recordingLog.Warnf("Can't open recording %v: %v", fileName, err)
 			continue
 		}
 		defer f.Close()
 
 		zipReader, err := gzip.NewReader(f)
 		if err != nil {
-			log.Warnf("Can't initialize gzip reader for %v: %v", fileName, err)
+			recordingLog.Warnf("Can't initialize gzip reader for %v: %v", fileName, err)
 			continue
 		}
 		defer zipReader.Close()
 
 		startTime, chunkSize, chunkOrigin, err := canvasDiskReaderParseHeader(zipReader)
 		if err != nil {
-			log.Warnf("Error reading header of %v: %v", fileName, err)
+			recordingLog.Warnf("Error reading header of %v: %v", fileName, err)
 			continue
 		}
 
@@ -401,11 +428,11 @@ func (cdr *canvasDiskReader) refreshRecordings() ([]canvasDiskReaderRecording, e
 			cdr.ChunkSize, cdr.ChunkOrigin = chunkSize, chunkOrigin
 		}
 		if cdr.ChunkSize != chunkSize {
-			log.Warnf("Chunk size differs in recording %v. From %v to %v. Separate this and similar files from the others to play it", fileName, cdr.ChunkSize, chunkSize)
+			recordingLog.Warnf("Chunk size differs in recording %v. From %v to %v. Separate this and similar files from the others to play it", fileName, cdr.ChunkSize, chunkSize)
 			continue
 		}
 		if cdr.ChunkOrigin != chunkOrigin {
-			log.Warnf("Origin differs in recording %v. From %v to %v. Separate this and similar files from the others to play it", fileName, cdr.ChunkOrigin, chunkOrigin)
+			recordingLog.Warnf("Origin differs in recording %v. From %v to %v. Separate this and similar files from the others to play it", fileName, cdr.ChunkOrigin, chunkOrigin)
 			continue
 		}
 
@@ -416,13 +443,18 @@ func (cdr *canvasDiskReader) refreshRecordings() ([]canvasDiskReaderRecording, e
 		}
 
 		// Set the end time of the previous element to the start time of the current
-		if i > 0 {
-			recs[i-1].EndTime = startTime
+		if len(recs) > 0 {
+			recs[len(recs)-1].EndTime = startTime
 		}
 
 		recs = append(recs, rec)
 	}
 
+	// Clips end at a known point in time
+	if clip, ok := cdr.Storage.(recordingStorageClip); ok && len(recs) > 0 && !clip.Info.EndTime.IsZero() {
+		recs[len(recs)-1].EndTime = clip.Info.EndTime
+	}
+
 	return recs, nil
 }
 
@@ -19,8 +19,6 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"image"
 	"image/color"
@@ -28,24 +26,44 @@ import (
 	"path/filepath"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/image/bmp"
+	"github.com/Dadido3/D3pixelbot/recording"
 
 	gzip "github.com/klauspost/pgzip"
 )
 
+// Maximum number of events that are queued for writing. If the disk can't keep up, further events are dropped
+const canvasDiskWriterQueueSize = 10000
+
+// Event that is queued for the IO goroutine of a canvasDiskWriter
+type canvasDiskWriterEvent struct {
+	Time   time.Time
+	Event  interface{}
+	Handle *chunkImage // Released after the event is written, if set
+}
+
 type canvasDiskWriter struct {
+	droppedCount uint64 // Number of events that didn't fit into the queue. Accessed atomically, keep it first for alignment
+
 	Closed      bool
 	ClosedMutex sync.RWMutex
 
 	Canvas *canvas
 
-	File      *os.File
-	ZipWriter *gzip.Writer
+	File   *os.File
+	Writer *recording.Writer // Only used by the IO goroutine
+
+	eventChan chan canvasDiskWriterEvent
+	resync    bool      // True after events were dropped, until the recording is in sync again. Only accessed by the handlers
+	lastTime  time.Time // Time of the last queued event, so times don't go backwards when the clock estimate changes. Only accessed by the handlers
+	waitGroup sync.WaitGroup
 }
 
-func (can *canvas) newCanvasDiskWriter(shortName string) (*canvasDiskWriter, error) {
+// Creates a pixrec recording of the canvas.
+// compression is the gzip compression level from 1 to 9, or 0 for the default level.
+func (can *canvas) newCanvasDiskWriter(shortName string, compression int) (*canvasDiskWriter, error) {
 	cdw := &canvasDiskWriter{
 		Canvas: can,
 	}
@@ -53,8 +71,12 @@ func (can *canvas) newCanvasDiskWriter(shortName string) (*canvasDiskWriter, err
 	re := regexp.MustCompile("[^a-zA-Z0-9\\-\\.]+")
 	shortName = re.ReplaceAllString(shortName, "_")
 
-	fileName := time.Now().UTC().Format("2006-01-02T150405") + ".pixrec" // Use RFC3339 like encoding, but with : removed
-	fileDirectory := filepath.Join(wd, "recordings", shortName)
+	// Everything is timed by the clock of the game server, as far as it is known
+	startTime := can.Clock.now()
+	clockOffset, _ := can.Clock.getOffset()
+
+	fileName := startTime.UTC().Format("2006-01-02T150405") + ".pixrec" // Use RFC3339 like encoding, but with : removed
+	fileDirectory := dataPath(getPaths().Recordings, shortName)
 	filePath := filepath.Join(fileDirectory, fileName)
 
 	os.MkdirAll(fileDirectory, 0777)
@@ -63,46 +85,55 @@ func (can *canvas) newCanvasDiskWriter(shortName string) (*canvasDiskWriter, err
 		return nil, fmt.Errorf("Can't create file %v: %v", filePath, err)
 	}
 
-	cdw.File = f
-	zipWriter, err := gzip.NewWriterLevel(f, gzip.DefaultCompression)
-	if err != nil {
-		f.Close()
-		return nil, fmt.Errorf("Can't initialize compression %v: %v", filePath, err)
+	// The marker is removed once the recording is finished, otherwise recoverRecordings() finalizes it on the next start
+	if marker, err := os.Create(filePath + recordingUnfinishedExtension); err != nil {
+		recordingLog.Warnf("Can't mark recording %v as unfinished: %v", filePath, err)
+	} else {
+		marker.Close()
+	}
+
+	level := gzip.DefaultCompression
+	if compression != 0 {
+		level = compression
 	}
-	cdw.ZipWriter = zipWriter
 
 	// Write basic information about the canvas
-	cdw.ZipWriter.Name = shortName
-	cdw.ZipWriter.Comment = "D3's custom pixel game client recording"
-
-	err = binary.Write(cdw.ZipWriter, binary.LittleEndian, struct {
-		MagicNumber             [4]byte
-		Version                 uint16 // File format version
-		Time                    int64
-		ChunkWidth, ChunkHeight uint32
-		OriginX, OriginY        int32  // Origin/Offset of the chunks
-		_                       uint32 // Reserved
-		_                       uint32 // Reserved
-		_                       uint32 // Reserved
-		_                       uint32 // Reserved
-		_                       uint32 // Reserved
-		_                       uint32 // Reserved
-	}{
-		MagicNumber: [4]byte{'P', 'R', 'E', 'C'},
-		Version:     1,
-		Time:        time.Now().UnixNano(),
-		ChunkWidth:  uint32(can.ChunkSize.X),
-		ChunkHeight: uint32(can.ChunkSize.Y),
-		OriginX:     int32(can.Origin.X),
-		OriginY:     int32(can.Origin.Y),
-	})
+	writer, err := recording.NewWriterLevel(f, shortName, recording.Header{
+		Time:        startTime,
+		ChunkSize:   image.Point(can.ChunkSize),
+		Origin:      can.Origin,
+		ClockOffset: clockOffset,
+		Authors:     can.Authors,
+	}, level)
 	if err != nil {
-		zipWriter.Close()
 		f.Close()
 		return nil, fmt.Errorf("Can't write to file %v: %v", filePath, err)
 	}
 
-	can.subscribeListener(cdw, false) // Don't let the canvas manage virtual chunks for us
+	cdw.File = f
+	cdw.Writer = writer
+	cdw.lastTime = startTime
+	cdw.eventChan = make(chan canvasDiskWriterEvent, memoryQueueSize(canvasDiskWriterQueueSize))
+
+	// Write the events in their own goroutine, so slow disks don't stall the handlers
+	cdw.waitGroup.Add(1)
+	go func() {
+		defer cdw.waitGroup.Done()
+
+		crashRun(fmt.Sprintf("Writer of recording %v", cdw.File.Name()), true, func() {
+			for e := range cdw.eventChan {
+				atomic.AddInt64(&memoryRecordingQueues, -memoryEventSize)
+				if err := cdw.Writer.WriteEvent(e.Time, e.Event); err != nil {
+					recordingLog.Errorf("Can't write to file %v: %v", cdw.File.Name(), err)
+				}
+				if e.Handle != nil {
+					e.Handle.release()
+				}
+			}
+		})
+	}()
+
+	can.subscribeListenerFiltered(cdw, false, canvasEventMaskAll&^canvasEventMaskDownloads) // Don't let the canvas manage virtual chunks for us. Downloads are simulated by the reader
 
 	return cdw, nil
 }
@@ -119,34 +150,85 @@ func (cdw *canvasDiskWriter) setListeningRects(rects []image.Rectangle) error {
 	return nil
 }
 
-func (cdw *canvasDiskWriter) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+// Returns the current time of the game server, but never a time before the last event
+func (cdw *canvasDiskWriter) now() time.Time {
+	if t := cdw.Canvas.Clock.now(); t.After(cdw.lastTime) {
+		cdw.lastTime = t
+	}
+	return cdw.lastTime
+}
+
+// Queues an event with the current time of the game server for writing, without blocking.
+//
+// If the queue is full, the event is dropped.
+// Once the queue is half empty again, the canvas is invalidated in the recording, and the images of all valid chunks are written.
+// So replays show the gap, and continue with the correct state afterwards.
+func (cdw *canvasDiskWriter) queueEvent(event interface{}) error {
+	if cdw.resync {
+		if len(cdw.eventChan) > cap(cdw.eventChan)/2 {
+			cdw.countDropped()
+			return nil
+		}
+		cdw.resync = false
+
+		// Wait for space if needed, the queue may be smaller than the number of chunks
+		t := cdw.now()
+		cdw.eventChan <- canvasDiskWriterEvent{Time: t, Event: recording.InvalidateAll{}}
+		atomic.AddInt64(&memoryRecordingQueues, memoryEventSize)
+		for _, chunk := range cdw.Canvas.getAllChunks() {
+			if handle, _, _, err := chunk.getImage(true); err == nil {
+				cdw.eventChan <- canvasDiskWriterEvent{Time: t, Event: recording.SetImage{Image: handle.Image}, Handle: handle}
+				atomic.AddInt64(&memoryRecordingQueues, memoryEventSize)
+			}
+		}
+	}
+
+	select {
+	case cdw.eventChan <- canvasDiskWriterEvent{Time: cdw.now(), Event: event}:
+		atomic.AddInt64(&memoryRecordingQueues, memoryEventSize)
+	default:
+		cdw.resync = true
+		cdw.countDropped()
+	}
+
+	return nil
+}
+
+func (cdw *canvasDiskWriter) countDropped() {
+	dropped := atomic.AddUint64(&cdw.droppedCount, 1)
+	if dropped%1000 == 1 {
+		recordingLog.Warnf("Disk can't keep up with recording %v, dropped %v events so far", cdw.File.Name(), dropped)
+	}
+}
+
+// Returns the path of the recording
+func (cdw *canvasDiskWriter) getFileName() string {
+	return cdw.File.Name()
+}
+
+// Returns the number of events that were dropped, because the disk couldn't keep up
+func (cdw *canvasDiskWriter) getDroppedEvents() uint64 {
+	return atomic.LoadUint64(&cdw.droppedCount)
+}
+
+func (cdw *canvasDiskWriter) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	return cdw.handleSetPixelAuthor(pos, col, "", vcID)
+}
+
+func (cdw *canvasDiskWriter) handleSetPixelAuthor(pos image.Point, col color.Color, author string, vcID int) error {
 	cdw.ClosedMutex.RLock()
 	defer cdw.ClosedMutex.RUnlock()
 	if cdw.Closed {
 		return fmt.Errorf("Listener is closed")
 	}
 
-	r, g, b, _ := color.RGBA() // Returns 16 bit per channel
-
-	err := binary.Write(cdw.ZipWriter, binary.LittleEndian, struct {
-		DataType uint8
-		Time     int64
-		X, Y     int32
-		R, G, B  uint8
-	}{
-		DataType: 10,
-		Time:     time.Now().UnixNano(),
-		X:        int32(pos.X),
-		Y:        int32(pos.Y),
-		R:        uint8(r >> 8),
-		G:        uint8(g >> 8),
-		B:        uint8(b >> 8),
-	})
-	if err != nil {
-		return fmt.Errorf("Can't write to file %v: %v", cdw.File.Name(), err)
+	if !cdw.Canvas.Authors {
+		author = "" // The recording was started without authors, so it stays readable by older versions
 	}
 
-	return nil
+	r, g, b, _ := col.RGBA() // Returns 16 bit per channel
+
+	return cdw.queueEvent(recording.SetPixel{Pos: pos, Color: color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}, Author: author})
 }
 
 func (cdw *canvasDiskWriter) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
@@ -156,22 +238,7 @@ func (cdw *canvasDiskWriter) handleInvalidateRect(rect image.Rectangle, vcIDs []
 		return fmt.Errorf("Listener is closed")
 	}
 
-	err := binary.Write(cdw.ZipWriter, binary.LittleEndian, struct {
-		DataType               uint8
-		Time                   int64
-		MinX, MinY, MaxX, MaxY int32
-	}{
-		DataType: 20,
-		Time:     time.Now().UnixNano(),
-		MinX:     int32(rect.Min.X),
-		MinY:     int32(rect.Min.Y),
-		MaxX:     int32(rect.Max.X),
-		MaxY:     int32(rect.Max.Y),
-	})
-	if err != nil {
-		return fmt.Errorf("Can't write to file %v: %v", cdw.File.Name(), err)
-	}
-	return nil
+	return cdw.queueEvent(recording.InvalidateRect{Rect: rect})
 }
 
 func (cdw *canvasDiskWriter) handleInvalidateAll() error {
@@ -181,17 +248,7 @@ func (cdw *canvasDiskWriter) handleInvalidateAll() error {
 		return fmt.Errorf("Listener is closed")
 	}
 
-	err := binary.Write(cdw.ZipWriter, binary.LittleEndian, struct {
-		DataType uint8
-		Time     int64
-	}{
-		Time:     time.Now().UnixNano(),
-		DataType: 21,
-	})
-	if err != nil {
-		return fmt.Errorf("Can't write to file %v: %v", cdw.File.Name(), err)
-	}
-	return nil
+	return cdw.queueEvent(recording.InvalidateAll{})
 }
 
 func (cdw *canvasDiskWriter) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
@@ -201,22 +258,7 @@ func (cdw *canvasDiskWriter) handleRevalidateRect(rect image.Rectangle, vcIDs []
 		return fmt.Errorf("Listener is closed")
 	}
 
-	err := binary.Write(cdw.ZipWriter, binary.LittleEndian, struct {
-		DataType               uint8
-		Time                   int64
-		MinX, MinY, MaxX, MaxY int32
-	}{
-		DataType: 22,
-		Time:     time.Now().UnixNano(),
-		MinX:     int32(rect.Min.X),
-		MinY:     int32(rect.Min.Y),
-		MaxX:     int32(rect.Max.X),
-		MaxY:     int32(rect.Max.Y),
-	})
-	if err != nil {
-		return fmt.Errorf("Can't write to file %v: %v", cdw.File.Name(), err)
-	}
-	return nil
+	return cdw.queueEvent(recording.RevalidateRect{Rect: rect})
 }
 
 func (cdw *canvasDiskWriter) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
@@ -244,35 +286,7 @@ func (cdw *canvasDiskWriter) handleSetImage(img image.Image, valid bool, vcIDs [
 		return nil
 	}
 
-	rawBuffer := &bytes.Buffer{}
-	err := bmp.Encode(rawBuffer, img) // TODO: Add extra case for paletted, so it doesn't write the palette for each image
-	if err != nil {
-		return fmt.Errorf("Can't create image for %v: %v", cdw.File.Name(), err)
-	}
-
-	bounds := img.Bounds()
-
-	err = binary.Write(cdw.ZipWriter, binary.LittleEndian, struct {
-		DataType uint8
-		Time     int64
-		X, Y     int32
-		Size     uint32
-	}{
-		DataType: 30,
-		Time:     time.Now().UnixNano(),
-		X:        int32(bounds.Min.X),
-		Y:        int32(bounds.Min.Y),
-		Size:     uint32(rawBuffer.Len()),
-	})
-	if err != nil {
-		return fmt.Errorf("Can't write to file %v: %v", cdw.File.Name(), err)
-	}
-	_, err = cdw.ZipWriter.Write(rawBuffer.Bytes())
-	if err != nil {
-		return fmt.Errorf("Can't write to file %v: %v", cdw.File.Name(), err)
-	}
-
-	return nil
+	return cdw.queueEvent(recording.SetImage{Image: img})
 }
 
 func (cdw *canvasDiskWriter) handleChunksChange(create, remove map[image.Rectangle]int) error {
@@ -303,10 +317,23 @@ func (cdw *canvasDiskWriter) Close() {
 	cdw.Canvas.unsubscribeListener(cdw)
 	cdw.handleInvalidateAll()
 
-	cdw.ClosedMutex.RLock()
+	cdw.ClosedMutex.Lock()
+	if cdw.Closed {
+		cdw.ClosedMutex.Unlock()
+		return
+	}
 	cdw.Closed = true // Prevent any new events from happening
-	cdw.ClosedMutex.RUnlock()
+	cdw.ClosedMutex.Unlock()
+	unregisterCanvasRecorder(cdw)
+
+	// Wait until all queued events are written
+	close(cdw.eventChan)
+	cdw.waitGroup.Wait()
 
-	cdw.ZipWriter.Close()
+	cdw.Writer.Close()
 	cdw.File.Close()
+	os.Remove(cdw.File.Name() + recordingUnfinishedExtension)
+
+	// Move the finished recording to the object storage, if there is one
+	recordingStorageUpload(cdw.File.Name())
 }
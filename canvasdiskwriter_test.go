@@ -17,15 +17,21 @@
 package main
 
 import (
+	"fmt"
 	"image"
 	"math/rand"
+	"os"
 	"testing"
+
+	"github.com/Dadido3/D3pixelbot/recording"
 )
 
 func Test_canvas_newCanvasDiskWriter(t *testing.T) {
+	useTestRecordingsDir(t)
+
 	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
 
-	cdw, err := can.newCanvasDiskWriter("Test")
+	cdw, err := can.newCanvasDiskWriter("Test", 0)
 	if err != nil {
 		t.Errorf("Can't create canvas disk writer: %v", err)
 	}
@@ -57,3 +63,100 @@ func Test_canvas_newCanvasDiskWriter(t *testing.T) {
 
 	can.Close()
 }
+
+func Test_canvasDiskWriterCompression(t *testing.T) {
+	useTestRecordingsDir(t)
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	for _, compression := range []int{1, 9} {
+		cdw, err := can.newCanvasDiskWriter(fmt.Sprintf("Test-Compression%v", compression), compression)
+		if err != nil {
+			t.Fatalf("Can't create canvas disk writer with compression %v: %v", compression, err)
+		}
+		fileName := cdw.File.Name()
+
+		can.setPixel(image.Point{1, 2}, pixelcanvasioPalette[5])
+		cdw.Close()
+
+		if _, err := os.Stat(fileName + recordingUnfinishedExtension); !os.IsNotExist(err) {
+			t.Errorf("Finished recording is still marked as unfinished: %v", err)
+		}
+
+		f, err := os.Open(fileName)
+		if err != nil {
+			t.Fatalf("Can't open recording: %v", err)
+		}
+		r, err := recording.NewReader(f)
+		if err != nil {
+			f.Close()
+			t.Fatalf("Can't read recording with compression %v: %v", compression, err)
+		}
+		events := 0
+		for {
+			if _, _, err := r.Next(); err != nil {
+				break
+			}
+			events++
+		}
+		r.Close()
+		f.Close()
+
+		if events < 2 {
+			t.Errorf("Recording with compression %v contains %v events, want at least the image and the pixel", compression, events)
+		}
+	}
+}
+
+func Test_canvasDiskWriterQueue(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	// Without IO goroutine, so the queue isn't drained
+	cdw := &canvasDiskWriter{
+		Canvas:    can,
+		File:      os.Stdout,
+		eventChan: make(chan canvasDiskWriterEvent, 4),
+	}
+
+	for i := 0; i < 6; i++ {
+		cdw.handleSetPixel(image.Point{i, 0}, pixelcanvasioPalette[5], 0)
+	}
+	if dropped := cdw.getDroppedEvents(); dropped != 2 {
+		t.Errorf("Dropped %v events, want 2", dropped)
+	}
+
+	// Events are dropped until the queue is half empty
+	<-cdw.eventChan
+	cdw.handleSetPixel(image.Point{6, 0}, pixelcanvasioPalette[5], 0)
+	if dropped := cdw.getDroppedEvents(); dropped != 3 {
+		t.Errorf("Dropped %v events, want 3", dropped)
+	}
+
+	// Afterwards the recording is invalidated, and continues with the images of all valid chunks
+	for len(cdw.eventChan) > 0 {
+		<-cdw.eventChan
+	}
+	cdw.handleSetPixel(image.Point{7, 0}, pixelcanvasioPalette[5], 0)
+
+	if e := <-cdw.eventChan; e.Event != (recording.InvalidateAll{}) {
+		t.Errorf("Got %T, want %T", e.Event, recording.InvalidateAll{})
+	}
+	if e := <-cdw.eventChan; e.Handle == nil || e.Event.(recording.SetImage).Image.Bounds() != rect {
+		t.Errorf("Got %v, want the image of the chunk at %v", e, rect)
+	} else {
+		e.Handle.release()
+	}
+	if e := <-cdw.eventChan; e.Event.(recording.SetPixel).Pos != (image.Point{7, 0}) {
+		t.Errorf("Got %v, want the pixel at %v", e, image.Point{7, 0})
+	}
+}
@@ -0,0 +1,387 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+	"sync/atomic"
+)
+
+// Default size of the canvas event channel. Producers like game connections only block if the broadcaster falls behind this much, see canvasOverflowBlock
+const canvasEventChanSize = 1024
+
+// Default number of events that can wait for a single listener, see chunkPolicySettings.ListenerQueueSize
+const canvasListenerQueueSize = 65536
+
+// Event that signals changed virtual chunks, it's only sent to listeners
+type canvasEventChunksChange struct {
+	Create, Remove map[image.Rectangle]int
+}
+
+// Marker that closes Done once all events queued before it are delivered, it's not sent to the listener
+type canvasEventDelivered struct {
+	Done chan struct{}
+}
+
+// Event for a single listener, together with the virtual chunks it affects
+type canvasListenerEvent struct {
+	Event interface{} // One of the canvasEvent* types
+	VCID  int         // Virtual chunk of canvasEventSetPixel
+	VCIDs []int       // Virtual chunks of rectangle and image events, or one per pixel of canvasEventSetPixels. Empty if the listener doesn't use virtual chunks
+	Valid bool        // Validity of canvasEventSetImage
+}
+
+var canvasNoVCIDs = []int{} // Shared by all events of listeners that don't use virtual chunks. Must not be modified
+
+// Maximum number of pixels that are passed to a single handleSetPixels call
+const canvasPixelBatchSize = 1024
+
+// Number of handler calls in a row that have to fail, before the listener is unsubscribed automatically.
+// Panics of handlers count as failed calls too
+const canvasListenerMaxErrors = 100
+
+// Pixel of a batch of set pixel events
+type canvasListenerPixel struct {
+	Pos    image.Point
+	Color  color.Color
+	Index  int // Index of the color in the known palette of the game, or -1
+	VCID   int
+	Author string // Identifier of the user that placed the pixel, empty if the game doesn't report it
+}
+
+// Listeners that implement this get consecutive set pixel events in one call, instead of calling handleSetPixel for each of them.
+// The slice is reused after the call returns.
+type canvasPixelsListener interface {
+	handleSetPixels(pixels []canvasListenerPixel) error
+}
+
+// Listeners that implement this get set pixel events with the index of the color in the known palette of the game, instead of calling handleSetPixel.
+// The index is -1 if there is no known palette. Listeners that implement canvasPixelsListener get the index with every pixel of the batch instead.
+type canvasPixelIndexListener interface {
+	handleSetPixelIndex(pos image.Point, col color.Color, index int, vcID int) error
+}
+
+// Listeners that implement this get set pixel events with the identifier of the user that placed the pixel, instead of calling handleSetPixel or handleSetPixelIndex.
+// It's only called for pixels with an author, listeners that implement canvasPixelsListener get the author with every pixel of the batch instead.
+type canvasAuthorListener interface {
+	handleSetPixelAuthor(pos image.Point, col color.Color, author string, vcID int) error
+}
+
+// Listeners that implement this are told about failed chunk downloads, e.g. to mark the chunks.
+// The chunks are downloaded again after a backoff, persistent is set once they failed chunkDownloadPersistentFailures times in a row.
+type canvasDownloadFailureListener interface {
+	handleDownloadFailed(rect image.Rectangle, failures int, reason string, persistent bool, vcIDs []int) error
+}
+
+// Listeners that implement this are told when the canvas unsubscribed them, because canvasListenerMaxErrors handler calls in a row failed.
+// err is the last error. No other handler is called after, or concurrently to this.
+type canvasCloseListener interface {
+	handleClose(err error)
+}
+
+// Delivers the events of a single listener in its own goroutine.
+//
+// Events are delivered in batches, in the order they were queued.
+// A slow listener doesn't stall the broadcaster, game connections or other listeners, until its queue is full.
+// Then the overflow policy decides: canvasOverflowDrop drops pixel, image and validity events until the listener caught up,
+// and calls resync with their area. The other policies make push wait for the listener.
+//
+// Once the handlers failed canvasListenerMaxErrors times in a row, failed is called and all further events are discarded.
+type canvasDispatcher struct {
+	sync.Mutex
+
+	listener canvasListener
+	queue    []canvasListenerEvent
+	closed   bool
+
+	limit       int             // Number of events that can be queued, 0 is unlimited
+	drop        bool            // Drop events that don't fit into the queue, instead of waiting
+	space       *sync.Cond      // Broadcasted when the queue got emptied, or the dispatcher is closed
+	dropped     image.Rectangle // Area of the dropped events
+	droppedNum  int             // Number of dropped events since the last resync
+	droppedSome bool            // Set once an event was dropped, all further droppable events are dropped until the queue is empty
+
+	failed  func(d *canvasDispatcher, err error)                         // Called once, from the delivery goroutine
+	resync  func(d *canvasDispatcher, rect image.Rectangle, dropped int) // Called from the delivery goroutine, once dropped events are delivered
+	errors  int                                                          // Handler calls that failed in a row, only used by the delivery goroutine
+	failing bool                                                         // True once failed was called, only used by the delivery goroutine
+
+	signal chan struct{} // Receives an element when there are new events, or the dispatcher is closed
+	done   chan struct{} // Closed when all events are delivered after closing
+}
+
+func newCanvasDispatcher(l canvasListener, limit int, policy string, failed func(d *canvasDispatcher, err error), resync func(d *canvasDispatcher, rect image.Rectangle, dropped int)) *canvasDispatcher {
+	d := &canvasDispatcher{
+		listener: l,
+		limit:    limit,
+		drop:     policy == canvasOverflowDrop,
+		failed:   failed,
+		resync:   resync,
+		signal:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	d.space = sync.NewCond(&d.Mutex)
+
+	go func() {
+		defer close(d.done)
+
+		pl, _ := l.(canvasPixelsListener)
+		var pixels []canvasListenerPixel
+
+		component := fmt.Sprintf("Dispatcher of listener %T", l)
+
+		var batch []canvasListenerEvent
+		for range d.signal {
+			d.Lock()
+			batch, d.queue = d.queue, batch[:0] // Swap buffers, so they are reused
+			closed := d.closed
+			d.space.Broadcast()
+			d.Unlock()
+
+			// A panicking handler only loses the event it was called with, the delivery continues with the next one
+			for i := 0; i < len(batch); i++ {
+				crashed := crashProtect(component, true, func() {
+					for ; i < len(batch); i++ {
+						e := batch[i]
+						if d.failing {
+							if event, ok := e.Event.(canvasEventDelivered); ok {
+								close(event.Done)
+							}
+							batch[i] = canvasListenerEvent{}
+							continue
+						}
+						if pl != nil {
+							if event, ok := e.Event.(canvasEventSetPixel); ok {
+								pixels = append(pixels, canvasListenerPixel{event.Pos, event.Color, event.Index, e.VCID, event.Author})
+								batch[i] = canvasListenerEvent{}
+								// Deliver the pixels once a different event follows, or the batch is full
+								if i+1 < len(batch) && len(pixels) < canvasPixelBatchSize {
+									if _, ok := batch[i+1].Event.(canvasEventSetPixel); ok {
+										continue
+									}
+								}
+								d.count(pl.handleSetPixels(pixels))
+								pixels = pixels[:0]
+								continue
+							}
+						}
+						d.count(d.deliver(e))
+						batch[i] = canvasListenerEvent{} // Don't keep images alive
+					}
+				})
+				if crashed {
+					batch[i] = canvasListenerEvent{}
+					d.count(fmt.Errorf("Handler panicked"))
+				}
+				pixels = pixels[:0]
+			}
+			atomic.AddInt64(&memoryListenerQueues, -int64(len(batch))*memoryEventSize)
+
+			if closed {
+				return
+			}
+
+			// The listener caught up with the dropped events, let it get the current state of their area
+			d.Lock()
+			var resync bool
+			rect, dropped := d.dropped, d.droppedNum
+			if d.droppedSome && len(d.queue) == 0 {
+				resync = !d.closed && !d.failing
+				d.dropped, d.droppedNum, d.droppedSome = image.Rectangle{}, 0, false
+			}
+			d.Unlock()
+			if resync && d.resync != nil {
+				d.resync(d, rect, dropped)
+			}
+		}
+	}()
+
+	return d
+}
+
+// Queues an event for the listener.
+// If the queue is full, pixel, image and validity events are dropped or wait for space, depending on the overflow policy.
+// Other events are always queued
+func (d *canvasDispatcher) push(e canvasListenerEvent) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.limit > 0 {
+		if rect, ok := canvasEventDroppableRect(e.Event); ok {
+			if d.drop {
+				if d.droppedSome || len(d.queue) >= d.limit {
+					d.dropped = d.dropped.Union(rect)
+					d.droppedNum++
+					d.droppedSome = true
+					return
+				}
+			} else {
+				for len(d.queue) >= d.limit && !d.closed {
+					d.space.Wait()
+				}
+			}
+		}
+	}
+
+	d.enqueue(e)
+}
+
+// Queues an event for the listener, even if the queue is full. This never blocks.
+// Used for the current images of chunks, which replace dropped events and therefore must not be dropped themselves
+func (d *canvasDispatcher) pushAlways(e canvasListenerEvent) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.enqueue(e)
+}
+
+// Appends the event to the queue, the caller has to hold the lock
+func (d *canvasDispatcher) enqueue(e canvasListenerEvent) {
+	if d.closed {
+		return
+	}
+	d.queue = append(d.queue, e)
+	atomic.AddInt64(&memoryListenerQueues, memoryEventSize)
+
+	select {
+	case d.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Counts the result of a handler call, and reports the listener once too many calls failed in a row
+func (d *canvasDispatcher) count(err error) {
+	if err == nil {
+		d.errors = 0
+		return
+	}
+
+	d.errors++
+	if d.errors >= canvasListenerMaxErrors && !d.failing {
+		d.failing = true
+		if d.failed != nil {
+			d.failed(d, err)
+		}
+	}
+}
+
+// Calls the handler of the event, and returns its error
+func (d *canvasDispatcher) deliver(e canvasListenerEvent) error {
+	l := d.listener
+
+	switch event := e.Event.(type) {
+	case canvasEventSetPixel:
+		if al, ok := l.(canvasAuthorListener); ok && event.Author != "" {
+			return al.handleSetPixelAuthor(event.Pos, event.Color, event.Author, e.VCID)
+		}
+		if il, ok := l.(canvasPixelIndexListener); ok {
+			return il.handleSetPixelIndex(event.Pos, event.Color, event.Index, e.VCID)
+		}
+		return l.handleSetPixel(event.Pos, event.Color, e.VCID)
+	case canvasEventSetPixels:
+		return d.deliverPixels(event.Pixels, e.VCIDs)
+	case canvasEventSetImage:
+		return l.handleSetImage(event.Image, e.Valid, e.VCIDs)
+	case canvasEventInvalidateRect:
+		return l.handleInvalidateRect(event.Rect, e.VCIDs)
+	case canvasEventInvalidateAll:
+		return l.handleInvalidateAll()
+	case canvasEventRevalidate:
+		return l.handleRevalidateRect(event.Rect, e.VCIDs)
+	case canvasEventSignalDownload:
+		return l.handleSignalDownload(event.Rect, e.VCIDs)
+	case canvasEventDownloadFailed:
+		if fl, ok := l.(canvasDownloadFailureListener); ok {
+			return fl.handleDownloadFailed(event.Rect, event.Failures, event.Reason, event.Failures >= chunkDownloadPersistentFailures, e.VCIDs)
+		}
+		return nil
+	case canvasEventSetTime:
+		return l.handleSetTime(event.Time)
+	case canvasEventChunksChange:
+		return l.handleChunksChange(event.Create, event.Remove)
+	case canvasEventDelivered:
+		close(event.Done)
+		return nil
+	default:
+		canvasLog.Panicf("Unknown listener event occurred: %T", event)
+		return nil
+	}
+}
+
+// Delivers the pixels of a canvasEventSetPixels, in batches of canvasPixelBatchSize if the listener supports them.
+// Returns the last error of the handlers
+func (d *canvasDispatcher) deliverPixels(pixels []canvasEventSetPixel, vcIDs []int) (err error) {
+	l := d.listener
+	vcID := func(i int) int {
+		if i < len(vcIDs) {
+			return vcIDs[i]
+		}
+		return 0
+	}
+
+	if pl, ok := l.(canvasPixelsListener); ok {
+		batch := make([]canvasListenerPixel, 0, canvasPixelBatchSize)
+		for i, pixel := range pixels {
+			batch = append(batch, canvasListenerPixel{pixel.Pos, pixel.Color, pixel.Index, vcID(i), pixel.Author})
+			if len(batch) == canvasPixelBatchSize || i == len(pixels)-1 {
+				if e := pl.handleSetPixels(batch); e != nil {
+					err = e
+				}
+				batch = batch[:0]
+			}
+		}
+		return err
+	}
+
+	il, _ := l.(canvasPixelIndexListener)
+	al, _ := l.(canvasAuthorListener)
+	for i, pixel := range pixels {
+		var e error
+		if al != nil && pixel.Author != "" {
+			e = al.handleSetPixelAuthor(pixel.Pos, pixel.Color, pixel.Author, vcID(i))
+		} else if il != nil {
+			e = il.handleSetPixelIndex(pixel.Pos, pixel.Color, pixel.Index, vcID(i))
+		} else {
+			e = l.handleSetPixel(pixel.Pos, pixel.Color, vcID(i))
+		}
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Stops the dispatcher after all queued events are delivered.
+// The returned channel is closed once that happened.
+func (d *canvasDispatcher) close() <-chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.closed {
+		d.closed = true
+		d.space.Broadcast() // Don't let push wait for events that are never delivered
+		select {
+		case d.signal <- struct{}{}:
+		default:
+		}
+	}
+
+	return d.done
+}
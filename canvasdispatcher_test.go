@@ -0,0 +1,611 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Listener that records the positions of set pixels, and takes its time for each of them
+type testSlowListener struct {
+	sync.Mutex
+	positions []image.Point
+}
+
+func (l *testSlowListener) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+func (l *testSlowListener) handleInvalidateAll() error                                    { return nil }
+func (l *testSlowListener) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error  { return nil }
+func (l *testSlowListener) handleSetImage(img image.Image, valid bool, vcIDs []int) error { return nil }
+func (l *testSlowListener) handleSignalDownload(rect image.Rectangle, vcIDs []int) error  { return nil }
+func (l *testSlowListener) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error  { return nil }
+func (l *testSlowListener) handleSetTime(t time.Time) error                               { return nil }
+
+func (l *testSlowListener) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	time.Sleep(time.Millisecond)
+	l.Lock()
+	defer l.Unlock()
+	l.positions = append(l.positions, pos)
+	return nil
+}
+
+func Test_canvasDispatcher(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	slow := &testSlowListener{}
+	if err := can.subscribeListener(slow, false); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+
+	// Setting pixels doesn't wait for the slow listener
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		can.setPixel(image.Point{i % 64, i / 64}, pixelcanvasioPalette[5])
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Setting pixels took %v, the slow listener stalled the canvas", d)
+	}
+
+	// After unsubscribing, the listener has got all events in order
+	if err := can.unsubscribeListener(slow); err != nil {
+		t.Fatalf("Can't unsubscribe listener: %v", err)
+	}
+	slow.Lock()
+	defer slow.Unlock()
+	if len(slow.positions) != 200 {
+		t.Fatalf("Listener got %v pixels, want 200", len(slow.positions))
+	}
+	for i, pos := range slow.positions {
+		if want := (image.Point{i % 64, i / 64}); pos != want {
+			t.Fatalf("Pixel %v is at %v, want %v", i, pos, want)
+		}
+	}
+}
+
+// Listener that blocks in handleSetPixel until release is closed
+type testBlockedListener struct {
+	testSlowListener
+	release chan struct{}
+}
+
+func (l *testBlockedListener) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	<-l.release
+	return nil
+}
+
+func Test_canvasDispatcherBlocked(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	blocked, other := &testBlockedListener{release: make(chan struct{})}, &testPixelsListener{}
+	for _, l := range []canvasListener{blocked, other} {
+		if err := can.subscribeListener(l, false); err != nil {
+			t.Fatalf("Can't subscribe listener: %v", err)
+		}
+	}
+
+	// The other listener gets all pixels, while the blocked listener still hangs in its first call
+	for i := 0; i < 200; i++ {
+		can.setPixel(image.Point{i % 64, i / 64}, pixelcanvasioPalette[5])
+	}
+	if err := can.unsubscribeListener(other); err != nil {
+		t.Fatalf("Can't unsubscribe listener: %v", err)
+	}
+	if len(other.positions) != 201 { // Including the initial time
+		t.Errorf("Other listener got %v events, want 201", len(other.positions))
+	}
+
+	close(blocked.release)
+	if err := can.unsubscribeListener(blocked); err != nil {
+		t.Fatalf("Can't unsubscribe listener: %v", err)
+	}
+}
+
+// Listener that blocks like testBlockedListener, and records invalidations and images
+type testResyncListener struct {
+	testBlockedListener
+	invalidated []image.Rectangle
+	images      []image.Rectangle
+}
+
+func (l *testResyncListener) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	<-l.release
+	l.Lock()
+	defer l.Unlock()
+	l.positions = append(l.positions, pos)
+	return nil
+}
+
+func (l *testResyncListener) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	l.Lock()
+	defer l.Unlock()
+	l.invalidated = append(l.invalidated, rect)
+	return nil
+}
+
+func (l *testResyncListener) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	l.Lock()
+	defer l.Unlock()
+	l.images = append(l.images, img.Bounds())
+	return nil
+}
+
+func Test_canvasDispatcherOverflow(t *testing.T) {
+	defer setChunkPolicy(getChunkPolicy())
+
+	rect := image.Rect(0, 0, 64, 64)
+	for _, policy := range []string{canvasOverflowDrop, canvasOverflowBlock} {
+		t.Run(policy, func(t *testing.T) {
+			setChunkPolicy(chunkPolicySettings{IdleTimeout: "5m", RequestQueueSize: 1, EventOverflow: policy, ListenerQueueSize: 10})
+			can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+			defer can.Close()
+
+			can.signalDownload(rect)
+			can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+			l := &testResyncListener{testBlockedListener: testBlockedListener{release: make(chan struct{})}}
+			if err := can.subscribeListener(l, false); err != nil {
+				t.Fatalf("Can't subscribe listener: %v", err)
+			}
+			l.Lock()
+			l.images = nil
+			l.Unlock()
+
+			// The broadcaster waits for the blocked listener with the block policy, so release it meanwhile
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				close(l.release)
+			}()
+			for i := 0; i < 200; i++ {
+				can.setPixel(image.Point{i % 64, i / 64}, pixelcanvasioPalette[5])
+			}
+
+			// Wait until the listener got the current image of the chunk, if it dropped pixels
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				l.Lock()
+				done := len(l.positions) == 200 || len(l.images) > 0
+				l.Unlock()
+				if done || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if err := can.unsubscribeListener(l); err != nil {
+				t.Fatalf("Can't unsubscribe listener: %v", err)
+			}
+
+			l.Lock()
+			defer l.Unlock()
+			switch policy {
+			case canvasOverflowDrop:
+				if len(l.positions) >= 200 {
+					t.Errorf("Listener got all %v pixels, want some to be dropped", len(l.positions))
+				}
+				if len(l.invalidated) != 1 || !l.invalidated[0].In(rect) {
+					t.Errorf("Listener got invalidations %v, want one inside of %v", l.invalidated, rect)
+				}
+				if len(l.images) != 1 || l.images[0] != rect {
+					t.Errorf("Listener got images %v, want %v", l.images, rect)
+				}
+			default:
+				if len(l.positions) != 200 {
+					t.Errorf("Listener got %v pixels, want 200", len(l.positions))
+				}
+				if len(l.invalidated) != 0 || len(l.images) != 0 {
+					t.Errorf("Listener got invalidations %v and images %v, want none", l.invalidated, l.images)
+				}
+			}
+		})
+	}
+}
+
+// Listener that gets set pixel events in batches, and records them together with time events
+type testPixelsListener struct {
+	testSlowListener
+	calls   int
+	indices []int
+}
+
+func (l *testPixelsListener) handleSetTime(t time.Time) error {
+	l.Lock()
+	defer l.Unlock()
+	l.positions = append(l.positions, image.Point{-1, -1})
+	return nil
+}
+
+func (l *testPixelsListener) handleSetPixels(pixels []canvasListenerPixel) error {
+	time.Sleep(time.Millisecond)
+	l.Lock()
+	defer l.Unlock()
+	l.calls++
+	for _, pixel := range pixels {
+		l.positions = append(l.positions, pixel.Pos)
+		l.indices = append(l.indices, pixel.Index)
+	}
+	return nil
+}
+
+func Test_canvasDispatcherPixels(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	listener := &testPixelsListener{}
+	if err := can.subscribeListener(listener, false); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+
+	// Other events end a batch, so everything is delivered in order. Subscribing sends the current time first
+	want := []image.Point{{-1, -1}}
+	for i := 0; i < 200; i++ {
+		if i == 100 {
+			can.setTime(time.Now())
+			want = append(want, image.Point{-1, -1})
+		}
+		can.setPixel(image.Point{i % 64, i / 64}, pixelcanvasioPalette[5])
+		want = append(want, image.Point{i % 64, i / 64})
+	}
+
+	if err := can.unsubscribeListener(listener); err != nil {
+		t.Fatalf("Can't unsubscribe listener: %v", err)
+	}
+	listener.Lock()
+	defer listener.Unlock()
+	if len(listener.positions) != len(want) {
+		t.Fatalf("Listener got %v events, want %v", len(listener.positions), len(want))
+	}
+	for i, pos := range listener.positions {
+		if pos != want[i] {
+			t.Fatalf("Event %v is at %v, want %v", i, pos, want[i])
+		}
+	}
+	if listener.calls >= 200 {
+		t.Errorf("Listener got %v calls for 200 pixels, they weren't batched", listener.calls)
+	}
+}
+
+func Test_canvasDispatcherFilter(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	pixels, times := &testPixelsListener{}, &testPixelsListener{}
+	if err := can.subscribeListenerFiltered(pixels, false, canvasEventMaskPixels); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+	if err := can.subscribeListenerFiltered(times, false, canvasEventMaskTime); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+
+	can.setPixel(image.Point{1, 2}, pixelcanvasioPalette[5])
+	can.setTime(time.Now())
+	can.setPixels([]pixelUpdate{{Pos: image.Point{3, 4}, Color: pixelcanvasioPalette[5]}})
+
+	for _, l := range []*testPixelsListener{pixels, times} {
+		if err := can.unsubscribeListener(l); err != nil {
+			t.Fatalf("Can't unsubscribe listener: %v", err)
+		}
+	}
+
+	// The initial time is filtered too
+	if want := []image.Point{{1, 2}, {3, 4}}; !equalPoints(pixels.positions, want) {
+		t.Errorf("Pixel listener got events %v, want %v", pixels.positions, want)
+	}
+	if want := []image.Point{{-1, -1}, {-1, -1}}; !equalPoints(times.positions, want) {
+		t.Errorf("Time listener got events %v, want %v", times.positions, want)
+	}
+}
+
+func equalPoints(a, b []image.Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Listener that records the palette indices of set pixel events
+type testPixelIndexListener struct {
+	testSlowListener
+	indices []int
+}
+
+func (l *testPixelIndexListener) handleSetPixelIndex(pos image.Point, col color.Color, index int, vcID int) error {
+	l.Lock()
+	defer l.Unlock()
+	l.indices = append(l.indices, index)
+	return nil
+}
+
+func Test_canvasPixelIndices(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+	can.Palette.setPalette(pixelcanvasioPalette)
+
+	// Images with colors of the game palette are stored with its indices
+	rect := image.Rect(0, 0, 64, 64)
+	img := image.NewRGBA(rect)
+	draw.Draw(img, rect, &image.Uniform{pixelcanvasioPalette[3]}, image.Point{}, draw.Src)
+	can.signalDownload(rect)
+	can.setImage(img, false, false)
+	if index, err := can.getPixelIndex(image.Point{1, 1}); err != nil || index != 3 {
+		t.Errorf("Got index %v (%v), want 3", index, err)
+	}
+	chunk, _ := can.getChunk(chunkCoordinate{0, 0}, false)
+	if index, err := chunk.getPixelIndex(image.Point{1, 1}); err != nil || index != 3 {
+		t.Errorf("Chunk has index %v (%v), want the one of the game palette", index, err)
+	}
+
+	listener, batchListener := &testPixelIndexListener{}, &testPixelsListener{}
+	for _, l := range []canvasListener{listener, batchListener} {
+		if err := can.subscribeListener(l, false); err != nil {
+			t.Fatalf("Can't subscribe listener: %v", err)
+		}
+	}
+
+	if err := can.setPixelIndex(image.Point{2, 2}, 5); err != nil {
+		t.Fatalf("Can't set pixel index: %v", err)
+	}
+	if err := can.setPixelIndex(image.Point{2, 2}, uint8(len(pixelcanvasioPalette))); err == nil {
+		t.Errorf("Set a pixel to an index outside of the palette")
+	}
+	if col, _ := can.getPixel(image.Point{2, 2}); col != pixelcanvasioPalette[5] {
+		t.Errorf("Pixel has color %v, want %v", col, pixelcanvasioPalette[5])
+	}
+	if index, err := can.getPixelIndex(image.Point{2, 2}); err != nil || index != 5 {
+		t.Errorf("Got index %v (%v), want 5", index, err)
+	}
+
+	for _, l := range []canvasListener{listener, batchListener} {
+		if err := can.unsubscribeListener(l); err != nil {
+			t.Fatalf("Can't unsubscribe listener: %v", err)
+		}
+	}
+	if len(listener.indices) != 1 || listener.indices[0] != 5 {
+		t.Errorf("Listener got indices %v, want [5]", listener.indices)
+	}
+	if len(batchListener.indices) != 1 || batchListener.indices[0] != 5 {
+		t.Errorf("Batch listener got indices %v, want [5]", batchListener.indices)
+	}
+}
+
+func Test_canvasSetPixels(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+	can.Palette.setPalette(pixelcanvasioPalette)
+
+	rect := image.Rect(0, 0, 128, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	batchListener, slow := &testPixelsListener{}, &testSlowListener{}
+	viewer := &testChunkListener{chunks: map[image.Rectangle]int{}, pixelVCID: map[image.Point]int{}}
+	for _, l := range []canvasListener{batchListener, slow} {
+		if err := can.subscribeListener(l, false); err != nil {
+			t.Fatalf("Can't subscribe listener: %v", err)
+		}
+	}
+	if err := can.subscribeListener(viewer, true); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+	can.registerRects(viewer, []image.Rectangle{image.Rect(64, 0, 65, 1)})
+
+	pixels := []pixelUpdate{
+		{Pos: image.Point{1, 1}, Color: pixelcanvasioPalette[5]},
+		{Pos: image.Point{70, 2}, Color: pixelcanvasioPalette[6]},
+		{Pos: image.Point{2000000, 0}, Color: pixelcanvasioPalette[6]}, // Outside of the canvas
+		{Pos: image.Point{200, 200}, Color: pixelcanvasioPalette[7]},   // Without chunk
+		{Pos: image.Point{3, 3}, Color: pixelcanvasioPalette[8]},
+	}
+	if err := can.setPixels(pixels); err == nil {
+		t.Errorf("Setting pixels outside of the canvas and without chunk didn't fail")
+	}
+	for _, pixel := range []pixelUpdate{pixels[0], pixels[1], pixels[4]} {
+		if col, _ := can.getPixel(pixel.Pos); col != pixel.Color {
+			t.Errorf("Pixel at %v has color %v, want %v", pixel.Pos, col, pixel.Color)
+		}
+	}
+
+	for _, l := range []canvasListener{batchListener, slow, viewer} {
+		if err := can.unsubscribeListener(l); err != nil {
+			t.Fatalf("Can't unsubscribe listener: %v", err)
+		}
+	}
+
+	// All pixels inside of the canvas are sent in one call, the positions start with the time of subscribing
+	want := []image.Point{{1, 1}, {70, 2}, {200, 200}, {3, 3}}
+	if batchListener.calls != 1 || len(batchListener.positions) != len(want)+1 {
+		t.Fatalf("Batch listener got %v in %v calls, want %v in 1 call", batchListener.positions, batchListener.calls, want)
+	}
+	for i, pos := range want {
+		if batchListener.positions[i+1] != pos || slow.positions[i] != pos {
+			t.Errorf("Pixel %v is at %v and %v, want %v", i, batchListener.positions[i+1], slow.positions[i], pos)
+		}
+	}
+	if want := 5; batchListener.indices[0] != want {
+		t.Errorf("Got index %v, want %v", batchListener.indices[0], want)
+	}
+
+	// Listeners with virtual chunks only get the pixels of their chunks
+	if len(viewer.pixelVCID) != 1 || viewer.pixelVCID[image.Point{70, 2}] != viewer.chunks[image.Rect(64, 0, 128, 64)] {
+		t.Errorf("Viewer got pixels %v, want only %v of chunk %v", viewer.pixelVCID, image.Point{70, 2}, viewer.chunks[image.Rect(64, 0, 128, 64)])
+	}
+}
+
+func Test_canvasClose(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	slow := &testSlowListener{}
+	if err := can.subscribeListener(slow, false); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+
+	// Senders that race with closing the canvas must not panic
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := can.setPixel(image.Point{j % 64, i}, pixelcanvasioPalette[5]); err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+
+	// Close several times concurrently, all calls return after the listener got its events
+	closers := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			can.Close()
+		}()
+	}
+	closers.Wait()
+	wg.Wait()
+
+	slow.Lock()
+	delivered := len(slow.positions)
+	slow.Unlock()
+
+	if err := can.unsubscribeListener(slow); err == nil {
+		t.Errorf("Unsubscribing from a closed canvas succeeded")
+	}
+	if err := can.setPixel(image.Point{}, pixelcanvasioPalette[5]); err == nil {
+		t.Errorf("Setting a pixel on a closed canvas succeeded")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	slow.Lock()
+	defer slow.Unlock()
+	if len(slow.positions) != delivered {
+		t.Errorf("Listener got %v pixels after the canvas was closed", len(slow.positions)-delivered)
+	}
+}
+
+// Listener that fails every handleSetPixel call, while failing is set
+type testFailingListener struct {
+	testSlowListener
+	failing  bool
+	closeErr error
+	closed   int
+}
+
+func (l *testFailingListener) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	l.Lock()
+	defer l.Unlock()
+	l.positions = append(l.positions, pos)
+	if l.failing {
+		return fmt.Errorf("Broken listener")
+	}
+	return nil
+}
+
+func (l *testFailingListener) handleClose(err error) {
+	l.Lock()
+	defer l.Unlock()
+	l.closeErr = err
+	l.closed++
+}
+
+func Test_canvasListenerErrors(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	// A successful call resets the count of errors in a row
+	flaky, broken := &testFailingListener{}, &testFailingListener{failing: true}
+	for _, l := range []*testFailingListener{flaky, broken} {
+		if err := can.subscribeListener(l, false); err != nil {
+			t.Fatalf("Can't subscribe listener: %v", err)
+		}
+	}
+	for i := 0; i < canvasListenerMaxErrors*2; i++ {
+		flaky.Lock()
+		flaky.failing = i%canvasListenerMaxErrors != 0
+		flaky.Unlock()
+		can.setPixel(image.Point{i % 64, i / 64}, pixelcanvasioPalette[5])
+		if err := can.subscribeListener(flaky, false); err != nil { // Subscribing again waits until the pixel is delivered
+			t.Fatalf("Can't subscribe listener: %v", err)
+		}
+	}
+
+	// The broken listener is unsubscribed asynchronously
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		broken.Lock()
+		closed := broken.closed
+		broken.Unlock()
+		if closed > 0 {
+			break
+		}
+	}
+
+	for _, l := range []*testFailingListener{flaky, broken} {
+		if err := can.unsubscribeListener(l); err != nil {
+			t.Fatalf("Can't unsubscribe listener: %v", err)
+		}
+	}
+
+	if flaky.closed != 0 {
+		t.Errorf("Flaky listener was closed by the canvas")
+	}
+	if len(flaky.positions) != canvasListenerMaxErrors*2 {
+		t.Errorf("Flaky listener got %v pixels, want %v", len(flaky.positions), canvasListenerMaxErrors*2)
+	}
+	if broken.closed != 1 || broken.closeErr == nil {
+		t.Errorf("Broken listener was closed %v times with %v, want once with an error", broken.closed, broken.closeErr)
+	}
+	if len(broken.positions) != canvasListenerMaxErrors {
+		t.Errorf("Broken listener got %v pixels, want %v", len(broken.positions), canvasListenerMaxErrors)
+	}
+}
@@ -0,0 +1,216 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"time"
+)
+
+// Extracts frames of recordings at increasing points in time.
+//
+// In contrast to the canvasDiskReader, this doesn't pace the replay in any way.
+// Events are applied as fast as possible, until the requested point in time is reached.
+// This is meant to be used by exporters.
+type canvasFrameExtractor struct {
+	ShortName  string
+	Canvas     *canvas
+	Recordings []canvasDiskReaderRecording
+
+	recIndex   int                // Index of the currently opened recording, -1 if there is none
+	decoder    *canvasDiskDecoder // Decoder of the currently opened recording, nil if it ended
+	replayTime time.Time
+
+	// Event that was read, but not applied yet, as it is in the future
+	nextEvent     interface{}
+	nextEventTime time.Time
+
+	applied  int // Number of applied events, to check regularly whether chunks have to be spilled
+	throttle *backgroundThrottle
+}
+
+func newCanvasFrameExtractor(shortName string) (*canvasFrameExtractor, error) {
+	cdr := canvasDiskReaderFor(shortName)
+
+	recs, err := cdr.refreshRecordings()
+	if err != nil {
+		return nil, fmt.Errorf("Can't get recordings from %v: %v", shortName, err)
+	}
+
+	if len(recs) <= 0 {
+		return nil, fmt.Errorf("Found no recordings for %v", shortName)
+	}
+
+	can, _ := newCanvas(cdr.ChunkSize, cdr.ChunkOrigin, image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32))
+	if limit := getExportSettings().SpillLimit; limit > 0 {
+		if err := can.enableSpill(int64(limit) << 20); err != nil {
+			exportLog.Warnf("Exporting %v without spilling chunks: %v", shortName, err)
+		}
+	}
+
+	cfe := &canvasFrameExtractor{
+		ShortName:  cdr.ShortName,
+		Canvas:     can,
+		Recordings: recs,
+		recIndex:   -1,
+		throttle:   newBackgroundThrottle(backgroundThrottleInterval),
+	}
+
+	return cfe, nil
+}
+
+// Returns the time range that is covered by all recordings
+func (cfe *canvasFrameExtractor) getTimeRange() (startTime, endTime time.Time) {
+	return cfe.Recordings[0].StartTime, cfe.Recordings[len(cfe.Recordings)-1].EndTime
+}
+
+func (cfe *canvasFrameExtractor) closeRecording() {
+	if cfe.decoder != nil {
+		cfe.decoder.Close()
+		cfe.decoder = nil
+	}
+	cfe.nextEvent = nil
+	cfe.recIndex = -1
+
+	cfe.Canvas.invalidateAll()
+}
+
+func (cfe *canvasFrameExtractor) openRecording(index int) error {
+	cfe.closeRecording()
+
+	rec := cfe.Recordings[index]
+	decoder, err := openCanvasDiskDecoder(rec.FileName, getBackgroundSettings().getWorkers())
+	if err != nil {
+		return err
+	}
+	if cfe.Canvas.ChunkSize != decoder.ChunkSize || cfe.Canvas.Origin != decoder.ChunkOrigin {
+		decoder.Close()
+		return fmt.Errorf("Chunk size or origin differs in recording %v", rec.FileName)
+	}
+
+	cfe.decoder, cfe.recIndex = decoder, index
+	cfe.replayTime = decoder.StartTime
+
+	return nil
+}
+
+// Replays all events up to and including the given point in time.
+//
+// If t is before the last replayed time, or in a different recording, the corresponding recording will be read from its beginning.
+func (cfe *canvasFrameExtractor) seek(t time.Time) error {
+	index := -1
+	for i, rec := range cfe.Recordings {
+		if !t.Before(rec.StartTime) && t.Before(rec.EndTime) {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		// Outside of any recording, there is nothing to show
+		if cfe.recIndex >= 0 {
+			cfe.closeRecording()
+		}
+		cfe.replayTime = t
+		return nil
+	}
+
+	if index != cfe.recIndex || t.Before(cfe.replayTime) {
+		if err := cfe.openRecording(index); err != nil {
+			return err
+		}
+	}
+
+	for cfe.decoder != nil {
+		if cfe.nextEvent == nil {
+			eventTime, event, err := cfe.decoder.next()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// Recording ended (or was cut off), stay at the last state
+				cfe.decoder.Close()
+				cfe.decoder = nil
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("Error while reading recording %v: %v", cfe.Recordings[cfe.recIndex].FileName, err)
+			}
+			cfe.nextEvent, cfe.nextEventTime = event, eventTime
+		}
+
+		if cfe.nextEventTime.After(t) {
+			break
+		}
+
+		canvasDiskReaderApplyEvent(cfe.Canvas, cfe.nextEvent)
+		cfe.nextEvent = nil
+
+		if cfe.applied++; cfe.applied%canvasSpillCheckInterval == 0 {
+			if _, err := cfe.Canvas.spillColdChunks(); err != nil {
+				return fmt.Errorf("Can't spill chunks: %v", err)
+			}
+		}
+		cfe.throttle.step()
+	}
+
+	cfe.replayTime = t
+
+	return nil
+}
+
+// Returns an image of the given rectangle at the point in time t.
+//
+// Points in time should be requested in ascending order, otherwise the recording has to be read again from its beginning.
+func (cfe *canvasFrameExtractor) getFrame(t time.Time, rect image.Rectangle) (*image.RGBA, error) {
+	if err := cfe.seek(t); err != nil {
+		return nil, err
+	}
+
+	return cfe.Canvas.getImageCopy(rect, false, true)
+}
+
+// Returns the palette of the replayed canvas.
+// As the images of a recording are stored paletted, this is the palette of the game.
+// If the canvas isn't paletted, the palette in the configuration at .palettes.<shortName> is used, or nil if there is none.
+//
+// Images are stored as BMP, which pads palettes to 256 colors.
+// Trailing colors that repeat earlier colors of the palette are removed.
+func (cfe *canvasFrameExtractor) getPalette() color.Palette {
+	for _, chunk := range cfe.Canvas.getAllChunks() {
+		chunk.RLock()
+		img, ok := chunk.Image.(*image.Paletted)
+		chunk.RUnlock()
+		if ok {
+			pal := img.Palette
+			for len(pal) > 1 && pal.Index(pal[len(pal)-1]) < len(pal)-1 {
+				pal = pal[:len(pal)-1]
+			}
+			return pal
+		}
+	}
+
+	return getConfiguredPalette(conf, cfe.ShortName)
+}
+
+// Closes the extractor and its canvas
+func (cfe *canvasFrameExtractor) Close() {
+	cfe.closeRecording()
+
+	cfe.Canvas.Close()
+}
@@ -0,0 +1,139 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Temporary recordings directories of the running tests, see useTestRecordingsDir
+var testRecordingsDirs = map[*testing.T]string{}
+
+// Points the recordings directory at a temporary directory until the test ends, so no recordings are left behind.
+// Calling it again within the same test keeps the directory.
+func useTestRecordingsDir(t *testing.T) string {
+	if dir, ok := testRecordingsDirs[t]; ok {
+		return dir
+	}
+
+	oldPaths := getPaths()
+	paths := oldPaths
+	paths.Recordings = t.TempDir()
+	setPathSettings(paths)
+	testRecordingsDirs[t] = paths.Recordings
+
+	t.Cleanup(func() {
+		setPathSettings(oldPaths)
+		delete(testRecordingsDirs, t)
+	})
+
+	return paths.Recordings
+}
+
+// Writes a short recording for shortName, containing a single chunk with a pixel set at returned position.
+// The recording is written into the temporary recordings directory of the test, see useTestRecordingsDir.
+// The returned time is after all recorded events.
+func writeTestRecording(t *testing.T, shortName string) (image.Rectangle, image.Point, time.Time) {
+	useTestRecordingsDir(t)
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+
+	cdw, err := can.newCanvasDiskWriter(shortName, 0)
+	if err != nil {
+		t.Fatalf("Can't create canvas disk writer: %v", err)
+	}
+
+	rect := image.Rect(0, 0, 64, 64)
+	if _, err := can.signalDownload(rect); err != nil {
+		t.Errorf("Can't signal download at rectangle %v: %v", rect, err)
+	}
+	if err := can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false); err != nil {
+		t.Errorf("Can't set image at %v: %v", rect, err)
+	}
+	pos := image.Point{1, 2}
+	if err := can.setPixel(pos, pixelcanvasioPalette[5]); err != nil {
+		t.Errorf("Can't set pixel at %v: %v", pos, err)
+	}
+
+	cdw.Close()
+	can.Close()
+
+	return rect, pos, time.Now()
+}
+
+func Test_canvasFrameExtractor(t *testing.T) {
+	rect, pos, frameTime := writeTestRecording(t, "Test-FrameExtractor")
+
+	cfe, err := newCanvasFrameExtractor("Test-FrameExtractor")
+	if err != nil {
+		t.Fatalf("Can't create frame extractor: %v", err)
+	}
+	defer cfe.Close()
+
+	img, err := cfe.getFrame(frameTime, rect)
+	if err != nil {
+		t.Fatalf("Can't get frame at %v: %v", frameTime, err)
+	}
+
+	if got, want := img.At(pos.X, pos.Y), color.RGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+		t.Errorf("Pixel at %v = %v, want %v", pos, got, want)
+	}
+	if got, want := img.At(0, 0), color.RGBAModel.Convert(pixelcanvasioPalette[0]); got != want {
+		t.Errorf("Pixel at %v = %v, want %v", image.Point{}, got, want)
+	}
+}
+
+func Test_canvasFrameExtractorRemote(t *testing.T) {
+	rect, pos, frameTime := writeTestRecording(t, "Test-RemoteRecording")
+
+	as := newAPIServer()
+	defer as.Close()
+	server := httptest.NewServer(as.handler())
+	defer server.Close()
+
+	cfe, err := newCanvasFrameExtractor(server.URL + "/api/recordings/Test-RemoteRecording")
+	if err != nil {
+		t.Fatalf("Can't create frame extractor: %v", err)
+	}
+	defer cfe.Close()
+
+	img, err := cfe.getFrame(frameTime, rect)
+	if err != nil {
+		t.Fatalf("Can't get frame at %v: %v", frameTime, err)
+	}
+	if got, want := img.At(pos.X, pos.Y), color.RGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+		t.Errorf("Pixel at %v = %v, want %v", pos, got, want)
+	}
+
+	// Only the beginning of a file is requested, when just the header is needed
+	f, err := openRecordingFile(cfe.Recordings[0].FileName, true)
+	if err != nil {
+		t.Fatalf("Can't open remote recording: %v", err)
+	}
+	f.Close()
+
+	if resp, err := http.Get(server.URL + "/api/recordings/Test-RemoteRecording/..%2Fconfig.json"); err != nil {
+		t.Errorf("Can't request file: %v", err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Request outside of the recordings directory returned %v, want %v", resp.Status, http.StatusNotFound)
+	}
+}
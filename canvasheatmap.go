@@ -0,0 +1,337 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+// Number of intervals the window of a live heatmap is divided into. Queried windows are rounded up to whole intervals
+const canvasHeatmapBuckets = 60
+
+// Shortest window of a live heatmap
+const canvasHeatmapMinWindow = time.Minute
+
+// Settings of the live heatmap of a game, stored in the configuration at .heatmaps.<game>
+type canvasHeatmapSettings struct {
+	Window   string // Duration like "24h", how long changes are counted. Empty disables the heatmap
+	PerChunk bool   // Count the changes per chunk instead of per pixel, which needs much less memory
+}
+
+func (s canvasHeatmapSettings) validate() error {
+	if s.Window == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(s.Window)
+	if err != nil {
+		return fmt.Errorf("Invalid window %q: %v", s.Window, err)
+	}
+	if d < canvasHeatmapMinWindow {
+		return fmt.Errorf("Window %v must be at least %v", d, canvasHeatmapMinWindow)
+	}
+	return nil
+}
+
+// Changes that were counted in one interval of a live heatmap
+type canvasHeatmapBucket struct {
+	Start  time.Time
+	Counts map[image.Point]uint32 // By pixel position, or by chunk coordinate if counted per chunk
+}
+
+// Changes counted at a pixel or chunk of a live heatmap
+type canvasHeatmapEntry struct {
+	Rect  image.Rectangle `json:"rect"` // A single pixel, or a chunk
+	Count uint32          `json:"count"`
+}
+
+// Counts the changes per pixel or per chunk of a canvas, within a sliding window.
+//
+// It's opened together with the game connection, but only counts once a window is set in its settings.
+// Unlike heatmapAccumulator, which counts changes of recordings, it only knows what happened while the game was open.
+type canvasHeatmap struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas    *canvas
+	ShortName string
+
+	sync.Mutex
+	window   time.Duration // 0 if the heatmap is disabled
+	interval time.Duration // Length of a bucket
+	perChunk bool
+	buckets  []canvasHeatmapBucket // Oldest first, intervals without any changes are missing
+
+	config     *configdb.Config
+	callbackID int
+}
+
+var canvasHeatmapGames = struct {
+	sync.Mutex
+	games map[string]*canvasHeatmap
+}{
+	games: map[string]*canvasHeatmap{},
+}
+
+// Starts the live heatmap of the canvas of the given game.
+//
+// The settings are read from c and applied when they change. If c is nil, nothing is counted until setSettings is called.
+func (can *canvas) newCanvasHeatmap(c *configdb.Config, shortName string) (*canvasHeatmap, error) {
+	hm := &canvasHeatmap{
+		Canvas:    can,
+		ShortName: shortName,
+		config:    c,
+	}
+
+	if err := can.subscribeListenerFiltered(hm, false, canvasEventMaskPixels); err != nil {
+		return nil, err
+	}
+
+	canvasHeatmapGames.Lock()
+	canvasHeatmapGames.games[shortName] = hm
+	canvasHeatmapGames.Unlock()
+
+	if c != nil {
+		hm.callbackID = c.RegisterCallback([]string{".heatmaps." + shortName}, func(c *configdb.Config, modified, added, removed []string) {
+			settings := canvasHeatmapSettings{}
+			c.Get(".heatmaps."+shortName, &settings)
+			if err := settings.validate(); err != nil {
+				log.Errorf("Invalid settings at .heatmaps.%v, the heatmap is disabled: %v", shortName, err)
+				settings = canvasHeatmapSettings{}
+			}
+			hm.setSettings(settings)
+		})
+	}
+
+	return hm, nil
+}
+
+// Returns the live heatmap of an open game
+func getCanvasHeatmap(shortName string) (*canvasHeatmap, error) {
+	canvasHeatmapGames.Lock()
+	defer canvasHeatmapGames.Unlock()
+
+	hm, ok := canvasHeatmapGames.games[shortName]
+	if !ok {
+		return nil, fmt.Errorf("There is no heatmap of %q", shortName)
+	}
+	return hm, nil
+}
+
+// Changes the window and what the changes are counted per. The counts so far are dropped
+func (hm *canvasHeatmap) setSettings(settings canvasHeatmapSettings) error {
+	hm.ClosedMutex.RLock()
+	defer hm.ClosedMutex.RUnlock()
+	if hm.Closed {
+		return fmt.Errorf("Heatmap is closed")
+	}
+	if err := settings.validate(); err != nil {
+		return err
+	}
+
+	hm.Lock()
+	defer hm.Unlock()
+
+	hm.window, hm.perChunk, hm.buckets = 0, settings.PerChunk, nil
+	if d, err := time.ParseDuration(settings.Window); err == nil {
+		hm.window, hm.interval = d, d/canvasHeatmapBuckets
+	}
+
+	return nil
+}
+
+// Counts a change at the given time. The lock must be held
+func (hm *canvasHeatmap) count(pos image.Point, t time.Time) {
+	if hm.window == 0 {
+		return
+	}
+
+	key := pos
+	if hm.perChunk {
+		key = image.Point(hm.Canvas.ChunkSize.getChunkCoord(pos, hm.Canvas.Origin))
+	}
+
+	t = t.Truncate(hm.interval)
+	if n := len(hm.buckets); n > 0 && !hm.buckets[n-1].Start.Before(t) {
+		hm.buckets[n-1].Counts[key]++
+		return
+	}
+
+	// Drop the buckets that are outside of the window, once per interval
+	cut := 0
+	for cut < len(hm.buckets) && t.Sub(hm.buckets[cut].Start) >= hm.window {
+		cut++
+	}
+	hm.buckets = append(hm.buckets[cut:], canvasHeatmapBucket{Start: t, Counts: map[image.Point]uint32{key: 1}})
+}
+
+// Returns the counts within window before now, summed up by pixel position or chunk coordinate.
+// A window of 0 or larger than the one of the settings returns all counts
+func (hm *canvasHeatmap) sum(window time.Duration, now time.Time) (counts map[image.Point]uint32, perChunk bool, err error) {
+	hm.Lock()
+	defer hm.Unlock()
+
+	if hm.window == 0 {
+		return nil, false, fmt.Errorf("The heatmap of %q is disabled, see .heatmaps.%v in the configuration", hm.ShortName, hm.ShortName)
+	}
+	if window <= 0 || window > hm.window {
+		window = hm.window
+	}
+	window = (window + hm.interval - 1) / hm.interval * hm.interval
+
+	first := now.Truncate(hm.interval).Add(hm.interval - window)
+	counts = map[image.Point]uint32{}
+	for _, bucket := range hm.buckets {
+		if bucket.Start.Before(first) {
+			continue
+		}
+		for key, count := range bucket.Counts {
+			counts[key] += count
+		}
+	}
+
+	return counts, hm.perChunk, nil
+}
+
+// Returns the area of a key of the counts
+func (hm *canvasHeatmap) keyRect(key image.Point, perChunk bool) image.Rectangle {
+	if !perChunk {
+		return image.Rectangle{key, key.Add(image.Point{1, 1})}
+	}
+	min := image.Point{key.X*hm.Canvas.ChunkSize.X - hm.Canvas.Origin.X, key.Y*hm.Canvas.ChunkSize.Y - hm.Canvas.Origin.Y}
+	return image.Rectangle{min, min.Add(image.Point{hm.Canvas.ChunkSize.X, hm.Canvas.ChunkSize.Y})}
+}
+
+// Returns the counts of the pixels or chunks that overlap rect and changed within window before now, sorted by position.
+// An empty rect returns the counts of the whole canvas
+func (hm *canvasHeatmap) getEntries(rect image.Rectangle, window time.Duration, now time.Time) ([]canvasHeatmapEntry, error) {
+	counts, perChunk, err := hm.sum(window, now)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []canvasHeatmapEntry{}
+	for key, count := range counts {
+		keyRect := hm.keyRect(key, perChunk)
+		if rect.Empty() || keyRect.Overlaps(rect) {
+			entries = append(entries, canvasHeatmapEntry{Rect: keyRect, Count: count})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].Rect.Min, entries[j].Rect.Min
+		return a.Y < b.Y || a.Y == b.Y && a.X < b.X
+	})
+
+	return entries, nil
+}
+
+// Returns the counts of the pixels of rect within window before now, so they can be rendered like the heatmaps of recordings.
+// Counted chunks fill all of their pixels with their count
+func (hm *canvasHeatmap) getAccumulator(rect image.Rectangle, window time.Duration, now time.Time) (*heatmapAccumulator, error) {
+	counts, perChunk, err := hm.sum(window, now)
+	if err != nil {
+		return nil, err
+	}
+
+	ha := newHeatmapAccumulator(rect)
+	for key, count := range counts {
+		area := hm.keyRect(key, perChunk).Intersect(ha.Rect)
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				ha.Counts[(y-ha.Rect.Min.Y)*ha.Rect.Dx()+(x-ha.Rect.Min.X)] += count
+			}
+		}
+	}
+
+	return ha, nil
+}
+
+func (hm *canvasHeatmap) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	hm.Lock()
+	defer hm.Unlock()
+
+	hm.count(pos, time.Now())
+	return nil
+}
+
+func (hm *canvasHeatmap) handleSetPixels(pixels []canvasListenerPixel) error {
+	hm.Lock()
+	defer hm.Unlock()
+
+	t := time.Now()
+	for _, pixel := range pixels {
+		hm.count(pixel.Pos, t)
+	}
+	return nil
+}
+
+func (hm *canvasHeatmap) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (hm *canvasHeatmap) handleInvalidateAll() error {
+	return nil
+}
+
+func (hm *canvasHeatmap) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (hm *canvasHeatmap) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+
+func (hm *canvasHeatmap) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (hm *canvasHeatmap) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (hm *canvasHeatmap) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Stops counting, and unregisters the heatmap of the game
+func (hm *canvasHeatmap) Close() {
+	hm.ClosedMutex.Lock()
+	if hm.Closed {
+		hm.ClosedMutex.Unlock()
+		return
+	}
+	hm.Closed = true
+	hm.ClosedMutex.Unlock()
+
+	if hm.config != nil {
+		hm.config.UnregisterCallback(hm.callbackID)
+	}
+
+	canvasHeatmapGames.Lock()
+	if canvasHeatmapGames.games[hm.ShortName] == hm {
+		delete(canvasHeatmapGames.games, hm.ShortName)
+	}
+	canvasHeatmapGames.Unlock()
+
+	hm.Canvas.unsubscribeListener(hm)
+}
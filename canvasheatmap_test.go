@@ -0,0 +1,114 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+func Test_canvasHeatmap(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	hm, err := can.newCanvasHeatmap(nil, "test")
+	if err != nil {
+		t.Fatalf("Can't start heatmap: %v", err)
+	}
+	defer hm.Close()
+
+	if _, err := getCanvasHeatmap("test"); err != nil {
+		t.Errorf("Heatmap isn't registered: %v", err)
+	}
+	if _, err := hm.getEntries(image.Rectangle{}, 0, time.Now()); err == nil {
+		t.Errorf("Got counts of a disabled heatmap")
+	}
+	if err := hm.setSettings(canvasHeatmapSettings{Window: "1s"}); err == nil {
+		t.Errorf("Window shorter than %v was accepted", canvasHeatmapMinWindow)
+	}
+
+	// A window of an hour has buckets of a minute
+	if err := hm.setSettings(canvasHeatmapSettings{Window: "1h"}); err != nil {
+		t.Fatalf("Can't set settings: %v", err)
+	}
+	now := time.Date(2019, 6, 14, 12, 0, 30, 0, time.UTC)
+	hm.Lock()
+	hm.count(image.Point{1, 2}, now.Add(-90*time.Minute)) // Outside of the window, dropped with the next bucket
+	hm.count(image.Point{1, 2}, now.Add(-30*time.Minute))
+	hm.count(image.Point{1, 2}, now)
+	hm.count(image.Point{1, 2}, now)
+	hm.count(image.Point{70, 2}, now)
+	buckets := len(hm.buckets)
+	hm.Unlock()
+	if buckets != 2 {
+		t.Errorf("Heatmap has %v buckets, want 2", buckets)
+	}
+
+	tests := []struct {
+		rect   image.Rectangle
+		window time.Duration
+		want   []canvasHeatmapEntry
+	}{
+		{image.Rectangle{}, 0, []canvasHeatmapEntry{{image.Rect(1, 2, 2, 3), 3}, {image.Rect(70, 2, 71, 3), 1}}},
+		{image.Rectangle{}, 10 * time.Second, []canvasHeatmapEntry{{image.Rect(1, 2, 2, 3), 2}, {image.Rect(70, 2, 71, 3), 1}}}, // Rounded up to the current minute
+		{image.Rect(0, 0, 64, 64), 2 * time.Hour, []canvasHeatmapEntry{{image.Rect(1, 2, 2, 3), 3}}},
+	}
+	for _, test := range tests {
+		entries, err := hm.getEntries(test.rect, test.window, now)
+		if err != nil {
+			t.Fatalf("Can't get counts: %v", err)
+		}
+		if len(entries) != len(test.want) {
+			t.Errorf("Got %v in %v within %v, want %v", entries, test.rect, test.window, test.want)
+			continue
+		}
+		for i := range entries {
+			if entries[i] != test.want[i] {
+				t.Errorf("Got %v in %v within %v, want %v", entries, test.rect, test.window, test.want)
+				break
+			}
+		}
+	}
+
+	// Live changes are counted per chunk, which fills all pixels of the chunk in images
+	if err := hm.setSettings(canvasHeatmapSettings{Window: "1h", PerChunk: true}); err != nil {
+		t.Fatalf("Can't set settings: %v", err)
+	}
+	can.setPixel(image.Point{1, 2}, pixelcanvasioPalette[5])
+	can.setPixels([]pixelUpdate{{Pos: image.Point{3, 4}, Color: pixelcanvasioPalette[5]}, {Pos: image.Point{-1, 0}, Color: pixelcanvasioPalette[5]}})
+	if err := can.unsubscribeListener(hm); err != nil { // Waits until the heatmap got the pixels
+		t.Fatalf("Can't unsubscribe heatmap: %v", err)
+	}
+
+	entries, err := hm.getEntries(image.Rectangle{}, 0, time.Now())
+	if err != nil {
+		t.Fatalf("Can't get counts: %v", err)
+	}
+	want := []canvasHeatmapEntry{{image.Rect(-64, 0, 0, 64), 1}, {image.Rect(0, 0, 64, 64), 2}}
+	if len(entries) != 2 || entries[0] != want[0] || entries[1] != want[1] {
+		t.Errorf("Got chunk counts %v, want %v", entries, want)
+	}
+
+	ha, err := hm.getAccumulator(image.Rect(-2, 0, 2, 1), 0, time.Now())
+	if err != nil {
+		t.Fatalf("Can't get counts: %v", err)
+	}
+	if want := []uint32{1, 1, 2, 2}; len(ha.Counts) != len(want) || ha.Counts[0] != want[0] || ha.Counts[1] != want[1] || ha.Counts[2] != want[2] || ha.Counts[3] != want[3] {
+		t.Errorf("Got pixel counts %v, want %v", ha.Counts, want)
+	}
+}
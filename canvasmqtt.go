@@ -0,0 +1,324 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var mqttLog = moduleLog("mqtt")
+
+// Settings of a canvas MQTT publisher, stored in the configuration at .mqtt.<shortName>
+type canvasMQTTSettings struct {
+	Broker      string            // Address of the MQTT broker, e.g. "localhost:1883". Publishing is disabled if this is empty
+	ClientID    string            // Defaults to "d3pixelbot-<shortName>-<pid>"
+	Username    string            // Optional
+	Password    string            // Optional
+	TopicPrefix string            // Prefix of all topics. Defaults to "d3pixelbot"
+	Rects       []image.Rectangle // Only events inside these rectangles are published. Everything is published if this is empty
+}
+
+// Maximum number of queued messages. If the broker can't keep up, further messages are dropped
+const canvasMQTTQueueSize = 10000
+
+// A message that is queued for publishing
+type canvasMQTTMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// Publishes pixel and invalidation events of a canvas to an MQTT broker.
+//
+// Events are published with QoS 0 on the following topics:
+//
+//	<prefix>/<shortName>/chunk/<x>/<y>/pixel         {"x": 1, "y": 2, "color": "#RRGGBB"}
+//	<prefix>/<shortName>/chunk/<x>/<y>/invalidate    {"x": 0, "y": 0, "width": 64, "height": 64}
+//	<prefix>/<shortName>/chunk/<x>/<y>/revalidate    {"x": 0, "y": 0, "width": 64, "height": 64}
+//	<prefix>/<shortName>/chunk/<x>/<y>/image         {"x": 0, "y": 0, "width": 64, "height": 64}
+//	<prefix>/<shortName>/invalidate                  {}
+//
+// x and y of the topics are chunk coordinates.
+// The image topic signals that a chunk was downloaded, its content can be queried with the API server.
+type canvasMQTTPublisher struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas    *canvas
+	ShortName string
+
+	settingsMutex sync.RWMutex
+	settings      canvasMQTTSettings // Current settings, used by the event handlers to build topics and filter events
+
+	messageChan  chan canvasMQTTMessage
+	droppedCount int // Only accessed by the canvas goroutine
+
+	settingsChan chan canvasMQTTSettings
+	quitChan     chan struct{}
+	waitGroup    sync.WaitGroup
+}
+
+func (can *canvas) newCanvasMQTTPublisher(shortName string) (*canvasMQTTPublisher, error) {
+	re := regexp.MustCompile("[^a-zA-Z0-9\\-\\.]+")
+
+	cm := &canvasMQTTPublisher{
+		Canvas:       can,
+		ShortName:    re.ReplaceAllString(shortName, "_"),
+		messageChan:  make(chan canvasMQTTMessage, memoryQueueSize(canvasMQTTQueueSize)),
+		settingsChan: make(chan canvasMQTTSettings),
+		quitChan:     make(chan struct{}),
+	}
+
+	if err := can.subscribeListenerFiltered(cm, false, canvasEventMaskPixels|canvasEventMaskImages|canvasEventMaskValidity); err != nil {
+		return nil, err
+	}
+
+	cm.waitGroup.Add(1)
+	go func() {
+		defer cm.waitGroup.Done()
+
+		const keepAlive = 60 * time.Second
+
+		settings := canvasMQTTSettings{}
+		var client *mqttClient
+		var doneChan <-chan struct{}
+		var reconnectChan <-chan time.Time
+
+		ticker := time.NewTicker(keepAlive / 2)
+		defer ticker.Stop()
+
+		disconnect := func() {
+			if client != nil {
+				client.Close()
+				client, doneChan = nil, nil
+			}
+		}
+		defer disconnect()
+
+		connect := func() {
+			reconnectChan = nil
+			if settings.Broker == "" {
+				return
+			}
+			clientID := settings.ClientID
+			if clientID == "" {
+				clientID = fmt.Sprintf("d3pixelbot-%v-%v", cm.ShortName, os.Getpid())
+			}
+			var err error
+			if client, err = mqttDial(settings.Broker, clientID, settings.Username, settings.Password, keepAlive); err != nil {
+				mqttLog.Errorf("Can't connect to MQTT broker %v: %v", settings.Broker, err)
+				client, reconnectChan = nil, time.After(10*time.Second)
+				return
+			}
+			doneChan = client.done()
+		}
+
+		for {
+			select {
+			case settings = <-cm.settingsChan:
+				disconnect()
+				connect()
+			case <-reconnectChan:
+				connect()
+			case <-doneChan:
+				mqttLog.Warnf("Connection to MQTT broker %v lost: %v", settings.Broker, client.err)
+				client.Close()
+				client, doneChan = nil, nil
+				reconnectChan = time.After(10 * time.Second)
+			case msg := <-cm.messageChan:
+				if client == nil {
+					break // Drop messages while disconnected
+				}
+				if err := client.publish(msg.Topic, msg.Payload, false); err != nil {
+					mqttLog.Warnf("Can't publish to MQTT broker %v: %v", settings.Broker, err)
+					client.Close()
+					client, doneChan = nil, nil
+					reconnectChan = time.After(10 * time.Second)
+				}
+			case <-ticker.C:
+				if client != nil {
+					client.ping()
+				}
+			case <-cm.quitChan:
+				return
+			}
+		}
+	}()
+
+	return cm, nil
+}
+
+// Changes the settings of the publisher, and reconnects to the broker.
+// The rectangles are registered at the canvas, so that they are kept up to date.
+func (cm *canvasMQTTPublisher) setSettings(settings canvasMQTTSettings) error {
+	cm.ClosedMutex.RLock()
+	defer cm.ClosedMutex.RUnlock()
+	if cm.Closed {
+		return fmt.Errorf("MQTT publisher is closed")
+	}
+
+	if settings.TopicPrefix == "" {
+		settings.TopicPrefix = "d3pixelbot"
+	}
+
+	cm.settingsMutex.Lock()
+	cm.settings = settings
+	cm.settingsMutex.Unlock()
+
+	if err := cm.Canvas.registerRects(cm, settings.Rects); err != nil {
+		return err
+	}
+
+	cm.settingsChan <- settings
+
+	return nil
+}
+
+// Queues a message for all chunks that intersect with rect, if the rect is inside the configured rectangles
+func (cm *canvasMQTTPublisher) queue(rect image.Rectangle, subTopic string, payload interface{}) error {
+	cm.ClosedMutex.RLock()
+	defer cm.ClosedMutex.RUnlock()
+	if cm.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	cm.settingsMutex.RLock()
+	settings := cm.settings
+	cm.settingsMutex.RUnlock()
+
+	if settings.Broker == "" {
+		return nil
+	}
+
+	if len(settings.Rects) > 0 {
+		inside := false
+		for _, r := range settings.Rects {
+			if rect.Overlaps(r) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	topics := []string{}
+	if rect.Empty() {
+		topics = append(topics, fmt.Sprintf("%v/%v/%v", settings.TopicPrefix, cm.ShortName, subTopic))
+	} else {
+		chunkRect := cm.Canvas.ChunkSize.getOuterChunkRect(rect, cm.Canvas.Origin)
+		for iy := chunkRect.Min.Y; iy < chunkRect.Max.Y; iy++ {
+			for ix := chunkRect.Min.X; ix < chunkRect.Max.X; ix++ {
+				topics = append(topics, fmt.Sprintf("%v/%v/chunk/%v/%v/%v", settings.TopicPrefix, cm.ShortName, ix, iy, subTopic))
+			}
+		}
+	}
+
+	for _, topic := range topics {
+		select {
+		case cm.messageChan <- canvasMQTTMessage{topic, data}:
+		default:
+			// Don't block the canvas, just count and report dropped messages
+			if cm.droppedCount%1000 == 0 {
+				mqttLog.Warnf("MQTT queue of %v is full, dropped %v messages so far", cm.ShortName, cm.droppedCount+1)
+			}
+			cm.droppedCount++
+		}
+	}
+
+	return nil
+}
+
+// Rectangle payload of invalidation events
+type canvasMQTTRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func (cm *canvasMQTTPublisher) handleInvalidateAll() error {
+	return cm.queue(image.Rectangle{}, "invalidate", struct{}{})
+}
+
+func (cm *canvasMQTTPublisher) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return cm.queue(rect, "invalidate", canvasMQTTRect{rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy()})
+}
+
+func (cm *canvasMQTTPublisher) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return cm.queue(rect, "revalidate", canvasMQTTRect{rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy()})
+}
+
+func (cm *canvasMQTTPublisher) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	if !valid {
+		return nil
+	}
+	rect := img.Bounds()
+	return cm.queue(rect, "image", canvasMQTTRect{rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy()})
+}
+
+func (cm *canvasMQTTPublisher) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	c := color.NRGBAModel.Convert(col).(color.NRGBA)
+	payload := struct {
+		X     int    `json:"x"`
+		Y     int    `json:"y"`
+		Color string `json:"color"`
+	}{pos.X, pos.Y, fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)}
+
+	return cm.queue(image.Rectangle{pos, pos.Add(image.Point{1, 1})}, "pixel", payload)
+}
+
+func (cm *canvasMQTTPublisher) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (cm *canvasMQTTPublisher) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (cm *canvasMQTTPublisher) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Close disconnects from the broker, and unsubscribes from the canvas
+func (cm *canvasMQTTPublisher) Close() {
+	cm.ClosedMutex.Lock()
+	if cm.Closed {
+		cm.ClosedMutex.Unlock()
+		return
+	}
+	cm.Closed = true
+	cm.ClosedMutex.Unlock()
+
+	// Unsubscribe without holding the lock, as the canvas may wait for a handler that wants to read the closed state
+	cm.Canvas.unsubscribeListener(cm)
+
+	close(cm.quitChan)
+	cm.waitGroup.Wait()
+}
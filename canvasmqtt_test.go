@@ -0,0 +1,61 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+func Test_canvasMQTTPublisher(t *testing.T) {
+	addr, publishChan := startTestMQTTBroker(t)
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 128, 64)
+	can.signalDownload(rect)
+	if err := can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false); err != nil {
+		t.Fatalf("Can't set image at %v: %v", rect, err)
+	}
+
+	cm, err := can.newCanvasMQTTPublisher("Test-MQTT")
+	if err != nil {
+		t.Fatalf("Can't create MQTT publisher: %v", err)
+	}
+	defer cm.Close()
+
+	settings := canvasMQTTSettings{Broker: addr, Rects: []image.Rectangle{image.Rect(64, 0, 128, 64)}}
+	if err := cm.setSettings(settings); err != nil {
+		t.Fatalf("Can't set settings: %v", err)
+	}
+
+	// The first pixel is outside of the rectangles, and must not be published
+	can.setPixel(image.Point{1, 2}, pixelcanvasioPalette[5])
+	can.setPixel(image.Point{65, 2}, pixelcanvasioPalette[5])
+
+	select {
+	case msg := <-publishChan:
+		want := [2]string{"d3pixelbot/Test-MQTT/chunk/1/0/pixel", `{"x":65,"y":2,"color":"#E50000"}`}
+		if msg != want {
+			t.Errorf("Broker got %q, want %q", msg, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Broker didn't receive message")
+	}
+}
@@ -0,0 +1,249 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"sync"
+	"sync/atomic"
+)
+
+// Policies for events that don't fit into the event queue of a canvas, stored in the configuration at .chunks.EventOverflow
+const (
+	canvasOverflowBlock    = "block"    // Wait until the broadcaster has room for the event
+	canvasOverflowDrop     = "drop"     // Drop pixel, image and validity events, and send the current images of their area once there is room again
+	canvasOverflowCoalesce = "coalesce" // Merge pixel events while the queue is full, only the latest color of every pixel is delivered
+)
+
+func validateCanvasOverflowPolicy(policy string) error {
+	switch policy {
+	case "", canvasOverflowBlock, canvasOverflowDrop, canvasOverflowCoalesce:
+		return nil
+	}
+	return fmt.Errorf("Unknown event overflow policy %q", policy)
+}
+
+// Events that didn't fit into the event queue of a canvas.
+// The broadcaster takes them once the queue is empty, so the overflow is always newer than the queued events.
+type canvasOverflow struct {
+	sync.Mutex
+	Policy string
+
+	Pixels   []canvasEventSetPixel // Coalesced pixel events, only the latest of every position
+	indices  map[image.Point]int   // Index into Pixels of every position
+	flushing int                   // Number of senders that took the coalesced pixels, and are queueing them
+
+	Dropped     image.Rectangle // Union of the areas of all dropped events
+	DroppedSome bool
+
+	Signal    chan struct{}  // Wakes up the broadcaster when the overflow isn't empty anymore
+	WaitGroup sync.WaitGroup // Counts pending overflows, so that Close can wait until they are delivered
+}
+
+func newCanvasOverflow(policy string) canvasOverflow {
+	if policy == "" {
+		policy = canvasOverflowBlock
+	}
+	return canvasOverflow{
+		Policy: policy,
+		Signal: make(chan struct{}, 1),
+	}
+}
+
+func (ov *canvasOverflow) signal() {
+	select {
+	case ov.Signal <- struct{}{}:
+	default:
+	}
+}
+
+// Merges pixels into the overflow, the overflow has to be locked
+func (ov *canvasOverflow) coalesce(pixels []canvasEventSetPixel) {
+	if len(ov.Pixels) == 0 {
+		ov.indices = map[image.Point]int{}
+		ov.WaitGroup.Add(1)
+		ov.signal()
+	}
+	for _, pixel := range pixels {
+		if i, ok := ov.indices[pixel.Pos]; ok {
+			ov.Pixels[i] = pixel
+			continue
+		}
+		ov.indices[pixel.Pos] = len(ov.Pixels)
+		ov.Pixels = append(ov.Pixels, pixel)
+	}
+}
+
+// Returns the coalesced pixels as a single event, or nil. The overflow has to be locked
+func (ov *canvasOverflow) takePixels() *canvasEventSetPixels {
+	if len(ov.Pixels) == 0 {
+		return nil
+	}
+	event := &canvasEventSetPixels{Pixels: ov.Pixels}
+	ov.Pixels, ov.indices = nil, nil
+	ov.WaitGroup.Done() // The caller holds a read lock of ClosedMutex or is the broadcaster, so Close still waits for the event
+	return event
+}
+
+// Adds the area of a dropped event to the overflow, the overflow has to be locked
+func (ov *canvasOverflow) drop(rect image.Rectangle) {
+	if !ov.DroppedSome {
+		ov.DroppedSome, ov.Dropped = true, rect
+		ov.WaitGroup.Add(1)
+		ov.signal()
+		return
+	}
+	ov.Dropped = ov.Dropped.Union(rect)
+}
+
+// Returns the pixels of set pixel events
+func canvasEventPixels(e interface{}) ([]canvasEventSetPixel, bool) {
+	switch event := e.(type) {
+	case canvasEventSetPixel:
+		return []canvasEventSetPixel{event}, true
+	case canvasEventSetPixels:
+		return event.Pixels, true
+	}
+	return nil, false
+}
+
+// Returns the affected area of events that can be dropped.
+// All of them can be replaced by an invalidation and the current images of their area.
+func canvasEventDroppableRect(e interface{}) (image.Rectangle, bool) {
+	switch event := e.(type) {
+	case canvasEventSetPixel:
+		return image.Rectangle{event.Pos, event.Pos.Add(image.Point{1, 1})}, true
+	case canvasEventSetPixels:
+		rect := image.Rectangle{}
+		for _, pixel := range event.Pixels {
+			rect = rect.Union(image.Rectangle{pixel.Pos, pixel.Pos.Add(image.Point{1, 1})})
+		}
+		return rect, true
+	case canvasEventSetImage:
+		return event.Image.Bounds(), true
+	case canvasEventInvalidateRect:
+		return event.Rect, true
+	case canvasEventRevalidate:
+		return event.Rect, true
+	}
+	return image.Rectangle{}, false
+}
+
+func (can *canvas) countOverflow() {
+	if overflowed := atomic.AddUint64(&can.overflowedEvents, 1); overflowed%1000 == 1 {
+		canvasLog.Warnf("Listeners of the canvas can't keep up, %v events overflowed so far (Policy %v)", overflowed, can.overflow.Policy)
+	}
+}
+
+// Queues an event for the broadcaster, according to the overflow policy of the canvas.
+// The caller has to hold a read lock of ClosedMutex.
+func (can *canvas) sendEvent(e interface{}) {
+	can.counters.count(e)
+	ov := &can.overflow
+
+	switch ov.Policy {
+	case canvasOverflowDrop:
+		if rect, ok := canvasEventDroppableRect(e); ok {
+			ov.Lock()
+			defer ov.Unlock()
+			if !ov.DroppedSome {
+				select {
+				case can.EventChan <- e:
+					return
+				default:
+				}
+			}
+			ov.drop(rect) // Also drop everything after the first dropped event, until the broadcaster caught up
+			can.countOverflow()
+			return
+		}
+
+	case canvasOverflowCoalesce:
+		if pixels, ok := canvasEventPixels(e); ok {
+			ov.Lock()
+			defer ov.Unlock()
+			if len(ov.Pixels) == 0 && ov.flushing == 0 {
+				select {
+				case can.EventChan <- e:
+					return
+				default:
+				}
+			}
+			ov.coalesce(pixels)
+			can.countOverflow()
+			return
+		}
+
+		// Other events can't be merged, queue the coalesced pixels before them
+		ov.Lock()
+		pixels := ov.takePixels()
+		if pixels != nil {
+			ov.flushing++
+		}
+		ov.Unlock()
+		if pixels != nil {
+			can.EventChan <- *pixels
+			can.EventChan <- e
+			ov.Lock()
+			ov.flushing--
+			if len(ov.Pixels) > 0 {
+				ov.signal() // The broadcaster ignored the overflow while it was flushed
+			}
+			ov.Unlock()
+			return
+		}
+	}
+
+	can.EventChan <- e
+}
+
+// Takes the overflow as events that the broadcaster handles before anything else.
+// Returns nothing while a sender is flushing the overflow, it will signal the broadcaster again.
+//
+// Dropped events are replaced by an invalidation of their area, followed by the images of all valid chunks in it.
+func (can *canvas) takeOverflow() []interface{} {
+	ov := &can.overflow
+
+	ov.Lock()
+	if ov.flushing > 0 {
+		ov.Unlock()
+		return nil
+	}
+	var events []interface{}
+	if pixels := ov.takePixels(); pixels != nil {
+		events = append(events, *pixels)
+	}
+	rect, dropped := ov.Dropped, ov.DroppedSome
+	ov.Dropped, ov.DroppedSome = image.Rectangle{}, false
+	ov.Unlock()
+
+	if dropped {
+		events = append(events, canvasEventInvalidateRect{Rect: rect})
+		for _, chunk := range can.getAllChunks() {
+			if !chunk.Rect.Overlaps(rect) {
+				continue
+			}
+			if img, _, _, err := chunk.getImage(true); err == nil {
+				events = append(events, canvasEventSetImage{Image: img.Image}) // Not released, as listeners may keep the image
+			}
+		}
+		ov.WaitGroup.Done()
+	}
+
+	return events
+}
@@ -0,0 +1,150 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_canvasOverflowCoalesce(t *testing.T) {
+	can := &canvas{EventChan: make(chan interface{}, 1), Chunks: map[chunkCoordinate]*chunk{}, overflow: newCanvasOverflow(canvasOverflowCoalesce)}
+
+	can.sendEvent(canvasEventSetPixel{Pos: image.Point{0, 0}, Color: pixelcanvasioPalette[1]}) // Fits into the queue
+	can.sendEvent(canvasEventSetPixel{Pos: image.Point{1, 0}, Color: pixelcanvasioPalette[2]})
+	can.sendEvent(canvasEventSetPixels{Pixels: []canvasEventSetPixel{{Pos: image.Point{2, 0}, Color: pixelcanvasioPalette[3]}, {Pos: image.Point{1, 0}, Color: pixelcanvasioPalette[4]}}})
+
+	if e := <-can.EventChan; e.(canvasEventSetPixel).Pos != (image.Point{0, 0}) {
+		t.Errorf("Got %v as first event, want the pixel at %v", e, image.Point{0, 0})
+	}
+
+	// Other events are queued after the coalesced pixels
+	go can.sendEvent(canvasEventInvalidateAll{})
+	e := <-can.EventChan
+	want := []canvasEventSetPixel{{Pos: image.Point{1, 0}, Color: pixelcanvasioPalette[4]}, {Pos: image.Point{2, 0}, Color: pixelcanvasioPalette[3]}}
+	if pixels, ok := e.(canvasEventSetPixels); !ok || len(pixels.Pixels) != len(want) || pixels.Pixels[0] != want[0] || pixels.Pixels[1] != want[1] {
+		t.Errorf("Got coalesced pixels %v, want %v", e, want)
+	}
+	if e := <-can.EventChan; e != (canvasEventInvalidateAll{}) {
+		t.Errorf("Got %v after the coalesced pixels, want %v", e, canvasEventInvalidateAll{})
+	}
+	if events := can.takeOverflow(); len(events) != 0 {
+		t.Errorf("Overflow still contains %v", events)
+	}
+}
+
+func Test_canvasOverflowDrop(t *testing.T) {
+	can := &canvas{EventChan: make(chan interface{}, 1), Chunks: map[chunkCoordinate]*chunk{}, overflow: newCanvasOverflow(canvasOverflowDrop)}
+	for i, valid := range []bool{true, false} {
+		chunk := newChunk(image.Rect(i*64, 0, i*64+64, 64))
+		chunk.Image, chunk.Valid = image.NewPaletted(chunk.Rect, pixelcanvasioPalette), valid
+		can.Chunks[chunkCoordinate{i, 0}] = chunk
+	}
+
+	can.sendEvent(canvasEventSetPixel{Pos: image.Point{0, 0}, Color: pixelcanvasioPalette[1]}) // Fits into the queue
+	can.sendEvent(canvasEventSetPixel{Pos: image.Point{1, 1}, Color: pixelcanvasioPalette[2]})
+	can.sendEvent(canvasEventRevalidate{Rect: image.Rect(70, 0, 80, 10)})
+	<-can.EventChan
+
+	// Events that can't be dropped still go through the queue
+	can.sendEvent(canvasEventSetTime{})
+	if e := <-can.EventChan; e != (canvasEventSetTime{}) {
+		t.Errorf("Got %v, want %v", e, canvasEventSetTime{})
+	}
+
+	// The dropped area is invalidated, and only the valid chunk is sent again
+	events := can.takeOverflow()
+	if len(events) != 2 {
+		t.Fatalf("Got %v events from the overflow, want 2", len(events))
+	}
+	if e, want := events[0], (canvasEventInvalidateRect{Rect: image.Rect(1, 0, 80, 10)}); e != want {
+		t.Errorf("Got %v, want %v", e, want)
+	}
+	if e, ok := events[1].(canvasEventSetImage); !ok || e.Image.Bounds() != image.Rect(0, 0, 64, 64) {
+		t.Errorf("Got %v, want the image of the valid chunk", events[1])
+	}
+}
+
+// Listener that remembers the last color of every pixel
+type testColorListener struct {
+	sync.Mutex
+	colors map[image.Point]color.Color
+}
+
+func (l *testColorListener) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+func (l *testColorListener) handleInvalidateAll() error                                   { return nil }
+func (l *testColorListener) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error { return nil }
+func (l *testColorListener) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+func (l *testColorListener) handleSignalDownload(rect image.Rectangle, vcIDs []int) error { return nil }
+func (l *testColorListener) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error { return nil }
+func (l *testColorListener) handleSetTime(t time.Time) error                              { return nil }
+
+func (l *testColorListener) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	l.Lock()
+	defer l.Unlock()
+	l.colors[pos] = color
+	return nil
+}
+
+func Test_canvasOverflowClose(t *testing.T) {
+	defer setChunkPolicy(getChunkPolicy())
+	setChunkPolicy(chunkPolicySettings{IdleTimeout: "5m", RequestQueueSize: 1, EventQueueSize: 1, EventOverflow: canvasOverflowCoalesce})
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	l := &testColorListener{colors: map[image.Point]color.Color{}}
+	if err := can.subscribeListener(l, false); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+
+	// Every goroutine writes its own row several times
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				can.setPixel(image.Point{j % 64, i}, pixelcanvasioPalette[j%len(pixelcanvasioPalette)])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Close delivers everything, including the overflow, and the listener ends up with the colors of the canvas
+	can.Close()
+	l.Lock()
+	defer l.Unlock()
+	for pos, col := range l.colors {
+		if want, _ := can.getPixel(pos); col != want {
+			t.Errorf("Listener has color %v at %v, want %v", col, pos, want)
+		}
+	}
+	if len(l.colors) != 4*64 {
+		t.Errorf("Listener got %v pixels, want %v", len(l.colors), 4*64)
+	}
+}
@@ -0,0 +1,255 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"sync"
+	"time"
+)
+
+var paletteLog = moduleLog("palette")
+
+// Change of the palette of a game, e.g. because of event palettes or seasonal colors
+type canvasPaletteChange struct {
+	Time    time.Time
+	Added   []color.RGBA  // Colors that weren't part of the palette before
+	Palette color.Palette // The palette including the added colors
+}
+
+// Keeps track of the known palette of a game, and detects incoming colors that don't match it.
+//
+// Unknown colors are added to the end of the palette, and reported once to the subscribers.
+// So the index of a color stays the same until the palette is replaced by setPalette.
+// Chunks use the indices of this palette where possible, recordings store colors.
+// Without known palette, e.g. while replaying, nothing is checked.
+type canvasPaletteTracker struct {
+	sync.RWMutex
+
+	palette color.Palette
+	indices map[color.RGBA]int // Index of every color of the palette
+
+	listeners       map[int]func(canvasPaletteChange)
+	listenerCounter int
+}
+
+func newCanvasPaletteTracker() *canvasPaletteTracker {
+	return &canvasPaletteTracker{
+		listeners: map[int]func(canvasPaletteChange){},
+	}
+}
+
+// Sets the known palette. nil disables the detection
+func (cpt *canvasPaletteTracker) setPalette(pal color.Palette) {
+	cpt.Lock()
+	defer cpt.Unlock()
+
+	cpt.palette, cpt.indices = nil, nil
+	if len(pal) == 0 {
+		return
+	}
+	cpt.indices = map[color.RGBA]int{}
+	for _, c := range pal {
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		if _, ok := cpt.indices[rgba]; !ok {
+			cpt.indices[rgba] = len(cpt.palette)
+		}
+		cpt.palette = append(cpt.palette, rgba)
+	}
+}
+
+// Returns the index of the color in the known palette, or -1 if it isn't part of it
+func (cpt *canvasPaletteTracker) getIndex(c color.Color) int {
+	cpt.RLock()
+	defer cpt.RUnlock()
+
+	if index, ok := cpt.indices[color.RGBAModel.Convert(c).(color.RGBA)]; ok {
+		return index
+	}
+	return -1
+}
+
+// Returns the color of the given index of the known palette
+func (cpt *canvasPaletteTracker) getColor(index int) (color.RGBA, error) {
+	cpt.RLock()
+	defer cpt.RUnlock()
+
+	if index < 0 || index >= len(cpt.palette) {
+		return color.RGBA{}, fmt.Errorf("Color index %v is outside of the palette with %v colors", index, len(cpt.palette))
+	}
+	return cpt.palette[index].(color.RGBA), nil
+}
+
+// Changes the palette of the image to the known palette, if all of its colors are part of it.
+// Afterwards the indices of the image are the ones of the known palette. The palette of the image is replaced, not modified.
+// Returns false if the image was left unchanged.
+func (cpt *canvasPaletteTracker) remapImage(img *image.Paletted) bool {
+	cpt.RLock()
+	defer cpt.RUnlock()
+
+	if len(cpt.palette) == 0 || len(cpt.palette) > 256 {
+		return false
+	}
+
+	mapping := [256]uint8{}
+	for index, c := range img.Palette {
+		known, ok := cpt.indices[color.RGBAModel.Convert(c).(color.RGBA)]
+		if !ok {
+			return false
+		}
+		mapping[index] = uint8(known)
+	}
+
+	rect := img.Rect
+	for iy := 0; iy < rect.Dy(); iy++ {
+		row := img.Pix[iy*img.Stride : iy*img.Stride+rect.Dx()]
+		for i, index := range row {
+			row[i] = mapping[index]
+		}
+	}
+	img.Palette = cpt.palette[:len(cpt.palette):len(cpt.palette)] // Appending to it by chunks must copy it
+	return true
+}
+
+// Returns a copy of the known palette, or nil if there is none
+func (cpt *canvasPaletteTracker) getPalette() color.Palette {
+	cpt.RLock()
+	defer cpt.RUnlock()
+
+	if cpt.palette == nil {
+		return nil
+	}
+	return append(color.Palette{}, cpt.palette...)
+}
+
+// Calls f with every change of the palette, until the returned function is called.
+// f is called by the goroutine that sets the pixels, it must not block.
+func (cpt *canvasPaletteTracker) subscribe(f func(canvasPaletteChange)) (unsubscribe func()) {
+	cpt.Lock()
+	defer cpt.Unlock()
+
+	cpt.listenerCounter++
+	id := cpt.listenerCounter
+	cpt.listeners[id] = f
+
+	return func() {
+		cpt.Lock()
+		defer cpt.Unlock()
+
+		delete(cpt.listeners, id)
+	}
+}
+
+// Checks the given colors, and reports the ones that aren't part of the palette
+func (cpt *canvasPaletteTracker) check(colors ...color.RGBA) {
+	cpt.RLock()
+	if cpt.indices == nil {
+		cpt.RUnlock()
+		return
+	}
+	unknown := false
+	for _, c := range colors {
+		if _, ok := cpt.indices[c]; !ok && c.A != 0 {
+			unknown = true
+			break
+		}
+	}
+	cpt.RUnlock()
+	if !unknown {
+		return
+	}
+
+	cpt.Lock()
+	change := canvasPaletteChange{Time: time.Now()}
+	for _, c := range colors {
+		if _, ok := cpt.indices[c]; !ok && c.A != 0 && cpt.indices != nil {
+			cpt.indices[c] = len(cpt.palette)
+			cpt.palette = append(cpt.palette, c)
+			change.Added = append(change.Added, c)
+		}
+	}
+	change.Palette = append(color.Palette{}, cpt.palette...)
+	listeners := make([]func(canvasPaletteChange), 0, len(cpt.listeners))
+	for _, f := range cpt.listeners {
+		listeners = append(listeners, f)
+	}
+	cpt.Unlock()
+
+	if len(change.Added) == 0 {
+		return // Another goroutine was faster
+	}
+
+	added := []string{}
+	for _, c := range change.Added {
+		added = append(added, paletteHex(c))
+	}
+	paletteLog.Warnf("Palette changed, %v new colors: %v", len(change.Added), strings.Join(added, ", "))
+
+	for _, f := range listeners {
+		f(change)
+	}
+}
+
+// Checks all colors that are used by the image
+func (cpt *canvasPaletteTracker) checkImage(img image.Image) {
+	if cpt.getPaletteSize() == 0 {
+		return
+	}
+
+	switch img := img.(type) {
+	case *image.Paletted:
+		used := [256]bool{}
+		rect := img.Rect
+		for iy := 0; iy < rect.Dy(); iy++ {
+			for _, index := range img.Pix[iy*img.Stride : iy*img.Stride+rect.Dx()] {
+				used[index] = true
+			}
+		}
+		colors := []color.RGBA{}
+		for index, ok := range used {
+			if ok && index < len(img.Palette) {
+				colors = append(colors, color.RGBAModel.Convert(img.Palette[index]).(color.RGBA))
+			}
+		}
+		cpt.check(colors...)
+
+	default:
+		seen := map[color.RGBA]struct{}{}
+		rect := img.Bounds()
+		for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+			for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+				seen[color.RGBAModel.Convert(img.At(ix, iy)).(color.RGBA)] = struct{}{}
+			}
+		}
+		colors := make([]color.RGBA, 0, len(seen))
+		for c := range seen {
+			colors = append(colors, c)
+		}
+		cpt.check(colors...)
+	}
+}
+
+// Returns the number of colors of the known palette
+func (cpt *canvasPaletteTracker) getPaletteSize() int {
+	cpt.RLock()
+	defer cpt.RUnlock()
+
+	return len(cpt.palette)
+}
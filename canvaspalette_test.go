@@ -0,0 +1,162 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func Test_canvasPaletteTracker(t *testing.T) {
+	cpt := newCanvasPaletteTracker()
+	changes := []canvasPaletteChange{}
+	unsubscribe := cpt.subscribe(func(change canvasPaletteChange) { changes = append(changes, change) })
+	defer unsubscribe()
+
+	foreign := color.RGBA{1, 2, 3, 255}
+
+	// Without palette nothing is checked
+	cpt.check(foreign)
+	if len(changes) != 0 {
+		t.Errorf("Got %v changes without known palette, want none", len(changes))
+	}
+
+	cpt.setPalette(pixelcanvasioPalette)
+	cpt.check(pixelcanvasioPalette[5].(color.RGBA), color.RGBA{}) // Transparent pixels are ignored
+	if len(changes) != 0 {
+		t.Errorf("Got %v changes for known colors, want none", len(changes))
+	}
+
+	cpt.check(foreign, foreign)
+	cpt.check(foreign) // Only reported once
+	if len(changes) != 1 {
+		t.Fatalf("Got %v changes, want 1", len(changes))
+	}
+	if len(changes[0].Added) != 1 || changes[0].Added[0] != foreign {
+		t.Errorf("Added colors are %v, want %v", changes[0].Added, foreign)
+	}
+	if len(changes[0].Palette) != len(pixelcanvasioPalette)+1 || cpt.getPaletteSize() != len(pixelcanvasioPalette)+1 {
+		t.Errorf("Palette has %v colors, want %v", len(changes[0].Palette), len(pixelcanvasioPalette)+1)
+	}
+}
+
+func Test_canvasPaletteChange(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+	can.Palette.setPalette(pixelcanvasioPalette)
+
+	changes := 0
+	defer can.Palette.subscribe(func(change canvasPaletteChange) { changes++ })()
+
+	rect := image.Rect(0, 0, 64, 64)
+	if _, err := can.signalDownload(rect); err != nil {
+		t.Fatalf("Can't signal download at %v: %v", rect, err)
+	}
+	// Padded palettes, like the ones of BMP images, are fine as long as the colors aren't used
+	img := image.NewPaletted(rect, append(append(color.Palette{}, pixelcanvasioPalette...), color.RGBA{1, 2, 3, 255}))
+	img.SetColorIndex(1, 1, 5)
+	if err := can.setImage(img, false, false); err != nil {
+		t.Fatalf("Can't set image at %v: %v", rect, err)
+	}
+	if changes != 0 {
+		t.Errorf("Got %v changes for an image with known colors, want none", changes)
+	}
+
+	seasonal := color.RGBA{255, 128, 0, 255}
+	if err := can.setPixel(image.Point{2, 2}, seasonal); err != nil {
+		t.Fatalf("Can't set pixel: %v", err)
+	}
+	if changes != 1 {
+		t.Errorf("Got %v changes for a new color, want 1", changes)
+	}
+	if col, _ := can.getPixel(image.Point{2, 2}); color.RGBAModel.Convert(col) != seasonal {
+		t.Errorf("Pixel with the new color is %v, want %v", col, seasonal)
+	}
+}
+
+func Test_compactPalette(t *testing.T) {
+	pal := color.Palette{}
+	for i := 0; i < 256; i++ {
+		pal = append(pal, color.RGBA{uint8(i), 0, 0, 255})
+	}
+	img := image.NewPaletted(image.Rect(0, 0, 4, 4), pal)
+	img.SetColorIndex(1, 1, 200)
+	img.SetColorIndex(2, 2, 100)
+
+	compactPalette(img)
+
+	if len(img.Palette) != 3 {
+		t.Errorf("Palette has %v colors, want 3", len(img.Palette))
+	}
+	if pal[200] != (color.RGBA{200, 0, 0, 255}) {
+		t.Errorf("The original palette was modified")
+	}
+	for _, p := range []image.Point{{0, 0}, {1, 1}, {2, 2}} {
+		if got, want := img.At(p.X, p.Y), pal[[]int{0, 200, 100}[p.X]]; got != want {
+			t.Errorf("Pixel at %v = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func Test_canvasPaletteIndices(t *testing.T) {
+	cpt := newCanvasPaletteTracker()
+	if index := cpt.getIndex(pixelcanvasioPalette[5]); index != -1 {
+		t.Errorf("Got index %v without known palette, want -1", index)
+	}
+
+	cpt.setPalette(pixelcanvasioPalette)
+	for i, c := range pixelcanvasioPalette {
+		if index := cpt.getIndex(c); index != i {
+			t.Errorf("Got index %v for %v, want %v", index, c, i)
+		}
+		if col, err := cpt.getColor(i); err != nil || col != c {
+			t.Errorf("Got color %v (%v) for index %v, want %v", col, err, i, c)
+		}
+	}
+	if _, err := cpt.getColor(len(pixelcanvasioPalette)); err == nil {
+		t.Errorf("Got a color for an index outside of the palette")
+	}
+
+	// Added colors are appended, so the other indices stay the same
+	foreign := color.RGBA{1, 2, 3, 255}
+	cpt.check(foreign)
+	if index := cpt.getIndex(foreign); index != len(pixelcanvasioPalette) {
+		t.Errorf("Got index %v for an added color, want %v", index, len(pixelcanvasioPalette))
+	}
+
+	// Images with colors of the palette get its indices
+	img := image.NewPaletted(image.Rect(10, 10, 12, 11), color.Palette{pixelcanvasioPalette[7], foreign})
+	img.SetColorIndex(11, 10, 1)
+	if !cpt.remapImage(img) {
+		t.Fatalf("Image with known colors wasn't remapped")
+	}
+	if index := img.ColorIndexAt(10, 10); int(index) != 7 {
+		t.Errorf("Got index %v, want 7", index)
+	}
+	if index := img.ColorIndexAt(11, 10); int(index) != len(pixelcanvasioPalette) {
+		t.Errorf("Got index %v, want %v", index, len(pixelcanvasioPalette))
+	}
+	if img.At(10, 10) != pixelcanvasioPalette[7] || img.At(11, 10) != foreign {
+		t.Errorf("Remapping changed the colors of the image")
+	}
+
+	other := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.RGBA{4, 5, 6, 255}})
+	if cpt.remapImage(other) {
+		t.Errorf("Image with unknown colors was remapped")
+	}
+}
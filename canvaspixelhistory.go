@@ -0,0 +1,167 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum number of changes per pixel the history of a canvas can keep
+const canvasPixelHistoryMax = 1000
+
+// Approximate memory used by a single change in the pixel history, in bytes
+const canvasPixelChangeSize = 64
+
+// Default limit in MiB for the pixel history of a canvas, see chunkPolicySettings.PixelHistoryLimit
+const canvasPixelHistoryLimit = 64
+
+// A change of a pixel, as kept by the pixel history of a canvas
+type canvasPixelChange struct {
+	Time   time.Time
+	Color  color.RGBA
+	Author string // Identifier of the user that placed the pixel, empty if the game doesn't report it
+}
+
+// Pixel history of a canvas.
+//
+// The changes are stored in the chunks, so they are dropped together with them and count towards their memory usage.
+// Once all chunks together keep more than Limit changes, the histories of the least recently changed chunks are dropped.
+// The history is only kept in memory while the game is open.
+// The changes of the local recordings of a game are stored in the pixelIndex instead.
+type canvasPixelHistory struct {
+	changes  int64 // Number of kept changes, including the ones of deleted chunks until the next trim. Accessed atomically, keep it first for alignment
+	trimming int32 // Set while the history is trimmed. Accessed atomically
+
+	Size  int   // Changes that are kept per pixel
+	Limit int64 // Changes that are kept in all chunks together
+}
+
+func newCanvasPixelHistory(size int, limitBytes int64) *canvasPixelHistory {
+	return &canvasPixelHistory{
+		Size:  size,
+		Limit: limitBytes / canvasPixelChangeSize,
+	}
+}
+
+// Adds a change of the pixel at pos to the history of its chunk, and trims the history of the canvas if it got too large
+func (can *canvas) addPixelChange(chunk *chunk, pos image.Point, col color.RGBA, author string, t time.Time) {
+	ph := can.history
+	if grown := chunk.addPixelChange(pos, col, author, t, ph.Size); grown != 0 {
+		if atomic.AddInt64(&ph.changes, int64(grown)) > ph.Limit {
+			can.trimPixelHistory()
+		}
+	}
+}
+
+// Drops the histories of the least recently changed chunks, until three quarters of the limit are left.
+// The number of kept changes is counted again, so changes of deleted chunks are forgotten
+func (can *canvas) trimPixelHistory() {
+	ph := can.history
+	if !atomic.CompareAndSwapInt32(&ph.trimming, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&ph.trimming, 0)
+
+	type chunkHistory struct {
+		chunk *chunk
+		time  time.Time
+	}
+	var histories []chunkHistory
+	var total int64
+	for _, chunk := range can.getAllChunks() {
+		chunk.RLock()
+		size, t := chunk.HistorySize, chunk.HistoryTime
+		chunk.RUnlock()
+		if size > 0 {
+			histories = append(histories, chunkHistory{chunk, t})
+			total += int64(size)
+		}
+	}
+	sort.Slice(histories, func(i, j int) bool { return histories[i].time.Before(histories[j].time) })
+
+	for _, history := range histories {
+		if total <= ph.Limit*3/4 {
+			break
+		}
+		total -= int64(history.chunk.clearPixelHistory())
+	}
+
+	atomic.StoreInt64(&ph.changes, total)
+}
+
+// Adds a change of the pixel at pos to the history of the chunk, keeping at most size changes of every pixel.
+// If the time went backwards, like when a replay jumps back, the changes after t are forgotten.
+// Returns by how many changes the history grew, which is negative if changes were forgotten
+func (chu *chunk) addPixelChange(pos image.Point, col color.RGBA, author string, t time.Time, size int) int {
+	chu.Lock()
+	defer chu.Unlock()
+
+	if !pos.In(chu.Rect) {
+		return 0
+	}
+	if chu.History == nil {
+		chu.History = map[image.Point][]canvasPixelChange{}
+	}
+
+	changes := chu.History[pos]
+	before := len(changes)
+	for len(changes) > 0 && changes[len(changes)-1].Time.After(t) {
+		changes = changes[:len(changes)-1]
+	}
+	if len(changes) >= size {
+		copy(changes, changes[len(changes)-size+1:])
+		changes = changes[:size-1]
+	}
+	chu.History[pos] = append(changes, canvasPixelChange{Time: t, Color: col, Author: author})
+
+	grown := len(chu.History[pos]) - before
+	chu.HistorySize += grown
+	if t.After(chu.HistoryTime) {
+		chu.HistoryTime = t
+	}
+
+	return grown
+}
+
+// Returns a copy of the changes of the pixel at pos, the newest first
+func (chu *chunk) getPixelChanges(pos image.Point) []canvasPixelChange {
+	chu.RLock()
+	defer chu.RUnlock()
+
+	changes := chu.History[pos]
+	result := make([]canvasPixelChange, len(changes))
+	for i, change := range changes {
+		result[len(changes)-1-i] = change
+	}
+
+	return result
+}
+
+// Drops the pixel history of the chunk, and returns the number of dropped changes
+func (chu *chunk) clearPixelHistory() int {
+	chu.Lock()
+	defer chu.Unlock()
+
+	size := chu.HistorySize
+	chu.History, chu.HistorySize = nil, 0
+
+	return size
+}
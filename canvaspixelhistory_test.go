@@ -0,0 +1,155 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns the color of the given index of pixelcanvasioPalette as color.RGBA
+func testPaletteRGBA(i int) color.RGBA {
+	return color.RGBAModel.Convert(pixelcanvasioPalette[i]).(color.RGBA)
+}
+
+func Test_canvasPixelHistory(t *testing.T) {
+	chu := newChunk(image.Rect(0, 0, 64, 64))
+	pos, start := image.Point{1, 2}, time.Date(2019, 6, 14, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		chu.addPixelChange(pos, testPaletteRGBA(i), "", start.Add(time.Duration(i)*time.Second), 3)
+	}
+	if chu.HistorySize != 3 {
+		t.Errorf("Chunk counts %v changes, want 3", chu.HistorySize)
+	}
+
+	// Only the last 3 changes are kept, the newest first
+	changes := chu.getPixelChanges(pos)
+	if len(changes) != 3 {
+		t.Fatalf("Got %v changes, want 3", len(changes))
+	}
+	for i, change := range changes {
+		if want := testPaletteRGBA(4 - i); change.Color != want || !change.Time.Equal(start.Add(time.Duration(4-i)*time.Second)) {
+			t.Errorf("Change %v is %v at %v, want %v", i, change.Color, change.Time, want)
+		}
+	}
+
+	// Going back in time forgets the changes after that
+	if grown := chu.addPixelChange(pos, testPaletteRGBA(9), "", start.Add(2500*time.Millisecond), 3); grown != -1 {
+		t.Errorf("History grew by %v changes after going back in time, want -1", grown)
+	}
+	if changes := chu.getPixelChanges(pos); len(changes) != 2 || changes[0].Color != testPaletteRGBA(9) || changes[1].Color != testPaletteRGBA(2) {
+		t.Errorf("Got changes %v after going back in time, want the new color after the one at 2 seconds", changes)
+	}
+
+	if changes := chu.getPixelChanges(image.Point{}); len(changes) != 0 {
+		t.Errorf("Got changes %v of an unchanged pixel", changes)
+	}
+}
+
+func Test_canvasGetPixelHistory(t *testing.T) {
+	defer setChunkPolicy(getChunkPolicy())
+	policy := defaultChunkPolicySettings
+	setChunkPolicy(policy)
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	if _, err := can.getPixelHistory(image.Point{}); err == nil {
+		t.Errorf("Got pixel history, while it's disabled")
+	}
+	can.Close()
+
+	policy.PixelHistory = 10
+	setChunkPolicy(policy)
+	can, _ = newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	replayTime := time.Date(2019, 6, 14, 12, 0, 0, 0, time.UTC)
+	can.setTime(replayTime)
+	can.setPixel(image.Point{1, 2}, pixelcanvasioPalette[5])
+	can.setPixels([]pixelUpdate{{Pos: image.Point{1, 2}, Color: pixelcanvasioPalette[6]}, {Pos: image.Point{3, 4}, Color: pixelcanvasioPalette[7]}})
+
+	changes, err := can.getPixelHistory(image.Point{1, 2})
+	if err != nil {
+		t.Fatalf("Can't get pixel history: %v", err)
+	}
+	if len(changes) != 2 || changes[0].Color != testPaletteRGBA(6) || changes[1].Color != testPaletteRGBA(5) {
+		t.Errorf("Got changes %v, want the colors 6 and 5 of the palette", changes)
+	}
+	for _, change := range changes {
+		if !change.Time.Equal(replayTime) {
+			t.Errorf("Change is at %v, want the time of the canvas %v", change.Time, replayTime)
+		}
+	}
+
+	if _, err := can.getPixelHistory(pixelcanvasioCanvasRect.Max); err == nil {
+		t.Errorf("Got pixel history of a pixel outside of the canvas")
+	}
+}
+
+func Test_canvasPixelHistoryLimit(t *testing.T) {
+	defer setChunkPolicy(getChunkPolicy())
+	policy := defaultChunkPolicySettings
+	policy.PixelHistory = 10
+	setChunkPolicy(policy)
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+	can.history.Limit = 100
+
+	rects := []image.Rectangle{image.Rect(0, 0, 64, 64), image.Rect(64, 0, 128, 64)}
+	for _, rect := range rects {
+		can.signalDownload(rect)
+		can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+	}
+
+	// The older changes of the first chunk are dropped, once both chunks exceed the limit
+	start := time.Date(2019, 6, 14, 12, 0, 0, 0, time.UTC)
+	for i, rect := range rects {
+		can.setTime(start.Add(time.Duration(i) * time.Minute))
+		for j := 0; j < 60; j++ {
+			can.setPixel(rect.Min.Add(image.Point{j, 0}), pixelcanvasioPalette[5])
+		}
+	}
+	if changes, _ := can.getPixelHistory(image.Point{0, 0}); len(changes) != 0 {
+		t.Errorf("Got changes %v of the least recently changed chunk, want them to be dropped", changes)
+	}
+	if changes, _ := can.getPixelHistory(image.Point{64, 0}); len(changes) != 1 {
+		t.Errorf("Got changes %v of the newest chunk, want one", changes)
+	}
+	if changes := atomic.LoadInt64(&can.history.changes); changes > can.history.Limit {
+		t.Errorf("History keeps %v changes, above the limit of %v", changes, can.history.Limit)
+	}
+
+	// The history counts towards the memory of the chunks, and is dropped with them
+	chunk, err := can.getChunk(chunkCoordinate{1, 0}, false)
+	if err != nil {
+		t.Fatalf("Can't get chunk: %v", err)
+	}
+	withHistory, _ := chunk.getMemoryUsage()
+	if freed := chunk.clearPixelHistory(); freed != 60 {
+		t.Errorf("Dropped %v changes, want 60", freed)
+	}
+	if withoutHistory, _ := chunk.getMemoryUsage(); withHistory-withoutHistory != 60*canvasPixelChangeSize {
+		t.Errorf("History used %v bytes, want %v", withHistory-withoutHistory, 60*canvasPixelChangeSize)
+	}
+}
@@ -0,0 +1,140 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+)
+
+var recordingLog = moduleLog("recording")
+
+// Writes the events of a canvas into a recording
+type canvasRecorder interface {
+	setListeningRects(rects []image.Rectangle) error
+	Close()
+}
+
+// Implemented by recorders that drop events when the disk can't keep up
+type canvasRecorderDropper interface {
+	getDroppedEvents() uint64
+}
+
+// Implemented by recorders that write into a single file
+type canvasRecorderFile interface {
+	getFileName() string
+}
+
+// Running recorders with the short name of their game, regardless of whether they were started by the UI, the API or the daemon.
+// Recorders remove themselves when they are closed
+var canvasRecorders = struct {
+	sync.Mutex
+	recorders map[canvasRecorder]string
+}{
+	recorders: map[canvasRecorder]string{},
+}
+
+// Settings of a recording, they can't be changed once it's started
+type canvasRecorderSettings struct {
+	Format      string // One of canvasRecorderFormats, or empty for the default format
+	Compression int    // Compression level from 1 (fastest) to 9 (smallest files), or 0 for the default. Ignored by formats without compression
+}
+
+func (s canvasRecorderSettings) validate() error {
+	if s.Compression < 0 || s.Compression > 9 {
+		return fmt.Errorf("Invalid compression level %v, must be between 1 and 9, or 0 for the default", s.Compression)
+	}
+	return nil
+}
+
+// Available recording formats, selectable per recording session.
+// The keys are the format names, as used in the configuration.
+var canvasRecorderFormats = map[string]func(can *canvas, shortName string, settings canvasRecorderSettings) (canvasRecorder, error){
+	"pixrec": func(can *canvas, shortName string, settings canvasRecorderSettings) (canvasRecorder, error) {
+		cdw, err := can.newCanvasDiskWriter(shortName, settings.Compression)
+		if err != nil {
+			return nil, err
+		}
+		return cdw, nil
+	},
+}
+
+// Default recording format, used if none is given
+const canvasRecorderDefaultFormat = "pixrec"
+
+// Creates a recorder for the canvas that writes in the format of the settings
+func (can *canvas) newCanvasRecorder(shortName string, settings canvasRecorderSettings) (canvasRecorder, error) {
+	if settings.Format == "" {
+		settings.Format = canvasRecorderDefaultFormat
+	}
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+
+	newRecorder, ok := canvasRecorderFormats[settings.Format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown recording format %q, available formats: %v", settings.Format, canvasRecorderFormatNames())
+	}
+
+	if err := retentionCheckFreeSpace(); err != nil {
+		return nil, err
+	}
+
+	recorder, err := newRecorder(can, shortName, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	canvasRecorders.Lock()
+	canvasRecorders.recorders[recorder] = shortName
+	canvasRecorders.Unlock()
+
+	return recorder, nil
+}
+
+func unregisterCanvasRecorder(recorder canvasRecorder) {
+	canvasRecorders.Lock()
+	defer canvasRecorders.Unlock()
+
+	delete(canvasRecorders.recorders, recorder)
+}
+
+// Returns the running recorders of a game
+func getCanvasRecorders(shortName string) []canvasRecorder {
+	canvasRecorders.Lock()
+	defer canvasRecorders.Unlock()
+
+	result := []canvasRecorder{}
+	for recorder, name := range canvasRecorders.recorders {
+		if name == shortName {
+			result = append(result, recorder)
+		}
+	}
+	return result
+}
+
+// Returns the names of all available recording formats
+func canvasRecorderFormatNames() []string {
+	names := []string{}
+	for name := range canvasRecorderFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,282 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// Options for rendering big canvas regions
+type canvasRenderOptions struct {
+	TileSize    pixelSize // Size of the tiles that are rendered in parallel, starting at the upper left corner of the region. Defaults to the chunk size
+	Workers     int       // Number of goroutines that render tiles. Defaults to the number of CPUs
+	OnlyIfValid bool      // Fail if any of the chunks is invalid or doesn't exist
+
+	Progress func(done, total int) // Called after every finished tile, may be nil. Calls don't overlap
+}
+
+// Renders rect of the canvas in horizontal bands, which are passed to fn from top to bottom.
+//
+// Each band is one tile high, and its tiles are rendered in parallel by a pool of workers.
+// Only a few bands are held in memory at once, so this can be used for regions that would not fit into memory as a whole.
+// The band must not be used after fn returned.
+func (can *canvas) renderBands(rect image.Rectangle, opts canvasRenderOptions, fn func(band *image.RGBA) error) error {
+	rect = rect.Canon()
+	if opts.TileSize.X <= 0 || opts.TileSize.Y <= 0 {
+		opts.TileSize = can.ChunkSize
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+
+	type band struct {
+		img       *image.RGBA
+		waitGroup sync.WaitGroup
+	}
+	type tileJob struct {
+		band *band
+		rect image.Rectangle
+	}
+
+	tilesX, tilesY := divideCeil(rect.Dx(), opts.TileSize.X), divideCeil(rect.Dy(), opts.TileSize.Y)
+	totalTiles, doneTiles := tilesX*tilesY, 0
+
+	var errMutex sync.Mutex
+	var firstErr error
+	setErr := func(err error) {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	getErr := func() error {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+		return firstErr
+	}
+
+	jobChan := make(chan tileJob)
+	bandChan := make(chan *band, 1) // Limits the number of bands in memory to the one being consumed, one waiting and one being rendered
+	quitChan := make(chan struct{})
+
+	// Workers
+	var progressMutex sync.Mutex
+	var workerWaitGroup sync.WaitGroup
+	workerWaitGroup.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go func() {
+			defer workerWaitGroup.Done()
+			for job := range jobChan {
+				img, err := can.getImageCopy(job.rect, opts.OnlyIfValid, !opts.OnlyIfValid)
+				if err != nil {
+					setErr(err)
+				} else {
+					draw.Draw(job.band.img, job.rect, img, job.rect.Min, draw.Src)
+				}
+				job.band.waitGroup.Done()
+
+				if opts.Progress != nil {
+					progressMutex.Lock()
+					doneTiles++
+					opts.Progress(doneTiles, totalTiles)
+					progressMutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	// Producer of bands and their tiles
+	go func() {
+		defer close(jobChan)
+		defer close(bandChan)
+		for ty := 0; ty < tilesY; ty++ {
+			bandRect := image.Rect(rect.Min.X, rect.Min.Y+ty*opts.TileSize.Y, rect.Max.X, rect.Min.Y+(ty+1)*opts.TileSize.Y).Intersect(rect)
+			b := &band{img: image.NewRGBA(bandRect)}
+			b.waitGroup.Add(tilesX)
+			select {
+			case bandChan <- b:
+			case <-quitChan:
+				return
+			}
+			for tx := 0; tx < tilesX; tx++ {
+				tileRect := image.Rect(rect.Min.X+tx*opts.TileSize.X, bandRect.Min.Y, rect.Min.X+(tx+1)*opts.TileSize.X, bandRect.Max.Y).Intersect(rect)
+				select {
+				case jobChan <- tileJob{b, tileRect}:
+				case <-quitChan:
+					return
+				}
+			}
+		}
+	}()
+
+	var err error
+	for b := range bandChan {
+		b.waitGroup.Wait()
+		if err = getErr(); err != nil {
+			break
+		}
+		if err = fn(b.img); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		close(quitChan)
+		for range bandChan {
+		}
+	}
+	workerWaitGroup.Wait()
+
+	return err
+}
+
+// Renders rect of the canvas as RGBA PNG into w.
+//
+// The image is rendered and encoded band by band, so the whole image is never held in memory.
+func (can *canvas) encodePNG(w io.Writer, rect image.Rectangle, opts canvasRenderOptions) error {
+	rect = rect.Canon()
+	if rect.Empty() {
+		return fmt.Errorf("Rectangle %v is empty", rect)
+	}
+
+	if _, err := w.Write([]byte("\x89PNG\r\n\x1a\n")); err != nil {
+		return err
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(rect.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(rect.Dy()))
+	ihdr[8] = 8 // Bit depth
+	ihdr[9] = 6 // Color type: RGBA
+	if err := writePNGChunk(w, "IHDR", ihdr); err != nil {
+		return err
+	}
+
+	// Compressed data is split into IDAT chunks by the buffer size
+	idatWriter := bufio.NewWriterSize(pngChunkWriter{w, "IDAT"}, 1<<16)
+	zipWriter := zlib.NewWriter(idatWriter)
+
+	line := make([]byte, 1+rect.Dx()*4) // Filter type 0 (None) and the pixels
+	err := can.renderBands(rect, opts, func(band *image.RGBA) error {
+		for iy := 0; iy < band.Rect.Dy(); iy++ {
+			pix := band.Pix[iy*band.Stride : iy*band.Stride+rect.Dx()*4]
+			for i := 0; i < len(pix); i += 4 {
+				r, g, b, a := pix[i], pix[i+1], pix[i+2], pix[i+3]
+				if a != 0 && a != 255 {
+					// Undo alpha premultiplication
+					r, g, b = uint8(uint16(r)*255/uint16(a)), uint8(uint16(g)*255/uint16(a)), uint8(uint16(b)*255/uint16(a))
+				}
+				line[1+i], line[2+i], line[3+i], line[4+i] = r, g, b, a
+			}
+			if _, err := zipWriter.Write(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return err
+	}
+	if err := idatWriter.Flush(); err != nil {
+		return err
+	}
+
+	return writePNGChunk(w, "IEND", nil)
+}
+
+// Writes every Write() call as a separate PNG chunk
+type pngChunkWriter struct {
+	w         io.Writer
+	chunkType string
+}
+
+func (cw pngChunkWriter) Write(p []byte) (int, error) {
+	if err := writePNGChunk(cw.w, cw.chunkType, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Writes rect of the canvas as PNG into w, scaled to size.
+//
+// Unscaled images are streamed with encodePNG, without holding the whole image in memory.
+func (can *canvas) writeImage(w io.Writer, rect image.Rectangle, size pixelSize) error {
+	if size.X == rect.Dx() && size.Y == rect.Dy() {
+		return can.encodePNG(w, rect, canvasRenderOptions{})
+	}
+	if size.X <= 0 || size.Y <= 0 {
+		return fmt.Errorf("Image size %v is invalid", size)
+	}
+
+	img, err := can.getImageCopy(rect, false, true)
+	if err != nil {
+		return err
+	}
+	var resized image.Image
+	if factor := exportUpscaleFactor(rect, size); factor > 1 {
+		resized = upscaleNearest(img, factor) // Keep pixels crisp for integer factors
+	} else {
+		resized = resize.Resize(uint(size.X), uint(size.Y), img, resize.Lanczos3)
+	}
+
+	return png.Encode(w, resized)
+}
+
+// Writes rect of the canvas unscaled as PNG file at path.
+//
+// If waitValid is larger than 0, it waits up to that long for all intersecting chunks to be valid, and fails if they aren't.
+// The rectangle has to be registered by a listener for that, otherwise its chunks aren't downloaded. See waitValid.
+// Chunks that don't exist are written transparent.
+func (can *canvas) exportPNG(rect image.Rectangle, path string, waitValid time.Duration) error {
+	if rect.Empty() {
+		return fmt.Errorf("Rectangle %v is empty", rect)
+	}
+
+	if waitValid > 0 && !can.waitValid(rect, waitValid, nil) {
+		return fmt.Errorf("Rectangle %v isn't completely downloaded after %v", rect, waitValid)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", path, err)
+	}
+	defer file.Close()
+
+	if err := can.writeImage(file, rect, pixelSize{rect.Dx(), rect.Dy()}); err != nil {
+		return fmt.Errorf("Can't write %v: %v", path, err)
+	}
+
+	return file.Close()
+}
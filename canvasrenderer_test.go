@@ -0,0 +1,144 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_canvasRenderer(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 128, 64)
+	can.signalDownload(rect)
+	img := image.NewPaletted(rect, pixelcanvasioPalette)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % len(pixelcanvasioPalette))
+	}
+	if err := can.setImage(img, false, false); err != nil {
+		t.Fatalf("Can't set image at %v: %v", rect, err)
+	}
+
+	// Region with tiles that don't align to chunks, and a part without data
+	renderRect := image.Rect(-10, 5, 120, 100)
+	want, err := can.getImageCopy(renderRect, false, true)
+	if err != nil {
+		t.Fatalf("Can't get image at %v: %v", renderRect, err)
+	}
+
+	got := image.NewRGBA(renderRect)
+	lastDone, lastTotal := 0, 0
+	opts := canvasRenderOptions{
+		TileSize: pixelSize{30, 20},
+		Workers:  3,
+		Progress: func(done, total int) { lastDone, lastTotal = done, total },
+	}
+	err = can.renderBands(renderRect, opts, func(band *image.RGBA) error {
+		draw.Draw(got, band.Rect, band, band.Rect.Min, draw.Src)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Can't render %v: %v", renderRect, err)
+	}
+	if !bytes.Equal(got.Pix, want.Pix) {
+		t.Errorf("Rendered bands differ from the image copy")
+	}
+	if lastTotal != 5*5 || lastDone != lastTotal {
+		t.Errorf("Progress ended at %v/%v, want 25/25", lastDone, lastTotal)
+	}
+
+	// Streamed PNG
+	buf := &bytes.Buffer{}
+	if err := can.encodePNG(buf, renderRect, opts); err != nil {
+		t.Fatalf("Can't encode PNG: %v", err)
+	}
+	decoded, err := png.Decode(buf)
+	if err != nil {
+		t.Fatalf("Can't decode PNG: %v", err)
+	}
+	if decoded.Bounds().Size() != renderRect.Size() {
+		t.Fatalf("PNG has size %v, want %v", decoded.Bounds().Size(), renderRect.Size())
+	}
+	for y := renderRect.Min.Y; y < renderRect.Max.Y; y++ {
+		for x := renderRect.Min.X; x < renderRect.Max.X; x++ {
+			r1, g1, b1, a1 := decoded.At(x-renderRect.Min.X, y-renderRect.Min.Y).RGBA()
+			r2, g2, b2, a2 := want.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				t.Fatalf("PNG pixel at %v differs", image.Point{x, y})
+			}
+		}
+	}
+
+	// Failing callbacks stop the rendering
+	errStop := fmt.Errorf("stop")
+	err = can.renderBands(renderRect, opts, func(band *image.RGBA) error {
+		return errStop
+	})
+	if err != errStop {
+		t.Errorf("renderBands() returned %v, want %v", err, errStop)
+	}
+}
+
+func Test_canvasExportPNG(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 128, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+	can.setPixel(image.Point{70, 10}, pixelcanvasioPalette[5])
+
+	fileName := filepath.Join(t.TempDir(), "canvas.png")
+	exportRect := image.Rect(60, 5, 80, 15)
+	if err := can.exportPNG(exportRect, fileName, time.Second); err != nil {
+		t.Fatalf("Can't export PNG: %v", err)
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Can't open %v: %v", fileName, err)
+	}
+	defer f.Close()
+	decoded, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Can't decode PNG: %v", err)
+	}
+	if decoded.Bounds().Size() != exportRect.Size() {
+		t.Fatalf("PNG has size %v, want %v", decoded.Bounds().Size(), exportRect.Size())
+	}
+	if got := color.RGBAModel.Convert(decoded.At(10, 5)); got != pixelcanvasioPalette[5] {
+		t.Errorf("Pixel has color %v, want %v", got, pixelcanvasioPalette[5])
+	}
+
+	// Rectangles that aren't downloaded fail after waiting, unless they are exported right away
+	missingRect := image.Rect(100, 50, 140, 70)
+	if err := can.exportPNG(missingRect, fileName, 200*time.Millisecond); err == nil {
+		t.Errorf("Exporting an incomplete rectangle didn't fail")
+	}
+	if err := can.exportPNG(missingRect, fileName, 0); err != nil {
+		t.Errorf("Can't export PNG right away: %v", err)
+	}
+}
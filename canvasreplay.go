@@ -0,0 +1,119 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"sort"
+	"time"
+)
+
+// Result of a deterministic replay
+type canvasReplayResult struct {
+	Recordings int       // Number of replayed recordings
+	Events     int       // Number of applied events
+	Time       time.Time // Time of the last event
+	Hash       string    // SHA-256 of the final canvas, see canvas.getHash()
+}
+
+// Replays all recordings of a game, a remote instance or a clip without any pacing, and returns the hash of the final canvas.
+//
+// Events are applied in order as fast as possible, so the result only depends on the recordings and on how events are applied.
+// This allows golden tests that check that recordings reproduce the same state across versions.
+func canvasReplayDeterministic(name string) (canvasReplayResult, error) {
+	cdr := canvasDiskReaderFor(name)
+
+	recs, err := cdr.refreshRecordings()
+	if err != nil {
+		return canvasReplayResult{}, fmt.Errorf("Can't get recordings from %v: %v", name, err)
+	}
+	if len(recs) <= 0 {
+		return canvasReplayResult{}, fmt.Errorf("Found no recordings for %v", name)
+	}
+
+	can, _ := newCanvas(cdr.ChunkSize, cdr.ChunkOrigin, image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32))
+	defer can.Close()
+
+	result := canvasReplayResult{Recordings: len(recs)}
+	err = canvasDiskReaderForEachEvent(recs, recs[0].StartTime, recs[len(recs)-1].EndTime, func(t time.Time, event interface{}) error {
+		result.Events++
+		result.Time = t
+		canvasDiskReaderApplyEvent(can, event) // Like in replays, events outside of downloaded chunks are dropped
+		return nil
+	})
+	if err != nil {
+		return canvasReplayResult{}, err
+	}
+
+	if result.Hash, err = can.getHash(); err != nil {
+		return canvasReplayResult{}, err
+	}
+
+	return result, nil
+}
+
+// Returns the SHA-256 of what the canvas shows, as hex string.
+//
+// Only the pixels of the chunks are hashed, in the order of their position.
+// Whether chunks are valid, and how their images are stored internally doesn't change the hash.
+// Chunks without image or with only transparent pixels are skipped.
+func (can *canvas) getHash() (string, error) {
+	chunks := can.getAllChunks()
+	sort.Slice(chunks, func(i, j int) bool {
+		a, b := chunks[i].Rect.Min, chunks[j].Rect.Min
+		return a.Y < b.Y || a.Y == b.Y && a.X < b.X
+	})
+
+	hash := sha256.New()
+	for _, chunk := range chunks {
+		handle, _, _, err := chunk.getImage(false)
+		if err != nil {
+			continue // The chunk has no image
+		}
+		img := image.NewRGBA(chunk.Rect)
+		draw.Draw(img, img.Rect, handle.Image, img.Rect.Min, draw.Src)
+		handle.release()
+
+		if isImageTransparent(img) {
+			continue
+		}
+
+		rect := [4]int64{int64(img.Rect.Min.X), int64(img.Rect.Min.Y), int64(img.Rect.Max.X), int64(img.Rect.Max.Y)}
+		if err := binary.Write(hash, binary.LittleEndian, rect); err != nil {
+			return "", err
+		}
+		hash.Write(img.Pix)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Returns true if all pixels of the image are fully transparent
+func isImageTransparent(img *image.RGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "Write the golden recording in testdata again, and print its hash")
+
+// Hash of the final canvas of the golden recording.
+// If this changes, recordings don't reproduce the same state as with previous versions anymore.
+const canvasReplayGoldenHash = "061170215380d9b16739fa34c0428d12f5443b8ca58fceec2ad5cbc79eb8c88c"
+
+// Writes the golden recording, with events of all types and on chunks with negative coordinates
+func writeGoldenRecording(fileName string) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Date(2019, 6, 14, 12, 0, 0, 0, time.UTC)
+	w, err := recording.NewWriter(f, "golden", recording.Header{Time: start, ChunkSize: image.Point{64, 64}})
+	if err != nil {
+		return err
+	}
+
+	t := start
+	write := func(event interface{}) error {
+		t = t.Add(time.Second)
+		return w.WriteEvent(t, event)
+	}
+
+	for i, rect := range []image.Rectangle{image.Rect(-64, -64, 0, 0), image.Rect(0, 0, 64, 64)} {
+		img := image.NewPaletted(rect, pixelcanvasioPalette)
+		for j := range img.Pix {
+			img.Pix[j] = uint8((i*7 + j) % len(pixelcanvasioPalette))
+		}
+		if err := write(recording.SetImage{Image: img}); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < 100; i++ {
+		pos := image.Point{i%64 - 32, i*7%64 - 32}
+		if err := write(recording.SetPixel{Pos: pos, Color: pixelcanvasioPalette[i%16].(color.RGBA)}); err != nil {
+			return err
+		}
+	}
+	for _, event := range []interface{}{
+		recording.InvalidateRect{Rect: image.Rect(0, 0, 64, 64)},
+		recording.SetPixel{Pos: image.Point{10, 10}, Color: pixelcanvasioPalette[5].(color.RGBA)}, // On an invalid chunk
+		recording.RevalidateRect{Rect: image.Rect(0, 0, 64, 64)},
+		recording.SetPixel{Pos: image.Point{11, 10}, Color: pixelcanvasioPalette[6].(color.RGBA)},
+		recording.InvalidateAll{},
+	} {
+		if err := write(event); err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+func Test_canvasReplayGolden(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Join("testdata", "recordings"))
+	if err != nil {
+		t.Fatalf("Can't get directory: %v", err)
+	}
+
+	defer setPathSettings(getPaths())
+	settings := getPaths()
+	settings.Recordings = dir
+	setPathSettings(settings)
+
+	if *updateGolden {
+		if err := writeGoldenRecording(filepath.Join(dir, "golden", "2019-06-14T120000.pixrec")); err != nil {
+			t.Fatalf("Can't write golden recording: %v", err)
+		}
+	}
+
+	result, err := canvasReplayDeterministic("golden")
+	if err != nil {
+		t.Fatalf("Can't replay golden recording: %v", err)
+	}
+	if *updateGolden {
+		t.Logf("Hash of the golden recording: %v", result.Hash)
+	}
+
+	if result.Recordings != 1 || result.Events != 107 {
+		t.Errorf("Replayed %v recordings with %v events, want 1 with 107", result.Recordings, result.Events)
+	}
+	if want := time.Date(2019, 6, 14, 12, 1, 47, 0, time.UTC); !result.Time.Equal(want) {
+		t.Errorf("Last event at %v, want %v", result.Time, want)
+	}
+	if result.Hash != canvasReplayGoldenHash {
+		t.Errorf("Final canvas has hash %v, want %v", result.Hash, canvasReplayGoldenHash)
+	}
+
+	// Replaying again gives the same result
+	again, err := canvasReplayDeterministic("golden")
+	if err != nil {
+		t.Fatalf("Can't replay golden recording: %v", err)
+	}
+	if again != result {
+		t.Errorf("Second replay = %+v, want %+v", again, result)
+	}
+}
+
+func Test_canvasGetHash(t *testing.T) {
+	rect := image.Rect(0, 0, 64, 64)
+	newTestCanvas := func(img image.Image) *canvas {
+		can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+		if _, err := can.signalDownload(rect); err != nil {
+			t.Fatalf("Can't signal download at %v: %v", rect, err)
+		}
+		if err := can.setImage(img, false, false); err != nil {
+			t.Fatalf("Can't set image at %v: %v", rect, err)
+		}
+		return can
+	}
+
+	paletted := image.NewPaletted(rect, pixelcanvasioPalette)
+	paletted.SetColorIndex(1, 2, 5)
+	rgba := image.NewRGBA(rect)
+	for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+		for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+			rgba.Set(ix, iy, paletted.At(ix, iy))
+		}
+	}
+
+	canA, canB := newTestCanvas(paletted), newTestCanvas(rgba)
+	defer canA.Close()
+	defer canB.Close()
+
+	hashA, err := canA.getHash()
+	if err != nil {
+		t.Fatalf("Can't get hash: %v", err)
+	}
+
+	// Independent of how the image is stored, and whether it's valid
+	canB.invalidateAll()
+	if hashB, _ := canB.getHash(); hashB != hashA {
+		t.Errorf("Hash of the RGBA canvas is %v, want %v", hashB, hashA)
+	}
+
+	// Changes with the pixels
+	canB.revalidateRect(rect)
+	if err := canB.setPixel(image.Point{1, 2}, pixelcanvasioPalette[6]); err != nil {
+		t.Fatalf("Can't set pixel: %v", err)
+	}
+	if hashB, _ := canB.getHash(); hashB == hashA {
+		t.Errorf("Hash didn't change after setting a pixel")
+	}
+}
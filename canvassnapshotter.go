@@ -0,0 +1,312 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var snapshotLog = moduleLog("snapshots")
+
+const canvasSnapshotterTimeFormat = "2006-01-02T150405" // Same format as recordings, RFC3339 like but with : removed
+
+// Settings of a canvas snapshotter, stored in the configuration at .snapshots.<shortName>
+type canvasSnapshotterSettings struct {
+	Interval string            // Time between two snapshots, e.g. "1h". Snapshots are disabled if this is empty
+	MaxFiles int               // Maximum number of snapshots that are kept per rectangle. 0 keeps everything
+	MaxAge   string            // Snapshots older than this are deleted, e.g. "720h". Empty keeps everything
+	Upscale  int               // Integer scaling factor with nearest neighbor sampling. 0 or 1 keeps the original size
+	Overlay  exportOverlay     // Text that is drawn onto the snapshots
+	Rects    []image.Rectangle // Canvas regions that are written as separate images
+
+	Reports []exportReportSettings // HTML reports that are written with every snapshot
+}
+
+// Periodically writes PNG images of rectangles of a canvas.
+//
+// Snapshots are stored as snapshots/<shortName>/<rect>/<time>.png.
+type canvasSnapshotter struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas    *canvas
+	ShortName string
+
+	settingsChan chan canvasSnapshotterSettings
+	quitChan     chan struct{}
+	waitGroup    sync.WaitGroup
+}
+
+func (can *canvas) newCanvasSnapshotter(shortName string) (*canvasSnapshotter, error) {
+	re := regexp.MustCompile("[^a-zA-Z0-9\\-\\.]+")
+
+	cs := &canvasSnapshotter{
+		Canvas:       can,
+		ShortName:    re.ReplaceAllString(shortName, "_"),
+		settingsChan: make(chan canvasSnapshotterSettings),
+		quitChan:     make(chan struct{}),
+	}
+
+	// No events needed, the subscription only keeps the rectangles in sync
+	if err := can.subscribeListenerFiltered(cs, false, 0); err != nil {
+		return nil, err
+	}
+
+	cs.waitGroup.Add(1)
+	go func() {
+		defer cs.waitGroup.Done()
+
+		settings := canvasSnapshotterSettings{}
+		var tickerChan <-chan time.Time
+		var ticker *time.Ticker
+		defer func() {
+			if ticker != nil {
+				ticker.Stop()
+			}
+		}()
+
+		for {
+			select {
+			case settings = <-cs.settingsChan:
+				if ticker != nil {
+					ticker.Stop()
+					ticker, tickerChan = nil, nil
+				}
+				if settings.Interval == "" {
+					break
+				}
+				interval, err := time.ParseDuration(settings.Interval)
+				if err != nil || interval <= 0 {
+					snapshotLog.Errorf("Invalid snapshot interval %q for %v", settings.Interval, cs.ShortName)
+					break
+				}
+				ticker = time.NewTicker(interval)
+				tickerChan = ticker.C
+			case t := <-tickerChan:
+				for _, rect := range settings.Rects {
+					if err := cs.takeSnapshot(rect, settings.Upscale, settings.Overlay, t); err != nil {
+						snapshotLog.Warnf("Can't take snapshot of %v at %v: %v", cs.ShortName, rect, err)
+					}
+					if err := cs.applyRetention(rect, settings, t); err != nil {
+						snapshotLog.Warnf("Can't clean up snapshots of %v at %v: %v", cs.ShortName, rect, err)
+					}
+				}
+				for _, report := range settings.Reports {
+					if err := cs.writeReport(report, t); err != nil {
+						snapshotLog.Warnf("Can't write report of %v at %v: %v", cs.ShortName, report.Rect, err)
+					}
+				}
+			case <-cs.quitChan:
+				return
+			}
+		}
+	}()
+
+	return cs, nil
+}
+
+// Changes the settings of the snapshotter.
+// The rectangles are registered at the canvas, so that they are kept up to date.
+func (cs *canvasSnapshotter) setSettings(settings canvasSnapshotterSettings) error {
+	cs.ClosedMutex.RLock()
+	defer cs.ClosedMutex.RUnlock()
+	if cs.Closed {
+		return fmt.Errorf("Snapshotter is closed")
+	}
+
+	if err := cs.Canvas.registerRects(cs, settings.Rects); err != nil {
+		return err
+	}
+
+	cs.settingsChan <- settings
+
+	return nil
+}
+
+func (cs *canvasSnapshotter) getDirectory(rect image.Rectangle) string {
+	return dataPath(getPaths().Snapshots, cs.ShortName, fmt.Sprintf("%d_%d_%dx%d", rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy()))
+}
+
+// Writes the current content of rect into a PNG file named after t.
+// If upscale is larger than 1, the image is scaled up by that factor. The overlay is drawn after scaling.
+// Nothing is written, if the rectangle isn't completely downloaded.
+func (cs *canvasSnapshotter) takeSnapshot(rect image.Rectangle, upscale int, overlay exportOverlay, t time.Time) error {
+	if !cs.Canvas.isValid(rect) {
+		return fmt.Errorf("Rectangle is not completely downloaded")
+	}
+
+	// All chunks at the same point in time, so snapshots never show halves of changes
+	snapshot, err := cs.Canvas.getConsistentSnapshot(rect, false)
+	if err != nil {
+		return err
+	}
+	rgba, ok := snapshot.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(rect)
+		draw.Draw(rgba, rect, snapshot, rect.Min, draw.Src)
+	}
+	img := draw.Image(rgba)
+	if upscale > 1 {
+		img = upscaleNearest(rgba, upscale).(*image.RGBA)
+	}
+	overlay.draw(img, t, rect, cs.ShortName)
+
+	dir := cs.getDirectory(rect)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("Can't create directory %v: %v", dir, err)
+	}
+
+	fileName := filepath.Join(dir, t.UTC().Format(canvasSnapshotterTimeFormat)+".png")
+	f, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		return fmt.Errorf("Can't encode %v: %v", fileName, err)
+	}
+
+	return nil
+}
+
+// Writes a HTML report from the recordings into reports/<shortName>/<rect>.html, replacing the previous one
+func (cs *canvasSnapshotter) writeReport(report exportReportSettings, t time.Time) error {
+	opts := exportOptions{
+		Rect:    report.Rect,
+		EndTime: t,
+		Upscale: report.Upscale,
+	}
+	if report.Period != "" {
+		period, err := time.ParseDuration(report.Period)
+		if err != nil || period <= 0 {
+			return fmt.Errorf("Invalid report period %q", report.Period)
+		}
+		opts.StartTime = t.Add(-period)
+	}
+
+	rect := report.Rect
+	fileName := dataPath(getPaths().Reports, cs.ShortName, fmt.Sprintf("%d_%d_%dx%d.html", rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy()))
+	if rect.Empty() && report.Template != "" {
+		// Imported templates have their own position, so the rectangle may not be set at all
+		fileName = dataPath(getPaths().Reports, cs.ShortName, strings.TrimSuffix(filepath.Base(report.Template), filepath.Ext(report.Template))+".html")
+	}
+
+	return exportReport(cs.ShortName, opts, report.Template, fileName)
+}
+
+// Deletes the oldest snapshots of rect, so that the limits of the settings are met
+func (cs *canvasSnapshotter) applyRetention(rect image.Rectangle, settings canvasSnapshotterSettings, now time.Time) error {
+	var maxAge time.Duration
+	if settings.MaxAge != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(settings.MaxAge); err != nil {
+			return fmt.Errorf("Invalid maximum age %q: %v", settings.MaxAge, err)
+		}
+	}
+
+	dir := cs.getDirectory(rect)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// Get all snapshots, sorted from new to old
+	names := []string{}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".png") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for i, name := range names {
+		remove := settings.MaxFiles > 0 && i >= settings.MaxFiles
+		if maxAge > 0 {
+			t, err := time.Parse(canvasSnapshotterTimeFormat, strings.TrimSuffix(name, ".png"))
+			if err == nil && now.Sub(t) > maxAge {
+				remove = true
+			}
+		}
+		if remove {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (cs *canvasSnapshotter) handleInvalidateAll() error {
+	return nil
+}
+
+func (cs *canvasSnapshotter) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (cs *canvasSnapshotter) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (cs *canvasSnapshotter) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+
+func (cs *canvasSnapshotter) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	return nil
+}
+
+func (cs *canvasSnapshotter) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (cs *canvasSnapshotter) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (cs *canvasSnapshotter) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Close stops taking snapshots, and unsubscribes from the canvas
+func (cs *canvasSnapshotter) Close() {
+	cs.ClosedMutex.Lock()
+	defer cs.ClosedMutex.Unlock()
+	if cs.Closed {
+		return
+	}
+	cs.Closed = true
+
+	cs.Canvas.unsubscribeListener(cs)
+
+	close(cs.quitChan)
+	cs.waitGroup.Wait()
+}
@@ -0,0 +1,87 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func Test_canvasSnapshotter(t *testing.T) {
+	defer setPathSettings(getPaths())
+	paths := getPaths()
+	paths.Snapshots = t.TempDir()
+	setPathSettings(paths)
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	if err := can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false); err != nil {
+		t.Fatalf("Can't set image at %v: %v", rect, err)
+	}
+
+	cs, err := can.newCanvasSnapshotter("Test-Snapshotter")
+	if err != nil {
+		t.Fatalf("Can't create snapshotter: %v", err)
+	}
+	defer cs.Close()
+
+	snapshotRect := image.Rect(10, 10, 40, 30)
+	dir := cs.getDirectory(snapshotRect)
+
+	settings := canvasSnapshotterSettings{
+		MaxFiles: 2,
+		Rects:    []image.Rectangle{snapshotRect},
+	}
+
+	startTime := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		ti := startTime.Add(time.Duration(i) * time.Hour)
+		if err := cs.takeSnapshot(snapshotRect, 1, exportOverlay{}, ti); err != nil {
+			t.Fatalf("Can't take snapshot: %v", err)
+		}
+		if err := cs.applyRetention(snapshotRect, settings, ti); err != nil {
+			t.Fatalf("Can't apply retention: %v", err)
+		}
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Fatalf("Found %v snapshots, want 2", len(files))
+	}
+	if got, want := files[0].Name(), "2019-07-01T130000.png"; got != want {
+		t.Errorf("Oldest snapshot = %v, want %v", got, want)
+	}
+
+	// Remove everything older than 30 minutes
+	settings.MaxAge = "30m"
+	if err := cs.applyRetention(snapshotRect, settings, startTime.Add(2*time.Hour)); err != nil {
+		t.Fatalf("Can't apply retention: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Found %v snapshots, want 1", len(files))
+	}
+
+	// Rectangles without data are not written
+	if err := cs.takeSnapshot(image.Rect(64, 0, 128, 64), 1, exportOverlay{}, startTime); err == nil {
+		t.Errorf("Snapshot of a rectangle without data succeeded")
+	}
+}
@@ -0,0 +1,357 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of applied events after which replays check whether chunks have to be spilled
+const canvasSpillCheckInterval = 10000
+
+// Stores the images of cold chunks in a temporary directory, while a canvas replays or exports regions that don't fit into memory.
+//
+// Spilled chunks are removed from the canvas, getChunk() loads them back once they are needed again.
+// This is meant for canvases that are modified by a single goroutine, like replays.
+type canvasSpill struct {
+	sync.Mutex
+
+	Dir   string
+	Limit int64 // Memory of chunk images in bytes, above which cold chunks are spilled
+
+	spilled map[chunkCoordinate]bool // Coordinates of spilled chunks, and whether they are still valid
+}
+
+// Lets the canvas spill cold chunks into a new temporary directory, once its chunk images use more than limit bytes
+func (can *canvas) enableSpill(limit int64) error {
+	dir, err := os.MkdirTemp("", "d3pixelbot-spill-")
+	if err != nil {
+		return fmt.Errorf("Can't create spill directory: %v", err)
+	}
+
+	can.Lock()
+	defer can.Unlock()
+
+	can.spill = &canvasSpill{
+		Dir:     dir,
+		Limit:   limit,
+		spilled: map[chunkCoordinate]bool{},
+	}
+
+	return nil
+}
+
+func (can *canvas) getSpill() *canvasSpill {
+	can.RLock()
+	defer can.RUnlock()
+
+	return can.spill
+}
+
+func (cs *canvasSpill) fileName(coord chunkCoordinate) string {
+	return filepath.Join(cs.Dir, fmt.Sprintf("%d_%d.chunk", coord.X, coord.Y))
+}
+
+// Moves the least recently used chunks into the spill directory, until the remaining chunk images use less memory than the limit.
+// Does nothing if spilling isn't enabled.
+//
+// Returns the number of spilled chunks.
+func (can *canvas) spillColdChunks() (int, error) {
+	cs := can.getSpill()
+	if cs == nil {
+		return 0, nil
+	}
+
+	type candidate struct {
+		coord    chunkCoordinate
+		chunk    *chunk
+		size     int64
+		accessed bool
+	}
+	candidates := []candidate{}
+	var usage int64
+	can.RLock()
+	for coord, chunk := range can.Chunks {
+		size, _ := chunk.getMemoryUsage()
+		usage += size
+		candidates = append(candidates, candidate{coord, chunk, size, atomic.SwapUint32(&chunk.accessed, 0) != 0})
+	}
+	can.RUnlock()
+
+	if usage <= cs.Limit {
+		return 0, nil
+	}
+
+	// Chunks that weren't used since the last check go first. Spill down to 3/4 of the limit, so this doesn't happen on every check
+	sort.SliceStable(candidates, func(i, j int) bool { return !candidates[i].accessed && candidates[j].accessed })
+	target := cs.Limit / 4 * 3
+
+	spilled := 0
+	for _, c := range candidates {
+		if usage <= target {
+			break
+		}
+
+		can.Lock()
+		if can.Chunks[c.coord] != c.chunk {
+			can.Unlock()
+			continue // Deleted meanwhile
+		}
+		ok, err := cs.write(c.coord, c.chunk)
+		if ok && err == nil {
+			delete(can.Chunks, c.coord)
+		}
+		can.Unlock()
+		if err != nil {
+			return spilled, err
+		}
+		if ok {
+			usage -= c.size
+			spilled++
+		}
+	}
+
+	return spilled, nil
+}
+
+// Writes the chunk into the spill directory.
+// Returns false if the chunk can't be spilled right now, because it's downloading or has no image.
+func (cs *canvasSpill) write(coord chunkCoordinate, chu *chunk) (bool, error) {
+	chu.RLock()
+	defer chu.RUnlock()
+
+	if chu.Downloading {
+		return false, nil
+	}
+
+	var kind uint8
+	switch chu.Image.(type) {
+	case *image.Paletted:
+		kind = 1
+	case *image.RGBA:
+		kind = 2
+	default:
+		return false, nil
+	}
+
+	f, err := os.Create(cs.fileName(coord))
+	if err != nil {
+		return false, fmt.Errorf("Can't create spill file: %v", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	valid := uint8(0)
+	if chu.Valid {
+		valid = 1
+	}
+	w.Write([]byte{kind, valid})
+
+	switch img := chu.Image.(type) {
+	case *image.Paletted:
+		binary.Write(w, binary.LittleEndian, uint16(len(img.Palette)))
+		for _, c := range img.Palette {
+			rgba := color.RGBAModel.Convert(c).(color.RGBA)
+			w.Write([]byte{rgba.R, rgba.G, rgba.B, rgba.A})
+		}
+		for iy := chu.Rect.Min.Y; iy < chu.Rect.Max.Y; iy++ {
+			i := img.PixOffset(chu.Rect.Min.X, iy)
+			w.Write(img.Pix[i : i+chu.Rect.Dx()])
+		}
+	case *image.RGBA:
+		for iy := chu.Rect.Min.Y; iy < chu.Rect.Max.Y; iy++ {
+			i := img.PixOffset(chu.Rect.Min.X, iy)
+			w.Write(img.Pix[i : i+chu.Rect.Dx()*4])
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return false, fmt.Errorf("Can't write spill file: %v", err)
+	}
+
+	cs.Lock()
+	cs.spilled[coord] = true
+	cs.Unlock()
+
+	return true, nil
+}
+
+// Reads a spilled chunk back, and removes it from the spill directory.
+// Returns nil if the chunk isn't spilled, or can't be read.
+func (cs *canvasSpill) load(coord chunkCoordinate, rect image.Rectangle) *chunk {
+	cs.Lock()
+	valid, ok := cs.spilled[coord]
+	delete(cs.spilled, coord)
+	cs.Unlock()
+	if !ok {
+		return nil
+	}
+
+	fileName := cs.fileName(coord)
+	defer os.Remove(fileName)
+
+	chu, err := cs.read(fileName, rect)
+	if err != nil {
+		canvasLog.Warnf("Can't read spilled chunk at %v: %v", coord, err)
+		return nil
+	}
+	chu.Valid = chu.Valid && valid
+
+	return chu
+}
+
+func (cs *canvasSpill) read(fileName string, rect image.Rectangle) (*chunk, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	chu := newChunk(rect)
+	chu.Valid = header[1] != 0
+
+	switch header[0] {
+	case 1:
+		var count uint16
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
+		palette := make(color.Palette, count)
+		for i := range palette {
+			c := make([]byte, 4)
+			if _, err := io.ReadFull(r, c); err != nil {
+				return nil, err
+			}
+			palette[i] = color.RGBA{c[0], c[1], c[2], c[3]}
+		}
+		img := image.NewPaletted(rect, palette)
+		if _, err := io.ReadFull(r, img.Pix); err != nil {
+			return nil, err
+		}
+		chu.Image = img
+	case 2:
+		img := image.NewRGBA(rect)
+		if _, err := io.ReadFull(r, img.Pix); err != nil {
+			return nil, err
+		}
+		chu.Image = img
+	default:
+		return nil, fmt.Errorf("Unknown image kind %v", header[0])
+	}
+
+	return chu, nil
+}
+
+// Reads a spilled chunk without loading it back into the canvas, the spill file is kept.
+// Returns nil if the chunk isn't spilled, or can't be read.
+func (cs *canvasSpill) peek(coord chunkCoordinate, rect image.Rectangle) *chunk {
+	cs.Lock()
+	valid, ok := cs.spilled[coord]
+	cs.Unlock()
+	if !ok {
+		return nil
+	}
+
+	chu, err := cs.read(cs.fileName(coord), rect)
+	if err != nil {
+		canvasLog.Warnf("Can't read spilled chunk at %v: %v", coord, err)
+		return nil
+	}
+	chu.Valid = chu.Valid && valid
+
+	return chu
+}
+
+// Returns the chunks inside of rect like getChunks, but spilled chunks are read without loading them back into the canvas.
+// The returned spilled chunks are copies, changes to them are lost.
+func (can *canvas) peekChunks(rect chunkRectangle, ignoreNonexistent bool) ([]*chunk, error) {
+	if can.getSpill() == nil {
+		return can.getChunks(rect, false, ignoreNonexistent)
+	}
+
+	rectTemp := rect.Canon()
+	chunks := []*chunk{}
+
+	// Holding the lock prevents chunks from being spilled or loaded while they are read
+	can.RLock()
+	defer can.RUnlock()
+
+	for iy := rectTemp.Min.Y; iy < rectTemp.Max.Y; iy++ {
+		for ix := rectTemp.Min.X; ix < rectTemp.Max.X; ix++ {
+			coord := chunkCoordinate{ix, iy}
+			chunk, ok := can.Chunks[coord]
+			if !ok {
+				min := image.Point{coord.X*can.ChunkSize.X - can.Origin.X, coord.Y*can.ChunkSize.Y - can.Origin.Y}
+				chunk = can.spill.peek(coord, image.Rectangle{min, min.Add(image.Point{can.ChunkSize.X, can.ChunkSize.Y})})
+			}
+			if chunk == nil {
+				if !ignoreNonexistent {
+					return nil, fmt.Errorf("Can't get all chunks: Chunk at %v does not exist", coord)
+				}
+				continue
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	return chunks, nil
+}
+
+// Marks all spilled chunks as invalid, without loading them
+func (cs *canvasSpill) invalidateAll() {
+	cs.Lock()
+	defer cs.Unlock()
+
+	for coord := range cs.spilled {
+		cs.spilled[coord] = false
+	}
+}
+
+// Returns the number of spilled chunks
+func (cs *canvasSpill) count() int {
+	cs.Lock()
+	defer cs.Unlock()
+
+	return len(cs.spilled)
+}
+
+// Removes the spill directory with all spilled chunks
+func (cs *canvasSpill) close() {
+	cs.Lock()
+	defer cs.Unlock()
+
+	cs.spilled = map[chunkCoordinate]bool{}
+	if err := os.RemoveAll(cs.Dir); err != nil {
+		canvasLog.Warnf("Can't remove spill directory %v: %v", cs.Dir, err)
+	}
+}
@@ -0,0 +1,117 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"testing"
+)
+
+func Test_canvasSpill(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	if err := can.enableSpill(1); err != nil {
+		t.Fatalf("Can't enable spill: %v", err)
+	}
+	dir := can.getSpill().Dir
+
+	img := image.NewRGBA(image.Rect(0, 0, 256, 128))
+	for iy := 0; iy < 128; iy++ {
+		for ix := 0; ix < 256; ix++ {
+			img.Set(ix, iy, pixelcanvasioPalette[(ix/16+iy/16)%len(pixelcanvasioPalette)])
+		}
+	}
+	if _, err := can.signalDownload(img.Bounds()); err != nil {
+		t.Fatalf("Can't signal download: %v", err)
+	}
+	if err := can.setImage(img, false, false); err != nil {
+		t.Fatalf("Can't set image: %v", err)
+	}
+
+	spilled, err := can.spillColdChunks()
+	if err != nil {
+		t.Fatalf("Can't spill chunks: %v", err)
+	}
+	if spilled != 8 || len(can.getAllChunks()) != 0 || can.getSpill().count() != 8 {
+		t.Fatalf("Spilled %v chunks, %v remain and %v are in the spill directory, want 8, 0 and 8", spilled, len(can.getAllChunks()), can.getSpill().count())
+	}
+
+	// Reading an image streams the spilled chunks without loading them back
+	copy, err := can.getImageCopy(img.Bounds(), false, false)
+	if err != nil {
+		t.Fatalf("Can't get image of spilled chunks: %v", err)
+	}
+	for iy := 0; iy < 128; iy++ {
+		for ix := 0; ix < 256; ix++ {
+			if copy.RGBAAt(ix, iy) != img.RGBAAt(ix, iy) {
+				t.Fatalf("Pixel at %v = %v, want %v", image.Point{ix, iy}, copy.RGBAAt(ix, iy), img.RGBAAt(ix, iy))
+			}
+		}
+	}
+	if len(can.getAllChunks()) != 0 {
+		t.Errorf("Reading an image loaded %v chunks back", len(can.getAllChunks()))
+	}
+
+	// Modifying a spilled chunk loads it back
+	if err := can.setPixel(image.Point{1, 1}, pixelcanvasioPalette[3]); err != nil {
+		t.Fatalf("Can't set pixel of spilled chunk: %v", err)
+	}
+	if len(can.getAllChunks()) != 1 || can.getSpill().count() != 7 {
+		t.Errorf("%v chunks and %v spilled chunks after setting a pixel, want 1 and 7", len(can.getAllChunks()), can.getSpill().count())
+	}
+	if col, err := can.getPixel(image.Point{2, 2}); err != nil || col != img.At(2, 2) {
+		t.Errorf("Pixel of loaded chunk = %v, %v, want %v", col, err, img.At(2, 2))
+	}
+
+	// Invalidation also affects spilled chunks
+	if err := can.invalidateAll(); err != nil {
+		t.Fatalf("Can't invalidate chunks: %v", err)
+	}
+	if _, err := can.getImageCopy(image.Rect(64, 0, 128, 64), true, false); err == nil {
+		t.Errorf("Got image of invalidated spilled chunk")
+	}
+	if chunk, err := can.getChunk(chunkCoordinate{1, 0}, false); err != nil || chunk.Valid {
+		t.Errorf("Loaded invalidated chunk = %v, %v, want invalid chunk", chunk, err)
+	}
+
+	can.Close()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Spill directory %v still exists after closing: %v", dir, err)
+	}
+}
+
+func Test_canvasSpillLimit(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+	if err := can.enableSpill(1 << 30); err != nil {
+		t.Fatalf("Can't enable spill: %v", err)
+	}
+
+	if err := can.setPixel(image.Point{}, color.RGBA{255, 255, 255, 255}); err == nil {
+		t.Fatalf("Set pixel of nonexistent chunk")
+	}
+	if _, err := can.signalDownload(image.Rect(0, 0, 128, 128)); err != nil {
+		t.Fatalf("Can't signal download: %v", err)
+	}
+	if err := can.setImage(image.NewRGBA(image.Rect(0, 0, 128, 128)), false, false); err != nil {
+		t.Fatalf("Can't set image: %v", err)
+	}
+	if spilled, err := can.spillColdChunks(); err != nil || spilled != 0 {
+		t.Errorf("Spilled %v chunks below the limit: %v", spilled, err)
+	}
+}
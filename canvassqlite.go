@@ -0,0 +1,396 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Name of the database/sql driver used for SQLite recordings.
+// The driver is only included when built with the sqlite tag, see canvassqlitedriver.go.
+const canvasSQLiteDriver = "sqlite3"
+
+const canvasSQLiteCommitInterval = 1 * time.Second // Events are written in transactions of this length
+
+// Database layout of SQLite recordings.
+//
+// Events use the same type numbers as pixrec files.
+// Their position is stored as pixel rectangle, and as chunk coordinate of the rectangle's minimum.
+// Pixels have a rectangle of size 1x1, InvalidateAll events have no position.
+// Colors are stored as 0xRRGGBB integers, images as PNG.
+const canvasSQLiteSchema = `
+CREATE TABLE IF NOT EXISTS info (
+	key   TEXT PRIMARY KEY,
+	value
+);
+CREATE TABLE IF NOT EXISTS events (
+	id      INTEGER PRIMARY KEY,
+	time    INTEGER NOT NULL, -- Unix time in nanoseconds
+	type    INTEGER NOT NULL, -- 10: SetPixel, 20: InvalidateRect, 21: InvalidateAll, 22: RevalidateRect, 30: SetImage
+	chunk_x INTEGER,
+	chunk_y INTEGER,
+	min_x   INTEGER,
+	min_y   INTEGER,
+	max_x   INTEGER,
+	max_y   INTEGER,
+	color   INTEGER,
+	image   BLOB
+);
+CREATE INDEX IF NOT EXISTS events_time ON events (time);
+CREATE INDEX IF NOT EXISTS events_chunk ON events (chunk_x, chunk_y, time);
+`
+
+func init() {
+	for _, driver := range sql.Drivers() {
+		if driver == canvasSQLiteDriver {
+			canvasRecorderFormats["sqlite"] = func(can *canvas, shortName string, settings canvasRecorderSettings) (canvasRecorder, error) {
+				csw, err := can.newCanvasSQLiteWriter(shortName)
+				if err != nil {
+					return nil, err
+				}
+				return csw, nil
+			}
+		}
+	}
+}
+
+// Records canvas events into a SQLite database.
+//
+// In contrast to pixrec files, the events are indexed by time and chunk.
+// This allows ad-hoc SQL queries and random access, but the files are a lot larger.
+type canvasSQLiteWriter struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas   *canvas
+	FileName string
+
+	db         *sql.DB
+	txMutex    sync.Mutex
+	tx         *sql.Tx
+	insertStmt *sql.Stmt
+	lastCommit time.Time
+	lastTime   time.Time // Time of the last event, so times don't go backwards when the clock estimate changes
+}
+
+func (can *canvas) newCanvasSQLiteWriter(shortName string) (*canvasSQLiteWriter, error) {
+	re := regexp.MustCompile("[^a-zA-Z0-9\\-\\.]+")
+	shortName = re.ReplaceAllString(shortName, "_")
+
+	startTime := can.Clock.now()
+	clockOffset, _ := can.Clock.getOffset()
+	fileName := startTime.UTC().Format("2006-01-02T150405") + ".sqlite"
+	fileDirectory := dataPath(getPaths().Recordings, shortName)
+	filePath := filepath.Join(fileDirectory, fileName)
+
+	os.MkdirAll(fileDirectory, 0777)
+	db, err := sql.Open(canvasSQLiteDriver, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open database %v: %v", filePath, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(canvasSQLiteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Can't create tables in %v: %v", filePath, err)
+	}
+
+	info := map[string]interface{}{
+		"version":      1,
+		"game":         shortName,
+		"start_time":   startTime.UnixNano(),
+		"chunk_width":  can.ChunkSize.X,
+		"chunk_height": can.ChunkSize.Y,
+		"origin_x":     can.Origin.X,
+		"origin_y":     can.Origin.Y,
+		"clock_offset": int64(clockOffset),
+	}
+	for key, value := range info {
+		if _, err := db.Exec("INSERT OR REPLACE INTO info (key, value) VALUES (?, ?)", key, value); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Can't write to %v: %v", filePath, err)
+		}
+	}
+
+	csw := &canvasSQLiteWriter{
+		Canvas:   can,
+		FileName: filePath,
+		db:       db,
+		lastTime: startTime,
+	}
+
+	if err := csw.begin(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	can.subscribeListenerFiltered(csw, false, canvasEventMaskAll&^canvasEventMaskDownloads) // Don't let the canvas manage virtual chunks for us. Downloads are not stored
+
+	return csw, nil
+}
+
+// Starts a new transaction. txMutex must be locked, or the writer must not be used by anything else
+func (csw *canvasSQLiteWriter) begin() error {
+	tx, err := csw.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Can't begin transaction in %v: %v", csw.FileName, err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO events (time, type, chunk_x, chunk_y, min_x, min_y, max_x, max_y, color, image) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Can't prepare statement in %v: %v", csw.FileName, err)
+	}
+
+	csw.tx, csw.insertStmt, csw.lastCommit = tx, stmt, time.Now()
+	return nil
+}
+
+// Commits the current transaction. txMutex must be locked
+func (csw *canvasSQLiteWriter) commit() error {
+	csw.insertStmt.Close()
+	if err := csw.tx.Commit(); err != nil {
+		return fmt.Errorf("Can't commit to %v: %v", csw.FileName, err)
+	}
+	csw.tx, csw.insertStmt = nil, nil
+	return nil
+}
+
+// Inserts an event. rect is ignored for InvalidateAll events, col and img may be nil
+func (csw *canvasSQLiteWriter) insert(eventType int, rect image.Rectangle, col interface{}, img []byte) error {
+	csw.txMutex.Lock()
+	defer csw.txMutex.Unlock()
+
+	if csw.tx == nil {
+		return fmt.Errorf("Database %v is closed", csw.FileName)
+	}
+
+	if t := csw.Canvas.Clock.now(); t.After(csw.lastTime) {
+		csw.lastTime = t
+	}
+
+	var err error
+	if eventType == 21 {
+		_, err = csw.insertStmt.Exec(csw.lastTime.UnixNano(), eventType, nil, nil, nil, nil, nil, nil, col, img)
+	} else {
+		chunk := csw.Canvas.ChunkSize.getChunkCoord(rect.Min, csw.Canvas.Origin)
+		_, err = csw.insertStmt.Exec(csw.lastTime.UnixNano(), eventType, chunk.X, chunk.Y, rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y, col, img)
+	}
+	if err != nil {
+		return fmt.Errorf("Can't write to %v: %v", csw.FileName, err)
+	}
+
+	if time.Since(csw.lastCommit) >= canvasSQLiteCommitInterval {
+		if err := csw.commit(); err != nil {
+			return err
+		}
+		return csw.begin()
+	}
+
+	return nil
+}
+
+// Returns the path of the database
+func (csw *canvasSQLiteWriter) getFileName() string {
+	return csw.FileName
+}
+
+func (csw *canvasSQLiteWriter) setListeningRects(rects []image.Rectangle) error {
+	csw.ClosedMutex.RLock()
+	defer csw.ClosedMutex.RUnlock()
+	if csw.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	csw.Canvas.registerRects(csw, rects)
+
+	return nil
+}
+
+func (csw *canvasSQLiteWriter) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	csw.ClosedMutex.RLock()
+	defer csw.ClosedMutex.RUnlock()
+	if csw.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	r, g, b, _ := col.RGBA() // Returns 16 bit per channel
+
+	return csw.insert(10, image.Rectangle{pos, pos.Add(image.Point{1, 1})}, int64(r>>8)<<16|int64(g>>8)<<8|int64(b>>8), nil)
+}
+
+func (csw *canvasSQLiteWriter) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	csw.ClosedMutex.RLock()
+	defer csw.ClosedMutex.RUnlock()
+	if csw.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	return csw.insert(20, rect, nil, nil)
+}
+
+func (csw *canvasSQLiteWriter) handleInvalidateAll() error {
+	csw.ClosedMutex.RLock()
+	defer csw.ClosedMutex.RUnlock()
+	if csw.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	return csw.insert(21, image.Rectangle{}, nil, nil)
+}
+
+func (csw *canvasSQLiteWriter) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	csw.ClosedMutex.RLock()
+	defer csw.ClosedMutex.RUnlock()
+	if csw.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	return csw.insert(22, rect, nil, nil)
+}
+
+func (csw *canvasSQLiteWriter) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	// Not stored, like in pixrec files
+	return nil
+}
+
+func (csw *canvasSQLiteWriter) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	csw.ClosedMutex.RLock()
+	defer csw.ClosedMutex.RUnlock()
+	if csw.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	// If image is not in sync with the game, ignore it. A valid image will follow later
+	if !valid {
+		return nil
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := png.Encode(buffer, img); err != nil {
+		return fmt.Errorf("Can't create image for %v: %v", csw.FileName, err)
+	}
+
+	return csw.insert(30, img.Bounds(), nil, buffer.Bytes())
+}
+
+func (csw *canvasSQLiteWriter) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+func (csw *canvasSQLiteWriter) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (csw *canvasSQLiteWriter) Close() {
+	csw.Canvas.unsubscribeListener(csw)
+	csw.handleInvalidateAll()
+
+	csw.ClosedMutex.Lock()
+	if csw.Closed {
+		csw.ClosedMutex.Unlock()
+		return
+	}
+	csw.Closed = true // Prevent any new events from happening
+	csw.ClosedMutex.Unlock()
+	unregisterCanvasRecorder(csw)
+
+	csw.txMutex.Lock()
+	defer csw.txMutex.Unlock()
+
+	if csw.tx != nil {
+		if err := csw.commit(); err != nil {
+			recordingLog.Errorf("%v", err)
+		}
+	}
+	csw.db.Close()
+}
+
+// Reads all events of a SQLite recording inside the time range from startTime (inclusive) to endTime (exclusive) in chronological order, and passes them to fn.
+// Only events that touch rect are read, InvalidateAll events are always passed.
+func canvasSQLiteForEachEvent(fileName string, rect image.Rectangle, startTime, endTime time.Time, fn func(t time.Time, event interface{}) error) error {
+	db, err := sql.Open(canvasSQLiteDriver, fileName)
+	if err != nil {
+		return fmt.Errorf("Can't open database %v: %v", fileName, err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT time, type, min_x, min_y, max_x, max_y, color, image FROM events
+		WHERE time >= ? AND time < ? AND (type = 21 OR (max_x > ? AND min_x < ? AND max_y > ? AND min_y < ?))
+		ORDER BY time, id`, startTime.UnixNano(), endTime.UnixNano(), rect.Min.X, rect.Max.X, rect.Min.Y, rect.Max.Y)
+	if err != nil {
+		return fmt.Errorf("Can't query %v: %v", fileName, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t int64
+		var eventType int
+		var minX, minY, maxX, maxY, col sql.NullInt64
+		var img []byte
+		if err := rows.Scan(&t, &eventType, &minX, &minY, &maxX, &maxY, &col, &img); err != nil {
+			return fmt.Errorf("Can't read event from %v: %v", fileName, err)
+		}
+		r := image.Rect(int(minX.Int64), int(minY.Int64), int(maxX.Int64), int(maxY.Int64))
+
+		var event interface{}
+		switch eventType {
+		case 10:
+			event = canvasEventSetPixel{Pos: r.Min, Color: color.RGBA{uint8(col.Int64 >> 16), uint8(col.Int64 >> 8), uint8(col.Int64), 255}, Index: -1}
+		case 20:
+			event = canvasEventInvalidateRect{Rect: r}
+		case 21:
+			event = canvasEventInvalidateAll{}
+		case 22:
+			event = canvasEventRevalidate{Rect: r}
+		case 30:
+			decoded, err := png.Decode(bytes.NewReader(img))
+			if err != nil {
+				return fmt.Errorf("Can't decode image in %v: %v", fileName, err)
+			}
+			// Move image to its position
+			switch decoded := decoded.(type) {
+			case *image.Paletted:
+				decoded.Rect = decoded.Rect.Add(r.Min)
+			case *image.RGBA:
+				decoded.Rect = decoded.Rect.Add(r.Min)
+			case *image.NRGBA:
+				decoded.Rect = decoded.Rect.Add(r.Min)
+			default:
+				return fmt.Errorf("Unknown image type %T in %v", decoded, fileName)
+			}
+			event = canvasEventSetImage{Image: decoded}
+		default:
+			return fmt.Errorf("Unknown event type %v in %v", eventType, fileName)
+		}
+
+		if err := fn(time.Unix(0, t), event); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,101 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"database/sql"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_canvasRecorderFormats(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	if _, err := can.newCanvasRecorder("Test-RecorderFormats", canvasRecorderSettings{Format: "unknown"}); err == nil {
+		t.Errorf("Unknown format was accepted")
+	}
+	if _, err := can.newCanvasRecorder("Test-RecorderFormats", canvasRecorderSettings{Compression: 10}); err == nil {
+		t.Errorf("Invalid compression level was accepted")
+	}
+
+	rec, err := can.newCanvasRecorder("Test-RecorderFormats", canvasRecorderSettings{})
+	if err != nil {
+		t.Fatalf("Can't create recorder with default format: %v", err)
+	}
+	if _, ok := rec.(*canvasDiskWriter); !ok {
+		t.Errorf("Default format created %T, want %T", rec, &canvasDiskWriter{})
+	}
+	rec.Close()
+	os.RemoveAll(filepath.Join("recordings", "Test-RecorderFormats"))
+}
+
+func Test_canvasSQLiteWriter(t *testing.T) {
+	if _, ok := canvasRecorderFormats["sqlite"]; !ok {
+		t.Skip("SQLite driver isn't included, build with the sqlite tag")
+	}
+
+	startTime := time.Now()
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	rec, err := can.newCanvasRecorder("Test-SQLite", canvasRecorderSettings{Format: "sqlite"})
+	if err != nil {
+		t.Fatalf("Can't create SQLite recorder: %v", err)
+	}
+	csw := rec.(*canvasSQLiteWriter)
+	defer os.RemoveAll(filepath.Dir(csw.FileName))
+
+	rect, pos := image.Rect(64, 0, 128, 64), image.Point{65, 2}
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+	can.setPixel(pos, pixelcanvasioPalette[5])
+	time.Sleep(50 * time.Millisecond)
+	rec.Close()
+	can.Close()
+
+	// Ad-hoc queries work on the indexed events
+	db, err := sql.Open(canvasSQLiteDriver, csw.FileName)
+	if err != nil {
+		t.Fatalf("Can't open database: %v", err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM events WHERE chunk_x = 1 AND chunk_y = 0 AND type = 10").Scan(&count); err != nil || count != 1 {
+		t.Errorf("Got %v pixel events in chunk (1, 0) (error: %v), want 1", count, err)
+	}
+	db.Close()
+
+	events := []interface{}{}
+	err = canvasSQLiteForEachEvent(csw.FileName, image.Rect(64, 0, 70, 10), startTime, time.Now(), func(t time.Time, event interface{}) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Can't read events: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Got %v events, want 3 (SetImage, SetPixel, InvalidateAll)", len(events))
+	}
+	if img, ok := events[0].(canvasEventSetImage); !ok || img.Image.Bounds() != rect {
+		t.Errorf("First event is %v, want SetImage at %v", events[0], rect)
+	}
+	if pixel, ok := events[1].(canvasEventSetPixel); !ok || pixel.Pos != pos || color.RGBAModel.Convert(pixel.Color) != color.RGBAModel.Convert(pixelcanvasioPalette[5]) {
+		t.Errorf("Second event is %v, want SetPixel at %v", events[1], pos)
+	}
+}
@@ -0,0 +1,349 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+// Length of the intervals that set pixels are counted in
+const canvasStatisticsInterval = time.Minute
+
+// How long the counts are kept, if the settings don't say otherwise
+const canvasStatisticsDefaultRetention = 24 * time.Hour
+
+// Settings of the activity statistics of a game, stored in the configuration at .statistics.<game>
+type canvasStatisticsSettings struct {
+	Regions   map[string]image.Rectangle // Regions by their name, the pixels that are set inside of them are counted
+	Retention string                     // Duration like "168h", how long the counts are kept. Defaults to 24 hours
+}
+
+func (s canvasStatisticsSettings) validate() error {
+	for name, rect := range s.Regions {
+		if rect.Empty() {
+			return fmt.Errorf("Region %q is empty", name)
+		}
+	}
+	if s.Retention != "" {
+		d, err := time.ParseDuration(s.Retention)
+		if err != nil {
+			return fmt.Errorf("Invalid retention %q: %v", s.Retention, err)
+		}
+		if d < canvasStatisticsInterval {
+			return fmt.Errorf("Retention %v must be at least %v", d, canvasStatisticsInterval)
+		}
+	}
+	return nil
+}
+
+// Returns the parsed retention, or the default
+func (s canvasStatisticsSettings) getRetention() time.Duration {
+	if d, err := time.ParseDuration(s.Retention); err == nil && d >= canvasStatisticsInterval {
+		return d
+	}
+	return canvasStatisticsDefaultRetention
+}
+
+// Number of pixels that were set in one interval
+type canvasStatisticsSample struct {
+	Time   time.Time `json:"time"` // Start of the interval
+	Pixels int       `json:"pixels"`
+}
+
+// Counts the pixels per minute that are set inside of configured regions of a canvas.
+//
+// It's opened together with the game connection, so it counts whether or not a recording is running.
+// The regions are registered at the canvas, so their chunks are kept up to date.
+type canvasStatistics struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas    *canvas
+	ShortName string
+
+	sync.Mutex
+	regions   map[string]image.Rectangle
+	retention time.Duration
+	started   time.Time
+	series    map[string][]canvasStatisticsSample // Sparse, intervals without any pixels are missing
+	total     [2]canvasStatisticsSample           // Pixels of the whole canvas in the last two intervals that had any
+
+	config     *configdb.Config
+	callbackID int
+}
+
+var canvasStatisticsGames = struct {
+	sync.Mutex
+	games map[string]*canvasStatistics
+}{
+	games: map[string]*canvasStatistics{},
+}
+
+// Starts counting the activity of the canvas of the given game.
+//
+// The settings are read from c and applied when they change. If c is nil, there are no regions until setSettings is called.
+func (can *canvas) newCanvasStatistics(c *configdb.Config, shortName string) (*canvasStatistics, error) {
+	st := &canvasStatistics{
+		Canvas:    can,
+		ShortName: shortName,
+		regions:   map[string]image.Rectangle{},
+		retention: canvasStatisticsDefaultRetention,
+		started:   time.Now(),
+		series:    map[string][]canvasStatisticsSample{},
+		config:    c,
+	}
+
+	if err := can.subscribeListenerFiltered(st, false, canvasEventMaskPixels); err != nil {
+		return nil, err
+	}
+
+	canvasStatisticsGames.Lock()
+	canvasStatisticsGames.games[shortName] = st
+	canvasStatisticsGames.Unlock()
+
+	if c != nil {
+		st.callbackID = c.RegisterCallback([]string{".statistics." + shortName}, func(c *configdb.Config, modified, added, removed []string) {
+			settings := canvasStatisticsSettings{}
+			c.Get(".statistics."+shortName, &settings)
+			if err := settings.validate(); err != nil {
+				log.Errorf("Invalid settings at .statistics.%v, not counting any region: %v", shortName, err)
+				settings = canvasStatisticsSettings{}
+			}
+			st.setSettings(settings)
+		})
+	}
+
+	return st, nil
+}
+
+// Returns the statistics of an open game
+func getCanvasStatistics(shortName string) (*canvasStatistics, error) {
+	canvasStatisticsGames.Lock()
+	defer canvasStatisticsGames.Unlock()
+
+	st, ok := canvasStatisticsGames.games[shortName]
+	if !ok {
+		return nil, fmt.Errorf("There are no statistics of %q", shortName)
+	}
+	return st, nil
+}
+
+// Changes the counted regions. Counts of regions that were removed are dropped
+func (st *canvasStatistics) setSettings(settings canvasStatisticsSettings) error {
+	st.ClosedMutex.RLock()
+	defer st.ClosedMutex.RUnlock()
+	if st.Closed {
+		return fmt.Errorf("Statistics are closed")
+	}
+
+	rects := []image.Rectangle{}
+	st.Lock()
+	st.regions, st.retention = map[string]image.Rectangle{}, settings.getRetention()
+	for name, rect := range settings.Regions {
+		st.regions[name] = rect
+		rects = append(rects, rect)
+	}
+	for name := range st.series {
+		if _, ok := st.regions[name]; !ok {
+			delete(st.series, name)
+		}
+	}
+	st.Unlock()
+
+	return st.Canvas.registerRects(st, rects)
+}
+
+// Counts a pixel that was set at the given time. The lock must be held
+func (st *canvasStatistics) count(pos image.Point, t time.Time) {
+	t = t.Truncate(canvasStatisticsInterval)
+	if st.total[1].Time.Equal(t) {
+		st.total[1].Pixels++
+	} else {
+		st.total[0], st.total[1] = st.total[1], canvasStatisticsSample{Time: t, Pixels: 1}
+	}
+
+	for name, rect := range st.regions {
+		if !pos.In(rect) {
+			continue
+		}
+		series := st.series[name]
+		if n := len(series); n > 0 && series[n-1].Time.Equal(t) {
+			series[n-1].Pixels++
+			continue
+		}
+
+		// Drop the samples that are older than the retention, once per interval
+		cut := 0
+		for cut < len(series) && t.Sub(series[cut].Time) >= st.retention {
+			cut++
+		}
+		st.series[name] = append(series[cut:], canvasStatisticsSample{Time: t, Pixels: 1})
+	}
+}
+
+// Returns the names of the regions, sorted
+func (st *canvasStatistics) getRegions() []string {
+	st.Lock()
+	defer st.Unlock()
+
+	names := make([]string, 0, len(st.regions))
+	for name := range st.regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the number of pixels that were set in the last complete interval before now, on the whole canvas and in each region
+func (st *canvasStatistics) getRates(now time.Time) (total int, regions map[string]int) {
+	st.Lock()
+	defer st.Unlock()
+
+	last := now.Truncate(canvasStatisticsInterval).Add(-canvasStatisticsInterval)
+	for _, sample := range st.total {
+		if sample.Time.Equal(last) {
+			total = sample.Pixels
+		}
+	}
+
+	regions = map[string]int{}
+	for name := range st.regions {
+		regions[name] = 0
+		series := st.series[name]
+		for i := len(series) - 1; i >= 0 && !series[i].Time.Before(last); i-- {
+			if series[i].Time.Equal(last) {
+				regions[name] = series[i].Pixels
+			}
+		}
+	}
+
+	return total, regions
+}
+
+// Returns the pixel counts of all regions, one sample per interval from since until now.
+//
+// Intervals without any pixels are included with a count of 0, so the series can be graphed directly.
+// The series start no earlier than the statistics were started, or the retention allows.
+func (st *canvasStatistics) getSeries(since, now time.Time) map[string][]canvasStatisticsSample {
+	st.Lock()
+	defer st.Unlock()
+
+	now = now.Truncate(canvasStatisticsInterval)
+	if earliest := now.Add(-st.retention + canvasStatisticsInterval); since.Before(earliest) {
+		since = earliest
+	}
+	if since.Before(st.started) {
+		since = st.started
+	}
+	since = since.Truncate(canvasStatisticsInterval)
+
+	result := map[string][]canvasStatisticsSample{}
+	for name := range st.regions {
+		series, i := st.series[name], 0
+		samples := []canvasStatisticsSample{}
+		for t := since; !t.After(now); t = t.Add(canvasStatisticsInterval) {
+			for i < len(series) && series[i].Time.Before(t) {
+				i++
+			}
+			sample := canvasStatisticsSample{Time: t}
+			if i < len(series) && series[i].Time.Equal(t) {
+				sample.Pixels = series[i].Pixels
+			}
+			samples = append(samples, sample)
+		}
+		result[name] = samples
+	}
+
+	return result
+}
+
+func (st *canvasStatistics) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	st.Lock()
+	defer st.Unlock()
+
+	st.count(pos, time.Now())
+	return nil
+}
+
+func (st *canvasStatistics) handleSetPixels(pixels []canvasListenerPixel) error {
+	st.Lock()
+	defer st.Unlock()
+
+	t := time.Now()
+	for _, pixel := range pixels {
+		st.count(pixel.Pos, t)
+	}
+	return nil
+}
+
+func (st *canvasStatistics) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (st *canvasStatistics) handleInvalidateAll() error {
+	return nil
+}
+
+func (st *canvasStatistics) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (st *canvasStatistics) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+
+func (st *canvasStatistics) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (st *canvasStatistics) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (st *canvasStatistics) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Stops counting, and unregisters the statistics of the game
+func (st *canvasStatistics) Close() {
+	st.ClosedMutex.Lock()
+	if st.Closed {
+		st.ClosedMutex.Unlock()
+		return
+	}
+	st.Closed = true
+	st.ClosedMutex.Unlock()
+
+	if st.config != nil {
+		st.config.UnregisterCallback(st.callbackID)
+	}
+
+	canvasStatisticsGames.Lock()
+	if canvasStatisticsGames.games[st.ShortName] == st {
+		delete(canvasStatisticsGames.games, st.ShortName)
+	}
+	canvasStatisticsGames.Unlock()
+
+	st.Canvas.unsubscribeListener(st)
+}
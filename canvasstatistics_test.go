@@ -0,0 +1,130 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+func Test_canvasStatistics(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	st, err := can.newCanvasStatistics(nil, "Test-statistics")
+	if err != nil {
+		t.Fatalf("Can't create statistics: %v", err)
+	}
+	if err := st.setSettings(canvasStatisticsSettings{Regions: map[string]image.Rectangle{
+		"left":  image.Rect(0, 0, 32, 64),
+		"right": image.Rect(32, 0, 64, 64),
+		"all":   image.Rect(0, 0, 64, 64),
+	}}); err != nil {
+		t.Fatalf("Can't change settings: %v", err)
+	}
+	if _, err := getCanvasStatistics("Test-statistics"); err != nil {
+		t.Errorf("Statistics aren't registered: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		can.setPixel(image.Point{i * 6, 0}, pixelcanvasioPalette[5])
+	}
+	st.Close() // Waits until all events are delivered
+
+	if _, err := getCanvasStatistics("Test-statistics"); err == nil {
+		t.Errorf("Statistics are still registered after closing")
+	}
+
+	// Sum all samples, the pixels may be counted in two minutes
+	series := st.getSeries(time.Time{}, time.Now())
+	for name, want := range map[string]int{"left": 6, "right": 4, "all": 10} {
+		got := 0
+		for _, sample := range series[name] {
+			got += sample.Pixels
+		}
+		if got != want {
+			t.Errorf("Region %q has %v pixels, want %v", name, got, want)
+		}
+	}
+}
+
+func Test_canvasStatisticsSeries(t *testing.T) {
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	st := &canvasStatistics{
+		regions:   map[string]image.Rectangle{"a": image.Rect(0, 0, 10, 10)},
+		retention: 10 * time.Minute,
+		started:   start,
+		series:    map[string][]canvasStatisticsSample{},
+	}
+
+	// Two pixels in the first minute, one in the fourth, one outside
+	st.count(image.Point{1, 1}, start.Add(10*time.Second))
+	st.count(image.Point{2, 2}, start.Add(50*time.Second))
+	st.count(image.Point{3, 3}, start.Add(3*time.Minute))
+	st.count(image.Point{20, 20}, start.Add(3*time.Minute))
+
+	// The rates are those of the last complete minute
+	if total, regions := st.getRates(start.Add(4*time.Minute + 30*time.Second)); total != 2 || regions["a"] != 1 {
+		t.Errorf("Got rates %v and %v, want 2 and 1", total, regions)
+	}
+	if total, regions := st.getRates(start.Add(3*time.Minute + 30*time.Second)); total != 0 || regions["a"] != 0 {
+		t.Errorf("Got rates %v and %v during the minute, want 0 and 0", total, regions)
+	}
+
+	got := st.getSeries(time.Time{}, start.Add(4*time.Minute+30*time.Second))["a"]
+	want := []int{2, 0, 0, 1, 0}
+	if len(got) != len(want) {
+		t.Fatalf("Got %v samples, want %v", len(got), len(want))
+	}
+	for i, sample := range got {
+		if sample.Pixels != want[i] || !sample.Time.Equal(start.Add(time.Duration(i)*time.Minute)) {
+			t.Errorf("Sample %v is %v pixels at %v, want %v pixels", i, sample.Pixels, sample.Time, want[i])
+		}
+	}
+
+	// Samples older than the retention are dropped, and not returned
+	st.count(image.Point{1, 1}, start.Add(12*time.Minute))
+	if n := len(st.series["a"]); n != 2 {
+		t.Errorf("Got %v stored samples after the retention, want 2", n)
+	}
+	if got := st.getSeries(time.Time{}, start.Add(12*time.Minute)); len(got["a"]) != 10 {
+		t.Errorf("Got %v samples, want 10", len(got["a"]))
+	}
+}
+
+func Test_canvasStatisticsSettings(t *testing.T) {
+	tests := []struct {
+		settings canvasStatisticsSettings
+		wantErr  bool
+	}{
+		{canvasStatisticsSettings{}, false},
+		{canvasStatisticsSettings{Regions: map[string]image.Rectangle{"a": image.Rect(0, 0, 1, 1)}, Retention: "168h"}, false},
+		{canvasStatisticsSettings{Regions: map[string]image.Rectangle{"a": {}}}, true},
+		{canvasStatisticsSettings{Retention: "10s"}, true},
+		{canvasStatisticsSettings{Retention: "abc"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.settings.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v.validate() error = %v, wantErr %v", tt.settings, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Minimum time between two samples of the event counters, shorter intervals return the rates of the last sample
+const canvasStatsInterval = time.Second
+
+// Runtime statistics of a canvas, see canvas.stats
+type canvasStats struct {
+	PixelsPerSecond float64 `json:"pixelsPerSecond"` // Pixels that were set, since the last sample
+	EventsPerSecond float64 `json:"eventsPerSecond"` // Events that were sent to the broadcaster, since the last sample
+
+	ValidChunks       int `json:"validChunks"`
+	InvalidChunks     int `json:"invalidChunks"` // Without the downloading ones
+	DownloadingChunks int `json:"downloadingChunks"`
+
+	DownloadQueue int `json:"downloadQueue"` // Chunk download requests waiting for the game connection, including dropped ones that are retried
+	EventQueue    int `json:"eventQueue"`    // Events waiting for the broadcaster
+	Listeners     int `json:"listeners"`
+
+	OverflowedEvents     uint64 `json:"overflowedEvents"`
+	DroppedChunkRequests uint64 `json:"droppedChunkRequests"`
+}
+
+// Counters of a canvas, that the rates of canvasStats are computed from
+type canvasStatsCounters struct {
+	pixels, events uint64 // Accessed atomically
+
+	sync.Mutex
+	sampleTime           time.Time
+	samplePixels         uint64
+	sampleEvents         uint64
+	pixelRate, eventRate float64
+}
+
+// Counts an event that is sent to the broadcaster
+func (sc *canvasStatsCounters) count(e interface{}) {
+	atomic.AddUint64(&sc.events, 1)
+	switch event := e.(type) {
+	case canvasEventSetPixel:
+		atomic.AddUint64(&sc.pixels, 1)
+	case canvasEventSetPixels:
+		atomic.AddUint64(&sc.pixels, uint64(len(event.Pixels)))
+	}
+}
+
+// Returns the pixel and event rates since the last sample, and takes a new one if it's older than canvasStatsInterval
+func (sc *canvasStatsCounters) rates() (pixelRate, eventRate float64) {
+	sc.Lock()
+	defer sc.Unlock()
+
+	now := time.Now()
+	pixels, events := atomic.LoadUint64(&sc.pixels), atomic.LoadUint64(&sc.events)
+	if d := now.Sub(sc.sampleTime); d >= canvasStatsInterval {
+		if !sc.sampleTime.IsZero() {
+			sc.pixelRate = float64(pixels-sc.samplePixels) / d.Seconds()
+			sc.eventRate = float64(events-sc.sampleEvents) / d.Seconds()
+		}
+		sc.sampleTime, sc.samplePixels, sc.sampleEvents = now, pixels, events
+	}
+
+	return sc.pixelRate, sc.eventRate
+}
+
+// Returns the runtime statistics of the canvas.
+// The first call only starts sampling the rates, they are zero until the next call a canvasStatsInterval later.
+func (can *canvas) stats() canvasStats {
+	s := canvasStats{
+		EventQueue:           len(can.EventChan),
+		OverflowedEvents:     atomic.LoadUint64(&can.overflowedEvents),
+		DroppedChunkRequests: can.getDroppedChunkRequests(),
+	}
+	s.PixelsPerSecond, s.EventsPerSecond = can.counters.rates()
+
+	for _, chunk := range can.getAllChunks() {
+		switch valid, downloading := chunk.getState(); {
+		case valid:
+			s.ValidChunks++
+		case downloading:
+			s.DownloadingChunks++
+		default:
+			s.InvalidChunks++
+		}
+	}
+
+	can.retryMutex.Lock()
+	s.DownloadQueue = len(can.ChunkRequestChan) + len(can.retryChunks)
+	can.retryMutex.Unlock()
+
+	can.RLock()
+	s.Listeners = can.listeners
+	can.RUnlock()
+
+	return s
+}
@@ -0,0 +1,73 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+func Test_canvasStats(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	// One valid, one downloading and one invalid chunk
+	for i := 0; i < 3; i++ {
+		rect := image.Rect(i*64, 0, i*64+64, 64)
+		can.signalDownload(rect)
+		if i != 1 {
+			can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+		}
+		if i == 2 {
+			can.invalidateRect(rect)
+		}
+	}
+
+	listener := &testPixelsListener{}
+	if err := can.subscribeListener(listener, false); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+	defer can.unsubscribeListener(listener)
+
+	can.stats() // Start sampling
+	can.counters.Lock()
+	can.counters.sampleTime = can.counters.sampleTime.Add(-10 * time.Second)
+	can.counters.Unlock()
+	for i := 0; i < 100; i++ {
+		can.setPixel(image.Point{i % 64, i / 64}, pixelcanvasioPalette[5])
+	}
+
+	s := can.stats()
+	if s.ValidChunks != 1 || s.DownloadingChunks != 1 || s.InvalidChunks != 1 {
+		t.Errorf("Got %v valid, %v downloading and %v invalid chunks, want one of each", s.ValidChunks, s.DownloadingChunks, s.InvalidChunks)
+	}
+	if s.Listeners != 1 {
+		t.Errorf("Got %v listeners, want 1", s.Listeners)
+	}
+	if s.PixelsPerSecond <= 9 || s.PixelsPerSecond > 10 {
+		t.Errorf("Got %v pixels per second, want 100 pixels in a bit more than 10 seconds", s.PixelsPerSecond)
+	}
+	if s.EventsPerSecond < s.PixelsPerSecond {
+		t.Errorf("Got %v events per second, want at least the %v pixels per second", s.EventsPerSecond, s.PixelsPerSecond)
+	}
+
+	// Rates are kept until the next sample is due
+	if again := can.stats(); again.PixelsPerSecond != s.PixelsPerSecond {
+		t.Errorf("Got %v pixels per second right after the last sample, want the last rate %v", again.PixelsPerSecond, s.PixelsPerSecond)
+	}
+}
@@ -0,0 +1,457 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var streamLog = moduleLog("streams")
+
+// Settings of a canvas streamer, stored in the configuration at .streams.<shortName>
+type canvasStreamerSettings struct {
+	Rect      image.Rectangle // Canvas region that is streamed. Streaming is disabled if this is empty
+	FrameRate float64         // Frames per second. Defaults to 1
+	Upscale   int             // Integer scaling factor with nearest neighbor sampling. 0 or 1 keeps the original size
+	Overlay   exportOverlay   // Text that is drawn onto every frame
+
+	RTMPURL      string // Frames are encoded with ffmpeg and pushed to this RTMP endpoint, e.g. "rtmp://live.example.com/app/key"
+	MJPEGAddress string // Frames are served as MJPEG HTTP stream on this address, e.g. ":8080"
+	JPEGQuality  int    // Quality of the MJPEG frames from 1 to 100. Defaults to 90
+}
+
+// Continuously renders a region of a canvas, and streams it to RTMP endpoints or MJPEG clients.
+//
+// The MJPEG stream is available at /, and the most recent frame at /frame.jpg.
+// Chunks of the whole canvas can be requested as PNG tiles at /tiles/<x>/<y>.png.
+type canvasStreamer struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas    *canvas
+	ShortName string
+	TileCache *canvasTileCache
+
+	frameMutex sync.Mutex
+	frame      []byte        // Most recent JPEG encoded frame
+	frameChan  chan struct{} // Closed when a new frame is available
+
+	settingsChan chan canvasStreamerSettings
+	quitChan     chan struct{}
+	waitGroup    sync.WaitGroup
+}
+
+func (can *canvas) newCanvasStreamer(shortName string) (*canvasStreamer, error) {
+	re := regexp.MustCompile("[^a-zA-Z0-9\\-\\.]+")
+
+	cs := &canvasStreamer{
+		Canvas:       can,
+		ShortName:    re.ReplaceAllString(shortName, "_"),
+		frameChan:    make(chan struct{}),
+		settingsChan: make(chan canvasStreamerSettings),
+		quitChan:     make(chan struct{}),
+	}
+
+	tileCache, err := can.newCanvasTileCache(shortName)
+	if err != nil {
+		return nil, err
+	}
+	cs.TileCache = tileCache
+
+	// No events needed, the subscription only keeps the rectangles in sync
+	if err := can.subscribeListenerFiltered(cs, false, 0); err != nil {
+		tileCache.Close()
+		return nil, err
+	}
+
+	cs.waitGroup.Add(1)
+	go func() {
+		defer cs.waitGroup.Done()
+
+		settings := canvasStreamerSettings{}
+		var tickerChan <-chan time.Time
+		var ticker *time.Ticker
+		var server *http.Server
+		var ffmpeg *canvasStreamerFFmpeg
+		var ffmpegFailed time.Time // Time of the last ffmpeg failure, to limit restarts
+
+		stop := func() {
+			if ticker != nil {
+				ticker.Stop()
+				ticker, tickerChan = nil, nil
+			}
+			if server != nil {
+				server.Close()
+				server = nil
+			}
+			if ffmpeg != nil {
+				ffmpeg.Close()
+				ffmpeg = nil
+			}
+		}
+		defer stop()
+
+		for {
+			select {
+			case settings = <-cs.settingsChan:
+				stop()
+				if settings.Rect.Empty() || (settings.RTMPURL == "" && settings.MJPEGAddress == "") {
+					break
+				}
+				if settings.FrameRate <= 0 {
+					settings.FrameRate = 1
+				}
+				if settings.MJPEGAddress != "" {
+					var err error
+					if server, err = cs.serve(settings.MJPEGAddress); err != nil {
+						streamLog.Errorf("Can't start MJPEG stream of %v: %v", cs.ShortName, err)
+					}
+				}
+				ffmpegFailed = time.Time{}
+				ticker = time.NewTicker(time.Duration(float64(time.Second) / settings.FrameRate))
+				tickerChan = ticker.C
+			case t := <-tickerChan:
+				img, err := cs.renderFrame(settings, t)
+				if err != nil {
+					streamLog.Warnf("Can't render stream frame of %v at %v: %v", cs.ShortName, settings.Rect, err)
+					break
+				}
+				if server != nil {
+					if err := cs.publishFrame(img, settings.JPEGQuality); err != nil {
+						streamLog.Warnf("Can't encode stream frame of %v: %v", cs.ShortName, err)
+					}
+				}
+				if settings.RTMPURL != "" {
+					if ffmpeg != nil && !ffmpeg.writeFrame(img.Pix) {
+						streamLog.Warnf("ffmpeg stream of %v stopped: %v", cs.ShortName, ffmpeg.err())
+						ffmpeg.Close()
+						ffmpeg, ffmpegFailed = nil, t
+					}
+					if ffmpeg == nil && t.Sub(ffmpegFailed) >= 10*time.Second {
+						size := pixelSize{img.Rect.Dx(), img.Rect.Dy()}
+						if ffmpeg, err = startCanvasStreamerFFmpeg(settings.RTMPURL, size, settings.FrameRate); err != nil {
+							streamLog.Errorf("Can't start RTMP stream of %v: %v", cs.ShortName, err)
+							ffmpegFailed = t
+						}
+					}
+				}
+			case <-cs.quitChan:
+				return
+			}
+		}
+	}()
+
+	return cs, nil
+}
+
+// Changes the settings of the streamer.
+// The rectangle is registered at the canvas, so that it is kept up to date.
+func (cs *canvasStreamer) setSettings(settings canvasStreamerSettings) error {
+	cs.ClosedMutex.RLock()
+	defer cs.ClosedMutex.RUnlock()
+	if cs.Closed {
+		return fmt.Errorf("Streamer is closed")
+	}
+
+	rects := []image.Rectangle{}
+	if !settings.Rect.Empty() {
+		rects = append(rects, settings.Rect)
+	}
+	if err := cs.Canvas.registerRects(cs, rects); err != nil {
+		return err
+	}
+
+	cs.settingsChan <- settings
+
+	return nil
+}
+
+// Returns the current content of the streamed region, with upscaling and overlay applied
+func (cs *canvasStreamer) renderFrame(settings canvasStreamerSettings, t time.Time) (*image.RGBA, error) {
+	img, err := cs.Canvas.getImageCopy(settings.Rect, false, true)
+	if err != nil {
+		return nil, err
+	}
+	if settings.Upscale > 1 {
+		img = upscaleNearest(img, settings.Upscale).(*image.RGBA)
+	} else {
+		// Frames must start at 0, 0
+		img = &image.RGBA{Pix: img.Pix, Stride: img.Stride, Rect: img.Rect.Sub(img.Rect.Min)}
+	}
+	settings.Overlay.draw(img, t, settings.Rect, cs.ShortName)
+	return img, nil
+}
+
+// Encodes the frame as JPEG, and wakes up all waiting MJPEG clients
+func (cs *canvasStreamer) publishFrame(img image.Image, quality int) error {
+	if quality <= 0 {
+		quality = 90
+	}
+
+	// JPEG has no alpha, so areas without data become black
+	opaque := image.NewRGBA(img.Bounds())
+	draw.Draw(opaque, opaque.Rect, image.Black, image.Point{}, draw.Src)
+	draw.Draw(opaque, opaque.Rect, img, img.Bounds().Min, draw.Over)
+
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, opaque, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+
+	cs.frameMutex.Lock()
+	defer cs.frameMutex.Unlock()
+	cs.frame = buf.Bytes()
+	close(cs.frameChan)
+	cs.frameChan = make(chan struct{})
+
+	return nil
+}
+
+// Returns the most recent JPEG frame, and a channel that is closed when the next frame is available
+func (cs *canvasStreamer) getFrame() ([]byte, <-chan struct{}) {
+	cs.frameMutex.Lock()
+	defer cs.frameMutex.Unlock()
+	return cs.frame, cs.frameChan
+}
+
+// Starts a HTTP server on addr, that serves the published frames
+func (cs *canvasStreamer) serve(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", cs.serveMJPEG)
+	mux.HandleFunc("/frame.jpg", cs.serveJPEG)
+	mux.Handle("/tiles/", http.StripPrefix("/tiles", http.HandlerFunc(cs.TileCache.serveTile)))
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			streamLog.Errorf("MJPEG stream of %v failed: %v", cs.ShortName, err)
+		}
+	}()
+
+	return server, nil
+}
+
+// Writes every published frame as part of a multipart response, until the client disconnects or the streamer is closed
+func (cs *canvasStreamer) serveMJPEG(w http.ResponseWriter, r *http.Request) {
+	const boundary = "frame"
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Send the header right away, clients would wait for it otherwise
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		frame, nextChan := cs.getFrame()
+		if frame != nil {
+			if _, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", boundary, len(frame)); err != nil {
+				return
+			}
+			if _, err := w.Write(append(frame, "\r\n"...)); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		select {
+		case <-nextChan:
+		case <-r.Context().Done():
+			return
+		case <-cs.quitChan:
+			return
+		}
+	}
+}
+
+// Writes the most recent frame as a single JPEG image
+func (cs *canvasStreamer) serveJPEG(w http.ResponseWriter, r *http.Request) {
+	frame, _ := cs.getFrame()
+	if frame == nil {
+		http.Error(w, "No frame available yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(frame)
+}
+
+func (cs *canvasStreamer) handleInvalidateAll() error {
+	return nil
+}
+
+func (cs *canvasStreamer) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (cs *canvasStreamer) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (cs *canvasStreamer) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+
+func (cs *canvasStreamer) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	return nil
+}
+
+func (cs *canvasStreamer) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (cs *canvasStreamer) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (cs *canvasStreamer) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Close stops streaming, and unsubscribes from the canvas
+func (cs *canvasStreamer) Close() {
+	cs.ClosedMutex.Lock()
+	defer cs.ClosedMutex.Unlock()
+	if cs.Closed {
+		return
+	}
+	cs.Closed = true
+
+	cs.Canvas.unsubscribeListener(cs)
+
+	close(cs.quitChan)
+	cs.waitGroup.Wait()
+
+	cs.TileCache.Close()
+}
+
+// An ffmpeg process that encodes raw RGBA frames and pushes them to an RTMP endpoint
+type canvasStreamerFFmpeg struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr *bytes.Buffer
+
+	frameChan chan []byte
+	doneChan  chan struct{} // Closed when ffmpeg exited
+	waitErr   error
+}
+
+func startCanvasStreamerFFmpeg(url string, size pixelSize, frameRate float64) (*canvasStreamerFFmpeg, error) {
+	ffmpegPath, err := findFFmpeg()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"-loglevel", "error",
+		"-f", "rawvideo", "-pix_fmt", "rgba",
+		"-s", fmt.Sprintf("%dx%d", size.X, size.Y),
+		"-r", fmt.Sprintf("%g", frameRate),
+		"-i", "-",
+		"-vf", "pad=ceil(iw/2)*2:ceil(ih/2)*2", // yuv420p needs even dimensions
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-pix_fmt", "yuv420p",
+		"-g", fmt.Sprintf("%d", int(frameRate*2)+1), // Keyframe every 2 seconds, so viewers can join quickly
+		"-f", "flv", url,
+	}
+
+	f := &canvasStreamerFFmpeg{
+		cmd:       exec.Command(ffmpegPath, args...),
+		stderr:    &bytes.Buffer{},
+		frameChan: make(chan []byte, 1),
+		doneChan:  make(chan struct{}),
+	}
+	f.cmd.Stderr = f.stderr
+	if f.stdin, err = f.cmd.StdinPipe(); err != nil {
+		return nil, fmt.Errorf("Can't pipe into ffmpeg: %v", err)
+	}
+	if err := f.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Can't start ffmpeg: %v", err)
+	}
+
+	// Frames are written in a separate goroutine, so a slow connection doesn't block the streamer
+	go func() {
+		for pix := range f.frameChan {
+			if _, err := f.stdin.Write(pix); err != nil {
+				break
+			}
+		}
+		f.stdin.Close()
+		for range f.frameChan {
+		}
+	}()
+	go func() {
+		f.waitErr = f.cmd.Wait()
+		close(f.doneChan)
+	}()
+
+	return f, nil
+}
+
+// Queues a frame for encoding. Frames are dropped if ffmpeg can't keep up.
+// Returns false if ffmpeg has exited.
+func (f *canvasStreamerFFmpeg) writeFrame(pix []byte) bool {
+	select {
+	case <-f.doneChan:
+		return false
+	default:
+	}
+
+	select {
+	case f.frameChan <- pix:
+	default:
+	}
+	return true
+}
+
+// Returns the reason why ffmpeg exited
+func (f *canvasStreamerFFmpeg) err() error {
+	<-f.doneChan
+	return fmt.Errorf("%v: %v", f.waitErr, strings.TrimSpace(f.stderr.String()))
+}
+
+// Close stops ffmpeg after the queued frames are written
+func (f *canvasStreamerFFmpeg) Close() {
+	close(f.frameChan)
+	select {
+	case <-f.doneChan:
+	case <-time.After(5 * time.Second):
+		f.cmd.Process.Kill()
+		<-f.doneChan
+	}
+}
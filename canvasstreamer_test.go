@@ -0,0 +1,88 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"image"
+	"image/jpeg"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_canvasStreamer(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	if err := can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false); err != nil {
+		t.Fatalf("Can't set image at %v: %v", rect, err)
+	}
+
+	cs, err := can.newCanvasStreamer("Test-Streamer")
+	if err != nil {
+		t.Fatalf("Can't create streamer: %v", err)
+	}
+	defer cs.Close()
+
+	settings := canvasStreamerSettings{Rect: image.Rect(10, 10, 40, 30), Upscale: 2}
+	img, err := cs.renderFrame(settings, time.Now())
+	if err != nil {
+		t.Fatalf("Can't render frame: %v", err)
+	}
+	if want := image.Rect(0, 0, 60, 40); img.Rect != want {
+		t.Fatalf("Frame has bounds %v, want %v", img.Rect, want)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(cs.serveMJPEG))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Can't request stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" {
+		t.Fatalf("Stream has content type %q", resp.Header.Get("Content-Type"))
+	}
+	reader := multipart.NewReader(bufio.NewReader(resp.Body), params["boundary"])
+
+	// Every published frame is sent to the client
+	for i := 0; i < 2; i++ {
+		if err := cs.publishFrame(img, 0); err != nil {
+			t.Fatalf("Can't publish frame: %v", err)
+		}
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("Can't read part %v: %v", i, err)
+		}
+		frame, err := jpeg.Decode(part)
+		if err != nil {
+			t.Fatalf("Can't decode part %v: %v", i, err)
+		}
+		if frame.Bounds() != img.Rect {
+			t.Errorf("Part %v has bounds %v, want %v", i, frame.Bounds(), img.Rect)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+// State of a chunk at some point in time, as it is exchanged between instances to find differences
+type canvasSyncChecksum struct {
+	Rect     image.Rectangle
+	Valid    bool
+	Checksum uint32 // CRC-32 of the RGBA pixels
+}
+
+// Returns the checksums of all chunks that overlap rect, at the point in time t.
+// Chunks that don't exist at that time are left out.
+func canvasSyncChecksums(cfe *canvasFrameExtractor, rect image.Rectangle, t time.Time) ([]canvasSyncChecksum, error) {
+	if err := cfe.seek(t); err != nil {
+		return nil, err
+	}
+
+	chunkRect := cfe.Canvas.ChunkSize.getOuterChunkRect(rect, cfe.Canvas.Origin)
+	chunks, err := cfe.Canvas.getChunks(chunkRect, false, true)
+	if err != nil {
+		return nil, err
+	}
+
+	checksums := []canvasSyncChecksum{}
+	for _, chunk := range chunks {
+		img, valid, _, err := chunk.getImage(false)
+		if err != nil {
+			continue
+		}
+		// Palettes may differ in their order, so compare the colors
+		rgba := image.NewRGBA(chunk.Rect)
+		draw.Draw(rgba, rgba.Rect, img, rgba.Rect.Min, draw.Src)
+		img.release()
+		checksums = append(checksums, canvasSyncChecksum{Rect: chunk.Rect, Valid: valid, Checksum: crc32.ChecksumIEEE(rgba.Pix)})
+	}
+
+	return checksums, nil
+}
+
+// Serves /api/sync/<game>/checksums?rect=&time= and /api/sync/<game>/clip?rect=&start=&end=, see canvasSyncFromPeer.
+// Times are in RFC3339 format with optional fractional seconds.
+func (as *apiServer) serveSync(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/sync/"), "/")
+	if len(parts) != 2 || (parts[1] != "checksums" && parts[1] != "clip") {
+		http.NotFound(w, r)
+		return
+	}
+	shortName, endpoint := parts[0], parts[1]
+	query := r.URL.Query()
+
+	rect, err := parseRectangle(query.Get("rect"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rect.Dx()*rect.Dy() > canvasClipMaxPixels {
+		http.Error(w, fmt.Sprintf("Rectangle %v is larger than %v pixels", rect, canvasClipMaxPixels), http.StatusBadRequest)
+		return
+	}
+
+	switch endpoint {
+	case "checksums":
+		t, err := time.Parse(time.RFC3339Nano, query.Get("time"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid time: %v", err), http.StatusBadRequest)
+			return
+		}
+		cfe, err := newCanvasFrameExtractor(shortName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer cfe.Close()
+		checksums, err := canvasSyncChecksums(cfe, rect, t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		apiServerWriteJSON(w, checksums)
+
+	case "clip":
+		opts := exportOptions{Rect: rect}
+		if opts.StartTime, err = time.Parse(time.RFC3339Nano, query.Get("start")); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid start time: %v", err), http.StatusBadRequest)
+			return
+		}
+		if opts.EndTime, err = time.Parse(time.RFC3339Nano, query.Get("end")); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid end time: %v", err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := writeCanvasClip(w, shortName, opts, ""); err != nil {
+			// Only works if nothing was written yet
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// Another instance, whose recordings are used to fill gaps in the local recordings
+type canvasSyncPeer struct {
+	Address string // Address of the API server of the peer, e.g. "http://192.168.1.10:8081"
+	Token   string // API token of the peer, needs the read permission
+	Game    string // Short name of the game on the peer. Defaults to the local short name
+}
+
+// Requests an endpoint of the sync API of the peer
+func (peer canvasSyncPeer) get(shortName, endpoint string, query url.Values) (*http.Response, error) {
+	if peer.Game != "" {
+		shortName = peer.Game
+	}
+	u := strings.TrimSuffix(peer.Address, "/") + "/api/sync/" + url.PathEscape(shortName) + "/" + endpoint + "?" + query.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if peer.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+peer.Token)
+	}
+
+	r, err := recordingHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != http.StatusOK {
+		defer r.Body.Close()
+		message, _ := ioutil.ReadAll(r.Body)
+		return nil, fmt.Errorf("Peer answered with %q: %v", r.Status, strings.TrimSpace(string(message)))
+	}
+
+	return r, nil
+}
+
+// Result of canvasSyncFromPeer
+type canvasSyncResult struct {
+	Chunks   int    // Number of chunks the peer has data for
+	Missing  int    // Number of chunks that were missing or different locally, and were taken from the peer
+	Events   int    // Number of events that were taken from the peer
+	FileName string // The written recording, empty if nothing was missing
+}
+
+// Fills the gap from start to end in the local recordings of shortName with the recordings of the peer, e.g. after an outage of the local recorder.
+//
+// The checksums of the chunks inside of rect at the end of the gap are compared first.
+// Chunks that are valid at the peer, but invalid or different locally, are transferred as clip and written into a new local recording that starts at start.
+//
+// If end is zero, the gap ends where the next local recording starts.
+// Only gaps without any local events other than invalidations can be filled, so recorded data is never replaced.
+func canvasSyncFromPeer(peer canvasSyncPeer, shortName string, rect image.Rectangle, start, end time.Time) (canvasSyncResult, error) {
+	result := canvasSyncResult{}
+
+	cdr := canvasDiskReaderFor(shortName)
+	if _, ok := cdr.Storage.(recordingStorageLocal); !ok {
+		return result, fmt.Errorf("Only local recordings can be synchronized")
+	}
+	recs, err := cdr.refreshRecordings()
+	if err != nil {
+		return result, err
+	}
+
+	// Check that the time range is a gap in the local recordings
+	for _, rec := range recs {
+		if rec.StartTime.After(start) {
+			if end.IsZero() {
+				end = rec.StartTime
+			} else if rec.StartTime.Before(end) {
+				return result, fmt.Errorf("Local recording %v starts inside of the gap", rec.FileName)
+			}
+		}
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	if !start.Before(end) {
+		return result, fmt.Errorf("Start time %v is not before end time %v", start, end)
+	}
+	err = canvasDiskReaderForEachEvent(recs, start, end, func(t time.Time, event interface{}) error {
+		switch event.(type) {
+		case canvasEventInvalidateAll, canvasEventInvalidateRect:
+			return nil
+		}
+		return fmt.Errorf("Local recordings contain events at %v, only gaps without events can be filled", t)
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// Compare the state of the chunks right before the gap ends
+	checkTime := end.Add(-1)
+	local := map[image.Rectangle]canvasSyncChecksum{}
+	if len(recs) > 0 {
+		cfe, err := newCanvasFrameExtractor(shortName)
+		if err != nil {
+			return result, err
+		}
+		checksums, err := canvasSyncChecksums(cfe, rect, checkTime)
+		cfe.Close()
+		if err != nil {
+			return result, err
+		}
+		for _, c := range checksums {
+			local[c.Rect] = c
+		}
+	}
+
+	r, err := peer.get(shortName, "checksums", url.Values{
+		"rect": {fmt.Sprintf("%d,%d,%d,%d", rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y)},
+		"time": {checkTime.UTC().Format(time.RFC3339Nano)},
+	})
+	if err != nil {
+		return result, fmt.Errorf("Can't get checksums from peer: %v", err)
+	}
+	remote := []canvasSyncChecksum{}
+	err = json.NewDecoder(r.Body).Decode(&remote)
+	r.Body.Close()
+	if err != nil {
+		return result, fmt.Errorf("Can't read checksums from peer: %v", err)
+	}
+
+	missing := []image.Rectangle{}
+	area := image.Rectangle{}
+	for _, c := range remote {
+		if !c.Valid {
+			continue
+		}
+		result.Chunks++
+		if l, ok := local[c.Rect]; ok && l.Valid && l.Checksum == c.Checksum {
+			continue
+		}
+		missing = append(missing, c.Rect)
+		area = area.Union(c.Rect)
+	}
+	result.Missing = len(missing)
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	// Get the events of the missing chunks as clip
+	r, err = peer.get(shortName, "clip", url.Values{
+		"rect":  {fmt.Sprintf("%d,%d,%d,%d", area.Min.X, area.Min.Y, area.Max.X, area.Max.Y)},
+		"start": {start.UTC().Format(time.RFC3339Nano)},
+		"end":   {end.UTC().Format(time.RFC3339Nano)},
+	})
+	if err != nil {
+		return result, fmt.Errorf("Can't get events from peer: %v", err)
+	}
+	defer r.Body.Close()
+	clip, err := recording.NewReader(r.Body)
+	if err != nil {
+		return result, fmt.Errorf("Can't read events from peer: %v", err)
+	}
+	defer clip.Close()
+	if len(recs) > 0 && (pixelSize(clip.ChunkSize) != cdr.ChunkSize || clip.Origin != cdr.ChunkOrigin) {
+		return result, fmt.Errorf("Chunk size or origin of the peer differs from the local recordings")
+	}
+
+	// Write the missing chunks into a new recording, that ends with the gap
+	fileDirectory := dataPath(getPaths().Recordings, shortName)
+	os.MkdirAll(fileDirectory, 0777)
+	result.FileName = filepath.Join(fileDirectory, start.UTC().Format("2006-01-02T150405")+".pixrec")
+	file, err := os.OpenFile(result.FileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return result, fmt.Errorf("Can't create recording: %v", err)
+	}
+	defer file.Close()
+	writer, err := recording.NewWriter(file, shortName, recording.Header{Time: start, ChunkSize: clip.ChunkSize, Origin: clip.Origin, Authors: clip.Authors})
+	if err != nil {
+		return result, err
+	}
+
+	err = func() error {
+		for {
+			t, event, err := clip.Next()
+			if err == io.EOF {
+				return writer.WriteEvent(end, recording.InvalidateAll{})
+			}
+			if err != nil {
+				return fmt.Errorf("Can't read events from peer: %v", err)
+			}
+			for _, e := range canvasSyncFilterEvent(event, missing) {
+				result.Events++
+				if err := writer.WriteEvent(t, e); err != nil {
+					return err
+				}
+			}
+		}
+	}()
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		writer.Close()
+		file.Close()
+		os.Remove(result.FileName)
+		return result, err
+	}
+
+	return result, nil
+}
+
+// Returns the parts of a recording.* event that are inside of the given chunk rectangles
+func canvasSyncFilterEvent(event interface{}, chunks []image.Rectangle) []interface{} {
+	events := []interface{}{}
+
+	switch event := event.(type) {
+	case recording.SetPixel:
+		for _, chunk := range chunks {
+			if event.Pos.In(chunk) {
+				events = append(events, event)
+				break
+			}
+		}
+	case recording.SetImage:
+		for _, chunk := range chunks {
+			if event.Image.Bounds().In(chunk) {
+				events = append(events, event)
+				break
+			}
+		}
+	case recording.InvalidateRect:
+		for _, chunk := range chunks {
+			if rect := event.Rect.Intersect(chunk); !rect.Empty() {
+				events = append(events, recording.InvalidateRect{Rect: rect})
+			}
+		}
+	case recording.RevalidateRect:
+		for _, chunk := range chunks {
+			if rect := event.Rect.Intersect(chunk); !rect.Empty() {
+				events = append(events, recording.RevalidateRect{Rect: rect})
+			}
+		}
+	case recording.InvalidateAll:
+		for _, chunk := range chunks {
+			events = append(events, recording.InvalidateRect{Rect: chunk})
+		}
+	}
+
+	return events
+}
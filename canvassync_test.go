@@ -0,0 +1,104 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+func Test_canvasSyncFromPeer(t *testing.T) {
+	// The local recording ends, and the gap starts in the next second, so the file name of the backfill differs
+	writeTestRecording(t, "Test-Sync")
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	start := time.Now()
+	rect, pos, _ := writeTestRecording(t, "Test-SyncPeer")
+
+	// Let the gap end before the recording of the peer was closed and invalidated
+	cfe, err := newCanvasFrameExtractor("Test-SyncPeer")
+	if err != nil {
+		t.Fatalf("Can't create frame extractor: %v", err)
+	}
+	var end time.Time
+	canvasDiskReaderForEachEvent(cfe.Recordings, start, time.Now(), func(t time.Time, event interface{}) error {
+		if _, ok := event.(canvasEventSetPixel); ok {
+			end = t.Add(1)
+		}
+		return nil
+	})
+	cfe.Close()
+
+	as := newAPIServer()
+	defer as.Close()
+	server := httptest.NewServer(as.handler())
+	defer server.Close()
+	peer := canvasSyncPeer{Address: server.URL, Game: "Test-SyncPeer"}
+
+	result, err := canvasSyncFromPeer(peer, "Test-Sync", image.Rect(0, 0, 8, 8), start, end)
+	if err != nil {
+		t.Fatalf("Can't sync: %v", err)
+	}
+	if result.Chunks != 1 || result.Missing != 1 || result.FileName == "" {
+		t.Fatalf("Got result %+v, want one missing chunk", result)
+	}
+
+	cfe, err = newCanvasFrameExtractor("Test-Sync")
+	if err != nil {
+		t.Fatalf("Can't create frame extractor: %v", err)
+	}
+	defer cfe.Close()
+	if len(cfe.Recordings) != 2 || cfe.Recordings[1].FileName != result.FileName {
+		t.Fatalf("Backfill isn't the second recording: %+v", cfe.Recordings)
+	}
+	img, err := cfe.getFrame(end.Add(-1), rect)
+	if err != nil {
+		t.Fatalf("Can't get frame: %v", err)
+	}
+	if got, want := img.At(pos.X, pos.Y), color.RGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+		t.Errorf("Pixel at %v = %v, want %v", pos, got, want)
+	}
+
+	// The gap is filled now
+	if _, err := canvasSyncFromPeer(peer, "Test-Sync", image.Rect(0, 0, 8, 8), start, end); err == nil {
+		t.Errorf("Synchronizing the same gap twice didn't fail")
+	}
+	os.Remove(result.FileName)
+}
+
+func Test_canvasSyncFilterEvent(t *testing.T) {
+	chunks := []image.Rectangle{image.Rect(0, 0, 64, 64), image.Rect(128, 0, 192, 64)}
+
+	if got := len(canvasSyncFilterEvent(recording.SetPixel{Pos: image.Point{70, 10}}, chunks)); got != 0 {
+		t.Errorf("Pixel outside of the chunks resulted in %v events", got)
+	}
+	if got := len(canvasSyncFilterEvent(recording.SetPixel{Pos: image.Point{130, 10}}, chunks)); got != 1 {
+		t.Errorf("Pixel inside of a chunk resulted in %v events", got)
+	}
+	if got := len(canvasSyncFilterEvent(recording.InvalidateAll{}, chunks)); got != 2 {
+		t.Errorf("Invalidation of everything resulted in %v events, want one per chunk", got)
+	}
+	events := canvasSyncFilterEvent(recording.InvalidateRect{Rect: image.Rect(32, 0, 160, 10)}, chunks)
+	if len(events) != 2 || events[0] != (recording.InvalidateRect{Rect: image.Rect(32, 0, 64, 10)}) || events[1] != (recording.InvalidateRect{Rect: image.Rect(128, 0, 160, 10)}) {
+		t.Errorf("Got invalidations %v, want them cut to the chunks", events)
+	}
+}
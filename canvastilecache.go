@@ -0,0 +1,216 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Keeps PNG encoded images of the chunks of a live canvas, so viewers can request them without encoding them every time.
+//
+// Tiles are invalidated when canvas events touch their chunk, and are rendered again when they are requested the next time.
+// The encoded tiles are stored in tiles/<shortName>, and are reused after a restart if their pixels didn't change.
+// The cache doesn't register any rectangles, it only shows what other listeners keep up to date.
+type canvasTileCache struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas    *canvas
+	ShortName string
+	Cache     *tileCache
+
+	tilesMutex sync.Mutex
+	tiles      map[chunkCoordinate][]byte // Encoded tiles that are up to date with the canvas
+	version    uint64                     // Incremented with every invalidation
+}
+
+func (can *canvas) newCanvasTileCache(shortName string) (*canvasTileCache, error) {
+	re := regexp.MustCompile("[^a-zA-Z0-9\\-\\.]+")
+	shortName = re.ReplaceAllString(shortName, "_")
+
+	cache, err := newTileCache(cachePath(getPaths().Tiles, shortName), png.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	ctc := &canvasTileCache{
+		Canvas:    can,
+		ShortName: shortName,
+		Cache:     cache,
+		tiles:     map[chunkCoordinate][]byte{},
+	}
+
+	if err := can.subscribeListenerFiltered(ctc, false, canvasEventMaskPixels|canvasEventMaskImages|canvasEventMaskValidity); err != nil {
+		return nil, err
+	}
+
+	return ctc, nil
+}
+
+// Returns the PNG encoded image of the chunk at the given chunk coordinate.
+// Areas without data are transparent.
+func (ctc *canvasTileCache) getTile(coord chunkCoordinate) ([]byte, error) {
+	ctc.tilesMutex.Lock()
+	data, ok := ctc.tiles[coord]
+	version := ctc.version
+	ctc.tilesMutex.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	rect := chunkRectangle{image.Rectangle{image.Point(coord), image.Point(coord).Add(image.Point{1, 1})}}.getPixelRectangle(ctc.Canvas.ChunkSize, ctc.Canvas.Origin)
+	img, err := ctc.Canvas.getImageCopy(rect, false, true)
+	if err != nil {
+		return nil, err
+	}
+	tile := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(tile, tile.Rect, img, rect.Min, draw.Src)
+
+	key := fmt.Sprintf("%d_%d", coord.X, coord.Y)
+	if _, err := ctc.Cache.put(key, tile); err != nil {
+		return nil, err
+	}
+	if data, err = ctc.Cache.get(key); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		// Empty tiles are not stored, encode them every time. They are small anyway
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, tile); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+
+	// Only keep the tile, if nothing was invalidated while it was rendered
+	ctc.tilesMutex.Lock()
+	if ctc.version == version {
+		ctc.tiles[coord] = data
+	}
+	ctc.tilesMutex.Unlock()
+
+	return data, nil
+}
+
+// Serves tiles requested as /<x>/<y>.png, where x and y are chunk coordinates.
+// Any prefix needs to be stripped beforehand.
+func (ctc *canvasTileCache) serveTile(w http.ResponseWriter, r *http.Request) {
+	var coord chunkCoordinate
+	if _, err := fmt.Sscanf(r.URL.Path, "/%d/%d.png", &coord.X, &coord.Y); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := ctc.getTile(coord)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
+
+// Removes all tiles that intersect with rect
+func (ctc *canvasTileCache) invalidate(rect image.Rectangle) {
+	chunkRect := ctc.Canvas.ChunkSize.getOuterChunkRect(rect, ctc.Canvas.Origin)
+
+	ctc.tilesMutex.Lock()
+	defer ctc.tilesMutex.Unlock()
+
+	ctc.version++
+	if chunkRect.Dx()*chunkRect.Dy() > len(ctc.tiles) {
+		for coord := range ctc.tiles {
+			if image.Point(coord).In(chunkRect.Rectangle) {
+				delete(ctc.tiles, coord)
+			}
+		}
+		return
+	}
+	for y := chunkRect.Min.Y; y < chunkRect.Max.Y; y++ {
+		for x := chunkRect.Min.X; x < chunkRect.Max.X; x++ {
+			delete(ctc.tiles, chunkCoordinate{x, y})
+		}
+	}
+}
+
+func (ctc *canvasTileCache) handleInvalidateAll() error {
+	ctc.tilesMutex.Lock()
+	defer ctc.tilesMutex.Unlock()
+
+	ctc.version++
+	ctc.tiles = map[chunkCoordinate][]byte{}
+	return nil
+}
+
+func (ctc *canvasTileCache) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	ctc.invalidate(rect)
+	return nil
+}
+
+func (ctc *canvasTileCache) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	ctc.invalidate(rect)
+	return nil
+}
+
+func (ctc *canvasTileCache) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	ctc.invalidate(img.Bounds())
+	return nil
+}
+
+func (ctc *canvasTileCache) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	ctc.invalidate(image.Rectangle{pos, pos.Add(image.Point{1, 1})})
+	return nil
+}
+
+func (ctc *canvasTileCache) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (ctc *canvasTileCache) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (ctc *canvasTileCache) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Close unsubscribes from the canvas, and stores the tile cache index
+func (ctc *canvasTileCache) Close() {
+	ctc.ClosedMutex.Lock()
+	defer ctc.ClosedMutex.Unlock()
+	if ctc.Closed {
+		return
+	}
+	ctc.Closed = true
+
+	ctc.Canvas.unsubscribeListener(ctc)
+
+	if err := ctc.Cache.saveIndex(); err != nil {
+		tileLog.Warnf("Can't save tile cache of %v: %v", ctc.ShortName, err)
+	}
+}
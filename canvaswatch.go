@@ -0,0 +1,500 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+var watchLog = moduleLog("watch")
+
+// Number of alerts of each game that are kept, for the alerts method of the control socket
+const canvasWatcherHistory = 100
+
+// Maximum number of alerts that wait for their notifications. Further alerts are only logged
+const canvasWatcherQueueSize = 100
+
+// Length of the intervals whose pixel rates are compared against the baseline
+const canvasWatchAnomalyInterval = time.Minute
+
+// Defaults of the anomaly detection, if the settings don't say otherwise
+const (
+	canvasWatchAnomalyBaseline = time.Hour        // Duration that the baseline averages over
+	canvasWatchAnomalyCooldown = 15 * time.Minute // Used if the region has no window
+	canvasWatchAnomalyWarmup   = 10               // Number of intervals that are needed for a baseline
+)
+
+// Settings of the region watches of a game, stored in the configuration at .watches.<game>
+type canvasWatchSettings struct {
+	Regions  map[string]canvasWatchRegion // Watched regions by their name
+	Webhooks []string                     // URLs that every alert is sent to as JSON POST request
+}
+
+// A watched region, and the thresholds of its alerts
+type canvasWatchRegion struct {
+	Rect      image.Rectangle
+	Pixels    int     // An alert is triggered when more than this many pixels are set inside of Rect...
+	Window    string  // ...within this duration, e.g. "5m". Empty disables the fixed threshold
+	Deviation float64 // An alert is triggered when the pixels of a minute exceed the baseline by this many standard deviations, e.g. 4. 0 disables it
+	Baseline  string  // Duration that the baseline averages over, e.g. "2h". Defaults to 1 hour
+	Cooldown  string  // Minimum time between two alerts of the region, e.g. "30m". Defaults to Window, or 15 minutes
+	Snapshot  bool    // Write a PNG of Rect with every alert into snapshots/<game>/watch-<name>/
+}
+
+func (s canvasWatchSettings) validate() error {
+	for name, region := range s.Regions {
+		if region.Rect.Empty() {
+			return fmt.Errorf("Region %q is empty", name)
+		}
+		if region.Pixels < 0 {
+			return fmt.Errorf("Region %q has a negative number of pixels", name)
+		}
+		if region.Window == "" && region.Deviation == 0 {
+			return fmt.Errorf("Region %q needs a window or a deviation", name)
+		}
+		if region.Window != "" {
+			if d, err := time.ParseDuration(region.Window); err != nil || d <= 0 {
+				return fmt.Errorf("Region %q has the invalid window %q", name, region.Window)
+			}
+		}
+		if region.Deviation < 0 {
+			return fmt.Errorf("Region %q has a negative deviation", name)
+		}
+		if region.Baseline != "" {
+			if d, err := time.ParseDuration(region.Baseline); err != nil || d < canvasWatchAnomalyWarmup*canvasWatchAnomalyInterval {
+				return fmt.Errorf("Region %q has the invalid baseline %q, it must be at least %v", name, region.Baseline, canvasWatchAnomalyWarmup*canvasWatchAnomalyInterval)
+			}
+		}
+		if region.Cooldown != "" {
+			if d, err := time.ParseDuration(region.Cooldown); err != nil || d < 0 {
+				return fmt.Errorf("Region %q has the invalid cooldown %q", name, region.Cooldown)
+			}
+		}
+	}
+	for _, url := range s.Webhooks {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return fmt.Errorf("Webhook %q must be a HTTP or HTTPS URL", url)
+		}
+	}
+	return nil
+}
+
+// Sent to the webhooks, and returned by the alerts method of the control socket
+type canvasWatchAlert struct {
+	Game     string
+	Region   string
+	Kind     string // "threshold" if more than Pixels were set within Window, "anomaly" if the rate deviates from the baseline
+	Rect     image.Rectangle
+	Pixels   int     // Number of pixels that were set inside of Rect within Window
+	Window   string  // Window of the region, or the interval of anomalies
+	Baseline float64 `json:",omitempty"` // Average number of pixels per interval, for anomalies
+	Time     time.Time
+	Snapshot string `json:",omitempty"` // File name of the snapshot, if the region has one
+}
+
+// State of a watched region
+type canvasWatchState struct {
+	canvasWatchRegion
+	window, cooldown time.Duration
+	times            []time.Time // Times of the latest set pixels, at most Pixels+1
+	lastAlert        time.Time
+
+	// Exponentially weighted average and variance of the pixels per interval
+	alpha          float64
+	mean, variance float64
+	samples        int       // Number of intervals in the baseline
+	interval       time.Time // Start of the current interval
+	intervalPixels int       // Pixels of the current interval
+}
+
+// Watches regions of a canvas, and sends alerts when more pixels than allowed are set within some time,
+// or when the pixels per minute deviate strongly from their usual rate.
+//
+// It's opened together with the game connection, so it watches whether or not a recording or bot is running.
+// Alerts are logged, sent to the webhooks, and optionally captured as snapshot.
+type canvasWatcher struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas    *canvas
+	ShortName string
+
+	sync.Mutex
+	regions  map[string]*canvasWatchState
+	webhooks []string
+	alerts   []canvasWatchAlert // Latest alerts, oldest first
+
+	alertChan chan canvasWatchAlert // Alerts that wait for their snapshot and notifications
+	waitGroup sync.WaitGroup
+
+	config     *configdb.Config
+	callbackID int
+}
+
+var canvasWatcherGames = struct {
+	sync.Mutex
+	games map[string]*canvasWatcher
+}{
+	games: map[string]*canvasWatcher{},
+}
+
+// Starts watching the canvas of the given game.
+//
+// The settings are read from c and applied when they change. If c is nil, there are no regions until setSettings is called.
+func (can *canvas) newCanvasWatcher(c *configdb.Config, shortName string) (*canvasWatcher, error) {
+	cw := &canvasWatcher{
+		Canvas:    can,
+		ShortName: shortName,
+		regions:   map[string]*canvasWatchState{},
+		alertChan: make(chan canvasWatchAlert, canvasWatcherQueueSize),
+		config:    c,
+	}
+
+	if err := can.subscribeListenerFiltered(cw, false, canvasEventMaskPixels); err != nil {
+		return nil, err
+	}
+
+	cw.waitGroup.Add(1)
+	go func() {
+		defer cw.waitGroup.Done()
+		for alert := range cw.alertChan {
+			cw.notify(alert)
+		}
+	}()
+
+	canvasWatcherGames.Lock()
+	canvasWatcherGames.games[shortName] = cw
+	canvasWatcherGames.Unlock()
+
+	if c != nil {
+		cw.callbackID = c.RegisterCallback([]string{".watches." + shortName}, func(c *configdb.Config, modified, added, removed []string) {
+			settings := canvasWatchSettings{}
+			c.Get(".watches."+shortName, &settings)
+			if err := settings.validate(); err != nil {
+				log.Errorf("Invalid settings at .watches.%v, not watching any region: %v", shortName, err)
+				settings = canvasWatchSettings{}
+			}
+			cw.setSettings(settings)
+		})
+	}
+
+	return cw, nil
+}
+
+// Returns the latest alerts of all games, or of a single game if shortName isn't empty. Sorted by time
+func getCanvasWatchAlerts(shortName string) []canvasWatchAlert {
+	canvasWatcherGames.Lock()
+	defer canvasWatcherGames.Unlock()
+
+	alerts := []canvasWatchAlert{}
+	for name, cw := range canvasWatcherGames.games {
+		if shortName != "" && name != shortName {
+			continue
+		}
+		cw.Lock()
+		alerts = append(alerts, cw.alerts...)
+		cw.Unlock()
+	}
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].Time.Before(alerts[j].Time) })
+
+	return alerts
+}
+
+// Changes the watched regions. Regions that keep their name and settings keep their state
+func (cw *canvasWatcher) setSettings(settings canvasWatchSettings) error {
+	cw.ClosedMutex.RLock()
+	defer cw.ClosedMutex.RUnlock()
+	if cw.Closed {
+		return fmt.Errorf("Watcher is closed")
+	}
+
+	rects := []image.Rectangle{}
+	cw.Lock()
+	regions := map[string]*canvasWatchState{}
+	for name, region := range settings.Regions {
+		if old, ok := cw.regions[name]; ok && old.canvasWatchRegion == region {
+			regions[name] = old
+		} else {
+			regions[name] = newCanvasWatchState(region, time.Now())
+		}
+		rects = append(rects, region.Rect)
+	}
+	cw.regions, cw.webhooks = regions, append([]string{}, settings.Webhooks...)
+	cw.Unlock()
+
+	return cw.Canvas.registerRects(cw, rects)
+}
+
+// Parses the settings of a region into a new state, whose baseline starts at now
+func newCanvasWatchState(region canvasWatchRegion, now time.Time) *canvasWatchState {
+	state := &canvasWatchState{canvasWatchRegion: region, interval: now.Truncate(canvasWatchAnomalyInterval)}
+	state.window, _ = time.ParseDuration(region.Window)
+
+	state.cooldown = state.window
+	if region.Cooldown != "" {
+		state.cooldown, _ = time.ParseDuration(region.Cooldown)
+	} else if state.window == 0 {
+		state.cooldown = canvasWatchAnomalyCooldown
+	}
+
+	baseline := canvasWatchAnomalyBaseline
+	if d, err := time.ParseDuration(region.Baseline); err == nil && d >= canvasWatchAnomalyWarmup*canvasWatchAnomalyInterval {
+		baseline = d
+	}
+	state.alpha = float64(canvasWatchAnomalyInterval) / float64(baseline)
+
+	return state
+}
+
+// Moves the current interval forward to the one of t, and adds the finished intervals to the baseline.
+// Intervals without any pixels are added with a count of 0
+func (state *canvasWatchState) advance(t time.Time) {
+	t = t.Truncate(canvasWatchAnomalyInterval)
+	for i := 0; state.interval.Before(t); i++ {
+		// After a long gap, the baseline is mostly made of the empty intervals anyway
+		if i > int(1/state.alpha) {
+			state.interval = t
+			break
+		}
+		// The first intervals are weighted more, so the baseline doesn't start at 0
+		alpha := math.Max(state.alpha, 1/float64(state.samples+1))
+		diff := float64(state.intervalPixels) - state.mean
+		increment := alpha * diff
+		state.mean += increment
+		state.variance = (1 - alpha) * (state.variance + diff*increment)
+		state.samples++
+		state.interval, state.intervalPixels = state.interval.Add(canvasWatchAnomalyInterval), 0
+	}
+}
+
+// Returns whether the pixels of the current interval deviate from the baseline by more than the allowed standard deviations.
+// Rare pixels in quiet regions are not an anomaly, so the standard deviation is at least that of a Poisson process, and at least 1
+func (state *canvasWatchState) isAnomaly() bool {
+	if state.Deviation <= 0 || state.samples < canvasWatchAnomalyWarmup {
+		return false
+	}
+	deviation := math.Max(math.Sqrt(state.variance), math.Max(math.Sqrt(state.mean), 1))
+	return float64(state.intervalPixels) > state.mean+state.Deviation*deviation
+}
+
+// Counts a pixel that was set at the given time, and returns the alerts it triggered. The lock must be held
+func (cw *canvasWatcher) count(pos image.Point, t time.Time) []canvasWatchAlert {
+	var alerts []canvasWatchAlert
+	for name, state := range cw.regions {
+		if !pos.In(state.Rect) {
+			continue
+		}
+
+		alert := canvasWatchAlert{Game: cw.ShortName, Region: name, Rect: state.Rect, Time: t}
+
+		if state.window > 0 {
+			// Keep only the times inside of the window, and not more than needed to exceed the threshold
+			times := append(state.times, t)
+			cut := 0
+			for cut < len(times) && (t.Sub(times[cut]) >= state.window || len(times)-cut > state.Pixels+1) {
+				cut++
+			}
+			state.times = append(times[:0], times[cut:]...)
+			if len(state.times) > state.Pixels {
+				alert.Kind, alert.Pixels, alert.Window = "threshold", len(state.times), state.Window
+			}
+		}
+
+		if state.Deviation > 0 {
+			state.advance(t)
+			state.intervalPixels++
+			if alert.Kind == "" && state.isAnomaly() {
+				alert.Kind, alert.Pixels, alert.Window, alert.Baseline = "anomaly", state.intervalPixels, canvasWatchAnomalyInterval.String(), state.mean
+			}
+		}
+
+		if alert.Kind == "" || (!state.lastAlert.IsZero() && t.Sub(state.lastAlert) < state.cooldown) {
+			continue
+		}
+		state.lastAlert = t
+		alerts = append(alerts, alert)
+	}
+
+	return alerts
+}
+
+// Queues alerts for their notifications, without blocking the canvas
+func (cw *canvasWatcher) queue(alerts []canvasWatchAlert) {
+	for _, alert := range alerts {
+		select {
+		case cw.alertChan <- alert:
+		default:
+			watchLog.Warnf("Too many alerts of %v, dropped the alert for region %q at %v", cw.ShortName, alert.Region, alert.Time)
+		}
+	}
+}
+
+// Takes the snapshot of an alert, logs it and sends it to the webhooks
+func (cw *canvasWatcher) notify(alert canvasWatchAlert) {
+	cw.Lock()
+	state, snapshot := cw.regions[alert.Region], false
+	if state != nil {
+		snapshot = state.Snapshot
+	}
+	webhooks := cw.webhooks
+	cw.Unlock()
+
+	if snapshot {
+		fileName, err := cw.takeSnapshot(alert)
+		if err != nil {
+			watchLog.Warnf("Can't take snapshot of region %q of %v: %v", alert.Region, cw.ShortName, err)
+		}
+		alert.Snapshot = fileName
+	}
+
+	if alert.Kind == "anomaly" {
+		watchLog.Warnf("Alert for region %q of %v: %v pixels were set within %v, the baseline is %.1f", alert.Region, cw.ShortName, alert.Pixels, alert.Window, alert.Baseline)
+	} else {
+		watchLog.Warnf("Alert for region %q of %v: %v pixels were set within %v", alert.Region, cw.ShortName, alert.Pixels, alert.Window)
+	}
+
+	cw.Lock()
+	cw.alerts = append(cw.alerts, alert)
+	if len(cw.alerts) > canvasWatcherHistory {
+		cw.alerts = cw.alerts[len(cw.alerts)-canvasWatcherHistory:]
+	}
+	cw.Unlock()
+
+	for _, url := range webhooks {
+		statusCode, _, _, err := postJSON(url, "", alert)
+		if err == nil && statusCode >= 300 {
+			err = fmt.Errorf("Got status code %v", statusCode)
+		}
+		if err != nil {
+			watchLog.Warnf("Can't send alert to webhook %v: %v", url, err)
+		}
+	}
+}
+
+// Writes the current content of the region of the alert into a PNG file, and returns its name
+func (cw *canvasWatcher) takeSnapshot(alert canvasWatchAlert) (string, error) {
+	rgba, err := cw.Canvas.getImageCopy(alert.Rect, false, true)
+	if err != nil {
+		return "", err
+	}
+
+	re := regexp.MustCompile("[^a-zA-Z0-9\\-\\.]+")
+	dir := dataPath(getPaths().Snapshots, re.ReplaceAllString(cw.ShortName, "_"), "watch-"+re.ReplaceAllString(alert.Region, "_"))
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", fmt.Errorf("Can't create directory %v: %v", dir, err)
+	}
+
+	fileName := filepath.Join(dir, alert.Time.UTC().Format(canvasSnapshotterTimeFormat)+".png")
+	f, err := os.Create(fileName)
+	if err != nil {
+		return "", fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, rgba); err != nil {
+		return "", fmt.Errorf("Can't encode %v: %v", fileName, err)
+	}
+
+	return fileName, nil
+}
+
+func (cw *canvasWatcher) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	cw.Lock()
+	alerts := cw.count(pos, time.Now())
+	cw.Unlock()
+
+	cw.queue(alerts)
+	return nil
+}
+
+func (cw *canvasWatcher) handleSetPixels(pixels []canvasListenerPixel) error {
+	cw.Lock()
+	t, alerts := time.Now(), []canvasWatchAlert{}
+	for _, pixel := range pixels {
+		alerts = append(alerts, cw.count(pixel.Pos, t)...)
+	}
+	cw.Unlock()
+
+	cw.queue(alerts)
+	return nil
+}
+
+func (cw *canvasWatcher) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (cw *canvasWatcher) handleInvalidateAll() error {
+	return nil
+}
+
+func (cw *canvasWatcher) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (cw *canvasWatcher) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+
+func (cw *canvasWatcher) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (cw *canvasWatcher) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (cw *canvasWatcher) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Stops watching, sends the queued alerts, and unregisters the watcher of the game
+func (cw *canvasWatcher) Close() {
+	cw.ClosedMutex.Lock()
+	if cw.Closed {
+		cw.ClosedMutex.Unlock()
+		return
+	}
+	cw.Closed = true
+	cw.ClosedMutex.Unlock()
+
+	if cw.config != nil {
+		cw.config.UnregisterCallback(cw.callbackID)
+	}
+
+	canvasWatcherGames.Lock()
+	if canvasWatcherGames.games[cw.ShortName] == cw {
+		delete(canvasWatcherGames.games, cw.ShortName)
+	}
+	canvasWatcherGames.Unlock()
+
+	cw.Canvas.unsubscribeListener(cw) // Waits until all events are delivered
+	close(cw.alertChan)
+	cw.waitGroup.Wait()
+}
@@ -0,0 +1,195 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_canvasWatchSettingsValidate(t *testing.T) {
+	valid := canvasWatchRegion{Rect: image.Rect(0, 0, 10, 10), Pixels: 50, Window: "5m"}
+	tests := []struct {
+		name     string
+		settings canvasWatchSettings
+		wantErr  bool
+	}{
+		{"valid", canvasWatchSettings{Regions: map[string]canvasWatchRegion{"a": valid}, Webhooks: []string{"https://example.com/hook"}}, false},
+		{"empty rect", canvasWatchSettings{Regions: map[string]canvasWatchRegion{"a": {Pixels: 50, Window: "5m"}}}, true},
+		{"missing window", canvasWatchSettings{Regions: map[string]canvasWatchRegion{"a": {Rect: valid.Rect, Pixels: 50}}}, true},
+		{"only deviation", canvasWatchSettings{Regions: map[string]canvasWatchRegion{"a": {Rect: valid.Rect, Deviation: 4, Baseline: "2h"}}}, false},
+		{"short baseline", canvasWatchSettings{Regions: map[string]canvasWatchRegion{"a": {Rect: valid.Rect, Deviation: 4, Baseline: "1m"}}}, true},
+		{"invalid cooldown", canvasWatchSettings{Regions: map[string]canvasWatchRegion{"a": {Rect: valid.Rect, Pixels: 50, Window: "5m", Cooldown: "soon"}}}, true},
+		{"invalid webhook", canvasWatchSettings{Webhooks: []string{"example.com/hook"}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.settings.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%v: validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_canvasWatcherCount(t *testing.T) {
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	cw := &canvasWatcher{ShortName: "Test-watch"}
+	cw.regions = map[string]*canvasWatchState{
+		"a": {canvasWatchRegion: canvasWatchRegion{Rect: image.Rect(0, 0, 10, 10), Pixels: 3, Window: "5m"}, window: 5 * time.Minute, cooldown: 5 * time.Minute},
+	}
+
+	// The fourth pixel within the window triggers an alert, the following ones are inside of the cooldown
+	for i, want := range []int{0, 0, 0, 1, 0, 0} {
+		alerts := cw.count(image.Point{1, 1}, start.Add(time.Duration(i)*time.Second))
+		if len(alerts) != want {
+			t.Errorf("Pixel %v triggered %v alerts, want %v", i, len(alerts), want)
+		}
+		if len(alerts) > 0 && (alerts[0].Region != "a" || alerts[0].Pixels != 4) {
+			t.Errorf("Got alert %+v, want one for region a with 4 pixels", alerts[0])
+		}
+	}
+	if alerts := cw.count(image.Point{20, 20}, start.Add(10*time.Second)); len(alerts) != 0 {
+		t.Errorf("Pixel outside of the region triggered %v alerts", len(alerts))
+	}
+
+	// After the window the old pixels don't count anymore
+	later := start.Add(10 * time.Minute)
+	for i, want := range []int{0, 0, 0, 1} {
+		if alerts := cw.count(image.Point{2, 2}, later.Add(time.Duration(i)*time.Minute)); len(alerts) != want {
+			t.Errorf("Pixel %v after the window triggered %v alerts, want %v", i, len(alerts), want)
+		}
+	}
+	if n := len(cw.regions["a"].times); n > 4 {
+		t.Errorf("Region keeps %v times, want at most 4", n)
+	}
+}
+
+func Test_canvasWatcherAnomaly(t *testing.T) {
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	cw := &canvasWatcher{ShortName: "Test-watch"}
+	cw.regions = map[string]*canvasWatchState{
+		"busy":  newCanvasWatchState(canvasWatchRegion{Rect: image.Rect(0, 0, 10, 10), Deviation: 4}, start),
+		"quiet": newCanvasWatchState(canvasWatchRegion{Rect: image.Rect(20, 20, 30, 30), Deviation: 4}, start),
+	}
+
+	// Between 3 and 7 pixels per minute in the busy region, and none in the quiet one
+	for minute := 0; minute < 30; minute++ {
+		pixels := 3 + minute%5
+		for i := 0; i < pixels; i++ {
+			if alerts := cw.count(image.Point{1, 1}, start.Add(time.Duration(minute)*time.Minute+time.Duration(i)*time.Second)); len(alerts) != 0 {
+				t.Fatalf("Usual activity in minute %v triggered %+v", minute, alerts)
+			}
+		}
+	}
+	if mean := cw.regions["busy"].mean; mean < 3 || mean > 7 {
+		t.Errorf("Baseline is %v pixels per minute, want between 3 and 7", mean)
+	}
+
+	// A raid in the busy region is detected after a few pixels
+	raid := start.Add(30 * time.Minute)
+	var alert *canvasWatchAlert
+	for i := 0; i < 60 && alert == nil; i++ {
+		if alerts := cw.count(image.Point{2, 2}, raid.Add(time.Duration(i)*time.Second)); len(alerts) > 0 {
+			alert = &alerts[0]
+		}
+	}
+	if alert == nil || alert.Kind != "anomaly" || alert.Region != "busy" || alert.Pixels > 20 || alert.Baseline == 0 {
+		t.Errorf("Raid triggered %+v, want an anomaly of the busy region within 20 pixels", alert)
+	}
+
+	// Single pixels in the quiet region are no anomaly
+	for i := 0; i < 4; i++ {
+		if alerts := cw.count(image.Point{21, 21}, raid.Add(time.Duration(i)*time.Second)); len(alerts) != 0 {
+			t.Errorf("Pixel %v in the quiet region triggered %+v", i, alerts)
+		}
+	}
+	if alerts := cw.count(image.Point{21, 21}, raid.Add(5*time.Second)); len(alerts) != 1 || alerts[0].Region != "quiet" {
+		t.Errorf("Fifth pixel in the quiet region triggered %+v, want an anomaly", alerts)
+	}
+}
+
+func Test_canvasWatcher(t *testing.T) {
+	defer setPathSettings(getPaths())
+	settings := getPaths()
+	settings.Snapshots = t.TempDir()
+	setPathSettings(settings)
+
+	var mutex sync.Mutex
+	received := []canvasWatchAlert{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := canvasWatchAlert{}
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("Can't decode alert: %v", err)
+		}
+		mutex.Lock()
+		received = append(received, alert)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	cw, err := can.newCanvasWatcher(nil, "Test-watch")
+	if err != nil {
+		t.Fatalf("Can't create watcher: %v", err)
+	}
+	defer cw.Close()
+	if err := cw.setSettings(canvasWatchSettings{
+		Regions: map[string]canvasWatchRegion{
+			"logo":  {Rect: image.Rect(0, 0, 8, 8), Pixels: 3, Window: "1m", Snapshot: true},
+			"quiet": {Rect: image.Rect(32, 32, 64, 64), Pixels: 3, Window: "1m"},
+		},
+		Webhooks: []string{server.URL},
+	}); err != nil {
+		t.Fatalf("Can't change settings: %v", err)
+	}
+
+	for i := 0; i < 6; i++ {
+		can.setPixel(image.Point{i, i}, pixelcanvasioPalette[5])
+	}
+
+	waitFor(t, 5*time.Second, "alert", func() bool { return len(getCanvasWatchAlerts("Test-watch")) > 0 })
+	cw.Close() // Sends the remaining alerts
+
+	alerts := getCanvasWatchAlerts("")
+	for _, alert := range alerts {
+		if alert.Game == "Test-watch" {
+			t.Errorf("Alerts are still listed after closing")
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("Webhook got %v alerts, want 1", len(received))
+	}
+	if alert := received[0]; alert.Game != "Test-watch" || alert.Region != "logo" || alert.Pixels != 4 || alert.Snapshot == "" {
+		t.Errorf("Webhook got %+v, want an alert of region logo with 4 pixels and a snapshot", alert)
+	}
+	if _, err := os.Stat(received[0].Snapshot); err != nil {
+		t.Errorf("Snapshot is missing: %v", err)
+	}
+}
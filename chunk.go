@@ -20,30 +20,182 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Wait time before a chunk is downloaded again after a failed download. It doubles with every failure in a row
 const (
-	chunkDeleteNoQueryDuration = 5 * time.Minute
-	chunkDeleteInvalidDuration = 5 * time.Minute
+	chunkDownloadBackoffMin = 5 * time.Second
+	chunkDownloadBackoffMax = 10 * time.Minute
 )
 
+// Chunks whose downloads failed this often in a row are reported as persistently failing
+const chunkDownloadPersistentFailures = 5
+
+// Retention of chunks, stored in the configuration at .chunks.
+// Chunks are deleted once they were invalid and not queried for the idle timeout, unless one of the flags keeps them.
+type chunkPolicySettings struct {
+	IdleTimeout  string // Duration like "5m" or "1h", "0" never deletes chunks
+	KeepRecorded bool   // Keep all chunks of canvases that are being recorded
+	KeepInRects  bool   // Keep chunks that intersect rectangles registered by listeners, like recorded or viewed areas
+	PalettedOnly bool   // Never store chunks as RGBA, colors that don't fit into the palette are replaced by the closest ones
+
+	RequestQueueSize  int    // Number of download requests that can wait for the game connection, applies to new canvases
+	EventQueueSize    int    // Number of events that can wait for the listeners of a canvas, 0 uses canvasEventChanSize. Applies to new canvases
+	EventOverflow     string // What happens to events that don't fit into the queue of the canvas or of a listener: "block", "drop" or "coalesce". Applies to new canvases
+	ListenerQueueSize int    // Number of events that can wait for each listener, 0 uses canvasListenerQueueSize. Applies to new canvases
+	MemoryLimit       int    // Limit in MiB for the chunks of each canvas. Above it, the least recently queried chunks are evicted. 0 disables the limit
+	PixelHistory      int    // Number of changes that are kept in memory for every pixel, see canvas.getPixelHistory. 0 disables the history. Applies to new canvases
+	PixelHistoryLimit int    // Limit in MiB for the pixel history of each canvas, 0 uses canvasPixelHistoryLimit. Applies to new canvases
+}
+
+var defaultChunkPolicySettings = chunkPolicySettings{
+	IdleTimeout:       "5m",
+	RequestQueueSize:  500,
+	EventQueueSize:    canvasEventChanSize,
+	EventOverflow:     canvasOverflowBlock,
+	ListenerQueueSize: canvasListenerQueueSize,
+	PixelHistoryLimit: canvasPixelHistoryLimit,
+}
+
+func (s chunkPolicySettings) validate() error {
+	d, err := time.ParseDuration(s.IdleTimeout)
+	if err != nil {
+		return fmt.Errorf("Invalid chunk idle timeout %q: %v", s.IdleTimeout, err)
+	}
+	if d < 0 {
+		return fmt.Errorf("Chunk idle timeout %v must not be negative", d)
+	}
+	if s.RequestQueueSize < 1 {
+		return fmt.Errorf("Chunk request queue size %v is less than 1", s.RequestQueueSize)
+	}
+	if s.EventQueueSize < 0 {
+		return fmt.Errorf("Canvas event queue size %v must not be negative", s.EventQueueSize)
+	}
+	if err := validateCanvasOverflowPolicy(s.EventOverflow); err != nil {
+		return err
+	}
+	if s.ListenerQueueSize < 0 {
+		return fmt.Errorf("Listener event queue size %v must not be negative", s.ListenerQueueSize)
+	}
+	if s.MemoryLimit < 0 {
+		return fmt.Errorf("Canvas memory limit %v must not be negative", s.MemoryLimit)
+	}
+	if s.PixelHistory < 0 || s.PixelHistory > canvasPixelHistoryMax {
+		return fmt.Errorf("Pixel history size %v is not between 0 and %v", s.PixelHistory, canvasPixelHistoryMax)
+	}
+	if s.PixelHistoryLimit < 0 {
+		return fmt.Errorf("Pixel history limit %v must not be negative", s.PixelHistoryLimit)
+	}
+	return nil
+}
+
+// Returns the parsed idle timeout, 0 means that chunks are never deleted
+func (s chunkPolicySettings) getIdleTimeout() time.Duration {
+	d, _ := time.ParseDuration(s.IdleTimeout)
+	return d
+}
+
+// Returns the size of the event queue of new canvases
+func (s chunkPolicySettings) getEventQueueSize() int {
+	if s.EventQueueSize <= 0 {
+		return canvasEventChanSize
+	}
+	return s.EventQueueSize
+}
+
+// Returns the size of the event queue of each listener of new canvases
+func (s chunkPolicySettings) getListenerQueueSize() int {
+	if s.ListenerQueueSize <= 0 {
+		return canvasListenerQueueSize
+	}
+	return s.ListenerQueueSize
+}
+
+// Returns the limit of the pixel history of each new canvas in bytes
+func (s chunkPolicySettings) getPixelHistoryLimit() int64 {
+	if s.PixelHistoryLimit <= 0 {
+		return canvasPixelHistoryLimit << 20
+	}
+	return int64(s.PixelHistoryLimit) << 20
+}
+
+// Returns the memory limit of each canvas in bytes, 0 means no limit
+func (s chunkPolicySettings) getMemoryLimit() int64 {
+	return int64(s.MemoryLimit) << 20
+}
+
+var chunkPolicyMutex sync.RWMutex
+var chunkPolicy = defaultChunkPolicySettings
+
+// Changes the retention of chunks of all canvases
+func setChunkPolicy(s chunkPolicySettings) {
+	chunkPolicyMutex.Lock()
+	defer chunkPolicyMutex.Unlock()
+
+	chunkPolicy = s
+}
+
+// Returns the current retention of chunks
+func getChunkPolicy() chunkPolicySettings {
+	chunkPolicyMutex.RLock()
+	defer chunkPolicyMutex.RUnlock()
+
+	return chunkPolicy
+}
+
 type pixelQueueElement struct {
 	Pos   image.Point
 	Color color.Color
 }
 
+// Immutable image of a chunk, that is shared instead of copied.
+//
+// As long as a handle is retained by someone else, the chunk copies its image before it's modified.
+// Users call release() once they don't need the image anymore, so the chunk can modify its image in place again.
+// Images that are passed on, e.g. to listeners, are simply not released.
+type chunkImage struct {
+	image.Image
+	refs int32
+}
+
+func (ci *chunkImage) retain() *chunkImage {
+	atomic.AddInt32(&ci.refs, 1)
+	return ci
+}
+
+// Releases the handle. The image must not be used afterwards
+func (ci *chunkImage) release() {
+	if atomic.AddInt32(&ci.refs, -1) < 0 {
+		panic("Chunk image was released too often")
+	}
+}
+
 type chunk struct {
 	sync.RWMutex
 
-	Rect  image.Rectangle
-	Image image.Image // TODO: Compress or unload image when not needed
+	Rect   image.Rectangle
+	Image  image.Image // Paletted, or RGBA if the colors don't fit into a palette. TODO: Compress or unload image when not needed
+	handle *chunkImage // Handle of Image that was handed out, nil if Image isn't shared
 
 	PixelQueue           []pixelQueueElement // Queued pixels, that are set while the image is downloading
 	Valid, Downloading   bool                // Valid: Data is in sync with the game. Downloading: Data is being downloaded. Both flags can't be true at the same time
 	LastQueryTime        time.Time           // Point in time, when that chunk was queried last. If this chunk hasn't been queried for some period, it will be unloaded.
 	LastInvalidationTime time.Time           // Point in time, when that chunk was invalidated last.
+
+	DownloadFailures int       // Number of downloads that failed in a row
+	DownloadError    string    // Reason of the last failed download
+	LastFailureTime  time.Time // Point in time, when the last download failed
+	RetryTime        time.Time // The chunk isn't downloaded again before this point in time
+
+	History     map[image.Point][]canvasPixelChange // Last changes of the pixels, oldest first. Only used if the canvas keeps a pixel history
+	HistorySize int                                 // Number of changes in History
+	HistoryTime time.Time                           // Time of the newest change in History
+
+	accessed uint32 // Set when the chunk is used by a canvas that spills chunks, cleared when it looks for cold chunks. Accessed atomically
 }
 
 // Create new empty chunk with rect
@@ -72,6 +224,8 @@ func (chu *chunk) getPixel(pos image.Point) (color.Color, error) {
 	return chu.Image.At(pos.X, pos.Y), nil // TODO: Make this call secure, it causes a runtime error when it tries to retrieve an index outside the palette.
 }
 
+// Returns the index of the pixel in the palette of the chunk image.
+// That's the index of the game palette, if all colors of the chunk were part of it when the image was set. See canvas.getPixelIndex
 func (chu *chunk) getPixelIndex(pos image.Point) (uint8, error) {
 	chu.RLock()
 	defer chu.RUnlock()
@@ -97,13 +251,8 @@ func (chu *chunk) setPixel(pos image.Point, col color.Color) error {
 	}
 
 	if chu.Valid {
-		switch img := chu.Image.(type) {
-		case *image.RGBA:
-			img.Set(pos.X, pos.Y, col)
-		case *image.Paletted:
-			img.Set(pos.X, pos.Y, col)
-		default:
-			return fmt.Errorf("Incompatible chunk image type %T", img)
+		if err := chu.setImagePixel(pos, col); err != nil {
+			return err
 		}
 	}
 
@@ -118,6 +267,108 @@ func (chu *chunk) setPixel(pos image.Point, col color.Color) error {
 	return nil
 }
 
+// Sets several pixels while holding the lock only once, see setPixel.
+// Pixels outside of the chunk are skipped, the first error is returned after all other pixels are set.
+func (chu *chunk) setPixels(pixels []pixelUpdate) error {
+	chu.Lock()
+	defer chu.Unlock()
+
+	var firstErr error
+	for _, pixel := range pixels {
+		if !pixel.Pos.In(chu.Rect) {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Position %v is outside of the chunk", pixel.Pos)
+			}
+			continue
+		}
+
+		if chu.Valid {
+			if err := chu.setImagePixel(pixel.Pos, pixel.Color); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		// If chunk is downloading, append to queue to draw them later
+		if chu.Downloading {
+			chu.PixelQueue = append(chu.PixelQueue, pixelQueueElement{
+				Pos:   pixel.Pos,
+				Color: pixel.Color,
+			})
+		}
+	}
+
+	return firstErr
+}
+
+// Sets a pixel of the image, the chunk has to be locked.
+//
+// Paletted images are converted to RGBA, if the color isn't part of the palette.
+// Otherwise it would be replaced by the closest color of the palette.
+func (chu *chunk) setImagePixel(pos image.Point, col color.Color) error {
+	if err := chu.unshareImage(); err != nil {
+		return err
+	}
+
+	switch img := chu.Image.(type) {
+	case *image.RGBA:
+		img.Set(pos.X, pos.Y, col)
+	case *image.Paletted:
+		if len(img.Palette) > 0 {
+			index := img.Palette.Index(col)
+			if color.RGBAModel.Convert(img.Palette[index]) == color.RGBAModel.Convert(col) {
+				img.SetColorIndex(pos.X, pos.Y, uint8(index))
+				break
+			}
+			if getChunkPolicy().PalettedOnly {
+				if len(img.Palette) >= 256 {
+					compactPalette(img) // Make room for new colors, e.g. after a palette change of the game
+				}
+				if len(img.Palette) < 256 {
+					index = len(img.Palette)
+					img.Palette = append(img.Palette[:len(img.Palette):len(img.Palette)], col) // Don't write into a palette that may be shared
+				}
+				img.SetColorIndex(pos.X, pos.Y, uint8(index))
+				break
+			}
+		}
+		rgba := image.NewRGBA(img.Rect)
+		draw.Draw(rgba, rgba.Rect, img, rgba.Rect.Min, draw.Src)
+		rgba.Set(pos.X, pos.Y, col)
+		chu.Image = rgba
+	default:
+		return fmt.Errorf("Incompatible chunk image type %T", img)
+	}
+
+	return nil
+}
+
+// Removes all colors from the palette of the image, that aren't used by any pixel.
+// The pixels are modified, so the image must not be shared. The palette itself is copied, as it may be shared.
+func compactPalette(img *image.Paletted) {
+	used := [256]bool{}
+	for _, index := range img.Pix {
+		used[index] = true
+	}
+
+	mapping := [256]uint8{}
+	palette := make(color.Palette, 0, len(img.Palette))
+	for index, col := range img.Palette {
+		if used[index] {
+			mapping[index] = uint8(len(palette))
+			palette = append(palette, col)
+		}
+	}
+	if len(palette) == len(img.Palette) {
+		return
+	}
+
+	for i, index := range img.Pix {
+		img.Pix[i] = mapping[index]
+	}
+	img.Palette = palette
+}
+
+// Sets a pixel to the given index of the palette of the chunk image, see getPixelIndex
 func (chu *chunk) setPixelIndex(pos image.Point, colorIndex uint8) error {
 	chu.Lock()
 	defer chu.Unlock()
@@ -136,7 +387,10 @@ func (chu *chunk) setPixelIndex(pos image.Point, colorIndex uint8) error {
 	}
 
 	if chu.Valid {
-		img.SetColorIndex(pos.X, pos.Y, colorIndex)
+		if err := chu.unshareImage(); err != nil {
+			return err
+		}
+		chu.Image.(*image.Paletted).SetColorIndex(pos.X, pos.Y, colorIndex)
 	}
 
 	// If chunk is downloading, append to queue to draw them later
@@ -157,8 +411,8 @@ func (chu *chunk) setPixelIndex(pos image.Point, colorIndex uint8) error {
 // All queued pixels will be replayed when this function is called.
 // This helps to prevent inconsistencies while downloading chunks.
 //
-// The chunk will share its pixels with the given image.
-// The result image is an up to date subimage copy containing all queued changes.
+// The result image is an up to date copy containing all queued changes.
+// It's shared with the chunk and must not be modified.
 func (chu *chunk) setImage(srcImg image.Image) (image.Image, error) {
 	chu.Lock()
 	defer chu.Unlock()
@@ -181,51 +435,112 @@ func (chu *chunk) setImage(srcImg image.Image) (image.Image, error) {
 		chu.PixelQueue = []pixelQueueElement{}
 		chu.Downloading = false
 		chu.Valid = true
+		chu.resetDownloadFailures()
 
 		return nil, nil // Return no image copy, this will cause the canvas to send a revalidate event
 	}
 
-	chu.Image = subImg // This will share pixels with the srcImage
+	// Copy the subimage, so the chunk doesn't share pixels with srcImg
+	cpyImg, err := copyImageReduced(subImg)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't copy image: %v", err)
+	}
+	if chu.handle == nil {
+		releaseImage(chu.Image) // Nobody else has the old image, its buffer can be reused
+	}
+	chu.Image = cpyImg
+	chu.handle = nil
 
 	// Replay all the queued pixels
 	for _, pqe := range chu.PixelQueue {
-		switch img := chu.Image.(type) {
-		case *image.RGBA:
-			img.Set(pqe.Pos.X, pqe.Pos.Y, pqe.Color)
-		case *image.Paletted:
-			img.Set(pqe.Pos.X, pqe.Pos.Y, pqe.Color)
-		default:
-			return nil, fmt.Errorf("Incompatible chunk image type %T", img)
+		if err := chu.setImagePixel(pqe.Pos, pqe.Color); err != nil {
+			return nil, err
 		}
 	}
 
 	chu.PixelQueue = []pixelQueueElement{}
 	chu.Downloading = false
 	chu.Valid = true
+	chu.resetDownloadFailures()
 
-	// Create copy of the subimage (in the most recent state)
-	cpyImg, err := copyImageReduced(chu.Image)
-	if err != nil {
-		return nil, fmt.Errorf("Couldn't copy image: %v", err)
-	}
+	// The image in its most recent state is shared with the result
+	chu.handle = &chunkImage{Image: chu.Image, refs: 1}
 
-	return cpyImg, nil
+	return chu.handle.retain().Image, nil
 }
 
-func (chu *chunk) getImageCopy(onlyIfValid bool) (image.Image, bool, bool, error) {
-	chu.RLock()
-	defer chu.RUnlock()
+// Returns the current image of the chunk, without copying it.
+// The handle has to be released once the image isn't needed anymore.
+func (chu *chunk) getImage(onlyIfValid bool) (*chunkImage, bool, bool, error) {
+	chu.Lock()
+	defer chu.Unlock()
 
 	if onlyIfValid && !chu.Valid {
 		return nil, false, false, fmt.Errorf("Chunk is not valid")
 	}
 
-	cpyImg, err := copyImageReduced(chu.Image)
-	if err != nil {
-		return nil, false, false, fmt.Errorf("Couldn't copy image: %v", err)
+	switch img := chu.Image.(type) {
+	case *image.RGBA, *image.Paletted:
+	default:
+		return nil, false, false, fmt.Errorf("Incompatible chunk image type %T", img)
+	}
+
+	if chu.handle == nil {
+		chu.handle = &chunkImage{Image: chu.Image, refs: 1} // The chunk's own reference
+	}
+
+	return chu.handle.retain(), chu.Valid, chu.Downloading, nil
+}
+
+// Prepares the image to be modified, the chunk has to be locked.
+// The image is copied if a handle of it is still in use.
+func (chu *chunk) unshareImage() error {
+	if chu.handle == nil {
+		return nil
+	}
+
+	if atomic.LoadInt32(&chu.handle.refs) > 1 {
+		cpyImg, err := copyImageReduced(chu.Image)
+		if err != nil {
+			return fmt.Errorf("Couldn't copy image: %v", err)
+		}
+		chu.Image = cpyImg
+	}
+	chu.handle = nil
+
+	return nil
+}
+
+// Returns the approximate memory used by the image, the queued pixels and the pixel history in bytes, and when the chunk was queried last
+func (chu *chunk) getMemoryUsage() (int64, time.Time) {
+	chu.RLock()
+	defer chu.RUnlock()
+
+	size := int64(len(chu.PixelQueue))*32 + int64(chu.HistorySize)*canvasPixelChangeSize
+	switch img := chu.Image.(type) {
+	case *image.Paletted:
+		size += int64(len(img.Pix) + len(img.Palette)*20)
+	case *image.RGBA:
+		size += int64(len(img.Pix))
 	}
 
-	return cpyImg, chu.Valid, chu.Downloading, nil
+	return size, chu.LastQueryTime
+}
+
+// Returns whether the data of the chunk is in sync with the game
+func (chu *chunk) isValid() bool {
+	chu.RLock()
+	defer chu.RUnlock()
+
+	return chu.Valid
+}
+
+// Returns whether the data of the chunk is in sync with the game, and whether it's being downloaded
+func (chu *chunk) getState() (valid, downloading bool) {
+	chu.RLock()
+	defer chu.RUnlock()
+
+	return chu.Valid, chu.Downloading
 }
 
 // Invalidates the image, which shows that this chunk contains old or completely wrong data.
@@ -251,6 +566,7 @@ func (chu *chunk) revalidate() {
 	chu.PixelQueue = []pixelQueueElement{}
 	chu.Downloading = false
 	chu.Valid = true
+	chu.resetDownloadFailures()
 
 	return
 }
@@ -269,11 +585,60 @@ func (chu *chunk) signalDownload() bool {
 	}
 
 	chu.PixelQueue = []pixelQueueElement{} // Empty queue on new download.
-	chu.Downloading = true                 // TODO: Fix chunks getting stuck in downloading state. Reset downloading state if the download failed!
+	chu.Downloading = true                 // Connections reset this with signalDownloadFailed() if the download fails
 
 	return true
 }
 
+// Signals that the download of the chunk failed, the chunk isn't downloading anymore.
+// It's downloaded again once the backoff is over, which grows with every failure in a row.
+//
+// Returns the number of failures in a row, or 0 if the chunk wasn't downloading.
+func (chu *chunk) signalDownloadFailed(reason string) int {
+	chu.Lock()
+	defer chu.Unlock()
+
+	if !chu.Downloading {
+		return 0
+	}
+
+	now := time.Now()
+	chu.PixelQueue = []pixelQueueElement{}
+	chu.Downloading = false
+	chu.DownloadFailures++
+	chu.DownloadError = reason
+	chu.LastFailureTime = now
+	chu.RetryTime = now.Add(chunkDownloadBackoff(chu.DownloadFailures))
+
+	return chu.DownloadFailures
+}
+
+// Forgets the failed downloads. The lock must be held
+func (chu *chunk) resetDownloadFailures() {
+	chu.DownloadFailures, chu.DownloadError = 0, ""
+	chu.LastFailureTime, chu.RetryTime = time.Time{}, time.Time{}
+}
+
+// Returns the failed downloads in a row, their last reason and when the chunk is downloaded again
+func (chu *chunk) getDownloadFailures() (failures int, reason string, last, retry time.Time) {
+	chu.RLock()
+	defer chu.RUnlock()
+
+	return chu.DownloadFailures, chu.DownloadError, chu.LastFailureTime, chu.RetryTime
+}
+
+// Returns how long to wait before the next download, after the given number of failures in a row
+func chunkDownloadBackoff(failures int) time.Duration {
+	backoff := chunkDownloadBackoffMin
+	for i := 1; i < failures && backoff < chunkDownloadBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > chunkDownloadBackoffMax {
+		backoff = chunkDownloadBackoffMax
+	}
+	return backoff
+}
+
 type chunkQueryResult int
 
 const (
@@ -286,14 +651,14 @@ const (
 // Query a chunk and reset its timer.
 // The result suggests whether a chunk should be downloaded, kept or deleted.
 // The canvas handles the result.
-func (chu *chunk) getQueryState(resetTime bool) chunkQueryResult {
+//
+// Chunks are only suggested for deletion if they were invalid and haven't been queried for idleTimeout. An idleTimeout of 0 keeps them.
+func (chu *chunk) getQueryState(resetTime bool, idleTimeout time.Duration) chunkQueryResult {
 	chu.Lock()
 	defer chu.Unlock()
 
-	// TODO: Add option to not delete old chunks (For replay)
-	// TODO: Add option to ignore chunkDeleteInvalidDuration
 	// Delete chunks that were invalid for some time and haven't been queried for some time
-	if !chu.Valid && chu.LastInvalidationTime.Add(chunkDeleteInvalidDuration).Before(time.Now()) && chu.LastQueryTime.Add(chunkDeleteNoQueryDuration).Before(time.Now()) {
+	if idleTimeout > 0 && !chu.Valid && chu.LastInvalidationTime.Add(idleTimeout).Before(time.Now()) && chu.LastQueryTime.Add(idleTimeout).Before(time.Now()) {
 		return chunkDelete
 	}
 
@@ -302,8 +667,8 @@ func (chu *chunk) getQueryState(resetTime bool) chunkQueryResult {
 		chu.LastQueryTime = time.Now()
 	}
 
-	// Suggest downloading of the chunk if it is invalid and not downloading already
-	if !chu.Valid && !chu.Downloading {
+	// Suggest downloading of the chunk if it is invalid, not downloading already, and not waiting after a failed download
+	if !chu.Valid && !chu.Downloading && !time.Now().Before(chu.RetryTime) {
 		return chunkDownload
 	}
 
@@ -0,0 +1,230 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func Test_chunkPaletted(t *testing.T) {
+	rect := image.Rect(0, 0, 4, 4)
+	rgba := image.NewRGBA(rect)
+	rgba.Set(1, 1, pixelcanvasioPalette[5])
+	img, err := copyImagePaletted(rgba)
+	if err != nil {
+		t.Fatalf("copyImagePaletted() failed: %v", err)
+	}
+
+	chu := newChunk(rect)
+	chu.signalDownload()
+	chu.setPixel(image.Point{2, 2}, pixelcanvasioPalette[5]) // Queued while downloading
+	if _, err := chu.setImage(img); err != nil {
+		t.Fatalf("setImage() failed: %v", err)
+	}
+	if _, ok := chu.Image.(*image.Paletted); !ok {
+		t.Fatalf("Chunk image is %T, want *image.Paletted", chu.Image)
+	}
+
+	// Colors of the palette keep the image paletted, others convert it to RGBA
+	tests := []struct {
+		pos      image.Point
+		col      color.Color
+		paletted bool
+	}{
+		{image.Point{3, 3}, pixelcanvasioPalette[5], true},
+		{image.Point{0, 3}, color.RGBA{1, 2, 3, 255}, false},
+	}
+
+	for _, test := range tests {
+		if err := chu.setPixel(test.pos, test.col); err != nil {
+			t.Fatalf("setPixel() failed: %v", err)
+		}
+		if _, ok := chu.Image.(*image.Paletted); ok != test.paletted {
+			t.Errorf("Chunk image is %T after setting %v", chu.Image, test.col)
+		}
+		if got, want := color.RGBAModel.Convert(chu.Image.At(test.pos.X, test.pos.Y)), color.RGBAModel.Convert(test.col); got != want {
+			t.Errorf("Color at %v = %v, want %v", test.pos, got, want)
+		}
+		for _, pos := range []image.Point{{1, 1}, {2, 2}} {
+			if got, want := color.RGBAModel.Convert(chu.Image.At(pos.X, pos.Y)), color.RGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+				t.Errorf("Color at %v = %v, want %v", pos, got, want)
+			}
+		}
+	}
+}
+
+func Test_chunkImage(t *testing.T) {
+	rect := image.Rect(0, 0, 4, 4)
+	chu := newChunk(rect)
+	chu.signalDownload()
+	if _, err := chu.setImage(image.NewPaletted(rect, pixelcanvasioPalette)); err != nil {
+		t.Fatalf("setImage() failed: %v", err)
+	}
+
+	a, _, _, err := chu.getImage(true)
+	if err != nil {
+		t.Fatalf("getImage() failed: %v", err)
+	}
+	b, _, _, _ := chu.getImage(true)
+	if a != b || a.Image != chu.Image {
+		t.Errorf("Unmodified chunk returned different images")
+	}
+
+	// Retained images are copied before they are modified
+	chu.setPixel(image.Point{1, 1}, pixelcanvasioPalette[3])
+	if a.Image == chu.Image || a.At(1, 1) == pixelcanvasioPalette[3] {
+		t.Errorf("Retained image was modified")
+	}
+	a.release()
+	b.release()
+
+	// Released images are modified in place
+	c, _, _, _ := chu.getImage(true)
+	c.release()
+	chu.setPixel(image.Point{2, 2}, pixelcanvasioPalette[3])
+	if c.Image != chu.Image {
+		t.Errorf("Released image was copied")
+	}
+}
+
+func Test_chunkQueryState(t *testing.T) {
+	chu := newChunk(image.Rect(0, 0, 4, 4))
+	chu.LastQueryTime = time.Now().Add(-10 * time.Minute)
+	chu.LastInvalidationTime = time.Now().Add(-10 * time.Minute)
+
+	if state := chu.getQueryState(false, 0); state != chunkDownload {
+		t.Errorf("Chunk without idle timeout got state %v, want %v", state, chunkDownload)
+	}
+	if state := chu.getQueryState(false, time.Hour); state != chunkDownload {
+		t.Errorf("Recently used chunk got state %v, want %v", state, chunkDownload)
+	}
+	if state := chu.getQueryState(false, 5*time.Minute); state != chunkDelete {
+		t.Errorf("Idle chunk got state %v, want %v", state, chunkDelete)
+	}
+
+	if err := (chunkPolicySettings{IdleTimeout: "-1m", RequestQueueSize: 1}).validate(); err == nil {
+		t.Errorf("Negative idle timeout is valid")
+	}
+	if err := (chunkPolicySettings{IdleTimeout: "0", RequestQueueSize: 1}).validate(); err != nil {
+		t.Errorf("Idle timeout of 0 is invalid: %v", err)
+	}
+	if err := (chunkPolicySettings{IdleTimeout: "5m"}).validate(); err == nil {
+		t.Errorf("Chunk request queue without size is valid")
+	}
+}
+
+func Test_chunkDownloadFailures(t *testing.T) {
+	chu := newChunk(image.Rect(0, 0, 4, 4))
+
+	if failures := chu.signalDownloadFailed("Not downloading"); failures != 0 {
+		t.Errorf("Chunk that wasn't downloading got %v failures, want 0", failures)
+	}
+
+	// Failed chunks wait for the backoff before they are downloaded again
+	for i := 1; i <= 3; i++ {
+		if !chu.signalDownload() {
+			t.Fatalf("Can't signal download %v", i)
+		}
+		if failures := chu.signalDownloadFailed("Timeout"); failures != i {
+			t.Errorf("Got %v failures, want %v", failures, i)
+		}
+		if state := chu.getQueryState(false, 0); state != chunkKeep {
+			t.Errorf("Failed chunk got state %v, want %v", state, chunkKeep)
+		}
+	}
+
+	failures, reason, last, retry := chu.getDownloadFailures()
+	if failures != 3 || reason != "Timeout" || retry.Sub(last) != 4*chunkDownloadBackoffMin {
+		t.Errorf("Got %v failures with reason %q and retry after %v, want 3, %q and %v", failures, reason, retry.Sub(last), "Timeout", 4*chunkDownloadBackoffMin)
+	}
+
+	chu.RetryTime = time.Now().Add(-time.Second)
+	if state := chu.getQueryState(false, 0); state != chunkDownload {
+		t.Errorf("Chunk after the backoff got state %v, want %v", state, chunkDownload)
+	}
+
+	// A successful download forgets the failures
+	chu.signalDownload()
+	if _, err := chu.setImage(image.NewRGBA(chu.Rect)); err != nil {
+		t.Fatalf("Can't set image: %v", err)
+	}
+	if failures, _, _, _ := chu.getDownloadFailures(); failures != 0 {
+		t.Errorf("Got %v failures after a successful download, want 0", failures)
+	}
+
+	if backoff := chunkDownloadBackoff(100); backoff != chunkDownloadBackoffMax {
+		t.Errorf("Got backoff %v after many failures, want %v", backoff, chunkDownloadBackoffMax)
+	}
+}
+
+func Test_chunkSetImageCopy(t *testing.T) {
+	rect := image.Rect(0, 0, 4, 4)
+	src := image.NewPaletted(image.Rect(0, 0, 8, 8), pixelcanvasioPalette)
+
+	chu := newChunk(rect)
+	chu.signalDownload()
+	if _, err := chu.setImage(src); err != nil {
+		t.Fatalf("setImage() failed: %v", err)
+	}
+
+	// The chunk must not share pixels with the source, as it's reused for other events
+	src.SetColorIndex(1, 1, 5)
+	if chu.Image.At(1, 1) == pixelcanvasioPalette[5] {
+		t.Errorf("Chunk shares pixels with the source image")
+	}
+
+	// Images that are still shared are kept, instead of being recycled
+	a, _, _, _ := chu.getImage(true)
+	chu.invalidateImage()
+	chu.signalDownload()
+	src.SetColorIndex(2, 2, 3)
+	if _, err := chu.setImage(src); err != nil {
+		t.Fatalf("setImage() failed: %v", err)
+	}
+	if a.At(1, 1) == pixelcanvasioPalette[5] || a.At(2, 2) == pixelcanvasioPalette[3] {
+		t.Errorf("Retained image was modified")
+	}
+	a.release()
+}
+
+func Test_chunkPalettedOnly(t *testing.T) {
+	defer setChunkPolicy(getChunkPolicy())
+	setChunkPolicy(chunkPolicySettings{IdleTimeout: "5m", PalettedOnly: true, RequestQueueSize: 1})
+
+	rect := image.Rect(0, 0, 4, 4)
+	chu := newChunk(rect)
+	chu.signalDownload()
+	if _, err := chu.setImage(image.NewPaletted(rect, pixelcanvasioPalette[:2])); err != nil {
+		t.Fatalf("setImage() failed: %v", err)
+	}
+
+	// Colors are added to the palette, instead of converting the image to RGBA
+	col := color.RGBA{1, 2, 3, 255}
+	if err := chu.setPixel(image.Point{1, 1}, col); err != nil {
+		t.Fatalf("setPixel() failed: %v", err)
+	}
+	img, ok := chu.Image.(*image.Paletted)
+	if !ok {
+		t.Fatalf("Chunk image is %T, want *image.Paletted", chu.Image)
+	}
+	if got := color.RGBAModel.Convert(img.At(1, 1)); got != col || len(img.Palette) != 3 {
+		t.Errorf("Color at (1, 1) = %v with %v colors, want %v with 3 colors", got, len(img.Palette), col)
+	}
+}
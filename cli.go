@@ -0,0 +1,913 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+)
+
+var cliLog = moduleLog("cli")
+
+// A subcommand of the command line interface
+type cliCommand struct {
+	Usage       string // Arguments and flags, shown in the help
+	Description string
+	NoServices  bool // Run without starting the API server and other services, api is nil then
+
+	Run func(api *apiServer, args []string) error
+}
+
+var cliCommands map[string]cliCommand
+
+func init() {
+	// Assigned in init, as the help command refers to the map itself
+	cliCommands = map[string]cliCommand{
+		"connect":   {"<game>", "Connect to a game and keep the canvas up to date, e.g. to serve it with the API server", false, cliConnect},
+		"record":    {"<game> -rect x1,y1,x2,y2 [-format pixrec] [-duration 0]", "Record rectangles of a game until interrupted", false, cliRecord},
+		"replay":    {"<game> -time <RFC3339> -rect x1,y1,x2,y2 -o file.png | <game> -hash", "Write the state of a recorded canvas at some point in time as PNG, or print the hash of its final state", false, cliReplay},
+		"png":       {"<game> -rect x1,y1,x2,y2 [-o canvas.png] [-wait 30s]", "Write a rectangle of the live canvas as PNG, once it's completely downloaded", false, cliPNG},
+		"diff":      {"-a <game>[@<RFC3339>] -b <game>[@<RFC3339>] -rect x1,y1,x2,y2 [-o diff.png]", "Compare two recordings or points in time pixel by pixel, e.g. to reconcile the archives of two recorders", false, cliDiff},
+		"export":    {"<kind> <game> -rect x1,y1,x2,y2 -o file [options]", "Export a recording, see the export options with -h", false, cliExport},
+		"sync":      {"<game> -peer <address> -rect x1,y1,x2,y2 -start <RFC3339> [-end <RFC3339>]", "Fill a gap in the local recordings with the recordings of another instance", false, cliSync},
+		"palette":   {"<game> -rect x1,y1,x2,y2 [-duration 30s] [-save]", "Sample the colors of a live canvas to derive the palette of the game, and store it in the configuration", false, cliPalette},
+		"index":     {"<game>", "Build or update the index of the pixel changes in the local recordings of a game, see pixel", false, cliIndex},
+		"compact":   {"<game> [-age 720h] [-interval 1m]", "Compact the recordings of a game that ended longer ago than age into one frame per interval, defaults to the quota of the game", false, cliCompact},
+		"anonymize": {"<game> -o <directory> [-salt secret]", "Copy the recordings of a game into a directory without the authors of pixels, e.g. to publish them. With -salt, authors are replaced by pseudonyms instead", false, cliAnonymize},
+		"pixel":     {"<game> -x <x> -y <y> [-time <RFC3339>] [-history]", "Print the color of a pixel at some point in time and when it changed, from the index", false, cliPixel},
+		"search":    {"<game>[@<RFC3339>] -pattern logo.png -rect x1,y1,x2,y2 [-tolerance 0] [-max 100] [-live]", "Find occurrences of a pixel art pattern in the recordings or on the live canvas, e.g. copies of a logo", false, cliSearch},
+		"macro":     {"<name> [-delays] | -list", "Run a macro that was recorded in the user interface, and wait for the exports it queued", false, cliMacro},
+		"stress":    {"[-rect x1,y1,x2,y2] [-pixels 1000000] [-rate 0] [-listeners 4] [-record] [-maxheap 0]", "Set random pixels on a synthetic canvas as fast as possible, and print the throughput and the peak memory usage", false, cliStress},
+		"bot":       {"<game>", "Place pixels automatically (not implemented yet)", false, cliBot},
+		"daemon":    {"", "Connect, record and export as set in the configuration at .daemon, until interrupted", false, cliDaemon},
+		"serve":     {"[-address :8081]", "Run the API server until interrupted, without opening the UI", false, cliServe},
+		"ctl":       {"<method> [params as JSON] [-socket path]", "Call a method of the control socket of a running instance, and print the result", true, cliCtl},
+		"help":      {"", "Show this help", true, cliHelp},
+	}
+}
+
+// Runs the subcommand given by args[0], and blocks until it's finished.
+// Commands that run until they are interrupted return nil when they are stopped with Ctrl+C.
+func cliRun(api *apiServer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("No command given, see \"help\"")
+	}
+
+	command, ok := cliCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown command %q, see \"help\"", args[0])
+	}
+
+	if err := command.Run(api, args[1:]); err != nil && err != flag.ErrHelp {
+		return err
+	}
+
+	return nil
+}
+
+// Parses flags and positional arguments, which can be mixed in any order.
+// Returns an error if the number of positional arguments doesn't match.
+func cliParse(fs *flag.FlagSet, args []string, positionalNames ...string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(positional) != len(positionalNames) {
+		return nil, fmt.Errorf("%v needs the arguments %v, got %q", fs.Name(), positionalNames, positional)
+	}
+
+	return positional, nil
+}
+
+// Flag that can be given several times, each with a rectangle in the form "x1,y1,x2,y2"
+type cliRects []image.Rectangle
+
+func (cr *cliRects) String() string {
+	return fmt.Sprint(*cr)
+}
+
+func (cr *cliRects) Set(s string) error {
+	rect, err := parseRectangle(s)
+	if err != nil {
+		return err
+	}
+	*cr = append(*cr, rect)
+	return nil
+}
+
+// Flag with a point in time in RFC3339 format
+type cliTime struct{ time.Time }
+
+func (ct *cliTime) String() string {
+	if ct.IsZero() {
+		return ""
+	}
+	return ct.Format(time.RFC3339)
+}
+
+func (ct *cliTime) Set(s string) error {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return err
+	}
+	ct.Time = t
+	return nil
+}
+
+// Blocks until the program is interrupted, or the duration is over. A duration of 0 waits forever
+func cliWait(duration time.Duration) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	defer signal.Stop(signalChan)
+
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timeout = time.After(duration)
+	}
+
+	select {
+	case <-signalChan:
+		cliLog.Infof("Interrupted, stopping")
+	case <-timeout:
+	}
+}
+
+// Opens a connection of the given connection type
+func cliConnectGame(shortName string) (connection, *canvas, error) {
+	connectionType, ok := connectionTypes[shortName]
+	if !ok {
+		names := []string{}
+		for name := range connectionTypes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, nil, fmt.Errorf("Unknown game %q, available games: %v", shortName, names)
+	}
+
+	con, can := connectionType.FunctionNew()
+	return con, can, nil
+}
+
+func cliConnect(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("connect", flag.ContinueOnError)
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+
+	con, _, err := cliConnectGame(positional[0])
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+
+	cliLog.Infof("Connected to %v, stop with Ctrl+C", con.getName())
+	cliWait(0)
+
+	return nil
+}
+
+func cliRecord(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("record", flag.ContinueOnError)
+	rects := cliRects{}
+	fs.Var(&rects, "rect", "Rectangle x1,y1,x2,y2 to record, can be given several times")
+	format := fs.String("format", canvasRecorderDefaultFormat, fmt.Sprintf("Recording format, one of %v", canvasRecorderFormatNames()))
+	compression := fs.Int("compression", 0, "Compression level from 1 (fastest) to 9 (smallest files), 0 for the default")
+	duration := fs.Duration("duration", 0, "Stop recording after this duration, 0 records until interrupted")
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+	if len(rects) == 0 {
+		return fmt.Errorf("No rectangle to record given, use -rect")
+	}
+
+	con, can, err := cliConnectGame(positional[0])
+	if err != nil {
+		return err
+	}
+
+	rec, err := can.newCanvasRecorder(con.getShortName(), canvasRecorderSettings{Format: *format, Compression: *compression})
+	if err != nil {
+		con.Close()
+		return err
+	}
+	// Close the connection first, so the recorder gets all events
+	defer shutdown.close(shutdown.register("Recording of "+con.getName(), map[shutdownStage]func(){
+		shutdownConnections: con.Close,
+		shutdownRecorders:   rec.Close,
+	}))
+	if err := rec.setListeningRects(rects); err != nil {
+		return err
+	}
+
+	cliLog.Infof("Recording %v of %v, stop with Ctrl+C", rects, con.getName())
+	cliWait(*duration)
+
+	return nil
+}
+
+func cliReplay(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	rects := cliRects{}
+	fs.Var(&rects, "rect", "Rectangle x1,y1,x2,y2 of the canvas to write")
+	t := cliTime{}
+	fs.Var(&t, "time", "Point in time in RFC3339 format, e.g. 2019-06-14T12:00:00Z. Defaults to the end of the recordings")
+	fileName := fs.String("o", "replay.png", "Output file")
+	hash := fs.Bool("hash", false, "Replay all recordings without pacing, and print the number of events and the hash of the final canvas as JSON, instead of writing an image")
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+
+	if *hash {
+		result, err := canvasReplayDeterministic(positional[0])
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(result, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if len(rects) != 1 {
+		return fmt.Errorf("Exactly one rectangle must be given with -rect")
+	}
+
+	cfe, err := newCanvasFrameExtractor(positional[0])
+	if err != nil {
+		return err
+	}
+	defer cfe.Close()
+
+	if t.IsZero() {
+		_, t.Time = cfe.getTimeRange()
+	}
+
+	img, err := cfe.getFrame(t.Time, rects[0])
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", *fileName, err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		return fmt.Errorf("Can't write file %v: %v", *fileName, err)
+	}
+
+	cliLog.Infof("Written %v at %v to %v", rects[0], t.Time, *fileName)
+	return nil
+}
+
+func cliPNG(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("png", flag.ContinueOnError)
+	rects := cliRects{}
+	fs.Var(&rects, "rect", "Rectangle x1,y1,x2,y2 of the canvas")
+	fileName := fs.String("o", "canvas.png", "Output file")
+	wait := fs.Duration("wait", 30*time.Second, "Time to wait until the rectangle is downloaded, 0 writes it right away")
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+	if len(rects) != 1 {
+		return fmt.Errorf("Exactly one rectangle must be given with -rect")
+	}
+
+	game, err := api.getGame(positional[0])
+	if err != nil {
+		return err
+	}
+	if err := game.register(rects[0]); err != nil {
+		return err
+	}
+
+	if err := game.Canvas.exportPNG(rects[0], *fileName, *wait); err != nil {
+		return err
+	}
+	cliLog.Infof("Wrote %v of %v into %v", rects[0], positional[0], *fileName)
+
+	return nil
+}
+
+func cliDiff(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	rects := cliRects{}
+	fs.Var(&rects, "rect", "Rectangle x1,y1,x2,y2 of the canvas to compare")
+	a := fs.String("a", "", "First recordings as <game>[@<RFC3339>], the game can also be the address of another instance or a clip file. Defaults to the end of the recordings")
+	b := fs.String("b", "", "Second recordings, in the same form as -a")
+	fileName := fs.String("o", "diff.png", "Output file of the difference image, empty to skip it")
+	if _, err := cliParse(fs, args); err != nil {
+		return err
+	}
+	if len(rects) != 1 {
+		return fmt.Errorf("Exactly one rectangle must be given with -rect")
+	}
+
+	srcA, err := parseCanvasDiffSource(*a)
+	if err != nil {
+		return fmt.Errorf("Invalid -a: %v", err)
+	}
+	srcB, err := parseCanvasDiffSource(*b)
+	if err != nil {
+		return fmt.Errorf("Invalid -b: %v", err)
+	}
+
+	imgA, timeA, err := srcA.getImage(rects[0])
+	if err != nil {
+		return err
+	}
+	imgB, timeB, err := srcB.getImage(rects[0])
+	if err != nil {
+		return err
+	}
+
+	summary, diff := canvasDiff(imgA, imgB)
+	summary.A, summary.B, summary.TimeA, summary.TimeB = srcA.Name, srcB.Name, timeA, timeB
+
+	if *fileName != "" {
+		f, err := os.Create(*fileName)
+		if err != nil {
+			return fmt.Errorf("Can't create file %v: %v", *fileName, err)
+		}
+		defer f.Close()
+
+		if err := png.Encode(f, diff); err != nil {
+			return fmt.Errorf("Can't write file %v: %v", *fileName, err)
+		}
+		cliLog.Infof("Written difference image to %v", *fileName)
+	}
+
+	result, err := json.MarshalIndent(summary, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(result))
+
+	return nil
+}
+
+func cliExport(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	opts := exportOptions{}
+	params := exportJobParams{}
+	rects := cliRects{}
+	fs.Var(&rects, "rect", "Rectangle x1,y1,x2,y2 of the canvas to export")
+	startTime, endTime := cliTime{}, cliTime{}
+	fs.Var(&startTime, "start", "Start time in RFC3339 format. Defaults to the start of the recordings")
+	fs.Var(&endTime, "end", "End time in RFC3339 format. Defaults to the end of the recordings")
+	fs.Float64Var(&opts.Speedup, "speedup", 3600, "Recording time per output time")
+	fs.Float64Var(&opts.FrameRate, "fps", 30, "Frames per second of the output")
+	fs.Float64Var(&opts.Scale, "scale", 0, "Scaling factor of the output")
+	fs.IntVar(&opts.Upscale, "upscale", 0, "Integer scaling factor with crisp pixels")
+	fs.BoolVar(&opts.Dither, "dither", false, "Use dithering when colors need to be reduced")
+	fs.StringVar(&params.Ramp, "ramp", "", "Color ramp of heatmaps")
+	fs.BoolVar(&params.PixelsOnly, "pixels-only", false, "Only export pixel changes in event exports")
+	fs.StringVar(&params.Template, "template", "", "Template image of reports and forensics")
+	fs.DurationVar(&params.Interval, "interval", time.Hour, "Time between frames of contact sheets")
+	fs.IntVar(&params.Columns, "columns", 0, "Number of columns of contact sheets")
+	fs.StringVar(&params.Title, "title", "", "Title of clips")
+	fileName := fs.String("o", "", "Output file, or directory for tile exports")
+	positional, err := cliParse(fs, args, "kind", "game")
+	if err != nil {
+		return err
+	}
+
+	kind, ok := exportJobKinds[positional[0]]
+	if !ok {
+		names := []string{}
+		for name := range exportJobKinds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("Unknown export kind %q, available kinds: %v", positional[0], names)
+	}
+	if len(rects) != 1 {
+		return fmt.Errorf("Exactly one rectangle must be given with -rect")
+	}
+	if *fileName == "" {
+		return fmt.Errorf("No output file given, use -o")
+	}
+	opts.Rect, opts.StartTime, opts.EndTime = rects[0], startTime.Time, endTime.Time
+
+	lastLog := time.Now()
+	opts.Progress = func(done, total int) {
+		if time.Since(lastLog) >= 5*time.Second || done == total {
+			lastLog = time.Now()
+			cliLog.Infof("%v: %v of %v done", kind.Name, done, total)
+		}
+	}
+
+	if err := kind.FunctionRun(positional[1], opts, params, *fileName); err != nil {
+		return err
+	}
+
+	cliLog.Infof("Exported to %v", *fileName)
+	return nil
+}
+
+func cliSync(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	peer := canvasSyncPeer{}
+	fs.StringVar(&peer.Address, "peer", "", "Address of the API server of the other instance, e.g. http://192.168.1.10:8081")
+	fs.StringVar(&peer.Token, "token", "", "API token of the other instance")
+	fs.StringVar(&peer.Game, "peer-game", "", "Short name of the game on the other instance. Defaults to the local one")
+	rects := cliRects{}
+	fs.Var(&rects, "rect", "Rectangle x1,y1,x2,y2 of the canvas to synchronize")
+	startTime, endTime := cliTime{}, cliTime{}
+	fs.Var(&startTime, "start", "Start of the gap in RFC3339 format")
+	fs.Var(&endTime, "end", "End of the gap in RFC3339 format. Defaults to the start of the next local recording")
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+	if peer.Address == "" {
+		return fmt.Errorf("No peer given, use -peer")
+	}
+	if len(rects) != 1 {
+		return fmt.Errorf("Exactly one rectangle must be given with -rect")
+	}
+	if startTime.IsZero() {
+		return fmt.Errorf("No start time given, use -start")
+	}
+
+	result, err := canvasSyncFromPeer(peer, positional[0], rects[0], startTime.Time, endTime.Time)
+	if err != nil {
+		return err
+	}
+
+	if result.FileName == "" {
+		cliLog.Infof("All %v chunks of the peer are already recorded", result.Chunks)
+		return nil
+	}
+	cliLog.Infof("Took %v of %v chunks with %v events from the peer, and wrote them to %v", result.Missing, result.Chunks, result.Events, result.FileName)
+	return nil
+}
+
+func cliPalette(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("palette", flag.ContinueOnError)
+	rects := cliRects{}
+	fs.Var(&rects, "rect", "Rectangle x1,y1,x2,y2 of the canvas to sample")
+	duration := fs.Duration("duration", 30*time.Second, "Time to sample downloaded chunks and pixel changes")
+	save := fs.Bool("save", false, "Store the palette in the configuration at .palettes.<game>")
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+	if len(rects) != 1 {
+		return fmt.Errorf("Exactly one rectangle must be given with -rect")
+	}
+
+	con, can, err := cliConnectGame(positional[0])
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+
+	sampler := newPaletteSampler(rects[0])
+	if err := can.subscribeListener(sampler, false); err != nil {
+		return err
+	}
+	defer can.unsubscribeListener(sampler)
+	if err := can.registerRects(sampler, rects); err != nil {
+		return err
+	}
+
+	cliLog.Infof("Sampling %v of %v for %v, stop early with Ctrl+C", rects[0], con.getName(), *duration)
+	cliWait(*duration)
+
+	settings, err := sampler.getPalette()
+	if err != nil {
+		return err
+	}
+	cliLog.Infof("Found %v colors in %v sampled pixels", len(settings.Colors), sampler.getPixels())
+
+	if *save {
+		// Only the colors are replaced, names of colors are kept
+		if err := conf.Set(".palettes."+con.getShortName()+".Colors", settings.Colors); err != nil {
+			return fmt.Errorf("Can't store palette: %v", err)
+		}
+		cliLog.Infof("Stored the palette at .palettes.%v", con.getShortName())
+	}
+
+	data, err := json.MarshalIndent(settings, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	return nil
+}
+
+func cliIndex(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("index", flag.ContinueOnError)
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+
+	pi, err := openPixelIndex(positional[0])
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	result, err := pi.update()
+	if err != nil {
+		return err
+	}
+	cliLog.Infof("Indexed %v events with %v pixel changes from %v recordings in %v", result.Events, result.Changes, result.Recordings, time.Since(started))
+
+	return nil
+}
+
+func cliCompact(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	age := fs.String("age", "", "Compact recordings that ended longer ago than this, e.g. 720h. Defaults to CompactAge of the quota")
+	interval := fs.String("interval", "", "Time resolution of the compacted recordings, e.g. 1m. Defaults to CompactInterval of the quota")
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+	shortName := positional[0]
+
+	settings := getRetentionSettings()
+	quota := settings.getQuota(shortName)
+	if *age != "" {
+		quota.CompactAge = *age
+	}
+	if *interval != "" {
+		quota.CompactInterval = *interval
+	}
+	if err := quota.validate(); err != nil {
+		return err
+	}
+	if quota.getCompactAge() <= 0 {
+		return fmt.Errorf("No compaction age given, set -age or CompactAge in the quota of %v", shortName)
+	}
+	settings.Games = map[string]retentionQuota{shortName: quota}
+
+	// Interrupting keeps the recording that is compacted at the moment as it is
+	stop, done := make(chan struct{}), make(chan struct{})
+	var compacted int
+	started := time.Now()
+	go func() {
+		defer close(done)
+		compacted, err = retentionCompactGame(shortName, settings, stop)
+	}()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	defer signal.Stop(signalChan)
+
+	select {
+	case <-done:
+	case <-signalChan:
+		cliLog.Infof("Interrupted, stopping")
+		close(stop)
+		<-done
+	}
+	if err != nil {
+		return err
+	}
+	cliLog.Infof("Compacted %v recordings in %v", compacted, time.Since(started))
+
+	return nil
+}
+
+func cliAnonymize(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("anonymize", flag.ContinueOnError)
+	outDir := fs.String("o", "", "Directory of the anonymized recordings")
+	salt := fs.String("salt", "", "Secret that the pseudonyms are derived from. Anyone who knows it can check which user a pseudonym belongs to")
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+	if *outDir == "" {
+		return fmt.Errorf("No output directory given, set -o")
+	}
+
+	started := time.Now()
+	recordings, pixels, err := newRecordingAnonymizer(*salt).anonymizeGame(positional[0], *outDir)
+	if err != nil {
+		return err
+	}
+	cliLog.Infof("Anonymized %v pixels with author in %v recordings in %v", pixels, recordings, time.Since(started))
+
+	return nil
+}
+
+func cliStress(api *apiServer, args []string) error {
+	settings := defaultStressSettings
+	fs := flag.NewFlagSet("stress", flag.ContinueOnError)
+	rects := cliRects{}
+	fs.Var(&rects, "rect", fmt.Sprintf("Rectangle x1,y1,x2,y2 of the virtual canvas. Defaults to %v", formatRectangle(settings.Rect)))
+	fs.IntVar(&settings.Pixels, "pixels", settings.Pixels, "Number of pixel events")
+	fs.IntVar(&settings.Rate, "rate", settings.Rate, "Pixels per second, 0 sets them as fast as possible")
+	fs.IntVar(&settings.Listeners, "listeners", settings.Listeners, "Number of listeners that get every event")
+	fs.BoolVar(&settings.Record, "record", settings.Record, "Also record every event into recordings/stress/")
+	fs.BoolVar(&settings.Keep, "keep", settings.Keep, "Keep the recording afterwards")
+	fs.Int64Var(&settings.Seed, "seed", settings.Seed, "Seed of the random pixels")
+	maxHeap := fs.Float64("maxheap", 0, "Fail if the heap grows above this many MiB, 0 disables the check")
+	if _, err := cliParse(fs, args); err != nil {
+		return err
+	}
+	if len(rects) > 1 {
+		return fmt.Errorf("At most one rectangle can be given with -rect")
+	}
+	if len(rects) == 1 {
+		settings.Rect = rects[0]
+	}
+	if err := settings.validate(); err != nil {
+		return err
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	var report stressReport
+	var err error
+	go func() {
+		defer close(done)
+		report, err = runStress(settings, stop)
+	}()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	defer signal.Stop(signalChan)
+
+	select {
+	case <-done:
+	case <-signalChan:
+		cliLog.Infof("Interrupted, stopping")
+		close(stop)
+		<-done
+	}
+
+	data, jsonErr := json.MarshalIndent(report, "", "\t")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	fmt.Println(string(data))
+
+	if err != nil {
+		return err
+	}
+	if *maxHeap > 0 && report.PeakHeapMiB > *maxHeap {
+		return fmt.Errorf("Heap peaked at %.1f MiB, above the limit of %v MiB", report.PeakHeapMiB, *maxHeap)
+	}
+
+	return nil
+}
+
+func cliPixel(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("pixel", flag.ContinueOnError)
+	x := fs.Int("x", 0, "X coordinate of the pixel")
+	y := fs.Int("y", 0, "Y coordinate of the pixel")
+	t := cliTime{}
+	fs.Var(&t, "time", "Point in time in RFC3339 format, e.g. 2019-06-14T12:00:00Z. Defaults to the end of the index")
+	history := fs.Bool("history", false, "Also print all changes of the pixel until then")
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+
+	pi, err := openPixelIndex(positional[0])
+	if err != nil {
+		return err
+	}
+	result, err := pi.query(image.Point{*x, *y}, t.Time, *history)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(result, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	return nil
+}
+
+func cliSearch(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	rects := cliRects{}
+	fs.Var(&rects, "rect", "Rectangle x1,y1,x2,y2 of the canvas to search")
+	patternFile := fs.String("pattern", "", "Pattern to search for, as image or in the template formats of other bots")
+	tolerance := fs.Float64("tolerance", 0, fmt.Sprintf("Share of the pattern pixels that may differ, up to %v", templateSearchMaxTolerance))
+	maxMatches := fs.Int("max", templateSearchDefaultMatches, "Maximum number of matches")
+	live := fs.Bool("live", false, "Search the live canvas of the game instead of its recordings")
+	positional, err := cliParse(fs, args, "game")
+	if err != nil {
+		return err
+	}
+	if len(rects) != 1 {
+		return fmt.Errorf("Exactly one rectangle must be given with -rect")
+	}
+	if *patternFile == "" {
+		return fmt.Errorf("No pattern given, use -pattern")
+	}
+
+	src, err := parseCanvasDiffSource(positional[0])
+	if err != nil {
+		return err
+	}
+
+	var matches []templateMatch
+	if *live {
+		if !src.Time.IsZero() {
+			return fmt.Errorf("The live canvas can't be searched at a point in time")
+		}
+		pattern, err := loadTemplateSearchPattern(*patternFile, nil)
+		if err != nil {
+			return err
+		}
+		if matches, err = api.searchTemplate(src.Name, rects[0], pattern, *tolerance, *maxMatches, nil); err != nil {
+			return err
+		}
+		cliLog.Infof("Found %v matches on the live canvas of %v", len(matches), src.Name)
+	} else {
+		var t time.Time
+		if matches, t, err = searchTemplateRecordings(src, rects[0], *patternFile, *tolerance, *maxMatches); err != nil {
+			return err
+		}
+		cliLog.Infof("Found %v matches in the recordings of %v at %v", len(matches), src.Name, t)
+	}
+
+	data, err := json.MarshalIndent(matches, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	return nil
+}
+
+func cliBot(api *apiServer, args []string) error {
+	return fmt.Errorf("The bot isn't implemented yet")
+}
+
+func cliDaemon(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	if _, err := cliParse(fs, args); err != nil {
+		return err
+	}
+
+	d := newDaemon(conf)
+	defer d.Close()
+
+	cliLog.Infof("Running as daemon, stop with Ctrl+C")
+	cliWait(0)
+
+	return nil
+}
+
+func cliMacro(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("macro", flag.ContinueOnError)
+	delays := fs.Bool("delays", false, "Wait the recorded time between the steps")
+	list := fs.Bool("list", false, "List the stored macros instead")
+	positional, err := cliParse(fs, args, "name")
+	if *list {
+		for _, name := range listMacros() {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	m, err := loadMacro(positional[0])
+	if err != nil {
+		return err
+	}
+	results, err := runMacro(api, m, *delays)
+	if err != nil {
+		return err
+	}
+	for i, result := range results {
+		if result == nil {
+			continue
+		}
+		data, _ := json.Marshal(result)
+		cliLog.Infof("Step %v (%v) returned %s", i+1, m.Steps[i].Method, data)
+	}
+
+	// Exports run in the background, wait for them before everything is shut down
+	for {
+		pending := 0
+		for _, job := range exportJobs.getJobs() {
+			if job.State == exportJobQueued || job.State == exportJobRunning {
+				pending++
+			}
+		}
+		if pending == 0 {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return nil
+}
+
+func cliServe(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	address := fs.String("address", "", "Address of the API server. Defaults to the address in the configuration")
+	if _, err := cliParse(fs, args); err != nil {
+		return err
+	}
+
+	if *address != "" {
+		if err := api.setSettings(apiServerSettings{Address: *address}); err != nil {
+			return err
+		}
+	}
+
+	cliLog.Infof("Serving the API, stop with Ctrl+C")
+	cliWait(0)
+
+	return nil
+}
+
+func cliCtl(api *apiServer, args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	settings := controlSocketSettings{}
+	if conf != nil {
+		conf.Get(".control", &settings)
+	}
+	socketPath := fs.String("socket", settings.Socket, "Path of the control socket. Defaults to the socket in the configuration")
+
+	positional, err := cliParse(fs, args, "method", "params")
+	if err != nil && err != flag.ErrHelp {
+		// The params are optional
+		if positional, err = cliParse(fs, args, "method"); err != nil {
+			return err
+		}
+		positional = append(positional, "{}")
+	} else if err != nil {
+		return err
+	}
+	if *socketPath == "" {
+		return fmt.Errorf("No control socket given, use -socket or set it in the configuration")
+	}
+
+	result, err := controlSocketCall(*socketPath, positional[0], json.RawMessage(positional[1]))
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(result))
+
+	return nil
+}
+
+func cliHelp(api *apiServer, args []string) error {
+	names := []string{}
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"Usage: D3pixelbot [-debug localhost:6060] [command] [arguments]", "Without command, the user interface is opened.", "With -debug, profiles and traces are served at http://<address>/debug/pprof/.", "", "Commands:"}
+	for _, name := range names {
+		command := cliCommands[name]
+		lines = append(lines, fmt.Sprintf("  %v %v", name, command.Usage), "      "+command.Description)
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+
+	return nil
+}
@@ -0,0 +1,85 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_cliParse(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	rects := cliRects{}
+	fs.Var(&rects, "rect", "")
+	format := fs.String("format", "", "")
+
+	positional, err := cliParse(fs, []string{"-rect", "0,0,10,10", "pixelcanvasio", "-format", "sqlite", "-rect", "-5,-5,5,5"}, "game")
+	if err != nil {
+		t.Fatalf("Can't parse arguments: %v", err)
+	}
+	if !reflect.DeepEqual(positional, []string{"pixelcanvasio"}) {
+		t.Errorf("Got positional arguments %q, want %q", positional, []string{"pixelcanvasio"})
+	}
+	if want := (cliRects{image.Rect(0, 0, 10, 10), image.Rect(-5, -5, 5, 5)}); !reflect.DeepEqual(rects, want) {
+		t.Errorf("Got rectangles %v, want %v", rects, want)
+	}
+	if *format != "sqlite" {
+		t.Errorf("Got format %q, want %q", *format, "sqlite")
+	}
+
+	if _, err := cliParse(flag.NewFlagSet("test", flag.ContinueOnError), []string{"a", "b"}, "game"); err == nil {
+		t.Errorf("Too many positional arguments were accepted")
+	}
+}
+
+func Test_cliRun(t *testing.T) {
+	if err := cliRun(nil, []string{"unknown"}); err == nil {
+		t.Errorf("Unknown command succeeded")
+	}
+	if err := cliRun(nil, []string{"bot", "pixelcanvasio"}); err == nil {
+		t.Errorf("Bot command succeeded, but it's not implemented")
+	}
+
+	_, pos, frameTime := writeTestRecording(t, "Test-CLI")
+
+	fileName := filepath.Join(os.TempDir(), "D3pixelbot-Test-CLI.png")
+	defer os.Remove(fileName)
+
+	if err := cliRun(nil, []string{"replay", "Test-CLI", "-rect", "0,0,8,8", "-time", frameTime.Format(time.RFC3339Nano), "-o", fileName}); err != nil {
+		t.Fatalf("Replay command failed: %v", err)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Can't open output: %v", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Can't decode output: %v", err)
+	}
+	if got, want := color.RGBAModel.Convert(img.At(pos.X, pos.Y)), color.RGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+		t.Errorf("Pixel at %v = %v, want %v", pos, got, want)
+	}
+}
@@ -0,0 +1,308 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Dadido3/configdb"
+	"github.com/Dadido3/configdb/tree"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// Configuration files, in the order they are looked for in the configuration directory, see appDirectories.
+// The first one that exists is used, otherwise config.json is created when something is changed.
+var configFileNames = []string{"config.yaml", "config.yml", "config.json"}
+
+// Directories where files are stored, stored in the configuration at .paths.
+// Relative paths are relative to the data directory, tiles and the pixel index to the cache directory. See appDirectories.
+type pathSettings struct {
+	Recordings string
+	Snapshots  string
+	Reports    string
+	Tiles      string
+	Index      string
+	Logs       string
+	Macros     string
+	Exports    string // Output of exports and images that are requested over the control socket and webhooks
+}
+
+// Settings of the log, stored in the configuration at .log
+type logSettings struct {
+	Level    string // One of "panic", "fatal", "error", "warn", "info", "debug" or "trace"
+	Format   string // Format of the log files, "text" or "json". The console always gets colored text
+	MaxSize  int    // Size in MiB after which a new log file is started. 0 never rotates
+	MaxFiles int    // Maximum number of log files that are kept. 0 keeps everything
+}
+
+// Settings of the export jobs, stored in the configuration at .exports
+type exportSettings struct {
+	Workers    int // Maximum number of exports that run at the same time
+	SpillLimit int // Memory in MiB for the chunks of each export or replay, above which cold chunks are moved to a temporary directory. 0 disables it
+}
+
+var defaultPathSettings = pathSettings{
+	Recordings: "recordings",
+	Snapshots:  "snapshots",
+	Reports:    "reports",
+	Tiles:      "tiles",
+	Index:      "pixelindex",
+	Logs:       "log",
+	Macros:     "macros",
+	Exports:    "exports",
+}
+
+var defaultLogSettings = logSettings{
+	Level:    "trace",
+	Format:   "text",
+	MaxSize:  10,
+	MaxFiles: 20,
+}
+
+var defaultExportSettings = exportSettings{
+	Workers: 2,
+}
+
+func (s pathSettings) validate() error {
+	if s.Recordings == "" || s.Snapshots == "" || s.Reports == "" || s.Tiles == "" || s.Index == "" || s.Logs == "" || s.Macros == "" || s.Exports == "" {
+		return fmt.Errorf("Paths must not be empty")
+	}
+	return nil
+}
+
+func (s logSettings) validate() error {
+	if _, err := logrus.ParseLevel(s.Level); err != nil {
+		return err
+	}
+	if _, ok := logFormatters[s.Format]; !ok {
+		return fmt.Errorf("Unknown log format %q", s.Format)
+	}
+	if s.MaxSize < 0 || s.MaxFiles < 0 {
+		return fmt.Errorf("Log limits must not be negative")
+	}
+	return nil
+}
+
+func (s exportSettings) validate() error {
+	if s.Workers < 1 {
+		return fmt.Errorf("Number of export workers %v is less than 1", s.Workers)
+	}
+	if s.SpillLimit < 0 {
+		return fmt.Errorf("Spill limit %v must not be negative", s.SpillLimit)
+	}
+	return nil
+}
+
+// Returns the storages of the configuration.
+// The configuration file has the highest priority, changes are written into it.
+// Everything that isn't set in the file is taken from the defaults.
+func configStorages() []configdb.Storage {
+	fileName := configFileNames[len(configFileNames)-1]
+	for _, name := range configFileNames {
+		if _, err := os.Stat(filepath.Join(dirs.Config, name)); err == nil {
+			fileName = name
+			break
+		}
+	}
+
+	file := &configFile{path: filepath.Join(dirs.Config, fileName)}
+	switch filepath.Ext(fileName) {
+	case ".yaml", ".yml":
+		file.Storage = configdb.UseYAMLFile(file.path)
+	default:
+		file.Storage = configdb.UseJSONFile(file.path)
+	}
+
+	defaults := configDefaults{file: file.Storage, profiles: map[string]configdb.Storage{}}
+	for name, settings := range configProfiles {
+		defaults.profiles[name] = configdb.UseDummyStorage("", settings)
+	}
+
+	return []configdb.Storage{file, defaults}
+}
+
+// Storage of the default settings of the profile that is selected in the file.
+//
+// configdb merges the storages into the tree it reads from the storage with the lowest priority.
+// Without a copy, the defaults would be overwritten and changes of the file wouldn't be detected anymore.
+type configDefaults struct {
+	file     configdb.Storage
+	profiles map[string]configdb.Storage
+}
+
+func (d configDefaults) Read() (tree.Node, error) {
+	name := defaultProfileSettings.Name
+	if t, err := d.file.Read(); err == nil {
+		name = t.GetString(".profile.Name", name)
+	}
+	profile, ok := d.profiles[name]
+	if !ok {
+		profile = d.profiles[defaultProfileSettings.Name] // The unknown name is logged by the callback of the profile
+	}
+
+	t, err := profile.Read()
+	if err != nil {
+		return nil, err
+	}
+	return t.Copy(), nil
+}
+
+// Defaults can't be changed, changes are written into the file
+func (d configDefaults) Write(t tree.Node) error {
+	return fmt.Errorf("Defaults can't be changed")
+}
+
+// Defaults of a profile don't change, selecting another profile is a change of the file
+func (d configDefaults) RegisterWatcher(changeChan chan<- struct{}) error {
+	return nil
+}
+
+// Configuration file that is watched for changes, so they are applied while running.
+//
+// The directory is watched instead of the file, as editors and configdb itself replace the file with a renamed temporary file.
+// A watch on the file would end with the first replacement.
+type configFile struct {
+	configdb.Storage
+	path string
+
+	watcher *fsnotify.Watcher
+}
+
+// Signals changes of the file on changeChan. A nil channel stops watching.
+func (f *configFile) RegisterWatcher(changeChan chan<- struct{}) error {
+	if f.watcher != nil {
+		if err := f.watcher.Close(); err != nil {
+			return err
+		}
+		f.watcher = nil
+	}
+
+	if changeChan == nil {
+		return nil
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != f.path {
+					continue
+				}
+				// Don't block, a pending signal reloads everything anyway
+				select {
+				case changeChan <- struct{}{}:
+				default:
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Warnf("Can't watch configuration file %v: %v", f.path, err)
+			}
+		}
+	}()
+
+	if err := w.Add(filepath.Dir(f.path)); err != nil {
+		w.Close()
+		return err
+	}
+
+	f.watcher = w
+	return nil
+}
+
+// Reads the settings at path into the struct that settings points to, and validates them.
+// Returns false and logs the error if they can't be read or are invalid, the caller should use the defaults then.
+func configGet(c *configdb.Config, path string, settings interface{ validate() error }) bool {
+	err := c.Get(path, settings)
+	if err == nil {
+		err = settings.validate()
+	}
+	if err != nil {
+		log.Errorf("Invalid settings at %v, using the defaults: %v", path, err)
+		return false
+	}
+	return true
+}
+
+var pathsMutex sync.RWMutex
+var paths = defaultPathSettings
+
+// Changes the directories where files are stored. Files that are already open stay where they are
+func setPathSettings(s pathSettings) {
+	pathsMutex.Lock()
+	defer pathsMutex.Unlock()
+
+	paths = s
+}
+
+// Returns the current path settings
+func getPaths() pathSettings {
+	pathsMutex.RLock()
+	defer pathsMutex.RUnlock()
+
+	return paths
+}
+
+var exportsMutex sync.RWMutex
+var exports = defaultExportSettings
+
+// Changes the export settings, running exports keep their settings
+func setExportSettings(s exportSettings) {
+	exportsMutex.Lock()
+	defer exportsMutex.Unlock()
+
+	exports = s
+}
+
+// Returns the current export settings
+func getExportSettings() exportSettings {
+	exportsMutex.RLock()
+	defer exportsMutex.RUnlock()
+
+	return exports
+}
+
+// Returns the path of elem inside of dir, which is one of the directories of the path settings.
+// For example dataPath(getPaths().Recordings, shortName)
+func dataPath(dir string, elem ...string) string {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(dirs.Data, dir)
+	}
+	return filepath.Join(append([]string{dir}, elem...)...)
+}
+
+// Like dataPath, but relative directories are inside of the cache directory.
+// For example cachePath(getPaths().Tiles, shortName)
+func cachePath(dir string, elem ...string) string {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(dirs.Cache, dir)
+	}
+	return filepath.Join(append([]string{dir}, elem...)...)
+}
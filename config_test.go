@@ -0,0 +1,179 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+func Test_configStorages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-test-config")
+	if err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	yaml := "paths:\n  Recordings: /data/recordings\nlog:\n  Level: verbose\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.yaml"), []byte(yaml), 0666); err != nil {
+		t.Fatalf("Can't write configuration: %v", err)
+	}
+
+	oldDirs := dirs
+	dirs = appDirectories{Config: dir, Data: dir, Cache: dir}
+	defer func() { dirs = oldDirs }()
+
+	c, err := configdb.New(configStorages())
+	if err != nil {
+		t.Fatalf("Can't load configuration: %v", err)
+	}
+	defer c.Close()
+
+	paths := pathSettings{}
+	if !configGet(c, ".paths", &paths) {
+		t.Fatalf("Paths are invalid")
+	}
+	if paths.Recordings != "/data/recordings" || paths.Snapshots != defaultPathSettings.Snapshots {
+		t.Errorf("Got paths %+v, want the recordings from the file and defaults for the rest", paths)
+	}
+	if got, want := dataPath(paths.Snapshots, "game"), filepath.Join(dir, "snapshots", "game"); got != want {
+		t.Errorf("Got snapshot path %v, want %v", got, want)
+	}
+
+	if settings := (logSettings{}); configGet(c, ".log", &settings) {
+		t.Errorf("Invalid log level %q was accepted", settings.Level)
+	}
+
+	exports := exportSettings{}
+	if !configGet(c, ".exports", &exports) || exports != defaultExportSettings {
+		t.Errorf("Got export settings %+v, want the defaults %+v", exports, defaultExportSettings)
+	}
+}
+
+func Test_configFileWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-test-config")
+	if err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Replace the file like editors do, the watch has to survive that
+	path := filepath.Join(dir, "config.yaml")
+	writeLevel := func(level string) {
+		if err := ioutil.WriteFile(path+".tmp", []byte("log:\n  Level: "+level+"\n"), 0666); err != nil {
+			t.Fatalf("Can't write configuration: %v", err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatalf("Can't replace configuration: %v", err)
+		}
+	}
+	writeLevel("info")
+
+	oldDirs := dirs
+	dirs = appDirectories{Config: dir, Data: dir, Cache: dir}
+	defer func() { dirs = oldDirs }()
+
+	c, err := configdb.New(configStorages())
+	if err != nil {
+		t.Fatalf("Can't load configuration: %v", err)
+	}
+	defer c.Close()
+
+	levels := make(chan string, 10)
+	id := c.RegisterCallback([]string{".log"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := logSettings{}
+		c.Get(".log", &settings)
+		levels <- settings.Level
+	})
+	defer c.UnregisterCallback(id)
+
+	for _, want := range []string{"info", "debug", "warn"} {
+		if want != "info" {
+			time.Sleep(100 * time.Millisecond) // configdb starts watching in the background
+			writeLevel(want)
+		}
+		select {
+		case got := <-levels:
+			if got != want {
+				t.Errorf("Got log level %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Change to log level %q wasn't applied", want)
+		}
+	}
+}
+
+func Test_configProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-test-config")
+	if err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDirs := dirs
+	dirs = appDirectories{Config: dir, Data: dir, Cache: dir}
+	defer func() { dirs = oldDirs }()
+
+	// The profile changes the defaults, the file still takes precedence
+	yaml := "profile:\n  Name: lowmemory\nmemory:\n  SoftLimit: 128\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.yaml"), []byte(yaml), 0666); err != nil {
+		t.Fatalf("Can't write configuration: %v", err)
+	}
+	c, err := configdb.New(configStorages())
+	if err != nil {
+		t.Fatalf("Can't load configuration: %v", err)
+	}
+	defer c.Close()
+
+	profile := profileSettings{}
+	if !configGet(c, ".profile", &profile) || !profile.DisableUI {
+		t.Errorf("Got profile %+v, want the lowmemory profile with disabled user interface", profile)
+	}
+	memory := memorySettings{}
+	if !configGet(c, ".memory", &memory) || memory.SoftLimit != 128 || !memory.SmallQueues {
+		t.Errorf("Got memory settings %+v, want the soft limit of the file and small queues of the profile", memory)
+	}
+	chunks := chunkPolicySettings{}
+	if !configGet(c, ".chunks", &chunks) || !chunks.PalettedOnly {
+		t.Errorf("Got chunk settings %+v, want paletted only chunks", chunks)
+	}
+	paths := pathSettings{}
+	if !configGet(c, ".paths", &paths) || paths != defaultPathSettings {
+		t.Errorf("Got paths %+v, want the defaults %+v", paths, defaultPathSettings)
+	}
+
+	// Unknown profiles fall back to the defaults
+	if err := (profileSettings{Name: "tiny"}).validate(); err == nil {
+		t.Errorf("Unknown profile is valid")
+	}
+	defaults := configDefaults{file: configdb.UseDummyStorage("", map[string]interface{}{"profile": profileSettings{Name: "tiny"}}), profiles: map[string]configdb.Storage{}}
+	for name, settings := range configProfiles {
+		defaults.profiles[name] = configdb.UseDummyStorage("", settings)
+	}
+	tree, err := defaults.Read()
+	if err != nil {
+		t.Fatalf("Can't read defaults: %v", err)
+	}
+	if err := tree.Get(".memory", &memory); err != nil || memory != defaultMemorySettings {
+		t.Errorf("Got memory settings %+v, want the defaults %+v", memory, defaultMemorySettings)
+	}
+}
@@ -16,7 +16,11 @@
 
 package main
 
-import "time"
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
 type connection interface {
 	getShortName() string // Return short and filesystem friendly name, also used as internal identifier
@@ -43,3 +47,51 @@ type connectionType struct {
 }
 
 var connectionTypes = map[string]connectionType{}
+
+// Connection that is currently open, together with its canvas
+type openConnection struct {
+	Connection connection
+	Canvas     *canvas
+}
+
+// Open connections by their short name, regardless of whether they were opened by the UI, the API or the daemon
+var openConnections = struct {
+	sync.Mutex
+	games map[string]openConnection
+}{
+	games: map[string]openConnection{},
+}
+
+// Adds a connection to the open connections, and attaches the listener plugins to it. Call unregisterConnection when it's closed
+func registerConnection(con connection, can *canvas) {
+	openConnections.Lock()
+	openConnections.games[con.getShortName()] = openConnection{con, can}
+	openConnections.Unlock()
+
+	attachListenerPlugins(con, can)
+}
+
+func unregisterConnection(con connection) {
+	detachListenerPlugins(con)
+
+	openConnections.Lock()
+	defer openConnections.Unlock()
+
+	if openConnections.games[con.getShortName()].Connection == con {
+		delete(openConnections.games, con.getShortName())
+	}
+}
+
+// Returns all open connections, sorted by their short name
+func getOpenConnections() []openConnection {
+	openConnections.Lock()
+	defer openConnections.Unlock()
+
+	result := make([]openConnection, 0, len(openConnections.games))
+	for _, game := range openConnections.games {
+		result = append(result, game)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Connection.getShortName() < result[j].Connection.getShortName() })
+
+	return result
+}
@@ -0,0 +1,668 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var controlLog = moduleLog("control")
+
+// Settings of the control socket, stored in the configuration at .control
+type controlSocketSettings struct {
+	Socket string // Path of the unix socket, e.g. "d3pixelbot.sock". The control socket is disabled if this is empty
+}
+
+// JSON-RPC 2.0 error codes
+const (
+	controlSocketParseError     = -32700
+	controlSocketInvalidRequest = -32600
+	controlSocketMethodNotFound = -32601
+	controlSocketInvalidParams  = -32602
+	controlSocketServerError    = -32000
+)
+
+// A method of the control socket. params is the raw JSON of the request's params, and may be empty
+type controlSocketMethod func(as *apiServer, params json.RawMessage) (interface{}, error)
+
+// Methods of the control socket, with the names used in the requests.
+// Rectangles are given as strings in the form "x1,y1,x2,y2", times in RFC3339 format.
+var controlSocketMethods = map[string]controlSocketMethod{
+	"status": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		return as.getStatus(), nil
+	},
+	"dashboard": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		return getDashboard(), nil
+	},
+	"downloadFailures": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game string `json:"game"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		game, err := as.getGame(p.Game)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return game.Canvas.getDownloadFailures(), nil
+	},
+	"canvasStats": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game string `json:"game"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		game, err := as.getGame(p.Game)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return game.Canvas.stats(), nil
+	},
+	"memoryUsage": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		return getMemoryUsage(), nil
+	},
+	"crashes": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		return getCrashReports(), nil
+	},
+	"statistics": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game  string    `json:"game"`
+			Since time.Time `json:"since"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		series, err := as.getStatistics(p.Game, p.Since)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return series, nil
+	},
+	"heatmap": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game   string `json:"game"`
+			Rect   string `json:"rect"`   // The whole canvas if empty
+			Window string `json:"window"` // The whole window of the heatmap if empty
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		var rect image.Rectangle
+		var window time.Duration
+		var err error
+		if p.Rect != "" {
+			if rect, err = parseRectangle(p.Rect); err != nil {
+				return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+			}
+		}
+		if p.Window != "" {
+			if window, err = time.ParseDuration(p.Window); err != nil {
+				return nil, controlSocketError{controlSocketInvalidParams, fmt.Sprintf("Invalid window %q: %v", p.Window, err)}
+			}
+		}
+		entries, err := as.getHeatmap(p.Game, rect, window)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return entries, nil
+	},
+	"pixel": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game    string    `json:"game"`
+			X       int       `json:"x"`
+			Y       int       `json:"y"`
+			Time    time.Time `json:"time"`
+			History bool      `json:"history"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		pi, err := openPixelIndex(p.Game)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return pi.query(image.Point{p.X, p.Y}, p.Time, p.History)
+	},
+	"pixelHistory": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game string `json:"game"`
+			X    int    `json:"x"`
+			Y    int    `json:"y"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		changes, err := as.getPixelHistory(p.Game, image.Point{p.X, p.Y})
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return changes, nil
+	},
+	"alerts": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game string `json:"game"` // All games if empty
+		}{}
+		if len(params) > 0 {
+			if err := controlSocketParams(params, &p); err != nil {
+				return nil, err
+			}
+		}
+		return getCanvasWatchAlerts(p.Game), nil
+	},
+	"announcePlacement": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game  string    `json:"game"`
+			X     int       `json:"x"`
+			Y     int       `json:"y"`
+			Color string    `json:"color"` // Hex notation, e.g. "#E50000"
+			Time  time.Time `json:"time"`  // When the pixel was placed, now if omitted
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		pal, err := (paletteSettings{Colors: []string{p.Color}}).getPalette()
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		if err := as.announcePlacement(p.Game, image.Point{p.X, p.Y}, pal[0], p.Time); err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return nil, nil
+	},
+	"latency": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game string `json:"game"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		report, err := as.getLatency(p.Game)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return report, nil
+	},
+	"searchTemplate": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game      string  `json:"game"`
+			Pattern   string  `json:"pattern"` // File name of the pattern, see loadTemplates
+			Rect      string  `json:"rect"`    // All loaded chunks if empty
+			Tolerance float64 `json:"tolerance"`
+			Max       int     `json:"max"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		rect := image.Rectangle{}
+		if p.Rect != "" {
+			var err error
+			if rect, err = parseRectangle(p.Rect); err != nil {
+				return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+			}
+		}
+		pattern, err := loadTemplateSearchPattern(p.Pattern, nil)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return as.searchTemplate(p.Game, rect, pattern, p.Tolerance, p.Max, nil)
+	},
+	"diskUsage": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		return getRetentionDiskUsage(), nil
+	},
+	"listGames": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		return apiListGames(), nil
+	},
+	"listRecordings": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		return apiListRecordings(), nil
+	},
+	"startRecording": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game        string   `json:"game"`
+			Rects       []string `json:"rects"`
+			Format      string   `json:"format"`
+			Compression int      `json:"compression"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		rects := []image.Rectangle{}
+		for _, s := range p.Rects {
+			rect, err := parseRectangle(s)
+			if err != nil {
+				return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+			}
+			rects = append(rects, rect)
+		}
+		return nil, as.startRecording(p.Game, rects, canvasRecorderSettings{Format: p.Format, Compression: p.Compression})
+	},
+	"stopRecording": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game string `json:"game"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, as.stopRecording(p.Game)
+	},
+	"openReplay": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game string `json:"game"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		return as.openReplay(p.Game)
+	},
+	"setReplayTime": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Replay string    `json:"replay"`
+			Time   time.Time `json:"time"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, as.setReplayTime(p.Replay, p.Time)
+	},
+	"closeReplay": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Replay string `json:"replay"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, as.closeReplay(p.Replay)
+	},
+	"saveImage": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Game     string `json:"game"`
+			Rect     string `json:"rect"`
+			Width    int    `json:"width"`    // Unscaled if 0
+			Height   int    `json:"height"`   // Unscaled if 0
+			FileName string `json:"fileName"` // Relative to the exports directory, "{time}" is replaced by the current time
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		rect, err := parseRectangle(p.Rect)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		if err := apiCheckFileName(p.FileName); err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		size := pixelSize{p.Width, p.Height}
+		if size.X == 0 && size.Y == 0 {
+			size = pixelSize{rect.Dx(), rect.Dy()}
+		}
+		fileName := strings.Replace(p.FileName, "{time}", time.Now().UTC().Format("2006-01-02T150405"), -1)
+		return nil, as.saveImage(p.Game, rect, size, fileName)
+	},
+	"queueExport": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Kind       string    `json:"kind"`
+			Game       string    `json:"game"`
+			Rect       string    `json:"rect"`
+			Start      time.Time `json:"start"`
+			End        time.Time `json:"end"`
+			Speedup    float64   `json:"speedup"`
+			FrameRate  float64   `json:"fps"`
+			Upscale    int       `json:"upscale"`
+			Ramp       string    `json:"ramp"`
+			PixelsOnly bool      `json:"pixelsOnly"`
+			Template   string    `json:"template"`
+			Title      string    `json:"title"`
+			FileName   string    `json:"fileName"` // Relative to the exports directory, "{time}" is replaced by the current time
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		rect, err := parseRectangle(p.Rect)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		if p.FileName == "" {
+			return nil, controlSocketError{controlSocketInvalidParams, "Missing fileName"}
+		}
+		opts := exportOptions{Rect: rect, StartTime: p.Start, EndTime: p.End, Speedup: p.Speedup, FrameRate: p.FrameRate, Upscale: p.Upscale}
+		jobParams := exportJobParams{Ramp: p.Ramp, PixelsOnly: p.PixelsOnly, Template: p.Template, Title: p.Title}
+		fileName := strings.Replace(p.FileName, "{time}", time.Now().UTC().Format("2006-01-02T150405"), -1)
+		id, err := apiQueueExport(p.Kind, p.Game, opts, jobParams, fileName)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return struct {
+			ID int `json:"id"`
+		}{id}, nil
+	},
+	"getExport": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			ID int `json:"id"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		job, err := exportJobs.getJob(p.ID)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		status := struct {
+			ID       int            `json:"id"`
+			Kind     string         `json:"kind"`
+			Game     string         `json:"game"`
+			FileName string         `json:"fileName"`
+			State    exportJobState `json:"state"`
+			Done     int            `json:"done"`
+			Total    int            `json:"total"`
+			Error    string         `json:"error,omitempty"`
+		}{job.ID, job.Kind, job.ShortName, job.FileName, job.State, job.Done, job.Total, ""}
+		if job.Err != nil {
+			status.Error = job.Err.Error()
+		}
+		return status, nil
+	},
+	"listMacros": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		return listMacros(), nil
+	},
+	"startMacro": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Name string `json:"name"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		if err := startMacroRecording(p.Name); err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return nil, nil
+	},
+	"stopMacro": func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		return stopMacroRecording()
+	},
+}
+
+func init() {
+	// Assigned in init, as runMacro calls the other methods
+	controlSocketMethods["runMacro"] = func(as *apiServer, params json.RawMessage) (interface{}, error) {
+		p := struct {
+			Name   string `json:"name"`
+			Delays bool   `json:"delays"`
+		}{}
+		if err := controlSocketParams(params, &p); err != nil {
+			return nil, err
+		}
+		m, err := loadMacro(p.Name)
+		if err != nil {
+			return nil, controlSocketError{controlSocketInvalidParams, err.Error()}
+		}
+		return runMacro(as, m, p.Delays)
+	}
+}
+
+// Error with a JSON-RPC error code
+type controlSocketError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e controlSocketError) Error() string {
+	return e.Message
+}
+
+func controlSocketParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return controlSocketError{controlSocketInvalidParams, "Missing params"}
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return controlSocketError{controlSocketInvalidParams, fmt.Sprintf("Invalid params: %v", err)}
+	}
+	return nil
+}
+
+type controlSocketRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"` // Not set for notifications
+}
+
+type controlSocketResponse struct {
+	JSONRPC string              `json:"jsonrpc"`
+	Result  interface{}         `json:"result,omitempty"`
+	Error   *controlSocketError `json:"error,omitempty"`
+	ID      json.RawMessage     `json:"id"`
+}
+
+// Local JSON-RPC 2.0 interface on a unix socket, to control a running instance from shell scripts.
+//
+// Requests and responses are JSON objects separated by newlines, e.g. with socat:
+//
+//	echo '{"jsonrpc": "2.0", "method": "status", "id": 1}' | socat - UNIX-CONNECT:d3pixelbot.sock
+//
+// See controlSocketMethods for the available methods.
+type controlSocket struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	API *apiServer
+
+	settingsChan chan controlSocketSettings
+	quitChan     chan struct{}
+	waitGroup    sync.WaitGroup
+}
+
+func newControlSocket(as *apiServer) *controlSocket {
+	cs := &controlSocket{
+		API:          as,
+		settingsChan: make(chan controlSocketSettings),
+		quitChan:     make(chan struct{}),
+	}
+
+	cs.waitGroup.Add(1)
+	go func() {
+		defer cs.waitGroup.Done()
+
+		var listener net.Listener
+		stop := func() {
+			if listener != nil {
+				listener.Close() // Also removes the socket file
+				listener = nil
+			}
+		}
+		defer stop()
+
+		for {
+			select {
+			case settings := <-cs.settingsChan:
+				stop()
+				if settings.Socket != "" {
+					var err error
+					if listener, err = cs.listen(settings.Socket); err != nil {
+						controlLog.Errorf("Can't start control socket: %v", err)
+					}
+				}
+			case <-cs.quitChan:
+				return
+			}
+		}
+	}()
+
+	return cs
+}
+
+// Changes the settings of the control socket, the socket is reopened if needed
+func (cs *controlSocket) setSettings(settings controlSocketSettings) error {
+	cs.ClosedMutex.RLock()
+	defer cs.ClosedMutex.RUnlock()
+	if cs.Closed {
+		return fmt.Errorf("Control socket is closed")
+	}
+
+	cs.settingsChan <- settings
+
+	return nil
+}
+
+// Listens on the unix socket at socketPath, and handles connections in the background
+func (cs *controlSocket) listen(socketPath string) (net.Listener, error) {
+	// Remove the socket of an instance that didn't exit cleanly, but not the one of a running instance
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v is used by another instance", socketPath)
+		}
+		os.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(socketPath, 0600) // Only the own user may control the instance
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go cs.handleConnection(conn)
+		}
+	}()
+
+	return listener, nil
+}
+
+// Answers requests until the connection is closed
+func (cs *controlSocket) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	encoder := json.NewEncoder(conn)
+
+	for {
+		request := controlSocketRequest{}
+		if err := decoder.Decode(&request); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				encoder.Encode(controlSocketResponse{JSONRPC: "2.0", Error: &controlSocketError{controlSocketParseError, err.Error()}, ID: json.RawMessage("null")})
+			}
+			return
+		}
+
+		response := cs.handleRequest(request)
+		if len(request.ID) == 0 {
+			continue // Notifications don't get a response
+		}
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+func (cs *controlSocket) handleRequest(request controlSocketRequest) controlSocketResponse {
+	response := controlSocketResponse{JSONRPC: "2.0", ID: request.ID}
+
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		response.Error = &controlSocketError{controlSocketInvalidRequest, "Invalid request"}
+		return response
+	}
+
+	method, ok := controlSocketMethods[request.Method]
+	if !ok {
+		response.Error = &controlSocketError{controlSocketMethodNotFound, fmt.Sprintf("Unknown method %q, available methods: %v", request.Method, controlSocketMethodNames())}
+		return response
+	}
+
+	result, err := method(cs.API, request.Params)
+	switch err := err.(type) {
+	case nil:
+		if result == nil {
+			result = true // Result must be set on success
+		}
+		response.Result = result
+	case controlSocketError:
+		response.Error = &err
+	default:
+		response.Error = &controlSocketError{controlSocketServerError, err.Error()}
+	}
+
+	return response
+}
+
+// Returns the names of all methods of the control socket
+func controlSocketMethodNames() []string {
+	names := []string{}
+	for name := range controlSocketMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Closes the control socket. Open connections stay open until the clients close them
+func (cs *controlSocket) Close() {
+	cs.ClosedMutex.Lock()
+	defer cs.ClosedMutex.Unlock()
+	if cs.Closed {
+		return
+	}
+	cs.Closed = true
+
+	close(cs.quitChan)
+	cs.waitGroup.Wait()
+}
+
+// Sends a single request to the control socket at socketPath, and returns the result
+func controlSocketCall(socketPath, method string, params interface{}) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	request := controlSocketRequest{JSONRPC: "2.0", Method: method, Params: rawParams, ID: json.RawMessage("1")}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, err
+	}
+
+	response := struct {
+		Result json.RawMessage     `json:"result"`
+		Error  *controlSocketError `json:"error"`
+	}{}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, fmt.Errorf("Can't read response: %v", err)
+	}
+	if response.Error != nil {
+		return nil, fmt.Errorf("%v (code %v)", response.Error.Message, response.Error.Code)
+	}
+
+	return response.Result, nil
+}
@@ -0,0 +1,105 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_controlSocket(t *testing.T) {
+	useTestRecordingsDir(t)
+	registerAPIServerTestGame()
+	defer delete(connectionTypes, "apitest")
+
+	dir, err := ioutil.TempDir("", "D3pixelbot-Test-ControlSocket")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "d3pixelbot.sock")
+
+	as := newAPIServer()
+	defer as.Close()
+	cs := newControlSocket(as)
+	defer cs.Close()
+	cs.setSettings(controlSocketSettings{Socket: socketPath})
+
+	// Wait until the socket is opened
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := controlSocketCall(socketPath, "startRecording", map[string]interface{}{"game": "apitest", "rects": []string{"0,0,64,64"}}); err != nil {
+		t.Fatalf("Can't start recording: %v", err)
+	}
+
+	result, err := controlSocketCall(socketPath, "status", nil)
+	if err != nil {
+		t.Fatalf("Can't get status: %v", err)
+	}
+	status := []apiGameStatus{}
+	if err := json.Unmarshal(result, &status); err != nil {
+		t.Fatalf("Can't parse status %s: %v", result, err)
+	}
+	if len(status) != 1 || status[0].ShortName != "apitest" || !status[0].Recording {
+		t.Errorf("Got status %s, want apitest to be recorded", result)
+	}
+
+	if _, err := controlSocketCall(socketPath, "stopRecording", map[string]string{"game": "apitest"}); err != nil {
+		t.Errorf("Can't stop recording: %v", err)
+	}
+	if _, err := controlSocketCall(socketPath, "stopRecording", map[string]string{"game": "apitest"}); err == nil {
+		t.Errorf("Stopping recording twice succeeded, but it should fail")
+	}
+	if _, err := controlSocketCall(socketPath, "startRecording", map[string]interface{}{"game": "apitest", "rects": []string{"0,0"}}); err == nil || !strings.Contains(err.Error(), "-32602") {
+		t.Errorf("Got error %v for invalid rectangle, want invalid params error", err)
+	}
+	if _, err := controlSocketCall(socketPath, "unknown", nil); err == nil || !strings.Contains(err.Error(), "-32601") {
+		t.Errorf("Got error %v for unknown method, want method not found error", err)
+	}
+
+	// A second instance must not take over the socket
+	cs2 := newControlSocket(as)
+	defer cs2.Close()
+	if listener, err := cs2.listen(socketPath); err == nil {
+		listener.Close()
+		t.Errorf("Second instance could open the socket of a running instance")
+	}
+
+	// Notifications are not answered, the next request is
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Can't connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(`{"jsonrpc": "2.0", "method": "listGames"}` + "\n" + `{"jsonrpc": "2.0", "method": "listGames", "id": "b"}` + "\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.Contains(line, `"id":"b"`) {
+		t.Errorf("Got response %q (error: %v), want the response to the second request", line, err)
+	}
+}
@@ -0,0 +1,148 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var crashLog = moduleLog("crash")
+
+// Number of crash reports that are kept for the crashes method of the control socket
+const crashReportsMax = 50
+
+// Delay before a crashed component is restarted. It doubles with every crash in a row, up to crashRestartMaxDelay
+const (
+	crashRestartDelay    = 1 * time.Second
+	crashRestartMaxDelay = 1 * time.Minute
+)
+
+// Report of a panic in a long-running goroutine
+type crashReport struct {
+	Component string    `json:"component"`
+	Time      time.Time `json:"time"`
+	Error     string    `json:"error"`
+	Stack     string    `json:"stack"`
+	Restart   bool      `json:"restart"` // The component is restarted after the crash
+}
+
+var crashes = struct {
+	sync.Mutex
+	reports   []crashReport
+	listeners map[int]func(crashReport)
+	nextID    int
+}{
+	listeners: map[int]func(crashReport){},
+}
+
+// Registers a function that is called with every new crash report, in the goroutine that crashed.
+//
+// The function must not block. The returned function unregisters it.
+func crashSubscribe(f func(crashReport)) (unsubscribe func()) {
+	crashes.Lock()
+	defer crashes.Unlock()
+
+	id := crashes.nextID
+	crashes.nextID++
+	crashes.listeners[id] = f
+
+	return func() {
+		crashes.Lock()
+		defer crashes.Unlock()
+		delete(crashes.listeners, id)
+	}
+}
+
+// Returns the latest crash reports, the oldest first
+func getCrashReports() []crashReport {
+	crashes.Lock()
+	defer crashes.Unlock()
+
+	return append([]crashReport{}, crashes.reports...)
+}
+
+// Logs the report with its stack trace, keeps it and hands it to the listeners
+func crashReportAdd(report crashReport) {
+	if report.Restart {
+		crashLog.Errorf("%v crashed and will be restarted: %v\n%s", report.Component, report.Error, report.Stack)
+	} else {
+		crashLog.Errorf("%v crashed: %v\n%s", report.Component, report.Error, report.Stack)
+	}
+
+	crashes.Lock()
+	crashes.reports = append(crashes.reports, report)
+	if len(crashes.reports) > crashReportsMax {
+		crashes.reports = append(crashes.reports[:0], crashes.reports[len(crashes.reports)-crashReportsMax:]...)
+	}
+	listeners := make([]func(crashReport), 0, len(crashes.listeners))
+	for _, f := range crashes.listeners {
+		listeners = append(listeners, f)
+	}
+	crashes.Unlock()
+
+	for _, f := range listeners {
+		f(report)
+	}
+}
+
+// Runs f, and reports a panic of it instead of crashing the whole program.
+//
+// Returns true if f panicked.
+// Deferred functions of f still run during the panic, so locks, wait groups and channels are released as usual.
+func crashProtect(component string, restart bool, f func()) (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			crashed = true
+			crashReportAdd(crashReport{
+				Component: component,
+				Time:      time.Now(),
+				Error:     fmt.Sprint(r),
+				Stack:     string(debug.Stack()),
+				Restart:   restart,
+			})
+		}
+	}()
+
+	f()
+	return false
+}
+
+// Runs f in the current goroutine, and reports panics of it.
+//
+// If restart is true, f is run again after a crash, until it returns normally.
+// f has to be able to start over, and has to return once its component is closed.
+func crashRun(component string, restart bool, f func()) {
+	delay := crashRestartDelay
+	for {
+		started := time.Now()
+		if !crashProtect(component, restart, f) || !restart {
+			return
+		}
+
+		// Reset the delay, if the component ran fine for a while
+		if time.Since(started) > crashRestartMaxDelay {
+			delay = crashRestartDelay
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > crashRestartMaxDelay {
+			delay = crashRestartMaxDelay
+		}
+	}
+}
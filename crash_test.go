@@ -0,0 +1,132 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_crashProtect(t *testing.T) {
+	reports := make(chan crashReport, 1)
+	unsubscribe := crashSubscribe(func(report crashReport) { reports <- report })
+	defer unsubscribe()
+
+	deferred := false
+	crashed := crashProtect("Test component", false, func() {
+		defer func() { deferred = true }()
+		panic("Test panic")
+	})
+	if !crashed {
+		t.Errorf("crashProtect() = false, want true")
+	}
+	if !deferred {
+		t.Errorf("Deferred function of the crashed function didn't run")
+	}
+
+	select {
+	case report := <-reports:
+		if report.Component != "Test component" || report.Error != "Test panic" {
+			t.Errorf("Got report of %q with error %q", report.Component, report.Error)
+		}
+		if !strings.Contains(report.Stack, "Test_crashProtect") {
+			t.Errorf("Stack trace doesn't contain the crashed function: %v", report.Stack)
+		}
+	default:
+		t.Fatalf("Listener didn't get a report")
+	}
+
+	if reports := getCrashReports(); len(reports) == 0 || reports[len(reports)-1].Component != "Test component" {
+		t.Errorf("Report isn't kept")
+	}
+
+	if crashProtect("Test component", false, func() {}) {
+		t.Errorf("crashProtect() = true for a function that didn't panic")
+	}
+}
+
+func Test_crashRun(t *testing.T) {
+	runs := 0
+	crashRun("Test component", true, func() {
+		if runs++; runs == 1 {
+			panic("Test panic")
+		}
+	})
+	if runs != 2 {
+		t.Errorf("Function ran %v times, want 2", runs)
+	}
+
+	runs = 0
+	crashRun("Test component", false, func() {
+		runs++
+		panic("Test panic")
+	})
+	if runs != 1 {
+		t.Errorf("Function ran %v times without restarts, want 1", runs)
+	}
+}
+
+// Listener that panics on every pixel at the origin
+type testPanickingListener struct {
+	testSlowListener
+}
+
+func (l *testPanickingListener) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	if pos == (image.Point{}) {
+		panic("Test panic")
+	}
+	return l.testSlowListener.handleSetPixel(pos, color, vcID)
+}
+
+func Test_canvasDispatcherCrash(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	listener := &testPanickingListener{}
+	if err := can.subscribeListener(listener, false); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+
+	// The events after the one that caused the crash are still delivered
+	for i := 0; i < 10; i++ {
+		can.setPixel(image.Point{i, 0}, pixelcanvasioPalette[5])
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		can.unsubscribeListener(listener)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Unsubscribing timed out, the dispatcher stopped")
+	}
+
+	listener.Lock()
+	defer listener.Unlock()
+	if len(listener.positions) != 9 {
+		t.Errorf("Listener got %v pixels, want 9", len(listener.positions))
+	}
+}
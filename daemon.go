@@ -0,0 +1,265 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+var daemonLog = moduleLog("daemon")
+
+// Settings of the daemon mode, stored in the configuration at .daemon
+type daemonSettings struct {
+	Games   []string               // Short names of the games that are connected to and recorded. See gameRecorder for their settings
+	Exports []daemonExportSettings // Exports that are queued periodically
+}
+
+// An export that is queued periodically
+type daemonExportSettings struct {
+	Kind     string          // Key of exportJobKinds, e.g. "timelapse"
+	Game     string          // Short name of the recorded game
+	Rect     image.Rectangle // Region of the canvas that will be exported
+	Interval string          // Time between two exports, e.g. "24h"
+	Period   string          // Length of the time range before each export that is exported, e.g. "24h". Empty exports all recordings
+	FileName string          // Output file, or directory for tile exports. "{time}" is replaced by the time of the export
+
+	Speedup   float64
+	FrameRate float64
+	Upscale   int
+	Overlay   exportOverlay
+	Ramp      string // Color ramp of heatmaps
+	Template  string // Template image of reports and forensics
+}
+
+// A game that is connected to and recorded by the daemon
+type daemonGame struct {
+	Connection connection
+	Recorder   *gameRecorder
+}
+
+// A periodic export, and when it's run next
+type daemonExport struct {
+	Settings daemonExportSettings
+	interval time.Duration
+	period   time.Duration
+	next     time.Time
+}
+
+// Runs everything that is set in the configuration, without any user interface.
+//
+// Games are connected to and recorded as long as they are listed in the settings.
+// Exports are queued into exportJobs in their interval, the first one an interval after the daemon started.
+type daemon struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Config *configdb.Config
+
+	callbackID   int
+	settingsChan chan daemonSettings
+	quitChan     chan struct{}
+	waitGroup    sync.WaitGroup
+}
+
+func newDaemon(c *configdb.Config) *daemon {
+	d := &daemon{
+		Config:       c,
+		settingsChan: make(chan daemonSettings, 1),
+		quitChan:     make(chan struct{}),
+	}
+
+	d.waitGroup.Add(1)
+	go func() {
+		defer d.waitGroup.Done()
+
+		games := map[string]*daemonGame{}
+		exports := []*daemonExport{}
+		defer func() {
+			for shortName, game := range games {
+				d.closeGame(shortName, game)
+			}
+		}()
+
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case settings := <-d.settingsChan:
+				// Close games that aren't listed anymore, and open new ones
+				wanted := map[string]bool{}
+				for _, shortName := range settings.Games {
+					wanted[shortName] = true
+				}
+				for shortName, game := range games {
+					if !wanted[shortName] {
+						d.closeGame(shortName, game)
+						delete(games, shortName)
+					}
+				}
+				for shortName := range wanted {
+					if _, ok := games[shortName]; ok {
+						continue
+					}
+					game, err := d.openGame(shortName)
+					if err != nil {
+						daemonLog.Errorf("Can't open %v: %v", shortName, err)
+						continue
+					}
+					games[shortName] = game
+				}
+
+				exports = d.prepareExports(settings.Exports, exports)
+
+			case now := <-ticker.C:
+				for _, export := range exports {
+					if now.Before(export.next) {
+						continue
+					}
+					export.next = now.Add(export.interval)
+					if err := export.queue(now); err != nil {
+						daemonLog.Errorf("Can't queue %v export of %v: %v", export.Settings.Kind, export.Settings.Game, err)
+					}
+				}
+
+			case <-d.quitChan:
+				return
+			}
+		}
+	}()
+
+	d.callbackID = c.RegisterCallback([]string{".daemon"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := daemonSettings{}
+		c.Get(".daemon", &settings)
+
+		// Replace settings that weren't applied yet. This never blocks, so the daemon can use the configuration meanwhile
+		select {
+		case <-d.settingsChan:
+		default:
+		}
+		d.settingsChan <- settings
+	})
+
+	return d
+}
+
+func (d *daemon) openGame(shortName string) (*daemonGame, error) {
+	connectionType, ok := connectionTypes[shortName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown game %q", shortName)
+	}
+
+	con, can := connectionType.FunctionNew()
+	recorder, err := newGameRecorder(d.Config, con, can)
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+
+	daemonLog.Infof("Daemon connected to %v", con.getName())
+	return &daemonGame{Connection: con, Recorder: recorder}, nil
+}
+
+// Closes the connection first, so the recorder gets all events
+func (d *daemon) closeGame(shortName string, game *daemonGame) {
+	game.Connection.Close()
+	game.Recorder.Close()
+	daemonLog.Infof("Daemon closed %v", shortName)
+}
+
+// Parses the export settings. Exports that didn't change keep their schedule
+func (d *daemon) prepareExports(settings []daemonExportSettings, previous []*daemonExport) []*daemonExport {
+	exports := []*daemonExport{}
+
+	for _, s := range settings {
+		export := &daemonExport{Settings: s}
+
+		var err error
+		if export.interval, err = time.ParseDuration(s.Interval); err != nil || export.interval <= 0 {
+			daemonLog.Errorf("Invalid interval %q of %v export of %v", s.Interval, s.Kind, s.Game)
+			continue
+		}
+		if s.Period != "" {
+			if export.period, err = time.ParseDuration(s.Period); err != nil {
+				daemonLog.Errorf("Invalid period %q of %v export of %v", s.Period, s.Kind, s.Game)
+				continue
+			}
+		}
+		if _, ok := exportJobKinds[s.Kind]; !ok {
+			daemonLog.Errorf("Unknown export kind %q", s.Kind)
+			continue
+		}
+
+		export.next = time.Now().Add(export.interval)
+		for _, p := range previous {
+			if p.Settings == s {
+				export.next = p.next
+				break
+			}
+		}
+
+		exports = append(exports, export)
+	}
+
+	return exports
+}
+
+// Queues the export, with the time range ending at now
+func (export *daemonExport) queue(now time.Time) error {
+	s := export.Settings
+
+	opts := exportOptions{
+		Rect:      s.Rect,
+		EndTime:   now,
+		Speedup:   s.Speedup,
+		FrameRate: s.FrameRate,
+		Upscale:   s.Upscale,
+		Overlay:   s.Overlay,
+	}
+	if export.period > 0 {
+		opts.StartTime = now.Add(-export.period)
+	}
+	params := exportJobParams{
+		Ramp:     s.Ramp,
+		Template: s.Template,
+	}
+	fileName := strings.Replace(s.FileName, "{time}", now.UTC().Format("2006-01-02T150405"), -1)
+
+	exportJobs.clearFinished()
+	_, err := exportJobs.add(s.Kind, s.Game, opts, params, fileName)
+	return err
+}
+
+// Closes all games that were opened by the daemon. Queued exports keep running
+func (d *daemon) Close() {
+	d.ClosedMutex.Lock()
+	defer d.ClosedMutex.Unlock()
+	if d.Closed {
+		return
+	}
+	d.Closed = true
+
+	d.Config.UnregisterCallback(d.callbackID)
+	close(d.quitChan)
+	d.waitGroup.Wait()
+}
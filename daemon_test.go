@@ -0,0 +1,96 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+func Test_daemon(t *testing.T) {
+	registerAPIServerTestGame()
+	defer delete(connectionTypes, "apitest")
+
+	// The dummy storage doesn't signal changes, so the settings have to be there from the start
+	c, err := configdb.New([]configdb.Storage{configdb.UseDummyStorage("", map[string]interface{}{
+		"daemon":   daemonSettings{Games: []string{"apitest", "unknown"}},
+		"recorder": map[string]interface{}{"apitest": map[string]interface{}{"rects": []image.Rectangle{image.Rect(0, 0, 64, 64)}}},
+	})})
+	if err != nil {
+		t.Fatalf("Can't create configuration: %v", err)
+	}
+	defer c.Close()
+
+	dir := dataPath(getPaths().Recordings, "apitest")
+	recordings := func() []os.FileInfo {
+		files, _ := ioutil.ReadDir(dir)
+		return files
+	}
+	// Recordings are named by the second they started
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	before := len(recordings())
+
+	d := newDaemon(c)
+	for i := 0; i < 100 && len(recordings()) == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.Close()
+
+	files := recordings()
+	if len(files) != before+1 {
+		t.Fatalf("Got %v new recordings, want 1", len(files)-before)
+	}
+	for _, f := range files[before:] {
+		os.Remove(filepath.Join(dir, f.Name()))
+	}
+}
+
+func Test_daemonPrepareExports(t *testing.T) {
+	d := &daemon{}
+	settings := []daemonExportSettings{
+		{Kind: "events", Game: "apitest", Interval: "1h"},
+		{Kind: "events", Game: "apitest", Interval: "invalid"},
+		{Kind: "unknown", Game: "apitest", Interval: "1h"},
+		{Kind: "heatmap", Game: "apitest", Interval: "24h", Period: "24h"},
+	}
+
+	exports := d.prepareExports(settings, nil)
+	if len(exports) != 2 {
+		t.Fatalf("Got %v valid exports, want 2", len(exports))
+	}
+	if exports[1].period != 24*time.Hour {
+		t.Errorf("Got period %v, want %v", exports[1].period, 24*time.Hour)
+	}
+
+	// Unchanged exports keep their schedule
+	next := time.Now().Add(-time.Minute)
+	exports[0].next = next
+	settings[3].Period = "48h"
+	exports = d.prepareExports(settings, exports)
+	if !exports[0].next.Equal(next) {
+		t.Errorf("Unchanged export was rescheduled to %v, want %v", exports[0].next, next)
+	}
+	if exports[1].next.Before(time.Now()) {
+		t.Errorf("Changed export kept its schedule")
+	}
+}
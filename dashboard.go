@@ -0,0 +1,121 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Overview of everything that runs in this instance, to check a recording rig with many games at once
+type dashboard struct {
+	Time       time.Time        `json:"time"`
+	Games      []dashboardGame  `json:"games"`      // Open connections, sorted by their short name
+	Recordings map[string]int64 `json:"recordings"` // Size of the local recordings of each game in bytes
+	FreeSpace  int64            `json:"freeSpace"`  // Free space in bytes on the disk of the recordings directory, -1 if it's unknown
+	LowSpace   bool             `json:"lowSpace"`   // Set if the free space is below the warning limit
+	Memory     memoryUsage      `json:"memory"`
+	Crashes    int              `json:"crashes"` // Number of crashed components since the start
+}
+
+// State of an open connection, and everything that records or watches its canvas
+type dashboardGame struct {
+	ShortName     string         `json:"shortName"`
+	Name          string         `json:"name"`
+	OnlinePlayers int            `json:"onlinePlayers"`
+	PixelRate     int            `json:"pixelRate"`             // Pixels that were set on the whole canvas in the last complete minute
+	RegionRates   map[string]int `json:"regionRates,omitempty"` // Pixels that were set in the last complete minute in the regions of the statistics
+	ClockOffset   string         `json:"clockOffset,omitempty"` // Offset of the game server's clock, once it's known
+
+	Recorders []dashboardRecorder `json:"recorders"`           // Running recordings, sorted by their file name
+	LastAlert *canvasWatchAlert   `json:"lastAlert,omitempty"` // Latest alert of the watched regions
+
+	DroppedChunkRequests uint64 `json:"droppedChunkRequests,omitempty"`
+	FailedChunks         int    `json:"failedChunks,omitempty"` // Chunks whose last download failed, see the failures endpoint of the API
+}
+
+// A running recording
+type dashboardRecorder struct {
+	FileName      string `json:"fileName"`
+	Size          int64  `json:"size"` // Bytes written so far
+	DroppedEvents uint64 `json:"droppedEvents,omitempty"`
+}
+
+// Collects the state of all open connections and recordings, regardless of whether they were opened by the UI, the API or the daemon
+func getDashboard() dashboard {
+	now := time.Now()
+	usage := getRetentionDiskUsage()
+
+	d := dashboard{
+		Time:       now,
+		Games:      []dashboardGame{},
+		Recordings: usage.Games,
+		FreeSpace:  usage.FreeSpace,
+		LowSpace:   usage.LowSpace,
+		Memory:     getMemoryUsage(),
+		Crashes:    len(getCrashReports()),
+	}
+
+	for _, open := range getOpenConnections() {
+		shortName := open.Connection.getShortName()
+		game := dashboardGame{
+			ShortName:     shortName,
+			Name:          open.Connection.getName(),
+			OnlinePlayers: open.Connection.getOnlinePlayers(),
+			Recorders:     []dashboardRecorder{},
+
+			DroppedChunkRequests: open.Canvas.getDroppedChunkRequests(),
+			FailedChunks:         len(open.Canvas.getDownloadFailures()),
+		}
+
+		if st, err := getCanvasStatistics(shortName); err == nil {
+			game.PixelRate, game.RegionRates = st.getRates(now)
+			if len(game.RegionRates) == 0 {
+				game.RegionRates = nil
+			}
+		}
+
+		if offset, ok := open.Canvas.Clock.getOffset(); ok {
+			game.ClockOffset = offset.String()
+		}
+
+		for _, recorder := range getCanvasRecorders(shortName) {
+			rec := dashboardRecorder{}
+			if file, ok := recorder.(canvasRecorderFile); ok {
+				rec.FileName = filepath.Base(file.getFileName())
+				if info, err := os.Stat(file.getFileName()); err == nil {
+					rec.Size = info.Size()
+				}
+			}
+			if dropper, ok := recorder.(canvasRecorderDropper); ok {
+				rec.DroppedEvents = dropper.getDroppedEvents()
+			}
+			game.Recorders = append(game.Recorders, rec)
+		}
+		sort.Slice(game.Recorders, func(i, j int) bool { return game.Recorders[i].FileName < game.Recorders[j].FileName })
+
+		if alerts := getCanvasWatchAlerts(shortName); len(alerts) > 0 {
+			game.LastAlert = &alerts[len(alerts)-1]
+		}
+
+		d.Games = append(d.Games, game)
+	}
+
+	return d
+}
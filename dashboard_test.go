@@ -0,0 +1,77 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+func Test_getDashboard(t *testing.T) {
+	defer setPathSettings(getPaths())
+	settings := getPaths()
+	settings.Recordings = t.TempDir()
+	setPathSettings(settings)
+
+	con := newConnectionLoad(connectionLoadSettings{PixelRate: 1000})
+	closed := false
+	defer func() {
+		if !closed {
+			con.close()
+		}
+	}()
+
+	recorder, err := con.Canvas.newCanvasRecorder("load", canvasRecorderSettings{})
+	if err != nil {
+		t.Fatalf("Can't start recording: %v", err)
+	}
+	defer recorder.Close()
+	if err := recorder.setListeningRects([]image.Rectangle{image.Rect(0, 0, 64, 64)}); err != nil {
+		t.Fatalf("Can't set listening rectangle: %v", err)
+	}
+
+	findGame := func(d dashboard) *dashboardGame {
+		for i, game := range d.Games {
+			if game.ShortName == "load" {
+				return &d.Games[i]
+			}
+		}
+		return nil
+	}
+
+	game := findGame(getDashboard())
+	if game == nil {
+		t.Fatalf("The open connection is missing in the dashboard")
+	}
+	if len(game.Recorders) != 1 || game.Recorders[0].FileName == "" {
+		t.Errorf("Got recorders %v, want the running recording", game.Recorders)
+	}
+
+	// Stopped recordings and closed connections disappear
+	recorder.Close()
+	waitFor(t, 5*time.Second, "the recording to be listed on disk", func() bool { return getDashboard().Recordings["load"] > 0 })
+	if game := findGame(getDashboard()); game == nil || len(game.Recorders) != 0 {
+		t.Errorf("Got %v after stopping the recording, want the game without recorders", game)
+	}
+
+	con.close()
+	closed = true
+	if game := findGame(getDashboard()); game != nil {
+		t.Errorf("Got %v after closing the connection, want nothing", game)
+	}
+}
@@ -0,0 +1,147 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+)
+
+var debugLog = moduleLog("debug")
+
+// Settings of the debug server, stored in the configuration at .debug
+type debugServerSettings struct {
+	Address string // Profiles and traces are served on this address, e.g. "localhost:6060". Only loopback addresses are allowed. The server is disabled if this is empty
+}
+
+// Serves the profiles of net/http/pprof and runtime traces, to diagnose stalls and CPU spikes of a running instance.
+//
+// Everything is available at /debug/pprof/, e.g. "go tool pprof http://localhost:6060/debug/pprof/goroutine".
+type debugServer struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	settingsChan chan debugServerSettings
+	quitChan     chan struct{}
+	waitGroup    sync.WaitGroup
+}
+
+func newDebugServer() *debugServer {
+	ds := &debugServer{
+		settingsChan: make(chan debugServerSettings),
+		quitChan:     make(chan struct{}),
+	}
+
+	ds.waitGroup.Add(1)
+	go func() {
+		defer ds.waitGroup.Done()
+
+		var server *http.Server
+		stop := func() {
+			if server != nil {
+				server.Close()
+				server = nil
+			}
+		}
+		defer stop()
+
+		for {
+			select {
+			case settings := <-ds.settingsChan:
+				stop()
+				if settings.Address != "" {
+					var err error
+					if server, err = debugServe(settings.Address); err != nil {
+						debugLog.Errorf("Can't start debug server: %v", err)
+					} else {
+						debugLog.Warnf("Debug server is listening on %v", settings.Address)
+					}
+				}
+			case <-ds.quitChan:
+				return
+			}
+		}
+	}()
+
+	return ds
+}
+
+// Changes the settings of the debug server, the server is restarted if needed
+func (ds *debugServer) setSettings(settings debugServerSettings) error {
+	ds.ClosedMutex.RLock()
+	defer ds.ClosedMutex.RUnlock()
+	if ds.Closed {
+		return fmt.Errorf("Debug server is closed")
+	}
+
+	ds.settingsChan <- settings
+
+	return nil
+}
+
+// Returns the HTTP handler of the profiles and traces
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Starts a HTTP server on addr, which must be a loopback address, as the profiles expose internals of the process
+func debugServe(addr string) (*http.Server, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%v is not a loopback address", addr)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: debugHandler()}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			debugLog.Errorf("Debug server failed: %v", err)
+		}
+	}()
+
+	return server, nil
+}
+
+// Stops the debug server
+func (ds *debugServer) Close() {
+	ds.ClosedMutex.Lock()
+	defer ds.ClosedMutex.Unlock()
+	if ds.Closed {
+		return
+	}
+	ds.Closed = true
+
+	close(ds.quitChan)
+	ds.waitGroup.Wait()
+}
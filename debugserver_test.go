@@ -0,0 +1,53 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_debugServe(t *testing.T) {
+	for _, addr := range []string{":6060", "0.0.0.0:6060", "192.168.1.10:6060", "localhost"} {
+		if server, err := debugServe(addr); err == nil {
+			server.Close()
+			t.Errorf("Debug server was started on %q", addr)
+		}
+	}
+}
+
+func Test_debugHandler(t *testing.T) {
+	server := httptest.NewServer(debugHandler())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatalf("Can't get goroutine profile: %v", err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Can't read goroutine profile: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "Test_debugHandler") {
+		t.Errorf("Got status %v and a profile without the test goroutine", res.Status)
+	}
+}
@@ -0,0 +1,125 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Name of the directories inside of the configuration, data and cache directories of the user
+const appDirectoryName = "D3pixelbot"
+
+// File next to the executable that enables the portable mode
+const portableMarkerFile = "portable"
+
+// Environment variable that enables the portable mode, if it's set to "1" or "true"
+const portableEnvironmentVariable = "D3PIXELBOT_PORTABLE"
+
+// Directories where the configuration, data and caches are stored.
+//
+// By default they follow the conventions of the operating system, like XDG on Linux or %APPDATA% on Windows.
+// In portable mode everything is stored next to the executable.
+// The zero value resolves relative paths against the working directory, which is used by tests.
+type appDirectories struct {
+	Executable string // Directory of the executable, where ffmpeg is looked for first
+	Config     string // Directory of the configuration file
+	Data       string // Base of relative paths in the path settings, like recordings and logs
+	Cache      string // Base of relative paths of caches, like rendered tiles
+	Portable   bool
+}
+
+var dirs appDirectories
+
+// Returns the directories of the portable mode, which are all the directory of the executable
+func portableAppDirectories(exeDir string) appDirectories {
+	return appDirectories{Executable: exeDir, Config: exeDir, Data: exeDir, Cache: exeDir, Portable: true}
+}
+
+// Finds the directories for this installation.
+//
+// The portable mode is used if it's enabled by the marker file or the environment variable, or if there is a configuration file next to the executable.
+// The latter keeps installations working that were set up before the directories of the user were used.
+// If the directories of the user can't be determined, the portable mode is used and an error is returned.
+func findAppDirectories() (appDirectories, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return appDirectories{}, fmt.Errorf("Can't find executable: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	exeDir := filepath.Dir(exe)
+
+	switch strings.ToLower(os.Getenv(portableEnvironmentVariable)) {
+	case "1", "true":
+		return portableAppDirectories(exeDir), nil
+	}
+	for _, name := range append([]string{portableMarkerFile}, configFileNames...) {
+		if _, err := os.Stat(filepath.Join(exeDir, name)); err == nil {
+			return portableAppDirectories(exeDir), nil
+		}
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return portableAppDirectories(exeDir), fmt.Errorf("Can't find configuration directory of the user: %v", err)
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return portableAppDirectories(exeDir), fmt.Errorf("Can't find cache directory of the user: %v", err)
+	}
+	dataDir, err := userDataDir()
+	if err != nil {
+		return portableAppDirectories(exeDir), fmt.Errorf("Can't find data directory of the user: %v", err)
+	}
+
+	return appDirectories{
+		Executable: exeDir,
+		Config:     filepath.Join(configDir, appDirectoryName),
+		Data:       filepath.Join(dataDir, appDirectoryName),
+		Cache:      filepath.Join(cacheDir, appDirectoryName),
+	}, nil
+}
+
+// Returns the directory for data of the user, like os.UserConfigDir does for the configuration.
+//
+// On Unix systems it's $XDG_DATA_HOME or ~/.local/share, on Windows %LOCALAPPDATA%, as recordings shouldn't be synchronized with roaming profiles.
+// On macOS it's ~/Library/Application Support.
+func userDataDir() (string, error) {
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return dir, nil
+		}
+		return "", fmt.Errorf("%%LOCALAPPDATA%% is not defined")
+	case "darwin", "ios":
+		return os.UserConfigDir()
+	}
+
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
@@ -0,0 +1,81 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func Test_findAppDirectories(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Test uses the XDG variables of Linux")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Can't find executable: %v", err)
+	}
+	exeDir, _ := filepath.EvalSymlinks(filepath.Dir(exe))
+
+	t.Setenv("XDG_CONFIG_HOME", "/xdg/config")
+	t.Setenv("XDG_CACHE_HOME", "/xdg/cache")
+	t.Setenv("XDG_DATA_HOME", "/xdg/data")
+
+	t.Setenv(portableEnvironmentVariable, "")
+	d, err := findAppDirectories()
+	if err != nil {
+		t.Fatalf("Can't find directories: %v", err)
+	}
+	want := appDirectories{Executable: exeDir, Config: "/xdg/config/D3pixelbot", Data: "/xdg/data/D3pixelbot", Cache: "/xdg/cache/D3pixelbot"}
+	if d != want {
+		t.Errorf("Got directories %+v, want %+v", d, want)
+	}
+
+	t.Setenv(portableEnvironmentVariable, "true")
+	if d, err := findAppDirectories(); err != nil || d != portableAppDirectories(exeDir) {
+		t.Errorf("Got directories %+v, want everything in %v", d, exeDir)
+	}
+
+	// Without XDG variable, the data directory is inside of the home directory
+	t.Setenv(portableEnvironmentVariable, "")
+	t.Setenv("XDG_DATA_HOME", "")
+	t.Setenv("HOME", "/home/test")
+	if dir, err := userDataDir(); err != nil || dir != "/home/test/.local/share" {
+		t.Errorf("Got data directory %q, want %q", dir, "/home/test/.local/share")
+	}
+}
+
+func Test_dataPath(t *testing.T) {
+	oldDirs := dirs
+	dirs = appDirectories{Data: "/data", Cache: "/cache"}
+	defer func() { dirs = oldDirs }()
+
+	tests := []struct {
+		got, want string
+	}{
+		{dataPath("recordings", "game"), filepath.Join("/data", "recordings", "game")},
+		{cachePath("tiles", "game"), filepath.Join("/cache", "tiles", "game")},
+		{dataPath(filepath.Join(string(filepath.Separator), "elsewhere"), "game"), filepath.Join(string(filepath.Separator), "elsewhere", "game")},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("Got path %q, want %q", test.got, test.want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sync"
+)
+
+// Filters of what the user interface shows, stored in the configuration at .display.
+// They only change how canvases are rendered on the screen, recordings and exports keep the original colors.
+type displaySettings struct {
+	Mode             string  // Simulated color vision: "" for none, "deuteranopia" or "protanopia"
+	HighContrast     bool    // Show the chunk grid and the selected region in high-contrast colors
+	GridColor        string  // Color of the chunk grid in hex notation like "#FFFF00". Empty hides the grid, unless HighContrast is set
+	SelectionColor   string  // Color of the outline of the selected region. Empty uses the default, or a high-contrast color if HighContrast is set
+	Patterns         bool    // Overlay pixels of colors that are hard to tell apart with patterns
+	PatternThreshold float64 // Distance between two displayed colors below which they are considered ambiguous, from 0 to 765. Defaults to 120
+}
+
+var defaultDisplaySettings = displaySettings{}
+
+// Colors of the chunk grid and the selection that are used when HighContrast is set and nothing else is configured
+const (
+	displayHighContrastGrid      = "#FFFF00"
+	displayHighContrastSelection = "#FF00FF"
+	displayDefaultSelection      = "#00A0FF"
+)
+
+// Distance below which displayed palette colors get patterns, if nothing else is configured
+const displayDefaultPatternThreshold = 120
+
+// Number of screen pixels in each direction that a canvas pixel is rendered with, when patterns are enabled
+const displayPatternScale = 4
+
+// Color transformation matrices of the simulated color vision deficiencies, applied to linear RGB.
+// These are the matrices of Machado, Oliveira and Fernandes (2009) at full severity.
+var displayModeMatrices = map[string][3][3]float64{
+	"deuteranopia": {
+		{0.367322, 0.860646, -0.227968},
+		{0.280085, 0.672501, 0.047413},
+		{-0.011820, 0.042940, 0.968881},
+	},
+	"protanopia": {
+		{0.152286, 1.052583, -0.204868},
+		{0.114503, 0.786281, 0.099216},
+		{-0.003882, -0.048116, 1.051998},
+	},
+}
+
+func (s displaySettings) validate() error {
+	if _, ok := displayModeMatrices[s.Mode]; s.Mode != "" && !ok {
+		return fmt.Errorf("Unknown display mode %q", s.Mode)
+	}
+	for _, c := range []string{s.GridColor, s.SelectionColor} {
+		if c == "" {
+			continue
+		}
+		if _, err := paletteNormalizeHex(c); err != nil {
+			return err
+		}
+	}
+	if s.PatternThreshold < 0 || s.PatternThreshold > 765 {
+		return fmt.Errorf("Pattern threshold %v is not in the range of 0 to 765", s.PatternThreshold)
+	}
+	return nil
+}
+
+// Returns the color of the chunk grid in hex notation, or an empty string if there is no grid
+func (s displaySettings) getGridColor() string {
+	if hex, err := paletteNormalizeHex(s.GridColor); err == nil {
+		return hex
+	}
+	if s.HighContrast {
+		return displayHighContrastGrid
+	}
+	return ""
+}
+
+// Returns the color of the outline of the selected region in hex notation
+func (s displaySettings) getSelectionColor() string {
+	if hex, err := paletteNormalizeHex(s.SelectionColor); err == nil {
+		return hex
+	}
+	if s.HighContrast {
+		return displayHighContrastSelection
+	}
+	return displayDefaultSelection
+}
+
+func (s displaySettings) getPatternThreshold() float64 {
+	if s.PatternThreshold <= 0 {
+		return displayDefaultPatternThreshold
+	}
+	return s.PatternThreshold
+}
+
+var displayMutex sync.RWMutex
+var display = defaultDisplaySettings
+
+// Changes the display filters, they are used by canvas windows that are opened afterwards
+func setDisplaySettings(s displaySettings) {
+	displayMutex.Lock()
+	defer displayMutex.Unlock()
+
+	display = s
+}
+
+// Returns the current display filters
+func getDisplaySettings() displaySettings {
+	displayMutex.RLock()
+	defer displayMutex.RUnlock()
+
+	return display
+}
+
+// Patterns that are drawn over ambiguous colors, as functions of the position inside a displayPatternScale sized cell.
+// The index into this list + 1 is the pattern ID, 0 means no pattern.
+var displayPatterns = []func(x, y int) bool{
+	func(x, y int) bool { return (x+y)%4 == 0 },                             // Diagonal stripes
+	func(x, y int) bool { return x%2 == 0 && y%2 == 0 },                     // Dots
+	func(x, y int) bool { return (x-y+4)%4 == 0 },                           // Anti-diagonal stripes
+	func(x, y int) bool { return y == 1 },                                   // Horizontal line
+	func(x, y int) bool { return x == 1 },                                   // Vertical line
+	func(x, y int) bool { return (x == 1 || x == 2) && (y == 1 || y == 2) }, // Square
+}
+
+// Maps the colors of a canvas to what is displayed, according to displaySettings.
+//
+// It is safe for concurrent use, the palette can be changed any time.
+type displayFilter struct {
+	settings displaySettings
+	matrix   *[3][3]float64
+
+	sync.RWMutex
+	patterns map[color.RGBA]int // Pattern IDs of ambiguous palette colors
+}
+
+func newDisplayFilter(settings displaySettings, palette color.Palette) *displayFilter {
+	df := &displayFilter{
+		settings: settings,
+	}
+	if matrix, ok := displayModeMatrices[settings.Mode]; ok {
+		df.matrix = &matrix
+	}
+	df.setPalette(palette)
+
+	return df
+}
+
+// Returns whether the filter changes anything, otherwise images and colors can be used unchanged
+func (df *displayFilter) isActive() bool {
+	return df.matrix != nil || df.settings.Patterns
+}
+
+// Returns the number of screen pixels in each direction that a canvas pixel is rendered with
+func (df *displayFilter) getScale() int {
+	if df.settings.Patterns {
+		return displayPatternScale
+	}
+	return 1
+}
+
+// Assigns patterns to the palette colors that are hard to tell apart from other palette colors, once they are displayed.
+// The colors that come first in the palette stay without pattern, as they are usually the most used ones.
+func (df *displayFilter) setPalette(palette color.Palette) {
+	patterns := map[color.RGBA]int{}
+	if df.settings.Patterns {
+		threshold := df.settings.getPatternThreshold()
+		colors := make([]color.RGBA, 0, len(palette))
+		for _, c := range palette {
+			colors = append(colors, color.RGBAModel.Convert(c).(color.RGBA))
+		}
+		for i, a := range colors {
+			used := map[int]bool{}
+			for _, b := range colors[:i] {
+				if displayColorDistance(df.mapColor(a), df.mapColor(b)) < threshold {
+					used[patterns[b]] = true
+				}
+			}
+			// Pick the first pattern that no similar color uses yet, starting with no pattern at all
+			for id := 0; id <= len(displayPatterns); id++ {
+				if !used[id] {
+					if id > 0 {
+						patterns[a] = id
+					}
+					break
+				}
+			}
+		}
+	}
+
+	df.Lock()
+	defer df.Unlock()
+
+	df.patterns = patterns
+}
+
+// Returns the pattern ID of the given color, 0 if it has none
+func (df *displayFilter) getPattern(c color.RGBA) int {
+	df.RLock()
+	defer df.RUnlock()
+
+	return df.patterns[c]
+}
+
+// Returns the displayed color of a canvas color, without patterns
+func (df *displayFilter) mapColor(c color.RGBA) color.RGBA {
+	if df.matrix == nil {
+		return c
+	}
+
+	r, g, b := displayLinear(c.R), displayLinear(c.G), displayLinear(c.B)
+	m := df.matrix
+	return color.RGBA{
+		R: displaySRGB(m[0][0]*r + m[0][1]*g + m[0][2]*b),
+		G: displaySRGB(m[1][0]*r + m[1][1]*g + m[1][2]*b),
+		B: displaySRGB(m[2][0]*r + m[2][1]*g + m[2][2]*b),
+		A: c.A,
+	}
+}
+
+// Returns the displayed color of any canvas color, without patterns
+func (df *displayFilter) filterColor(c color.Color) color.RGBA {
+	return df.mapColor(color.RGBAModel.Convert(c).(color.RGBA))
+}
+
+// Draws the displayed cell of a canvas color into img, with its upper left corner at pos.
+// The cell is getScale() pixels wide and high.
+func (df *displayFilter) drawCell(img *image.RGBA, pos image.Point, c color.RGBA) {
+	mapped := df.mapColor(c)
+	scale := df.getScale()
+	pattern := df.getPattern(c)
+	mark := color.RGBA{0, 0, 0, mapped.A}
+	if 299*int(mapped.R)+587*int(mapped.G)+114*int(mapped.B) < 128000 {
+		mark = color.RGBA{255, 255, 255, mapped.A} // Light marks on dark colors
+	}
+
+	for y := 0; y < scale; y++ {
+		for x := 0; x < scale; x++ {
+			if pattern > 0 && displayPatterns[pattern-1](x, y) {
+				img.SetRGBA(pos.X+x, pos.Y+y, mark)
+			} else {
+				img.SetRGBA(pos.X+x, pos.Y+y, mapped)
+			}
+		}
+	}
+}
+
+// Returns the displayed image of img.
+// Its bounds are the ones of img, multiplied by getScale().
+func (df *displayFilter) filterImage(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	scale := df.getScale()
+	result := image.NewRGBA(image.Rectangle{bounds.Min.Mul(scale), bounds.Max.Mul(scale)})
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			df.drawCell(result, image.Point{x * scale, y * scale}, c)
+		}
+	}
+
+	return result
+}
+
+// Returns the displayed cell of a single canvas pixel, with the bounds of the pixel multiplied by getScale()
+func (df *displayFilter) filterPixel(pos image.Point, c color.Color) *image.RGBA {
+	scale := df.getScale()
+	result := image.NewRGBA(image.Rectangle{pos.Mul(scale), pos.Add(image.Point{1, 1}).Mul(scale)})
+	df.drawCell(result, result.Rect.Min, color.RGBAModel.Convert(c).(color.RGBA))
+
+	return result
+}
+
+// Converts a sRGB channel to linear RGB in the range of 0 to 1
+func displayLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+// Converts a linear RGB channel to sRGB, values outside of the range are clamped
+func displaySRGB(f float64) uint8 {
+	f = math.Max(0, math.Min(1, f))
+	if f <= 0.0031308 {
+		f *= 12.92
+	} else {
+		f = 1.055*math.Pow(f, 1/2.4) - 0.055
+	}
+	return uint8(math.Round(f * 255))
+}
+
+// Returns the sum of the absolute differences of the channels of two colors, from 0 to 765
+func displayColorDistance(a, b color.RGBA) float64 {
+	abs := func(v int) float64 { return math.Abs(float64(v)) }
+	return abs(int(a.R)-int(b.R)) + abs(int(a.G)-int(b.G)) + abs(int(a.B)-int(b.B))
+}
@@ -0,0 +1,133 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func Test_displaySettings(t *testing.T) {
+	for _, s := range []displaySettings{{Mode: "tritanopia"}, {GridColor: "yellow"}, {SelectionColor: "#12345"}, {PatternThreshold: -1}, {PatternThreshold: 800}} {
+		if err := s.validate(); err == nil {
+			t.Errorf("Settings %+v are valid", s)
+		}
+	}
+	for _, s := range []displaySettings{{}, {Mode: "deuteranopia", Patterns: true}, {Mode: "protanopia", HighContrast: true, GridColor: "#00ff00"}} {
+		if err := s.validate(); err != nil {
+			t.Errorf("Settings %+v are invalid: %v", s, err)
+		}
+	}
+
+	if color := (displaySettings{}).getGridColor(); color != "" {
+		t.Errorf("Got grid color %q by default, want none", color)
+	}
+	if color := (displaySettings{HighContrast: true}).getGridColor(); color != displayHighContrastGrid {
+		t.Errorf("Got grid color %q with high contrast, want %q", color, displayHighContrastGrid)
+	}
+	if color := (displaySettings{HighContrast: true, SelectionColor: "#00ff00"}).getSelectionColor(); color != "#00FF00" {
+		t.Errorf("Got selection color %q, want the configured #00FF00", color)
+	}
+	if color := (displaySettings{}).getSelectionColor(); color != displayDefaultSelection {
+		t.Errorf("Got selection color %q by default, want %q", color, displayDefaultSelection)
+	}
+}
+
+func Test_displayFilterModes(t *testing.T) {
+	red, green := color.RGBA{229, 0, 0, 255}, color.RGBA{2, 190, 1, 255}
+
+	df := newDisplayFilter(displaySettings{}, nil)
+	if df.isActive() || df.getScale() != 1 {
+		t.Errorf("Filter without settings is active")
+	}
+	if c := df.mapColor(red); c != red {
+		t.Errorf("Got %v without mode, want the unchanged %v", c, red)
+	}
+
+	// Red and green are easy to tell apart, but not for people with deuteranopia or protanopia
+	normalDistance := displayColorDistance(red, green)
+	for _, mode := range []string{"deuteranopia", "protanopia"} {
+		df := newDisplayFilter(displaySettings{Mode: mode}, nil)
+		if !df.isActive() {
+			t.Errorf("Filter with mode %q isn't active", mode)
+		}
+		if distance := displayColorDistance(df.mapColor(red), df.mapColor(green)); distance >= normalDistance/2 {
+			t.Errorf("Distance of red and green with mode %q is %v, want less than half of %v", mode, distance, normalDistance)
+		}
+		for _, c := range []color.RGBA{{0, 0, 0, 255}, {255, 255, 255, 255}} {
+			if mapped := df.mapColor(c); displayColorDistance(mapped, c) > 3 {
+				t.Errorf("Mode %q maps %v to %v, want it to keep black and white", mode, c, mapped)
+			}
+		}
+	}
+}
+
+func Test_displayFilterPatterns(t *testing.T) {
+	red, green, blue, white := color.RGBA{229, 0, 0, 255}, color.RGBA{2, 190, 1, 255}, color.RGBA{0, 0, 234, 255}, color.RGBA{255, 255, 255, 255}
+	palette := color.Palette{white, red, blue, green}
+
+	df := newDisplayFilter(displaySettings{Mode: "deuteranopia", Patterns: true}, palette)
+	if scale := df.getScale(); scale != displayPatternScale {
+		t.Fatalf("Got scale %v with patterns, want %v", scale, displayPatternScale)
+	}
+
+	// Red comes first in the palette, so green gets the pattern
+	for c, want := range map[color.RGBA]int{white: 0, red: 0, blue: 0, green: 1} {
+		if pattern := df.getPattern(c); pattern != want {
+			t.Errorf("Got pattern %v for %v, want %v", pattern, c, want)
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(-2, 5, 0, 6))
+	img.SetRGBA(-2, 5, red)
+	img.SetRGBA(-1, 5, green)
+	result := df.filterImage(img)
+	if want := image.Rect(-8, 20, 0, 24); result.Bounds() != want {
+		t.Fatalf("Got image bounds %v, want %v", result.Bounds(), want)
+	}
+	redCell, greenCell := map[color.RGBA]int{}, map[color.RGBA]int{}
+	for y := 20; y < 24; y++ {
+		for x := -8; x < -4; x++ {
+			redCell[result.RGBAAt(x, y)]++
+			greenCell[result.RGBAAt(x+4, y)]++
+		}
+	}
+	if len(redCell) != 1 {
+		t.Errorf("Cell of red has %v colors, want 1", len(redCell))
+	}
+	if len(greenCell) != 2 {
+		t.Errorf("Cell of green has %v colors, want the color and the pattern", len(greenCell))
+	}
+
+	// Single pixels are drawn like the cells of images
+	cell := df.filterPixel(image.Point{-1, 5}, green)
+	for y := 20; y < 24; y++ {
+		for x := -4; x < 0; x++ {
+			if cell.RGBAAt(x, y) != result.RGBAAt(x, y) {
+				t.Errorf("Pixel at %v of the cell is %v, want %v", image.Point{x, y}, cell.RGBAAt(x, y), result.RGBAAt(x, y))
+			}
+		}
+	}
+
+	// Added palette colors get patterns as well
+	yellow := color.RGBA{229, 217, 0, 255}
+	df.setPalette(append(palette, color.RGBA{230, 212, 10, 255}, yellow))
+	if pattern := df.getPattern(yellow); pattern == 0 {
+		t.Errorf("Yellow has no pattern, although it is similar to another palette color")
+	}
+}
@@ -0,0 +1,196 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+var exportLog = moduleLog("export")
+
+// Options for exports of recordings
+type exportOptions struct {
+	Rect               image.Rectangle // Region of the canvas that will be exported
+	StartTime, EndTime time.Time       // Time range that will be exported. Zero values will be replaced by the start/end of the recordings
+
+	Speedup   float64 // Recording time per output time. E.g. 3600 will turn one hour into one second
+	FrameRate float64 // Frames per second of the output
+
+	Scale   float64 // Scaling factor of the output. 0 or 1 will keep the original size. Only used by image based exports
+	Upscale int     // Integer scaling factor from 2 to 16 with nearest neighbor sampling, for crisp pixels. Can't be combined with Scale. 0 or 1 disables it
+	Dither  bool    // Use Floyd-Steinberg dithering when colors need to be reduced. Only used by paletted exports
+
+	Overlay   exportOverlay   // Text that is drawn onto every frame. Only used by frame based exports
+	AutoFrame exportAutoFrame // Let the frames follow the activity, instead of showing the whole rectangle. Only used by frame based exports
+
+	Progress func(done, total int) // Called with the number of finished and total steps (frames, tiles, ...) of an export. May be nil
+
+	frameRects []image.Rectangle // Canvas rectangle of every frame, if auto framing is enabled
+}
+
+// Fills in default values, and checks the options for validity
+func (opts *exportOptions) prepare(cfe *canvasFrameExtractor) error {
+	startTime, endTime := cfe.getTimeRange()
+	if opts.StartTime.IsZero() {
+		opts.StartTime = startTime
+	}
+	if opts.EndTime.IsZero() {
+		opts.EndTime = endTime
+	}
+	if opts.Speedup <= 0 {
+		opts.Speedup = 3600
+	}
+	if opts.FrameRate <= 0 {
+		opts.FrameRate = 30
+	}
+	if opts.Scale <= 0 {
+		opts.Scale = 1
+	}
+
+	if opts.Upscale < 0 || opts.Upscale > 16 {
+		return fmt.Errorf("Upscaling factor %v is outside of 1 to 16", opts.Upscale)
+	}
+	if opts.Upscale > 1 && opts.Scale != 1 {
+		return fmt.Errorf("Upscaling can't be combined with a scaling factor of %v", opts.Scale)
+	}
+
+	opts.Rect = opts.Rect.Canon()
+	if opts.Rect.Empty() {
+		return fmt.Errorf("Export rectangle %v is empty", opts.Rect)
+	}
+	if !opts.StartTime.Before(opts.EndTime) {
+		return fmt.Errorf("Start time %v is not before end time %v", opts.StartTime, opts.EndTime)
+	}
+
+	return nil
+}
+
+// Computes the rectangle of every frame, if auto framing is enabled.
+// This needs to be called after prepare() by frame based exports.
+func (opts *exportOptions) prepareFrames(cfe *canvasFrameExtractor) error {
+	opts.frameRects = nil
+	if !opts.AutoFrame.Enabled {
+		return nil
+	}
+
+	rects, err := opts.AutoFrame.computeRects(cfe, opts)
+	if err != nil {
+		return fmt.Errorf("Can't compute auto framing: %v", err)
+	}
+	opts.frameRects = rects
+
+	return nil
+}
+
+// Returns the canvas rectangle that is shown in the i-th frame
+func (opts *exportOptions) frameRect(i int) image.Rectangle {
+	if i >= 0 && i < len(opts.frameRects) {
+		return opts.frameRects[i]
+	}
+	return opts.Rect
+}
+
+// Returns the time between two frames in recording time
+func (opts *exportOptions) frameInterval() time.Duration {
+	interval := time.Duration(float64(time.Second) * opts.Speedup / opts.FrameRate)
+	if interval <= 0 {
+		interval = 1
+	}
+	return interval
+}
+
+// Returns the number of frames of frame based exports
+func (opts *exportOptions) frameCount() int {
+	return int((opts.EndTime.Sub(opts.StartTime) + opts.frameInterval() - 1) / opts.frameInterval())
+}
+
+// Calls the progress callback, if there is any
+func (opts *exportOptions) reportProgress(done, total int) {
+	if opts.Progress != nil {
+		opts.Progress(done, total)
+	}
+}
+
+// Returns the size of the output in pixels
+func (opts *exportOptions) outputSize() pixelSize {
+	if opts.Upscale > 1 {
+		return pixelSize{opts.Rect.Dx() * opts.Upscale, opts.Rect.Dy() * opts.Upscale}
+	}
+
+	size := pixelSize{
+		X: int(float64(opts.Rect.Dx())*opts.Scale + 0.5),
+		Y: int(float64(opts.Rect.Dy())*opts.Scale + 0.5),
+	}
+	if size.X < 1 {
+		size.X = 1
+	}
+	if size.Y < 1 {
+		size.Y = 1
+	}
+	return size
+}
+
+// Returns the integer factor that scales rect to size, or 0 if there is none
+func exportUpscaleFactor(rect image.Rectangle, size pixelSize) int {
+	if rect.Empty() {
+		return 0
+	}
+	factor := size.X / rect.Dx()
+	if size.X != rect.Dx()*factor || size.Y != rect.Dy()*factor {
+		return 0
+	}
+	return factor
+}
+
+// Scales an image of the export rectangle, or of a frame rectangle, to the output size
+func (opts *exportOptions) scaleImage(img image.Image) image.Image {
+	size := opts.outputSize()
+	rect := img.Bounds()
+	if size.X == rect.Dx() && size.Y == rect.Dy() {
+		return img
+	}
+
+	if factor := exportUpscaleFactor(rect, size); factor > 1 {
+		return upscaleNearest(img, factor)
+	}
+	if opts.Upscale > 1 {
+		// Auto framed rectangles don't always fit the output size by an integer factor, but pixels should stay crisp
+		return resize.Resize(uint(size.X), uint(size.Y), img, resize.NearestNeighbor)
+	}
+
+	return resize.Resize(uint(size.X), uint(size.Y), img, resize.Lanczos3)
+}
+
+// Scales a frame to the output size, and draws the overlay onto it.
+// The frame may be modified.
+func (opts *exportOptions) renderFrame(img *image.RGBA, t time.Time, shortName string) *image.RGBA {
+	scaled := opts.scaleImage(img)
+	frame, ok := scaled.(*image.RGBA)
+	if !ok {
+		frame = image.NewRGBA(scaled.Bounds())
+		draw.Draw(frame, frame.Rect, scaled, frame.Rect.Min, draw.Src)
+	}
+
+	opts.Overlay.draw(frame, t, img.Rect, shortName)
+
+	return frame
+}
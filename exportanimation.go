@@ -0,0 +1,237 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Encodes the frames of an animation into some file format
+type animationEncoder interface {
+	// Converts a full frame into the image type the encoder works with.
+	// The result is what is passed to writeFrame, or a subimage of it.
+	convertFrame(img image.Image) image.Image
+
+	// Writes a frame that is shown for the given duration.
+	// The first frame covers the whole animation, following frames only contain the area that changed.
+	writeFrame(img image.Image, duration time.Duration) error
+
+	// Finishes the file, this doesn't close the underlying writer
+	Close() error
+}
+
+type animationFormat struct {
+	Name            string
+	OffsetAlignment int // Frame offsets are aligned to multiples of this value
+
+	FunctionNew func(w io.WriteSeeker, size pixelSize, pal color.Palette, opts exportOptions) (animationEncoder, error) // pal is nil if the game palette is unknown
+}
+
+var animationFormats = map[string]animationFormat{
+	".gif": {
+		Name:            "GIF",
+		OffsetAlignment: 1,
+		FunctionNew:     newGIFEncoder,
+	},
+	".png": {
+		Name:            "APNG",
+		OffsetAlignment: 1,
+		FunctionNew:     newAPNGEncoder,
+	},
+	".apng": {
+		Name:            "APNG",
+		OffsetAlignment: 1,
+		FunctionNew:     newAPNGEncoder,
+	},
+	".webp": {
+		Name:            "WebP",
+		OffsetAlignment: 2,
+		FunctionNew:     newWebPEncoder,
+	},
+}
+
+// Exports the recordings of shortName as animation.
+// The format is chosen by the file extension (.gif, .png, .apng or .webp).
+func exportAnimation(shortName string, opts exportOptions, fileName string) error {
+	format, ok := animationFormats[strings.ToLower(filepath.Ext(fileName))]
+	if !ok {
+		return fmt.Errorf("Unsupported animation format %v", filepath.Ext(fileName))
+	}
+
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return err
+	}
+	if err := opts.prepareFrames(cfe); err != nil {
+		return err
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+
+	size := opts.outputSize()
+	interval := opts.frameInterval()
+	frameDuration := time.Duration(float64(time.Second) / opts.FrameRate)
+
+	exportLog.Debugf("Started %v export of %v at %v from %v to %v into %v", format.Name, shortName, opts.Rect, opts.StartTime, opts.EndTime, fileName)
+
+	var enc animationEncoder
+	var prev, pending image.Image // Previous full frame, and the frame that waits to be written
+	var pendingDuration time.Duration
+	frames, frameCount := 0, opts.frameCount()
+	for i, t := 0, opts.StartTime; t.Before(opts.EndTime); i, t = i+1, t.Add(interval) {
+		img, err := cfe.getFrame(t, opts.frameRect(i))
+		if err != nil {
+			return fmt.Errorf("Can't get frame at %v: %v", t, err)
+		}
+		opts.reportProgress(i+1, frameCount)
+
+		scaled := opts.renderFrame(img, t, shortName)
+
+		// Create the encoder when the first frame is available, as the palette is known from then on
+		if enc == nil {
+			if enc, err = format.FunctionNew(file, size, cfe.getPalette(), opts); err != nil {
+				return fmt.Errorf("Can't create %v encoder: %v", format.Name, err)
+			}
+		}
+
+		frame := enc.convertFrame(scaled)
+
+		if prev == nil {
+			pending, pendingDuration = frame, frameDuration
+			prev = frame
+			continue
+		}
+
+		diff := diffRect(prev, frame)
+		if diff.Empty() {
+			// Nothing changed, show the pending frame longer
+			pendingDuration += frameDuration
+			continue
+		}
+
+		if err := enc.writeFrame(pending, pendingDuration); err != nil {
+			return fmt.Errorf("Can't write frame: %v", err)
+		}
+		frames++
+
+		diff = alignRect(diff, format.OffsetAlignment).Intersect(frame.Bounds())
+		pending = frame.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(diff)
+		pendingDuration = frameDuration
+		prev = frame
+	}
+
+	if enc == nil {
+		return fmt.Errorf("There are no frames to export")
+	}
+
+	if err := enc.writeFrame(pending, pendingDuration); err != nil {
+		return fmt.Errorf("Can't write frame: %v", err)
+	}
+	frames++
+
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("Can't finish %v file: %v", format.Name, err)
+	}
+
+	exportLog.Debugf("Finished %v export of %v with %v frames into %v", format.Name, shortName, frames, fileName)
+
+	return nil
+}
+
+// Extends the rectangle, so that its minimum is a multiple of alignment
+func alignRect(rect image.Rectangle, alignment int) image.Rectangle {
+	if alignment > 1 {
+		rect.Min.X = divideFloor(rect.Min.X, alignment) * alignment
+		rect.Min.Y = divideFloor(rect.Min.Y, alignment) * alignment
+	}
+	return rect
+}
+
+// Returns the smallest rectangle that contains all differing pixels of two images.
+// Both images need to be of the same type and have the same bounds.
+// If the images can't be compared, their whole bounds are returned.
+func diffRect(a, b image.Image) image.Rectangle {
+	var aPix, bPix []uint8
+	var aStride, bStride, bytesPerPixel int
+	var aRect, bRect image.Rectangle
+
+	switch a := a.(type) {
+	case *image.Paletted:
+		b, ok := b.(*image.Paletted)
+		if !ok {
+			return a.Rect.Union(b.Bounds())
+		}
+		aPix, bPix, aStride, bStride, aRect, bRect, bytesPerPixel = a.Pix, b.Pix, a.Stride, b.Stride, a.Rect, b.Rect, 1
+	case *image.RGBA:
+		b, ok := b.(*image.RGBA)
+		if !ok {
+			return a.Rect.Union(b.Bounds())
+		}
+		aPix, bPix, aStride, bStride, aRect, bRect, bytesPerPixel = a.Pix, b.Pix, a.Stride, b.Stride, a.Rect, b.Rect, 4
+	case *image.NRGBA:
+		b, ok := b.(*image.NRGBA)
+		if !ok {
+			return a.Rect.Union(b.Bounds())
+		}
+		aPix, bPix, aStride, bStride, aRect, bRect, bytesPerPixel = a.Pix, b.Pix, a.Stride, b.Stride, a.Rect, b.Rect, 4
+	default:
+		return a.Bounds().Union(b.Bounds())
+	}
+
+	if !aRect.Eq(bRect) {
+		return aRect.Union(bRect)
+	}
+
+	diff := image.Rectangle{}
+	width := aRect.Dx() * bytesPerPixel
+	for iy := 0; iy < aRect.Dy(); iy++ {
+		aLine := aPix[iy*aStride : iy*aStride+width]
+		bLine := bPix[iy*bStride : iy*bStride+width]
+		if bytes.Equal(aLine, bLine) {
+			continue
+		}
+		min, max := 0, len(aLine)-1
+		for aLine[min] == bLine[min] {
+			min++
+		}
+		for aLine[max] == bLine[max] {
+			max--
+		}
+		diff = diff.Union(image.Rect(aRect.Min.X+min/bytesPerPixel, aRect.Min.Y+iy, aRect.Min.X+max/bytesPerPixel+1, aRect.Min.Y+iy+1))
+	}
+
+	return diff
+}
@@ -0,0 +1,119 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_exportGIF(t *testing.T) {
+	startTime := time.Now()
+	rect, _, endTime := writeTestRecording(t, "Test-ExportGIF")
+
+	fileName := filepath.Join(os.TempDir(), "d3pixelbot-test.gif")
+	defer os.Remove(fileName)
+
+	opts := exportOptions{
+		Rect:      rect,
+		StartTime: startTime,
+		EndTime:   endTime.Add(time.Second),
+		Speedup:   1,
+		FrameRate: 10,
+		Scale:     2,
+	}
+	if err := exportAnimation("Test-ExportGIF", opts, fileName); err != nil {
+		t.Fatalf("Can't export GIF: %v", err)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Can't open exported GIF: %v", err)
+	}
+	defer f.Close()
+
+	anim, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatalf("Can't decode exported GIF: %v", err)
+	}
+	if len(anim.Image) == 0 {
+		t.Fatalf("Exported GIF has no frames")
+	}
+	if got, want := anim.Image[0].Bounds(), image.Rect(0, 0, 128, 128); got != want {
+		t.Errorf("Frame bounds = %v, want %v", got, want)
+	}
+}
+
+func Test_exportAPNG(t *testing.T) {
+	rect, pos, endTime := writeTestRecording(t, "Test-ExportAPNG")
+
+	fileName := filepath.Join(os.TempDir(), "d3pixelbot-test.apng")
+	defer os.Remove(fileName)
+
+	opts := exportOptions{
+		Rect:      rect,
+		StartTime: endTime,
+		EndTime:   endTime.Add(time.Second),
+		Speedup:   1,
+		FrameRate: 10,
+		Upscale:   2,
+	}
+	if err := exportAnimation("Test-ExportAPNG", opts, fileName); err != nil {
+		t.Fatalf("Can't export APNG: %v", err)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Can't open exported APNG: %v", err)
+	}
+	defer f.Close()
+
+	// Decoders without APNG support only see the first frame, which is the default image
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Can't decode exported APNG: %v", err)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 128, 128); got != want {
+		t.Errorf("Image bounds = %v, want %v", got, want)
+	}
+	for _, p := range []image.Point{pos.Mul(2), pos.Mul(2).Add(image.Point{1, 1})} {
+		if got, want := color.RGBAModel.Convert(img.At(p.X, p.Y)), color.RGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+			t.Errorf("Pixel at %v = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func Test_diffRect(t *testing.T) {
+	a := image.NewPaletted(image.Rect(0, 0, 16, 16), pixelcanvasioPalette)
+	b := image.NewPaletted(image.Rect(0, 0, 16, 16), pixelcanvasioPalette)
+
+	if got := diffRect(a, b); !got.Empty() {
+		t.Errorf("diffRect() of equal images = %v, want empty rectangle", got)
+	}
+
+	b.SetColorIndex(3, 4, 1)
+	b.SetColorIndex(7, 10, 1)
+	if got, want := diffRect(a, b), image.Rect(3, 4, 8, 11); got != want {
+		t.Errorf("diffRect() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,237 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"time"
+)
+
+// Writes frames as animated PNG.
+//
+// Frames are streamed into the file, the frame count is updated on Close().
+// If the game palette is known and the output isn't scaled, the frames are stored paletted. Otherwise as 8 bit RGBA.
+type apngEncoder struct {
+	writer  io.WriteSeeker
+	size    pixelSize
+	palette color.Palette // nil for RGBA
+
+	sequence       uint32 // Sequence number of the next fcTL or fdAT chunk
+	frames         uint32
+	acTLOffset     int64
+	compressBuffer bytes.Buffer
+}
+
+func newAPNGEncoder(w io.WriteSeeker, size pixelSize, pal color.Palette, opts exportOptions) (animationEncoder, error) {
+	enc := &apngEncoder{
+		writer: w,
+		size:   size,
+	}
+	if pal != nil && len(pal) < 256 && opts.Scale == 1 {
+		enc.palette = make(color.Palette, len(pal), len(pal)+1)
+		copy(enc.palette, pal)
+		enc.palette = append(enc.palette, color.Transparent) // For areas without data
+	}
+
+	if _, err := w.Write([]byte("\x89PNG\r\n\x1a\n")); err != nil {
+		return nil, err
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(size.X))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(size.Y))
+	ihdr[8] = 8 // Bit depth
+	ihdr[9] = 6 // Color type: RGBA
+	if enc.palette != nil {
+		ihdr[9] = 3 // Color type: Paletted
+	}
+	if err := enc.writeChunk("IHDR", ihdr); err != nil {
+		return nil, err
+	}
+
+	offset, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	enc.acTLOffset = offset
+	if err := enc.writeACTL(); err != nil {
+		return nil, err
+	}
+
+	if enc.palette != nil {
+		plte, trns := make([]byte, 0, 3*len(enc.palette)), make([]byte, 0, len(enc.palette))
+		for _, col := range enc.palette {
+			c := color.NRGBAModel.Convert(col).(color.NRGBA)
+			plte = append(plte, c.R, c.G, c.B)
+			trns = append(trns, c.A)
+		}
+		if err := enc.writeChunk("PLTE", plte); err != nil {
+			return nil, err
+		}
+		if err := enc.writeChunk("tRNS", trns); err != nil {
+			return nil, err
+		}
+	}
+
+	return enc, nil
+}
+
+func (enc *apngEncoder) writeChunk(chunkType string, data []byte) error {
+	return writePNGChunk(enc.writer, chunkType, data)
+}
+
+// Writes a PNG chunk with length and CRC
+func writePNGChunk(w io.Writer, chunkType string, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	copy(header[4:8], chunkType)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:8])
+	crc.Write(data)
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc.Sum32())
+
+	for _, b := range [][]byte{header, data, footer} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (enc *apngEncoder) writeACTL() error {
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:4], enc.frames)
+	binary.BigEndian.PutUint32(actl[4:8], 0) // Loop forever
+	return enc.writeChunk("acTL", actl)
+}
+
+func (enc *apngEncoder) convertFrame(img image.Image) image.Image {
+	rect := image.Rect(0, 0, enc.size.X, enc.size.Y)
+
+	if enc.palette != nil {
+		paletted := image.NewPaletted(rect, enc.palette)
+		draw.Draw(paletted, rect, img, img.Bounds().Min, draw.Src)
+		return paletted
+	}
+
+	nrgba := image.NewNRGBA(rect)
+	draw.Draw(nrgba, rect, img, img.Bounds().Min, draw.Src)
+	return nrgba
+}
+
+func (enc *apngEncoder) writeFrame(img image.Image, duration time.Duration) error {
+	rect := img.Bounds()
+
+	// Get raw scanlines, each prefixed by the filter type 0 (None)
+	var pix []uint8
+	var stride, bytesPerPixel int
+	switch img := img.(type) {
+	case *image.Paletted:
+		pix, stride, bytesPerPixel = img.Pix, img.Stride, 1
+	case *image.NRGBA:
+		pix, stride, bytesPerPixel = img.Pix, img.Stride, 4
+	default:
+		return fmt.Errorf("Incompatible image type %T", img)
+	}
+
+	enc.compressBuffer.Reset()
+	zipWriter, err := zlib.NewWriterLevel(&enc.compressBuffer, zlib.BestCompression)
+	if err != nil {
+		return err
+	}
+	width := rect.Dx() * bytesPerPixel
+	for iy := 0; iy < rect.Dy(); iy++ {
+		zipWriter.Write([]byte{0})
+		zipWriter.Write(pix[iy*stride : iy*stride+width])
+	}
+	if err := zipWriter.Close(); err != nil {
+		return err
+	}
+
+	delay := duration / time.Millisecond
+	if delay > 0xFFFF {
+		delay = 0xFFFF
+	}
+
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[0:4], enc.sequence)
+	binary.BigEndian.PutUint32(fctl[4:8], uint32(rect.Dx()))
+	binary.BigEndian.PutUint32(fctl[8:12], uint32(rect.Dy()))
+	binary.BigEndian.PutUint32(fctl[12:16], uint32(rect.Min.X))
+	binary.BigEndian.PutUint32(fctl[16:20], uint32(rect.Min.Y))
+	binary.BigEndian.PutUint16(fctl[20:22], uint16(delay))
+	binary.BigEndian.PutUint16(fctl[22:24], 1000)
+	fctl[24] = 0 // Dispose: None
+	fctl[25] = 0 // Blend: Source
+	if err := enc.writeChunk("fcTL", fctl); err != nil {
+		return err
+	}
+	enc.sequence++
+
+	if enc.frames == 0 {
+		// The first frame is also the default image
+		if err := enc.writeChunk("IDAT", enc.compressBuffer.Bytes()); err != nil {
+			return err
+		}
+	} else {
+		fdat := make([]byte, 4, 4+enc.compressBuffer.Len())
+		binary.BigEndian.PutUint32(fdat[0:4], enc.sequence)
+		fdat = append(fdat, enc.compressBuffer.Bytes()...)
+		if err := enc.writeChunk("fdAT", fdat); err != nil {
+			return err
+		}
+		enc.sequence++
+	}
+
+	enc.frames++
+
+	return nil
+}
+
+func (enc *apngEncoder) Close() error {
+	if err := enc.writeChunk("IEND", nil); err != nil {
+		return err
+	}
+
+	// Update the frame count
+	end, err := enc.writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := enc.writer.Seek(enc.acTLOffset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := enc.writeACTL(); err != nil {
+		return err
+	}
+	if _, err := enc.writer.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"math"
+	"time"
+)
+
+// Automatic framing of frame based exports.
+//
+// Instead of showing the whole export rectangle all the time, a virtual camera pans and zooms to follow the activity.
+// The camera keeps the aspect ratio of the export rectangle, and always stays inside of it.
+type exportAutoFrame struct {
+	Enabled   bool
+	Window    int     // Number of frames before and after each frame whose pixel changes are taken into account. Defaults to 15
+	Padding   float64 // Space around the activity, relative to its size. Defaults to 0.5
+	MinWidth  int     // Minimum width of the camera in canvas pixels. Defaults to 1/8 of the export rectangle
+	Smoothing float64 // Smoothing of the camera movement from 0 (none) to below 1. Defaults to 0.9
+}
+
+// Pixel changes that happened during a single frame, reduced to their first and second moments
+type autoFrameBucket struct {
+	Count            float64
+	SumX, SumY       float64
+	SumXSqr, SumYSqr float64
+}
+
+func (b *autoFrameBucket) add(pos image.Point) {
+	x, y := float64(pos.X)+0.5, float64(pos.Y)+0.5 // Center of the pixel
+	b.Count++
+	b.SumX += x
+	b.SumY += y
+	b.SumXSqr += x * x
+	b.SumYSqr += y * y
+}
+
+// Reads the pixel changes of the recordings and computes the camera rectangle of every frame.
+// The options need to be prepared already.
+func (af exportAutoFrame) computeRects(cfe *canvasFrameExtractor, opts *exportOptions) ([]image.Rectangle, error) {
+	frameCount := opts.frameCount()
+	if frameCount <= 0 {
+		return nil, nil
+	}
+	interval := opts.frameInterval()
+	buckets := make([]autoFrameBucket, frameCount)
+
+	err := canvasDiskReaderForEachEvent(cfe.Recordings, opts.StartTime, opts.EndTime, func(t time.Time, event interface{}) error {
+		if event, ok := event.(canvasEventSetPixel); ok && event.Pos.In(opts.Rect) {
+			i := int(t.Sub(opts.StartTime) / interval)
+			if i >= 0 && i < frameCount {
+				buckets[i].add(event.Pos)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return af.cameraRects(buckets, opts.Rect), nil
+}
+
+// Returns one camera rectangle per bucket.
+//
+// The camera covers roughly 95% of the pixel changes inside of the window around each frame, plus padding.
+// Frames without any activity nearby keep the camera of the previous frame.
+// If there is no activity at all, the camera shows the whole rectangle.
+func (af exportAutoFrame) cameraRects(buckets []autoFrameBucket, rect image.Rectangle) []image.Rectangle {
+	if af.Window <= 0 {
+		af.Window = 15
+	}
+	if af.Padding <= 0 {
+		af.Padding = 0.5
+	}
+	if af.MinWidth <= 0 {
+		af.MinWidth = rect.Dx() / 8
+	}
+	if af.Smoothing < 0 || af.Smoothing >= 1 {
+		af.Smoothing = 0.9
+	}
+
+	aspect := float64(rect.Dx()) / float64(rect.Dy())
+	maxWidth := float64(rect.Dx())
+	minWidth := math.Max(1, math.Min(float64(af.MinWidth), maxWidth))
+
+	// Prefix sums, so that every window can be summed up in constant time
+	sums := make([]autoFrameBucket, len(buckets)+1)
+	for i, b := range buckets {
+		s := sums[i]
+		sums[i+1] = autoFrameBucket{s.Count + b.Count, s.SumX + b.SumX, s.SumY + b.SumY, s.SumXSqr + b.SumXSqr, s.SumYSqr + b.SumYSqr}
+	}
+
+	// Raw camera per frame as center and width, NaN where there is no activity
+	type camera struct{ X, Y, Width float64 }
+	cams := make([]camera, len(buckets))
+	for i := range buckets {
+		a, b := i-af.Window, i+af.Window+1
+		if a < 0 {
+			a = 0
+		}
+		if b > len(buckets) {
+			b = len(buckets)
+		}
+		s, e := sums[a], sums[b]
+		count := e.Count - s.Count
+		if count <= 0 {
+			cams[i] = camera{math.NaN(), math.NaN(), math.NaN()}
+			continue
+		}
+		meanX, meanY := (e.SumX-s.SumX)/count, (e.SumY-s.SumY)/count
+		devX := math.Sqrt(math.Max(0, (e.SumXSqr-s.SumXSqr)/count-meanX*meanX))
+		devY := math.Sqrt(math.Max(0, (e.SumYSqr-s.SumYSqr)/count-meanY*meanY))
+
+		width := math.Max(4*devX, 4*devY*aspect) * (1 + af.Padding)
+		cams[i] = camera{meanX, meanY, math.Max(minWidth, math.Min(maxWidth, width))}
+	}
+
+	// Fill frames without activity with the previous camera, or the following one at the beginning
+	known := -1
+	for i := range cams {
+		if !math.IsNaN(cams[i].Width) {
+			known = i
+		} else if known >= 0 {
+			cams[i] = cams[known]
+		}
+	}
+	if known < 0 {
+		rects := make([]image.Rectangle, len(buckets))
+		for i := range rects {
+			rects[i] = rect
+		}
+		return rects
+	}
+	for i := len(cams) - 1; i >= 0; i-- {
+		if !math.IsNaN(cams[i].Width) {
+			known = i
+		} else {
+			cams[i] = cams[known]
+		}
+	}
+
+	// Smooth forwards and backwards, so the camera doesn't lag behind the activity
+	for _, dir := range []int{1, -1} {
+		start, end := 0, len(cams)
+		if dir < 0 {
+			start, end = len(cams)-1, -1
+		}
+		prev := cams[start]
+		for i := start; i != end; i += dir {
+			c := cams[i]
+			prev = camera{
+				X:     prev.X*af.Smoothing + c.X*(1-af.Smoothing),
+				Y:     prev.Y*af.Smoothing + c.Y*(1-af.Smoothing),
+				Width: prev.Width*af.Smoothing + c.Width*(1-af.Smoothing),
+			}
+			cams[i] = prev
+		}
+	}
+
+	rects := make([]image.Rectangle, len(cams))
+	for i, c := range cams {
+		rects[i] = autoFrameCameraRect(c.X, c.Y, c.Width, aspect, rect)
+	}
+	return rects
+}
+
+// Returns the rectangle with the given center and width, and the aspect ratio of bounds.
+// The result is moved to lie inside of bounds.
+func autoFrameCameraRect(x, y, width, aspect float64, bounds image.Rectangle) image.Rectangle {
+	w := int(math.Round(width))
+	if w > bounds.Dx() {
+		w = bounds.Dx()
+	}
+	if w < 1 {
+		w = 1
+	}
+	h := int(math.Round(float64(w) / aspect))
+	if h > bounds.Dy() {
+		h = bounds.Dy()
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	min := image.Point{int(math.Round(x - float64(w)/2)), int(math.Round(y - float64(h)/2))}
+	if min.X < bounds.Min.X {
+		min.X = bounds.Min.X
+	}
+	if min.Y < bounds.Min.Y {
+		min.Y = bounds.Min.Y
+	}
+	if min.X+w > bounds.Max.X {
+		min.X = bounds.Max.X - w
+	}
+	if min.Y+h > bounds.Max.Y {
+		min.Y = bounds.Max.Y - h
+	}
+
+	return image.Rectangle{min, min.Add(image.Point{w, h})}
+}
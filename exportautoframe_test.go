@@ -0,0 +1,85 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func Test_exportAutoFrame_cameraRects(t *testing.T) {
+	rect := image.Rect(-100, -50, 300, 150)
+
+	// Activity in the upper left corner first, then in the lower right corner
+	areas := []image.Rectangle{image.Rect(-90, -40, -70, -30), image.Rect(250, 120, 270, 130)}
+	buckets := make([]autoFrameBucket, 100)
+	for i := range buckets {
+		area := areas[i*len(areas)/len(buckets)]
+		for y := area.Min.Y; y < area.Max.Y; y += 2 {
+			for x := area.Min.X; x < area.Max.X; x += 2 {
+				buckets[i].add(image.Point{x, y})
+			}
+		}
+	}
+
+	af := exportAutoFrame{Enabled: true, Window: 2, Smoothing: 0.5}
+	rects := af.cameraRects(buckets, rect)
+	if len(rects) != len(buckets) {
+		t.Fatalf("Got %v rectangles, want %v", len(rects), len(buckets))
+	}
+	for i, r := range rects {
+		if !r.In(rect) {
+			t.Errorf("Rectangle %v of frame %v is outside of %v", r, i, rect)
+		}
+		if got, want := float64(r.Dx())/float64(r.Dy()), float64(rect.Dx())/float64(rect.Dy()); got < want*0.9 || got > want*1.1 {
+			t.Errorf("Rectangle %v of frame %v has aspect ratio %v, want %v", r, i, got, want)
+		}
+	}
+	if first := rects[0]; !areas[0].In(first) || first.Dx() >= rect.Dx()/2 {
+		t.Errorf("First rectangle %v doesn't zoom in on %v", first, areas[0])
+	}
+	if last := rects[len(rects)-1]; !areas[1].In(last) || last.Dx() >= rect.Dx()/2 {
+		t.Errorf("Last rectangle %v doesn't zoom in on %v", last, areas[1])
+	}
+
+	// Without any activity the whole rectangle is shown
+	rects = af.cameraRects(make([]autoFrameBucket, 10), rect)
+	for i, r := range rects {
+		if r != rect {
+			t.Errorf("Rectangle of frame %v without activity = %v, want %v", i, r, rect)
+		}
+	}
+}
+
+func Test_autoFrameCameraRect(t *testing.T) {
+	bounds := image.Rect(0, 0, 200, 100)
+	tests := []struct {
+		x, y, width float64
+		want        image.Rectangle
+	}{
+		{100, 50, 40, image.Rect(80, 40, 120, 60)},
+		{0, 0, 40, image.Rect(0, 0, 40, 20)},
+		{200, 100, 40, image.Rect(160, 80, 200, 100)},
+		{50, 50, 1000, bounds},
+	}
+
+	for _, test := range tests {
+		if got := autoFrameCameraRect(test.x, test.y, test.width, 2, bounds); got != test.want {
+			t.Errorf("autoFrameCameraRect(%v, %v, %v) = %v, want %v", test.x, test.y, test.width, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// File extension of clips
+const canvasClipExtension = ".pixclip"
+
+// Metadata of a clip, stored as JSON in the extra field of its gzip header
+type canvasClipInfo struct {
+	Game               string          // Short name of the recorded game
+	Title              string          // Optional description of what happens in the clip
+	Rect               image.Rectangle // Region of the canvas the clip is about. The recorded area is extended to whole chunks
+	StartTime, EndTime time.Time
+	Creator            string // Version of D3pixelbot that exported the clip
+}
+
+// Maximum number of pixels of the chunk aligned area of a clip
+const canvasClipMaxPixels = 4096 * 4096
+
+// Exports a short part of the recordings of shortName into a single self-contained clip, that can be shared and replayed by other instances.
+//
+// A clip is a pixrec file with some extras: It starts with a keyframe of all valid chunks at the start time, and only contains events inside the chunks that overlap the rectangle of the options.
+// Its metadata is stored in the gzip header, see canvasClipInfo.
+func exportClip(shortName string, opts exportOptions, title string, fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+
+	if err := writeCanvasClip(file, shortName, opts, title); err != nil {
+		file.Close()
+		os.Remove(fileName)
+		return fmt.Errorf("Can't export clip into %v: %v", fileName, err)
+	}
+
+	return nil
+}
+
+// Writes a clip into w, see exportClip
+func writeCanvasClip(w io.Writer, shortName string, opts exportOptions, title string) error {
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return err
+	}
+
+	chunkRect := cfe.Canvas.ChunkSize.getOuterChunkRect(opts.Rect, cfe.Canvas.Origin)
+	area := chunkRect.getPixelRectangle(cfe.Canvas.ChunkSize, cfe.Canvas.Origin)
+	if area.Dx()*area.Dy() > canvasClipMaxPixels {
+		return fmt.Errorf("Clip area %v is larger than %v pixels", area, canvasClipMaxPixels)
+	}
+
+	info := canvasClipInfo{
+		Game:      cfe.ShortName,
+		Title:     title,
+		Rect:      opts.Rect,
+		StartTime: opts.StartTime,
+		EndTime:   opts.EndTime,
+		Creator:   fmt.Sprintf("D3pixelbot %v", version),
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	exportLog.Debugf("Started clip export of %v at %v from %v to %v", shortName, area, opts.StartTime, opts.EndTime)
+
+	zipWriter, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return fmt.Errorf("Can't initialize compression: %v", err)
+	}
+	if err := zipWriter.SetConcurrency(recording.BlockSize, getBackgroundSettings().getWorkers()); err != nil {
+		return fmt.Errorf("Can't initialize compression: %v", err)
+	}
+	zipWriter.Name = info.Game
+	zipWriter.Comment = "D3's custom pixel game client clip"
+	zipWriter.Extra = infoJSON
+
+	header := recording.Header{
+		Time:      opts.StartTime,
+		ChunkSize: image.Point(cfe.Canvas.ChunkSize),
+		Origin:    cfe.Canvas.Origin,
+	}
+	if err := recording.WriteHeader(zipWriter, header); err != nil {
+		return err
+	}
+
+	// Keyframe with the state of all valid chunks at the start time
+	if err := cfe.seek(opts.StartTime); err != nil {
+		return err
+	}
+	chunks, err := cfe.Canvas.getChunks(chunkRect, false, true)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		img, _, _, err := chunk.getImage(true)
+		if err != nil {
+			continue // Invalid chunks stay invalid in the replay
+		}
+		err = recording.WriteEvent(zipWriter, opts.StartTime, recording.SetImage{Image: img.Image})
+		img.release()
+		if err != nil {
+			return err
+		}
+	}
+
+	// All events that touch the area, cut to it
+	events := 0
+	err = canvasDiskReaderForEachEvent(cfe.Recordings, opts.StartTime, opts.EndTime, func(t time.Time, event interface{}) error {
+		var clipEvent interface{}
+		switch event := event.(type) {
+		case canvasEventSetPixel:
+			if event.Pos.In(area) {
+				r, g, b, _ := event.Color.RGBA()
+				clipEvent = recording.SetPixel{Pos: event.Pos, Color: color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}}
+			}
+		case canvasEventInvalidateRect:
+			if rect := event.Rect.Intersect(area); !rect.Empty() {
+				clipEvent = recording.InvalidateRect{Rect: rect}
+			}
+		case canvasEventInvalidateAll:
+			clipEvent = recording.InvalidateAll{}
+		case canvasEventRevalidate:
+			if rect := event.Rect.Intersect(area); !rect.Empty() {
+				clipEvent = recording.RevalidateRect{Rect: rect}
+			}
+		case canvasEventSetImage:
+			// Images are usually whole chunks, so they are either completely inside or outside of the area
+			if event.Image.Bounds().In(area) {
+				clipEvent = recording.SetImage{Image: event.Image}
+			}
+		}
+		if clipEvent == nil {
+			return nil
+		}
+
+		events++
+		return recording.WriteEvent(zipWriter, t, clipEvent)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return err
+	}
+
+	exportLog.Debugf("Finished clip export of %v with %v events", shortName, events)
+
+	return nil
+}
+
+// Returns whether name is the file name of a clip
+func isCanvasClip(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), canvasClipExtension)
+}
+
+// Reads the metadata of the clip in the given file
+func readCanvasClipInfo(fileName string) (canvasClipInfo, error) {
+	info := canvasClipInfo{}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+
+	zipReader, err := gzip.NewReader(io.LimitReader(file, 1<<20))
+	if err != nil {
+		return info, fmt.Errorf("Can't decompress %v: %v", fileName, err)
+	}
+	defer zipReader.Close()
+
+	if err := json.Unmarshal(zipReader.Extra, &info); err != nil {
+		return info, fmt.Errorf("%v is not a clip: %v", fileName, err)
+	}
+
+	return info, nil
+}
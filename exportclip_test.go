@@ -0,0 +1,83 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_exportClip(t *testing.T) {
+	rect, pos, frameTime := writeTestRecording(t, "Test-ExportClip")
+
+	// Time right after the pixel was set, before the recording was closed and invalidated
+	cfe, err := newCanvasFrameExtractor("Test-ExportClip")
+	if err != nil {
+		t.Fatalf("Can't create frame extractor: %v", err)
+	}
+	var pixelTime time.Time
+	canvasDiskReaderForEachEvent(cfe.Recordings, cfe.Recordings[0].StartTime, frameTime, func(t time.Time, event interface{}) error {
+		if _, ok := event.(canvasEventSetPixel); ok {
+			pixelTime = t.Add(1)
+		}
+		return nil
+	})
+	cfe.Close()
+
+	tests := []struct {
+		name string
+		opts exportOptions
+	}{
+		{"Events", exportOptions{Rect: image.Rect(0, 0, 8, 8), EndTime: pixelTime.Add(1)}},
+		{"Keyframe", exportOptions{Rect: image.Rect(0, 0, 8, 8), StartTime: pixelTime, EndTime: frameTime}},
+	}
+	for _, tt := range tests {
+		fileName := filepath.Join(os.TempDir(), "d3pixelbot-test-"+tt.name+canvasClipExtension)
+		defer os.Remove(fileName)
+		if err := exportClip("Test-ExportClip", tt.opts, "Test clip", fileName); err != nil {
+			t.Fatalf("%v: Can't export clip: %v", tt.name, err)
+		}
+
+		info, err := readCanvasClipInfo(fileName)
+		if err != nil {
+			t.Fatalf("%v: Can't read clip info: %v", tt.name, err)
+		}
+		if info.Game != "Test-ExportClip" || info.Title != "Test clip" || info.Rect != tt.opts.Rect {
+			t.Errorf("%v: Got clip info %+v", tt.name, info)
+		}
+
+		cfe, err := newCanvasFrameExtractor(fileName)
+		if err != nil {
+			t.Fatalf("%v: Can't open clip: %v", tt.name, err)
+		}
+		if _, endTime := cfe.getTimeRange(); !endTime.Equal(info.EndTime) {
+			t.Errorf("%v: Clip ends at %v, want %v", tt.name, endTime, info.EndTime)
+		}
+		img, err := cfe.getFrame(pixelTime, rect)
+		if err != nil {
+			t.Fatalf("%v: Can't get frame at %v: %v", tt.name, pixelTime, err)
+		}
+		if got, want := img.At(pos.X, pos.Y), color.RGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+			t.Errorf("%v: Pixel at %v = %v, want %v", tt.name, pos, got, want)
+		}
+		cfe.Close()
+	}
+}
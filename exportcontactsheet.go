@@ -0,0 +1,94 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"time"
+)
+
+const exportContactSheetMaxFrames = 1024
+
+// Exports a grid of frames of the recordings of shortName as one PNG image.
+//
+// The frames are taken every interval, starting at the start time of the options.
+// Frames are placed from left to right, top to bottom. If columns is 0 or less, the grid is made roughly square.
+// The overlay of the options is drawn onto every frame, so it can be used to label them with their time.
+func exportContactSheet(shortName string, opts exportOptions, interval time.Duration, columns int, fileName string) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid interval %v", interval)
+	}
+
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return err
+	}
+
+	frameCount := int((opts.EndTime.Sub(opts.StartTime) + interval - 1) / interval)
+	if frameCount > exportContactSheetMaxFrames {
+		return fmt.Errorf("The contact sheet would contain %v frames, the maximum is %v", frameCount, exportContactSheetMaxFrames)
+	}
+	if columns <= 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(frameCount))))
+	}
+	rows := (frameCount + columns - 1) / columns
+
+	const spacing = 4
+	size := opts.outputSize()
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*(size.X+spacing)+spacing, rows*(size.Y+spacing)+spacing))
+	draw.Draw(sheet, sheet.Rect, image.NewUniform(color.RGBA{32, 32, 32, 255}), image.Point{}, draw.Src)
+
+	exportLog.Debugf("Started contact sheet export of %v at %v from %v to %v with %v frames into %v", shortName, opts.Rect, opts.StartTime, opts.EndTime, frameCount, fileName)
+
+	for i, t := 0, opts.StartTime; i < frameCount; i, t = i+1, t.Add(interval) {
+		img, err := cfe.getFrame(t, opts.Rect)
+		if err != nil {
+			return fmt.Errorf("Can't get frame at %v: %v", t, err)
+		}
+		frame := opts.renderFrame(img, t, shortName)
+
+		pos := image.Point{spacing + (i%columns)*(size.X+spacing), spacing + (i/columns)*(size.Y+spacing)}
+		draw.Draw(sheet, frame.Rect.Sub(frame.Rect.Min).Add(pos), frame, frame.Rect.Min, draw.Over)
+
+		opts.reportProgress(i+1, frameCount)
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, sheet); err != nil {
+		return fmt.Errorf("Can't encode contact sheet %v: %v", fileName, err)
+	}
+
+	exportLog.Debugf("Finished contact sheet export of %v into %v", shortName, fileName)
+
+	return nil
+}
@@ -0,0 +1,79 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_exportContactSheet(t *testing.T) {
+	rect, pos, eventTime := writeTestRecording(t, "Test-ExportContactSheet")
+
+	cfe, err := newCanvasFrameExtractor("Test-ExportContactSheet")
+	if err != nil {
+		t.Fatalf("Can't create frame extractor: %v", err)
+	}
+	startTime, _ := cfe.getTimeRange()
+	cfe.Close()
+
+	fileName := filepath.Join(os.TempDir(), "d3pixelbot-test-contactsheet.png")
+	defer os.Remove(fileName)
+
+	// Three frames in a grid with two columns, all events happen before the second frame
+	opts := exportOptions{
+		Rect:      rect,
+		StartTime: startTime,
+		EndTime:   startTime.Add(eventTime.Sub(startTime) * 3),
+		Upscale:   2,
+	}
+	interval := eventTime.Sub(startTime) + 1
+	if err := exportContactSheet("Test-ExportContactSheet", opts, interval, 2, fileName); err != nil {
+		t.Fatalf("Can't export contact sheet: %v", err)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Can't open exported PNG: %v", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Can't decode exported PNG: %v", err)
+	}
+
+	cellSize := rect.Dx()*2 + 4
+	if got, want := img.Bounds(), image.Rect(0, 0, 2*cellSize+4, 2*cellSize+4); got != want {
+		t.Fatalf("Contact sheet has bounds %v, want %v", got, want)
+	}
+
+	// The last frame contains the pixel
+	lastPos := image.Point{4 + pos.X*2, 4 + cellSize + pos.Y*2}
+	if got, want := color.NRGBAModel.Convert(img.At(lastPos.X, lastPos.Y)), color.NRGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+		t.Errorf("Pixel at %v = %v, want %v", lastPos, got, want)
+	}
+
+	// The fourth cell stays empty
+	background := color.NRGBAModel.Convert(color.RGBA{32, 32, 32, 255})
+	if got := color.NRGBAModel.Convert(img.At(4+cellSize+10, 4+cellSize+10)); got != background {
+		t.Errorf("Empty cell has color %v, want %v", got, background)
+	}
+}
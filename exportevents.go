@@ -0,0 +1,188 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A single recorded event in a flat form, as it is written by exportEvents().
+//
+// X and Y are the position of pixels, or the upper left corner of rectangles and images.
+// Author is only set for pixels of games that report who placed them.
+type exportEventRow struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	X      int       `json:"x"`
+	Y      int       `json:"y"`
+	Width  int       `json:"width,omitempty"`
+	Height int       `json:"height,omitempty"`
+	Color  string    `json:"color,omitempty"` // Hex color like #RRGGBB, only for pixel events
+	Author string    `json:"author,omitempty"`
+
+	ColorName string `json:"colorName,omitempty"` // Name of the color, see paletteNames. After the author, so the columns of older exports keep their position
+}
+
+var exportEventColumns = []string{"time", "type", "x", "y", "width", "height", "color", "author", "color_name"}
+
+func (row exportEventRow) csvRecord() []string {
+	record := []string{
+		row.Time.UTC().Format(time.RFC3339Nano),
+		row.Type,
+		strconv.Itoa(row.X),
+		strconv.Itoa(row.Y),
+		"",
+		"",
+		row.Color,
+		row.Author,
+		row.ColorName,
+	}
+	if row.Width != 0 || row.Height != 0 {
+		record[4], record[5] = strconv.Itoa(row.Width), strconv.Itoa(row.Height)
+	}
+	return record
+}
+
+// Converts a canvasEvent* into a row. Returns false if the event doesn't intersect with rect
+func newExportEventRow(t time.Time, event interface{}, rect image.Rectangle) (exportEventRow, bool) {
+	row := exportEventRow{Time: t}
+
+	setRect := func(r image.Rectangle) bool {
+		row.X, row.Y, row.Width, row.Height = r.Min.X, r.Min.Y, r.Dx(), r.Dy()
+		return r.Overlaps(rect)
+	}
+
+	switch event := event.(type) {
+	case canvasEventSetPixel:
+		row.Type = "set_pixel"
+		row.X, row.Y = event.Pos.X, event.Pos.Y
+		c := color.NRGBAModel.Convert(event.Color).(color.NRGBA)
+		row.Color = fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+		row.Author = event.Author
+		return row, event.Pos.In(rect)
+	case canvasEventInvalidateRect:
+		row.Type = "invalidate_rect"
+		return row, setRect(event.Rect)
+	case canvasEventInvalidateAll:
+		row.Type = "invalidate_all"
+		return row, true
+	case canvasEventRevalidate:
+		row.Type = "revalidate_rect"
+		return row, setRect(event.Rect)
+	case canvasEventSetImage:
+		row.Type = "set_image"
+		return row, setRect(event.Image.Bounds())
+	}
+
+	return row, false
+}
+
+// Exports the events of the recordings of shortName as CSV or newline delimited JSON.
+// The format is chosen by the file extension (.csv, .ndjson or .jsonl).
+//
+// Only events inside of the time range and rectangle of the options are written.
+// If the rectangle of the options is empty, events of the whole canvas are written.
+// If pixelsOnly is true, only pixel changes are written.
+func exportEvents(shortName string, opts exportOptions, pixelsOnly bool, fileName string) error {
+	var writeRow func(row exportEventRow) error
+	var finish func() error
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+	bufWriter := bufio.NewWriter(file)
+
+	switch ext := strings.ToLower(filepath.Ext(fileName)); ext {
+	case ".csv":
+		csvWriter := csv.NewWriter(bufWriter)
+		if err := csvWriter.Write(exportEventColumns); err != nil {
+			return err
+		}
+		writeRow = func(row exportEventRow) error {
+			return csvWriter.Write(row.csvRecord())
+		}
+		finish = func() error {
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	case ".ndjson", ".jsonl":
+		encoder := json.NewEncoder(bufWriter) // Encode writes a newline after every value
+		writeRow = func(row exportEventRow) error {
+			return encoder.Encode(row)
+		}
+		finish = func() error { return nil }
+	default:
+		return fmt.Errorf("Unsupported event export format %v", ext)
+	}
+
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return err
+	}
+	defer cfe.Close()
+
+	if opts.Rect.Empty() {
+		opts.Rect = image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32)
+	}
+	if err := opts.prepare(cfe); err != nil {
+		return err
+	}
+
+	exportLog.Debugf("Started event export of %v at %v from %v to %v into %v", shortName, opts.Rect, opts.StartTime, opts.EndTime, fileName)
+
+	names := getPaletteNames(conf, shortName)
+	events := 0
+	err = canvasDiskReaderForEachEvent(cfe.Recordings, opts.StartTime, opts.EndTime, func(t time.Time, event interface{}) error {
+		if _, ok := event.(canvasEventSetPixel); pixelsOnly && !ok {
+			return nil
+		}
+		row, ok := newExportEventRow(t, event, opts.Rect)
+		if !ok {
+			return nil
+		}
+		row.ColorName = names[row.Color]
+		events++
+		return writeRow(row)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := finish(); err != nil {
+		return fmt.Errorf("Can't write to %v: %v", fileName, err)
+	}
+	if err := bufWriter.Flush(); err != nil {
+		return fmt.Errorf("Can't write to %v: %v", fileName, err)
+	}
+
+	exportLog.Debugf("Finished event export of %v with %v events into %v", shortName, events, fileName)
+
+	return nil
+}
@@ -0,0 +1,103 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func Test_exportEvents(t *testing.T) {
+	_, pos, _ := writeTestRecording(t, "Test-ExportEvents")
+
+	c := color.NRGBAModel.Convert(pixelcanvasioPalette[5]).(color.NRGBA)
+	wantColor := fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+
+	csvFileName := filepath.Join(os.TempDir(), "d3pixelbot-test-events.csv")
+	defer os.Remove(csvFileName)
+	if err := exportEvents("Test-ExportEvents", exportOptions{}, false, csvFileName); err != nil {
+		t.Fatalf("Can't export events: %v", err)
+	}
+
+	f, err := os.Open(csvFileName)
+	if err != nil {
+		t.Fatalf("Can't open exported CSV: %v", err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("Can't read exported CSV: %v", err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("Got %v records, want header, image, pixel and the invalidation at the end", len(records))
+	}
+	if got, want := records[1][1], "set_image"; got != want {
+		t.Errorf("Type of first event = %v, want %v", got, want)
+	}
+	if got, want := records[2][1:7], []string{"set_pixel", strconv.Itoa(pos.X), strconv.Itoa(pos.Y), "", "", wantColor}; !equalStrings(got, want) {
+		t.Errorf("Pixel event = %v, want %v", got, want)
+	}
+	if got, want := records[3][1], "invalidate_all"; got != want {
+		t.Errorf("Type of last event = %v, want %v", got, want)
+	}
+
+	jsonFileName := filepath.Join(os.TempDir(), "d3pixelbot-test-events.ndjson")
+	defer os.Remove(jsonFileName)
+	if err := exportEvents("Test-ExportEvents", exportOptions{}, true, jsonFileName); err != nil {
+		t.Fatalf("Can't export events: %v", err)
+	}
+
+	f2, err := os.Open(jsonFileName)
+	if err != nil {
+		t.Fatalf("Can't open exported NDJSON: %v", err)
+	}
+	defer f2.Close()
+	rows := []exportEventRow{}
+	scanner := bufio.NewScanner(f2)
+	for scanner.Scan() {
+		row := exportEventRow{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("Can't parse line %q: %v", scanner.Text(), err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("Got %v rows, want only the pixel", len(rows))
+	}
+	if rows[0].X != pos.X || rows[0].Y != pos.Y || rows[0].Color != wantColor {
+		t.Errorf("Pixel event = %+v, want position %v and color %v", rows[0], pos, wantColor)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
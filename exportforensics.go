@@ -0,0 +1,411 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Overwrites of correct template pixels belong to the same incident, as long as they are at most this far apart
+const forensicsIncidentGap = 2 * time.Minute
+
+// Minimum number of overwrites of an incident. Fewer are left out as noise, like single misclicks
+const forensicsIncidentMin = 10
+
+// Number of incidents with snapshots, the ones with the most overwrites get them
+const forensicsSnapshots = 10
+
+// Thresholds of the patterns that hint at coordinated or automated griefing
+const (
+	forensicsBurstRate       = 30   // Overwrites per minute of a burst
+	forensicsRegularTiming   = 0.25 // Maximum coefficient of variation of the intervals between overwrites
+	forensicsSingleColor     = 0.8  // Minimum share of the most used color
+	forensicsCompactDensity  = 0.5  // Minimum share of overwritten pixels in the bounds of the incident
+	forensicsSnapshotPadding = 8    // Pixels around the bounds of an incident that are shown in its snapshots
+)
+
+// A group of overwrites of correct template pixels that happened close together
+type forensicsIncident struct {
+	Start, End    time.Time
+	Overwrites    int             // Placements that replaced a correct template pixel with a wrong color
+	Pixels        int             // Number of different pixels that were overwritten
+	Rate          float64         // Overwrites per minute
+	Variation     float64         // Coefficient of variation of the intervals between the overwrites. Bots have low values
+	DominantColor string          // Most used color in hex notation
+	DominantName  string          `json:",omitempty"` // Name of the most used color, see paletteNames
+	DominantShare float64         // Share of the most used color
+	Bounds        image.Rectangle // Bounds of the overwritten pixels
+	Density       float64         // Share of overwritten pixels in the bounds
+	Patterns      []string        // Patterns that hint at coordination or bots: "burst", "regular timing", "single color", "compact shape"
+
+	Before, After template.URL `json:",omitempty"` // PNG snapshots of the bounds as data URIs. Only set for the largest incidents
+
+	times  []time.Time
+	colors map[color.NRGBA]int
+	pixels map[image.Point]struct{}
+}
+
+// Results of the forensics, also used as data of the HTML template
+type forensicsData struct {
+	ShortName          string
+	Rect               image.Rectangle
+	StartTime, EndTime time.Time
+	Generated          time.Time
+
+	TemplatePixels int // Number of non transparent template pixels
+	Placements     int // Number of pixel changes inside of the template
+	Helpful        int // Placements that matched the template
+	Overwrites     int // Placements that replaced a correct pixel with a wrong one
+	Incidents      []*forensicsIncident
+
+	OverwriteBars, HelpfulBars []exportReportBar `json:"-"`
+	GraphWidth, GraphHeight    int               `json:"-"`
+}
+
+// Scans the recordings of a game for griefing of a template.
+//
+// Overwrites of correct template pixels are grouped into incidents, which are checked for patterns of coordinated or automated griefing.
+// The result is written as HTML timeline with snapshots of the largest incidents, or as JSON if the file name ends with .json.
+// The template is placed like in reports, see exportReport().
+func exportForensics(shortName string, opts exportOptions, templateFileName string, fileName string) error {
+	if templateFileName == "" {
+		return fmt.Errorf("Forensics need a template, use -template")
+	}
+	tmpl, err := loadExportReportTemplate(templateFileName, opts.Rect.Min)
+	if err != nil {
+		return err
+	}
+	opts.Rect = tmpl.Rect
+
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return err
+	}
+
+	// The current state of the region, to know whether a placement overwrites a correct pixel
+	state, err := cfe.getFrame(opts.StartTime, opts.Rect)
+	if err != nil {
+		return fmt.Errorf("Can't get image at %v: %v", opts.StartTime, err)
+	}
+	pal := cfe.getPalette()
+	quantizeExportReportTemplate(tmpl, pal)
+	quantize := func(c color.Color) color.NRGBA {
+		if pal != nil {
+			c = pal.Convert(c)
+		}
+		return color.NRGBAModel.Convert(c).(color.NRGBA)
+	}
+
+	data := forensicsData{
+		ShortName:   shortName,
+		Rect:        opts.Rect,
+		StartTime:   opts.StartTime,
+		EndTime:     opts.EndTime,
+		Generated:   time.Now(),
+		GraphWidth:  600,
+		GraphHeight: 150,
+	}
+	for i := 3; i < len(tmpl.Pix); i += 4 {
+		if tmpl.Pix[i] != 0 {
+			data.TemplatePixels++
+		}
+	}
+
+	snapshots := forensicsSnapshots
+	progressTotal := 2 + 2*snapshots
+	opts.reportProgress(1, progressTotal)
+
+	overwriteBuckets, helpfulBuckets := make([]int, exportReportSamples), make([]int, exportReportSamples)
+	var incident *forensicsIncident
+	err = canvasDiskReaderForEachEvent(cfe.Recordings, opts.StartTime, opts.EndTime, func(t time.Time, event interface{}) error {
+		switch event := event.(type) {
+		case canvasEventSetImage:
+			// Downloads resynchronize the state
+			draw.Draw(state, event.Image.Bounds().Intersect(state.Rect), event.Image, event.Image.Bounds().Intersect(state.Rect).Min, draw.Src)
+			return nil
+		case canvasEventSetPixel:
+			pos := event.Pos
+			if !pos.In(tmpl.Rect) {
+				return nil
+			}
+			want := tmpl.NRGBAAt(pos.X, pos.Y)
+			if want.A == 0 {
+				return nil
+			}
+			c, previous := quantize(event.Color), quantize(state.RGBAAt(pos.X, pos.Y))
+			state.SetRGBA(pos.X, pos.Y, color.RGBAModel.Convert(event.Color).(color.RGBA))
+
+			data.Placements++
+			bucket := int(int64(t.Sub(opts.StartTime)) * exportReportSamples / int64(opts.EndTime.Sub(opts.StartTime)))
+			if c == want {
+				data.Helpful++
+				helpfulBuckets[bucket]++
+				return nil
+			}
+			if previous != want {
+				return nil // Only overwrites of correct pixels count as griefing
+			}
+			data.Overwrites++
+			overwriteBuckets[bucket]++
+
+			if incident == nil || t.Sub(incident.End) > forensicsIncidentGap {
+				incident = &forensicsIncident{Start: t, colors: map[color.NRGBA]int{}, pixels: map[image.Point]struct{}{}}
+				data.Incidents = append(data.Incidents, incident)
+			}
+			incident.End = t
+			incident.times = append(incident.times, t)
+			incident.colors[c]++
+			incident.pixels[pos] = struct{}{}
+			incident.Bounds = incident.Bounds.Union(image.Rectangle{pos, pos.Add(image.Point{1, 1})})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	opts.reportProgress(2, progressTotal)
+
+	// Drop small incidents, and analyze the others
+	names := getPaletteNames(conf, shortName)
+	incidents := data.Incidents[:0]
+	for _, incident := range data.Incidents {
+		if len(incident.times) >= forensicsIncidentMin {
+			incident.analyze()
+			incident.DominantName = names[incident.DominantColor]
+			incidents = append(incidents, incident)
+		}
+	}
+	data.Incidents = incidents
+
+	data.OverwriteBars = forensicsBars(overwriteBuckets, data.GraphWidth, data.GraphHeight)
+	data.HelpfulBars = forensicsBars(helpfulBuckets, data.GraphWidth, data.GraphHeight)
+
+	// Snapshots of the largest incidents, requested in ascending order of time
+	largest := append([]*forensicsIncident{}, data.Incidents...)
+	sort.SliceStable(largest, func(i, j int) bool { return largest[i].Overwrites > largest[j].Overwrites })
+	if len(largest) > snapshots {
+		largest = largest[:snapshots]
+	}
+	type snapshot struct {
+		t        time.Time
+		incident *forensicsIncident
+		after    bool
+	}
+	requests := []snapshot{}
+	for _, incident := range largest {
+		before, after := incident.Start.Add(-time.Second), incident.End.Add(time.Second)
+		if before.Before(opts.StartTime) {
+			before = opts.StartTime
+		}
+		if !after.Before(opts.EndTime) {
+			after = opts.EndTime.Add(-time.Nanosecond)
+		}
+		requests = append(requests, snapshot{before, incident, false}, snapshot{after, incident, true})
+	}
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].t.Before(requests[j].t) })
+	for i, request := range requests {
+		rect := request.incident.Bounds.Inset(-forensicsSnapshotPadding).Intersect(opts.Rect)
+		img, err := cfe.getFrame(request.t, rect)
+		if err != nil {
+			return fmt.Errorf("Can't get image at %v: %v", request.t, err)
+		}
+		uri, err := forensicsDataURI(img, opts.Upscale)
+		if err != nil {
+			return fmt.Errorf("Can't encode image: %v", err)
+		}
+		if request.after {
+			request.incident.After = uri
+		} else {
+			request.incident.Before = uri
+		}
+		opts.reportProgress(3+i, progressTotal)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0777); err != nil {
+		return fmt.Errorf("Can't create directory for %v: %v", fileName, err)
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(fileName)) == ".json" {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "\t")
+		err = encoder.Encode(data)
+	} else {
+		err = exportForensicsTemplate.Execute(file, data)
+	}
+	if err != nil {
+		return fmt.Errorf("Can't write forensics %v: %v", fileName, err)
+	}
+	opts.reportProgress(progressTotal, progressTotal)
+
+	return nil
+}
+
+// Computes the statistics and patterns of an incident from its overwrites
+func (incident *forensicsIncident) analyze() {
+	incident.Overwrites = len(incident.times)
+	incident.Pixels = len(incident.pixels)
+
+	minutes := math.Max(incident.End.Sub(incident.Start).Minutes(), 1.0/60)
+	incident.Rate = float64(incident.Overwrites) / minutes
+
+	// Variation of the intervals. Identical timestamps count as perfectly regular
+	intervals := make([]float64, 0, len(incident.times)-1)
+	mean := 0.0
+	for i := 1; i < len(incident.times); i++ {
+		d := incident.times[i].Sub(incident.times[i-1]).Seconds()
+		intervals = append(intervals, d)
+		mean += d
+	}
+	mean /= float64(len(intervals))
+	if mean > 0 {
+		variance := 0.0
+		for _, d := range intervals {
+			variance += (d - mean) * (d - mean)
+		}
+		incident.Variation = math.Sqrt(variance/float64(len(intervals))) / mean
+	}
+
+	var dominant color.NRGBA
+	for c, n := range incident.colors {
+		if n > incident.colors[dominant] || n == incident.colors[dominant] && forensicsHex(c) < forensicsHex(dominant) {
+			dominant = c
+		}
+	}
+	incident.DominantColor = forensicsHex(dominant)
+	incident.DominantShare = float64(incident.colors[dominant]) / float64(incident.Overwrites)
+
+	incident.Density = float64(incident.Pixels) / float64(incident.Bounds.Dx()*incident.Bounds.Dy())
+
+	incident.Patterns = []string{}
+	if incident.Rate >= forensicsBurstRate {
+		incident.Patterns = append(incident.Patterns, "burst")
+	}
+	if incident.Variation <= forensicsRegularTiming {
+		incident.Patterns = append(incident.Patterns, "regular timing")
+	}
+	if incident.DominantShare >= forensicsSingleColor {
+		incident.Patterns = append(incident.Patterns, "single color")
+	}
+	if incident.Density >= forensicsCompactDensity && incident.Pixels > 1 {
+		incident.Patterns = append(incident.Patterns, "compact shape")
+	}
+}
+
+func forensicsHex(c color.NRGBA) string {
+	return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+}
+
+// Returns the bars of a bar graph of the given counts
+func forensicsBars(buckets []int, width, height int) []exportReportBar {
+	max := 0
+	for _, count := range buckets {
+		if max < count {
+			max = count
+		}
+	}
+	bars := []exportReportBar{}
+	for i, count := range buckets {
+		if count == 0 {
+			continue
+		}
+		w := float64(width) / float64(len(buckets))
+		h := float64(height) * float64(count) / float64(max)
+		bars = append(bars, exportReportBar{w * float64(i), float64(height) - h, w, h})
+	}
+	return bars
+}
+
+// Encodes an image as PNG data URI, upscaled by the given factor
+func forensicsDataURI(img image.Image, upscale int) (template.URL, error) {
+	if upscale > 1 {
+		img = upscaleNearest(img, upscale)
+	}
+	return exportReportDataURI(img)
+}
+
+var exportForensicsTemplate = template.Must(template.New("forensics").Funcs(template.FuncMap{
+	"time":    func(t time.Time) string { return t.Format("2006-01-02 15:04:05 MST") },
+	"percent": func(f float64) string { return fmt.Sprintf("%.0f%%", f*100) },
+	"join":    strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.ShortName}} forensics {{time .EndTime}}</title>
+<style>
+	body { font-family: sans-serif; background: #222; color: #ddd; margin: 2em; }
+	h1, h2, h3 { font-weight: normal; }
+	img { image-rendering: pixelated; max-width: 100%; min-width: 8em; background: repeating-conic-gradient(#333 0% 25%, #444 0% 50%) 0 0 / 16px 16px; }
+	figure { display: inline-block; margin: 0 1em 1em 0; vertical-align: top; }
+	table { border-collapse: collapse; }
+	td, th { padding: 0.2em 0.8em; text-align: right; }
+	.swatch { display: inline-block; width: 1em; height: 1em; border: 1px solid #888; vertical-align: middle; }
+	.pattern { color: #e66; }
+	svg { background: #333; }
+</style>
+</head>
+<body>
+<h1>{{.ShortName}} forensics at ({{.Rect.Min.X}}, {{.Rect.Min.Y}}) - ({{.Rect.Max.X}}, {{.Rect.Max.Y}})</h1>
+<p>From {{time .StartTime}} to {{time .EndTime}}, generated {{time .Generated}}</p>
+
+<h2>Timeline</h2>
+<p>{{.Placements}} pixels were placed on {{.TemplatePixels}} template pixels, {{.Helpful}} of them matching the template.
+{{.Overwrites}} placements overwrote correct pixels, {{len .Incidents}} incidents have at least 10 overwrites.</p>
+<svg width="{{.GraphWidth}}" height="{{.GraphHeight}}" viewBox="0 0 {{.GraphWidth}} {{.GraphHeight}}">
+	{{range .HelpfulBars}}<rect x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}" fill="#4c4" fill-opacity="0.5"/>{{end}}
+	{{range .OverwriteBars}}<rect x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}" fill="#c44" fill-opacity="0.8"/>{{end}}
+</svg>
+<p>Overwrites in red, placements matching the template in green.</p>
+
+{{if .Incidents}}
+<h2>Incidents</h2>
+<table>
+	<tr><th>Start</th><th>Duration</th><th>Overwrites</th><th>Pixels</th><th>Per minute</th><th>Timing variation</th><th>Main color</th><th>Patterns</th></tr>
+	{{range .Incidents}}<tr><td>{{time .Start}}</td><td>{{.End.Sub .Start}}</td><td>{{.Overwrites}}</td><td>{{.Pixels}}</td><td>{{printf "%.1f" .Rate}}</td><td>{{printf "%.2f" .Variation}}</td><td><span class="swatch" style="background: {{.DominantColor}}"></span> {{with .DominantName}}{{.}} {{end}}{{percent .DominantShare}}</td><td class="pattern">{{join .Patterns ", "}}</td></tr>
+	{{end}}
+</table>
+
+{{range .Incidents}}{{if .Before}}
+<h3>{{time .Start}} at ({{.Bounds.Min.X}}, {{.Bounds.Min.Y}}) - ({{.Bounds.Max.X}}, {{.Bounds.Max.Y}})</h3>
+<figure><img src="{{.Before}}" alt="Before"><figcaption>Before</figcaption></figure>
+<figure><img src="{{.After}}" alt="After"><figcaption>After {{.Overwrites}} overwrites</figcaption></figure>
+{{end}}{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,139 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+func Test_exportForensics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-test-forensics")
+	if err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer setPathSettings(getPaths())
+	settings := getPaths()
+	settings.Recordings = dir
+	setPathSettings(settings)
+
+	// The template is a 8x8 square of color 5
+	tmpl := image.NewPaletted(image.Rect(0, 0, 8, 8), pixelcanvasioPalette)
+	for i := range tmpl.Pix {
+		tmpl.Pix[i] = 5
+	}
+	templateFileName := filepath.Join(dir, "template.png")
+	f, err := os.Create(templateFileName)
+	if err != nil {
+		t.Fatalf("Can't create template: %v", err)
+	}
+	if err := png.Encode(f, tmpl); err != nil {
+		t.Fatalf("Can't encode template: %v", err)
+	}
+	f.Close()
+
+	// The square is built slowly, then a bot overwrites a 4x4 block with color 3 every second.
+	// A few single overwrites in between are left out as noise
+	os.MkdirAll(filepath.Join(dir, "Test-Forensics"), 0777)
+	f, err = os.Create(filepath.Join(dir, "Test-Forensics", "2019-06-01T000000.pixrec"))
+	if err != nil {
+		t.Fatalf("Can't create recording: %v", err)
+	}
+	start := time.Unix(1559347200, 0)
+	w, err := recording.NewWriter(f, "Test", recording.Header{Time: start, ChunkSize: image.Point{64, 64}})
+	if err != nil {
+		t.Fatalf("Can't create writer: %v", err)
+	}
+	correct, wrong := color.RGBAModel.Convert(pixelcanvasioPalette[5]).(color.RGBA), color.RGBAModel.Convert(pixelcanvasioPalette[3]).(color.RGBA)
+	w.WriteEvent(start, recording.SetImage{Image: image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette)})
+	tm := start
+	for i := 0; i < 64; i++ {
+		tm = tm.Add(10 * time.Second)
+		w.WriteEvent(tm, recording.SetPixel{Pos: image.Point{i % 8, i / 8}, Color: correct})
+	}
+	tm = tm.Add(time.Hour)
+	w.WriteEvent(tm, recording.SetPixel{Pos: image.Point{7, 7}, Color: wrong})
+	tm = tm.Add(time.Hour)
+	for i := 0; i < 16; i++ {
+		tm = tm.Add(time.Second)
+		w.WriteEvent(tm, recording.SetPixel{Pos: image.Point{i % 4, i / 4}, Color: wrong})
+	}
+	tm = tm.Add(time.Hour)
+	w.WriteEvent(tm, recording.InvalidateAll{})
+	if err := w.Close(); err != nil {
+		t.Fatalf("Can't close writer: %v", err)
+	}
+	f.Close()
+
+	fileName := filepath.Join(dir, "forensics.json")
+	if err := exportForensics("Test-Forensics", exportOptions{}, templateFileName, fileName); err != nil {
+		t.Fatalf("Can't export forensics: %v", err)
+	}
+	result := struct {
+		Placements, Helpful, Overwrites int
+		Incidents                       []forensicsIncident
+	}{}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("Can't read result: %v", err)
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("Can't parse result: %v", err)
+	}
+	if result.Placements != 81 || result.Helpful != 64 || result.Overwrites != 17 {
+		t.Errorf("Got %v placements, %v helpful and %v overwrites, want 81, 64 and 17", result.Placements, result.Helpful, result.Overwrites)
+	}
+	if len(result.Incidents) != 1 {
+		t.Fatalf("Got %v incidents, want 1", len(result.Incidents))
+	}
+	incident := result.Incidents[0]
+	if incident.Overwrites != 16 || incident.Pixels != 16 || incident.Bounds != image.Rect(0, 0, 4, 4) {
+		t.Errorf("Incident has %v overwrites of %v pixels in %v, want 16 of 16 in %v", incident.Overwrites, incident.Pixels, incident.Bounds, image.Rect(0, 0, 4, 4))
+	}
+	if got, want := strings.Join(incident.Patterns, ", "), "burst, regular timing, single color, compact shape"; got != want {
+		t.Errorf("Incident has the patterns %q, want %q", got, want)
+	}
+	if incident.Before == "" || incident.After == "" {
+		t.Errorf("Incident has no snapshots")
+	}
+
+	// The HTML report contains the same
+	fileName = filepath.Join(dir, "forensics.html")
+	if err := exportForensics("Test-Forensics", exportOptions{}, templateFileName, fileName); err != nil {
+		t.Fatalf("Can't export forensics: %v", err)
+	}
+	if data, err = ioutil.ReadFile(fileName); err != nil {
+		t.Fatalf("Can't read result: %v", err)
+	}
+	for _, want := range []string{"17 placements overwrote correct pixels, 1 incidents", "burst, regular timing, single color, compact shape", "data:image/png;base64,"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("HTML doesn't contain %q", want)
+		}
+	}
+}
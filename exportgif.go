@@ -0,0 +1,125 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"time"
+)
+
+// Collects paletted frames, and writes them as animated GIF on Close().
+//
+// All frames are held in memory until the file is written, so this is meant for short clips.
+type gifEncoder struct {
+	writer      io.Writer
+	size        pixelSize
+	gamePalette color.Palette
+	palette     color.Palette // Palette of all frames, determined by the first frame
+	drawer      draw.Drawer
+
+	anim gif.GIF
+}
+
+func newGIFEncoder(w io.WriteSeeker, size pixelSize, pal color.Palette, opts exportOptions) (animationEncoder, error) {
+	enc := &gifEncoder{
+		writer:      w,
+		size:        size,
+		gamePalette: pal,
+		drawer:      draw.Src,
+	}
+	if opts.Dither {
+		enc.drawer = draw.FloydSteinberg
+	}
+
+	return enc, nil
+}
+
+func (enc *gifEncoder) convertFrame(img image.Image) image.Image {
+	if enc.palette == nil {
+		enc.palette = exportGIFPalette(enc.gamePalette, img)
+	}
+
+	paletted := image.NewPaletted(image.Rect(0, 0, enc.size.X, enc.size.Y), enc.palette)
+	enc.drawer.Draw(paletted, paletted.Rect, img, img.Bounds().Min)
+
+	return paletted
+}
+
+func (enc *gifEncoder) writeFrame(img image.Image, duration time.Duration) error {
+	paletted, ok := img.(*image.Paletted)
+	if !ok {
+		return fmt.Errorf("Incompatible image type %T", img)
+	}
+
+	delay := int(duration / (10 * time.Millisecond)) // In 100ths of a second
+	if delay < 2 {
+		delay = 2 // Most viewers will slow down GIFs with a smaller delay
+	}
+
+	enc.anim.Image = append(enc.anim.Image, paletted)
+	enc.anim.Delay = append(enc.anim.Delay, delay)
+	enc.anim.Disposal = append(enc.anim.Disposal, gif.DisposalNone)
+
+	return nil
+}
+
+func (enc *gifEncoder) Close() error {
+	enc.anim.Config = image.Config{
+		ColorModel: enc.palette,
+		Width:      enc.size.X,
+		Height:     enc.size.Y,
+	}
+
+	return gif.EncodeAll(enc.writer, &enc.anim)
+}
+
+// Returns the palette that is used to encode frames of a GIF.
+//
+// If the game palette is known, it is used with an additional transparent color for areas without data.
+// Otherwise the colors of the first frame are used, or a generic palette if there are too many.
+func exportGIFPalette(gamePalette color.Palette, img image.Image) color.Palette {
+	if gamePalette != nil && len(gamePalette) < 256 {
+		pal := make(color.Palette, len(gamePalette), len(gamePalette)+1)
+		copy(pal, gamePalette)
+		return append(pal, color.Transparent)
+	}
+
+	colors := map[color.Color]struct{}{}
+	pal := color.Palette{}
+	rect := img.Bounds()
+	for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+		for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+			col := color.RGBAModel.Convert(img.At(ix, iy))
+			if _, ok := colors[col]; ok {
+				continue
+			}
+			if len(pal) >= 256 {
+				return palette.Plan9
+			}
+			colors[col] = struct{}{}
+			pal = append(pal, col)
+		}
+	}
+
+	return pal
+}
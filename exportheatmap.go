@@ -0,0 +1,80 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image/png"
+	"os"
+	"time"
+)
+
+// Counts all pixel changes of the recordings of shortName inside of the time range and rectangle of the options.
+// The options are prepared in place.
+func accumulateHeatmap(shortName string, opts *exportOptions) (*heatmapAccumulator, error) {
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return nil, err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return nil, err
+	}
+
+	ha := newHeatmapAccumulator(opts.Rect)
+
+	err = canvasDiskReaderForEachEvent(cfe.Recordings, opts.StartTime, opts.EndTime, func(t time.Time, event interface{}) error {
+		if event, ok := event.(canvasEventSetPixel); ok {
+			ha.add(event.Pos)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ha, nil
+}
+
+// Exports a heatmap of the pixel changes in the recordings of shortName as PNG.
+// ramp is the name of a color ramp, or a list of colors. See parseHeatmapRamp().
+func exportHeatmap(shortName string, opts exportOptions, ramp string, fileName string) error {
+	colorRamp, err := parseHeatmapRamp(ramp)
+	if err != nil {
+		return err
+	}
+
+	ha, err := accumulateHeatmap(shortName, &opts)
+	if err != nil {
+		return err
+	}
+
+	img := opts.scaleImage(ha.image(colorRamp))
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, img); err != nil {
+		return fmt.Errorf("Can't encode heatmap %v: %v", fileName, err)
+	}
+
+	return nil
+}
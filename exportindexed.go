@@ -0,0 +1,191 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Exports a region of the recordings of shortName as indexed image with the game palette embedded.
+// The format is chosen by the file extension (.png, .aseprite or .ase).
+//
+// The image shows the state at the end time of the options.
+// Areas without data use an additional transparent palette entry.
+func exportIndexed(shortName string, opts exportOptions, fileName string) error {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if ext != ".png" && ext != ".aseprite" && ext != ".ase" {
+		return fmt.Errorf("Unsupported indexed image format %v", ext)
+	}
+
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return err
+	}
+	if opts.Scale != 1 {
+		return fmt.Errorf("Indexed exports can only be scaled by integer upscaling")
+	}
+
+	snapshotTime := opts.EndTime.Add(-time.Nanosecond) // The end time itself is not part of the recordings
+	img, err := cfe.getFrame(snapshotTime, opts.Rect)
+	if err != nil {
+		return fmt.Errorf("Can't get image at %v: %v", snapshotTime, err)
+	}
+
+	gamePalette := cfe.getPalette()
+	if gamePalette == nil {
+		return fmt.Errorf("The palette of %v is unknown", shortName)
+	}
+	if len(gamePalette) >= 256 {
+		return fmt.Errorf("The palette of %v has too many colors", shortName)
+	}
+	pal := make(color.Palette, len(gamePalette), len(gamePalette)+1)
+	copy(pal, gamePalette)
+	pal = append(pal, color.Transparent) // For areas without data
+
+	var paletted image.Image = image.NewPaletted(image.Rect(0, 0, opts.Rect.Dx(), opts.Rect.Dy()), pal)
+	draw.Draw(paletted.(*image.Paletted), paletted.Bounds(), img, img.Rect.Min, draw.Src)
+	paletted = opts.scaleImage(paletted)
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+
+	switch ext {
+	case ".png":
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		err = enc.Encode(file, paletted)
+	default:
+		err = writeAseprite(file, paletted.(*image.Paletted), uint8(len(pal)-1), shortName)
+	}
+	if err != nil {
+		return fmt.Errorf("Can't encode %v: %v", fileName, err)
+	}
+
+	return nil
+}
+
+// Writes an indexed image as Aseprite file with a single frame and layer.
+//
+// See https://github.com/aseprite/aseprite/blob/master/docs/ase-file-specs.md
+func writeAseprite(w io.Writer, img *image.Paletted, transparentIndex uint8, layerName string) error {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if width > 0xFFFF || height > 0xFFFF {
+		return fmt.Errorf("Image size %v exceeds the maximum Aseprite size", img.Rect.Size())
+	}
+	if len(img.Palette) > 256 {
+		return fmt.Errorf("Palette has too many colors")
+	}
+
+	le := binary.LittleEndian
+	chunks := [][]byte{}
+	newChunk := func(chunkType uint16, data []byte) {
+		chunk := make([]byte, 6, 6+len(data))
+		le.PutUint32(chunk[0:4], uint32(6+len(data)))
+		le.PutUint16(chunk[4:6], chunkType)
+		chunks = append(chunks, append(chunk, data...))
+	}
+	asepriteString := func(s string) []byte {
+		b := make([]byte, 2, 2+len(s))
+		le.PutUint16(b, uint16(len(s)))
+		return append(b, s...)
+	}
+
+	// Palette chunk
+	palChunk := make([]byte, 20, 20+6*len(img.Palette))
+	le.PutUint32(palChunk[0:4], uint32(len(img.Palette)))
+	le.PutUint32(palChunk[4:8], 0)
+	le.PutUint32(palChunk[8:12], uint32(len(img.Palette)-1))
+	for _, col := range img.Palette {
+		c := color.NRGBAModel.Convert(col).(color.NRGBA)
+		palChunk = append(palChunk, 0, 0, c.R, c.G, c.B, c.A) // No flags, no name
+	}
+	newChunk(0x2019, palChunk)
+
+	// Layer chunk
+	layerChunk := make([]byte, 16)
+	le.PutUint16(layerChunk[0:2], 1|2) // Visible, editable
+	layerChunk[12] = 255               // Opacity
+	newChunk(0x2004, append(layerChunk, asepriteString(layerName)...))
+
+	// Cel chunk with compressed pixels
+	celChunk := make([]byte, 20)
+	celChunk[6] = 255              // Opacity
+	le.PutUint16(celChunk[7:9], 2) // Compressed image
+	le.PutUint16(celChunk[16:18], uint16(width))
+	le.PutUint16(celChunk[18:20], uint16(height))
+	compressed := &bytes.Buffer{}
+	zipWriter := zlib.NewWriter(compressed)
+	for iy := 0; iy < height; iy++ {
+		zipWriter.Write(img.Pix[iy*img.Stride : iy*img.Stride+width])
+	}
+	if err := zipWriter.Close(); err != nil {
+		return err
+	}
+	newChunk(0x2005, append(celChunk, compressed.Bytes()...))
+
+	frameSize := 16
+	for _, chunk := range chunks {
+		frameSize += len(chunk)
+	}
+
+	header := make([]byte, 128)
+	le.PutUint32(header[0:4], uint32(128+frameSize))
+	le.PutUint16(header[4:6], 0xA5E0) // Magic number
+	le.PutUint16(header[6:8], 1)      // Frames
+	le.PutUint16(header[8:10], uint16(width))
+	le.PutUint16(header[10:12], uint16(height))
+	le.PutUint16(header[12:14], 8) // Color depth: Indexed
+	le.PutUint32(header[14:18], 1) // Layer opacity is valid
+	le.PutUint16(header[18:20], 100)
+	header[28] = transparentIndex
+	le.PutUint16(header[32:34], uint16(len(img.Palette)%256)) // 0 means 256
+	header[34], header[35] = 1, 1                             // Pixel ratio
+
+	frameHeader := make([]byte, 16)
+	le.PutUint32(frameHeader[0:4], uint32(frameSize))
+	le.PutUint16(frameHeader[4:6], 0xF1FA) // Magic number
+	le.PutUint16(frameHeader[6:8], uint16(len(chunks)))
+	le.PutUint16(frameHeader[8:10], 100) // Duration in ms
+	le.PutUint32(frameHeader[12:16], uint32(len(chunks)))
+
+	for _, b := range append([][]byte{header, frameHeader}, chunks...) {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_exportIndexed(t *testing.T) {
+	rect, pos, _ := writeTestRecording(t, "Test-ExportIndexed")
+
+	fileName := filepath.Join(os.TempDir(), "d3pixelbot-test-indexed.png")
+	defer os.Remove(fileName)
+
+	opts := exportOptions{Rect: rect.Inset(-8)} // Include some area without data
+	if err := exportIndexed("Test-ExportIndexed", opts, fileName); err != nil {
+		t.Fatalf("Can't export indexed PNG: %v", err)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Can't open exported PNG: %v", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Can't decode exported PNG: %v", err)
+	}
+	paletted, ok := img.(*image.Paletted)
+	if !ok {
+		t.Fatalf("Exported PNG is of type %T, want paletted", img)
+	}
+	if got, want := paletted.Palette[:len(pixelcanvasioPalette)], pixelcanvasioPalette; !isPaletteEqual(got, want) {
+		t.Errorf("Palette starts with %v, want %v", got, want)
+	}
+	if got := paletted.ColorIndexAt(pos.X+8, pos.Y+8); got != 5 {
+		t.Errorf("Color index at %v = %v, want 5", pos, got)
+	}
+	if got, want := paletted.ColorIndexAt(0, 0), uint8(len(paletted.Palette)-1); got != want {
+		t.Errorf("Color index outside of the recorded area = %v, want %v", got, want)
+	}
+}
+
+func Test_writeAseprite(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 5, 3), pixelcanvasioPalette)
+	img.SetColorIndex(4, 2, 7)
+
+	buf := &bytes.Buffer{}
+	if err := writeAseprite(buf, img, 0, "Layer"); err != nil {
+		t.Fatalf("Can't write Aseprite file: %v", err)
+	}
+	data := buf.Bytes()
+	le := binary.LittleEndian
+
+	if got, want := le.Uint32(data[0:4]), uint32(len(data)); got != want {
+		t.Errorf("File size = %v, want %v", got, want)
+	}
+	if got := le.Uint16(data[4:6]); got != 0xA5E0 {
+		t.Errorf("Magic number = %X, want A5E0", got)
+	}
+	if got := le.Uint16(data[12:14]); got != 8 {
+		t.Errorf("Color depth = %v, want 8", got)
+	}
+	if got := le.Uint16(data[128+4 : 128+6]); got != 0xF1FA {
+		t.Errorf("Frame magic number = %X, want F1FA", got)
+	}
+
+	// Walk through the chunks, and decompress the cel
+	chunks := int(le.Uint32(data[128+12 : 128+16]))
+	offset := 128 + 16
+	var pixels []byte
+	for i := 0; i < chunks; i++ {
+		size, chunkType := int(le.Uint32(data[offset:offset+4])), le.Uint16(data[offset+4:offset+6])
+		if chunkType == 0x2005 {
+			zipReader, err := zlib.NewReader(bytes.NewReader(data[offset+6+20 : offset+size]))
+			if err != nil {
+				t.Fatalf("Can't decompress cel: %v", err)
+			}
+			if pixels, err = ioutil.ReadAll(zipReader); err != nil {
+				t.Fatalf("Can't decompress cel: %v", err)
+			}
+		}
+		offset += size
+	}
+	if offset != len(data) {
+		t.Errorf("Chunks end at %v, want %v", offset, len(data))
+	}
+	if !bytes.Equal(pixels, img.Pix) {
+		t.Errorf("Cel pixels = %v, want %v", pixels, img.Pix)
+	}
+}
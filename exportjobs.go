@@ -0,0 +1,312 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State of an export job
+type exportJobState string
+
+const (
+	exportJobQueued   exportJobState = "queued"
+	exportJobRunning  exportJobState = "running"
+	exportJobFinished exportJobState = "finished"
+	exportJobFailed   exportJobState = "failed"
+	exportJobCanceled exportJobState = "canceled"
+)
+
+// Parameters that are only used by some kinds of exports
+type exportJobParams struct {
+	Ramp       string        // Color ramp of heatmaps
+	PixelsOnly bool          // Only export pixel changes in event exports
+	Template   string        // Template image of reports and forensics
+	Interval   time.Duration // Time between frames of contact sheets
+	Columns    int           // Number of columns of contact sheets
+	Title      string        // Title of clips
+}
+
+type exportJobKind struct {
+	Name string
+
+	FunctionRun func(shortName string, opts exportOptions, params exportJobParams, fileName string) error
+}
+
+var exportJobKinds = map[string]exportJobKind{
+	"timelapse": {
+		Name: "Timelapse",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportTimelapse(shortName, opts, fileName)
+		},
+	},
+	"animation": {
+		Name: "Animation",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportAnimation(shortName, opts, fileName)
+		},
+	},
+	"tiles": {
+		Name: "Tiles",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportTiles(shortName, opts, fileName)
+		},
+	},
+	"heatmap": {
+		Name: "Heatmap",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportHeatmap(shortName, opts, params.Ramp, fileName)
+		},
+	},
+	"indexed": {
+		Name: "Indexed image",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportIndexed(shortName, opts, fileName)
+		},
+	},
+	"events": {
+		Name: "Events",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportEvents(shortName, opts, params.PixelsOnly, fileName)
+		},
+	},
+	"palette": {
+		Name: "Palette statistics",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportPaletteStats(shortName, opts, fileName)
+		},
+	},
+	"leaderboard": {
+		Name: "Leaderboard",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportLeaderboard(shortName, opts, fileName)
+		},
+	},
+	"report": {
+		Name: "Report",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportReport(shortName, opts, params.Template, fileName)
+		},
+	},
+	"forensics": {
+		Name: "Forensics",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportForensics(shortName, opts, params.Template, fileName)
+		},
+	},
+	"contactsheet": {
+		Name: "Contact sheet",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportContactSheet(shortName, opts, params.Interval, params.Columns, fileName)
+		},
+	},
+	"clip": {
+		Name: "Clip",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			return exportClip(shortName, opts, params.Title, fileName)
+		},
+	},
+}
+
+// A queued, running or finished export
+type exportJob struct {
+	ID        int
+	Kind      string // Key of exportJobKinds
+	ShortName string
+	Options   exportOptions // The progress callback is set by the manager
+	Params    exportJobParams
+	FileName  string // Output file, or directory for tile exports
+
+	State                           exportJobState
+	Done, Total                     int // Progress of the running export
+	Err                             error
+	QueuedAt, StartedAt, FinishedAt time.Time
+}
+
+// Runs export jobs in the background, with a limited number of them running at the same time.
+//
+// The manager is not bound to any window, so exports keep running when the window that started them is closed.
+type exportJobManager struct {
+	sync.Mutex
+
+	Workers int // Maximum number of exports that run at the same time
+
+	jobs           []*exportJob
+	idCounter      int
+	runningWorkers int
+}
+
+// Global export job manager, shared by all windows
+var exportJobs = newExportJobManager(2)
+
+func newExportJobManager(workers int) *exportJobManager {
+	if workers < 1 {
+		workers = 1
+	}
+	return &exportJobManager{
+		Workers: workers,
+	}
+}
+
+// Changes the maximum number of exports that run at the same time.
+// Running exports are finished, even if there are more of them than workers.
+func (ejm *exportJobManager) setWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	ejm.Lock()
+	defer ejm.Unlock()
+
+	// Workers without queued jobs stop immediately
+	ejm.Workers = workers
+	for ejm.runningWorkers < ejm.Workers {
+		ejm.runningWorkers++
+		go ejm.worker()
+	}
+}
+
+// Queues a new export job, and returns its ID
+func (ejm *exportJobManager) add(kind, shortName string, opts exportOptions, params exportJobParams, fileName string) (int, error) {
+	if _, ok := exportJobKinds[kind]; !ok {
+		return 0, fmt.Errorf("Unknown export kind %q", kind)
+	}
+
+	ejm.Lock()
+	defer ejm.Unlock()
+
+	ejm.idCounter++
+	job := &exportJob{
+		ID:        ejm.idCounter,
+		Kind:      kind,
+		ShortName: shortName,
+		Options:   opts,
+		Params:    params,
+		FileName:  fileName,
+		State:     exportJobQueued,
+		QueuedAt:  time.Now(),
+	}
+	ejm.jobs = append(ejm.jobs, job)
+
+	if ejm.runningWorkers < ejm.Workers {
+		ejm.runningWorkers++
+		go ejm.worker()
+	}
+
+	exportLog.Infof("Queued %v export #%v of %v into %v", exportJobKinds[kind].Name, job.ID, shortName, fileName)
+
+	return job.ID, nil
+}
+
+// Runs queued jobs until there are none left
+func (ejm *exportJobManager) worker() {
+	for {
+		ejm.Lock()
+		var job *exportJob
+		for _, j := range ejm.jobs {
+			if j.State == exportJobQueued {
+				job = j
+				break
+			}
+		}
+		if job == nil || ejm.runningWorkers > ejm.Workers {
+			ejm.runningWorkers--
+			ejm.Unlock()
+			return
+		}
+		job.State, job.StartedAt = exportJobRunning, time.Now()
+		opts, params := job.Options, job.Params
+		ejm.Unlock()
+
+		opts.Progress = func(done, total int) {
+			ejm.Lock()
+			defer ejm.Unlock()
+			job.Done, job.Total = done, total
+		}
+
+		err := exportJobKinds[job.Kind].FunctionRun(job.ShortName, opts, params, job.FileName)
+
+		ejm.Lock()
+		job.FinishedAt, job.Err = time.Now(), err
+		if err != nil {
+			job.State = exportJobFailed
+			exportLog.Errorf("%v export #%v of %v failed: %v", exportJobKinds[job.Kind].Name, job.ID, job.ShortName, err)
+		} else {
+			job.State = exportJobFinished
+			exportLog.Infof("Finished %v export #%v of %v into %v after %v", exportJobKinds[job.Kind].Name, job.ID, job.ShortName, job.FileName, job.FinishedAt.Sub(job.StartedAt))
+		}
+		ejm.Unlock()
+	}
+}
+
+// Returns copies of all jobs, in the order they were queued
+func (ejm *exportJobManager) getJobs() []exportJob {
+	ejm.Lock()
+	defer ejm.Unlock()
+
+	jobs := make([]exportJob, 0, len(ejm.jobs))
+	for _, job := range ejm.jobs {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+// Returns a copy of the job with the given ID
+func (ejm *exportJobManager) getJob(id int) (exportJob, error) {
+	ejm.Lock()
+	defer ejm.Unlock()
+
+	for _, job := range ejm.jobs {
+		if job.ID == id {
+			return *job, nil
+		}
+	}
+	return exportJob{}, fmt.Errorf("There is no export job #%v", id)
+}
+
+// Cancels a queued job. Running exports can't be canceled
+func (ejm *exportJobManager) cancel(id int) error {
+	ejm.Lock()
+	defer ejm.Unlock()
+
+	for _, job := range ejm.jobs {
+		if job.ID == id {
+			if job.State != exportJobQueued {
+				return fmt.Errorf("Export job #%v is %v, only queued jobs can be canceled", id, job.State)
+			}
+			job.State, job.FinishedAt = exportJobCanceled, time.Now()
+			return nil
+		}
+	}
+	return fmt.Errorf("There is no export job #%v", id)
+}
+
+// Removes all jobs that are finished, failed or canceled
+func (ejm *exportJobManager) clearFinished() {
+	ejm.Lock()
+	defer ejm.Unlock()
+
+	jobs := []*exportJob{}
+	for _, job := range ejm.jobs {
+		if job.State == exportJobQueued || job.State == exportJobRunning {
+			jobs = append(jobs, job)
+		}
+	}
+	ejm.jobs = jobs
+}
@@ -0,0 +1,93 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_exportJobManager(t *testing.T) {
+	releaseChan := make(chan struct{})
+	exportJobKinds["test"] = exportJobKind{
+		Name: "Test",
+		FunctionRun: func(shortName string, opts exportOptions, params exportJobParams, fileName string) error {
+			opts.reportProgress(1, 2)
+			<-releaseChan
+			if fileName == "fail" {
+				return fmt.Errorf("Failed on purpose")
+			}
+			return nil
+		},
+	}
+	defer delete(exportJobKinds, "test")
+
+	ejm := newExportJobManager(2)
+
+	if _, err := ejm.add("unknown", "Test", exportOptions{}, exportJobParams{}, ""); err == nil {
+		t.Errorf("Adding a job of an unknown kind succeeded")
+	}
+
+	ids := []int{}
+	for _, fileName := range []string{"a", "fail", "b", "c"} {
+		id, err := ejm.add("test", "Test", exportOptions{}, exportJobParams{}, fileName)
+		if err != nil {
+			t.Fatalf("Can't add job: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Waits until the state of every job is as wanted
+	waitForStates := func(want ...exportJobState) {
+		var got []exportJobState
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			got = got[:0]
+			for _, job := range ejm.getJobs() {
+				got = append(got, job.State)
+			}
+			if fmt.Sprint(got) == fmt.Sprint(want) {
+				return
+			}
+		}
+		t.Fatalf("Job states = %v, want %v", got, want)
+	}
+
+	// Only two jobs run at the same time
+	waitForStates(exportJobRunning, exportJobRunning, exportJobQueued, exportJobQueued)
+	if job, _ := ejm.getJob(ids[0]); job.Done != 1 || job.Total != 2 {
+		t.Errorf("Progress of job #%v = %v/%v, want 1/2", job.ID, job.Done, job.Total)
+	}
+
+	if err := ejm.cancel(ids[3]); err != nil {
+		t.Errorf("Can't cancel queued job: %v", err)
+	}
+	if err := ejm.cancel(ids[0]); err == nil {
+		t.Errorf("Canceling a running job succeeded")
+	}
+
+	close(releaseChan)
+	waitForStates(exportJobFinished, exportJobFailed, exportJobFinished, exportJobCanceled)
+	if job, _ := ejm.getJob(ids[1]); job.Err == nil {
+		t.Errorf("Failed job has no error")
+	}
+
+	ejm.clearFinished()
+	if jobs := ejm.getJobs(); len(jobs) != 0 {
+		t.Errorf("Got %v jobs after clearing, want 0", len(jobs))
+	}
+}
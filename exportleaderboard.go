@@ -0,0 +1,238 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Contributions of a single user, as counted by accumulateLeaderboard
+type leaderboardEntry struct {
+	Rank        int
+	Author      string
+	Placements  int // Pixels placed inside of the rectangle and time range
+	Overwritten int // Placed pixels that were changed to another color before the end time
+	Standing    int // Placed pixels that were still there at the end time
+
+	SurvivalSeconds     float64 // Sum of the time the placed pixels stayed, until the pixel was placed again, changed or the end time
+	MeanSurvivalSeconds float64 // Average time a placed pixel stayed
+}
+
+// Results of the leaderboard, also used as data of the HTML template
+type leaderboardData struct {
+	ShortName          string
+	Rect               image.Rectangle
+	StartTime, EndTime time.Time
+	Generated          time.Time
+
+	Placements   int // All pixel changes inside of the rectangle and time range
+	Unattributed int // Pixel changes without author, they aren't part of the entries
+	Entries      []*leaderboardEntry
+}
+
+// A placed pixel, until it's placed again or changed
+type leaderboardPlacement struct {
+	Entry *leaderboardEntry
+	Color color.RGBA
+	Time  time.Time
+}
+
+// Counts the placements of every author inside of the time range and rectangle of the options, and how long their pixels survived.
+// The options are prepared in place.
+//
+// A pixel survives until it's placed again, until a downloaded image shows a different color at its position, or until the end time.
+// Only games that report who placed a pixel have authors in their recordings, other pixels are counted as unattributed.
+func accumulateLeaderboard(shortName string, opts *exportOptions) (*leaderboardData, error) {
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return nil, err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return nil, err
+	}
+
+	data := &leaderboardData{
+		ShortName: shortName,
+		Rect:      opts.Rect,
+		StartTime: opts.StartTime,
+		EndTime:   opts.EndTime,
+		Generated: time.Now(),
+		Entries:   []*leaderboardEntry{},
+	}
+	entries := map[string]*leaderboardEntry{}
+	placements := map[image.Point]leaderboardPlacement{}
+
+	// Ends the survival of the placement at pos, changed tells whether its color was replaced
+	end := func(pos image.Point, t time.Time, changed bool) {
+		placement, ok := placements[pos]
+		if !ok {
+			return
+		}
+		delete(placements, pos)
+		placement.Entry.SurvivalSeconds += t.Sub(placement.Time).Seconds()
+		if changed {
+			placement.Entry.Overwritten++
+		}
+	}
+
+	opts.reportProgress(0, 1)
+	err = canvasDiskReaderForEachEvent(cfe.Recordings, opts.StartTime, opts.EndTime, func(t time.Time, event interface{}) error {
+		switch event := event.(type) {
+		case canvasEventSetPixel:
+			if !event.Pos.In(opts.Rect) {
+				return nil
+			}
+			col := color.RGBAModel.Convert(event.Color).(color.RGBA)
+			if placement, ok := placements[event.Pos]; ok {
+				end(event.Pos, t, placement.Color != col)
+			}
+
+			data.Placements++
+			if event.Author == "" {
+				data.Unattributed++
+				return nil
+			}
+			entry, ok := entries[event.Author]
+			if !ok {
+				entry = &leaderboardEntry{Author: event.Author}
+				entries[event.Author] = entry
+			}
+			entry.Placements++
+			placements[event.Pos] = leaderboardPlacement{Entry: entry, Color: col, Time: t}
+
+		case canvasEventSetImage:
+			// Downloads show changes that weren't recorded as pixel events
+			img := event.Image
+			rect := img.Bounds().Intersect(opts.Rect)
+			for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+				for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+					pos := image.Point{ix, iy}
+					if placement, ok := placements[pos]; ok && color.RGBAModel.Convert(img.At(ix, iy)).(color.RGBA) != placement.Color {
+						end(pos, t, true)
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, placement := range placements {
+		placement.Entry.Standing++
+		placement.Entry.SurvivalSeconds += opts.EndTime.Sub(placement.Time).Seconds()
+	}
+
+	for _, entry := range entries {
+		entry.MeanSurvivalSeconds = entry.SurvivalSeconds / float64(entry.Placements)
+		data.Entries = append(data.Entries, entry)
+	}
+	sort.Slice(data.Entries, func(i, j int) bool {
+		a, b := data.Entries[i], data.Entries[j]
+		if a.Placements != b.Placements {
+			return a.Placements > b.Placements
+		}
+		if a.Standing != b.Standing {
+			return a.Standing > b.Standing
+		}
+		return a.Author < b.Author
+	})
+	for i, entry := range data.Entries {
+		entry.Rank = i + 1
+	}
+	opts.reportProgress(1, 1)
+
+	return data, nil
+}
+
+// Exports a leaderboard of the users that placed pixels in the recordings of shortName, see accumulateLeaderboard.
+// The result is written as HTML table, or as JSON if the file name ends with .json.
+func exportLeaderboard(shortName string, opts exportOptions, fileName string) error {
+	data, err := accumulateLeaderboard(shortName, &opts)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0777); err != nil {
+		return fmt.Errorf("Can't create directory for %v: %v", fileName, err)
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(fileName)) == ".json" {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "\t")
+		err = encoder.Encode(data)
+	} else {
+		err = exportLeaderboardTemplate.Execute(file, data)
+	}
+	if err != nil {
+		return fmt.Errorf("Can't write leaderboard %v: %v", fileName, err)
+	}
+
+	return nil
+}
+
+var exportLeaderboardTemplate = template.Must(template.New("leaderboard").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05 MST") },
+	"duration": func(seconds float64) string {
+		return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.ShortName}} leaderboard {{time .EndTime}}</title>
+<style>
+	body { font-family: sans-serif; background: #222; color: #ddd; margin: 2em; }
+	h1, h2 { font-weight: normal; }
+	table { border-collapse: collapse; }
+	td, th { padding: 0.2em 0.8em; text-align: right; }
+	td.author { text-align: left; }
+	tr:nth-child(even) { background: #2a2a2a; }
+</style>
+</head>
+<body>
+<h1>{{.ShortName}} leaderboard at ({{.Rect.Min.X}}, {{.Rect.Min.Y}}) - ({{.Rect.Max.X}}, {{.Rect.Max.Y}})</h1>
+<p>From {{time .StartTime}} to {{time .EndTime}}, generated {{time .Generated}}</p>
+<p>{{.Placements}} pixels were placed by {{len .Entries}} users, {{.Unattributed}} of them without a known author.</p>
+
+{{if .Entries}}
+<table>
+	<tr><th>Rank</th><th>User</th><th>Placements</th><th>Still standing</th><th>Overwritten</th><th>Total survival</th><th>Mean survival</th></tr>
+	{{range .Entries}}<tr><td>{{.Rank}}</td><td class="author">{{.Author}}</td><td>{{.Placements}}</td><td>{{.Standing}}</td><td>{{.Overwritten}}</td><td>{{duration .SurvivalSeconds}}</td><td>{{duration .MeanSurvivalSeconds}}</td></tr>
+	{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
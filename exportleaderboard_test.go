@@ -0,0 +1,110 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+func Test_exportLeaderboard(t *testing.T) {
+	dir := useTestRecordingsDir(t)
+
+	os.MkdirAll(filepath.Join(dir, "Test-Leaderboard"), 0777)
+	f, err := os.Create(filepath.Join(dir, "Test-Leaderboard", "2019-06-01T000000.pixrec"))
+	if err != nil {
+		t.Fatalf("Can't create recording: %v", err)
+	}
+	start := time.Unix(1559347200, 0)
+	w, err := recording.NewWriter(f, "Test", recording.Header{Time: start, ChunkSize: image.Point{64, 64}, Authors: true})
+	if err != nil {
+		t.Fatalf("Can't create writer: %v", err)
+	}
+	red, black := color.RGBAModel.Convert(pixelcanvasioPalette[5]).(color.RGBA), color.RGBAModel.Convert(pixelcanvasioPalette[3]).(color.RGBA)
+	w.WriteEvent(start, recording.SetImage{Image: image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette)})
+	w.WriteEvent(start.Add(10*time.Second), recording.SetPixel{Pos: image.Point{0, 0}, Color: red, Author: "alice"})
+	w.WriteEvent(start.Add(20*time.Second), recording.SetPixel{Pos: image.Point{1, 0}, Color: red, Author: "bob"})
+	w.WriteEvent(start.Add(30*time.Second), recording.SetPixel{Pos: image.Point{2, 0}, Color: red, Author: "alice"})
+	w.WriteEvent(start.Add(40*time.Second), recording.SetPixel{Pos: image.Point{0, 0}, Color: black, Author: "bob"})
+	w.WriteEvent(start.Add(50*time.Second), recording.SetPixel{Pos: image.Point{3, 0}, Color: red})
+	w.WriteEvent(start.Add(60*time.Second), recording.SetPixel{Pos: image.Point{20, 20}, Color: red, Author: "carol"})
+	w.WriteEvent(start.Add(200*time.Second), recording.InvalidateAll{})
+	if err := w.Close(); err != nil {
+		t.Fatalf("Can't close writer: %v", err)
+	}
+	f.Close()
+
+	opts := exportOptions{Rect: image.Rect(0, 0, 8, 8), EndTime: start.Add(100 * time.Second)}
+	data, err := accumulateLeaderboard("Test-Leaderboard", &opts)
+	if err != nil {
+		t.Fatalf("Can't accumulate leaderboard: %v", err)
+	}
+	if data.Placements != 5 || data.Unattributed != 1 {
+		t.Errorf("Got %v placements and %v unattributed, want 5 and 1", data.Placements, data.Unattributed)
+	}
+	want := []leaderboardEntry{
+		{Rank: 1, Author: "bob", Placements: 2, Overwritten: 0, Standing: 2, SurvivalSeconds: 140, MeanSurvivalSeconds: 70},
+		{Rank: 2, Author: "alice", Placements: 2, Overwritten: 1, Standing: 1, SurvivalSeconds: 100, MeanSurvivalSeconds: 50},
+	}
+	if len(data.Entries) != len(want) {
+		t.Fatalf("Got %v entries, want %v", len(data.Entries), len(want))
+	}
+	for i, entry := range data.Entries {
+		if *entry != want[i] {
+			t.Errorf("Entry %v is %+v, want %+v", i, *entry, want[i])
+		}
+	}
+
+	// Both output formats contain the entries
+	fileName := filepath.Join(dir, "leaderboard.json")
+	if err := exportLeaderboard("Test-Leaderboard", exportOptions{Rect: image.Rect(0, 0, 8, 8), EndTime: start.Add(100 * time.Second)}, fileName); err != nil {
+		t.Fatalf("Can't export leaderboard: %v", err)
+	}
+	result := leaderboardData{}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("Can't read result: %v", err)
+	}
+	if err := json.Unmarshal(content, &result); err != nil {
+		t.Fatalf("Can't parse result: %v", err)
+	}
+	if len(result.Entries) != 2 || result.Entries[0].Author != "bob" {
+		t.Errorf("JSON has the entries %+v, want bob in front", result.Entries)
+	}
+
+	fileName = filepath.Join(dir, "leaderboard.html")
+	if err := exportLeaderboard("Test-Leaderboard", exportOptions{Rect: image.Rect(0, 0, 8, 8), EndTime: start.Add(100 * time.Second)}, fileName); err != nil {
+		t.Fatalf("Can't export leaderboard: %v", err)
+	}
+	if content, err = ioutil.ReadFile(fileName); err != nil {
+		t.Fatalf("Can't read result: %v", err)
+	}
+	for _, want := range []string{"5 pixels were placed by 2 users, 1 of them without a known author", `<td class="author">bob</td><td>2</td><td>2</td><td>0</td><td>2m20s</td><td>1m10s</td>`} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("HTML doesn't contain %q", want)
+		}
+	}
+}
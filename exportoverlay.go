@@ -0,0 +1,121 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Text that is rendered onto exported frames and snapshots.
+// Every enabled element is written in its own line.
+type exportOverlay struct {
+	Timestamp   bool   // Show the point in time of the frame
+	TimeFormat  string // Layout of the timestamp, see time.Format(). Defaults to "2006-01-02 15:04:05 MST"
+	GameName    bool   // Show the short name of the game
+	Coordinates bool   // Show the canvas rectangle of the frame
+	Watermark   string // Custom text, can contain several lines
+
+	Position  string // Corner of the text: "top-left", "top-right", "bottom-left" or "bottom-right". Defaults to "bottom-left"
+	TextScale int    // Integer scaling factor of the text. 0 or 1 uses the original font size
+}
+
+// Returns true if the overlay contains anything to render
+func (o exportOverlay) enabled() bool {
+	return o.Timestamp || o.GameName || o.Coordinates || o.Watermark != ""
+}
+
+func (o exportOverlay) lines(t time.Time, rect image.Rectangle, shortName string) []string {
+	lines := []string{}
+	if o.Timestamp {
+		layout := o.TimeFormat
+		if layout == "" {
+			layout = "2006-01-02 15:04:05 MST"
+		}
+		lines = append(lines, t.Format(layout))
+	}
+	if o.GameName {
+		lines = append(lines, shortName)
+	}
+	if o.Coordinates {
+		lines = append(lines, fmt.Sprintf("(%d, %d) - (%d, %d)", rect.Min.X, rect.Min.Y, rect.Max.X, rect.Max.Y))
+	}
+	if o.Watermark != "" {
+		lines = append(lines, strings.Split(o.Watermark, "\n")...)
+	}
+	return lines
+}
+
+// Draws the overlay onto dst.
+//
+// t is the point in time of the frame, rect the canvas rectangle it shows and shortName the game it belongs to.
+// The text is white on a semi transparent black background.
+func (o exportOverlay) draw(dst draw.Image, t time.Time, rect image.Rectangle, shortName string) {
+	if !o.enabled() {
+		return
+	}
+
+	face := basicfont.Face7x13
+	const padding = 2
+
+	lines := o.lines(t, rect, shortName)
+	width := 0
+	for _, line := range lines {
+		if w := len([]rune(line)) * face.Advance; width < w {
+			width = w
+		}
+	}
+
+	text := image.NewRGBA(image.Rect(0, 0, width+2*padding, len(lines)*face.Height+2*padding))
+	draw.Draw(text, text.Rect, image.NewUniform(color.RGBA{0, 0, 0, 160}), image.Point{}, draw.Src)
+	drawer := font.Drawer{
+		Dst:  text,
+		Src:  image.White,
+		Face: face,
+	}
+	for i, line := range lines {
+		drawer.Dot = fixed.P(padding, padding+i*face.Height+face.Ascent)
+		drawer.DrawString(line)
+	}
+
+	var textImg image.Image = text
+	if o.TextScale > 1 {
+		textImg = upscaleNearest(text, o.TextScale)
+	}
+
+	// Place the text into the chosen corner
+	dstRect, textRect := dst.Bounds(), textImg.Bounds()
+	pos := image.Point{dstRect.Min.X, dstRect.Max.Y - textRect.Dy()}
+	switch o.Position {
+	case "top-left":
+		pos = dstRect.Min
+	case "top-right":
+		pos = image.Point{dstRect.Max.X - textRect.Dx(), dstRect.Min.Y}
+	case "bottom-right":
+		pos = dstRect.Max.Sub(textRect.Size())
+	}
+
+	draw.Draw(dst, textRect.Sub(textRect.Min).Add(pos), textImg, textRect.Min, draw.Over)
+}
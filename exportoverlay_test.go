@@ -0,0 +1,60 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+	"time"
+)
+
+func Test_exportOverlay(t *testing.T) {
+	frameTime := time.Date(2019, 7, 1, 12, 30, 0, 0, time.UTC)
+	rect := image.Rect(-10, -20, 30, 40)
+
+	o := exportOverlay{
+		Timestamp:   true,
+		GameName:    true,
+		Coordinates: true,
+		Watermark:   "Line 1\nLine 2",
+	}
+	lines := o.lines(frameTime, rect, "pixelcanvasio")
+	want := []string{"2019-07-01 12:30:00 UTC", "pixelcanvasio", "(-10, -20) - (30, 40)", "Line 1", "Line 2"}
+	if !equalStrings(lines, want) {
+		t.Errorf("lines() = %q, want %q", lines, want)
+	}
+
+	white := color.RGBA{255, 255, 255, 255}
+	img := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(img, img.Rect, image.NewUniform(white), image.Point{}, draw.Src)
+
+	o = exportOverlay{Watermark: "Test", Position: "top-right", TextScale: 2}
+	o.draw(img, frameTime, rect, "pixelcanvasio")
+
+	if got := img.RGBAAt(199, 0); got == white {
+		t.Errorf("Top right pixel is not covered by the overlay")
+	}
+	if got := img.RGBAAt(0, 99); got != white {
+		t.Errorf("Bottom left pixel = %v, want %v", got, white)
+	}
+	// 4 characters of 7 pixels plus padding, scaled by 2
+	if got := img.RGBAAt(199-(4*7+4)*2, 0); got != white {
+		t.Errorf("Pixel left of the overlay = %v, want %v", got, white)
+	}
+}
@@ -0,0 +1,273 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Usage of a single color of the game palette
+type paletteStatsEntry struct {
+	Color      color.NRGBA
+	Name       string // Name of the color, empty if it has none. See paletteNames
+	Pixels     int    // Number of pixels with this color at the end of the time range
+	Placements int    // Number of times this color was placed inside of the time range
+}
+
+var paletteStatsColumns = []string{"index", "color", "name", "pixels", "pixels_percent", "placements", "placements_percent"}
+
+// Counts the usage of every color of the game palette inside of the time range and rectangle of the options.
+// The options are prepared in place.
+//
+// Pixels without data are not counted, so the pixel counts may not add up to the size of the rectangle.
+func accumulatePaletteStats(shortName string, opts *exportOptions) ([]paletteStatsEntry, error) {
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return nil, err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return nil, err
+	}
+
+	snapshotTime := opts.EndTime.Add(-time.Nanosecond) // The end time itself is not part of the recordings
+	img, err := cfe.getFrame(snapshotTime, opts.Rect)
+	if err != nil {
+		return nil, fmt.Errorf("Can't get image at %v: %v", snapshotTime, err)
+	}
+
+	pal := cfe.getPalette()
+	if pal == nil {
+		return nil, fmt.Errorf("The palette of %v is unknown", shortName)
+	}
+
+	names := getPaletteNames(conf, shortName)
+	entries := make([]paletteStatsEntry, len(pal))
+	for i, col := range pal {
+		entries[i].Color = color.NRGBAModel.Convert(col).(color.NRGBA)
+		entries[i].Name = names.name(col)
+	}
+
+	for iy := img.Rect.Min.Y; iy < img.Rect.Max.Y; iy++ {
+		for ix := img.Rect.Min.X; ix < img.Rect.Max.X; ix++ {
+			col := img.RGBAAt(ix, iy)
+			if col.A == 0 {
+				continue
+			}
+			entries[pal.Index(col)].Pixels++
+		}
+	}
+
+	err = canvasDiskReaderForEachEvent(cfe.Recordings, opts.StartTime, opts.EndTime, func(t time.Time, event interface{}) error {
+		if event, ok := event.(canvasEventSetPixel); ok && event.Pos.In(opts.Rect) {
+			entries[pal.Index(event.Color)].Placements++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Exports the usage of every palette color in the recordings of shortName as table or as bar chart.
+// The format is chosen by the file extension (.csv or .png).
+//
+// Pixel counts are taken at the end time of the options, placements are counted over the whole time range.
+func exportPaletteStats(shortName string, opts exportOptions, fileName string) error {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if ext != ".csv" && ext != ".png" {
+		return fmt.Errorf("Unsupported palette statistics format %v", ext)
+	}
+
+	entries, err := accumulatePaletteStats(shortName, &opts)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+
+	switch ext {
+	case ".csv":
+		bufWriter := bufio.NewWriter(file)
+		if err := writePaletteStatsCSV(bufWriter, entries); err != nil {
+			return fmt.Errorf("Can't write to %v: %v", fileName, err)
+		}
+		if err := bufWriter.Flush(); err != nil {
+			return fmt.Errorf("Can't write to %v: %v", fileName, err)
+		}
+	default:
+		var img image.Image = paletteStatsChart(entries)
+		if opts.Upscale > 1 {
+			img = upscaleNearest(img, opts.Upscale)
+		}
+		if err := png.Encode(file, img); err != nil {
+			return fmt.Errorf("Can't encode palette statistics %v: %v", fileName, err)
+		}
+	}
+
+	return nil
+}
+
+// Returns the sum of the pixels and placements of all entries
+func paletteStatsTotals(entries []paletteStatsEntry) (pixels, placements int) {
+	for _, entry := range entries {
+		pixels += entry.Pixels
+		placements += entry.Placements
+	}
+	return
+}
+
+func writePaletteStatsCSV(w *bufio.Writer, entries []paletteStatsEntry) error {
+	totalPixels, totalPlacements := paletteStatsTotals(entries)
+	percent := func(v, total int) string {
+		if total == 0 {
+			return "0"
+		}
+		return strconv.FormatFloat(float64(v)*100/float64(total), 'f', 2, 64)
+	}
+
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write(paletteStatsColumns); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		c := entry.Color
+		record := []string{
+			strconv.Itoa(i),
+			fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B),
+			entry.Name,
+			strconv.Itoa(entry.Pixels),
+			percent(entry.Pixels, totalPixels),
+			strconv.Itoa(entry.Placements),
+			percent(entry.Placements, totalPlacements),
+		}
+		if err := csvWriter.Write(record); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+
+	return csvWriter.Error()
+}
+
+// Renders a horizontal bar chart with one row per palette color.
+//
+// The upper bar of each row shows the pixel count, the lower and lighter one the number of placements.
+// Both are relative to the highest count of their kind.
+func paletteStatsChart(entries []paletteStatsEntry) *image.RGBA {
+	face := basicfont.Face7x13
+	const padding, swatchSize, barWidth = 4, 24, 300
+	labelWidth := 8 * face.Advance // "#RRGGBB" and a space, or the longest name
+	for _, entry := range entries {
+		if w := (len(entry.Name) + 1) * face.Advance; labelWidth < w {
+			labelWidth = w
+		}
+	}
+	valueWidth := 12 * face.Advance // Room for the numbers right of the bars
+	rowHeight := swatchSize + padding
+
+	var maxPixels, maxPlacements int
+	for _, entry := range entries {
+		if maxPixels < entry.Pixels {
+			maxPixels = entry.Pixels
+		}
+		if maxPlacements < entry.Placements {
+			maxPlacements = entry.Placements
+		}
+	}
+
+	legendHeight := face.Height + padding
+	width := padding + swatchSize + padding + labelWidth + barWidth + padding + valueWidth
+	height := padding + legendHeight + len(entries)*rowHeight + padding
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Rect, image.White, image.Point{}, draw.Src)
+	border := image.NewUniform(color.Gray{160})
+
+	drawer := font.Drawer{
+		Dst:  img,
+		Src:  image.Black,
+		Face: face,
+	}
+	drawText := func(x, y int, s string) {
+		drawer.Dot = fixed.P(x, y+face.Ascent)
+		drawer.DrawString(s)
+	}
+	// Draws a filled rectangle with a gray border, so bright colors are still visible on the background
+	drawBar := func(r image.Rectangle, col color.Color) {
+		draw.Draw(img, r, border, image.Point{}, draw.Src)
+		draw.Draw(img, r.Inset(1), image.White, image.Point{}, draw.Src)
+		draw.Draw(img, r.Inset(1), image.NewUniform(col), image.Point{}, draw.Over)
+	}
+
+	totalPixels, totalPlacements := paletteStatsTotals(entries)
+	drawText(padding, padding, fmt.Sprintf("Pixels (%d total), placements (%d total, lighter)", totalPixels, totalPlacements))
+
+	barX := padding + swatchSize + padding + labelWidth
+	barHeight := swatchSize / 2
+	for i, entry := range entries {
+		y := padding + legendHeight + i*rowHeight
+		c := entry.Color
+
+		drawBar(image.Rect(padding, y, padding+swatchSize, y+swatchSize), c)
+		label := entry.Name
+		if label == "" {
+			label = fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+		}
+		drawText(padding+swatchSize+padding, y+(swatchSize-face.Height)/2, label)
+
+		light := color.NRGBA{c.R, c.G, c.B, c.A / 2}
+		for j, bar := range []struct {
+			value, max int
+			col        color.Color
+		}{{entry.Pixels, maxPixels, c}, {entry.Placements, maxPlacements, light}} {
+			barY := y + j*barHeight
+			length := 0
+			if bar.max > 0 {
+				length = bar.value * barWidth / bar.max
+			}
+			if length > 2 {
+				drawBar(image.Rect(barX, barY, barX+length, barY+barHeight), bar.col)
+			}
+			drawText(barX+length+padding, barY+(barHeight-face.Height)/2, strconv.Itoa(bar.value))
+		}
+	}
+
+	return img
+}
@@ -0,0 +1,95 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/csv"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_exportPaletteStats(t *testing.T) {
+	rect, pos, _ := writeTestRecording(t, "Test-ExportPaletteStats")
+
+	opts := exportOptions{Rect: rect}
+	entries, err := accumulatePaletteStats("Test-ExportPaletteStats", &opts)
+	if err != nil {
+		t.Fatalf("Can't accumulate palette statistics: %v", err)
+	}
+	if len(entries) < len(pixelcanvasioPalette) {
+		t.Fatalf("Got %v entries, want at least one per palette color (%v)", len(entries), len(pixelcanvasioPalette))
+	}
+	if got, want := entries[0].Pixels, rect.Dx()*rect.Dy()-1; got != want {
+		t.Errorf("Pixel count of color 0 = %v, want %v", got, want)
+	}
+	if got := entries[5].Pixels; got != 1 {
+		t.Errorf("Pixel count of color 5 = %v, want 1", got)
+	}
+	if got := entries[5].Placements; got != 1 {
+		t.Errorf("Placements of color 5 = %v, want 1", got)
+	}
+
+	// The pixel is outside of this rectangle
+	opts = exportOptions{Rect: rect.Add(pos).Add(rect.Size().Div(2))}
+	if entries, err = accumulatePaletteStats("Test-ExportPaletteStats", &opts); err != nil {
+		t.Fatalf("Can't accumulate palette statistics: %v", err)
+	}
+	if got := entries[5].Placements; got != 0 {
+		t.Errorf("Placements of color 5 outside of the rectangle = %v, want 0", got)
+	}
+
+	csvFileName := filepath.Join(os.TempDir(), "d3pixelbot-test-palette.csv")
+	defer os.Remove(csvFileName)
+	if err := exportPaletteStats("Test-ExportPaletteStats", exportOptions{Rect: rect}, csvFileName); err != nil {
+		t.Fatalf("Can't export palette statistics: %v", err)
+	}
+	f, err := os.Open(csvFileName)
+	if err != nil {
+		t.Fatalf("Can't open exported CSV: %v", err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("Can't read exported CSV: %v", err)
+	}
+	if len(records) != len(entries)+1 {
+		t.Fatalf("Got %v records, want header and one per palette color", len(records))
+	}
+	if got, want := records[6][3:6], []string{"1", "0.02", "1"}; !equalStrings(got, want) {
+		t.Errorf("Record of color 5 = %v, want %v", got, want)
+	}
+
+	pngFileName := filepath.Join(os.TempDir(), "d3pixelbot-test-palette.png")
+	defer os.Remove(pngFileName)
+	if err := exportPaletteStats("Test-ExportPaletteStats", exportOptions{Rect: rect, Upscale: 2}, pngFileName); err != nil {
+		t.Fatalf("Can't export palette chart: %v", err)
+	}
+	f2, err := os.Open(pngFileName)
+	if err != nil {
+		t.Fatalf("Can't open exported PNG: %v", err)
+	}
+	defer f2.Close()
+	img, err := png.Decode(f2)
+	if err != nil {
+		t.Fatalf("Can't decode exported PNG: %v", err)
+	}
+	if want := paletteStatsChart(entries).Rect.Size().Mul(2); img.Bounds().Size() != want {
+		t.Errorf("Chart has size %v, want %v", img.Bounds().Size(), want)
+	}
+}
@@ -0,0 +1,399 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const exportReportSamples = 48 // Number of points in time that are shown in the graphs
+
+// Settings of a report that is written periodically by the snapshotter
+type exportReportSettings struct {
+	Rect     image.Rectangle // Region of the report. With a template only Min is needed, the size is taken from the template
+	Template string          // Template file that is compared against the canvas, see loadTemplates(). Plain images are placed at Rect.Min. Optional
+	Period   string          // Time range that ends at the time of the report, e.g. "168h". Empty covers all recordings
+	Upscale  int             // Integer scaling factor of the images. 0 or 1 keeps the original size
+}
+
+// Statistics of a report, also used as data of the HTML template
+type exportReportData struct {
+	ShortName          string
+	Rect               image.Rectangle
+	StartTime, EndTime time.Time
+	Generated          time.Time
+
+	Before, After, Diff template.URL // PNG images as data URIs. Diff is only set with a template
+
+	HasTemplate       bool
+	TemplatePixels    int     // Number of non transparent template pixels
+	ProgressStart     float64 // Percentage of correct template pixels at the start time
+	ProgressEnd       float64 // Percentage of correct template pixels at the end time
+	ProgressChange    float64 // Difference of the percentages in percentage points
+	Remaining         int     // Number of wrong template pixels at the end time
+	Placements        int     // Number of pixel changes inside of the region
+	Helpful, Harmful  int     // Pixel changes that matched or contradicted the template
+	BusiestStart      time.Time
+	BusiestPlacements int
+	Colors            []exportReportColor
+	ProgressPoints    string // SVG polyline points of the progress over time
+	ActivityBars      []exportReportBar
+	GraphWidth        int
+	GraphHeight       int
+}
+
+type exportReportColor struct {
+	Hex        string
+	Name       string // Name of the color, see paletteNames
+	Placements int
+	Pixels     int
+}
+
+type exportReportBar struct {
+	X, Y, Width, Height float64
+}
+
+// Loads a template, and moves plain images so that their upper left corner is at pos.
+// Templates in the formats of other bots keep their own position, see loadTemplates().
+func loadExportReportTemplate(fileName string, pos image.Point) (*image.NRGBA, error) {
+	templates, err := loadTemplates(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := mergeTemplates(templates)
+	if isTemplateImageFile(fileName) {
+		tmpl.Rect = tmpl.Rect.Sub(tmpl.Rect.Min).Add(pos)
+	}
+
+	return tmpl, nil
+}
+
+// Replaces the colors of all non transparent template pixels with their closest palette color.
+// Pixels that are more than half transparent are made fully transparent, they are not part of the template.
+func quantizeExportReportTemplate(tmpl *image.NRGBA, pal color.Palette) {
+	for i := 0; i < len(tmpl.Pix); i += 4 {
+		c := color.NRGBA{tmpl.Pix[i+0], tmpl.Pix[i+1], tmpl.Pix[i+2], tmpl.Pix[i+3]}
+		if c.A < 128 {
+			c = color.NRGBA{}
+		} else if pal != nil {
+			c = color.NRGBAModel.Convert(pal.Convert(color.NRGBA{c.R, c.G, c.B, 255})).(color.NRGBA)
+		} else {
+			c.A = 255
+		}
+		tmpl.Pix[i+0], tmpl.Pix[i+1], tmpl.Pix[i+2], tmpl.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+}
+
+// Returns the number of template pixels that match the image, and the number of all template pixels
+func exportReportCompare(img *image.RGBA, tmpl *image.NRGBA) (correct, total int) {
+	rect := img.Rect.Intersect(tmpl.Rect)
+	for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+		for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+			want := tmpl.NRGBAAt(ix, iy)
+			if want.A == 0 {
+				continue
+			}
+			total++
+			if color.NRGBAModel.Convert(img.RGBAAt(ix, iy)) == want {
+				correct++
+			}
+		}
+	}
+	return
+}
+
+// Returns a copy of img, where pixels that differ from the template are red, and pixels outside of the template are darkened
+func exportReportDiffImage(img *image.RGBA, tmpl *image.NRGBA) *image.RGBA {
+	diff := image.NewRGBA(img.Rect)
+	for iy := img.Rect.Min.Y; iy < img.Rect.Max.Y; iy++ {
+		for ix := img.Rect.Min.X; ix < img.Rect.Max.X; ix++ {
+			c := img.RGBAAt(ix, iy)
+			want := tmpl.NRGBAAt(ix, iy)
+			switch {
+			case want.A == 0 || !image.Pt(ix, iy).In(tmpl.Rect):
+				c = color.RGBA{c.R / 3, c.G / 3, c.B / 3, c.A}
+			case color.NRGBAModel.Convert(c) != want:
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			diff.SetRGBA(ix, iy, c)
+		}
+	}
+	return diff
+}
+
+// Exports a standalone HTML report of a region of the recordings of shortName.
+// The report contains images of the region at the start and end time, a graph of the activity and statistics of the placed pixels.
+//
+// If templateFileName is not empty, the template is placed at the upper left corner of the rectangle, and the progress towards it is shown.
+// In that case the rectangle may be empty, it is set to the size of the template then.
+func exportReport(shortName string, opts exportOptions, templateFileName string, fileName string) error {
+	var tmpl *image.NRGBA
+	if templateFileName != "" {
+		var err error
+		if tmpl, err = loadExportReportTemplate(templateFileName, opts.Rect.Min); err != nil {
+			return err
+		}
+		if opts.Rect.Empty() {
+			opts.Rect = tmpl.Rect
+		}
+	}
+
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return err
+	}
+
+	data := exportReportData{
+		ShortName:   shortName,
+		Rect:        opts.Rect,
+		StartTime:   opts.StartTime,
+		EndTime:     opts.EndTime,
+		Generated:   time.Now(),
+		HasTemplate: tmpl != nil,
+		GraphWidth:  600,
+		GraphHeight: 150,
+	}
+
+	// Sample the region at evenly distributed points in time
+	duration := opts.EndTime.Sub(opts.StartTime) - time.Nanosecond // The end time itself is not part of the recordings
+	var before, after *image.RGBA
+	var pal color.Palette
+	progress := []float64{}
+	for i := 0; i < exportReportSamples; i++ {
+		t := opts.StartTime.Add(duration * time.Duration(i) / (exportReportSamples - 1))
+		img, err := cfe.getFrame(t, opts.Rect)
+		if err != nil {
+			return fmt.Errorf("Can't get image at %v: %v", t, err)
+		}
+		opts.reportProgress(i+1, exportReportSamples+1)
+
+		if i == 0 {
+			// Without a palette, the template has to match exactly
+			before, pal = img, cfe.getPalette()
+			if tmpl != nil {
+				quantizeExportReportTemplate(tmpl, pal)
+			}
+		}
+		after = img
+
+		if tmpl != nil {
+			correct, total := exportReportCompare(img, tmpl)
+			data.TemplatePixels, data.Remaining = total, total-correct
+			p := 0.0
+			if total > 0 {
+				p = float64(correct) * 100 / float64(total)
+			}
+			progress = append(progress, p)
+		}
+	}
+	if tmpl != nil {
+		data.ProgressStart, data.ProgressEnd = progress[0], progress[len(progress)-1]
+		data.ProgressChange = data.ProgressEnd - data.ProgressStart
+		points := []string{}
+		for i, p := range progress {
+			x := float64(data.GraphWidth) * float64(i) / float64(len(progress)-1)
+			y := float64(data.GraphHeight) * (1 - p/100)
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+		}
+		data.ProgressPoints = strings.Join(points, " ")
+	}
+
+	if pal == nil {
+		pal = cfe.getPalette()
+	}
+
+	// Count placements over time, and compare them against the template
+	buckets := make([]int, exportReportSamples)
+	colorPlacements := map[color.NRGBA]int{}
+	err = canvasDiskReaderForEachEvent(cfe.Recordings, opts.StartTime, opts.EndTime, func(t time.Time, event interface{}) error {
+		setPixel, ok := event.(canvasEventSetPixel)
+		if !ok || !setPixel.Pos.In(opts.Rect) {
+			return nil
+		}
+		data.Placements++
+		buckets[int(int64(t.Sub(opts.StartTime))*int64(len(buckets))/int64(opts.EndTime.Sub(opts.StartTime)))]++
+
+		c := color.NRGBAModel.Convert(setPixel.Color).(color.NRGBA)
+		if pal != nil {
+			c = color.NRGBAModel.Convert(pal.Convert(c)).(color.NRGBA)
+		}
+		colorPlacements[c]++
+
+		if tmpl != nil && setPixel.Pos.In(tmpl.Rect) {
+			if want := tmpl.NRGBAAt(setPixel.Pos.X, setPixel.Pos.Y); want.A != 0 {
+				if c == want {
+					data.Helpful++
+				} else {
+					data.Harmful++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	maxBucket := 0
+	for i, count := range buckets {
+		if maxBucket < count {
+			maxBucket = count
+			data.BusiestPlacements = count
+			data.BusiestStart = opts.StartTime.Add(opts.EndTime.Sub(opts.StartTime) * time.Duration(i) / exportReportSamples)
+		}
+	}
+	for i, count := range buckets {
+		if count == 0 {
+			continue
+		}
+		width := float64(data.GraphWidth) / float64(len(buckets))
+		height := float64(data.GraphHeight) * float64(count) / float64(maxBucket)
+		data.ActivityBars = append(data.ActivityBars, exportReportBar{width * float64(i), float64(data.GraphHeight) - height, width, height})
+	}
+
+	// Colors sorted by the number of placements
+	colorPixels := map[color.NRGBA]int{}
+	for iy := after.Rect.Min.Y; iy < after.Rect.Max.Y; iy++ {
+		for ix := after.Rect.Min.X; ix < after.Rect.Max.X; ix++ {
+			if c := after.RGBAAt(ix, iy); c.A != 0 {
+				colorPixels[color.NRGBAModel.Convert(c).(color.NRGBA)]++
+			}
+		}
+	}
+	names := getPaletteNames(conf, shortName)
+	for c, placements := range colorPlacements {
+		data.Colors = append(data.Colors, exportReportColor{fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B), names.name(c), placements, colorPixels[c]})
+	}
+	sort.Slice(data.Colors, func(i, j int) bool {
+		if data.Colors[i].Placements != data.Colors[j].Placements {
+			return data.Colors[i].Placements > data.Colors[j].Placements
+		}
+		return data.Colors[i].Hex < data.Colors[j].Hex
+	})
+
+	// Embed the images, so the report is a single file
+	toDataURI := func(img image.Image) (template.URL, error) {
+		return exportReportDataURI(opts.scaleImage(img))
+	}
+	if data.Before, err = toDataURI(before); err != nil {
+		return fmt.Errorf("Can't encode image: %v", err)
+	}
+	if data.After, err = toDataURI(after); err != nil {
+		return fmt.Errorf("Can't encode image: %v", err)
+	}
+	if tmpl != nil {
+		if data.Diff, err = toDataURI(exportReportDiffImage(after, tmpl)); err != nil {
+			return fmt.Errorf("Can't encode image: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0777); err != nil {
+		return fmt.Errorf("Can't create directory for %v: %v", fileName, err)
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("Can't create file %v: %v", fileName, err)
+	}
+	defer file.Close()
+
+	if err := exportReportTemplate.Execute(file, data); err != nil {
+		return fmt.Errorf("Can't write report %v: %v", fileName, err)
+	}
+	opts.reportProgress(exportReportSamples+1, exportReportSamples+1)
+
+	return nil
+}
+
+// Encodes an image as PNG data URI, so it can be embedded into HTML
+func exportReportDataURI(img image.Image) (template.URL, error) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+var exportReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04 MST") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.ShortName}} report {{time .EndTime}}</title>
+<style>
+	body { font-family: sans-serif; background: #222; color: #ddd; margin: 2em; }
+	h1, h2 { font-weight: normal; }
+	img { image-rendering: pixelated; max-width: 100%; background: repeating-conic-gradient(#333 0% 25%, #444 0% 50%) 0 0 / 16px 16px; }
+	figure { display: inline-block; margin: 0 1em 1em 0; vertical-align: top; }
+	table { border-collapse: collapse; }
+	td, th { padding: 0.2em 0.8em; text-align: right; }
+	.swatch { display: inline-block; width: 1em; height: 1em; border: 1px solid #888; vertical-align: middle; }
+	svg { background: #333; }
+</style>
+</head>
+<body>
+<h1>{{.ShortName}} at ({{.Rect.Min.X}}, {{.Rect.Min.Y}}) - ({{.Rect.Max.X}}, {{.Rect.Max.Y}})</h1>
+<p>From {{time .StartTime}} to {{time .EndTime}}, generated {{time .Generated}}</p>
+
+{{if .HasTemplate}}
+<h2>Progress</h2>
+<p>{{printf "%.1f" .ProgressEnd}}% of {{.TemplatePixels}} template pixels are correct ({{printf "%+.1f" .ProgressChange}} points), {{.Remaining}} remaining.</p>
+<svg width="{{.GraphWidth}}" height="{{.GraphHeight}}" viewBox="0 0 {{.GraphWidth}} {{.GraphHeight}}">
+	<polyline points="{{.ProgressPoints}}" fill="none" stroke="#4c4" stroke-width="2"/>
+</svg>
+{{end}}
+
+<h2>Canvas</h2>
+<figure><img src="{{.Before}}" alt="Before"><figcaption>{{time .StartTime}}</figcaption></figure>
+<figure><img src="{{.After}}" alt="After"><figcaption>{{time .EndTime}}</figcaption></figure>
+{{if .Diff}}<figure><img src="{{.Diff}}" alt="Differences"><figcaption>Wrong pixels in red</figcaption></figure>{{end}}
+
+<h2>Activity</h2>
+<p>{{.Placements}} pixels were placed{{if .HasTemplate}}, {{.Helpful}} of them matching the template and {{.Harmful}} against it{{end}}.
+{{if .BusiestPlacements}}The busiest time was around {{time .BusiestStart}} with {{.BusiestPlacements}} pixels.{{end}}</p>
+<svg width="{{.GraphWidth}}" height="{{.GraphHeight}}" viewBox="0 0 {{.GraphWidth}} {{.GraphHeight}}">
+	{{range .ActivityBars}}<rect x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}" fill="#c84"/>{{end}}
+</svg>
+
+{{if .Colors}}
+<h2>Colors</h2>
+<table>
+	<tr><th>Color</th><th>Placements</th><th>Pixels now</th></tr>
+	{{range .Colors}}<tr><td><span class="swatch" style="background: {{.Hex}}"></span> {{with .Name}}{{.}} {{end}}{{.Hex}}</td><td>{{.Placements}}</td><td>{{.Pixels}}</td></tr>
+	{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,68 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_exportReport(t *testing.T) {
+	_, pos, _ := writeTestRecording(t, "Test-ExportReport")
+
+	// Template that expects the recorded pixel, and a single pixel with a different color
+	tmpl := image.NewPaletted(image.Rect(0, 0, 8, 8), pixelcanvasioPalette)
+	tmpl.SetColorIndex(pos.X, pos.Y, 5)
+	tmpl.SetColorIndex(6, 6, 3)
+	templateFileName := filepath.Join(os.TempDir(), "d3pixelbot-test-template.png")
+	defer os.Remove(templateFileName)
+	f, err := os.Create(templateFileName)
+	if err != nil {
+		t.Fatalf("Can't create template: %v", err)
+	}
+	if err := png.Encode(f, tmpl); err != nil {
+		t.Fatalf("Can't encode template: %v", err)
+	}
+	f.Close()
+
+	fileName := filepath.Join(os.TempDir(), "d3pixelbot-test-report.html")
+	defer os.Remove(fileName)
+	if err := exportReport("Test-ExportReport", exportOptions{}, templateFileName, fileName); err != nil {
+		t.Fatalf("Can't export report: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("Can't read report: %v", err)
+	}
+	report := string(data)
+	for _, want := range []string{
+		"98.4% of 64 template pixels are correct", // All but one pixel are correct at the end
+		"1 remaining",
+		"1 pixels were placed, 1 of them matching the template and 0 against it",
+		"data:image/png;base64,",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Report doesn't contain %q", want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const exportTileSize = 256
+
+// Describes the tile pyramid, written as tiles.json into the output directory
+type exportTilesInfo struct {
+	TileSize int             // Width and height of a tile in pixels
+	MinZoom  int             // Zoom level with a single tile covering the whole region
+	MaxZoom  int             // Zoom level where a tile pixel is a canvas pixel
+	Rect     image.Rectangle // Exported region of the canvas, the tile 0/0/0 starts at Rect.Min
+	Time     time.Time       // Point in time of the snapshot
+}
+
+// Exports a snapshot of the recordings of shortName as a pyramid of map tiles into dir.
+//
+// The tiles are stored as dir/z/x/y.png, where z = MaxZoom is the original resolution and every lower level halves it.
+// The snapshot is taken at the end time of the options. Tiles without any data are not written.
+// Exporting into the same directory again only encodes the tiles that changed.
+func exportTiles(shortName string, opts exportOptions, dir string) error {
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return err
+	}
+
+	tc, err := newTileCache(dir, png.BestCompression)
+	if err != nil {
+		return err
+	}
+
+	snapshotTime := opts.EndTime.Add(-time.Nanosecond) // The end time itself is not part of the recordings
+	if err := cfe.seek(snapshotTime); err != nil {
+		return fmt.Errorf("Can't replay recordings up to %v: %v", snapshotTime, err)
+	}
+
+	// Find the zoom level where a single tile covers the region
+	maxZoom := 0
+	for exportTileSize<<uint(maxZoom) < opts.Rect.Dx() || exportTileSize<<uint(maxZoom) < opts.Rect.Dy() {
+		maxZoom++
+	}
+
+	exportLog.Debugf("Started tile export of %v at %v with %v zoom levels into %v", shortName, opts.Rect, maxZoom+1, dir)
+
+	tilesX, tilesY := divideCeil(opts.Rect.Dx(), exportTileSize), divideCeil(opts.Rect.Dy(), exportTileSize)
+	tiles := 0
+
+	// Count the tiles of all levels for the progress
+	doneSteps, totalSteps := 0, 0
+	for x, y, z := tilesX, tilesY, maxZoom; z >= 0; x, y, z = divideCeil(x, 2), divideCeil(y, 2), z-1 {
+		totalSteps += x * y
+	}
+	step := func() {
+		doneSteps++
+		opts.reportProgress(doneSteps, totalSteps)
+	}
+
+	// Tiles of the highest zoom level are taken directly from the canvas, rendered in parallel
+	ty := 0
+	renderOpts := canvasRenderOptions{TileSize: pixelSize{exportTileSize, exportTileSize}}
+	err = cfe.Canvas.renderBands(opts.Rect, renderOpts, func(band *image.RGBA) error {
+		for tx := 0; tx < tilesX; tx++ {
+			tileRect := image.Rect(0, 0, exportTileSize, exportTileSize).Add(opts.Rect.Min).Add(image.Point{tx * exportTileSize, ty * exportTileSize})
+
+			tile := image.NewNRGBA(image.Rect(0, 0, exportTileSize, exportTileSize))
+			srcRect := tileRect.Intersect(band.Rect)
+			draw.Draw(tile, srcRect.Sub(tileRect.Min), band, srcRect.Min, draw.Src)
+
+			encoded, err := exportTilesWrite(tc, maxZoom, tx, ty, tile)
+			if err != nil {
+				return err
+			}
+			if encoded {
+				tiles++
+			}
+			step()
+		}
+		ty++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Can't render tiles: %v", err)
+	}
+
+	// Every lower zoom level is created from the four tiles above it
+	for z := maxZoom - 1; z >= 0; z-- {
+		tilesX, tilesY = divideCeil(tilesX, 2), divideCeil(tilesY, 2)
+		for ty := 0; ty < tilesY; ty++ {
+			for tx := 0; tx < tilesX; tx++ {
+				tile := image.NewNRGBA(image.Rect(0, 0, exportTileSize, exportTileSize))
+				for i := 0; i < 4; i++ {
+					cx, cy := i%2, i/2
+					child, err := exportTilesRead(dir, z+1, tx*2+cx, ty*2+cy)
+					if err != nil {
+						return err
+					}
+					if child != nil {
+						exportTilesDownscale(tile, child, image.Point{cx * exportTileSize / 2, cy * exportTileSize / 2})
+					}
+				}
+
+				encoded, err := exportTilesWrite(tc, z, tx, ty, tile)
+				if err != nil {
+					return err
+				}
+				if encoded {
+					tiles++
+				}
+				step()
+			}
+		}
+	}
+
+	info := exportTilesInfo{
+		TileSize: exportTileSize,
+		MinZoom:  0,
+		MaxZoom:  maxZoom,
+		Rect:     opts.Rect,
+		Time:     snapshotTime,
+	}
+	data, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "tiles.json"), data, 0666); err != nil {
+		return fmt.Errorf("Can't write tile info: %v", err)
+	}
+	if err := tc.saveIndex(); err != nil {
+		return err
+	}
+
+	exportLog.Debugf("Finished tile export of %v with %v encoded tiles into %v", shortName, tiles, dir)
+
+	return nil
+}
+
+func exportTilesFileName(dir string, z, x, y int) string {
+	return filepath.Join(dir, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y)+".png")
+}
+
+// Writes the tile, if it contains any non transparent pixel.
+// Returns false if the tile didn't need to be encoded, because it didn't change since the last export.
+func exportTilesWrite(tc *tileCache, z, x, y int, tile *image.NRGBA) (bool, error) {
+	return tc.put(fmt.Sprintf("%d/%d/%d", z, x, y), tile)
+}
+
+// Reads a previously written tile. Returns nil if the tile doesn't exist
+func exportTilesRead(dir string, z, x, y int) (image.Image, error) {
+	fileName := exportTilesFileName(dir, z, x, y)
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't open tile %v: %v", fileName, err)
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("Can't decode tile %v: %v", fileName, err)
+	}
+
+	return img, nil
+}
+
+// Draws src with half its size at offset into dst. Every destination pixel is the average of 2x2 source pixels
+func exportTilesDownscale(dst *image.NRGBA, src image.Image, offset image.Point) {
+	srcRect := src.Bounds()
+	for iy := 0; iy < srcRect.Dy()/2; iy++ {
+		for ix := 0; ix < srcRect.Dx()/2; ix++ {
+			var r, g, b, a uint32
+			for i := 0; i < 4; i++ {
+				cr, cg, cb, ca := src.At(srcRect.Min.X+ix*2+i%2, srcRect.Min.Y+iy*2+i/2).RGBA() // Premultiplied
+				r, g, b, a = r+cr, g+cg, b+cb, a+ca
+			}
+			if a == 0 {
+				continue
+			}
+			i := dst.PixOffset(offset.X+ix, offset.Y+iy)
+			dst.Pix[i+0] = uint8(r * 0xFF / a)
+			dst.Pix[i+1] = uint8(g * 0xFF / a)
+			dst.Pix[i+2] = uint8(b * 0xFF / a)
+			dst.Pix[i+3] = uint8(a / 4 >> 8)
+		}
+	}
+}
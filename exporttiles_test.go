@@ -0,0 +1,61 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_exportTiles(t *testing.T) {
+	_, pos, _ := writeTestRecording(t, "Test-ExportTiles")
+
+	dir, err := ioutil.TempDir("", "d3pixelbot-tiles")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := exportOptions{
+		Rect: image.Rect(0, 0, 600, 300), // Results in 3 zoom levels
+	}
+	if err := exportTiles("Test-ExportTiles", opts, dir); err != nil {
+		t.Fatalf("Can't export tiles: %v", err)
+	}
+
+	img, err := exportTilesRead(dir, 2, 0, 0)
+	if err != nil || img == nil {
+		t.Fatalf("Can't read tile 2/0/0: %v", err)
+	}
+	if got, want := color.NRGBAModel.Convert(img.At(pos.X, pos.Y)), color.NRGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+		t.Errorf("Pixel at %v = %v, want %v", pos, got, want)
+	}
+
+	for _, tile := range []struct{ z, x, y int }{{1, 0, 0}, {0, 0, 0}} {
+		if img, err := exportTilesRead(dir, tile.z, tile.x, tile.y); err != nil || img == nil {
+			t.Errorf("Can't read tile %v/%v/%v: %v", tile.z, tile.x, tile.y, err)
+		}
+	}
+
+	// Tiles without data are not written
+	if img, _ := exportTilesRead(dir, 2, 1, 0); img != nil {
+		t.Errorf("Tile 2/1/0 exists, but has no data")
+	}
+}
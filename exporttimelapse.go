@@ -0,0 +1,126 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Returns the path of ffmpeg, preferring the one next to the executable over the one in the PATH
+func findFFmpeg() (string, error) {
+	ffmpegPath, err := exec.LookPath(filepath.Join(dirs.Executable, "ffmpeg"))
+	if err != nil {
+		ffmpegPath, err = exec.LookPath("ffmpeg")
+		if err != nil {
+			return "", fmt.Errorf("Can't find ffmpeg: %v", err)
+		}
+	}
+	return ffmpegPath, nil
+}
+
+// Exports a timelapse of the recordings of shortName into a video file.
+// The codec is chosen by the file extension (.mp4 or .webm).
+//
+// This needs ffmpeg to be available next to the executable or in the PATH, see findFFmpeg.
+func exportTimelapse(shortName string, opts exportOptions, fileName string) error {
+	var codecArgs []string
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".mp4":
+		codecArgs = []string{"-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart"}
+	case ".webm":
+		codecArgs = []string{"-c:v", "libvpx-vp9", "-pix_fmt", "yuv420p", "-b:v", "0", "-crf", "30"}
+	default:
+		return fmt.Errorf("Unsupported video format %v", filepath.Ext(fileName))
+	}
+
+	ffmpegPath, err := findFFmpeg()
+	if err != nil {
+		return err
+	}
+
+	cfe, err := newCanvasFrameExtractor(shortName)
+	if err != nil {
+		return err
+	}
+	defer cfe.Close()
+
+	if err := opts.prepare(cfe); err != nil {
+		return err
+	}
+	if err := opts.prepareFrames(cfe); err != nil {
+		return err
+	}
+
+	size := opts.outputSize()
+
+	args := []string{
+		"-y", "-loglevel", "error",
+		"-f", "rawvideo", "-pix_fmt", "rgba",
+		"-s", fmt.Sprintf("%dx%d", size.X, size.Y),
+		"-r", fmt.Sprintf("%g", opts.FrameRate),
+		"-i", "-",
+		"-vf", "pad=ceil(iw/2)*2:ceil(ih/2)*2", // yuv420p needs even dimensions
+	}
+	args = append(args, codecArgs...)
+	args = append(args, fileName)
+
+	cmd := exec.Command(ffmpegPath, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("Can't pipe into ffmpeg: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Can't start ffmpeg: %v", err)
+	}
+
+	exportLog.Debugf("Started timelapse export of %v at %v from %v to %v into %v", shortName, opts.Rect, opts.StartTime, opts.EndTime, fileName)
+
+	interval := opts.frameInterval()
+	frames, frameCount := 0, opts.frameCount()
+	var frameErr error
+	for i, t := 0, opts.StartTime; t.Before(opts.EndTime); i, t = i+1, t.Add(interval) {
+		img, err := cfe.getFrame(t, opts.frameRect(i))
+		if err != nil {
+			frameErr = fmt.Errorf("Can't get frame at %v: %v", t, err)
+			break
+		}
+		if _, err := stdin.Write(opts.renderFrame(img, t, shortName).Pix); err != nil {
+			frameErr = fmt.Errorf("Can't write frame to ffmpeg: %v", err)
+			break
+		}
+		frames++
+		opts.reportProgress(frames, frameCount)
+	}
+	stdin.Close()
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	if frameErr != nil {
+		return frameErr
+	}
+
+	exportLog.Debugf("Finished timelapse export of %v with %v frames into %v", shortName, frames, fileName)
+
+	return nil
+}
@@ -0,0 +1,523 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// Writes frames as animated lossless WebP.
+//
+// Frames are streamed into the file, the RIFF size is updated on Close().
+type webpEncoder struct {
+	writer io.WriteSeeker
+	size   pixelSize
+
+	startOffset int64 // Offset of the RIFF header
+}
+
+func newWebPEncoder(w io.WriteSeeker, size pixelSize, pal color.Palette, opts exportOptions) (animationEncoder, error) {
+	if size.X > 1<<14 || size.Y > 1<<14 {
+		return nil, fmt.Errorf("Size %v exceeds the maximum WebP frame size", size)
+	}
+
+	enc := &webpEncoder{
+		writer: w,
+		size:   size,
+	}
+
+	offset, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	enc.startOffset = offset
+
+	if _, err := w.Write([]byte("RIFF\x00\x00\x00\x00WEBP")); err != nil {
+		return nil, err
+	}
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x10 | 0x02 // Flags: Alpha, Animation
+	putUint24(vp8x[4:7], uint32(size.X-1))
+	putUint24(vp8x[7:10], uint32(size.Y-1))
+	if err := enc.writeChunk("VP8X", vp8x); err != nil {
+		return nil, err
+	}
+
+	anim := make([]byte, 6) // Transparent background, loop forever
+	if err := enc.writeChunk("ANIM", anim); err != nil {
+		return nil, err
+	}
+
+	return enc, nil
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+func (enc *webpEncoder) writeChunk(chunkType string, data []byte) error {
+	header := make([]byte, 8)
+	copy(header[0:4], chunkType)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(data)))
+
+	if _, err := enc.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := enc.writer.Write(data); err != nil {
+		return err
+	}
+	if len(data)%2 != 0 {
+		if _, err := enc.writer.Write([]byte{0}); err != nil { // Padding
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (enc *webpEncoder) convertFrame(img image.Image) image.Image {
+	rect := image.Rect(0, 0, enc.size.X, enc.size.Y)
+
+	nrgba := image.NewNRGBA(rect)
+	draw.Draw(nrgba, rect, img, img.Bounds().Min, draw.Src)
+	return nrgba
+}
+
+func (enc *webpEncoder) writeFrame(img image.Image, duration time.Duration) error {
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		return fmt.Errorf("Incompatible image type %T", img)
+	}
+	rect := nrgba.Rect
+
+	bitstream := encodeVP8L(nrgba)
+
+	delay := duration / time.Millisecond
+	if delay > 0xFFFFFF {
+		delay = 0xFFFFFF
+	}
+
+	anmf := make([]byte, 16, 16+8+len(bitstream)+1)
+	putUint24(anmf[0:3], uint32(rect.Min.X/2))
+	putUint24(anmf[3:6], uint32(rect.Min.Y/2))
+	putUint24(anmf[6:9], uint32(rect.Dx()-1))
+	putUint24(anmf[9:12], uint32(rect.Dy()-1))
+	putUint24(anmf[12:15], uint32(delay))
+	anmf[15] = 0x02 // Don't blend, don't dispose
+
+	// Frame data as embedded VP8L chunk
+	vp8lHeader := make([]byte, 8)
+	copy(vp8lHeader[0:4], "VP8L")
+	binary.LittleEndian.PutUint32(vp8lHeader[4:8], uint32(len(bitstream)))
+	anmf = append(anmf, vp8lHeader...)
+	anmf = append(anmf, bitstream...)
+	if len(bitstream)%2 != 0 {
+		anmf = append(anmf, 0)
+	}
+
+	return enc.writeChunk("ANMF", anmf)
+}
+
+func (enc *webpEncoder) Close() error {
+	// Update the RIFF size
+	end, err := enc.writer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := enc.writer.Seek(enc.startOffset+4, io.SeekStart); err != nil {
+		return err
+	}
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(end-enc.startOffset-8))
+	if _, err := enc.writer.Write(size); err != nil {
+		return err
+	}
+	if _, err := enc.writer.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Bit writer for the VP8L bitstream, bits are packed starting with the least significant bit
+type vp8lBitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint
+}
+
+func (w *vp8lBitWriter) write(value uint32, n uint) {
+	w.bits |= uint64(value) << w.nBits
+	w.nBits += n
+	for w.nBits >= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+		w.nBits -= 8
+	}
+}
+
+func (w *vp8lBitWriter) flush() []byte {
+	if w.nBits > 0 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits, w.nBits = 0, 0
+	}
+	return w.buf
+}
+
+// Canonical prefix code, as used by VP8L
+type vp8lPrefixCode struct {
+	lengths []uint8
+	codes   []uint16 // Bit reversed codes, ready to be written
+	single  bool     // Only one symbol is used, it will be written with zero bits
+}
+
+// Creates a length limited prefix code from the given symbol histogram
+func newVP8LPrefixCode(histogram []uint32, maxLength uint8) vp8lPrefixCode {
+	pc := vp8lPrefixCode{
+		lengths: make([]uint8, len(histogram)),
+		codes:   make([]uint16, len(histogram)),
+	}
+
+	used := 0
+	for symbol, count := range histogram {
+		if count > 0 {
+			used++
+			pc.lengths[symbol] = 1
+		}
+	}
+	if used <= 1 {
+		pc.single = true
+		return pc
+	}
+
+	// Build Huffman trees until the lengths fit. Small counts are raised each time, this flattens the tree
+	type node struct {
+		count       uint32
+		left, right int // Children, -1 for leaves
+	}
+	for minCount := uint32(1); ; minCount *= 2 {
+		nodes := []node{}
+		leafSymbols := []int{}
+		for symbol, count := range histogram {
+			if count > 0 {
+				if count < minCount {
+					count = minCount
+				}
+				nodes = append(nodes, node{count, -1, -1})
+				leafSymbols = append(leafSymbols, symbol)
+			}
+		}
+
+		active := make([]int, len(nodes))
+		for i := range active {
+			active[i] = i
+		}
+		for len(active) > 1 {
+			// Find the two nodes with the smallest count
+			a, b := 0, 1
+			if nodes[active[b]].count < nodes[active[a]].count {
+				a, b = b, a
+			}
+			for i := 2; i < len(active); i++ {
+				if nodes[active[i]].count < nodes[active[a]].count {
+					a, b = i, a
+				} else if nodes[active[i]].count < nodes[active[b]].count {
+					b = i
+				}
+			}
+			nodes = append(nodes, node{nodes[active[a]].count + nodes[active[b]].count, active[a], active[b]})
+			if a > b {
+				a, b = b, a
+			}
+			active = append(active[:b], active[b+1:]...)
+			active[a] = len(nodes) - 1
+		}
+
+		// Get the depth of all leaves
+		depths := make([]uint8, len(nodes))
+		tooLong := false
+		for i := len(nodes) - 1; i >= 0; i-- {
+			if nodes[i].left >= 0 {
+				depths[nodes[i].left], depths[nodes[i].right] = depths[i]+1, depths[i]+1
+			} else if depths[i] > maxLength {
+				tooLong = true
+			}
+		}
+		if tooLong {
+			continue
+		}
+		for i, symbol := range leafSymbols {
+			pc.lengths[symbol] = depths[i]
+		}
+		break
+	}
+
+	// Assign canonical codes
+	var lengthCount, nextCode [16]uint16
+	for _, length := range pc.lengths {
+		if length > 0 {
+			lengthCount[length]++
+		}
+	}
+	code := uint16(0)
+	for length := 1; length < 16; length++ {
+		code = (code + lengthCount[length-1]) << 1
+		nextCode[length] = code
+	}
+	for symbol, length := range pc.lengths {
+		if length > 0 {
+			pc.codes[symbol] = bits.Reverse16(nextCode[length]) >> (16 - length)
+			nextCode[length]++
+		}
+	}
+
+	return pc
+}
+
+func (pc *vp8lPrefixCode) writeSymbol(w *vp8lBitWriter, symbol int) {
+	if !pc.single {
+		w.write(uint32(pc.codes[symbol]), uint(pc.lengths[symbol]))
+	}
+}
+
+var vp8lCodeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// Writes the prefix code for the given histogram into the bitstream, and returns it
+func (w *vp8lBitWriter) writePrefixCode(histogram []uint32) vp8lPrefixCode {
+	symbols := []int{}
+	for symbol, count := range histogram {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	// Use a simple code if possible
+	if len(symbols) <= 2 && (len(symbols) == 0 || symbols[len(symbols)-1] < 256) {
+		if len(symbols) == 0 {
+			symbols = append(symbols, 0)
+		}
+		w.write(1, 1)
+		w.write(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(symbols[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			w.write(uint32(symbols[1]), 8)
+		}
+		return newVP8LPrefixCode(histogram, 15)
+	}
+
+	pc := newVP8LPrefixCode(histogram, 15)
+
+	// Run length encode the code lengths
+	type token struct {
+		symbol          int
+		extra, extraLen uint32
+	}
+	tokens := []token{}
+	for i := 0; i < len(pc.lengths); {
+		length := pc.lengths[i]
+		run := 1
+		for i+run < len(pc.lengths) && pc.lengths[i+run] == length {
+			run++
+		}
+		i += run
+		if length == 0 {
+			for run >= 11 {
+				r := run
+				if r > 138 {
+					r = 138
+				}
+				tokens = append(tokens, token{18, uint32(r - 11), 7})
+				run -= r
+			}
+			if run >= 3 {
+				tokens = append(tokens, token{17, uint32(run - 3), 3})
+				run = 0
+			}
+		} else {
+			tokens = append(tokens, token{int(length), 0, 0})
+			run--
+			for run >= 3 {
+				r := run
+				if r > 6 {
+					r = 6
+				}
+				tokens = append(tokens, token{16, uint32(r - 3), 2})
+				run -= r
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, token{int(length), 0, 0})
+		}
+	}
+
+	clHistogram := make([]uint32, 19)
+	for _, t := range tokens {
+		clHistogram[t.symbol]++
+	}
+	clCode := newVP8LPrefixCode(clHistogram, 7)
+
+	numCodes := 4
+	for i, symbol := range vp8lCodeLengthCodeOrder {
+		if clCode.lengths[symbol] > 0 && i+1 > numCodes {
+			numCodes = i + 1
+		}
+	}
+
+	w.write(0, 1)
+	w.write(uint32(numCodes-4), 4)
+	for _, symbol := range vp8lCodeLengthCodeOrder[:numCodes] {
+		w.write(uint32(clCode.lengths[symbol]), 3)
+	}
+	w.write(0, 1) // Code lengths for the whole alphabet follow
+	for _, t := range tokens {
+		clCode.writeSymbol(w, t.symbol)
+		if t.extraLen > 0 {
+			w.write(t.extra, uint(t.extraLen))
+		}
+	}
+
+	return pc
+}
+
+// Returns the prefix symbol, extra bits and the amount of extra bits of an LZ77 length or distance value (>= 1)
+func vp8lPrefixEncode(value int) (symbol int, extra uint32, extraLen uint) {
+	d := value - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	h := bits.Len(uint(d)) - 1
+	second := (d >> uint(h-1)) & 1
+	extraLen = uint(h - 1)
+	return 2*h + second, uint32(d) & (1<<extraLen - 1), extraLen
+}
+
+// Encodes an image into a VP8L (lossless WebP) bitstream.
+//
+// This uses no transforms and no color cache.
+// Runs of pixels that repeat the left or upper neighbor are encoded as backward references, which works well for pixel art.
+func encodeVP8L(img *image.NRGBA) []byte {
+	rect := img.Rect
+	width, height := rect.Dx(), rect.Dy()
+
+	argb := make([]uint32, 0, width*height)
+	for iy := 0; iy < height; iy++ {
+		line := img.Pix[iy*img.Stride : iy*img.Stride+width*4]
+		for i := 0; i < len(line); i += 4 {
+			argb = append(argb, uint32(line[i+3])<<24|uint32(line[i])<<16|uint32(line[i+1])<<8|uint32(line[i+2]))
+		}
+	}
+
+	const maxLength, minLength = 4096, 3
+
+	type backRef struct {
+		pos, length, distCode int
+	}
+	refs := []backRef{}
+
+	var greenHist [256 + 24]uint32
+	var redHist, blueHist, alphaHist [256]uint32
+	var distHist [40]uint32
+
+	for i := 0; i < len(argb); {
+		bestLength, bestDistCode := 0, 0
+		for _, candidate := range [2]struct{ dist, code int }{{width, 1}, {1, 2}} {
+			if i < candidate.dist {
+				continue
+			}
+			length := 0
+			for i+length < len(argb) && length < maxLength && argb[i+length] == argb[i+length-candidate.dist] {
+				length++
+			}
+			if length > bestLength {
+				bestLength, bestDistCode = length, candidate.code
+			}
+		}
+
+		if bestLength >= minLength {
+			refs = append(refs, backRef{i, bestLength, bestDistCode})
+			lengthSymbol, _, _ := vp8lPrefixEncode(bestLength)
+			distSymbol, _, _ := vp8lPrefixEncode(bestDistCode)
+			greenHist[256+lengthSymbol]++
+			distHist[distSymbol]++
+			i += bestLength
+			continue
+		}
+
+		pixel := argb[i]
+		greenHist[(pixel>>8)&0xFF]++
+		redHist[(pixel>>16)&0xFF]++
+		blueHist[pixel&0xFF]++
+		alphaHist[pixel>>24]++
+		i++
+	}
+
+	w := &vp8lBitWriter{}
+	w.write(0x2F, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	w.write(1, 1) // The alpha channel may be used
+	w.write(0, 3) // Version
+	w.write(0, 1) // No transforms
+	w.write(0, 1) // No color cache
+	w.write(0, 1) // No meta prefix codes
+
+	greenCode := w.writePrefixCode(greenHist[:])
+	redCode := w.writePrefixCode(redHist[:])
+	blueCode := w.writePrefixCode(blueHist[:])
+	alphaCode := w.writePrefixCode(alphaHist[:])
+	distCode := w.writePrefixCode(distHist[:])
+
+	for i := 0; i < len(argb); {
+		if len(refs) > 0 && refs[0].pos == i {
+			ref := refs[0]
+			refs = refs[1:]
+
+			symbol, extra, extraLen := vp8lPrefixEncode(ref.length)
+			greenCode.writeSymbol(w, 256+symbol)
+			w.write(extra, extraLen)
+			symbol, extra, extraLen = vp8lPrefixEncode(ref.distCode)
+			distCode.writeSymbol(w, symbol)
+			w.write(extra, extraLen)
+
+			i += ref.length
+			continue
+		}
+
+		pixel := argb[i]
+		greenCode.writeSymbol(w, int((pixel>>8)&0xFF))
+		redCode.writeSymbol(w, int((pixel>>16)&0xFF))
+		blueCode.writeSymbol(w, int(pixel&0xFF))
+		alphaCode.writeSymbol(w, int(pixel>>24))
+		i++
+	}
+
+	return w.flush()
+}
@@ -0,0 +1,79 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/vp8l"
+)
+
+func Test_encodeVP8L(t *testing.T) {
+	tests := []struct {
+		name string
+		size pixelSize
+		fill func(img *image.NRGBA)
+	}{
+		{"Single pixel", pixelSize{1, 1}, func(img *image.NRGBA) {}},
+		{"Uniform", pixelSize{37, 21}, func(img *image.NRGBA) {
+			for i := range img.Pix {
+				img.Pix[i] = 200
+			}
+		}},
+		{"Palette", pixelSize{64, 48}, func(img *image.NRGBA) {
+			r := rand.New(rand.NewSource(1))
+			for iy := 0; iy < img.Rect.Dy(); iy++ {
+				for ix := 0; ix < img.Rect.Dx(); ix++ {
+					if r.Intn(4) == 0 {
+						img.Set(ix, iy, pixelcanvasioPalette[r.Intn(len(pixelcanvasioPalette))])
+					} else if ix > 0 {
+						img.Set(ix, iy, img.At(ix-1, iy))
+					}
+				}
+			}
+		}},
+		{"Noise", pixelSize{50, 50}, func(img *image.NRGBA) {
+			rand.New(rand.NewSource(2)).Read(img.Pix)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewNRGBA(image.Rect(0, 0, tt.size.X, tt.size.Y))
+			tt.fill(img)
+
+			decoded, err := vp8l.Decode(bytes.NewReader(encodeVP8L(img)))
+			if err != nil {
+				t.Fatalf("Can't decode bitstream: %v", err)
+			}
+			if got, want := decoded.Bounds(), img.Rect; got != want {
+				t.Fatalf("Decoded bounds = %v, want %v", got, want)
+			}
+			for iy := 0; iy < tt.size.Y; iy++ {
+				for ix := 0; ix < tt.size.X; ix++ {
+					if got, want := color.NRGBAModel.Convert(decoded.At(ix, iy)), img.NRGBAAt(ix, iy); got != want {
+						t.Fatalf("Pixel at %v = %v, want %v", image.Point{ix, iy}, got, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+
+	"github.com/Dadido3/configdb"
+)
+
+// Records a game, together with all services that are configured for it.
+//
+// The settings are read from the configuration, and applied when they change:
+//
+//	.recorder.<game>   Format, compression and rectangles of the recording, see canvasRecorderSettings
+//	.snapshots.<game>  See canvasSnapshotterSettings
+//	.streams.<game>    See canvasStreamerSettings
+//	.mqtt.<game>       See canvasMQTTSettings
+type gameRecorder struct {
+	Config *configdb.Config
+
+	DiskWriter  canvasRecorder
+	Snapshotter *canvasSnapshotter
+	Streamer    *canvasStreamer
+	MQTT        *canvasMQTTPublisher
+
+	callbackIDs []int
+}
+
+// Starts recording the canvas of the given connection.
+// The format and compression of the recording are only read once, changes apply to the next recording.
+func newGameRecorder(c *configdb.Config, con connection, can *canvas) (*gameRecorder, error) {
+	shortName := con.getShortName()
+	gr := &gameRecorder{
+		Config: c,
+	}
+
+	settings := canvasRecorderSettings{}
+	c.Get(".recorder."+shortName, &settings)
+	var err error
+	if gr.DiskWriter, err = can.newCanvasRecorder(shortName, settings); err != nil {
+		return nil, err
+	}
+	if gr.Snapshotter, err = can.newCanvasSnapshotter(shortName); err != nil {
+		gr.Close()
+		return nil, err
+	}
+	if gr.Streamer, err = can.newCanvasStreamer(shortName); err != nil {
+		gr.Close()
+		return nil, err
+	}
+	if gr.MQTT, err = can.newCanvasMQTTPublisher(shortName); err != nil {
+		gr.Close()
+		return nil, err
+	}
+
+	gr.callbackIDs = append(gr.callbackIDs, c.RegisterCallback([]string{".recorder." + shortName + ".rects"}, func(c *configdb.Config, modified, added, removed []string) {
+		rects := []image.Rectangle{}
+		c.Get(".recorder."+shortName+".rects", &rects)
+		gr.DiskWriter.setListeningRects(rects)
+	}))
+
+	gr.callbackIDs = append(gr.callbackIDs, c.RegisterCallback([]string{".snapshots." + shortName}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := canvasSnapshotterSettings{}
+		c.Get(".snapshots."+shortName, &settings)
+		gr.Snapshotter.setSettings(settings)
+	}))
+
+	gr.callbackIDs = append(gr.callbackIDs, c.RegisterCallback([]string{".streams." + shortName}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := canvasStreamerSettings{}
+		c.Get(".streams."+shortName, &settings)
+		gr.Streamer.setSettings(settings)
+	}))
+
+	gr.callbackIDs = append(gr.callbackIDs, c.RegisterCallback([]string{".mqtt." + shortName}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := canvasMQTTSettings{}
+		c.Get(".mqtt."+shortName, &settings)
+		gr.MQTT.setSettings(settings)
+	}))
+
+	return gr, nil
+}
+
+// Stops the recording and all services.
+//
+// Don't call this from a configuration callback, as it unregisters callbacks.
+func (gr *gameRecorder) Close() {
+	for _, id := range gr.callbackIDs {
+		gr.Config.UnregisterCallback(id)
+	}
+	gr.callbackIDs = nil
+
+	if gr.DiskWriter != nil {
+		gr.DiskWriter.Close()
+	}
+	if gr.Snapshotter != nil {
+		gr.Snapshotter.Close()
+	}
+	if gr.Streamer != nil {
+		gr.Streamer.Close()
+	}
+	if gr.MQTT != nil {
+		gr.MQTT.Close()
+	}
+}
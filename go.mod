@@ -1,17 +1,29 @@
 module github.com/Dadido3/D3pixelbot
 
+go 1.18
+
 require (
 	github.com/Dadido3/configdb v0.0.0-20190724144630-1ca3555db4ea
 	github.com/Dadido3/go-sciter v0.5.1-0.20190716095535-3e0efbbf0617
 	github.com/GeertJohan/go.rice v1.0.0
 	github.com/coreos/go-semver v0.2.0
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gorilla/websocket v1.4.0
-	github.com/klauspost/compress v1.5.0 // indirect
-	github.com/klauspost/cpuid v1.2.1 // indirect
 	github.com/klauspost/pgzip v1.2.1
 	github.com/mattn/go-colorable v0.1.2
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	github.com/sirupsen/logrus v1.4.2
 	golang.org/x/image v0.0.0-20190523035834-f03afa92d3ff
-	gopkg.in/yaml.v2 v2.2.2 // indirect
+)
+
+require (
+	github.com/daaku/go.zipexe v1.0.0 // indirect
+	github.com/google/go-cmp v0.3.0 // indirect
+	github.com/klauspost/compress v1.5.0 // indirect
+	github.com/klauspost/cpuid v1.2.1 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/lxn/win v0.0.0-20190618153233-9c04a4e8d0b8 // indirect
+	github.com/mattn/go-isatty v0.0.8 // indirect
+	golang.org/x/sys v0.0.0-20190712062909-fae7ac547cb7 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20190709130402-674ba3eaed22 // indirect
 )
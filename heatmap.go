@@ -0,0 +1,188 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Color gradient that maps normalized activity (0 to 1) to colors.
+// The stops are evenly distributed across the range.
+type heatmapRamp []color.NRGBA
+
+var heatmapRamps = map[string]heatmapRamp{
+	"heat":      {{0, 0, 0, 255}, {255, 0, 0, 255}, {255, 255, 0, 255}, {255, 255, 255, 255}},
+	"grayscale": {{0, 0, 0, 255}, {255, 255, 255, 255}},
+	"coolwarm":  {{59, 76, 192, 255}, {221, 221, 221, 255}, {180, 4, 38, 255}},
+	"viridis":   {{68, 1, 84, 255}, {59, 82, 139, 255}, {33, 145, 140, 255}, {94, 201, 98, 255}, {253, 231, 37, 255}},
+}
+
+// Returns a color ramp from its name, or from a comma separated list of hex colors like "#000000,#ff0000,#ffffff"
+func parseHeatmapRamp(s string) (heatmapRamp, error) {
+	if s == "" {
+		return heatmapRamps["heat"], nil
+	}
+	if ramp, ok := heatmapRamps[strings.ToLower(s)]; ok {
+		return ramp, nil
+	}
+
+	ramp := heatmapRamp{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimPrefix(strings.TrimSpace(part), "#")
+		if len(part) != 6 && len(part) != 8 {
+			return nil, fmt.Errorf("Invalid color %q in color ramp", part)
+		}
+		if len(part) == 6 {
+			part += "ff"
+		}
+		v, err := strconv.ParseUint(part, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid color %q in color ramp: %v", part, err)
+		}
+		ramp = append(ramp, color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)})
+	}
+	if len(ramp) < 2 {
+		return nil, fmt.Errorf("Color ramp %q needs at least two colors", s)
+	}
+
+	return ramp, nil
+}
+
+// Returns the interpolated color at v, which is clamped to the range of 0 to 1
+func (ramp heatmapRamp) at(v float64) color.NRGBA {
+	v = math.Max(0, math.Min(1, v)) * float64(len(ramp)-1)
+	i := int(v)
+	if i >= len(ramp)-1 {
+		return ramp[len(ramp)-1]
+	}
+	f := v - float64(i)
+	a, b := ramp[i], ramp[i+1]
+	lerp := func(a, b uint8) uint8 { return uint8(math.Round(float64(a) + (float64(b)-float64(a))*f)) }
+	return color.NRGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), lerp(a.A, b.A)}
+}
+
+// Counts pixel changes per pixel inside of a rectangle.
+//
+// It can be fed with events from a recording, or it can be subscribed to a live canvas.
+type heatmapAccumulator struct {
+	sync.RWMutex
+
+	Rect   image.Rectangle
+	Counts []uint32 // Number of changes per pixel, in rows from top to bottom
+}
+
+func newHeatmapAccumulator(rect image.Rectangle) *heatmapAccumulator {
+	rect = rect.Canon()
+	return &heatmapAccumulator{
+		Rect:   rect,
+		Counts: make([]uint32, rect.Dx()*rect.Dy()),
+	}
+}
+
+// Counts a change at the given position, if it is inside the rectangle
+func (ha *heatmapAccumulator) add(pos image.Point) {
+	if !pos.In(ha.Rect) {
+		return
+	}
+
+	ha.Lock()
+	defer ha.Unlock()
+
+	ha.Counts[(pos.Y-ha.Rect.Min.Y)*ha.Rect.Dx()+(pos.X-ha.Rect.Min.X)]++
+}
+
+// Resets all counts to zero
+func (ha *heatmapAccumulator) reset() {
+	ha.Lock()
+	defer ha.Unlock()
+
+	for i := range ha.Counts {
+		ha.Counts[i] = 0
+	}
+}
+
+// Renders the counts with the given color ramp.
+//
+// The counts are scaled logarithmically, relative to the highest count.
+// Pixels without any changes are transparent.
+func (ha *heatmapAccumulator) image(ramp heatmapRamp) *image.NRGBA {
+	ha.RLock()
+	defer ha.RUnlock()
+
+	var max uint32
+	for _, count := range ha.Counts {
+		if max < count {
+			max = count
+		}
+	}
+
+	img := image.NewNRGBA(ha.Rect)
+	logMax := math.Log1p(float64(max))
+	for i, count := range ha.Counts {
+		if count == 0 {
+			continue
+		}
+		v := 1.0
+		if logMax > 0 {
+			v = math.Log1p(float64(count)) / logMax
+		}
+		col := ramp.at(v)
+		img.Pix[i*4+0], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = col.R, col.G, col.B, col.A
+	}
+
+	return img
+}
+
+func (ha *heatmapAccumulator) handleSetPixel(pos image.Point, color color.Color, vcID int) error {
+	ha.add(pos)
+	return nil
+}
+
+func (ha *heatmapAccumulator) handleInvalidateAll() error {
+	return nil
+}
+
+func (ha *heatmapAccumulator) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (ha *heatmapAccumulator) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (ha *heatmapAccumulator) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+
+func (ha *heatmapAccumulator) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (ha *heatmapAccumulator) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (ha *heatmapAccumulator) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
@@ -0,0 +1,89 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func Test_parseHeatmapRamp(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    heatmapRamp
+		wantErr bool
+	}{
+		{"", heatmapRamps["heat"], false},
+		{"Grayscale", heatmapRamps["grayscale"], false},
+		{"#000000,#FF800040", heatmapRamp{{0, 0, 0, 255}, {255, 128, 0, 64}}, false},
+		{"#000000", nil, true},
+		{"#00000,#ffffff", nil, true},
+		{"unknown", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseHeatmapRamp(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseHeatmapRamp(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseHeatmapRamp(%q) = %v, want %v", tt.s, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseHeatmapRamp(%q) = %v, want %v", tt.s, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func Test_heatmapAccumulator(t *testing.T) {
+	ha := newHeatmapAccumulator(image.Rect(0, 0, 4, 4))
+	for i := 0; i < 9; i++ {
+		ha.add(image.Point{1, 1})
+	}
+	ha.add(image.Point{2, 3})
+	ha.add(image.Point{10, 10}) // Outside
+
+	img := ha.image(heatmapRamps["grayscale"])
+	if got, want := img.NRGBAAt(1, 1), (color.NRGBA{255, 255, 255, 255}); got != want {
+		t.Errorf("Pixel with the most changes = %v, want %v", got, want)
+	}
+	if got, want := img.NRGBAAt(2, 3), (color.NRGBA{77, 77, 77, 255}); got != want {
+		t.Errorf("Pixel with one change = %v, want %v", got, want)
+	}
+	if got := img.NRGBAAt(0, 0); got.A != 0 {
+		t.Errorf("Pixel without changes = %v, want transparent", got)
+	}
+}
+
+func Test_accumulateHeatmap(t *testing.T) {
+	rect, pos, _ := writeTestRecording(t, "Test-Heatmap")
+
+	opts := exportOptions{Rect: rect}
+	ha, err := accumulateHeatmap("Test-Heatmap", &opts)
+	if err != nil {
+		t.Fatalf("Can't accumulate heatmap: %v", err)
+	}
+
+	if got := ha.Counts[pos.Y*rect.Dx()+pos.X]; got != 1 {
+		t.Errorf("Changes at %v = %v, want 1", pos, got)
+	}
+}
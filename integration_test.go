@@ -0,0 +1,196 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connects to the mock game server, records the canvas and reads the recording back
+func Test_integrationRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-test-integration")
+	if err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer setPathSettings(getPaths())
+	settings := getPaths()
+	settings.Recordings = dir
+	setPathSettings(settings)
+
+	m, restore := useMockGameServer()
+	defer restore()
+
+	// Spans several bigchunks and negative coordinates
+	rect := image.Rect(-500, -500, 100, 100)
+	m.setPixel(image.Point{-500, -500}, 3)
+	m.setPixel(image.Point{-1, -1}, 5)
+	m.setPixel(image.Point{99, 99}, 15)
+
+	initial, final, liveTime := recordMockGame(t, m, rect)
+
+	cfe, err := newCanvasFrameExtractor("pixelcanvasio")
+	if err != nil {
+		t.Fatalf("Can't create frame extractor: %v", err)
+	}
+	defer cfe.Close()
+
+	_, endTime := cfe.getTimeRange()
+	for _, tt := range []struct {
+		t    time.Time
+		want image.Image
+	}{
+		{liveTime, initial},
+		{endTime.Add(-time.Nanosecond), final},
+	} {
+		img, err := cfe.getFrame(tt.t, rect)
+		if err != nil {
+			t.Fatalf("Can't get frame at %v: %v", tt.t, err)
+		}
+		if p, differs := firstDifference(img, tt.want); differs {
+			t.Errorf("Recorded frame at %v differs at %v: %v, want %v", tt.t, p, img.At(p.X, p.Y), tt.want.At(p.X, p.Y))
+		}
+	}
+}
+
+// Records the given rectangle of the mock game server while it changes some pixels.
+// Returns the state of the canvas before and after the changes, and a point in time between them.
+func recordMockGame(t *testing.T, m *mockGameServer, rect image.Rectangle) (initial, final image.Image, liveTime time.Time) {
+	con, can := newPixelcanvasio()
+	defer con.Close()
+
+	cdw, err := can.newCanvasDiskWriter("pixelcanvasio", 0)
+	if err != nil {
+		t.Fatalf("Can't create canvas disk writer: %v", err)
+	}
+	defer cdw.Close()
+	if err := cdw.setListeningRects([]image.Rectangle{rect}); err != nil {
+		t.Fatalf("Can't set listening rectangle: %v", err)
+	}
+
+	waitFor(t, 10*time.Second, "the websocket connection", func() bool { return m.getConnections() == 1 })
+	waitFor(t, 10*time.Second, "the download of the canvas", func() bool { return can.isValid(rect) })
+
+	initial = m.getImage(rect)
+	img, err := can.getImageCopy(rect, true, false)
+	if err != nil {
+		t.Fatalf("Can't get image at %v: %v", rect, err)
+	}
+	if p, differs := firstDifference(img, initial); differs {
+		t.Fatalf("Downloaded canvas differs at %v: %v, want %v", p, img.At(p.X, p.Y), initial.At(p.X, p.Y))
+	}
+
+	// Pixel changes over the websocket
+	time.Sleep(10 * time.Millisecond)
+	liveTime = can.Clock.now() // Recordings are timed by the clock of the game server
+	time.Sleep(10 * time.Millisecond)
+	m.setPixel(image.Point{-1, -1}, 0)
+	m.setPixel(image.Point{-64, 63}, 8)
+	m.setPixel(image.Point{-449, 0}, 12)
+	m.setPixel(image.Point{0, -449}, 13)
+
+	final = m.getImage(rect)
+	waitFor(t, 10*time.Second, "the pixel changes", func() bool {
+		img, err := can.getImageCopy(rect, true, false)
+		if err != nil {
+			return false
+		}
+		_, differs := firstDifference(img, final)
+		return !differs
+	})
+
+	return initial, final, liveTime
+}
+
+// Checks that the connection reconnects, and downloads changes it missed while it was disconnected
+func Test_integrationReconnect(t *testing.T) {
+	m, restore := useMockGameServer()
+	defer restore()
+
+	con, can := newPixelcanvasio()
+	defer con.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	listener := &testNullListener{}
+	can.subscribeListener(listener, false)
+	defer can.unsubscribeListener(listener)
+	if err := can.registerRects(listener, []image.Rectangle{rect}); err != nil {
+		t.Fatalf("Can't register rectangle: %v", err)
+	}
+
+	waitFor(t, 10*time.Second, "the websocket connection", func() bool { return m.getConnections() == 1 })
+	waitFor(t, 10*time.Second, "the download of the canvas", func() bool { return can.isValid(rect) })
+
+	m.disconnect()
+	waitFor(t, 10*time.Second, "the disconnect", func() bool { return m.getConnections() == 0 })
+	m.setPixel(image.Point{10, 10}, 5) // Not broadcast, as nobody is connected
+	bigchunks := m.getBigchunks()
+
+	waitFor(t, 20*time.Second, "the reconnect", func() bool { return m.getConnections() == 1 })
+	waitFor(t, 10*time.Second, "the download after the reconnect", func() bool {
+		return m.getBigchunks() > bigchunks && can.isValid(rect)
+	})
+
+	img, err := can.getImageCopy(rect, true, false)
+	if err != nil {
+		t.Fatalf("Can't get image at %v: %v", rect, err)
+	}
+	if want := m.getImage(rect); img.At(10, 10) != want.At(10, 10) {
+		t.Errorf("Pixel missed while disconnected = %v, want %v", img.At(10, 10), want.At(10, 10))
+	}
+}
+
+// Checks that failed downloads are tracked, instead of leaving the chunks in the downloading state
+func Test_integrationDownloadFailure(t *testing.T) {
+	m, restore := useMockGameServer()
+	defer restore()
+	m.setUnhealthy(true)
+
+	con, can := newPixelcanvasio()
+	defer con.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	listener := &testNullListener{}
+	can.subscribeListener(listener, false)
+	defer can.unsubscribeListener(listener)
+	if err := can.registerRects(listener, []image.Rectangle{rect}); err != nil {
+		t.Fatalf("Can't register rectangle: %v", err)
+	}
+
+	waitFor(t, 10*time.Second, "the failed download", func() bool {
+		for _, failure := range can.getDownloadFailures() {
+			if failure.Rect.Overlaps(rect) && strings.Contains(failure.Reason, "503") {
+				return true
+			}
+		}
+		return false
+	})
+
+	chu, err := can.getChunk(can.ChunkSize.getChunkCoord(rect.Min, can.Origin), false)
+	if err != nil {
+		t.Fatalf("Can't get chunk: %v", err)
+	}
+	if state := chu.getQueryState(false, 0); state != chunkKeep {
+		t.Errorf("Failed chunk got state %v during the backoff, want %v", state, chunkKeep)
+	}
+}
@@ -0,0 +1,250 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"sync"
+	"time"
+)
+
+var latencyLog = moduleLog("latency")
+
+// Placements that didn't come back through the game within this time are counted as lost
+const latencyProbeTimeout = time.Minute
+
+// Number of the latest latencies that the report is computed from
+const latencyProbeHistory = 1000
+
+// A pixel that was placed, and that is waited for to come back from the game
+type latencyPlacement struct {
+	Pos    image.Point
+	Color  color.NRGBA
+	Placed time.Time // Local time of the placement
+}
+
+// Latencies between placing pixels and getting them back from the game, returned by the latency method of the control socket.
+// The durations are in seconds, and are 0 if nothing was confirmed yet
+type latencyReport struct {
+	Game      string
+	Pending   int // Placements that are still waited for
+	Confirmed int // Placements that came back
+	Lost      int // Placements that didn't come back within latencyProbeTimeout
+	Samples   int // Number of latencies the durations below are computed from, at most latencyProbeHistory
+	Min       float64
+	Mean      float64
+	Median    float64
+	P90       float64
+	Max       float64
+	Last      time.Time `json:",omitempty"` // Time when the last placement came back
+}
+
+// Measures the time from placing a pixel until it comes back through the event stream of the game and is set on the canvas.
+//
+// Placements are announced by whatever placed them, e.g. an external bot, see announce.
+// The pixels of pending placements are registered at the canvas, so their chunks are kept up to date.
+type latencyProbe struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Canvas    *canvas
+	ShortName string
+
+	sync.Mutex
+	pending   []latencyPlacement // Oldest first
+	samples   []time.Duration    // Latest latencies, oldest first
+	confirmed int
+	lost      int
+	last      time.Time
+}
+
+func (can *canvas) newLatencyProbe(shortName string) (*latencyProbe, error) {
+	lp := &latencyProbe{
+		Canvas:    can,
+		ShortName: shortName,
+	}
+
+	if err := can.subscribeListenerFiltered(lp, false, canvasEventMaskPixels); err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// Adds a placement that is waited for. If placed is zero, the current time is used.
+// Announce a placement right before the pixel is placed, so that its chunk is already kept up to date when the pixel comes back
+func (lp *latencyProbe) announce(pos image.Point, col color.Color, placed time.Time) error {
+	lp.ClosedMutex.RLock()
+	defer lp.ClosedMutex.RUnlock()
+	if lp.Closed {
+		return fmt.Errorf("Latency probe is closed")
+	}
+
+	if placed.IsZero() {
+		placed = time.Now()
+	}
+
+	lp.Lock()
+	lp.expire(time.Now())
+	lp.pending = append(lp.pending, latencyPlacement{Pos: pos, Color: color.NRGBAModel.Convert(col).(color.NRGBA), Placed: placed})
+	rects := lp.pendingRects()
+	lp.Unlock()
+
+	return lp.Canvas.registerRects(lp, rects)
+}
+
+// Returns the rectangles of the pending placements. The lock must be held
+func (lp *latencyProbe) pendingRects() []image.Rectangle {
+	rects, known := []image.Rectangle{}, map[image.Point]bool{}
+	for _, placement := range lp.pending {
+		if !known[placement.Pos] {
+			known[placement.Pos] = true
+			rects = append(rects, image.Rectangle{placement.Pos, placement.Pos.Add(image.Point{1, 1})})
+		}
+	}
+	return rects
+}
+
+// Counts the placements that are older than latencyProbeTimeout as lost. The lock must be held
+func (lp *latencyProbe) expire(now time.Time) {
+	cut := 0
+	for cut < len(lp.pending) && now.Sub(lp.pending[cut].Placed) > latencyProbeTimeout {
+		latencyLog.Warnf("Pixel %v of %v didn't come back within %v", lp.pending[cut].Pos, lp.ShortName, latencyProbeTimeout)
+		cut++
+	}
+	lp.pending = append(lp.pending[:0], lp.pending[cut:]...)
+	lp.lost += cut
+}
+
+// Confirms the oldest pending placement of the pixel with the same color. The lock must be held
+func (lp *latencyProbe) confirm(pos image.Point, col color.Color, now time.Time) {
+	nrgba := color.NRGBAModel.Convert(col).(color.NRGBA)
+	for i, placement := range lp.pending {
+		if placement.Pos != pos || placement.Color != nrgba {
+			continue
+		}
+		latency := now.Sub(placement.Placed)
+		latencyLog.Debugf("Pixel %v of %v came back after %v", pos, lp.ShortName, latency)
+
+		lp.pending = append(lp.pending[:i], lp.pending[i+1:]...)
+		lp.samples = append(lp.samples, latency)
+		if len(lp.samples) > latencyProbeHistory {
+			lp.samples = lp.samples[len(lp.samples)-latencyProbeHistory:]
+		}
+		lp.confirmed++
+		lp.last = now
+		return
+	}
+}
+
+// Returns the current statistics of the latencies
+func (lp *latencyProbe) report() latencyReport {
+	lp.Lock()
+	defer lp.Unlock()
+
+	lp.expire(time.Now())
+
+	report := latencyReport{
+		Game:      lp.ShortName,
+		Pending:   len(lp.pending),
+		Confirmed: lp.confirmed,
+		Lost:      lp.lost,
+		Samples:   len(lp.samples),
+		Last:      lp.last,
+	}
+	if len(lp.samples) == 0 {
+		return report
+	}
+
+	sorted := append([]time.Duration{}, lp.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, latency := range sorted {
+		sum += latency
+	}
+	report.Min = sorted[0].Seconds()
+	report.Mean = (sum / time.Duration(len(sorted))).Seconds()
+	report.Median = sorted[len(sorted)/2].Seconds()
+	report.P90 = sorted[len(sorted)*9/10].Seconds()
+	report.Max = sorted[len(sorted)-1].Seconds()
+
+	return report
+}
+
+func (lp *latencyProbe) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	lp.Lock()
+	lp.confirm(pos, col, time.Now())
+	lp.Unlock()
+	return nil
+}
+
+func (lp *latencyProbe) handleSetPixels(pixels []canvasListenerPixel) error {
+	lp.Lock()
+	now := time.Now()
+	for _, pixel := range pixels {
+		if len(lp.pending) == 0 {
+			break
+		}
+		lp.confirm(pixel.Pos, pixel.Color, now)
+	}
+	lp.Unlock()
+	return nil
+}
+
+func (lp *latencyProbe) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (lp *latencyProbe) handleInvalidateAll() error {
+	return nil
+}
+
+func (lp *latencyProbe) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (lp *latencyProbe) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+
+func (lp *latencyProbe) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (lp *latencyProbe) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (lp *latencyProbe) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Stops waiting for placements
+func (lp *latencyProbe) Close() {
+	lp.ClosedMutex.Lock()
+	if lp.Closed {
+		lp.ClosedMutex.Unlock()
+		return
+	}
+	lp.Closed = true
+	lp.ClosedMutex.Unlock()
+
+	lp.Canvas.unsubscribeListener(lp)
+}
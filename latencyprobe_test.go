@@ -0,0 +1,81 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func Test_latencyProbeReport(t *testing.T) {
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	red, black := pixelcanvasioPalette[5], pixelcanvasioPalette[3]
+	nrgba := color.NRGBAModel.Convert(red).(color.NRGBA)
+	lp := &latencyProbe{ShortName: "Test-latency"}
+
+	for i := 0; i < 10; i++ {
+		lp.pending = append(lp.pending, latencyPlacement{Pos: image.Point{i, 0}, Color: nrgba, Placed: start})
+	}
+	lp.pending = append(lp.pending, latencyPlacement{Pos: image.Point{0, 1}, Color: nrgba, Placed: start})
+
+	lp.confirm(image.Point{0, 1}, black, start.Add(time.Second)) // Other color, not confirmed
+	for i := 0; i < 10; i++ {
+		lp.confirm(image.Point{i, 0}, red, start.Add(time.Duration(i+1)*100*time.Millisecond))
+	}
+	lp.expire(start.Add(2 * latencyProbeTimeout))
+
+	report := lp.report()
+	if report.Pending != 0 || report.Confirmed != 10 || report.Lost != 1 || report.Samples != 10 {
+		t.Errorf("Got report %+v, want 10 confirmed and 1 lost placements", report)
+	}
+	if report.Min != 0.1 || report.Max != 1 || report.Median != 0.6 || report.P90 != 1 {
+		t.Errorf("Got latencies %v, %v, %v, %v, want 0.1, 1, 0.6 and 1 seconds", report.Min, report.Max, report.Median, report.P90)
+	}
+}
+
+func Test_latencyProbe(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	lp, err := can.newLatencyProbe("Test-latency")
+	if err != nil {
+		t.Fatalf("Can't create latency probe: %v", err)
+	}
+	defer lp.Close()
+
+	if err := lp.announce(image.Point{1, 2}, pixelcanvasioPalette[5], time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Can't announce placement: %v", err)
+	}
+	can.setPixel(image.Point{1, 2}, pixelcanvasioPalette[3]) // Someone else
+	can.setPixel(image.Point{1, 2}, pixelcanvasioPalette[5])
+
+	waitFor(t, 5*time.Second, "the placement to come back", func() bool { return lp.report().Confirmed == 1 })
+	if report := lp.report(); report.Pending != 0 || report.Min < 1 {
+		t.Errorf("Got report %+v, want no pending placements and a latency of at least a second", report)
+	}
+
+	lp.Close()
+	if err := lp.announce(image.Point{1, 2}, pixelcanvasioPalette[5], time.Time{}); err == nil {
+		t.Errorf("Closed probe accepts placements")
+	}
+}
@@ -0,0 +1,204 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Settings of the load generator, stored in the configuration at .load
+type connectionLoadSettings struct {
+	PixelRate int // Pixels per second that are set on random positions of downloaded chunks
+	ChunkRate int // Chunks per second that are invalidated and downloaded again
+}
+
+var defaultLoadSettings = connectionLoadSettings{
+	PixelRate: 1000,
+	ChunkRate: 10,
+}
+
+// Interval of the load generator, in which the events of the rates are produced in bursts
+const connectionLoadInterval = 10 * time.Millisecond
+
+// Synthetic game that produces canvas events at configurable rates, to measure the performance of the canvas pipeline and its listeners.
+//
+// Chunks are "downloaded" instantly with random content, pixels are only set on downloaded chunks.
+// It can be recorded or exported like any other game, e.g. "D3pixelbot record load -rect 0,0,1024,1024".
+type connectionLoad struct {
+	Settings connectionLoadSettings
+
+	Canvas     *canvas
+	Statistics *canvasStatistics // Counts the activity, independent of recordings
+	Watcher    *canvasWatcher    // Alerts on activity in watched regions, independent of bots
+	Heatmap    *canvasHeatmap    // Counts the changes per pixel or chunk in a sliding window, independent of recordings
+
+	GoroutineQuit     chan struct{} // Closing this channel stops the goroutines
+	QuitWaitgroup     sync.WaitGroup
+	ChunkDownloadChan <-chan *chunk // Receives download requests from the canvas
+}
+
+func init() {
+	connectionTypes["load"] = connectionType{
+		Name:        "Synthetic load",
+		FunctionNew: newLoad,
+	}
+}
+
+var loadSingleton = &refCountingSingleton{}
+
+func newLoad() (connection, *canvas) {
+	settings := connectionLoadSettings{}
+	if !configGet(conf, ".load", &settings) {
+		settings = defaultLoadSettings
+	}
+
+	con := loadSingleton.get(func() interface{} { return newConnectionLoad(settings) }).(*connectionLoad)
+
+	return con, con.Canvas
+}
+
+func (s connectionLoadSettings) validate() error {
+	if s.PixelRate < 0 || s.ChunkRate < 0 {
+		return fmt.Errorf("Rates must not be negative")
+	}
+	return nil
+}
+
+func newConnectionLoad(settings connectionLoadSettings) *connectionLoad {
+	con := &connectionLoad{
+		Settings:      settings,
+		GoroutineQuit: make(chan struct{}),
+	}
+
+	con.Canvas, con.ChunkDownloadChan = newCanvas(pixelSize{64, 64}, image.Point{}, image.Rect(-1<<16, -1<<16, 1<<16, 1<<16))
+	con.Statistics, _ = con.Canvas.newCanvasStatistics(conf, con.getShortName())
+	con.Watcher, _ = con.Canvas.newCanvasWatcher(conf, con.getShortName())
+	con.Heatmap, _ = con.Canvas.newCanvasHeatmap(conf, con.getShortName())
+	registerConnection(con, con.Canvas)
+	con.Canvas.Palette.setPalette(pixelcanvasioPalette)
+
+	con.QuitWaitgroup.Add(1)
+	go func() {
+		defer con.QuitWaitgroup.Done()
+
+		ticker := time.NewTicker(connectionLoadInterval)
+		defer ticker.Stop()
+
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		chunks := []image.Rectangle{} // Rectangles of downloaded chunks. Only used in this goroutine
+		known := map[image.Rectangle]struct{}{}
+		var pixelDebt, chunkDebt float64 // Events that are due, including fractions of events
+
+		// Sets random content on the chunk, returns false if the chunk doesn't exist anymore
+		download := func(rect image.Rectangle) bool {
+			con.Canvas.signalDownload(rect)
+			img := image.NewPaletted(rect, pixelcanvasioPalette)
+			rng.Read(img.Pix)
+			for i := range img.Pix {
+				img.Pix[i] %= uint8(len(pixelcanvasioPalette))
+			}
+			if err := con.Canvas.setImage(img, false, false); err != nil {
+				return false
+			}
+			if _, ok := known[rect]; !ok {
+				known[rect] = struct{}{}
+				chunks = append(chunks, rect)
+			}
+			return true
+		}
+
+		for {
+			select {
+			case <-con.GoroutineQuit:
+				return
+			case chu := <-con.ChunkDownloadChan:
+				if chu.getQueryState(false, 0) == chunkDownload {
+					download(chu.Rect)
+				}
+			case <-ticker.C:
+				if len(chunks) == 0 {
+					pixelDebt, chunkDebt = 0, 0
+					break
+				}
+
+				pixelDebt += float64(con.Settings.PixelRate) * connectionLoadInterval.Seconds()
+				for ; pixelDebt >= 1; pixelDebt-- {
+					rect := chunks[rng.Intn(len(chunks))]
+					pos := image.Point{rect.Min.X + rng.Intn(rect.Dx()), rect.Min.Y + rng.Intn(rect.Dy())}
+					con.Canvas.setPixel(pos, pixelcanvasioPalette[rng.Intn(len(pixelcanvasioPalette))])
+				}
+
+				chunkDebt += float64(con.Settings.ChunkRate) * connectionLoadInterval.Seconds()
+				for ; chunkDebt >= 1 && len(chunks) > 0; chunkDebt-- {
+					i := rng.Intn(len(chunks))
+					rect := chunks[i]
+					con.Canvas.invalidateRect(rect)
+					if !download(rect) {
+						// Forget deleted chunks
+						chunks[i] = chunks[len(chunks)-1]
+						chunks = chunks[:len(chunks)-1]
+						delete(known, rect)
+					}
+				}
+			}
+		}
+	}()
+
+	return con
+}
+
+func (con *connectionLoad) getShortName() string {
+	return "load"
+}
+
+func (con *connectionLoad) getName() string {
+	return fmt.Sprintf("Synthetic load with %v pixels and %v chunks per second", con.Settings.PixelRate, con.Settings.ChunkRate)
+}
+
+func (con *connectionLoad) getOnlinePlayers() int {
+	return 0
+}
+
+// Closes connection and canvas
+func (con *connectionLoad) Close() {
+	if loadSingleton.release(con) {
+		con.close()
+	}
+}
+
+// Stops the goroutine, and closes the canvas
+func (con *connectionLoad) close() {
+	close(con.GoroutineQuit)
+
+	con.QuitWaitgroup.Wait()
+
+	unregisterConnection(con)
+	if con.Statistics != nil {
+		con.Statistics.Close()
+	}
+	if con.Watcher != nil {
+		con.Watcher.Close()
+	}
+	if con.Heatmap != nil {
+		con.Heatmap.Close()
+	}
+	con.Canvas.Close()
+}
@@ -0,0 +1,62 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+func Test_connectionLoad(t *testing.T) {
+	con := newConnectionLoad(connectionLoadSettings{PixelRate: 10000})
+	defer con.close()
+
+	l := &testChunkListener{chunks: map[image.Rectangle]int{}, pixelVCID: map[image.Point]int{}}
+	con.Canvas.subscribeListener(l, true)
+	defer con.Canvas.unsubscribeListener(l)
+
+	rect := image.Rect(0, 0, 128, 128)
+	con.Canvas.registerRects(l, []image.Rectangle{rect})
+
+	// The chunks are downloaded, and pixels are set on them
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.Lock()
+		pixels := len(l.pixelVCID)
+		l.Unlock()
+		if pixels >= 100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Listener got %v pixels, want at least 100", pixels)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !con.Canvas.isValid(rect) {
+		t.Errorf("Rectangle %v isn't valid", rect)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	for pos := range l.pixelVCID {
+		if !pos.In(rect) {
+			t.Errorf("Pixel %v is outside of the downloaded chunks %v", pos, rect)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Returns a logger that adds the name of the module to every entry, so log files can be filtered by it.
+func moduleLog(module string) *logrus.Entry {
+	return log.WithField("module", module)
+}
+
+func logCallerPrettyfier(f *runtime.Frame) (string, string) {
+	//return fmt.Sprintf("%s()", f.Function), fmt.Sprintf("%s:%d", filepath.Base(f.File), f.Line)
+	return fmt.Sprintf("%s()", f.Function), ""
+}
+
+// Formats of the log files, see logSettings.Format
+var logFormatters = map[string]logrus.Formatter{
+	"text": &logrus.TextFormatter{DisableColors: true, FullTimestamp: true, CallerPrettyfier: logCallerPrettyfier},
+	"json": &logrus.JSONFormatter{CallerPrettyfier: logCallerPrettyfier},
+}
+
+// Hook that writes all log entries into files in a directory.
+// A new file is started once the current one reaches its size limit, and the oldest files are deleted.
+type logFile struct {
+	sync.Mutex
+	directory string
+	settings  logSettings
+
+	file *os.File
+	size int64 // Size of file in bytes
+}
+
+func newLogFile(directory string) *logFile {
+	return &logFile{
+		directory: directory,
+		settings:  defaultLogSettings,
+	}
+}
+
+// Changes format and limits, they apply to the next entry
+func (lf *logFile) setSettings(s logSettings) {
+	lf.Lock()
+	defer lf.Unlock()
+
+	lf.settings = s
+}
+
+func (lf *logFile) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Writes the entry into the current file. This is called by logrus, don't log anything here
+func (lf *logFile) Fire(entry *logrus.Entry) error {
+	lf.Lock()
+	defer lf.Unlock()
+
+	b, err := logFormatters[lf.settings.Format].Format(entry)
+	if err != nil {
+		return err
+	}
+
+	maxSize := int64(lf.settings.MaxSize) << 20
+	if lf.file == nil || (maxSize > 0 && lf.size > 0 && lf.size+int64(len(b)) > maxSize) {
+		if err := lf.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := lf.file.Write(b)
+	lf.size += int64(n)
+	return err
+}
+
+// Closes the current file and starts a new one. Files exceeding MaxFiles are deleted, starting with the oldest
+func (lf *logFile) rotate() error {
+	if lf.file != nil {
+		lf.file.Close()
+		lf.file = nil
+	}
+
+	if err := os.MkdirAll(lf.directory, os.ModePerm); err != nil {
+		return err
+	}
+
+	fileName := filepath.Join(lf.directory, time.Now().UTC().Format("2006-01-02T150405.000")+".log")
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("Can't open log file: %v", err)
+	}
+	lf.file, lf.size = f, 0
+	if stat, err := f.Stat(); err == nil {
+		lf.size = stat.Size()
+	}
+
+	if lf.settings.MaxFiles <= 0 {
+		return nil
+	}
+
+	infos, err := ioutil.ReadDir(lf.directory) // Sorted by name, which starts with the time
+	if err != nil {
+		return nil
+	}
+	fileNames := []string{}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".log") {
+			fileNames = append(fileNames, filepath.Join(lf.directory, info.Name()))
+		}
+	}
+	for i := 0; i < len(fileNames)-lf.settings.MaxFiles; i++ {
+		if fileNames[i] != fileName {
+			os.Remove(fileNames[i])
+		}
+	}
+
+	return nil
+}
+
+// Closes the current file, the next entry opens a new one
+func (lf *logFile) Close() {
+	lf.Lock()
+	defer lf.Unlock()
+
+	if lf.file != nil {
+		lf.file.Close()
+		lf.file = nil
+	}
+}
@@ -0,0 +1,85 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func Test_logFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-test-log")
+	if err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	lf := newLogFile(dir)
+	defer lf.Close()
+	lf.setSettings(logSettings{Level: "trace", Format: "json", MaxSize: 1, MaxFiles: 2})
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logger.AddHook(lf)
+
+	// Each entry is 400 KiB, so every third entry starts a new file
+	message := strings.Repeat("x", 400<<10)
+	for i := 0; i < 8; i++ {
+		logger.WithField("module", "test").Info(message)
+		time.Sleep(2 * time.Millisecond) // Files are named by the time in milliseconds
+	}
+	lf.Close()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatalf("Can't list log files: %v", err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("Got %v log files, want 2", len(matches))
+	}
+
+	f, err := os.Open(matches[1])
+	if err != nil {
+		t.Fatalf("Can't open log file: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	entries := 0
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Can't parse log entry: %v", err)
+		}
+		if entry["module"] != "test" || entry["msg"] != message {
+			t.Errorf("Log entry has module %v and a message of %v bytes, want test and %v bytes", entry["module"], len(entry["msg"].(string)), len(message))
+		}
+		entries++
+	}
+	if entries != 2 {
+		t.Errorf("Got %v entries in the newest file, want 2", entries)
+	}
+}
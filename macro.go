@@ -0,0 +1,266 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var macroLog = moduleLog("macro")
+
+// A recorded sequence of actions, stored as <name>.json in the macros directory.
+//
+// Every step is a call of a control socket method, so macros can be run without the user interface, and edited by hand.
+type macro struct {
+	Name  string
+	Steps []macroStep
+}
+
+// A step of a macro, see controlSocketMethods for the methods and their params
+type macroStep struct {
+	Method string
+	Params json.RawMessage `json:",omitempty"`
+	Delay  string          `json:",omitempty"` // Time since the previous step, e.g. "2.5s". Only waited for if the macro is run with delays
+}
+
+// Methods that can't be used in macros, as they would record or run macros themselves
+var macroForbiddenMethods = map[string]bool{
+	"startMacro": true,
+	"stopMacro":  true,
+	"runMacro":   true,
+}
+
+// Methods whose consecutive steps are merged while recording, with the param that names their target.
+// E.g. dragging the time slider of a replay results in a single step.
+var macroMergedMethods = map[string]string{
+	"setReplayTime": "replay",
+}
+
+// The macro that is currently recorded, there is at most one at a time
+var macroRecording = struct {
+	sync.Mutex
+	active   bool
+	macro    macro
+	lastTime time.Time
+}{}
+
+// Starts recording a new macro.
+// Actions of the user interface are added with recordMacroStep, until stopMacroRecording is called.
+func startMacroRecording(name string) error {
+	if err := validateMacroName(name); err != nil {
+		return err
+	}
+
+	macroRecording.Lock()
+	defer macroRecording.Unlock()
+
+	if macroRecording.active {
+		return fmt.Errorf("Macro %q is already recorded", macroRecording.macro.Name)
+	}
+	macroRecording.active = true
+	macroRecording.macro = macro{Name: name}
+	macroRecording.lastTime = time.Now()
+
+	macroLog.Infof("Started recording macro %q", name)
+
+	return nil
+}
+
+// Adds a step to the macro that is currently recorded, if any.
+// params is marshalled to JSON.
+func recordMacroStep(method string, params interface{}) {
+	macroRecording.Lock()
+	defer macroRecording.Unlock()
+
+	if !macroRecording.active {
+		return
+	}
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		macroLog.Errorf("Can't record step %q: %v", method, err)
+		return
+	}
+
+	steps := macroRecording.macro.Steps
+	if len(steps) > 0 && macroSameTarget(steps[len(steps)-1], method, data) {
+		steps[len(steps)-1].Params = data // Keep the delay, it's the time until the first of the merged steps
+		return
+	}
+
+	now := time.Now()
+	step := macroStep{Method: method, Params: data}
+	if delay := now.Sub(macroRecording.lastTime).Round(100 * time.Millisecond); delay > 0 {
+		step.Delay = delay.String()
+	}
+	macroRecording.lastTime = now
+	macroRecording.macro.Steps = append(steps, step)
+
+	macroLog.Debugf("Recorded step %q of macro %q", method, macroRecording.macro.Name)
+}
+
+// Returns whether a new step with the given method and params replaces the previous step, see macroMergedMethods
+func macroSameTarget(previous macroStep, method string, params json.RawMessage) bool {
+	targetParam, ok := macroMergedMethods[method]
+	if !ok || previous.Method != method {
+		return false
+	}
+
+	a, b := map[string]interface{}{}, map[string]interface{}{}
+	if json.Unmarshal(previous.Params, &a) != nil || json.Unmarshal(params, &b) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(a[targetParam], b[targetParam])
+}
+
+// Stops the recording of the current macro, and stores it in the macros directory
+func stopMacroRecording() (macro, error) {
+	macroRecording.Lock()
+	defer macroRecording.Unlock()
+
+	if !macroRecording.active {
+		return macro{}, fmt.Errorf("No macro is recorded")
+	}
+	macroRecording.active = false
+	m := macroRecording.macro
+
+	if err := saveMacro(m); err != nil {
+		return m, err
+	}
+
+	macroLog.Infof("Stored macro %q with %v steps", m.Name, len(m.Steps))
+
+	return m, nil
+}
+
+// Names are used as file names, so they must not contain any path
+func validateMacroName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\:`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("Invalid macro name %q", name)
+	}
+	return nil
+}
+
+func macroFileName(name string) string {
+	return dataPath(getPaths().Macros, name+".json")
+}
+
+// Writes the macro into the macros directory, replacing any macro with the same name
+func saveMacro(m macro) error {
+	if err := validateMacroName(m.Name); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	fileName := macroFileName(m.Name)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return fmt.Errorf("Can't create macros directory: %v", err)
+	}
+	if err := ioutil.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("Can't write macro %q: %v", m.Name, err)
+	}
+	if err := os.Rename(fileName+".tmp", fileName); err != nil {
+		return fmt.Errorf("Can't write macro %q: %v", m.Name, err)
+	}
+
+	return nil
+}
+
+// Reads a macro from the macros directory
+func loadMacro(name string) (macro, error) {
+	if err := validateMacroName(name); err != nil {
+		return macro{}, err
+	}
+
+	data, err := ioutil.ReadFile(macroFileName(name))
+	if err != nil {
+		return macro{}, fmt.Errorf("Can't read macro %q: %v", name, err)
+	}
+
+	m := macro{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return macro{}, fmt.Errorf("Can't read macro %q: %v", name, err)
+	}
+	m.Name = name // The file name wins, in case the file got renamed
+
+	return m, nil
+}
+
+// Returns the names of all stored macros, sorted
+func listMacros() []string {
+	files, _ := ioutil.ReadDir(dataPath(getPaths().Macros))
+
+	names := []string{}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(file.Name(), ".json"))
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Runs the steps of a macro one after another, and returns their results.
+// It stops at the first step that fails.
+// If delays is true, the recorded time between the steps is waited for.
+func runMacro(as *apiServer, m macro, delays bool) ([]interface{}, error) {
+	// Check everything first, so a broken macro doesn't run halfway
+	for i, step := range m.Steps {
+		if _, ok := controlSocketMethods[step.Method]; !ok || macroForbiddenMethods[step.Method] {
+			return nil, fmt.Errorf("Step %v of macro %q has invalid method %q", i+1, m.Name, step.Method)
+		}
+		if step.Delay != "" {
+			if _, err := time.ParseDuration(step.Delay); err != nil {
+				return nil, fmt.Errorf("Step %v of macro %q has invalid delay %q", i+1, m.Name, step.Delay)
+			}
+		}
+	}
+
+	macroLog.Infof("Running macro %q with %v steps", m.Name, len(m.Steps))
+
+	results := []interface{}{}
+	for i, step := range m.Steps {
+		if delays && step.Delay != "" {
+			delay, _ := time.ParseDuration(step.Delay)
+			time.Sleep(delay)
+		}
+
+		result, err := controlSocketMethods[step.Method](as, step.Params)
+		if err != nil {
+			return results, fmt.Errorf("Step %v (%v) of macro %q failed: %v", i+1, step.Method, m.Name, err)
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,115 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_macro(t *testing.T) {
+	registerAPIServerTestGame()
+	defer delete(connectionTypes, "apitest")
+
+	dir, err := ioutil.TempDir("", "D3pixelbot-Test-Macro")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer setPathSettings(getPaths())
+	settings := getPaths()
+	settings.Macros = filepath.Join(dir, "macros")
+	settings.Exports = filepath.Join(dir, "exports")
+	setPathSettings(settings)
+
+	recordMacroStep("listGames", nil) // Ignored, as nothing is recorded
+
+	if err := startMacroRecording("../escape"); err == nil {
+		t.Errorf("Recording a macro with a path as name succeeded, but it should fail")
+	}
+	if err := startMacroRecording("test"); err != nil {
+		t.Fatalf("Can't start recording macro: %v", err)
+	}
+	if err := startMacroRecording("other"); err == nil {
+		t.Errorf("Recording two macros at once succeeded, but it should fail")
+	}
+
+	fileName := filepath.Join(settings.Exports, "image.png")
+	replayTime := time.Date(2019, 6, 14, 12, 0, 0, 0, time.UTC)
+	recordMacroStep("setReplayTime", map[string]interface{}{"replay": "replay-apitest", "time": replayTime.Add(-time.Hour)})
+	recordMacroStep("setReplayTime", map[string]interface{}{"replay": "replay-apitest", "time": replayTime})
+	recordMacroStep("saveImage", map[string]interface{}{"game": "apitest", "rect": "0,0,64,64", "width": 128, "height": 128, "fileName": "image.png"})
+
+	if _, err := stopMacroRecording(); err != nil {
+		t.Fatalf("Can't stop recording macro: %v", err)
+	}
+	if _, err := stopMacroRecording(); err == nil {
+		t.Errorf("Stopping the recording twice succeeded, but it should fail")
+	}
+
+	if names := listMacros(); len(names) != 1 || names[0] != "test" {
+		t.Errorf("Got macros %v, want [test]", names)
+	}
+
+	m, err := loadMacro("test")
+	if err != nil {
+		t.Fatalf("Can't load macro: %v", err)
+	}
+	if len(m.Steps) != 2 || m.Steps[0].Method != "setReplayTime" || m.Steps[1].Method != "saveImage" {
+		t.Fatalf("Got steps %v, want the replay time steps to be merged", m.Steps)
+	}
+	params := struct {
+		Time time.Time `json:"time"`
+	}{}
+	if err := json.Unmarshal(m.Steps[0].Params, &params); err != nil || !params.Time.Equal(replayTime) {
+		t.Errorf("Got merged step %s, want the time of the last step", m.Steps[0].Params)
+	}
+
+	as := newAPIServer()
+	defer as.Close()
+
+	// The replay isn't open, so only run the image step
+	m.Steps = m.Steps[1:]
+	if _, err := runMacro(as, m, true); err != nil {
+		t.Fatalf("Can't run macro: %v", err)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Macro didn't save image: %v", err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatalf("Can't decode saved image: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != 128 || size.Y != 128 {
+		t.Errorf("Got image of size %v, want 128x128", size)
+	}
+
+	for _, step := range []macroStep{{Method: "unknown"}, {Method: "runMacro"}, {Method: "status", Delay: "soon"}} {
+		if _, err := runMacro(as, macro{Name: "invalid", Steps: []macroStep{step}}, false); err == nil {
+			t.Errorf("Running macro with step %v succeeded, but it should fail", step)
+		}
+	}
+}
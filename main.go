@@ -19,17 +19,12 @@
 // TODO: Add manifest for DPI awareness: https://github.com/c-smile/sciter-sdk/blob/master/demos/usciter/win-res/dpi-aware.manifest
 // TODO: Add way to gracefully stop everything when main window closes, or when the console closes.
 // TODO: Refactor most variable names when gorename works with modules
-// TODO: Add headless mode, and service
 
 package main
 
 import (
-	"fmt"
-	"io"
 	"os"
-	"path/filepath"
-	"runtime"
-	"time"
+	"strings"
 
 	"github.com/Dadido3/configdb"
 	"github.com/coreos/go-semver/semver"
@@ -38,17 +33,11 @@ import (
 )
 
 var log = logrus.New()
-var wd string // Initial working directory (Executable directory)
 var version *semver.Version
 var conf *configdb.Config
 
 func init() {
 	var err error
-	wd, err = os.Getwd()
-	if err != nil {
-		log.Panic("Can't get working directory")
-	}
-
 	version, err = semver.NewVersion("0.1.4")
 	if err != nil {
 		log.Panic(err.Error())
@@ -58,38 +47,211 @@ func init() {
 func main() {
 	log.SetReportCaller(true)
 	log.SetFormatter(&logrus.TextFormatter{
-		ForceColors: true,
-		CallerPrettyfier: func(f *runtime.Frame) (string, string) {
-			//return fmt.Sprintf("%s()", f.Function), fmt.Sprintf("%s:%d", filepath.Base(f.File), f.Line)
-			return fmt.Sprintf("%s()", f.Function), ""
-		},
+		ForceColors:      true,
+		CallerPrettyfier: logCallerPrettyfier,
 	})
 
-	os.MkdirAll(filepath.Join(wd, "log"), os.ModePerm)
-	f, err := os.OpenFile(filepath.Join(wd, "log", time.Now().UTC().Format("2006-01-02T150405")+".log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Panicf("error opening file: %v", err)
-	}
-	defer f.Close()
-
-	log.SetOutput(io.MultiWriter(colorable.NewColorableStdout(), f)) // TODO: Separate formatting for logfiles
 	log.SetLevel(logrus.TraceLevel)
 
-	storages := []configdb.Storage{configdb.UseJSONFile("config.json")}
-	conf, err = configdb.New(storages)
+	var dirsErr error
+	dirs, dirsErr = findAppDirectories()
+	if err := os.MkdirAll(dirs.Config, 0755); err != nil {
+		log.Errorf("Can't create configuration directory: %v", err)
+	}
+
+	var err error
+	conf, err = configdb.New(configStorages())
 	if err != nil {
 		log.Errorf("Can't load configuration: %v", err)
 	}
 
+	pathsCallbackID := conf.RegisterCallback([]string{".paths"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := pathSettings{}
+		if !configGet(c, ".paths", &settings) {
+			settings = defaultPathSettings
+		}
+		setPathSettings(settings)
+	})
+	defer conf.UnregisterCallback(pathsCallbackID)
+
+	profileCallbackID := conf.RegisterCallback([]string{".profile"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := profileSettings{}
+		if !configGet(c, ".profile", &settings) {
+			settings = defaultProfileSettings
+		}
+		setProfileSettings(settings)
+	})
+	defer conf.UnregisterCallback(profileCallbackID)
+
+	logFile := newLogFile(dataPath(getPaths().Logs))
+	defer logFile.Close()
+	log.SetOutput(colorable.NewColorableStdout())
+	log.AddHook(logFile)
+
+	// The configuration file is watched, changes are applied by the callbacks of the affected settings
+	configLoaded := false
+	changesCallbackID := conf.RegisterCallback(nil, func(c *configdb.Config, modified, added, removed []string) {
+		if !configLoaded {
+			configLoaded = true // Ignore the initial callback
+			return
+		}
+		log.Infof("Configuration changed: %v", strings.Join(append(append(modified, added...), removed...), ", "))
+	})
+	defer conf.UnregisterCallback(changesCallbackID)
+
+	logCallbackID := conf.RegisterCallback([]string{".log"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := logSettings{}
+		if !configGet(c, ".log", &settings) {
+			settings = defaultLogSettings
+		}
+		level, _ := logrus.ParseLevel(settings.Level)
+		log.SetLevel(level)
+		logFile.setSettings(settings)
+	})
+	defer conf.UnregisterCallback(logCallbackID)
+
+	exportsCallbackID := conf.RegisterCallback([]string{".exports"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := exportSettings{}
+		if !configGet(c, ".exports", &settings) {
+			settings = defaultExportSettings
+		}
+		exportJobs.setWorkers(settings.Workers)
+		setExportSettings(settings)
+	})
+	defer conf.UnregisterCallback(exportsCallbackID)
+
+	displayCallbackID := conf.RegisterCallback([]string{".display"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := displaySettings{}
+		if !configGet(c, ".display", &settings) {
+			settings = defaultDisplaySettings
+		}
+		setDisplaySettings(settings)
+	})
+	defer conf.UnregisterCallback(displayCallbackID)
+
 	log.Infof("D3pixelbot %v started", version)
+	if dirsErr != nil {
+		log.Warnf("Can't use the directories of the user: %v", dirsErr)
+	}
+	if dirs.Portable {
+		log.Infof("Storing everything in %v", dirs.Executable)
+	} else {
+		log.Infof("Storing the configuration in %v, data in %v and caches in %v", dirs.Config, dirs.Data, dirs.Cache)
+	}
 
-	/*pFile, err := os.Create("cpu.pprof")
-	if err != nil {
-		log.Panicf(err)
+	// Plugins are only read at the start, as games can't be removed from the connection types while they may be open
+	plugins := map[string]pluginSettings{}
+	conf.Get(".plugins", &plugins)
+	registerPlugins(plugins)
+
+	// "-debug <address>" in front of the command serves profiles and traces, it overrides the configuration at .debug
+	args, debugAddress := os.Args[1:], ""
+	if len(args) >= 2 && args[0] == "-debug" {
+		debugAddress, args = args[1], args[2:]
+	}
+
+	// Commands that don't need any services, like clients of other instances, run before anything is started
+	if len(args) > 0 && cliCommands[args[0]].NoServices {
+		if err := cliRun(nil, args); err != nil {
+			log.Errorf("%v", err)
+		}
+		return
+	}
+
+	chunksCallbackID := conf.RegisterCallback([]string{".chunks"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := chunkPolicySettings{}
+		if !configGet(c, ".chunks", &settings) {
+			settings = defaultChunkPolicySettings
+		}
+		setChunkPolicy(settings)
+	})
+	defer conf.UnregisterCallback(chunksCallbackID)
+
+	backgroundCallbackID := conf.RegisterCallback([]string{".background"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := backgroundSettings{}
+		if !configGet(c, ".background", &settings) {
+			settings = defaultBackgroundSettings
+		}
+		setBackgroundSettings(settings)
+	})
+	defer conf.UnregisterCallback(backgroundCallbackID)
+
+	// Services are closed by the shutdown, after the games. See shutdownCoordinator
+	memory := newMemoryAccountant()
+	shutdown.register("Memory accountant", map[shutdownStage]func(){shutdownServers: memory.Close})
+	memoryCallbackID := conf.RegisterCallback([]string{".memory"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := memorySettings{}
+		if !configGet(c, ".memory", &settings) {
+			settings = defaultMemorySettings
+		}
+		memory.setSettings(settings)
+	})
+	defer conf.UnregisterCallback(memoryCallbackID)
+
+	recordingRetention := newRetentionManager()
+	shutdown.register("Recording retention", map[shutdownStage]func(){shutdownServers: recordingRetention.Close})
+	retentionCallbackID := conf.RegisterCallback([]string{".retention"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := retentionSettings{}
+		if !configGet(c, ".retention", &settings) {
+			settings = defaultRetentionSettings
+		}
+		setRetentionSettings(settings)
+		recordingRetention.check()
+	})
+	defer conf.UnregisterCallback(retentionCallbackID)
+
+	debug := newDebugServer()
+	shutdown.register("Debug server", map[shutdownStage]func(){shutdownServers: debug.Close})
+	if debugAddress != "" {
+		debug.setSettings(debugServerSettings{Address: debugAddress})
+	} else {
+		debugCallbackID := conf.RegisterCallback([]string{".debug"}, func(c *configdb.Config, modified, added, removed []string) {
+			settings := debugServerSettings{}
+			c.Get(".debug", &settings)
+			debug.setSettings(settings)
+		})
+		defer conf.UnregisterCallback(debugCallbackID)
+	}
+
+	api := newAPIServer()
+	shutdown.register("API server", api.shutdownStages())
+	apiCallbackID := conf.RegisterCallback([]string{".api"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := apiServerSettings{}
+		c.Get(".api", &settings)
+		api.setSettings(settings)
+	})
+	defer conf.UnregisterCallback(apiCallbackID)
+
+	control := newControlSocket(api)
+	shutdown.register("Control socket", map[shutdownStage]func(){shutdownServers: control.Close})
+	controlCallbackID := conf.RegisterCallback([]string{".control"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := controlSocketSettings{}
+		c.Get(".control", &settings)
+		control.setSettings(settings)
+	})
+	defer conf.UnregisterCallback(controlCallbackID)
+
+	storageCallbackID := conf.RegisterCallback([]string{".storage"}, func(c *configdb.Config, modified, added, removed []string) {
+		settings := recordingStorageSettings{}
+		c.Get(".storage", &settings)
+		setRecordingStorageSettings(settings)
+	})
+	defer conf.UnregisterCallback(storageCallbackID)
+	defer recordingStorageUploads.Wait()
+	defer shutdown.run(shutdownStageTimeout) // Before waiting for uploads, as recorders start them when they are closed
+
+	// Only the main instance recovers recordings, other commands may run while it records
+	if len(args) == 0 || args[0] == "daemon" {
+		recoverRecordings()
+	}
+
+	// Run subcommands headless, otherwise open the user interface
+	if len(args) > 0 {
+		if err := cliRun(api, args); err != nil {
+			log.Errorf("%v", err)
+		}
+		return
 	}
-	defer pFile.Close()
-	pprof.StartCPUProfile(pFile)
-	defer pprof.StopCPUProfile()*/
 
-	sciterOpenMain()
+	runWithoutCommand(api)
 }
@@ -0,0 +1,32 @@
+//go:build !headless
+
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+// Opens the user interface, if no command is given.
+// Profiles for devices without display can disable it, they run as daemon instead
+func runWithoutCommand(api *apiServer) {
+	if getProfileSettings().DisableUI {
+		if err := cliDaemon(api, nil); err != nil {
+			daemonLog.Errorf("%v", err)
+		}
+		return
+	}
+
+	sciterOpenMain(api)
+}
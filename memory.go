@@ -0,0 +1,247 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var memoryLog = moduleLog("memory")
+
+// Settings of the memory accountant, stored in the configuration at .memory
+type memorySettings struct {
+	SoftLimit   int  // Limit in MiB for the accounted memory. Above it, chunks that weren't needed for some time are evicted. 0 disables the limit
+	SmallQueues bool // Shrink the event queues of canvases, listeners and recorders that are created afterwards
+}
+
+var defaultMemorySettings = memorySettings{}
+
+func (s memorySettings) validate() error {
+	if s.SoftLimit < 0 {
+		return fmt.Errorf("Memory soft limit %v must not be negative", s.SoftLimit)
+	}
+	return nil
+}
+
+// Estimated size of a queued event in bytes, without the images it references. Those are shared with the chunks
+const memoryEventSize = 64
+
+// Interval in which the memory usage is checked against the soft limit
+const memoryCheckInterval = 10 * time.Second
+
+// Memory of queued events in bytes, see memoryUsage. Accessed atomically
+var memoryListenerQueues, memoryRecordingQueues int64
+
+// Divisor of the event queue sizes, if SmallQueues is set
+const memorySmallQueueDivisor = 8
+
+// Set if event queues are shrunk, see memorySettings. Accessed atomically
+var memorySmallQueues uint32
+
+// Returns the size of a new event queue, which is shrunk if the settings ask for it
+func memoryQueueSize(size int) int {
+	if atomic.LoadUint32(&memorySmallQueues) == 0 {
+		return size
+	}
+	if size /= memorySmallQueueDivisor; size < 1 {
+		return 1
+	}
+	return size
+}
+
+// Canvases whose chunks are accounted, and evicted if needed
+var memoryCanvases = struct {
+	sync.Mutex
+	canvases map[*canvas]struct{}
+}{canvases: map[*canvas]struct{}{}}
+
+// Accounted memory in bytes, by what it's used for
+type memoryUsage struct {
+	ChunkImages     int64 `json:"chunkImages"`     // Images, queued pixels and pixel histories of the chunks of all canvases
+	ListenerQueues  int64 `json:"listenerQueues"`  // Events that wait to be delivered to listeners
+	RecordingQueues int64 `json:"recordingQueues"` // Events that wait to be written into recordings
+}
+
+func (u memoryUsage) total() int64 {
+	return u.ChunkImages + u.ListenerQueues + u.RecordingQueues
+}
+
+func (u memoryUsage) String() string {
+	return fmt.Sprintf("%.1f MiB (Chunk images: %.1f MiB, listener queues: %.1f MiB, recording queues: %.1f MiB)",
+		float64(u.total())/(1<<20), float64(u.ChunkImages)/(1<<20), float64(u.ListenerQueues)/(1<<20), float64(u.RecordingQueues)/(1<<20))
+}
+
+func memoryRegisterCanvas(can *canvas) {
+	memoryCanvases.Lock()
+	defer memoryCanvases.Unlock()
+
+	memoryCanvases.canvases[can] = struct{}{}
+}
+
+func memoryUnregisterCanvas(can *canvas) {
+	memoryCanvases.Lock()
+	defer memoryCanvases.Unlock()
+
+	delete(memoryCanvases.canvases, can)
+}
+
+// Returns all accounted canvases
+func memoryGetCanvases() []*canvas {
+	memoryCanvases.Lock()
+	defer memoryCanvases.Unlock()
+
+	canvases := make([]*canvas, 0, len(memoryCanvases.canvases))
+	for can := range memoryCanvases.canvases {
+		canvases = append(canvases, can)
+	}
+	return canvases
+}
+
+// Returns the current memory usage
+func getMemoryUsage() memoryUsage {
+	usage := memoryUsage{
+		ListenerQueues:  atomic.LoadInt64(&memoryListenerQueues),
+		RecordingQueues: atomic.LoadInt64(&memoryRecordingQueues),
+	}
+	for _, can := range memoryGetCanvases() {
+		usage.ChunkImages += can.getMemoryUsage()
+	}
+	return usage
+}
+
+// Evicts chunks until the usage is below limit, least recently needed chunks first.
+// Returns the usage after the eviction.
+func memoryEnforceLimit(limit int64) memoryUsage {
+	usage := getMemoryUsage()
+	excess := usage.total() - limit
+	if excess <= 0 {
+		return usage
+	}
+
+	// Start with the canvases that use the most memory
+	canvases := memoryGetCanvases()
+	sizes := map[*canvas]int64{}
+	for _, can := range canvases {
+		sizes[can] = can.getMemoryUsage()
+	}
+	sort.Slice(canvases, func(i, j int) bool { return sizes[canvases[i]] > sizes[canvases[j]] })
+	var freed int64
+	for _, can := range canvases {
+		if freed >= excess {
+			break
+		}
+		freed += can.evictChunks(excess-freed, canvasEvictMinAge)
+	}
+	if freed > 0 {
+		memoryLog.Infof("Evicted %.1f MiB of chunks, as the memory usage of %v was above the soft limit", float64(freed)/(1<<20), usage)
+	}
+
+	return getMemoryUsage()
+}
+
+// Checks the memory usage regularly, and keeps it below the soft limit by evicting chunks.
+//
+// Only data of the canvases and their listeners is accounted, not the whole process.
+// Chunks are evicted before the operating system runs out of memory, and warnings are logged if that's not enough.
+type memoryAccountant struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	settingsChan chan memorySettings
+	quitChan     chan struct{}
+	waitGroup    sync.WaitGroup
+}
+
+func newMemoryAccountant() *memoryAccountant {
+	ma := &memoryAccountant{
+		settingsChan: make(chan memorySettings),
+		quitChan:     make(chan struct{}),
+	}
+
+	ma.waitGroup.Add(1)
+	go func() {
+		defer ma.waitGroup.Done()
+
+		ticker := time.NewTicker(memoryCheckInterval)
+		defer ticker.Stop()
+
+		settings := defaultMemorySettings
+		exceeded := false // Only warn once until the usage is below the limit again
+
+		for {
+			select {
+			case settings = <-ma.settingsChan:
+			case <-ticker.C:
+				if settings.SoftLimit <= 0 {
+					exceeded = false
+					break
+				}
+				limit := int64(settings.SoftLimit) << 20
+				usage := memoryEnforceLimit(limit)
+				switch {
+				case usage.total() > limit && !exceeded:
+					memoryLog.Warnf("Memory usage of %v is above the soft limit of %v MiB, even after evicting chunks", usage, settings.SoftLimit)
+					exceeded = true
+				case usage.total() <= limit && exceeded:
+					memoryLog.Infof("Memory usage of %v is below the soft limit of %v MiB again", usage, settings.SoftLimit)
+					exceeded = false
+				}
+			case <-ma.quitChan:
+				return
+			}
+		}
+	}()
+
+	return ma
+}
+
+// Changes the settings of the memory accountant, they apply to the next check.
+// The queue sizes apply to new queues right away.
+func (ma *memoryAccountant) setSettings(settings memorySettings) error {
+	ma.ClosedMutex.RLock()
+	defer ma.ClosedMutex.RUnlock()
+	if ma.Closed {
+		return fmt.Errorf("Memory accountant is closed")
+	}
+
+	smallQueues := uint32(0)
+	if settings.SmallQueues {
+		smallQueues = 1
+	}
+	atomic.StoreUint32(&memorySmallQueues, smallQueues)
+
+	ma.settingsChan <- settings
+
+	return nil
+}
+
+// Stops checking the memory usage
+func (ma *memoryAccountant) Close() {
+	ma.ClosedMutex.Lock()
+	defer ma.ClosedMutex.Unlock()
+	if ma.Closed {
+		return
+	}
+	ma.Closed = true
+
+	close(ma.quitChan)
+	ma.waitGroup.Wait()
+}
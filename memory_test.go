@@ -0,0 +1,140 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_canvasEvictChunks(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 192, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	usage := can.getMemoryUsage()
+	if usage < 3*64*64 {
+		t.Fatalf("Canvas uses %v bytes, want at least the %v bytes of the images", usage, 3*64*64)
+	}
+
+	// Only chunks that weren't queried for some time are evicted, the oldest first
+	chunks := map[int]*chunk{}
+	for i := 0; i < 3; i++ {
+		chunks[i], _ = can.getChunk(chunkCoordinate{i, 0}, false)
+	}
+	chunks[0].LastQueryTime = time.Now().Add(-5 * time.Minute)
+	chunks[1].LastQueryTime = time.Now().Add(-10 * time.Minute)
+
+	if freed := can.evictChunks(1, canvasEvictMinAge); freed < 64*64 {
+		t.Errorf("Freed %v bytes, want at least %v", freed, 64*64)
+	}
+	for i, wantExisting := range []bool{true, false, true} {
+		if _, err := can.getChunk(chunkCoordinate{i, 0}, false); (err == nil) != wantExisting {
+			t.Errorf("Chunk %v exists: %v, want %v", i, err == nil, wantExisting)
+		}
+	}
+
+	// Recently queried chunks are kept, even if more memory is needed
+	can.evictChunks(usage, canvasEvictMinAge)
+	for i, wantExisting := range []bool{false, false, true} {
+		if _, err := can.getChunk(chunkCoordinate{i, 0}, false); (err == nil) != wantExisting {
+			t.Errorf("Chunk %v exists: %v, want %v", i, err == nil, wantExisting)
+		}
+	}
+}
+
+func Test_memoryCanvases(t *testing.T) {
+	registered := func(can *canvas) bool {
+		for _, c := range memoryGetCanvases() {
+			if c == can {
+				return true
+			}
+		}
+		return false
+	}
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	if !registered(can) {
+		t.Errorf("New canvas isn't accounted")
+	}
+
+	// Closed canvases aren't accounted anymore
+	can.Close()
+	if registered(can) {
+		t.Errorf("Closed canvas is still accounted")
+	}
+}
+
+func Test_memoryQueueSize(t *testing.T) {
+	defer atomic.StoreUint32(&memorySmallQueues, atomic.LoadUint32(&memorySmallQueues))
+
+	ma := newMemoryAccountant()
+	defer ma.Close()
+
+	ma.setSettings(memorySettings{})
+	if size := memoryQueueSize(1000); size != 1000 {
+		t.Errorf("Got queue size %v, want 1000", size)
+	}
+
+	ma.setSettings(memorySettings{SmallQueues: true})
+	if size := memoryQueueSize(1000); size != 1000/memorySmallQueueDivisor {
+		t.Errorf("Got small queue size %v, want %v", size, 1000/memorySmallQueueDivisor)
+	}
+	if size := memoryQueueSize(1); size != 1 {
+		t.Errorf("Got small queue size %v, want 1", size)
+	}
+}
+
+func Test_canvasMemoryLimit(t *testing.T) {
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 192, 64)
+	can.signalDownload(rect)
+	can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+
+	chunks := map[int]*chunk{}
+	for i := 0; i < 3; i++ {
+		chunks[i], _ = can.getChunk(chunkCoordinate{i, 0}, false)
+	}
+	chunks[0].LastQueryTime = time.Now().Add(-time.Second)
+	chunks[1].LastQueryTime = time.Now().Add(-2 * time.Second)
+
+	// Below the limit nothing happens
+	usage := can.getMemoryUsage()
+	if freed := can.enforceMemoryLimit(usage); freed != 0 {
+		t.Errorf("Freed %v bytes below the limit, want 0", freed)
+	}
+
+	// Above it, even recently queried chunks are evicted, the least recently queried first
+	if freed := can.enforceMemoryLimit(usage - 1); freed < 64*64 {
+		t.Errorf("Freed %v bytes, want at least %v", freed, 64*64)
+	}
+	for i, wantExisting := range []bool{true, false, true} {
+		if _, err := can.getChunk(chunkCoordinate{i, 0}, false); (err == nil) != wantExisting {
+			t.Errorf("Chunk %v exists: %v, want %v", i, err == nil, wantExisting)
+		}
+	}
+	if after := can.getMemoryUsage(); after > usage-1 {
+		t.Errorf("Canvas still uses %v bytes, want at most %v", after, usage-1)
+	}
+}
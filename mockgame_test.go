@@ -0,0 +1,244 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Mock of the pixelcanvas.io game server, to test connections, canvases, recorders and readers end-to-end without network access.
+//
+// It serves the number of online players, bigchunks and a websocket that broadcasts pixel changes.
+// Use it with useMockGameServer, which points the pixelcanvas.io connection to it.
+type mockGameServer struct {
+	sync.Mutex
+
+	Server *httptest.Server
+
+	pixels    map[image.Point]uint8 // Color indices of all pixels that aren't 0
+	conns     map[*websocket.Conn]struct{}
+	bigchunks int  // Number of served bigchunks
+	unhealthy bool // Bigchunk requests fail with a server error while set
+	upgrader  websocket.Upgrader
+}
+
+func newMockGameServer() *mockGameServer {
+	m := &mockGameServer{
+		pixels: map[image.Point]uint8{},
+		conns:  map[*websocket.Conn]struct{}{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/online", m.serveOnline)
+	mux.HandleFunc("/api/bigchunk/", m.serveBigchunk)
+	mux.HandleFunc("/ws", m.serveWebsocket)
+	m.Server = httptest.NewServer(mux)
+
+	return m
+}
+
+// Points the pixelcanvas.io connection to the mock server, and returns a function that restores the previous addresses
+func useMockGameServer() (*mockGameServer, func()) {
+	m := newMockGameServer()
+
+	oldURL, oldAPIURL, oldWebsocketURL := pixelcanvasioURL, pixelcanvasioAPIURL, pixelcanvasioWebsocketURL
+	pixelcanvasioURL, pixelcanvasioAPIURL = m.Server.URL, m.Server.URL
+	pixelcanvasioWebsocketURL = "ws" + strings.TrimPrefix(m.Server.URL, "http") + "/ws"
+
+	return m, func() {
+		pixelcanvasioURL, pixelcanvasioAPIURL, pixelcanvasioWebsocketURL = oldURL, oldAPIURL, oldWebsocketURL
+		m.Close()
+	}
+}
+
+func (m *mockGameServer) serveOnline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"online": 42}`)
+}
+
+// Serves the 15x15 chunks around the chunk given in the path, with two 4 bit color indices per byte
+func (m *mockGameServer) serveBigchunk(w http.ResponseWriter, r *http.Request) {
+	var cx, cy int
+	if _, err := fmt.Sscanf(path.Base(r.URL.Path), "%d.%d.bmp", &cx, &cy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.unhealthy {
+		http.Error(w, "Maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	m.bigchunks++
+
+	size, radius := pixelcanvasioChunkSize, pixelcanvasioChunkCollectionRadius
+	raw := make([]byte, 0, size.X*size.Y*pixelcanvasioChunkCollectionSize.X*pixelcanvasioChunkCollectionSize.Y/2)
+	for iy := cy - radius; iy <= cy+radius; iy++ {
+		for ix := cx - radius; ix <= cx+radius; ix++ {
+			for jy := 0; jy < size.Y; jy++ {
+				for jx := 0; jx < size.X; jx += 2 {
+					p := image.Point{ix*size.X + jx, iy*size.Y + jy}
+					raw = append(raw, m.pixels[p]<<4|m.pixels[p.Add(image.Point{1, 0})])
+				}
+			}
+		}
+	}
+
+	w.Write(raw)
+}
+
+func (m *mockGameServer) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	c, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	m.Lock()
+	m.conns[c] = struct{}{}
+	m.Unlock()
+
+	// Clients don't send anything, read until the connection is closed
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	m.Lock()
+	delete(m.conns, c)
+	m.Unlock()
+	c.Close()
+}
+
+// Sets a pixel and broadcasts the change to all connected clients
+func (m *mockGameServer) setPixel(pos image.Point, colorIndex uint8) {
+	m.Lock()
+	defer m.Unlock()
+
+	if colorIndex == 0 {
+		delete(m.pixels, pos)
+	} else {
+		m.pixels[pos] = colorIndex
+	}
+
+	size := pixelcanvasioChunkSize
+	cc := size.getChunkCoord(pos, image.Point{})
+	offset := pos.Sub(image.Point{cc.X * size.X, cc.Y * size.Y})
+
+	message := make([]byte, 7)
+	message[0] = 0xC1
+	binary.BigEndian.PutUint16(message[1:], uint16(int16(cc.X)))
+	binary.BigEndian.PutUint16(message[3:], uint16(int16(cc.Y)))
+	binary.BigEndian.PutUint16(message[5:], uint16(colorIndex&0x0F)|uint16(offset.X)<<4|uint16(offset.Y)<<10)
+
+	for c := range m.conns {
+		c.WriteMessage(websocket.BinaryMessage, message)
+	}
+}
+
+// Closes all websocket connections, clients will reconnect
+func (m *mockGameServer) disconnect() {
+	m.Lock()
+	defer m.Unlock()
+
+	for c := range m.conns {
+		c.Close()
+	}
+}
+
+// Returns the number of connected websocket clients
+func (m *mockGameServer) getConnections() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return len(m.conns)
+}
+
+// Lets bigchunk requests fail, or serves them again
+func (m *mockGameServer) setUnhealthy(unhealthy bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.unhealthy = unhealthy
+}
+
+// Returns the number of served bigchunks
+func (m *mockGameServer) getBigchunks() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.bigchunks
+}
+
+// Returns the expected state of the canvas at the given rectangle
+func (m *mockGameServer) getImage(rect image.Rectangle) *image.Paletted {
+	m.Lock()
+	defer m.Unlock()
+
+	img := image.NewPaletted(rect, pixelcanvasioPalette)
+	for pos, colorIndex := range m.pixels {
+		if pos.In(rect) {
+			img.SetColorIndex(pos.X, pos.Y, colorIndex)
+		}
+	}
+
+	return img
+}
+
+func (m *mockGameServer) Close() {
+	m.disconnect()
+	m.Server.Close()
+}
+
+// Returns the first pixel that differs between both images, or false if they are equal
+func firstDifference(a, b image.Image) (image.Point, bool) {
+	rect := a.Bounds().Union(b.Bounds())
+	for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+		for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+			if color.RGBAModel.Convert(a.At(ix, iy)) != color.RGBAModel.Convert(b.At(ix, iy)) {
+				return image.Point{ix, iy}, true
+			}
+		}
+	}
+	return image.Point{}, false
+}
+
+// Waits until cond returns true, or fails the test after the timeout
+func waitFor(t *testing.T, timeout time.Duration, description string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout while waiting for %v", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,217 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPingReq    = 12
+	mqttDisconnect = 14
+)
+
+// Minimal MQTT 3.1.1 client, that can only publish messages with QoS 0.
+type mqttClient struct {
+	conn       net.Conn
+	writeMutex sync.Mutex
+
+	doneChan chan struct{} // Closed when the connection is lost or closed
+	err      error         // Reason why the connection was lost, only valid after doneChan is closed
+}
+
+// Connects to the broker at addr, e.g. "localhost:1883" or "tcp://localhost:1883".
+// username and password are optional.
+func mqttDial(addr, clientID, username, password string, keepAlive time.Duration) (*mqttClient, error) {
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "tcp://"), "mqtt://")
+
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	// Variable header: Protocol name, level 4 (3.1.1), flags and keep alive in seconds
+	body := &bytes.Buffer{}
+	mqttWriteString(body, "MQTT")
+	flags := byte(0x02) // Clean session
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	body.Write([]byte{4, flags})
+	binary.Write(body, binary.BigEndian, uint16(keepAlive/time.Second))
+
+	// Payload
+	mqttWriteString(body, clientID)
+	if username != "" {
+		mqttWriteString(body, username)
+	}
+	if password != "" {
+		mqttWriteString(body, password)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := mqttWritePacket(conn, mqttConnect<<4, body.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	packetType, response, err := mqttReadPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Can't read CONNACK: %v", err)
+	}
+	if packetType>>4 != mqttConnAck || len(response) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("Expected CONNACK, got packet type %v", packetType>>4)
+	}
+	if response[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("Broker refused connection with return code %v", response[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &mqttClient{
+		conn:     conn,
+		doneChan: make(chan struct{}),
+	}
+
+	// Discard everything the broker sends, and detect connection loss
+	go func() {
+		defer close(c.doneChan)
+		for {
+			if _, _, err := mqttReadPacket(reader); err != nil {
+				c.err = err
+				return
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+// Publishes a message with QoS 0
+func (c *mqttClient) publish(topic string, payload []byte, retain bool) error {
+	body := &bytes.Buffer{}
+	mqttWriteString(body, topic)
+	body.Write(payload)
+
+	header := byte(mqttPublish << 4)
+	if retain {
+		header |= 0x01
+	}
+
+	return c.write(header, body.Bytes())
+}
+
+// Sends a PINGREQ, this has to be done within the keep alive interval if nothing else is sent
+func (c *mqttClient) ping() error {
+	return c.write(mqttPingReq<<4, nil)
+}
+
+func (c *mqttClient) write(header byte, body []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return mqttWritePacket(c.conn, header, body)
+}
+
+// Returns a channel that is closed when the connection is lost
+func (c *mqttClient) done() <-chan struct{} {
+	return c.doneChan
+}
+
+// Close sends a DISCONNECT and closes the connection
+func (c *mqttClient) Close() error {
+	c.write(mqttDisconnect<<4, nil)
+	err := c.conn.Close()
+	<-c.doneChan
+	return err
+}
+
+func mqttWriteString(w *bytes.Buffer, s string) {
+	binary.Write(w, binary.BigEndian, uint16(len(s)))
+	w.WriteString(s)
+}
+
+// Writes a control packet with the given first header byte, and the remaining length encoded as variable length integer
+func mqttWritePacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	_, err := w.Write(packet)
+	return err
+}
+
+// Reads a control packet, and returns its first header byte and the remaining data
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i >= 4 {
+			return 0, nil, fmt.Errorf("Malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7F) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header, body, nil
+}
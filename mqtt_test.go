@@ -0,0 +1,115 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// Accepts a single MQTT connection, and sends the topics and payloads of all PUBLISH packets into the returned channel
+func startTestMQTTBroker(t *testing.T) (addr string, publishChan <-chan [2]string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+
+	ch := make(chan [2]string, 100)
+	go func() {
+		defer listener.Close()
+		defer close(ch)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		if header, _, err := mqttReadPacket(reader); err != nil || header>>4 != mqttConnect {
+			t.Errorf("Expected CONNECT, got %v (%v)", header>>4, err)
+			return
+		}
+		mqttWritePacket(conn, mqttConnAck<<4, []byte{0, 0})
+
+		for {
+			header, body, err := mqttReadPacket(reader)
+			if err != nil || header>>4 == mqttDisconnect {
+				return
+			}
+			if header>>4 != mqttPublish {
+				continue
+			}
+			topicLength := int(binary.BigEndian.Uint16(body))
+			ch <- [2]string{string(body[2 : 2+topicLength]), string(body[2+topicLength:])}
+		}
+	}()
+
+	return listener.Addr().String(), ch
+}
+
+func Test_mqttClient(t *testing.T) {
+	addr, publishChan := startTestMQTTBroker(t)
+
+	client, err := mqttDial("tcp://"+addr, "test", "user", "password", time.Minute)
+	if err != nil {
+		t.Fatalf("Can't connect: %v", err)
+	}
+
+	if err := client.publish("a/b", []byte("payload"), false); err != nil {
+		t.Errorf("Can't publish: %v", err)
+	}
+	if err := client.ping(); err != nil {
+		t.Errorf("Can't ping: %v", err)
+	}
+
+	select {
+	case msg := <-publishChan:
+		if want := [2]string{"a/b", "payload"}; msg != want {
+			t.Errorf("Broker got %q, want %q", msg, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Broker didn't receive message")
+	}
+
+	client.Close()
+	select {
+	case <-client.done():
+	default:
+		t.Errorf("Client isn't done after closing")
+	}
+}
+
+func Test_mqttWritePacket(t *testing.T) {
+	for _, length := range []int{0, 127, 128, 16383, 16384, 200000} {
+		buf := &bytes.Buffer{}
+		if err := mqttWritePacket(buf, mqttPublish<<4, make([]byte, length)); err != nil {
+			t.Fatalf("Can't write packet: %v", err)
+		}
+		header, body, err := mqttReadPacket(bufio.NewReader(buf))
+		if err != nil {
+			t.Fatalf("Can't read packet with length %v: %v", length, err)
+		}
+		if header != mqttPublish<<4 || len(body) != length {
+			t.Errorf("Got header %v with length %v, want %v with length %v", header, len(body), mqttPublish<<4, length)
+		}
+	}
+}
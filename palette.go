@@ -0,0 +1,278 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+// Maximum number of colors of a palette. More colors mean that the game doesn't use a palette
+const paletteMaxColors = 256
+
+// Palette of a game, stored in the configuration at .palettes.<shortName>.
+// It's used for games whose palette isn't known from their API or their recordings.
+type paletteSettings struct {
+	Colors []string          // Colors in hex notation like "#E50000", the most used first
+	Names  map[string]string // Optional names of colors by their hex notation, like {"#E50000": "Red"}. They are shown instead of the hex notation
+}
+
+func (s paletteSettings) validate() error {
+	if _, err := s.getPalette(); err != nil {
+		return err
+	}
+	for hex := range s.Names {
+		if _, err := paletteNormalizeHex(hex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the parsed palette, or nil if there are no colors
+func (s paletteSettings) getPalette() (color.Palette, error) {
+	if len(s.Colors) > paletteMaxColors {
+		return nil, fmt.Errorf("Palette has %v colors, the maximum is %v", len(s.Colors), paletteMaxColors)
+	}
+
+	var pal color.Palette
+	for _, str := range s.Colors {
+		hex := strings.TrimPrefix(strings.TrimSpace(str), "#")
+		if len(hex) != 6 {
+			return nil, fmt.Errorf("Invalid color %q in palette", str)
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid color %q in palette: %v", str, err)
+		}
+		pal = append(pal, color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255})
+	}
+
+	return pal, nil
+}
+
+// Returns the color in hex notation like "#E50000", as it's stored in palette settings
+func paletteHex(c color.RGBA) string {
+	return fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)
+}
+
+// Returns the hex notation of a color in the form that is used by paletteHex, e.g. "#e50000" becomes "#E50000"
+func paletteNormalizeHex(s string) (string, error) {
+	pal, err := (paletteSettings{Colors: []string{s}}).getPalette()
+	if err != nil {
+		return "", err
+	}
+	return paletteHex(pal[0].(color.RGBA)), nil
+}
+
+// Names of the colors of a game by their hex notation, like {"#E50000": "Red"}
+type paletteNames map[string]string
+
+// Names of the colors of games whose palette is known
+var paletteGameNames = map[string]paletteNames{
+	"pixelcanvasio": pixelcanvasioPaletteNames,
+}
+
+// Returns the names of the colors of a game.
+// The names in the configuration at .palettes.<shortName> override the names that are known for the game.
+// Replays use the names of their game.
+func getPaletteNames(c *configdb.Config, shortName string) paletteNames {
+	shortName = strings.TrimPrefix(shortName, "replay-")
+
+	names := paletteNames{}
+	for hex, name := range paletteGameNames[shortName] {
+		names[hex] = name
+	}
+
+	if c == nil {
+		return names
+	}
+	settings := paletteSettings{}
+	if err := c.Get(".palettes."+shortName, &settings); err != nil {
+		return names
+	}
+	for hex, name := range settings.Names {
+		if hex, err := paletteNormalizeHex(hex); err == nil {
+			names[hex] = name
+		}
+	}
+
+	return names
+}
+
+// Returns the name of the color, or an empty string if it has none
+func (pn paletteNames) name(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return pn[paletteHex(color.RGBA{n.R, n.G, n.B, 255})]
+}
+
+// Returns the name of the color, or its hex notation if it has none
+func (pn paletteNames) label(c color.Color) string {
+	if name := pn.name(c); name != "" {
+		return name
+	}
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return paletteHex(color.RGBA{n.R, n.G, n.B, 255})
+}
+
+// Returns the palette that is stored in the configuration for the given game, or nil if there is none
+func getConfiguredPalette(c *configdb.Config, shortName string) color.Palette {
+	if c == nil {
+		return nil
+	}
+
+	settings := paletteSettings{}
+	if err := c.Get(".palettes."+shortName, &settings); err != nil {
+		return nil
+	}
+	pal, err := settings.getPalette()
+	if err != nil {
+		log.Errorf("Invalid palette at .palettes.%v: %v", shortName, err)
+		return nil
+	}
+
+	return pal
+}
+
+// Samples the colors of a live canvas, to derive the palette of games that don't document it.
+//
+// Colors are counted from downloaded images and pixel changes inside of a rectangle.
+// Subscribe it to a canvas, and register the rectangle to get the images downloaded.
+type paletteSampler struct {
+	sync.Mutex
+
+	Rect   image.Rectangle
+	Counts map[color.RGBA]int // Number of sampled pixels per color
+}
+
+func newPaletteSampler(rect image.Rectangle) *paletteSampler {
+	return &paletteSampler{
+		Rect:   rect.Canon(),
+		Counts: map[color.RGBA]int{},
+	}
+}
+
+// Counts all opaque pixels of the image that are inside the rectangle
+func (ps *paletteSampler) addImage(img image.Image) {
+	rect := img.Bounds().Intersect(ps.Rect)
+
+	ps.Lock()
+	defer ps.Unlock()
+
+	for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+		for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+			if c := color.RGBAModel.Convert(img.At(ix, iy)).(color.RGBA); c.A == 255 {
+				ps.Counts[c]++
+			}
+		}
+	}
+}
+
+// Returns the number of sampled pixels
+func (ps *paletteSampler) getPixels() int {
+	ps.Lock()
+	defer ps.Unlock()
+
+	pixels := 0
+	for _, count := range ps.Counts {
+		pixels += count
+	}
+	return pixels
+}
+
+// Returns the sampled colors, the most used first.
+//
+// Fails if there are more colors than a palette can have, which means that the game doesn't use a palette.
+func (ps *paletteSampler) getPalette() (paletteSettings, error) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	if len(ps.Counts) == 0 {
+		return paletteSettings{}, fmt.Errorf("No pixels sampled yet")
+	}
+	if len(ps.Counts) > paletteMaxColors {
+		return paletteSettings{}, fmt.Errorf("Found %v colors, the canvas doesn't seem to use a palette", len(ps.Counts))
+	}
+
+	colors := make([]color.RGBA, 0, len(ps.Counts))
+	for c := range ps.Counts {
+		colors = append(colors, c)
+	}
+	sort.Slice(colors, func(i, j int) bool {
+		a, b := colors[i], colors[j]
+		if ps.Counts[a] != ps.Counts[b] {
+			return ps.Counts[a] > ps.Counts[b]
+		}
+		return a.R < b.R || a.R == b.R && (a.G < b.G || a.G == b.G && a.B < b.B)
+	})
+
+	settings := paletteSettings{}
+	for _, c := range colors {
+		settings.Colors = append(settings.Colors, paletteHex(c))
+	}
+
+	return settings, nil
+}
+
+func (ps *paletteSampler) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	if !pos.In(ps.Rect) {
+		return nil
+	}
+	if c := color.RGBAModel.Convert(col).(color.RGBA); c.A == 255 {
+		ps.Lock()
+		ps.Counts[c]++
+		ps.Unlock()
+	}
+	return nil
+}
+
+func (ps *paletteSampler) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	ps.addImage(img)
+	return nil
+}
+
+func (ps *paletteSampler) handleInvalidateAll() error {
+	return nil
+}
+
+func (ps *paletteSampler) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (ps *paletteSampler) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (ps *paletteSampler) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (ps *paletteSampler) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (ps *paletteSampler) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
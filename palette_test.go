@@ -0,0 +1,151 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/configdb"
+)
+
+func Test_paletteSettings(t *testing.T) {
+	pal, err := paletteSettings{Colors: []string{"#E50000", "ffffff", " #00d3dd "}}.getPalette()
+	if err != nil {
+		t.Fatalf("Can't parse palette: %v", err)
+	}
+	want := color.Palette{color.RGBA{229, 0, 0, 255}, color.RGBA{255, 255, 255, 255}, color.RGBA{0, 211, 221, 255}}
+	if len(pal) != len(want) {
+		t.Fatalf("Got %v colors, want %v", len(pal), len(want))
+	}
+	for i := range want {
+		if pal[i] != want[i] {
+			t.Errorf("Color %v = %v, want %v", i, pal[i], want[i])
+		}
+	}
+
+	for _, colors := range [][]string{{"#E500"}, {"#GGGGGG"}, make([]string, 257)} {
+		if err := (paletteSettings{Colors: colors}).validate(); err == nil {
+			t.Errorf("Palette %q is valid", colors[0])
+		}
+	}
+}
+
+func Test_paletteNames(t *testing.T) {
+	red, white, unknown := color.RGBA{229, 0, 0, 255}, color.RGBA{255, 255, 255, 255}, color.RGBA{1, 2, 3, 255}
+
+	names := getPaletteNames(nil, "replay-pixelcanvasio")
+	if got := names.label(red); got != "Red" {
+		t.Errorf("Got label %q for red, want the built-in name", got)
+	}
+	if got := names.label(unknown); got != "#010203" {
+		t.Errorf("Got label %q for an unknown color, want its hex notation", got)
+	}
+
+	c, err := configdb.New([]configdb.Storage{configdb.UseDummyStorage("", map[string]interface{}{
+		"palettes": map[string]interface{}{
+			"pixelcanvasio": paletteSettings{Names: map[string]string{"#e50000": "Faction red", "010203": "Almost black"}},
+		},
+	})})
+	if err != nil {
+		t.Fatalf("Can't create configuration: %v", err)
+	}
+	defer c.Close()
+
+	names = getPaletteNames(c, "pixelcanvasio")
+	for col, want := range map[color.RGBA]string{red: "Faction red", white: "White", unknown: "Almost black"} {
+		if got := names.name(col); got != want {
+			t.Errorf("Got name %q for %v, want %q", got, col, want)
+		}
+	}
+
+	if err := (paletteSettings{Names: map[string]string{"red": "Red"}}).validate(); err == nil {
+		t.Errorf("Names with invalid colors are valid")
+	}
+}
+
+func Test_paletteSampler(t *testing.T) {
+	ps := newPaletteSampler(image.Rect(0, 0, 10, 10))
+
+	img := image.NewPaletted(image.Rect(-10, -10, 10, 10), pixelcanvasioPalette)
+	for iy := 0; iy < 10; iy++ {
+		img.SetColorIndex(5, iy, 5) // 10 pixels inside
+		img.SetColorIndex(-5, iy, 3)
+	}
+	ps.handleSetImage(img, true, nil)
+	ps.handleSetPixel(image.Point{1, 1}, pixelcanvasioPalette[3], 0)
+	ps.handleSetPixel(image.Point{20, 20}, pixelcanvasioPalette[4], 0) // Outside
+	ps.handleSetPixel(image.Point{2, 2}, color.RGBA{}, 0)              // Transparent
+
+	settings, err := ps.getPalette()
+	if err != nil {
+		t.Fatalf("Can't get palette: %v", err)
+	}
+	// 90 pixels of the background, then 10 and 1
+	if want := []string{"#FFFFFF", "#E50000", "#222222"}; !equalStrings(settings.Colors, want) {
+		t.Errorf("Got palette %v, want %v", settings.Colors, want)
+	}
+	if got := ps.getPixels(); got != 101 {
+		t.Errorf("Sampled %v pixels, want 101", got)
+	}
+
+	// Too many colors for a palette
+	rgba := image.NewRGBA(image.Rect(0, 0, 10, 30))
+	for i := 0; i < 300; i++ {
+		rgba.Set(i%10, i/10, color.RGBA{uint8(i), uint8(i >> 8), 0, 255})
+	}
+	ps = newPaletteSampler(rgba.Rect)
+	ps.addImage(rgba)
+	if _, err := ps.getPalette(); err == nil {
+		t.Errorf("Got palette of 300 colors")
+	}
+}
+
+// Samples the palette of the mock game server
+func Test_paletteSamplerLive(t *testing.T) {
+	m, restore := useMockGameServer()
+	defer restore()
+
+	m.setPixel(image.Point{1, 1}, 5)
+	m.setPixel(image.Point{2, 1}, 5)
+	m.setPixel(image.Point{3, 1}, 12)
+
+	con, can := newPixelcanvasio()
+	defer con.Close()
+
+	rect := image.Rect(0, 0, 16, 16)
+	ps := newPaletteSampler(rect)
+	if err := can.subscribeListener(ps, false); err != nil {
+		t.Fatalf("Can't subscribe: %v", err)
+	}
+	defer can.unsubscribeListener(ps)
+	if err := can.registerRects(ps, []image.Rectangle{rect}); err != nil {
+		t.Fatalf("Can't register rectangle: %v", err)
+	}
+
+	waitFor(t, 10*time.Second, "the sampled pixels", func() bool { return ps.getPixels() >= rect.Dx()*rect.Dy() })
+
+	settings, err := ps.getPalette()
+	if err != nil {
+		t.Fatalf("Can't get palette: %v", err)
+	}
+	if want := []string{"#FFFFFF", "#E50000", "#0083C7"}; !equalStrings(settings.Colors, want) {
+		t.Errorf("Got palette %v, want %v", settings.Colors, want)
+	}
+}
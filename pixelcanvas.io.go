@@ -35,6 +35,8 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+var pixelcanvasioLog = moduleLog("pixelcanvasio")
+
 var pixelcanvasioChunkSize = pixelSize{64, 64} // Not the chunk size that the canvas is initialized with
 var pixelcanvasioChunkCollectionRadius = 7
 var pixelcanvasioChunkCollectionSize = chunkSize{pixelcanvasioChunkCollectionRadius*2 + 1, pixelcanvasioChunkCollectionRadius*2 + 1} // Arraysize of chunks that's returned on the bigchunk request
@@ -42,6 +44,11 @@ var pixelcanvasioChunkOffset = image.Point{pixelcanvasioChunkCollectionRadius *
 var pixelcanvasioChunkCollectionPixelSize = pixelSize{pixelcanvasioChunkCollectionSize.X * pixelcanvasioChunkSize.X, pixelcanvasioChunkCollectionSize.Y * pixelcanvasioChunkSize.Y}
 var pixelcanvasioCanvasRect = image.Rectangle{image.Point{-999999, -999999}, image.Point{1000000, 1000000}}
 
+// Addresses of the game. Tests point them to a mock server, see mockgame_test.go
+var pixelcanvasioURL = "https://pixelcanvas.io"
+var pixelcanvasioAPIURL = "https://api.pixelcanvas.io"
+var pixelcanvasioWebsocketURL = "wss://ws.pixelcanvas.io:8443"
+
 var pixelcanvasioPalette = []color.Color{
 	color.RGBA{255, 255, 255, 255},
 	color.RGBA{228, 228, 228, 255},
@@ -61,14 +68,37 @@ var pixelcanvasioPalette = []color.Color{
 	color.RGBA{130, 0, 128, 255},
 }
 
+// Names of the colors of pixelcanvasioPalette, as they are shown in exports and the API
+var pixelcanvasioPaletteNames = paletteNames{
+	"#FFFFFF": "White",
+	"#E4E4E4": "Light gray",
+	"#888888": "Gray",
+	"#222222": "Black",
+	"#FFA7D1": "Pink",
+	"#E50000": "Red",
+	"#E59500": "Orange",
+	"#A06A42": "Brown",
+	"#E5D900": "Yellow",
+	"#94E044": "Light green",
+	"#02BE01": "Green",
+	"#00D3DD": "Cyan",
+	"#0083C7": "Blue",
+	"#0000EA": "Dark blue",
+	"#CF6EE4": "Magenta",
+	"#820080": "Purple",
+}
+
 type connectionPixelcanvasio struct {
 	Fingerprint      string
 	OnlinePlayers    uint32 // Must be read atomically
 	Center           image.Point
 	AuthName, AuthID string
-	NextPixel        time.Time
+	NextPixel        time.Time // On the clock of the game server
 
-	Canvas *canvas
+	Canvas     *canvas
+	Statistics *canvasStatistics // Counts the activity, independent of recordings
+	Watcher    *canvasWatcher    // Alerts on activity in watched regions, independent of bots
+	Heatmap    *canvasHeatmap    // Counts the changes per pixel or chunk in a sliding window, independent of recordings
 
 	GoroutineQuit     chan struct{} // Closing this channel stops the goroutines
 	QuitWaitgroup     sync.WaitGroup
@@ -95,34 +125,40 @@ func newPixelcanvasio() (connection, *canvas) {
 		}
 
 		con.Canvas, con.ChunkDownloadChan = newCanvas(pixelcanvasioChunkCollectionPixelSize, pixelcanvasioChunkOffset, pixelcanvasioCanvasRect)
+		con.Statistics, _ = con.Canvas.newCanvasStatistics(conf, con.getShortName())
+		con.Watcher, _ = con.Canvas.newCanvasWatcher(conf, con.getShortName())
+		con.Heatmap, _ = con.Canvas.newCanvasHeatmap(conf, con.getShortName())
+		registerConnection(con, con.Canvas)
+		con.Canvas.Palette.setPalette(pixelcanvasioPalette)
 
 		// Main goroutine that handles queries and timed things
 		con.QuitWaitgroup.Add(1)
 		go func() {
 			defer con.QuitWaitgroup.Done()
-
-			queryTicker := time.NewTicker(10 * time.Second)
-			defer queryTicker.Stop()
-
-			getOnlinePlayers := func() {
-				response := &struct {
-					Online int `json:"online"`
-				}{}
-				if err := getJSON("https://pixelcanvas.io/api/online", response); err == nil {
-					atomic.StoreUint32(&con.OnlinePlayers, uint32(response.Online))
-					log.Debugf("Player amount: %v", response.Online)
+			crashRun("Query loop of pixelcanvas.io", true, func() {
+				queryTicker := time.NewTicker(10 * time.Second)
+				defer queryTicker.Stop()
+
+				getOnlinePlayers := func() {
+					response := &struct {
+						Online int `json:"online"`
+					}{}
+					if err := getJSON(pixelcanvasioURL+"/api/online", response); err == nil {
+						atomic.StoreUint32(&con.OnlinePlayers, uint32(response.Online))
+						pixelcanvasioLog.Debugf("Player amount: %v", response.Online)
+					}
 				}
-			}
-			getOnlinePlayers()
+				getOnlinePlayers()
 
-			for {
-				select {
-				case <-queryTicker.C:
-					getOnlinePlayers()
-				case <-con.GoroutineQuit:
-					return
+				for {
+					select {
+					case <-queryTicker.C:
+						getOnlinePlayers()
+					case <-con.GoroutineQuit:
+						return
+					}
 				}
-			}
+			})
 		}()
 
 		myClient := &http.Client{Timeout: 1 * time.Minute}
@@ -148,33 +184,44 @@ func newPixelcanvasio() (connection, *canvas) {
 			}
 			// TODO: Only setImage on chunks returned by signalDownload
 
-			log.Tracef("Download at %v signalled", cc)
+			pixelcanvasioLog.Tracef("Download at %v signalled", cc)
 
 			downloadWaitgroup.Add(1)
-			go func() {
+			go crashRun(fmt.Sprintf("Download of pixelcanvas.io chunks at %v", cc), false, func() {
 				downloadLimit <- struct{}{} // Block inside the goroutine, so downloads will queue up without blocking anything else
 				defer downloadWaitgroup.Done()
 				defer func() { <-downloadLimit }()
 
 				startTime := time.Now()
-				log.Tracef("Download at %v started", cc)
+				pixelcanvasioLog.Tracef("Download at %v started", cc)
 
-				r, err := myClient.Get(fmt.Sprintf("https://api.pixelcanvas.io/api/bigchunk/%v.%v.bmp", cc.X, cc.Y))
+				// Failed chunks are downloaded again after a backoff, see canvas.signalDownloadFailed
+				failed := func(err error) {
+					pixelcanvasioLog.Errorf("Can't get bigchunk at %v: %v", cc, err)
+					con.Canvas.signalDownloadFailed(ca, err)
+				}
+
+				r, err := myClient.Get(fmt.Sprintf("%v/api/bigchunk/%v.%v.bmp", pixelcanvasioAPIURL, cc.X, cc.Y))
 				if err != nil {
-					log.Errorf("Can't get bigchunk at %v: %v", cc, err)
+					failed(err)
 					return
 				}
 				defer r.Body.Close()
+				con.Canvas.Clock.observeResponse(r.Header, startTime, time.Now())
+
+				if r.StatusCode != http.StatusOK {
+					failed(fmt.Errorf("Got status %q", r.Status))
+					return
+				}
 
 				raw, err := ioutil.ReadAll(r.Body)
 				if err != nil {
-					log.Errorf("Error in bigchunk result: %v", err)
+					failed(fmt.Errorf("Error in bigchunk result: %v", err))
 					return
 				}
 				expectedLen := pixelcanvasioChunkSize.X * pixelcanvasioChunkSize.Y * ((pixelcanvasioChunkCollectionSize.X) * (pixelcanvasioChunkCollectionSize.Y)) / 2
 				if len(raw) != expectedLen {
-					log.Errorf("Returned image data has the wrong length (%v, expected %v)", len(raw), expectedLen)
-					log.Errorf("API returned %v", string(raw[:1000]))
+					failed(fmt.Errorf("Returned image data has the wrong length (%v, expected %v)", len(raw), expectedLen))
 					return
 				}
 
@@ -210,14 +257,15 @@ func newPixelcanvasio() (connection, *canvas) {
 
 				err = con.Canvas.setImage(img, false, true)
 				if err != nil {
-					log.Warningf("Can't set image at %v: %v", img.Rect, err)
+					pixelcanvasioLog.Warningf("Can't set image at %v: %v", img.Rect, err)
+					con.Canvas.signalDownloadFailed(ca, err)
 					return
 				}
 
 				setTime := time.Now().Sub(startTime).Seconds()
-				log.Tracef("Times for %v: Download %.3fs, Drawing %.3fs, setImage() %.5fs ", cc, downloadTime, drawTime, setTime)
+				pixelcanvasioLog.Tracef("Times for %v: Download %.3fs, Drawing %.3fs, setImage() %.5fs ", cc, downloadTime, drawTime, setTime)
 
-			}()
+			})
 
 			return nil
 		}
@@ -238,9 +286,9 @@ func newPixelcanvasio() (connection, *canvas) {
 				// Any following connection attempt should be delayed a few seconds
 				waitTime = 5 * time.Second
 
-				u, err := url.Parse("wss://ws.pixelcanvas.io:8443")
+				u, err := url.Parse(pixelcanvasioWebsocketURL)
 				if err != nil {
-					log.Errorf("Invalid websocket URL: %v", err)
+					pixelcanvasioLog.Errorf("Invalid websocket URL: %v", err)
 					continue
 				}
 
@@ -249,25 +297,25 @@ func newPixelcanvasio() (connection, *canvas) {
 				// Connect to websocket server
 				c, _, err := websocket.DefaultDialer.Dial(u.String(), nil) // TODO: Ping websocket connection and set timeouts
 				if err != nil {
-					log.Errorf("Failed to connect to websocket server %v: %v", u.String(), err)
+					pixelcanvasioLog.Errorf("Failed to connect to websocket server %v: %v", u.String(), err)
 					continue
 				}
 
 				// Handle chunk downloading in a goroutine
 				chunkDownloaderQuit := make(chan struct{})
-				go func() {
+				go crashRun("Chunk downloader of pixelcanvas.io", true, func() {
 					for {
 						select {
 						case chu := <-con.ChunkDownloadChan:
 							// Check if the chunk still needs to be downloaded
-							if chu.getQueryState(false) == chunkDownload {
+							if chu.getQueryState(false, 0) == chunkDownload {
 								handleDownload(chu)
 							}
 						case <-chunkDownloaderQuit:
 							return
 						}
 					}
-				}()
+				})
 
 				// Wait for and handle external close events, or connection errors
 				quitChannel := make(chan struct{})
@@ -284,48 +332,50 @@ func newPixelcanvasio() (connection, *canvas) {
 					c.Close()
 				}(c, quitChannel)
 
-				log.Debugf("Websocket connection opened")
+				pixelcanvasioLog.Debugf("Websocket connection opened")
 
-				// Handle events
-				for {
-					_, message, err := c.ReadMessage()
-					if err != nil {
-						log.Warnf("Websocket connection error: %v", err)
-						break
-					}
-					if len(message) >= 1 {
-						opcode := uint8(message[0])
-						switch opcode {
-						case 0xC1:
-							if len(message) == 7 {
-								cx := int16(binary.BigEndian.Uint16(message[1:]))
-								cy := int16(binary.BigEndian.Uint16(message[3:]))
-								mixed := binary.BigEndian.Uint16(message[5:])
-								colorIndex := uint8(mixed & 0x0F)
-								color := pixelcanvasioPalette[colorIndex] // colorIndex technically can't be >= 16, so it should be save
-								ox := int((mixed >> 4) & 0x3F)
-								oy := int((mixed >> 10) & 0x3F)
-								log.Tracef("Pixelchange: color %v @ chunk %v, %v with offset %v, %v", colorIndex, cx, cy, ox, oy)
-								pos := image.Point{
-									X: int(cx)*pixelcanvasioChunkSize.X + ox,
-									Y: int(cy)*pixelcanvasioChunkSize.Y + oy,
-								}
-								if err := con.Canvas.setPixel(pos, color); err != nil {
-									log.Debugf("Couldn't draw pixel at %v with color %v: %v", pos, colorIndex, err)
+				// Handle events. A crash while handling a message closes the connection, it is reopened like after connection errors
+				crashProtect("Websocket connection of pixelcanvas.io", true, func() {
+					for {
+						_, message, err := c.ReadMessage()
+						if err != nil {
+							pixelcanvasioLog.Warnf("Websocket connection error: %v", err)
+							return
+						}
+						if len(message) >= 1 {
+							opcode := uint8(message[0])
+							switch opcode {
+							case 0xC1:
+								if len(message) == 7 {
+									cx := int16(binary.BigEndian.Uint16(message[1:]))
+									cy := int16(binary.BigEndian.Uint16(message[3:]))
+									mixed := binary.BigEndian.Uint16(message[5:])
+									colorIndex := uint8(mixed & 0x0F)
+									color := pixelcanvasioPalette[colorIndex] // colorIndex technically can't be >= 16, so it should be save
+									ox := int((mixed >> 4) & 0x3F)
+									oy := int((mixed >> 10) & 0x3F)
+									pixelcanvasioLog.Tracef("Pixelchange: color %v @ chunk %v, %v with offset %v, %v", colorIndex, cx, cy, ox, oy)
+									pos := image.Point{
+										X: int(cx)*pixelcanvasioChunkSize.X + ox,
+										Y: int(cy)*pixelcanvasioChunkSize.Y + oy,
+									}
+									if err := con.Canvas.setPixel(pos, color); err != nil {
+										pixelcanvasioLog.Debugf("Couldn't draw pixel at %v with color %v: %v", pos, colorIndex, err)
+									}
 								}
+							default:
+								pixelcanvasioLog.Errorf("Unknown websocket opcode: %v", opcode)
 							}
-						default:
-							log.Errorf("Unknown websocket opcode: %v", opcode)
-						}
 
+						}
 					}
-				}
-				log.Debugf("Websocket connection closed")
+				})
+				pixelcanvasioLog.Debugf("Websocket connection closed")
 				close(chunkDownloaderQuit)
 				close(quitChannel)
-				log.Trace("Waiting for downloads to finish")
+				pixelcanvasioLog.Trace("Waiting for downloads to finish")
 				downloadWaitgroup.Wait() // Wait until all chunk downloads are finished
-				log.Tracef("All downloads finished")
+				pixelcanvasioLog.Tracef("All downloads finished")
 
 				con.Canvas.invalidateAll()
 
@@ -364,10 +414,12 @@ func (con *connectionPixelcanvasio) authenticateMe() error {
 		Fingerprint: con.Fingerprint,
 	}
 
-	statusCode, _, body, err := postJSON("https://europe-west1-pixelcanvasv2.cloudfunctions.net/me", "https://pixelcanvas.io/", request)
+	sent := time.Now()
+	statusCode, headers, body, err := postJSON("https://europe-west1-pixelcanvasv2.cloudfunctions.net/me", pixelcanvasioURL+"/", request)
 	if err != nil {
 		return err
 	}
+	con.Canvas.Clock.observeResponse(headers, sent, time.Now())
 
 	response := &struct {
 		ID          string  `json:"id"`
@@ -390,7 +442,7 @@ func (con *connectionPixelcanvasio) authenticateMe() error {
 	con.AuthID = response.ID
 	con.AuthName = response.Name
 	con.Center.X, con.Center.Y = response.Center[0], response.Center[1]
-	con.NextPixel = time.Now().Add(time.Duration(response.WaitSeconds*1000) * time.Millisecond)
+	con.NextPixel = con.Canvas.Clock.now().Add(time.Duration(response.WaitSeconds*1000) * time.Millisecond)
 
 	return nil
 }
@@ -403,6 +455,16 @@ func (con *connectionPixelcanvasio) Close() {
 
 		con.QuitWaitgroup.Wait()
 
+		unregisterConnection(con)
+		if con.Statistics != nil {
+			con.Statistics.Close()
+		}
+		if con.Watcher != nil {
+			con.Watcher.Close()
+		}
+		if con.Heatmap != nil {
+			con.Heatmap.Close()
+		}
 		con.Canvas.Close()
 	}
 }
@@ -48,10 +48,12 @@ func Test_newPixelcanvasio(t *testing.T) {
 		t.Skip("Skipping testing in CI environment")
 	}
 
+	useTestRecordingsDir(t)
+
 	con, can := newPixelcanvasio()
 	defer con.Close()
 
-	cdw, err := can.newCanvasDiskWriter("pixelcanvas.io")
+	cdw, err := can.newCanvasDiskWriter("pixelcanvas.io", 0)
 	if err != nil {
 		t.Errorf("Can't create canvas disk writer: %v", err)
 	}
@@ -0,0 +1,452 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var pixelIndexLog = moduleLog("pixelindex")
+
+// Version of the file format, indexes of other versions are built again
+const pixelIndexVersion = 1
+
+const pixelIndexInfoFileName = "pixelindex.json"
+
+// Width and height of the tiles of the index in pixels. Every tile has its own file
+const pixelIndexTileSize = 64
+
+// Size of a single entry in a tile file
+const pixelIndexEntrySize = 16
+
+// Changes are written to the tile files once this many bytes are pending
+const pixelIndexFlushSize = 16 << 20
+
+// Flags of an entry
+const (
+	pixelIndexFlagFirst = 1 << iota // First known color of the pixel, not a change
+)
+
+// Index of the color changes of every pixel of the local recordings of a game.
+//
+// It answers which color a pixel had at some point in time and when it changed, without replaying the recordings.
+// The canvas is divided into tiles of pixelIndexTileSize, each stored as <Dir>/<x>_<y>.pixidx.
+// A tile file is a chronological list of entries of pixelIndexEntrySize bytes, one for every change of a pixel:
+//
+//	int64  Unix time in nanoseconds
+//	uint16 Offset of the pixel in the tile, y*pixelIndexTileSize + x
+//	uint8  Flags, see pixelIndexFlagFirst
+//	uint8  Unused
+//	[4]uint8 RGBA color
+//
+// The indexed recordings are listed in <Dir>/pixelindex.json, which is written after the tiles.
+// The index is only updated by update, queries read the files directly.
+type pixelIndex struct {
+	ShortName string
+	Dir       string
+
+	info  pixelIndexInfo
+	tiles map[image.Point]*pixelIndexTile // State of the tiles while updating
+}
+
+// Content of pixelindex.json
+type pixelIndexInfo struct {
+	Version    int
+	Recordings []pixelIndexRecording
+}
+
+type pixelIndexRecording struct {
+	FileName string
+	Events   int // Number of indexed events, recordings that are still written continue from there
+}
+
+// Current colors of a tile, and changes that aren't written yet
+type pixelIndexTile struct {
+	colors  [pixelIndexTileSize * pixelIndexTileSize]color.RGBA
+	known   [pixelIndexTileSize * pixelIndexTileSize]bool
+	pending []byte
+}
+
+// Summary of an update of the index
+type pixelIndexUpdate struct {
+	Recordings int  // Number of read recordings
+	Events     int  // Number of newly indexed events
+	Changes    int  // Number of newly indexed pixel changes
+	Rebuilt    bool // The existing index didn't fit to the recordings anymore, and was built again
+}
+
+// A change of a pixel
+type pixelIndexChange struct {
+	Time             time.Time
+	From, To         string `json:",omitempty"` // Colors in hex notation. From is empty for the first known color
+	FromName, ToName string `json:",omitempty"` // Names of the colors, see paletteNames
+}
+
+// Result of a query of a single pixel
+type pixelIndexQuery struct {
+	Pos        image.Point
+	Time       time.Time
+	Color      string             // Color at Time in hex notation, empty if nothing was recorded there until then
+	ColorName  string             `json:",omitempty"` // Name of the color, see paletteNames
+	Since      time.Time          // Point in time since when the pixel has this color
+	LastChange *pixelIndexChange  `json:",omitempty"` // Last change before Time, the first known color isn't counted
+	Changes    int                // Number of changes until Time
+	History    []pixelIndexChange `json:",omitempty"` // All changes until Time, if requested
+}
+
+// Opens the index of the local recordings of the game shortName, without reading or building anything yet
+func openPixelIndex(shortName string) (*pixelIndex, error) {
+	if shortName == "" || strings.ContainsAny(shortName, "/\\") || isCanvasClip(shortName) {
+		return nil, fmt.Errorf("Only local recordings can be indexed, got %q", shortName)
+	}
+
+	pi := &pixelIndex{
+		ShortName: shortName,
+		Dir:       cachePath(getPaths().Index, shortName),
+		info:      pixelIndexInfo{Version: pixelIndexVersion},
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(pi.Dir, pixelIndexInfoFileName))
+	if os.IsNotExist(err) {
+		return pi, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't read index of %v: %v", shortName, err)
+	}
+	if err := json.Unmarshal(data, &pi.info); err != nil {
+		pixelIndexLog.Warnf("Index of %v is damaged, it will be built again: %v", shortName, err)
+		pi.info = pixelIndexInfo{}
+	}
+
+	return pi, nil
+}
+
+// Returns whether the index contains any recording
+func (pi *pixelIndex) exists() bool {
+	return pi.info.Version == pixelIndexVersion && len(pi.info.Recordings) > 0
+}
+
+// Indexes the events of the recordings that were added or continued since the last update.
+// If recordings were removed or replaced, the index is built again from scratch.
+func (pi *pixelIndex) update() (pixelIndexUpdate, error) {
+	result := pixelIndexUpdate{}
+
+	recs, err := canvasDiskReaderFor(pi.ShortName).refreshRecordings()
+	if err != nil {
+		return result, fmt.Errorf("Can't get recordings of %v: %v", pi.ShortName, err)
+	}
+
+	// The indexed recordings must be the first of the current ones
+	valid := pi.info.Version == pixelIndexVersion && len(pi.info.Recordings) <= len(recs)
+	for i := 0; valid && i < len(pi.info.Recordings); i++ {
+		valid = pi.info.Recordings[i].FileName == recs[i].FileName
+	}
+	if !valid {
+		pixelIndexLog.Infof("Building the index of %v from scratch", pi.ShortName)
+		if err := os.RemoveAll(pi.Dir); err != nil {
+			return result, fmt.Errorf("Can't remove old index: %v", err)
+		}
+		pi.info = pixelIndexInfo{Version: pixelIndexVersion}
+		result.Rebuilt = true
+	}
+	if err := os.MkdirAll(pi.Dir, 0755); err != nil {
+		return result, fmt.Errorf("Can't create directory %v: %v", pi.Dir, err)
+	}
+
+	pi.tiles = map[image.Point]*pixelIndexTile{}
+	defer func() { pi.tiles = nil }()
+
+	// Continue with the last indexed recording, as it may have been written to since
+	first, skip := 0, 0
+	if n := len(pi.info.Recordings); n > 0 {
+		first, skip = n-1, pi.info.Recordings[n-1].Events
+	}
+
+	for i := first; i < len(recs); i++ {
+		events, changes, err := pi.indexRecording(recs[i].FileName, skip)
+		if err != nil {
+			return result, err
+		}
+		skip = 0
+
+		if err := pi.flush(); err != nil {
+			return result, err
+		}
+		if i < len(pi.info.Recordings) {
+			result.Events += events - pi.info.Recordings[i].Events
+			pi.info.Recordings[i].Events = events
+		} else {
+			result.Events += events
+			pi.info.Recordings = append(pi.info.Recordings, pixelIndexRecording{FileName: recs[i].FileName, Events: events})
+		}
+		result.Recordings++
+		result.Changes += changes
+
+		if err := pi.writeInfo(); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// Reads the recording, and adds the changes of all events after the first skip ones.
+// Returns the number of events in the recording, and the number of new changes.
+func (pi *pixelIndex) indexRecording(fileName string, skip int) (int, int, error) {
+	decoder, err := openCanvasDiskDecoder(fileName, getBackgroundSettings().getWorkers())
+	if err != nil {
+		return 0, 0, fmt.Errorf("Can't open recording %v: %v", fileName, err)
+	}
+	defer decoder.Close()
+
+	throttle := newBackgroundThrottle(backgroundThrottleInterval)
+
+	events, changes, pendingSize := 0, 0, 0
+	for {
+		t, event, err := decoder.next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return events, changes, nil
+		}
+		if err != nil {
+			return events, changes, fmt.Errorf("Error while reading recording %v: %v", fileName, err)
+		}
+		events++
+		if events <= skip {
+			continue
+		}
+
+		n := 0
+		switch event := event.(type) {
+		case canvasEventSetPixel:
+			if n, err = pi.setPixel(t, event.Pos, color.RGBAModel.Convert(event.Color).(color.RGBA)); err != nil {
+				return events, changes, err
+			}
+		case canvasEventSetImage:
+			if n, err = pi.setImage(t, event.Image); err != nil {
+				return events, changes, err
+			}
+		}
+		// Invalidations are ignored, the next image brings the changes in the meantime
+		changes += n
+
+		if pendingSize += n * pixelIndexEntrySize; pendingSize >= pixelIndexFlushSize {
+			if err := pi.flush(); err != nil {
+				return events, changes, err
+			}
+			pendingSize = 0
+		}
+		throttle.step()
+	}
+}
+
+// Returns the tile at the given tile coordinate, and loads its colors from the tile file if needed
+func (pi *pixelIndex) getTile(tilePos image.Point) (*pixelIndexTile, error) {
+	if tile, ok := pi.tiles[tilePos]; ok {
+		return tile, nil
+	}
+
+	tile := &pixelIndexTile{}
+	entries, err := readPixelIndexTile(pi.tileFileName(tilePos))
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i+pixelIndexEntrySize <= len(entries); i += pixelIndexEntrySize {
+		_, offset, _, col := decodePixelIndexEntry(entries[i:])
+		tile.colors[offset], tile.known[offset] = col, true
+	}
+
+	pi.tiles[tilePos] = tile
+	return tile, nil
+}
+
+// Adds an entry if the color of the pixel differs from its current color. Returns the number of added entries
+func (pi *pixelIndex) setPixel(t time.Time, pos image.Point, col color.RGBA) (int, error) {
+	tilePos := image.Point{divideFloor(pos.X, pixelIndexTileSize), divideFloor(pos.Y, pixelIndexTileSize)}
+	tile, err := pi.getTile(tilePos)
+	if err != nil {
+		return 0, err
+	}
+
+	offset := (pos.Y-tilePos.Y*pixelIndexTileSize)*pixelIndexTileSize + pos.X - tilePos.X*pixelIndexTileSize
+	if tile.known[offset] && tile.colors[offset] == col {
+		return 0, nil
+	}
+
+	flags := uint8(0)
+	if !tile.known[offset] {
+		flags |= pixelIndexFlagFirst
+	}
+	tile.colors[offset], tile.known[offset] = col, true
+	tile.pending = appendPixelIndexEntry(tile.pending, t, uint16(offset), flags, col)
+
+	return 1, nil
+}
+
+// Adds entries for all pixels of the image that differ from their current color. Returns the number of added entries
+func (pi *pixelIndex) setImage(t time.Time, img image.Image) (int, error) {
+	bounds, changes := img.Bounds(), 0
+
+	for iy := bounds.Min.Y; iy < bounds.Max.Y; iy++ {
+		for ix := bounds.Min.X; ix < bounds.Max.X; ix++ {
+			var col color.RGBA
+			switch img := img.(type) {
+			case *image.Paletted:
+				col = color.RGBAModel.Convert(img.Palette[img.ColorIndexAt(ix, iy)]).(color.RGBA)
+			case *image.RGBA:
+				col = img.RGBAAt(ix, iy)
+			default:
+				col = color.RGBAModel.Convert(img.At(ix, iy)).(color.RGBA)
+			}
+			n, err := pi.setPixel(t, image.Point{ix, iy}, col)
+			if err != nil {
+				return changes, err
+			}
+			changes += n
+		}
+	}
+
+	return changes, nil
+}
+
+// Appends the pending entries to the tile files
+func (pi *pixelIndex) flush() error {
+	for tilePos, tile := range pi.tiles {
+		if len(tile.pending) == 0 {
+			continue
+		}
+		fileName := pi.tileFileName(tilePos)
+		f, err := os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("Can't open tile file %v: %v", fileName, err)
+		}
+		_, err = f.Write(tile.pending)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("Can't write tile file %v: %v", fileName, err)
+		}
+		tile.pending = tile.pending[:0]
+	}
+
+	return nil
+}
+
+// Writes pixelindex.json, replacing the previous one at once
+func (pi *pixelIndex) writeInfo() error {
+	data, err := json.MarshalIndent(pi.info, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	fileName := filepath.Join(pi.Dir, pixelIndexInfoFileName)
+	if err := ioutil.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("Can't write index of %v: %v", pi.ShortName, err)
+	}
+	if err := os.Rename(fileName+".tmp", fileName); err != nil {
+		return fmt.Errorf("Can't write index of %v: %v", pi.ShortName, err)
+	}
+
+	return nil
+}
+
+func (pi *pixelIndex) tileFileName(tilePos image.Point) string {
+	return filepath.Join(pi.Dir, fmt.Sprintf("%d_%d.pixidx", tilePos.X, tilePos.Y))
+}
+
+// Returns the color of the pixel at pos at the point in time t, and when it changed.
+// Events at exactly t are included. A zero t returns the latest indexed color.
+// If history is true, all changes until t are returned too.
+func (pi *pixelIndex) query(pos image.Point, t time.Time, history bool) (pixelIndexQuery, error) {
+	result := pixelIndexQuery{Pos: pos, Time: t}
+	if !pi.exists() {
+		return result, fmt.Errorf("There is no index of %v yet, build it with the index command", pi.ShortName)
+	}
+
+	tilePos := image.Point{divideFloor(pos.X, pixelIndexTileSize), divideFloor(pos.Y, pixelIndexTileSize)}
+	offset := uint16((pos.Y-tilePos.Y*pixelIndexTileSize)*pixelIndexTileSize + pos.X - tilePos.X*pixelIndexTileSize)
+
+	entries, err := readPixelIndexTile(pi.tileFileName(tilePos))
+	if err != nil {
+		return result, err
+	}
+
+	names := getPaletteNames(conf, pi.ShortName)
+	for i := 0; i+pixelIndexEntrySize <= len(entries); i += pixelIndexEntrySize {
+		entryTime, entryOffset, flags, col := decodePixelIndexEntry(entries[i:])
+		if entryOffset != offset {
+			continue
+		}
+		if !t.IsZero() && entryTime.After(t) {
+			break
+		}
+
+		change := pixelIndexChange{Time: entryTime, To: paletteHex(col), ToName: names[paletteHex(col)]}
+		if flags&pixelIndexFlagFirst == 0 {
+			change.From, change.FromName = result.Color, result.ColorName
+			result.LastChange = &change
+			result.Changes++
+		}
+		if history {
+			result.History = append(result.History, change)
+		}
+		result.Color, result.ColorName, result.Since = change.To, change.ToName, entryTime
+	}
+
+	return result, nil
+}
+
+// Reads all complete entries of a tile file. A missing file has no entries
+func readPixelIndexTile(fileName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't read tile file %v: %v", fileName, err)
+	}
+
+	return data[:len(data)-len(data)%pixelIndexEntrySize], nil // An entry may be written at the moment
+}
+
+// Appends an entry to b
+func appendPixelIndexEntry(b []byte, t time.Time, offset uint16, flags uint8, col color.RGBA) []byte {
+	entry := [pixelIndexEntrySize]byte{}
+	binary.BigEndian.PutUint64(entry[0:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint16(entry[8:10], offset)
+	entry[10] = flags
+	entry[12], entry[13], entry[14], entry[15] = col.R, col.G, col.B, col.A
+	return append(b, entry[:]...)
+}
+
+func decodePixelIndexEntry(b []byte) (t time.Time, offset uint16, flags uint8, col color.RGBA) {
+	t = time.Unix(0, int64(binary.BigEndian.Uint64(b[0:8])))
+	offset = binary.BigEndian.Uint16(b[8:10])
+	flags = b[10]
+	col = color.RGBA{b[12], b[13], b[14], b[15]}
+	return
+}
@@ -0,0 +1,188 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+// Uses dir for the recordings and a temporary directory for the index, until the returned function is called
+func usePixelIndexPaths(t *testing.T, recordings string) func() {
+	old := getPaths()
+	settings := old
+	settings.Recordings, settings.Index = recordings, t.TempDir()
+	setPathSettings(settings)
+
+	return func() { setPathSettings(old) }
+}
+
+func Test_pixelIndexGolden(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Join("testdata", "recordings"))
+	if err != nil {
+		t.Fatalf("Can't get directory: %v", err)
+	}
+	defer usePixelIndexPaths(t, dir)()
+
+	pi, err := openPixelIndex("golden")
+	if err != nil {
+		t.Fatalf("Can't open index: %v", err)
+	}
+	if _, err := pi.query(image.Point{}, time.Time{}, false); err == nil {
+		t.Errorf("Query of a missing index succeeded")
+	}
+
+	result, err := pi.update()
+	if err != nil {
+		t.Fatalf("Can't build index: %v", err)
+	}
+	if result.Recordings != 1 || result.Events != 107 {
+		t.Errorf("update() = %+v, want 1 recording with 107 events", result)
+	}
+
+	// Changed by the last event that sets a pixel
+	pos, changed := image.Point{11, 10}, time.Date(2019, 6, 14, 12, 1, 46, 0, time.UTC)
+	before, err := pi.query(pos, changed.Add(-time.Second), false)
+	if err != nil {
+		t.Fatalf("Can't query %v: %v", pos, err)
+	}
+	if want := paletteHex(pixelcanvasioPalette[2].(color.RGBA)); before.Color != want || before.Changes != 0 || before.LastChange != nil {
+		t.Errorf("query(%v) before the change = %+v, want %v without changes", pos, before, want)
+	}
+	after, err := pi.query(pos, time.Time{}, true)
+	if err != nil {
+		t.Fatalf("Can't query %v: %v", pos, err)
+	}
+	want := pixelIndexChange{Time: changed, From: before.Color, To: paletteHex(pixelcanvasioPalette[6].(color.RGBA))}
+	if after.Color != want.To || after.Changes != 1 || after.LastChange == nil || !after.LastChange.Time.Equal(want.Time) || after.LastChange.From != want.From || len(after.History) != 2 {
+		t.Errorf("query(%v) = %+v, want last change %+v", pos, after, want)
+	}
+
+	// The index agrees with a replay of the recording
+	cfe, err := newCanvasFrameExtractor("golden")
+	if err != nil {
+		t.Fatalf("Can't create frame extractor: %v", err)
+	}
+	defer cfe.Close()
+	rect := image.Rect(-64, -64, 64, 64)
+	for _, frameTime := range []time.Time{time.Date(2019, 6, 14, 12, 0, 30, 500, time.UTC), time.Date(2019, 6, 14, 12, 1, 0, 500, time.UTC)} {
+		img, err := cfe.getFrame(frameTime, rect)
+		if err != nil {
+			t.Fatalf("Can't get frame at %v: %v", frameTime, err)
+		}
+		for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
+			for ix := rect.Min.X; ix < rect.Max.X; ix++ {
+				col := img.RGBAAt(ix, iy)
+				if col.A == 0 {
+					continue // Pixels of chunks that weren't downloaded are indexed, but not replayed
+				}
+				result, err := pi.query(image.Point{ix, iy}, frameTime, false)
+				if err != nil {
+					t.Fatalf("Can't query %v: %v", image.Point{ix, iy}, err)
+				}
+				if want := paletteHex(col); result.Color != want {
+					t.Fatalf("query(%v) at %v = %v, want %v", image.Point{ix, iy}, frameTime, result.Color, want)
+				}
+			}
+		}
+	}
+
+	// Nothing new to index
+	if result, err := pi.update(); err != nil || result.Events != 0 || result.Changes != 0 || result.Rebuilt {
+		t.Errorf("update() = %+v, %v, want nothing new", result, err)
+	}
+}
+
+func Test_pixelIndexUpdate(t *testing.T) {
+	dir := t.TempDir()
+	defer usePixelIndexPaths(t, dir)()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "recordings", "golden", "2019-06-14T120000.pixrec"))
+	if err != nil {
+		t.Fatalf("Can't read golden recording: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "game"), 0755); err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	first := filepath.Join(dir, "game", "2019-06-14T120000.pixrec")
+	if err := ioutil.WriteFile(first, data, 0644); err != nil {
+		t.Fatalf("Can't write recording: %v", err)
+	}
+
+	pi, err := openPixelIndex("game")
+	if err != nil {
+		t.Fatalf("Can't open index: %v", err)
+	}
+	if _, err := pi.update(); err != nil {
+		t.Fatalf("Can't build index: %v", err)
+	}
+
+	// A newer recording is added to the index
+	pos, changed := image.Point{11, 10}, time.Date(2019, 6, 14, 12, 5, 1, 0, time.UTC)
+	f, err := os.Create(filepath.Join(dir, "game", "2019-06-14T120500.pixrec"))
+	if err != nil {
+		t.Fatalf("Can't create recording: %v", err)
+	}
+	w, err := recording.NewWriter(f, "game", recording.Header{Time: changed.Add(-time.Second), ChunkSize: image.Point{64, 64}})
+	if err != nil {
+		t.Fatalf("Can't create recording writer: %v", err)
+	}
+	if err := w.WriteEvent(changed, recording.SetPixel{Pos: pos, Color: pixelcanvasioPalette[3].(color.RGBA)}); err != nil {
+		t.Errorf("Can't write event: %v", err)
+	}
+	w.Close()
+	f.Close()
+
+	result, err := pi.update()
+	if err != nil {
+		t.Fatalf("Can't update index: %v", err)
+	}
+	if result.Recordings != 2 || result.Events != 1 || result.Changes != 1 || result.Rebuilt {
+		t.Errorf("update() = %+v, want 1 new event with 1 change", result)
+	}
+
+	// The index is read again from the files
+	pi, err = openPixelIndex("game")
+	if err != nil {
+		t.Fatalf("Can't open index: %v", err)
+	}
+	query, err := pi.query(pos, time.Time{}, false)
+	if err != nil {
+		t.Fatalf("Can't query %v: %v", pos, err)
+	}
+	if want := paletteHex(pixelcanvasioPalette[3].(color.RGBA)); query.Color != want || query.Changes != 2 || !query.Since.Equal(changed) {
+		t.Errorf("query(%v) = %+v, want %v since %v after 2 changes", pos, query, want, changed)
+	}
+
+	// Removed recordings cause a rebuild
+	if err := os.Remove(first); err != nil {
+		t.Fatalf("Can't remove recording: %v", err)
+	}
+	if result, err := pi.update(); err != nil || !result.Rebuilt || result.Events != 1 {
+		t.Errorf("update() = %+v, %v, want a rebuild with 1 event", result, err)
+	}
+	if query, err := pi.query(pos, time.Time{}, false); err != nil || query.Changes != 0 || query.LastChange != nil {
+		t.Errorf("query(%v) = %+v, %v, want the first known color without changes", pos, query, err)
+	}
+}
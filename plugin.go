@@ -0,0 +1,402 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+
+	"github.com/sirupsen/logrus"
+)
+
+var pluginLog = moduleLog("plugin")
+
+// Settings of a plugin, stored in the configuration at .plugins.<name>.
+// Plugins are read once at the start, changes need a restart.
+type pluginSettings struct {
+	Kind    string   // "connection" or "listener"
+	Command []string // Program and its arguments
+
+	// Only for connections, the name of the plugin is the short name of the game
+	Name       string          // Full name of the game, for display purposes
+	ChunkSize  pixelSize       // Size of the chunks the plugin downloads
+	CanvasRect image.Rectangle // Area of the canvas that exists, everything else is ignored
+	Palette    []string        // Optional colors in hex notation, like "#E50000"
+
+	// Only for listeners
+	Games []string // Short names of the games the plugin is attached to, all games if this is empty
+}
+
+// Kinds of plugins
+const (
+	pluginKindConnection = "connection"
+	pluginKindListener   = "listener"
+)
+
+const (
+	pluginQueueSize    = 10000            // Maximum number of messages queued for a plugin
+	pluginSendTimeout  = 10 * time.Second // Time a message waits for space in the queue of a plugin, before sending it fails
+	pluginLineSize     = 64 << 20         // Maximum size of a message from a plugin, in bytes
+	pluginCloseTimeout = 5 * time.Second  // Time a plugin has to exit after its stdin is closed, before it's killed
+)
+
+func (s pluginSettings) validate() error {
+	if len(s.Command) == 0 || s.Command[0] == "" {
+		return fmt.Errorf("Missing command")
+	}
+
+	switch s.Kind {
+	case pluginKindConnection:
+		if s.ChunkSize.X <= 0 || s.ChunkSize.Y <= 0 {
+			return fmt.Errorf("Invalid chunk size %v", s.ChunkSize)
+		}
+		if s.CanvasRect.Empty() {
+			return fmt.Errorf("Canvas rectangle %v is empty", s.CanvasRect)
+		}
+		if _, err := (paletteSettings{Colors: s.Palette}).getPalette(); err != nil {
+			return err
+		}
+	case pluginKindListener:
+	default:
+		return fmt.Errorf("Unknown kind %q, must be %q or %q", s.Kind, pluginKindConnection, pluginKindListener)
+	}
+
+	return nil
+}
+
+// A message of the plugin protocol, as it is read from plugins.
+// Only the fields of the message's type are set, see the README for the types.
+type pluginMessage struct {
+	Type string `json:"type"`
+
+	Rect   string   `json:"rect"`   // In the form "x1,y1,x2,y2"
+	Rects  []string `json:"rects"`  // In the form "x1,y1,x2,y2"
+	X      int      `json:"x"`      // Position of a pixel
+	Y      int      `json:"y"`      // Position of a pixel
+	Color  string   `json:"color"`  // In hex notation, like "#E50000"
+	Author string   `json:"author"` // Identifier of the user that placed a pixel, optional
+	Pixels []struct {
+		X      int    `json:"x"`
+		Y      int    `json:"y"`
+		Color  string `json:"color"`
+		Author string `json:"author"`
+	} `json:"pixels"` // Several pixels at once
+	Image   []byte    `json:"image"`   // PNG file, base64 encoded in JSON
+	Players int       `json:"players"` // Number of online players
+	Level   string    `json:"level"`   // Log level, like "info"
+	Message string    `json:"message"` // Log message or reason of a failure
+	Time    time.Time `json:"time"`
+}
+
+// An external program that talks to D3pixelbot with JSON messages, one per line, over its stdin and stdout.
+// Everything it writes to stderr is logged.
+type pluginProcess struct {
+	Name string
+
+	cmd *exec.Cmd
+
+	queueChan   chan interface{} // Messages that are written to stdin
+	sendTimeout time.Duration    // See pluginSendTimeout
+
+	doneChan chan struct{} // Closed when the process exited
+	err      error         // Why the process exited, only valid after doneChan is closed
+	quitChan chan struct{}
+	closed   sync.Once
+}
+
+// Starts the plugin, and calls handler for every message the plugin writes, except for log messages.
+// handler is called from a single goroutine.
+func startPluginProcess(name string, command []string, handler func(msg pluginMessage)) (*pluginProcess, error) {
+	pp := &pluginProcess{
+		Name:        name,
+		cmd:         exec.Command(command[0], command[1:]...),
+		queueChan:   make(chan interface{}, memoryQueueSize(pluginQueueSize)),
+		sendTimeout: pluginSendTimeout,
+		doneChan:    make(chan struct{}),
+		quitChan:    make(chan struct{}),
+	}
+
+	stdin, err := pp.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := pp.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := pp.cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := pp.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Can't start plugin %v: %v", name, err)
+	}
+	pluginLog.Infof("Started plugin %v", name)
+
+	// Writes the queued messages, and closes stdin to signal the plugin to exit
+	go func() {
+		defer stdin.Close()
+		encoder := json.NewEncoder(stdin)
+		for {
+			select {
+			case msg := <-pp.queueChan:
+				if err := encoder.Encode(msg); err != nil {
+					pluginLog.Warnf("Can't write to plugin %v: %v", name, err)
+					return
+				}
+			case <-pp.quitChan:
+				return
+			}
+		}
+	}()
+
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			pluginLog.Infof("%v: %s", name, scanner.Bytes())
+		}
+	}()
+
+	go func() {
+		defer close(pp.doneChan)
+
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, pluginLineSize)
+		for scanner.Scan() {
+			msg := pluginMessage{}
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+				pluginLog.Warnf("Invalid message from plugin %v: %v", name, err)
+				continue
+			}
+			if msg.Type == "log" {
+				level, err := logrus.ParseLevel(msg.Level)
+				if err != nil {
+					level = logrus.InfoLevel
+				}
+				pluginLog.Logf(level, "%v: %v", name, msg.Message)
+				continue
+			}
+			handler(msg)
+		}
+		if err := scanner.Err(); err != nil {
+			pluginLog.Warnf("Can't read from plugin %v: %v", name, err)
+			io.Copy(ioutil.Discard, stdout) // Don't block the plugin, while waiting for it to exit
+		}
+		<-stderrDone
+		pp.err = pp.cmd.Wait()
+	}()
+
+	return pp, nil
+}
+
+// Queues a message for the plugin, it's marshalled to JSON.
+// If the queue is full, this waits until there is space again.
+// It fails if the plugin exited, or if it didn't read any message within pluginSendTimeout. In that case the message isn't sent.
+func (pp *pluginProcess) send(msg interface{}) error {
+	select {
+	case pp.queueChan <- msg:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(pp.sendTimeout)
+	defer timer.Stop()
+
+	select {
+	case pp.queueChan <- msg:
+		return nil
+	case <-pp.doneChan:
+		return fmt.Errorf("Plugin %v exited", pp.Name)
+	case <-pp.quitChan:
+		return fmt.Errorf("Plugin %v is closed", pp.Name)
+	case <-timer.C:
+		return fmt.Errorf("Plugin %v didn't read its messages for %v", pp.Name, pp.sendTimeout)
+	}
+}
+
+// Returns a channel that is closed when the plugin exited
+func (pp *pluginProcess) done() <-chan struct{} {
+	return pp.doneChan
+}
+
+// Close closes stdin of the plugin, and waits until it exits. It's killed if that takes too long
+func (pp *pluginProcess) Close() {
+	pp.closed.Do(func() {
+		close(pp.quitChan)
+
+		select {
+		case <-pp.doneChan:
+		case <-time.After(pluginCloseTimeout):
+			pluginLog.Warnf("Plugin %v didn't exit in time, killing it", pp.Name)
+			pp.cmd.Process.Kill()
+			<-pp.doneChan
+		}
+
+		if pp.err != nil {
+			pluginLog.Warnf("Plugin %v exited: %v", pp.Name, pp.err)
+		} else {
+			pluginLog.Infof("Plugin %v exited", pp.Name)
+		}
+	})
+}
+
+// Encodes the image as PNG, for messages to plugins
+func pluginEncodeImage(img image.Image) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decodes a PNG file of a plugin, and moves it to rect
+func pluginDecodeImage(data []byte, rect image.Rectangle) (image.Image, error) {
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if src.Bounds().Size() != rect.Size() {
+		return nil, fmt.Errorf("Image has size %v, but rectangle %v has size %v", src.Bounds().Size(), rect, rect.Size())
+	}
+
+	img := image.NewRGBA(rect)
+	draw.Draw(img, rect, src, src.Bounds().Min, draw.Src)
+
+	return img, nil
+}
+
+// Parses a color in hex notation, like "#E50000"
+func pluginParseColor(s string) (color.Color, error) {
+	pal, err := (paletteSettings{Colors: []string{s}}).getPalette()
+	if err != nil {
+		return nil, err
+	}
+	return pal[0], nil
+}
+
+// Checks that an author identifier fits into recordings
+func pluginCheckAuthor(author string) error {
+	if len(author) > recording.MaxAuthorSize {
+		return fmt.Errorf("Author %q is longer than %v bytes", author, recording.MaxAuthorSize)
+	}
+	return nil
+}
+
+// Listener plugins by their name, read from the configuration at the start
+var pluginListeners = struct {
+	sync.Mutex
+	settings map[string]pluginSettings
+	attached map[connection][]*canvasPluginListener
+}{
+	settings: map[string]pluginSettings{},
+	attached: map[connection][]*canvasPluginListener{},
+}
+
+// Registers the plugins of the configuration at .plugins.
+// Connections are added to the connection types, listeners are attached to every game that is opened afterwards.
+func registerPlugins(plugins map[string]pluginSettings) {
+	names := []string{}
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		settings := plugins[name]
+		if err := settings.validate(); err != nil {
+			pluginLog.Errorf("Invalid plugin at .plugins.%v: %v", name, err)
+			continue
+		}
+
+		switch settings.Kind {
+		case pluginKindConnection:
+			if _, ok := connectionTypes[name]; ok {
+				pluginLog.Errorf("Plugin %v has the same name as an existing game", name)
+				continue
+			}
+			registerConnectionPlugin(name, settings)
+		case pluginKindListener:
+			pluginListeners.Lock()
+			pluginListeners.settings[name] = settings
+			pluginListeners.Unlock()
+		}
+		pluginLog.Infof("Registered %v plugin %v", settings.Kind, name)
+	}
+}
+
+// Starts the listener plugins for the game of the connection. Called by registerConnection
+func attachListenerPlugins(con connection, can *canvas) {
+	pluginListeners.Lock()
+	defer pluginListeners.Unlock()
+
+	if len(pluginListeners.settings) == 0 {
+		return
+	}
+
+	names := []string{}
+	for name := range pluginListeners.settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		settings := pluginListeners.settings[name]
+		attach := len(settings.Games) == 0
+		for _, game := range settings.Games {
+			if game == con.getShortName() {
+				attach = true
+			}
+		}
+		if !attach {
+			continue
+		}
+		cpl, err := can.newCanvasPluginListener(name, con, settings)
+		if err != nil {
+			pluginLog.Errorf("Can't attach plugin %v to %v: %v", name, con.getShortName(), err)
+			continue
+		}
+		pluginListeners.attached[con] = append(pluginListeners.attached[con], cpl)
+	}
+}
+
+// Stops the listener plugins of the connection. Called by unregisterConnection
+func detachListenerPlugins(con connection) {
+	pluginListeners.Lock()
+	listeners := pluginListeners.attached[con]
+	delete(pluginListeners.attached, con)
+	pluginListeners.Unlock()
+
+	for _, cpl := range listeners {
+		cpl.Close()
+	}
+}
@@ -0,0 +1,282 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Environment variables of the test plugin, see Test_pluginHelperProcess
+const (
+	pluginTestModeEnv   = "D3PIXELBOT_TEST_PLUGIN"     // "connection" or "listener"
+	pluginTestOutputEnv = "D3PIXELBOT_TEST_PLUGIN_OUT" // File the listener appends the types of its messages to
+)
+
+// Runs as plugin, if the test binary is started by the plugin tests
+func Test_pluginHelperProcess(t *testing.T) {
+	mode := os.Getenv(pluginTestModeEnv)
+	if mode == "" {
+		return
+	}
+	defer os.Exit(0)
+
+	encoder := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, pluginLineSize)
+	for scanner.Scan() {
+		msg := struct {
+			Type string `json:"type"`
+			Rect string `json:"rect"`
+		}{}
+		json.Unmarshal(scanner.Bytes(), &msg)
+
+		switch mode {
+		case "connection":
+			switch msg.Type {
+			case "hello":
+				encoder.Encode(map[string]interface{}{"type": "players", "players": 7})
+				encoder.Encode(map[string]interface{}{"type": "log", "level": "debug", "message": "Hello"})
+			case "download":
+				rect, _ := parseRectangle(msg.Rect)
+				img := image.NewRGBA(image.Rectangle{Max: rect.Size()})
+				for i := range img.Pix {
+					img.Pix[i] = 255 // White
+				}
+				data, _ := pluginEncodeImage(img)
+				encoder.Encode(map[string]interface{}{"type": "image", "rect": msg.Rect, "image": data})
+				encoder.Encode(map[string]interface{}{"type": "pixel", "x": rect.Min.X, "y": rect.Min.Y, "color": "#E50000"})
+			}
+		case "listener":
+			if msg.Type == "hello" {
+				encoder.Encode(map[string]interface{}{"type": "rects", "rects": []string{"0,0,64,64"}})
+			}
+			file, err := os.OpenFile(os.Getenv(pluginTestOutputEnv), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			fmt.Fprintln(file, msg.Type)
+			file.Close()
+		}
+	}
+}
+
+func Test_pluginSettings(t *testing.T) {
+	tests := []struct {
+		settings pluginSettings
+		wantErr  bool
+	}{
+		{pluginSettings{Kind: "listener", Command: []string{"plugin"}}, false},
+		{pluginSettings{Kind: "connection", Command: []string{"plugin"}, ChunkSize: pixelSize{64, 64}, CanvasRect: image.Rect(0, 0, 64, 64)}, false},
+		{pluginSettings{Kind: "connection", Command: []string{"plugin"}, CanvasRect: image.Rect(0, 0, 64, 64)}, true},
+		{pluginSettings{Kind: "connection", Command: []string{"plugin"}, ChunkSize: pixelSize{64, 64}}, true},
+		{pluginSettings{Kind: "connection", Command: []string{"plugin"}, ChunkSize: pixelSize{64, 64}, CanvasRect: image.Rect(0, 0, 64, 64), Palette: []string{"red"}}, true},
+		{pluginSettings{Kind: "listener"}, true},
+		{pluginSettings{Kind: "bot", Command: []string{"plugin"}}, true},
+		{pluginSettings{Kind: "", Command: []string{"plugin"}}, true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.settings.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate() of %+v returned %v, want error: %v", tt.settings, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_pluginConnection(t *testing.T) {
+	os.Setenv(pluginTestModeEnv, "connection")
+	defer os.Unsetenv(pluginTestModeEnv)
+
+	registerPlugins(map[string]pluginSettings{
+		"plugintest": {
+			Kind:       pluginKindConnection,
+			Command:    []string{os.Args[0], "-test.run=^Test_pluginHelperProcess$"},
+			Name:       "Plugin test",
+			ChunkSize:  pixelSize{16, 16},
+			CanvasRect: image.Rect(0, 0, 64, 64),
+		},
+	})
+	defer delete(connectionTypes, "plugintest")
+
+	as := newAPIServer()
+	defer as.Close()
+
+	img, valid, err := as.getImage("plugintest", image.Rect(0, 0, 32, 32), nil)
+	if err != nil {
+		t.Fatalf("Can't get image of plugin: %v", err)
+	}
+	if !valid {
+		t.Fatalf("Plugin didn't answer the download requests")
+	}
+
+	// The plugin sets the upper left pixel of every chunk after its image
+	deadline := time.Now().Add(10 * time.Second)
+	for img.RGBAAt(16, 16) != (color.RGBA{0xE5, 0, 0, 255}) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		img, _, _ = as.getImage("plugintest", image.Rect(0, 0, 32, 32), nil)
+	}
+	if c := img.RGBAAt(16, 16); c != (color.RGBA{0xE5, 0, 0, 255}) {
+		t.Errorf("Got color %v at 16,16, want the pixel of the plugin", c)
+	}
+	if c := img.RGBAAt(17, 17); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("Got color %v at 17,17, want the image of the plugin", c)
+	}
+
+	game, _ := as.getGame("plugintest")
+	for game.Connection.getOnlinePlayers() != 7 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if players := game.Connection.getOnlinePlayers(); players != 7 {
+		t.Errorf("Got %v online players, want 7", players)
+	}
+}
+
+func Test_pluginListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "D3pixelbot-Test-Plugin")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "messages.txt")
+
+	os.Setenv(pluginTestModeEnv, "listener")
+	defer os.Unsetenv(pluginTestModeEnv)
+	os.Setenv(pluginTestOutputEnv, output)
+	defer os.Unsetenv(pluginTestOutputEnv)
+
+	registerPlugins(map[string]pluginSettings{
+		"listenertest": {
+			Kind:    pluginKindListener,
+			Command: []string{os.Args[0], "-test.run=^Test_pluginHelperProcess$"},
+			Games:   []string{"load"},
+		},
+	})
+	defer func() {
+		pluginListeners.Lock()
+		delete(pluginListeners.settings, "listenertest")
+		pluginListeners.Unlock()
+	}()
+
+	con := newConnectionLoad(connectionLoadSettings{PixelRate: 1000})
+	closed := false
+	defer func() {
+		if !closed {
+			con.close()
+		}
+	}()
+
+	// The plugin registers its rectangle, so the load generator downloads chunks and sets pixels in it
+	want := []string{"hello", "download", "image", "pixel"}
+	var got []string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, _ := ioutil.ReadFile(output)
+		got = strings.Fields(string(data))
+		found := 0
+		for _, w := range want {
+			for _, g := range got {
+				if g == w {
+					found++
+					break
+				}
+			}
+		}
+		if found == len(want) {
+			break
+		}
+	}
+	if len(got) == 0 || got[0] != "hello" {
+		t.Fatalf("Got messages %v, want hello first", got)
+	}
+	for _, w := range want {
+		if !strings.Contains(" "+strings.Join(got, " ")+" ", " "+w+" ") {
+			t.Errorf("Plugin didn't get a %q message, got %v", w, got)
+		}
+	}
+
+	con.close()
+	closed = true
+	pluginListeners.Lock()
+	attached := len(pluginListeners.attached)
+	pluginListeners.Unlock()
+	if attached != 0 {
+		t.Errorf("%v connections still have plugins attached after closing", attached)
+	}
+}
+
+// A listener plugin that stops reading misses events, so it's resynchronized once it reads again
+func Test_pluginListenerResync(t *testing.T) {
+	can, _ := newCanvas(pixelSize{16, 16}, image.Point{}, image.Rect(0, 0, 64, 64))
+	defer can.Close()
+	rect := image.Rect(0, 0, 16, 16)
+	can.signalDownload(rect)
+	can.setImage(image.NewRGBA(rect), false, false)
+
+	// Process without a program, the test reads its queue
+	pp := &pluginProcess{
+		Name:        "resynctest",
+		queueChan:   make(chan interface{}, 1),
+		sendTimeout: 200 * time.Millisecond,
+		doneChan:    make(chan struct{}),
+		quitChan:    make(chan struct{}),
+	}
+	cpl := &canvasPluginListener{Name: "resynctest", Canvas: can, Process: pp, readyChan: make(chan struct{})}
+	close(cpl.readyChan)
+
+	// The image of the subscription fills the queue, the time doesn't fit anymore
+	if err := can.subscribeListener(cpl, false); err != nil {
+		t.Fatalf("Can't subscribe listener: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); atomic.LoadInt32(&cpl.outOfSync) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&cpl.outOfSync) == 0 {
+		t.Fatalf("Listener isn't out of sync, after its plugin stopped reading")
+	}
+
+	// Reading again resynchronizes the plugin
+	var got []string
+	for deadline := time.After(10 * time.Second); len(got) < 4; {
+		select {
+		case msg := <-pp.queueChan:
+			data, _ := json.Marshal(msg)
+			typ := struct {
+				Type string `json:"type"`
+			}{}
+			json.Unmarshal(data, &typ)
+			got = append(got, typ.Type)
+		case <-deadline:
+			t.Fatalf("Got messages %v, want the plugin to be resynchronized", got)
+		}
+	}
+	if want := []string{"image", "invalidateAll", "image", "time"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Got messages %v, want %v", got, want)
+	}
+
+	close(pp.doneChan)
+	cpl.Close()
+}
@@ -0,0 +1,245 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+)
+
+// A game whose canvas is provided by a connection plugin.
+//
+// The plugin gets these messages on its stdin:
+//
+//	{"type": "hello", "game": "mygame"}
+//	{"type": "download", "rect": "0,0,64,64"}
+//
+// and answers with these messages on its stdout, also unrequested ones for changes:
+//
+//	{"type": "image", "rect": "0,0,64,64", "image": "<base64 PNG>"}
+//	{"type": "pixel", "x": 1, "y": 2, "color": "#E50000"}
+//	{"type": "failed", "rect": "0,0,64,64", "message": "Server error"}
+//	{"type": "invalidate", "rect": "0,0,64,64"}
+//	{"type": "invalidateAll"}
+//	{"type": "players", "players": 123}
+//
+// A download request is answered with image or failed, the rectangle is always a whole chunk.
+type connectionPlugin struct {
+	ShortName string
+	Settings  pluginSettings
+
+	Canvas     *canvas
+	Statistics *canvasStatistics // Counts the activity, independent of recordings
+	Watcher    *canvasWatcher    // Alerts on activity in watched regions, independent of bots
+	Heatmap    *canvasHeatmap    // Counts the changes per pixel or chunk in a sliding window, independent of recordings
+	Process    *pluginProcess
+
+	OnlinePlayers      int
+	OnlinePlayersMutex sync.RWMutex
+
+	GoroutineQuit     chan struct{} // Closing this channel stops the goroutines
+	QuitWaitgroup     sync.WaitGroup
+	ChunkDownloadChan <-chan *chunk // Receives download requests from the canvas
+	readyChan         chan struct{} // Closed once the connection is set up, messages of the plugin wait for it
+
+	singleton *refCountingSingleton // Shares the connection, the plugin is started once
+}
+
+// Adds the connection plugin to the connection types, so it can be used like any other game
+func registerConnectionPlugin(shortName string, settings pluginSettings) {
+	singleton := &refCountingSingleton{}
+
+	connectionTypes[shortName] = connectionType{
+		Name: settings.Name,
+		FunctionNew: func() (connection, *canvas) {
+			con := singleton.get(func() interface{} { return newConnectionPlugin(shortName, settings, singleton) }).(*connectionPlugin)
+			return con, con.Canvas
+		},
+	}
+}
+
+func newConnectionPlugin(shortName string, settings pluginSettings, singleton *refCountingSingleton) *connectionPlugin {
+	con := &connectionPlugin{
+		ShortName:     shortName,
+		Settings:      settings,
+		GoroutineQuit: make(chan struct{}),
+		readyChan:     make(chan struct{}),
+		singleton:     singleton,
+	}
+	defer close(con.readyChan)
+
+	con.Canvas, con.ChunkDownloadChan = newCanvas(settings.ChunkSize, image.Point{}, settings.CanvasRect)
+	con.Canvas.Authors = true // Plugins may report who placed pixels
+	if pal, _ := (paletteSettings{Colors: settings.Palette}).getPalette(); pal != nil {
+		con.Canvas.Palette.setPalette(pal)
+	}
+
+	var err error
+	if con.Process, err = startPluginProcess(shortName, settings.Command, con.handleMessage); err != nil {
+		pluginLog.Errorf("%v", err)
+	} else if err := con.Process.send(struct {
+		Type string `json:"type"`
+		Game string `json:"game"`
+	}{"hello", shortName}); err != nil {
+		pluginLog.Warnf("Can't greet plugin %v: %v", shortName, err)
+	}
+
+	con.Statistics, _ = con.Canvas.newCanvasStatistics(conf, shortName)
+	con.Watcher, _ = con.Canvas.newCanvasWatcher(conf, shortName)
+	con.Heatmap, _ = con.Canvas.newCanvasHeatmap(conf, shortName)
+	registerConnection(con, con.Canvas)
+
+	con.QuitWaitgroup.Add(1)
+	go func() {
+		defer con.QuitWaitgroup.Done()
+
+		var doneChan <-chan struct{}
+		if con.Process != nil {
+			doneChan = con.Process.done()
+		}
+
+		for {
+			select {
+			case <-con.GoroutineQuit:
+				return
+			case <-doneChan:
+				pluginLog.Errorf("Plugin %v exited, the canvas isn't updated anymore", shortName)
+				doneChan = nil
+			case chu := <-con.ChunkDownloadChan:
+				if con.Process == nil || chu.getQueryState(false, 0) != chunkDownload {
+					break
+				}
+				con.Canvas.signalDownload(chu.Rect)
+				if err := con.Process.send(pluginRectMessage{"download", formatRectangle(chu.Rect)}); err != nil {
+					con.Canvas.signalDownloadFailed(chu.Rect, err) // The chunk is requested again later
+				}
+			}
+		}
+	}()
+
+	return con
+}
+
+// Handles the messages of the plugin
+func (con *connectionPlugin) handleMessage(msg pluginMessage) {
+	<-con.readyChan
+
+	var rect image.Rectangle
+	switch msg.Type {
+	case "image", "failed", "invalidate":
+		var err error
+		if rect, err = parseRectangle(msg.Rect); err != nil {
+			pluginLog.Warnf("Invalid rectangle from plugin %v: %v", con.ShortName, err)
+			return
+		}
+	}
+
+	var err error
+	switch msg.Type {
+	case "image":
+		var img image.Image
+		if img, err = pluginDecodeImage(msg.Image, rect); err == nil {
+			err = con.Canvas.setImage(img, false, true)
+		}
+	case "pixel":
+		var col color.Color
+		if col, err = pluginParseColor(msg.Color); err == nil {
+			if err = pluginCheckAuthor(msg.Author); err == nil {
+				con.Canvas.setPixelAuthor(image.Point{msg.X, msg.Y}, col, msg.Author) // Fails for pixels that aren't downloaded, they are ignored
+			}
+		}
+	case "pixels":
+		pixels := make([]pixelUpdate, 0, len(msg.Pixels))
+		for _, pixel := range msg.Pixels {
+			var col color.Color
+			if col, err = pluginParseColor(pixel.Color); err != nil {
+				break
+			}
+			if err = pluginCheckAuthor(pixel.Author); err != nil {
+				break
+			}
+			pixels = append(pixels, pixelUpdate{image.Point{pixel.X, pixel.Y}, col, pixel.Author})
+		}
+		if err == nil {
+			con.Canvas.setPixels(pixels) // Fails for pixels that aren't downloaded, they are ignored
+		}
+	case "failed":
+		err = con.Canvas.signalDownloadFailed(rect, fmt.Errorf("%v", msg.Message))
+	case "invalidate":
+		err = con.Canvas.invalidateRect(rect)
+	case "invalidateAll":
+		err = con.Canvas.invalidateAll()
+	case "players":
+		con.OnlinePlayersMutex.Lock()
+		con.OnlinePlayers = msg.Players
+		con.OnlinePlayersMutex.Unlock()
+	default:
+		err = fmt.Errorf("Unknown message type %q", msg.Type)
+	}
+	if err != nil {
+		pluginLog.Warnf("Can't handle %q message of plugin %v: %v", msg.Type, con.ShortName, err)
+	}
+}
+
+func (con *connectionPlugin) getShortName() string {
+	return con.ShortName
+}
+
+func (con *connectionPlugin) getName() string {
+	if con.Settings.Name != "" {
+		return con.Settings.Name
+	}
+	return con.ShortName
+}
+
+func (con *connectionPlugin) getOnlinePlayers() int {
+	con.OnlinePlayersMutex.RLock()
+	defer con.OnlinePlayersMutex.RUnlock()
+
+	return con.OnlinePlayers
+}
+
+// Closes connection and canvas
+func (con *connectionPlugin) Close() {
+	if con.singleton.release(con) {
+		con.close()
+	}
+}
+
+// Stops the plugin and the goroutine, and closes the canvas
+func (con *connectionPlugin) close() {
+	close(con.GoroutineQuit)
+
+	con.QuitWaitgroup.Wait()
+
+	unregisterConnection(con)
+	if con.Process != nil {
+		con.Process.Close()
+	}
+	if con.Statistics != nil {
+		con.Statistics.Close()
+	}
+	if con.Watcher != nil {
+		con.Watcher.Close()
+	}
+	if con.Heatmap != nil {
+		con.Heatmap.Close()
+	}
+	con.Canvas.Close()
+}
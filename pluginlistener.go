@@ -0,0 +1,262 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Forwards the events of a canvas to a listener plugin.
+//
+// The plugin gets these messages on its stdin:
+//
+//	{"type": "hello", "game": "pixelcanvasio", "name": "PixelCanvas.io", "version": "0.1.4"}
+//	{"type": "image", "rect": "0,0,64,64", "valid": true, "image": "<base64 PNG>"}
+//	{"type": "pixel", "x": 1, "y": 2, "color": "#E50000"}
+//	{"type": "download", "rect": "0,0,64,64"}
+//	{"type": "invalidate", "rect": "0,0,64,64"}
+//	{"type": "revalidate", "rect": "0,0,64,64"}
+//	{"type": "invalidateAll"}
+//	{"type": "time", "time": "2019-06-14T12:00:00Z"}
+//
+// Only events of the rectangles the plugin asked for are sent, it does so by writing
+//
+//	{"type": "rects", "rects": ["0,0,256,256"]}
+//
+// If the plugin doesn't keep up with the events, it gets an invalidateAll message once it reads again, followed by all images, see resync.
+type canvasPluginListener struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	Name    string
+	Canvas  *canvas
+	Process *pluginProcess
+
+	outOfSync  int32 // 1 while the plugin misses events, until it's resynchronized. Accessed atomically
+	rects      []image.Rectangle
+	rectsMutex sync.Mutex
+
+	readyChan chan struct{} // Closed once the listener is subscribed, messages of the plugin wait for it
+}
+
+func (can *canvas) newCanvasPluginListener(name string, con connection, settings pluginSettings) (*canvasPluginListener, error) {
+	cpl := &canvasPluginListener{
+		Name:      name + "@" + con.getShortName(),
+		Canvas:    can,
+		readyChan: make(chan struct{}),
+	}
+	defer close(cpl.readyChan)
+
+	process, err := startPluginProcess(cpl.Name, settings.Command, cpl.handleMessage)
+	if err != nil {
+		return nil, err
+	}
+	cpl.Process = process
+
+	if err := process.send(struct {
+		Type    string `json:"type"`
+		Game    string `json:"game"`
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}{"hello", con.getShortName(), con.getName(), version.String()}); err != nil {
+		pluginLog.Warnf("Can't greet plugin %v: %v", cpl.Name, err)
+	}
+
+	if err := can.subscribeListener(cpl, false); err != nil {
+		cpl.Closed = true
+		process.Close()
+		return nil, err
+	}
+
+	return cpl, nil
+}
+
+// Handles the messages of the plugin
+func (cpl *canvasPluginListener) handleMessage(msg pluginMessage) {
+	<-cpl.readyChan
+
+	switch msg.Type {
+	case "rects":
+		rects := []image.Rectangle{}
+		for _, s := range msg.Rects {
+			rect, err := parseRectangle(s)
+			if err != nil {
+				pluginLog.Warnf("Invalid rectangle from plugin %v: %v", cpl.Name, err)
+				return
+			}
+			rects = append(rects, rect)
+		}
+
+		cpl.rectsMutex.Lock()
+		cpl.rects = rects
+		cpl.rectsMutex.Unlock()
+
+		cpl.ClosedMutex.RLock()
+		defer cpl.ClosedMutex.RUnlock()
+		if cpl.Closed {
+			return
+		}
+		if err := cpl.Canvas.registerRects(cpl, rects); err != nil {
+			pluginLog.Warnf("Can't register rectangles of plugin %v: %v", cpl.Name, err)
+		}
+	default:
+		pluginLog.Warnf("Unknown message type %q from plugin %v", msg.Type, cpl.Name)
+	}
+}
+
+// Message with only a type and a rectangle
+type pluginRectMessage struct {
+	Type string `json:"type"`
+	Rect string `json:"rect"`
+}
+
+// Sends an event to the plugin.
+// If that fails, the plugin is out of sync. Further events are dropped, and the plugin is resynchronized in the background.
+func (cpl *canvasPluginListener) send(msg interface{}) error {
+	if atomic.LoadInt32(&cpl.outOfSync) != 0 {
+		return nil
+	}
+
+	if err := cpl.Process.send(msg); err != nil {
+		if atomic.CompareAndSwapInt32(&cpl.outOfSync, 0, 1) {
+			go cpl.resync()
+		}
+		return err
+	}
+	return nil
+}
+
+// Resubscribes the plugin after it missed events.
+// It gets an invalidateAll message, followed by all images and its rectangles are registered again, like after it was started.
+// If it doesn't read the invalidateAll message in time either, it's stopped.
+func (cpl *canvasPluginListener) resync() {
+	cpl.ClosedMutex.RLock()
+	defer cpl.ClosedMutex.RUnlock()
+	if cpl.Closed {
+		return
+	}
+
+	pluginLog.Warnf("Plugin %v missed events, resynchronizing it", cpl.Name)
+
+	// Events that are still queued are dropped, as the plugin is out of sync
+	cpl.Canvas.unsubscribeListener(cpl)
+
+	if err := cpl.Process.send(struct {
+		Type string `json:"type"`
+	}{"invalidateAll"}); err != nil {
+		pluginLog.Errorf("Stopping plugin %v, as it can't be resynchronized: %v", cpl.Name, err)
+		go cpl.Close() // Close waits for the lock that is held here
+		return
+	}
+
+	atomic.StoreInt32(&cpl.outOfSync, 0)
+	if err := cpl.Canvas.subscribeListener(cpl, false); err != nil {
+		pluginLog.Errorf("Can't resubscribe plugin %v: %v", cpl.Name, err)
+		return
+	}
+
+	cpl.rectsMutex.Lock()
+	rects := cpl.rects
+	cpl.rectsMutex.Unlock()
+	if err := cpl.Canvas.registerRects(cpl, rects); err != nil {
+		pluginLog.Warnf("Can't register rectangles of plugin %v: %v", cpl.Name, err)
+	}
+}
+
+func (cpl *canvasPluginListener) handleInvalidateAll() error {
+	return cpl.send(struct {
+		Type string `json:"type"`
+	}{"invalidateAll"})
+}
+
+func (cpl *canvasPluginListener) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return cpl.send(pluginRectMessage{"invalidate", formatRectangle(rect)})
+}
+
+func (cpl *canvasPluginListener) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return cpl.send(pluginRectMessage{"revalidate", formatRectangle(rect)})
+}
+
+func (cpl *canvasPluginListener) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	data, err := pluginEncodeImage(img)
+	if err != nil {
+		return fmt.Errorf("Can't encode image for plugin %v: %v", cpl.Name, err)
+	}
+
+	return cpl.send(struct {
+		Type  string `json:"type"`
+		Rect  string `json:"rect"`
+		Valid bool   `json:"valid"`
+		Image []byte `json:"image"`
+	}{"image", formatRectangle(img.Bounds()), valid, data})
+}
+
+func (cpl *canvasPluginListener) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	return cpl.handleSetPixelIndex(pos, col, -1, vcID)
+}
+
+// Pixels have the index of their color in the palette of the game, if it's known
+func (cpl *canvasPluginListener) handleSetPixelIndex(pos image.Point, col color.Color, index int, vcID int) error {
+	c := color.NRGBAModel.Convert(col).(color.NRGBA)
+	msg := struct {
+		Type  string `json:"type"`
+		X     int    `json:"x"`
+		Y     int    `json:"y"`
+		Color string `json:"color"`
+		Index *int   `json:"index,omitempty"`
+	}{Type: "pixel", X: pos.X, Y: pos.Y, Color: fmt.Sprintf("#%02X%02X%02X", c.R, c.G, c.B)}
+	if index >= 0 {
+		msg.Index = &index
+	}
+	return cpl.send(msg)
+}
+
+func (cpl *canvasPluginListener) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return cpl.send(pluginRectMessage{"download", formatRectangle(rect)})
+}
+
+func (cpl *canvasPluginListener) handleSetTime(t time.Time) error {
+	return cpl.send(struct {
+		Type string    `json:"type"`
+		Time time.Time `json:"time"`
+	}{"time", t})
+}
+
+func (cpl *canvasPluginListener) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Close unsubscribes from the canvas, and stops the plugin
+func (cpl *canvasPluginListener) Close() {
+	cpl.ClosedMutex.Lock()
+	if cpl.Closed {
+		cpl.ClosedMutex.Unlock()
+		return
+	}
+	cpl.Closed = true
+	cpl.ClosedMutex.Unlock()
+
+	// Unsubscribe without holding the lock, as the canvas may wait for a handler that wants to read the closed state
+	cpl.Canvas.unsubscribeListener(cpl)
+
+	cpl.Process.Close()
+}
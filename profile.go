@@ -0,0 +1,86 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Profile that the defaults of all other settings are based on, stored in the configuration at .profile.
+// Settings that are set in the configuration file always take precedence over the defaults of the profile.
+type profileSettings struct {
+	Name      string // One of the configProfiles, like "default" or "lowmemory"
+	DisableUI bool   // Run as daemon if no command is given, instead of opening the user interface
+}
+
+var defaultProfileSettings = profileSettings{
+	Name: "default",
+}
+
+func (s profileSettings) validate() error {
+	if _, ok := configProfiles[s.Name]; !ok {
+		return fmt.Errorf("Unknown profile %q", s.Name)
+	}
+	return nil
+}
+
+// Defaults of all settings for each profile
+var configProfiles = map[string]map[string]interface{}{
+	"default": {
+		"profile":    defaultProfileSettings,
+		"paths":      defaultPathSettings,
+		"log":        defaultLogSettings,
+		"exports":    defaultExportSettings,
+		"memory":     defaultMemorySettings,
+		"chunks":     defaultChunkPolicySettings,
+		"load":       defaultLoadSettings,
+		"background": defaultBackgroundSettings,
+		"retention":  defaultRetentionSettings,
+	},
+	// Recorders on single board computers like the Raspberry Pi, with little memory and often without display
+	"lowmemory": {
+		"profile":    profileSettings{Name: "lowmemory", DisableUI: true},
+		"paths":      defaultPathSettings,
+		"log":        defaultLogSettings,
+		"exports":    exportSettings{Workers: 1, SpillLimit: 32},
+		"memory":     memorySettings{SoftLimit: 64, SmallQueues: true},
+		"chunks":     chunkPolicySettings{IdleTimeout: "1m", PalettedOnly: true, RequestQueueSize: 100},
+		"load":       defaultLoadSettings,
+		"background": defaultBackgroundSettings,
+		"retention":  defaultRetentionSettings,
+	},
+}
+
+var profileMutex sync.RWMutex
+var profile = defaultProfileSettings
+
+// Changes the current profile. The defaults it brings along are applied by the callbacks of their settings
+func setProfileSettings(s profileSettings) {
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+
+	profile = s
+}
+
+// Returns the current profile
+func getProfileSettings() profileSettings {
+	profileMutex.RLock()
+	defer profileMutex.RUnlock()
+
+	return profile
+}
@@ -0,0 +1,165 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package recording
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Size of the binary header in the uncompressed stream
+var headerSize = binary.Size(header{})
+
+// Returns an uncompressed stream with a header and one event of each type, as seed of the fuzz targets
+func fuzzSeedStream(tb testing.TB) []byte {
+	img := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{229, 0, 0, 255}})
+	img.SetColorIndex(1, 2, 1)
+
+	buffer := &bytes.Buffer{}
+	if err := WriteHeader(buffer, Header{Time: time.Unix(0, 1560513600000000000), ChunkSize: image.Point{64, 64}, Authors: true}); err != nil {
+		tb.Fatalf("Can't write header: %v", err)
+	}
+	for _, event := range []interface{}{
+		SetImage{Image: img},
+		SetPixel{Pos: image.Point{-5, 7}, Color: color.RGBA{1, 2, 3, 255}},
+		SetPixel{Pos: image.Point{8, -9}, Color: color.RGBA{4, 5, 6, 255}, Author: "user-123"},
+		InvalidateRect{Rect: image.Rect(0, 0, 64, 64)},
+		RevalidateRect{Rect: image.Rect(-64, 0, 0, 64)},
+		InvalidateAll{},
+	} {
+		if err := WriteEvent(buffer, time.Unix(0, 1560513600000000000), event); err != nil {
+			tb.Fatalf("Can't write event %v: %v", event, err)
+		}
+	}
+
+	return buffer.Bytes()
+}
+
+// Reads all events of an uncompressed stream.
+// Malformed data must result in errors, not in panics or huge allocations.
+func FuzzReadEvent(f *testing.F) {
+	seed := fuzzSeedStream(f)
+	f.Add(seed)
+	f.Add(seed[:len(seed)-1])
+	f.Add(append(append([]byte{}, seed[:headerSize]...), typeSetImage, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bytes.NewReader(data)
+		if _, err := ReadHeader(reader); err != nil {
+			return
+		}
+
+		for {
+			eventTime, event, err := ReadEvent(reader)
+			if err != nil {
+				return
+			}
+
+			// Events that could be read are written and read again unchanged, except images which are encoded again
+			if _, ok := event.(SetImage); ok {
+				continue
+			}
+			buffer := &bytes.Buffer{}
+			if err := WriteEvent(buffer, eventTime, event); err != nil {
+				t.Fatalf("Can't write event %v: %v", event, err)
+			}
+			gotTime, got, err := ReadEvent(buffer)
+			if err != nil {
+				t.Fatalf("Can't read written event %v: %v", event, err)
+			}
+			if !gotTime.Equal(eventTime) || !reflect.DeepEqual(got, event) {
+				t.Errorf("Got event %v at %v, want %v at %v", got, gotTime, event, eventTime)
+			}
+		}
+	})
+}
+
+// Reads whole compressed files, like the recordings of the main program
+func FuzzReader(f *testing.F) {
+	buffer := &bytes.Buffer{}
+	w, err := NewWriter(buffer, "test", Header{Time: time.Unix(0, 1560513600000000000), ChunkSize: image.Point{64, 64}})
+	if err != nil {
+		f.Fatalf("Can't create writer: %v", err)
+	}
+	w.WriteEvent(time.Unix(0, 1560513600000000000), SetPixel{Pos: image.Point{1, 2}, Color: color.RGBA{1, 2, 3, 255}})
+	if err := w.Close(); err != nil {
+		f.Fatalf("Can't close writer: %v", err)
+	}
+	f.Add(buffer.Bytes())
+	f.Add(buffer.Bytes()[:buffer.Len()/2])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		defer r.Close()
+
+		if r.ChunkSize.X <= 0 || r.ChunkSize.Y <= 0 {
+			t.Errorf("Got invalid chunk size %v", r.ChunkSize)
+		}
+		for {
+			if _, _, err := r.NextRaw(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// Decodes images, their size must be checked before they are allocated
+func FuzzRawImageDecode(f *testing.F) {
+	_, event, err := ReadRawEvent(bytes.NewReader(fuzzSeedStream(f)[headerSize:]))
+	if err != nil {
+		f.Fatalf("Can't read seed image: %v", err)
+	}
+	f.Add(event.(RawImage).Data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		setImage, err := RawImage{Pos: image.Point{64, -64}, Data: data}.Decode()
+		if err != nil {
+			return
+		}
+		if bounds := setImage.Image.Bounds(); bounds.Dx()*bounds.Dy() > MaxImagePixels {
+			t.Errorf("Decoded image with bounds %v is too large", bounds)
+		}
+	})
+}
+
+func TestReadRawEventMalformed(t *testing.T) {
+	events := fuzzSeedStream(t)[headerSize:]
+
+	// Cut off after the type of the event
+	if _, _, err := ReadRawEvent(bytes.NewReader(events[:1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("Got error %v for a cut off event, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// Image that claims to be larger than the stream
+	tooLarge := []byte{typeSetImage, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}
+	if _, _, err := ReadRawEvent(bytes.NewReader(tooLarge)); err == nil {
+		t.Errorf("Reading an image of %v bytes succeeded", uint32(0xFFFFFFFF))
+	}
+	binary.LittleEndian.PutUint32(tooLarge[17:], 1000)
+	if _, _, err := ReadRawEvent(bytes.NewReader(tooLarge)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Got error %v for a cut off image, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
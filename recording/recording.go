@@ -0,0 +1,499 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+// Package recording reads and writes pixrec files, the recording format of D3pixelbot.
+//
+// A pixrec file is a gzip stream, that contains a header followed by canvas events.
+// All values are little endian.
+// Events start with their type and the time in nanoseconds since the unix epoch, followed by the event specific data.
+// Images are stored as BMP.
+//
+// Pixels can carry the identifier of the user that placed them, if the game reports it.
+// Only files with authors are written as version 2, all other files stay version 1, so older readers can still read them.
+// Besides that and the short name of the game in the gzip header, nothing identifies where events came from.
+//
+// The format has no index, to get the state of the canvas at some point in time all events up to that point have to be applied.
+package recording
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"time"
+
+	"golang.org/x/image/bmp"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// Version is the newest file format version that can be read and written.
+// Version 2 added pixels with authors, files without authors are written as version 1.
+const Version = 2
+
+// Limits of values read from files, to prevent malformed files from allocating huge amounts of memory
+const (
+	MaxChunkSize   = 1 << 16  // Maximum width and height of chunks
+	MaxImageSize   = 64 << 20 // Maximum size of encoded images in bytes
+	MaxImagePixels = 16 << 20 // Maximum number of pixels of decoded images
+	MaxAuthorSize  = 255      // Maximum length of author identifiers in bytes
+)
+
+// Comment that is written into the gzip header
+const gzipComment = "D3's custom pixel game client recording"
+
+// Event types as stored in the file
+const (
+	typeSetPixel       = 10
+	typeSetPixelAuthor = 11
+	typeInvalidateRect = 20
+	typeInvalidateAll  = 21
+	typeRevalidateRect = 22
+	typeSetImage       = 30
+)
+
+// Header contains the basic information about the recorded canvas
+type Header struct {
+	Time      time.Time   // Start of the recording
+	ChunkSize image.Point // Size of the chunks in pixels
+	Origin    image.Point // Origin/Offset of the chunks
+
+	// Offset of the game server's clock to the local clock at the start of the recording.
+	// It is already applied to all times in the file, they are on the clock of the game server.
+	ClockOffset time.Duration
+
+	Authors bool // True if pixels may carry authors, which needs file format version 2
+}
+
+// SetPixel is the event of a single changed pixel
+type SetPixel struct {
+	Pos    image.Point
+	Color  color.RGBA
+	Author string // Identifier of the user that placed the pixel, empty if the game doesn't report it. At most MaxAuthorSize bytes
+}
+
+// InvalidateRect is the event of a rectangle that isn't in sync with the game anymore
+type InvalidateRect struct {
+	Rect image.Rectangle
+}
+
+// InvalidateAll is the event of the whole canvas becoming invalid, e.g. because the connection was lost or the recording ended
+type InvalidateAll struct{}
+
+// RevalidateRect is the event of a rectangle that is in sync with the game again, without having to download it
+type RevalidateRect struct {
+	Rect image.Rectangle
+}
+
+// SetImage is the event of a downloaded image, usually of a whole chunk.
+// The image is positioned at its canvas coordinates.
+type SetImage struct {
+	Image image.Image
+}
+
+// Binary layout of the header
+type header struct {
+	MagicNumber             [4]byte
+	Version                 uint16 // File format version
+	Time                    int64
+	ChunkWidth, ChunkHeight uint32
+	OriginX, OriginY        int32  // Origin/Offset of the chunks
+	ClockOffset             int64  // Offset of the game server's clock in nanoseconds, zero in older files
+	_                       uint32 // Reserved // TODO: Somehow store endTime here
+	_                       uint32 // Reserved
+	_                       uint32 // Reserved
+	_                       uint32 // Reserved
+}
+
+// ReadHeader reads the header from the decompressed stream
+func ReadHeader(reader io.Reader) (Header, error) {
+	var dat header
+	err := binary.Read(reader, binary.LittleEndian, &dat)
+	if err != nil {
+		return Header{}, fmt.Errorf("Error while reading file: %v", err)
+	}
+
+	if dat.MagicNumber != [4]byte{'P', 'R', 'E', 'C'} {
+		return Header{}, fmt.Errorf("Wrong file format")
+	}
+
+	if dat.Version > Version {
+		return Header{}, fmt.Errorf("Version is newer")
+	}
+
+	if dat.ChunkWidth == 0 || dat.ChunkHeight == 0 || dat.ChunkWidth > MaxChunkSize || dat.ChunkHeight > MaxChunkSize {
+		return Header{}, fmt.Errorf("Invalid chunk size %vx%v", dat.ChunkWidth, dat.ChunkHeight)
+	}
+
+	return Header{
+		Time:      time.Unix(0, dat.Time),
+		ChunkSize: image.Point{int(dat.ChunkWidth), int(dat.ChunkHeight)},
+		Origin:    image.Point{int(dat.OriginX), int(dat.OriginY)},
+
+		ClockOffset: time.Duration(dat.ClockOffset),
+
+		Authors: dat.Version >= 2,
+	}, nil
+}
+
+// WriteHeader writes the header into the uncompressed stream.
+// The file is only marked as version 2 if h.Authors is set.
+func WriteHeader(writer io.Writer, h Header) error {
+	var version uint16 = 1
+	if h.Authors {
+		version = 2
+	}
+
+	return binary.Write(writer, binary.LittleEndian, header{
+		MagicNumber: [4]byte{'P', 'R', 'E', 'C'},
+		Version:     version,
+		Time:        h.Time.UnixNano(),
+		ChunkWidth:  uint32(h.ChunkSize.X),
+		ChunkHeight: uint32(h.ChunkSize.Y),
+		OriginX:     int32(h.Origin.X),
+		OriginY:     int32(h.Origin.Y),
+		ClockOffset: int64(h.ClockOffset),
+	})
+}
+
+// RawImage is an image event as returned by ReadRawEvent, it still has to be decoded.
+//
+// Decoding images is the most expensive part of reading recordings.
+// Separating it from reading allows to decode several images at the same time.
+type RawImage struct {
+	Pos  image.Point // Position of the image on the canvas
+	Data []byte      // BMP encoded image
+}
+
+// Decode decodes the image, and returns it as SetImage event
+func (r RawImage) Decode() (SetImage, error) {
+	// The size is checked first, as the decoder allocates the image before it reads the pixels
+	config, err := bmp.DecodeConfig(bytes.NewReader(r.Data))
+	if err != nil {
+		return SetImage{}, fmt.Errorf("Can't decode bmp image: %v", err)
+	}
+	if int64(config.Width)*int64(config.Height) > MaxImagePixels {
+		return SetImage{}, fmt.Errorf("Image with %vx%v pixels is too large", config.Width, config.Height)
+	}
+
+	img, err := bmp.Decode(bytes.NewReader(r.Data))
+	if err != nil {
+		return SetImage{}, fmt.Errorf("Can't decode bmp image: %v", err)
+	}
+
+	// Move image to X and Y
+	switch img := img.(type) {
+	case *image.Paletted:
+		img.Rect = img.Rect.Add(r.Pos)
+	case *image.RGBA:
+		img.Rect = img.Rect.Add(r.Pos)
+	case *image.NRGBA:
+		img.Rect = img.Rect.Add(r.Pos)
+	default:
+		return SetImage{}, fmt.Errorf("Unknown internal image type %T", img)
+	}
+
+	return SetImage{Image: img}, nil
+}
+
+// ReadEvent reads the next event from the decompressed stream.
+// The event is returned as one of the event types of this package, together with its point in time.
+// io.EOF is returned at the end of the stream, io.ErrUnexpectedEOF if the stream is cut off, e.g. because it's still written to.
+func ReadEvent(reader io.Reader) (time.Time, interface{}, error) {
+	t, event, err := ReadRawEvent(reader)
+	if err != nil {
+		return t, nil, err
+	}
+
+	if raw, ok := event.(RawImage); ok {
+		setImage, err := raw.Decode()
+		if err != nil {
+			return t, nil, err
+		}
+		return t, setImage, nil
+	}
+
+	return t, event, nil
+}
+
+// ReadRawEvent is like ReadEvent, but images are returned as RawImage without decoding them
+func ReadRawEvent(reader io.Reader) (time.Time, interface{}, error) {
+	var dataType uint8
+	var binTime int64
+	if err := binary.Read(reader, binary.LittleEndian, &dataType); err != nil {
+		return time.Time{}, nil, err
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &binTime); err != nil {
+		return time.Time{}, nil, unexpectedEOF(err)
+	}
+	t := time.Unix(0, binTime)
+
+	switch dataType {
+	case typeSetPixel:
+		var dat struct {
+			X, Y    int32
+			R, G, B uint8
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &dat); err != nil {
+			return t, nil, unexpectedEOF(err)
+		}
+		return t, SetPixel{
+			Pos:   image.Point{int(dat.X), int(dat.Y)},
+			Color: color.RGBA{dat.R, dat.G, dat.B, 255},
+		}, nil
+
+	case typeSetPixelAuthor:
+		var dat struct {
+			X, Y       int32
+			R, G, B    uint8
+			AuthorSize uint8
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &dat); err != nil {
+			return t, nil, unexpectedEOF(err)
+		}
+		author := make([]byte, dat.AuthorSize)
+		if _, err := io.ReadFull(reader, author); err != nil {
+			return t, nil, unexpectedEOF(err)
+		}
+		return t, SetPixel{
+			Pos:    image.Point{int(dat.X), int(dat.Y)},
+			Color:  color.RGBA{dat.R, dat.G, dat.B, 255},
+			Author: string(author),
+		}, nil
+
+	case typeInvalidateRect, typeRevalidateRect:
+		var dat struct {
+			MinX, MinY, MaxX, MaxY int32
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &dat); err != nil {
+			return t, nil, unexpectedEOF(err)
+		}
+		rect := image.Rect(int(dat.MinX), int(dat.MinY), int(dat.MaxX), int(dat.MaxY))
+		if dataType == typeRevalidateRect {
+			return t, RevalidateRect{Rect: rect}, nil
+		}
+		return t, InvalidateRect{Rect: rect}, nil
+
+	case typeInvalidateAll:
+		return t, InvalidateAll{}, nil
+
+	case typeSetImage:
+		var dat struct {
+			X, Y int32
+			Size uint32
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &dat); err != nil {
+			return t, nil, unexpectedEOF(err)
+		}
+		if dat.Size > MaxImageSize {
+			return t, nil, fmt.Errorf("Image with %v bytes is too large", dat.Size)
+		}
+		// Don't trust the size, the buffer only grows with the data that is actually there
+		rawBuffer := &bytes.Buffer{}
+		if _, err := io.CopyN(rawBuffer, reader, int64(dat.Size)); err != nil {
+			return t, nil, unexpectedEOF(err)
+		}
+		return t, RawImage{Pos: image.Point{int(dat.X), int(dat.Y)}, Data: rawBuffer.Bytes()}, nil
+	}
+
+	return t, nil, fmt.Errorf("Found invalid data type %v", dataType)
+}
+
+// An event that ends before all of its data is read is cut off, not at the end of the stream
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WriteEvent writes an event into the uncompressed stream.
+// event must be one of the event types of this package, RawImage is written without encoding it again.
+// Pixels with authors need a header with Authors set.
+func WriteEvent(writer io.Writer, t time.Time, event interface{}) error {
+	var dat interface{}
+
+	switch event := event.(type) {
+	case SetPixel:
+		if event.Author != "" {
+			if len(event.Author) > MaxAuthorSize {
+				return fmt.Errorf("Author %q is longer than %v bytes", event.Author, MaxAuthorSize)
+			}
+			err := binary.Write(writer, binary.LittleEndian, struct {
+				DataType   uint8
+				Time       int64
+				X, Y       int32
+				R, G, B    uint8
+				AuthorSize uint8
+			}{typeSetPixelAuthor, t.UnixNano(), int32(event.Pos.X), int32(event.Pos.Y), event.Color.R, event.Color.G, event.Color.B, uint8(len(event.Author))})
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(writer, event.Author)
+			return err
+		}
+		dat = struct {
+			DataType uint8
+			Time     int64
+			X, Y     int32
+			R, G, B  uint8
+		}{typeSetPixel, t.UnixNano(), int32(event.Pos.X), int32(event.Pos.Y), event.Color.R, event.Color.G, event.Color.B}
+
+	case InvalidateRect:
+		dat = rectEvent(typeInvalidateRect, t, event.Rect)
+
+	case RevalidateRect:
+		dat = rectEvent(typeRevalidateRect, t, event.Rect)
+
+	case InvalidateAll:
+		dat = struct {
+			DataType uint8
+			Time     int64
+		}{typeInvalidateAll, t.UnixNano()}
+
+	case SetImage:
+		rawBuffer := &bytes.Buffer{}
+		if err := bmp.Encode(rawBuffer, event.Image); err != nil { // TODO: Add extra case for paletted, so it doesn't write the palette for each image
+			return fmt.Errorf("Can't encode image: %v", err)
+		}
+		return WriteEvent(writer, t, RawImage{Pos: event.Image.Bounds().Min, Data: rawBuffer.Bytes()})
+
+	case RawImage:
+		err := binary.Write(writer, binary.LittleEndian, struct {
+			DataType uint8
+			Time     int64
+			X, Y     int32
+			Size     uint32
+		}{typeSetImage, t.UnixNano(), int32(event.Pos.X), int32(event.Pos.Y), uint32(len(event.Data))})
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(event.Data)
+		return err
+
+	default:
+		return fmt.Errorf("Unknown event type %T", event)
+	}
+
+	return binary.Write(writer, binary.LittleEndian, dat)
+}
+
+func rectEvent(dataType uint8, t time.Time, rect image.Rectangle) interface{} {
+	return struct {
+		DataType               uint8
+		Time                   int64
+		MinX, MinY, MaxX, MaxY int32
+	}{dataType, t.UnixNano(), int32(rect.Min.X), int32(rect.Min.Y), int32(rect.Max.X), int32(rect.Max.Y)}
+}
+
+// Reader reads a pixrec file
+type Reader struct {
+	Header
+
+	zipReader *gzip.Reader
+}
+
+// NewReader decompresses the stream and reads its header
+func NewReader(r io.Reader) (*Reader, error) {
+	zipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("Can't decompress: %v", err)
+	}
+
+	h, err := ReadHeader(zipReader)
+	if err != nil {
+		zipReader.Close()
+		return nil, err
+	}
+
+	return &Reader{Header: h, zipReader: zipReader}, nil
+}
+
+// Next returns the next event, see ReadEvent
+func (r *Reader) Next() (time.Time, interface{}, error) {
+	return ReadEvent(r.zipReader)
+}
+
+// NextRaw returns the next event without decoding images, see ReadRawEvent
+func (r *Reader) NextRaw() (time.Time, interface{}, error) {
+	return ReadRawEvent(r.zipReader)
+}
+
+// Close stops the decompression. It doesn't close the underlying reader
+func (r *Reader) Close() error {
+	return r.zipReader.Close()
+}
+
+// Writer writes a pixrec file
+type Writer struct {
+	zipWriter *gzip.Writer
+	authors   bool // Pixels with authors are only allowed if the header has them enabled
+}
+
+// NewWriter starts a compressed stream with the default compression level, and writes the header into it.
+// name is stored in the gzip header, usually it's the short name of the game.
+func NewWriter(w io.Writer, name string, h Header) (*Writer, error) {
+	return NewWriterLevel(w, name, h, gzip.DefaultCompression)
+}
+
+// NewWriterLevel is like NewWriter, but with the given gzip compression level.
+// Lower levels need less CPU, at the cost of larger files.
+func NewWriterLevel(w io.Writer, name string, h Header, level int) (*Writer, error) {
+	return NewWriterConcurrency(w, name, h, level, DefaultBlocks)
+}
+
+// DefaultBlocks is the number of blocks that NewWriter and NewWriterLevel compress at the same time.
+const DefaultBlocks = 16
+
+// BlockSize is the size of the blocks that are compressed at the same time.
+const BlockSize = 256 << 10
+
+// NewWriterConcurrency is like NewWriterLevel, but compresses at most the given number of blocks at the same time.
+// Each block is compressed by its own goroutine, so fewer blocks use fewer CPU cores.
+func NewWriterConcurrency(w io.Writer, name string, h Header, level, blocks int) (*Writer, error) {
+	zipWriter, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, fmt.Errorf("Can't initialize compression: %v", err)
+	}
+	if err := zipWriter.SetConcurrency(BlockSize, blocks); err != nil {
+		return nil, fmt.Errorf("Can't initialize compression: %v", err)
+	}
+	zipWriter.Name = name
+	zipWriter.Comment = gzipComment
+
+	if err := WriteHeader(zipWriter, h); err != nil {
+		zipWriter.Close()
+		return nil, err
+	}
+
+	return &Writer{zipWriter: zipWriter, authors: h.Authors}, nil
+}
+
+// WriteEvent writes an event, see the WriteEvent function.
+// Pixels with authors are rejected, unless the header of the writer has Authors set.
+func (w *Writer) WriteEvent(t time.Time, event interface{}) error {
+	if event, ok := event.(SetPixel); ok && event.Author != "" && !w.authors {
+		return fmt.Errorf("Pixel has author %q, but the recording doesn't store authors", event.Author)
+	}
+	return WriteEvent(w.zipWriter, t, event)
+}
+
+// Close flushes the compressed stream. It doesn't close the underlying writer
+func (w *Writer) Close() error {
+	return w.zipWriter.Close()
+}
@@ -0,0 +1,234 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package recording
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	header := Header{
+		Time:      time.Unix(0, 1560513600000000000),
+		ChunkSize: image.Point{64, 64},
+		Origin:    image.Point{-32, 16},
+
+		ClockOffset: -1500 * time.Millisecond,
+
+		Authors: true,
+	}
+
+	img := image.NewRGBA(image.Rect(64, 0, 128, 64))
+	img.Set(65, 2, color.RGBA{229, 0, 0, 255})
+
+	events := []interface{}{
+		SetImage{Image: img},
+		SetPixel{Pos: image.Point{-5, 7}, Color: color.RGBA{1, 2, 3, 255}},
+		SetPixel{Pos: image.Point{8, -9}, Color: color.RGBA{4, 5, 6, 255}, Author: "user-123"},
+		InvalidateRect{Rect: image.Rect(0, 0, 64, 64)},
+		RevalidateRect{Rect: image.Rect(-64, 0, 0, 64)},
+		InvalidateAll{},
+	}
+
+	buffer := &bytes.Buffer{}
+	w, err := NewWriter(buffer, "test", header)
+	if err != nil {
+		t.Fatalf("Can't create writer: %v", err)
+	}
+	for i, event := range events {
+		if err := w.WriteEvent(header.Time.Add(time.Duration(i)*time.Second), event); err != nil {
+			t.Fatalf("Can't write event %v: %v", event, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Can't close writer: %v", err)
+	}
+
+	r, err := NewReader(buffer)
+	if err != nil {
+		t.Fatalf("Can't create reader: %v", err)
+	}
+	defer r.Close()
+
+	if !r.Time.Equal(header.Time) || r.ChunkSize != header.ChunkSize || r.Origin != header.Origin || r.ClockOffset != header.ClockOffset || r.Authors != header.Authors {
+		t.Errorf("Got header %v, want %v", r.Header, header)
+	}
+
+	for i, want := range events {
+		eventTime, event, err := r.Next()
+		if err != nil {
+			t.Fatalf("Can't read event %v: %v", i, err)
+		}
+		if wantTime := header.Time.Add(time.Duration(i) * time.Second); !eventTime.Equal(wantTime) {
+			t.Errorf("Event %v has time %v, want %v", i, eventTime, wantTime)
+		}
+
+		if want, ok := want.(SetImage); ok {
+			got, ok := event.(SetImage)
+			if !ok || got.Image.Bounds() != want.Image.Bounds() || color.RGBAModel.Convert(got.Image.At(65, 2)) != color.RGBAModel.Convert(want.Image.At(65, 2)) {
+				t.Errorf("Got event %v, want image with bounds %v", event, want.Image.Bounds())
+			}
+			continue
+		}
+		if !reflect.DeepEqual(event, want) {
+			t.Errorf("Got event %v, want %v", event, want)
+		}
+	}
+
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Errorf("Got error %v at the end, want %v", err, io.EOF)
+	}
+}
+
+func TestWriteEventLongAuthor(t *testing.T) {
+	author := string(bytes.Repeat([]byte{'a'}, MaxAuthorSize+1))
+	if err := WriteEvent(&bytes.Buffer{}, time.Unix(0, 0), SetPixel{Author: author}); err == nil {
+		t.Errorf("Writing an author with %v bytes succeeded", len(author))
+	}
+}
+
+func TestHeaderVersion(t *testing.T) {
+	for _, authors := range []bool{false, true} {
+		buffer := &bytes.Buffer{}
+		if err := WriteHeader(buffer, Header{Time: time.Unix(0, 0), ChunkSize: image.Point{64, 64}, Authors: authors}); err != nil {
+			t.Fatalf("Can't write header: %v", err)
+		}
+
+		var dat header
+		if err := binary.Read(bytes.NewReader(buffer.Bytes()), binary.LittleEndian, &dat); err != nil {
+			t.Fatalf("Can't read header: %v", err)
+		}
+		if want := map[bool]uint16{false: 1, true: 2}[authors]; dat.Version != want {
+			t.Errorf("Header with authors %v has version %v, want %v", authors, dat.Version, want)
+		}
+
+		h, err := ReadHeader(buffer)
+		if err != nil {
+			t.Fatalf("Can't read header: %v", err)
+		}
+		if h.Authors != authors {
+			t.Errorf("Got authors %v, want %v", h.Authors, authors)
+		}
+	}
+}
+
+func TestWriterRejectsAuthors(t *testing.T) {
+	w, err := NewWriter(&bytes.Buffer{}, "test", Header{Time: time.Unix(0, 0), ChunkSize: image.Point{64, 64}})
+	if err != nil {
+		t.Fatalf("Can't create writer: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.WriteEvent(time.Unix(0, 0), SetPixel{Author: "user-123"}); err == nil {
+		t.Errorf("Writing a pixel with author into a recording without authors succeeded")
+	}
+	if err := w.WriteEvent(time.Unix(0, 0), SetPixel{}); err != nil {
+		t.Errorf("Can't write pixel without author: %v", err)
+	}
+}
+
+func TestReadHeaderWrongFormat(t *testing.T) {
+	if _, err := ReadHeader(bytes.NewReader(make([]byte, 64))); err == nil {
+		t.Errorf("Reading a header without magic number succeeded")
+	}
+}
+
+func TestReadRawEvent(t *testing.T) {
+	img := image.NewPaletted(image.Rect(64, 128, 128, 192), color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{229, 0, 0, 255}})
+	img.SetColorIndex(70, 130, 1)
+
+	buffer := &bytes.Buffer{}
+	if err := WriteEvent(buffer, time.Unix(0, 0), SetImage{Image: img}); err != nil {
+		t.Fatalf("Can't write event: %v", err)
+	}
+
+	_, event, err := ReadRawEvent(buffer)
+	if err != nil {
+		t.Fatalf("Can't read event: %v", err)
+	}
+	raw, ok := event.(RawImage)
+	if !ok {
+		t.Fatalf("Got event %T, want RawImage", event)
+	}
+	if want := img.Rect.Min; raw.Pos != want {
+		t.Errorf("Raw image is at %v, want %v", raw.Pos, want)
+	}
+
+	setImage, err := raw.Decode()
+	if err != nil {
+		t.Fatalf("Can't decode image: %v", err)
+	}
+	if setImage.Image.Bounds() != img.Rect || color.RGBAModel.Convert(setImage.Image.At(70, 130)) != img.Palette[1] {
+		t.Errorf("Decoded image with bounds %v differs from the written one", setImage.Image.Bounds())
+	}
+
+	// Raw images are written unchanged
+	rawBuffer := &bytes.Buffer{}
+	if err := WriteEvent(rawBuffer, time.Unix(0, 0), raw); err != nil {
+		t.Fatalf("Can't write raw event: %v", err)
+	}
+	imageBuffer := &bytes.Buffer{}
+	WriteEvent(imageBuffer, time.Unix(0, 0), SetImage{Image: img})
+	if !bytes.Equal(rawBuffer.Bytes(), imageBuffer.Bytes()) {
+		t.Errorf("Written raw image differs from the written image")
+	}
+}
+
+func TestWriterConcurrency(t *testing.T) {
+	header := Header{Time: time.Unix(0, 0), ChunkSize: image.Point{64, 64}}
+
+	if _, err := NewWriterConcurrency(&bytes.Buffer{}, "test", header, 6, 0); err == nil {
+		t.Errorf("Writer without blocks was created")
+	}
+
+	// Enough events for several blocks, compressed one after another
+	buffer := &bytes.Buffer{}
+	w, err := NewWriterConcurrency(buffer, "test", header, 6, 1)
+	if err != nil {
+		t.Fatalf("Can't create writer: %v", err)
+	}
+	const events = BlockSize / 10
+	for i := 0; i < events; i++ {
+		if err := w.WriteEvent(header.Time, SetPixel{Pos: image.Point{i, -i}, Color: color.RGBA{uint8(i), 0, 0, 255}}); err != nil {
+			t.Fatalf("Can't write event %v: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Can't close writer: %v", err)
+	}
+
+	r, err := NewReader(buffer)
+	if err != nil {
+		t.Fatalf("Can't create reader: %v", err)
+	}
+	defer r.Close()
+	for i := 0; i < events; i++ {
+		_, event, err := r.Next()
+		if err != nil {
+			t.Fatalf("Can't read event %v: %v", i, err)
+		}
+		if want := (SetPixel{Pos: image.Point{i, -i}, Color: color.RGBA{uint8(i), 0, 0, 255}}); event != want {
+			t.Fatalf("Got event %v, want %v", event, want)
+		}
+	}
+}
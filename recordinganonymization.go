@@ -0,0 +1,181 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// Length of the hex encoded pseudonyms that replace authors, 64 bits are enough to keep users apart
+const recordingPseudonymLength = 16
+
+// Replaces the authors of pixels in recordings.
+// Without salt the authors are removed, otherwise every author is replaced by a pseudonym derived from the salt.
+// The same author gets the same pseudonym in all recordings that are anonymized with the same salt,
+// but without the salt the pseudonyms can't be traced back to the authors, not even by hashing a list of known names.
+type recordingAnonymizer struct {
+	Salt []byte
+
+	pseudonyms map[string]string
+}
+
+func newRecordingAnonymizer(salt string) *recordingAnonymizer {
+	return &recordingAnonymizer{
+		Salt:       []byte(salt),
+		pseudonyms: map[string]string{},
+	}
+}
+
+// Returns the replacement of an author, which is empty if there's no salt
+func (ra *recordingAnonymizer) replace(author string) string {
+	if author == "" || len(ra.Salt) == 0 {
+		return ""
+	}
+	if pseudonym, ok := ra.pseudonyms[author]; ok {
+		return pseudonym
+	}
+
+	mac := hmac.New(sha256.New, ra.Salt)
+	mac.Write([]byte(author))
+	pseudonym := hex.EncodeToString(mac.Sum(nil))[:recordingPseudonymLength]
+	ra.pseudonyms[author] = pseudonym
+
+	return pseudonym
+}
+
+// Writes a copy of the recording in fileName into w, with the authors of all pixels replaced.
+// Everything else is copied unchanged, including the gzip header and images, which aren't decoded.
+// Cut off recordings are copied up to where they end.
+// Returns the number of pixels that had an author.
+func (ra *recordingAnonymizer) writeRecording(w io.Writer, fileName string) (int, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	zipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, fmt.Errorf("Can't decompress %v: %v", fileName, err)
+	}
+	defer zipReader.Close()
+
+	header, err := recording.ReadHeader(zipReader)
+	if err != nil {
+		return 0, err
+	}
+
+	zipWriter, err := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	if err != nil {
+		return 0, fmt.Errorf("Can't initialize compression: %v", err)
+	}
+	if err := zipWriter.SetConcurrency(recording.BlockSize, getBackgroundSettings().getWorkers()); err != nil {
+		return 0, fmt.Errorf("Can't initialize compression: %v", err)
+	}
+	zipWriter.Header = zipReader.Header // Keeps the name and the compaction metadata
+	if len(ra.Salt) == 0 {
+		header.Authors = false // Without authors the copy can be read by older versions
+	}
+	if err := recording.WriteHeader(zipWriter, header); err != nil {
+		return 0, err
+	}
+
+	throttle := newBackgroundThrottle(backgroundThrottleInterval)
+	replaced := 0
+	for {
+		t, event, err := recording.ReadRawEvent(zipReader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Error while reading recording: %v", err)
+		}
+
+		if setPixel, ok := event.(recording.SetPixel); ok && setPixel.Author != "" {
+			setPixel.Author = ra.replace(setPixel.Author)
+			event = setPixel
+			replaced++
+		}
+		if err := recording.WriteEvent(zipWriter, t, event); err != nil {
+			return 0, err
+		}
+		throttle.step()
+	}
+
+	return replaced, zipWriter.Close()
+}
+
+// Writes anonymized copies of all finished recordings of a game into outDir, see recordingAnonymizer.
+// The copies keep the names and modification times of the recordings, so they can be used as recordings directory of the game.
+// Returns the number of copied recordings, and the number of pixels that had an author.
+func (ra *recordingAnonymizer) anonymizeGame(shortName, outDir string) (recordings, pixels int, err error) {
+	inDir := dataPath(getPaths().Recordings, shortName)
+	if absIn, err := filepath.Abs(inDir); err == nil {
+		if absOut, err := filepath.Abs(outDir); err == nil && absIn == absOut {
+			return 0, 0, fmt.Errorf("The anonymized recordings can't replace the originals in %v, choose another directory", inDir)
+		}
+	}
+
+	files, err := retentionListRecordings(shortName)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		return 0, 0, fmt.Errorf("Can't create directory %v: %v", outDir, err)
+	}
+
+	for _, file := range files {
+		filePath := filepath.Join(inDir, file.Name())
+		if _, err := os.Stat(filePath + recordingUnfinishedExtension); err == nil {
+			continue
+		}
+
+		tempFile, err := ioutil.TempFile(outDir, file.Name()+".*.tmp")
+		if err != nil {
+			return recordings, pixels, fmt.Errorf("Can't create temporary file: %v", err)
+		}
+		replaced, err := ra.writeRecording(tempFile, filePath)
+		if closeErr := tempFile.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("Can't write temporary file: %v", closeErr)
+		}
+		if err != nil {
+			os.Remove(tempFile.Name())
+			return recordings, pixels, fmt.Errorf("Can't anonymize recording %v: %v", filePath, err)
+		}
+
+		outPath := filepath.Join(outDir, file.Name())
+		os.Chtimes(tempFile.Name(), file.ModTime(), file.ModTime())
+		if err := os.Rename(tempFile.Name(), outPath); err != nil {
+			os.Remove(tempFile.Name())
+			return recordings, pixels, fmt.Errorf("Can't write recording %v: %v", outPath, err)
+		}
+		recordings, pixels = recordings+1, pixels+replaced
+	}
+
+	return recordings, pixels, nil
+}
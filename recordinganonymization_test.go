@@ -0,0 +1,149 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+// Reads all events of a recording, images stay encoded
+func readTestRecordingEvents(t *testing.T, fileName string) (recording.Header, []interface{}) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("Can't open recording: %v", err)
+	}
+	defer f.Close()
+
+	reader, err := recording.NewReader(f)
+	if err != nil {
+		t.Fatalf("Can't read recording: %v", err)
+	}
+	defer reader.Close()
+
+	events := []interface{}{}
+	for {
+		tm, event, err := reader.NextRaw()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Can't read event: %v", err)
+		}
+		events = append(events, tm, event)
+	}
+
+	return reader.Header, events
+}
+
+func Test_recordingAnonymizer(t *testing.T) {
+	dir := useTestRecordingsDir(t)
+
+	os.MkdirAll(filepath.Join(dir, "Test-Anonymize"), 0777)
+	fileName := filepath.Join(dir, "Test-Anonymize", "2019-06-01T000000.pixrec")
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatalf("Can't create recording: %v", err)
+	}
+	start := time.Unix(1559347200, 0)
+	w, err := recording.NewWriter(f, "Test-Anonymize", recording.Header{Time: start, ChunkSize: image.Point{64, 64}, Authors: true})
+	if err != nil {
+		t.Fatalf("Can't create writer: %v", err)
+	}
+	red := color.RGBAModel.Convert(pixelcanvasioPalette[5]).(color.RGBA)
+	w.WriteEvent(start, recording.SetImage{Image: image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette)})
+	w.WriteEvent(start.Add(1*time.Second), recording.SetPixel{Pos: image.Point{1, 2}, Color: red, Author: "alice"})
+	w.WriteEvent(start.Add(2*time.Second), recording.SetPixel{Pos: image.Point{3, 4}, Color: red, Author: "bob"})
+	w.WriteEvent(start.Add(3*time.Second), recording.SetPixel{Pos: image.Point{5, 6}, Color: red})
+	w.WriteEvent(start.Add(4*time.Second), recording.SetPixel{Pos: image.Point{7, 8}, Color: red, Author: "alice"})
+	w.WriteEvent(start.Add(5*time.Second), recording.InvalidateAll{})
+	if err := w.Close(); err != nil {
+		t.Fatalf("Can't close writer: %v", err)
+	}
+	f.Close()
+	modTime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	os.Chtimes(fileName, modTime, modTime)
+	header, original := readTestRecordingEvents(t, fileName)
+
+	// Without salt, the authors are removed and everything else is kept
+	outDir := filepath.Join(t.TempDir(), "stripped")
+	recordings, pixels, err := newRecordingAnonymizer("").anonymizeGame("Test-Anonymize", outDir)
+	if err != nil {
+		t.Fatalf("Can't anonymize recordings: %v", err)
+	}
+	if recordings != 1 || pixels != 3 {
+		t.Errorf("Anonymized %v pixels in %v recordings, want 3 in 1", pixels, recordings)
+	}
+	outName := filepath.Join(outDir, "2019-06-01T000000.pixrec")
+	if stat, err := os.Stat(outName); err != nil || !stat.ModTime().Equal(modTime) {
+		t.Errorf("Anonymized recording doesn't have the modification time %v: %v", modTime, err)
+	}
+	strippedHeader, stripped := readTestRecordingEvents(t, outName)
+	wantHeader := header
+	wantHeader.Authors = false // The copy is readable by older versions
+	if !reflect.DeepEqual(strippedHeader, wantHeader) {
+		t.Errorf("Header is %+v, want %+v", strippedHeader, wantHeader)
+	}
+	want := append([]interface{}{}, original...)
+	for i, event := range want {
+		if setPixel, ok := event.(recording.SetPixel); ok {
+			setPixel.Author = ""
+			want[i] = setPixel
+		}
+	}
+	if !reflect.DeepEqual(stripped, want) {
+		t.Errorf("Got the events %v, want %v", stripped, want)
+	}
+
+	// With salt, every author gets its own pseudonym
+	outDir = filepath.Join(t.TempDir(), "hashed")
+	if _, _, err := newRecordingAnonymizer("secret").anonymizeGame("Test-Anonymize", outDir); err != nil {
+		t.Fatalf("Can't anonymize recordings: %v", err)
+	}
+	hashedHeader, hashed := readTestRecordingEvents(t, filepath.Join(outDir, "2019-06-01T000000.pixrec"))
+	if !reflect.DeepEqual(hashedHeader, header) {
+		t.Errorf("Header is %+v, want %+v", hashedHeader, header)
+	}
+	authors := []string{}
+	for _, event := range hashed {
+		if setPixel, ok := event.(recording.SetPixel); ok {
+			authors = append(authors, setPixel.Author)
+		}
+	}
+	if len(authors) != 4 || len(authors[0]) != recordingPseudonymLength || authors[0] == "alice" || authors[0] != authors[3] || authors[0] == authors[1] || authors[2] != "" {
+		t.Errorf("Got the authors %q, want pseudonyms of alice, bob, none and alice", authors)
+	}
+	if pseudonym := newRecordingAnonymizer("other").replace("alice"); pseudonym == authors[0] {
+		t.Errorf("Pseudonym %q doesn't depend on the salt", pseudonym)
+	}
+
+	// The originals are never replaced
+	if _, _, err := newRecordingAnonymizer("").anonymizeGame("Test-Anonymize", filepath.Join(dir, "Test-Anonymize")); err == nil {
+		t.Errorf("Anonymizing into the recordings directory of the game succeeded")
+	}
+	if _, events := readTestRecordingEvents(t, fileName); !reflect.DeepEqual(events, original) {
+		t.Errorf("The original recording was changed")
+	}
+}
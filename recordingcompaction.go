@@ -0,0 +1,320 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// Time resolution of compacted recordings, if the quota doesn't say otherwise
+const recordingCompactionDefaultInterval = time.Minute
+
+// Chunks with more changed pixels than this fraction are written as whole image, otherwise as single pixels
+const recordingCompactionImageFraction = 8
+
+// Metadata of a compacted recording, stored as JSON in the extra field of its gzip header
+type recordingCompactionInfo struct {
+	Interval     string // Time resolution of the recording, e.g. "1m0s"
+	OriginalSize int64  // Size of the recording before it was compacted
+	Creator      string // Version of D3pixelbot that compacted the recording
+}
+
+// Reads the compaction metadata of a recording. ok is false if the recording isn't compacted
+func readRecordingCompactionInfo(fileName string) (info recordingCompactionInfo, ok bool, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return info, false, err
+	}
+	defer f.Close()
+
+	zipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return info, false, fmt.Errorf("Can't decompress %v: %v", fileName, err)
+	}
+	defer zipReader.Close()
+
+	if len(zipReader.Extra) == 0 {
+		return info, false, nil
+	}
+	if err := json.Unmarshal(zipReader.Extra, &info); err != nil || info.Interval == "" {
+		return info, false, nil
+	}
+
+	return info, true, nil
+}
+
+// Rewrites a recording with at most one frame per interval, and replaces the original with it.
+// The modification time of the original is kept, so that the quotas still see when the recording ended.
+// Returns the sizes before and after.
+//
+// Compaction stops early when stop is closed, the original is kept then.
+func compactRecording(fileName string, interval time.Duration, stop <-chan struct{}) (before, after int64, err error) {
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tmpName := filepath.Join(filepath.Dir(fileName), "."+filepath.Base(fileName)+".compacting")
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Can't create file %v: %v", tmpName, err)
+	}
+
+	info := recordingCompactionInfo{Interval: interval.String(), OriginalSize: stat.Size(), Creator: fmt.Sprintf("D3pixelbot %v", version)}
+	if err := writeCompactedRecording(file, fileName, interval, info, stop); err != nil {
+		file.Close()
+		os.Remove(tmpName)
+		return 0, 0, fmt.Errorf("Can't compact recording %v: %v", fileName, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpName)
+		return 0, 0, fmt.Errorf("Can't write file %v: %v", tmpName, err)
+	}
+
+	compacted, err := os.Stat(tmpName)
+	if err != nil {
+		os.Remove(tmpName)
+		return 0, 0, err
+	}
+	os.Chtimes(tmpName, stat.ModTime(), stat.ModTime())
+	if err := os.Rename(tmpName, fileName); err != nil {
+		os.Remove(tmpName)
+		return 0, 0, fmt.Errorf("Can't replace recording %v: %v", fileName, err)
+	}
+
+	return stat.Size(), compacted.Size(), nil
+}
+
+// Replays the recording in fileName, and writes its state into w whenever an interval of the grid of absolute time ends.
+//
+// Every frame is timed like the last event of its interval, so events don't move outside of the original recording.
+// It contains the net changes of the chunks: New chunks and chunks with many changes are written as images, others as single pixels.
+// Images of chunks that are valid in the replay are preceded by an invalidation, as a replay only applies images to invalid chunks.
+// Invalidations are kept, chunks that become valid again are written as images.
+func writeCompactedRecording(w io.Writer, fileName string, interval time.Duration, info recordingCompactionInfo, stop <-chan struct{}) error {
+	decoder, err := openCanvasDiskDecoder(fileName, getBackgroundSettings().getWorkers())
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	zipWriter, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return fmt.Errorf("Can't initialize compression: %v", err)
+	}
+	if err := zipWriter.SetConcurrency(recording.BlockSize, getBackgroundSettings().getWorkers()); err != nil {
+		return fmt.Errorf("Can't initialize compression: %v", err)
+	}
+	zipWriter.Name = filepath.Base(filepath.Dir(fileName))
+	zipWriter.Comment = "D3's custom pixel game client recording"
+	zipWriter.Extra = infoJSON
+
+	header := recording.Header{
+		Time:      decoder.StartTime,
+		ChunkSize: image.Point(decoder.ChunkSize),
+		Origin:    decoder.ChunkOrigin,
+	}
+	if err := recording.WriteHeader(zipWriter, header); err != nil {
+		return err
+	}
+
+	can, _ := newCanvas(decoder.ChunkSize, decoder.ChunkOrigin, image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32))
+	defer can.Close()
+
+	rc := &recordingCompactor{
+		Writer:  zipWriter,
+		Canvas:  can,
+		dirty:   map[chunkCoordinate]bool{},
+		written: map[chunkCoordinate]*image.RGBA{},
+	}
+
+	throttle := newBackgroundThrottle(backgroundThrottleInterval)
+	var bucket, lastTime time.Time
+	for events := 0; ; events++ {
+		if events%1000 == 0 {
+			select {
+			case <-stop:
+				return fmt.Errorf("Compaction was stopped")
+			default:
+			}
+		}
+
+		t, event, err := decoder.next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break // Cut off recordings are compacted up to where they end
+		}
+		if err != nil {
+			return fmt.Errorf("Error while reading recording: %v", err)
+		}
+
+		if b := t.Truncate(interval); !b.Equal(bucket) {
+			if err := rc.writeFrame(lastTime); err != nil {
+				return err
+			}
+			bucket = b
+		}
+		lastTime = t
+
+		rc.markDirty(event)
+		canvasDiskReaderApplyEvent(can, event)
+		throttle.step()
+	}
+	if err := rc.writeFrame(lastTime); err != nil {
+		return err
+	}
+
+	return zipWriter.Close()
+}
+
+// Writes the net changes of a replayed canvas as frames, see writeCompactedRecording
+type recordingCompactor struct {
+	Writer io.Writer
+	Canvas *canvas
+
+	dirty         map[chunkCoordinate]bool        // Chunks that were touched since the last frame
+	invalidateAll bool                            // Set if the whole canvas was invalidated since the last frame
+	written       map[chunkCoordinate]*image.RGBA // Valid chunks as they were written last
+}
+
+// Remembers the chunks that an event touches
+func (rc *recordingCompactor) markDirty(event interface{}) {
+	var rect image.Rectangle
+	switch event := event.(type) {
+	case canvasEventSetPixel:
+		rc.dirty[rc.Canvas.ChunkSize.getChunkCoord(event.Pos, rc.Canvas.Origin)] = true
+		return
+	case canvasEventInvalidateAll:
+		rc.invalidateAll = true
+		return
+	case canvasEventInvalidateRect:
+		rect = event.Rect
+	case canvasEventRevalidate:
+		rect = event.Rect
+	case canvasEventSetImage:
+		rect = event.Image.Bounds()
+	default:
+		return
+	}
+
+	chunkRect := rc.Canvas.ChunkSize.getOuterChunkRect(rect, rc.Canvas.Origin)
+	for y := chunkRect.Min.Y; y < chunkRect.Max.Y; y++ {
+		for x := chunkRect.Min.X; x < chunkRect.Max.X; x++ {
+			rc.dirty[chunkCoordinate{x, y}] = true
+		}
+	}
+}
+
+// Writes the changes since the last frame with the given time
+func (rc *recordingCompactor) writeFrame(t time.Time) error {
+	if rc.invalidateAll {
+		if err := recording.WriteEvent(rc.Writer, t, recording.InvalidateAll{}); err != nil {
+			return err
+		}
+		for coord := range rc.written {
+			rc.dirty[coord] = true
+		}
+		rc.written = map[chunkCoordinate]*image.RGBA{}
+		rc.invalidateAll = false
+	}
+
+	// Sorted, so the same recording is always compacted into the same file
+	coords := make([]chunkCoordinate, 0, len(rc.dirty))
+	for coord := range rc.dirty {
+		coords = append(coords, coord)
+	}
+	sort.Slice(coords, func(i, j int) bool {
+		return coords[i].Y < coords[j].Y || coords[i].Y == coords[j].Y && coords[i].X < coords[j].X
+	})
+	for _, coord := range coords {
+		if err := rc.writeChunk(t, coord); err != nil {
+			return err
+		}
+	}
+	rc.dirty = map[chunkCoordinate]bool{}
+
+	return nil
+}
+
+// Writes the changes of a single chunk since it was written last
+func (rc *recordingCompactor) writeChunk(t time.Time, coord chunkCoordinate) error {
+	old := rc.written[coord]
+
+	chunk, err := rc.Canvas.getChunk(coord, false)
+	if err != nil {
+		return nil // Chunks only disappear if they are invalid, which was written already
+	}
+	img, _, _, err := chunk.getImage(true)
+	if err != nil {
+		if old != nil {
+			delete(rc.written, coord)
+			return recording.WriteEvent(rc.Writer, t, recording.InvalidateRect{Rect: chunk.Rect})
+		}
+		return nil
+	}
+	defer img.release()
+
+	current := image.NewRGBA(img.Bounds())
+	draw.Draw(current, current.Rect, img.Image, current.Rect.Min, draw.Src)
+	rc.written[coord] = current
+
+	if old == nil || old.Rect != current.Rect {
+		return recording.WriteEvent(rc.Writer, t, recording.SetImage{Image: img.Image})
+	}
+
+	changed := []image.Point{}
+	for y := current.Rect.Min.Y; y < current.Rect.Max.Y; y++ {
+		for x := current.Rect.Min.X; x < current.Rect.Max.X; x++ {
+			if current.RGBAAt(x, y) != old.RGBAAt(x, y) {
+				changed = append(changed, image.Point{x, y})
+			}
+		}
+	}
+	if len(changed)*recordingCompactionImageFraction > current.Rect.Dx()*current.Rect.Dy() {
+		// Images are only applied to invalid chunks, like downloads
+		if err := recording.WriteEvent(rc.Writer, t, recording.InvalidateRect{Rect: chunk.Rect}); err != nil {
+			return err
+		}
+		return recording.WriteEvent(rc.Writer, t, recording.SetImage{Image: img.Image})
+	}
+	for _, pos := range changed {
+		col := current.RGBAAt(pos.X, pos.Y)
+		if err := recording.WriteEvent(rc.Writer, t, recording.SetPixel{Pos: pos, Color: color.RGBA{col.R, col.G, col.B, 255}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
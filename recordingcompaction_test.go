@@ -0,0 +1,154 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+// Replays a recording up to and including t, and returns the image of rect, whether it's valid and the number of read events
+func replayTestRecording(t *testing.T, fileName string, until time.Time, rect image.Rectangle) (*image.RGBA, bool, int) {
+	decoder, err := openCanvasDiskDecoder(fileName, 1)
+	if err != nil {
+		t.Fatalf("Can't open recording: %v", err)
+	}
+	defer decoder.Close()
+
+	can, _ := newCanvas(decoder.ChunkSize, decoder.ChunkOrigin, image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32))
+	defer can.Close()
+
+	events := 0
+	for {
+		eventTime, event, err := decoder.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Can't read recording: %v", err)
+		}
+		if eventTime.After(until) {
+			break
+		}
+		canvasDiskReaderApplyEvent(can, event)
+		events++
+	}
+
+	img, err := can.getImageCopy(rect, false, true)
+	if err != nil {
+		t.Fatalf("Can't get image: %v", err)
+	}
+	return img, can.isValid(rect), events
+}
+
+func Test_retentionCompactGame(t *testing.T) {
+	const shortName = "Test-Compaction"
+	dir := dataPath(getPaths().Recordings, shortName)
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A slowly drawn line in the first chunk, and a second chunk that is painted over at once and invalidated later
+	fileName := filepath.Join(dir, "2019-06-01T000000.pixrec")
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatalf("Can't create recording: %v", err)
+	}
+	start := time.Unix(1559347200, 0)
+	w, err := recording.NewWriter(f, "Test", recording.Header{Time: start, ChunkSize: image.Point{64, 64}})
+	if err != nil {
+		t.Fatalf("Can't create writer: %v", err)
+	}
+	red, black := color.RGBAModel.Convert(pixelcanvasioPalette[5]).(color.RGBA), color.RGBAModel.Convert(pixelcanvasioPalette[3]).(color.RGBA)
+	w.WriteEvent(start, recording.SetImage{Image: image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette)})
+	w.WriteEvent(start, recording.SetImage{Image: image.NewPaletted(image.Rect(64, 0, 128, 64), pixelcanvasioPalette)})
+	for i := 0; i < 30; i++ {
+		w.WriteEvent(start.Add(time.Duration(i+1)*10*time.Second), recording.SetPixel{Pos: image.Point{i, i}, Color: red})
+	}
+	for i := 0; i < 1024; i++ {
+		w.WriteEvent(start.Add(5*time.Minute+10*time.Second+time.Duration(i)*time.Millisecond), recording.SetPixel{Pos: image.Point{64 + i%32, i / 32}, Color: black})
+	}
+	w.WriteEvent(start.Add(6*time.Minute+30*time.Second), recording.InvalidateRect{Rect: image.Rect(64, 0, 128, 64)})
+	w.WriteEvent(start.Add(8*time.Minute), recording.InvalidateAll{})
+	if err := w.Close(); err != nil {
+		t.Fatalf("Can't close writer: %v", err)
+	}
+	f.Close()
+	modTime := time.Now().Add(-60 * 24 * time.Hour)
+	os.Chtimes(fileName, modTime, modTime)
+
+	original := filepath.Join(dir, "original")
+	if err := retentionCopyFile(fileName, original); err != nil {
+		t.Fatalf("Can't copy recording: %v", err)
+	}
+
+	// Recordings younger than the compaction age are kept
+	settings := retentionSettings{Default: retentionQuota{CompactAge: "2000h"}}
+	if compacted, err := retentionCompactGame(shortName, settings, nil); err != nil || compacted != 0 {
+		t.Errorf("Compacted %v recordings younger than the compaction age: %v", compacted, err)
+	}
+
+	settings = retentionSettings{Default: retentionQuota{CompactAge: "720h"}}
+	if err := settings.validate(); err != nil {
+		t.Errorf("Quota with compaction is invalid: %v", err)
+	}
+	if compacted, err := retentionCompactGame(shortName, settings, nil); err != nil || compacted != 1 {
+		t.Errorf("Compacted %v recordings, want 1: %v", compacted, err)
+	}
+	if compacted, err := retentionCompactGame(shortName, settings, nil); err != nil || compacted != 0 {
+		t.Errorf("Compacted %v recordings that were compacted already: %v", compacted, err)
+	}
+
+	if info, ok, err := readRecordingCompactionInfo(fileName); err != nil || !ok || info.Interval != "1m0s" {
+		t.Errorf("Got compaction info %+v, %v, %v, want an interval of 1m0s", info, ok, err)
+	}
+	if _, ok, _ := readRecordingCompactionInfo(original); ok {
+		t.Errorf("Original recording is marked as compacted")
+	}
+	if stat, err := os.Stat(fileName); err != nil || !stat.ModTime().Equal(modTime) {
+		t.Errorf("Compacted recording doesn't keep the modification time: %v", err)
+	}
+
+	// At the end of every interval, both recordings show the same
+	rect := image.Rect(0, 0, 128, 64)
+	for i := 1; i <= 9; i++ {
+		until := start.Add(time.Duration(i)*time.Minute - time.Nanosecond)
+		want, wantValid, wantEvents := replayTestRecording(t, original, until, rect)
+		got, gotValid, gotEvents := replayTestRecording(t, fileName, until, rect)
+		if !bytes.Equal(want.Pix, got.Pix) || wantValid != gotValid {
+			t.Errorf("Compacted recording differs after %v minutes", i)
+		}
+		if i == 9 && gotEvents >= wantEvents/10 {
+			t.Errorf("Compacted recording has %v events, the original %v", gotEvents, wantEvents)
+		}
+	}
+
+	if err := (retentionQuota{CompactInterval: "10ms"}).validate(); err == nil {
+		t.Errorf("Compaction interval below a second is valid")
+	}
+}
@@ -0,0 +1,142 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// Extension of the marker that exists next to a recording while it's written, e.g. "2019-06-01T120000.pixrec.unfinished"
+const recordingUnfinishedExtension = ".unfinished"
+
+// Directory inside the recordings of a game, where unreadable recordings are moved to
+const recordingQuarantineDirectory = "quarantine"
+
+// Finalizes recordings that weren't closed, because a previous run crashed or was killed.
+//
+// Their readable events are written into a complete pixrec file, which ends with an InvalidateAll event.
+// Recordings without readable header are moved into the quarantine directory of their game.
+// This must not run while other instances record into the same directory.
+func recoverRecordings() (recovered, quarantined int) {
+	markers, err := filepath.Glob(dataPath(getPaths().Recordings, "*", "*.pixrec"+recordingUnfinishedExtension))
+	if err != nil {
+		recordingLog.Warnf("Can't search for unfinished recordings: %v", err)
+		return 0, 0
+	}
+
+	for _, marker := range markers {
+		filePath := marker[:len(marker)-len(recordingUnfinishedExtension)]
+		shortName := filepath.Base(filepath.Dir(filePath))
+
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			os.Remove(marker)
+			continue
+		}
+
+		if err := recoverRecording(filePath, shortName); err != nil {
+			quarantinePath := filepath.Join(filepath.Dir(filePath), recordingQuarantineDirectory, filepath.Base(filePath))
+			recordingLog.Warnf("Can't recover recording %v, moving it to %v: %v", filePath, quarantinePath, err)
+			os.MkdirAll(filepath.Dir(quarantinePath), 0777)
+			if err := os.Rename(filePath, quarantinePath); err != nil {
+				recordingLog.Errorf("Can't move recording %v into quarantine: %v", filePath, err)
+				continue
+			}
+			os.Remove(marker)
+			quarantined++
+			continue
+		}
+
+		os.Remove(marker)
+		recovered++
+		recordingLog.Infof("Recovered unfinished recording %v", filePath)
+
+		// The recording wasn't moved to the object storage, as it never finished
+		recordingStorageUpload(filePath)
+	}
+
+	return recovered, quarantined
+}
+
+// Rewrites all readable events of a cut off recording into a complete one, that replaces the original file.
+// Recordings that are already complete are left unchanged.
+func recoverRecording(filePath, shortName string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader, err := recording.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("Can't create temporary file: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	writer, err := recording.NewWriterConcurrency(tempFile, shortName, reader.Header, gzip.DefaultCompression, getBackgroundSettings().getWorkers())
+	if err != nil {
+		return err
+	}
+
+	lastTime, events := reader.Time, 0
+	for {
+		t, event, err := reader.NextRaw()
+		if err == io.EOF {
+			return nil // The footer exists, the recording is complete
+		}
+		if err != nil {
+			recordingLog.Debugf("Recording %v is cut off after %v events: %v", filePath, events, err)
+			break
+		}
+		if err := writer.WriteEvent(t, event); err != nil {
+			return fmt.Errorf("Can't write event: %v", err)
+		}
+		lastTime, events = t, events+1
+	}
+
+	// Replays show the end of the recording, like it was closed
+	if err := writer.WriteEvent(lastTime, recording.InvalidateAll{}); err != nil {
+		return fmt.Errorf("Can't write event: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("Can't write temporary file: %v", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("Can't write temporary file: %v", err)
+	}
+
+	f.Close() // Windows can't replace open files
+	if err := os.Rename(tempFile.Name(), filePath); err != nil {
+		return fmt.Errorf("Can't replace recording: %v", err)
+	}
+
+	return nil
+}
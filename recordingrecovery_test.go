@@ -0,0 +1,127 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+// Writes a complete recording with a few events, and returns its content
+func testRecoveryRecording(t *testing.T, start time.Time) []byte {
+	buffer := &bytes.Buffer{}
+	w, err := recording.NewWriter(buffer, "Test", recording.Header{Time: start, ChunkSize: image.Point{64, 64}})
+	if err != nil {
+		t.Fatalf("Can't create recording: %v", err)
+	}
+	w.WriteEvent(start, recording.SetImage{Image: image.NewPaletted(image.Rect(0, 0, 64, 64), pixelcanvasioPalette)})
+	for i := 0; i < 1000; i++ {
+		w.WriteEvent(start.Add(time.Duration(i)*time.Second), recording.SetPixel{Pos: image.Point{i % 64, i / 64 % 64}, Color: color.RGBA{uint8(i), 0, 0, 255}})
+	}
+	w.Close()
+
+	return buffer.Bytes()
+}
+
+func Test_recoverRecordings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-test-recovery")
+	if err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer setPathSettings(getPaths())
+	settings := getPaths()
+	settings.Recordings = dir
+	setPathSettings(settings)
+
+	gameDir := filepath.Join(dir, "Test")
+	os.MkdirAll(gameDir, 0777)
+	start := time.Unix(1560000000, 0)
+	data := testRecoveryRecording(t, start)
+
+	files := map[string][]byte{
+		"2019-06-01T000000.pixrec": data[:len(data)/2], // Cut off by a crash
+		"2019-06-02T000000.pixrec": data,               // Complete, but the marker wasn't removed
+		"2019-06-03T000000.pixrec": data[:5],           // Header is missing
+		"2019-06-04T000000.pixrec": data[:len(data)/2], // Not marked as unfinished, so it's left alone
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(gameDir, name), content, 0666)
+		if name != "2019-06-04T000000.pixrec" {
+			ioutil.WriteFile(filepath.Join(gameDir, name+recordingUnfinishedExtension), nil, 0666)
+		}
+	}
+
+	recovered, quarantined := recoverRecordings()
+	if recovered != 2 || quarantined != 1 {
+		t.Errorf("Recovered %v and quarantined %v recordings, want 2 and 1", recovered, quarantined)
+	}
+
+	// The cut off recording ends cleanly with an invalidation
+	f, err := os.Open(filepath.Join(gameDir, "2019-06-01T000000.pixrec"))
+	if err != nil {
+		t.Fatalf("Can't open recovered recording: %v", err)
+	}
+	defer f.Close()
+	r, err := recording.NewReader(f)
+	if err != nil {
+		t.Fatalf("Can't read recovered recording: %v", err)
+	}
+	defer r.Close()
+	var lastEvent interface{}
+	events := 0
+	for {
+		_, event, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Can't read event %v of recovered recording: %v", events, err)
+		}
+		lastEvent = event
+		events++
+	}
+	if _, ok := lastEvent.(recording.InvalidateAll); !ok || events < 2 {
+		t.Errorf("Recovered recording has %v events and ends with %T, want some events and an invalidation", events, lastEvent)
+	}
+
+	if content, _ := ioutil.ReadFile(filepath.Join(gameDir, "2019-06-02T000000.pixrec")); !bytes.Equal(content, data) {
+		t.Errorf("Complete recording was modified")
+	}
+	if _, err := os.Stat(filepath.Join(gameDir, recordingQuarantineDirectory, "2019-06-03T000000.pixrec")); err != nil {
+		t.Errorf("Recording without header wasn't quarantined: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(gameDir, "2019-06-04T000000.pixrec")); !bytes.Equal(content, data[:len(data)/2]) {
+		t.Errorf("Recording without marker was modified")
+	}
+
+	// Only recordings and the quarantine directory remain
+	names, _ := filepath.Glob(filepath.Join(gameDir, "*"))
+	if len(names) != 4 {
+		t.Errorf("Game directory contains %v, want 3 recordings and the quarantine directory", names)
+	}
+}
@@ -0,0 +1,439 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var retentionLog = moduleLog("retention")
+
+// Interval in which the recordings are checked against their quotas, and the free disk space is checked
+const retentionCheckInterval = 10 * time.Minute
+
+// Quota of the recordings of a game
+type retentionQuota struct {
+	MaxSize         float64 // Size of all recordings of the game in GiB, above which the oldest are pruned. 0 is unlimited
+	MaxAge          string  // Duration like "720h", recordings that ended longer ago are pruned. "0" or empty keeps them
+	CompactAge      string  // Duration like "720h", recordings that ended longer ago are compacted. "0" or empty never compacts them
+	CompactInterval string  // Time resolution of compacted recordings, like "1m". Defaults to 1 minute
+}
+
+func (q retentionQuota) validate() error {
+	if q.MaxSize < 0 {
+		return fmt.Errorf("Maximum size %v must not be negative", q.MaxSize)
+	}
+	if q.MaxAge != "" {
+		d, err := time.ParseDuration(q.MaxAge)
+		if err != nil {
+			return fmt.Errorf("Invalid maximum age %q: %v", q.MaxAge, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("Maximum age %v must not be negative", d)
+		}
+	}
+	if q.CompactAge != "" {
+		d, err := time.ParseDuration(q.CompactAge)
+		if err != nil {
+			return fmt.Errorf("Invalid compaction age %q: %v", q.CompactAge, err)
+		}
+		if d < 0 {
+			return fmt.Errorf("Compaction age %v must not be negative", d)
+		}
+	}
+	if q.CompactInterval != "" {
+		d, err := time.ParseDuration(q.CompactInterval)
+		if err != nil {
+			return fmt.Errorf("Invalid compaction interval %q: %v", q.CompactInterval, err)
+		}
+		if d < time.Second {
+			return fmt.Errorf("Compaction interval %v must be at least a second", d)
+		}
+	}
+	return nil
+}
+
+// Returns the parsed maximum age, 0 means that recordings are kept forever
+func (q retentionQuota) getMaxAge() time.Duration {
+	d, _ := time.ParseDuration(q.MaxAge)
+	return d
+}
+
+// Returns the parsed compaction age, 0 means that recordings are never compacted
+func (q retentionQuota) getCompactAge() time.Duration {
+	d, _ := time.ParseDuration(q.CompactAge)
+	return d
+}
+
+// Returns the parsed compaction interval, or the default
+func (q retentionQuota) getCompactInterval() time.Duration {
+	if d, err := time.ParseDuration(q.CompactInterval); err == nil && d >= time.Second {
+		return d
+	}
+	return recordingCompactionDefaultInterval
+}
+
+// Settings of the retention of recordings, stored in the configuration at .retention
+type retentionSettings struct {
+	Default       retentionQuota            // Quota of all games that aren't listed in Games
+	Games         map[string]retentionQuota // Quotas by the directory name of the game, which is its short name
+	Archive       string                    // Directory where pruned recordings are moved to, relative to the data directory. They are deleted if this is empty
+	MinFreeSpace  int                       // Free disk space in MiB, below which recorders refuse to start. 0 disables the check
+	WarnFreeSpace int                       // Free disk space in MiB, below which warnings are logged
+}
+
+var defaultRetentionSettings = retentionSettings{
+	Default:       retentionQuota{MaxAge: "0"},
+	MinFreeSpace:  100,
+	WarnFreeSpace: 1024,
+}
+
+func (s retentionSettings) validate() error {
+	if err := s.Default.validate(); err != nil {
+		return fmt.Errorf("Invalid default quota: %v", err)
+	}
+	for shortName, quota := range s.Games {
+		if err := quota.validate(); err != nil {
+			return fmt.Errorf("Invalid quota of %v: %v", shortName, err)
+		}
+	}
+	if s.MinFreeSpace < 0 || s.WarnFreeSpace < 0 {
+		return fmt.Errorf("Free disk space limits must not be negative")
+	}
+	return nil
+}
+
+// Returns the quota of the game with the given directory name
+func (s retentionSettings) getQuota(shortName string) retentionQuota {
+	if quota, ok := s.Games[shortName]; ok {
+		return quota
+	}
+	return s.Default
+}
+
+var retentionMutex sync.RWMutex
+var retention = defaultRetentionSettings
+
+// Changes the quotas and disk space limits, they apply to the next check
+func setRetentionSettings(s retentionSettings) {
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+
+	retention = s
+}
+
+// Returns the current quotas and disk space limits
+func getRetentionSettings() retentionSettings {
+	retentionMutex.RLock()
+	defer retentionMutex.RUnlock()
+
+	return retention
+}
+
+// Disk usage of the recordings, as returned by the diskUsage method of the control socket
+type retentionDiskUsage struct {
+	FreeSpace int64            `json:"freeSpace"` // Free space in bytes on the disk of the recordings directory, -1 if it's unknown
+	LowSpace  bool             `json:"lowSpace"`  // Set if the free space is below the warning limit
+	Games     map[string]int64 `json:"games"`     // Size of the local recordings of each game in bytes
+}
+
+// Returns the free disk space and the size of the recordings of each game
+func getRetentionDiskUsage() retentionDiskUsage {
+	dir := dataPath(getPaths().Recordings)
+	usage := retentionDiskUsage{FreeSpace: -1, Games: map[string]int64{}}
+
+	if free, err := diskFreeSpace(dir); err == nil {
+		usage.FreeSpace = free
+		usage.LowSpace = free < int64(getRetentionSettings().WarnFreeSpace)<<20
+	}
+
+	gameDirs, _ := ioutil.ReadDir(dir)
+	for _, gameDir := range gameDirs {
+		if !gameDir.IsDir() {
+			continue
+		}
+		files, _ := retentionListRecordings(gameDir.Name())
+		for _, file := range files {
+			usage.Games[gameDir.Name()] += file.Size()
+		}
+	}
+
+	return usage
+}
+
+// Returns an error if the free disk space of the recordings is below the minimum, so no recorder is started.
+// Logs a warning if it's below the warning limit.
+func retentionCheckFreeSpace() error {
+	settings := getRetentionSettings()
+	dir := dataPath(getPaths().Recordings)
+	os.MkdirAll(dir, 0777)
+
+	free, err := diskFreeSpace(dir)
+	if err != nil {
+		retentionLog.Warnf("Can't check free disk space of %v: %v", dir, err)
+		return nil
+	}
+	if settings.MinFreeSpace > 0 && free < int64(settings.MinFreeSpace)<<20 {
+		return fmt.Errorf("Only %v MiB of disk space are free at %v, recordings need at least %v MiB", free>>20, dir, settings.MinFreeSpace)
+	}
+	if free < int64(settings.WarnFreeSpace)<<20 {
+		retentionLog.Warnf("Only %v MiB of disk space are free at %v", free>>20, dir)
+	}
+	return nil
+}
+
+// Returns the local recordings of a game, sorted from the oldest to the newest
+func retentionListRecordings(shortName string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dataPath(getPaths().Recordings, shortName))
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := []os.FileInfo{}
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".pixrec" {
+			recordings = append(recordings, file)
+		}
+	}
+	// The file names start with the time, so sorting them sorts the recordings by time
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Name() < recordings[j].Name() })
+
+	return recordings, nil
+}
+
+// Prunes the recordings of a game that exceed its quota, the oldest first.
+// Recordings that are still written are never pruned, but count towards the size.
+// Returns the number of pruned recordings.
+func retentionPruneGame(shortName string, settings retentionSettings) (int, error) {
+	quota := settings.getQuota(shortName)
+	maxSize, maxAge := int64(quota.MaxSize*(1<<30)), quota.getMaxAge()
+	if maxSize <= 0 && maxAge <= 0 {
+		return 0, nil
+	}
+
+	files, err := retentionListRecordings(shortName)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, file := range files {
+		size += file.Size()
+	}
+
+	pruned := 0
+	for _, file := range files {
+		tooOld := maxAge > 0 && time.Since(file.ModTime()) > maxAge
+		tooLarge := maxSize > 0 && size > maxSize
+		if !tooOld && !tooLarge {
+			break
+		}
+
+		filePath := dataPath(getPaths().Recordings, shortName, file.Name())
+		if _, err := os.Stat(filePath + recordingUnfinishedExtension); err == nil {
+			continue
+		}
+		if err := retentionPrune(filePath, shortName, settings.Archive); err != nil {
+			return pruned, err
+		}
+		size -= file.Size()
+		pruned++
+	}
+
+	return pruned, nil
+}
+
+// Moves a recording into the archive directory, or deletes it if there is none
+func retentionPrune(filePath, shortName, archive string) error {
+	if archive == "" {
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("Can't delete recording: %v", err)
+		}
+		retentionLog.Infof("Deleted recording %v, as it exceeded the quota", filePath)
+		return nil
+	}
+
+	archiveDir := dataPath(archive, shortName)
+	if err := os.MkdirAll(archiveDir, 0777); err != nil {
+		return fmt.Errorf("Can't create archive directory: %v", err)
+	}
+	archivePath := filepath.Join(archiveDir, filepath.Base(filePath))
+	if err := os.Rename(filePath, archivePath); err != nil {
+		// The archive may be on another disk
+		if err := retentionCopyFile(filePath, archivePath); err != nil {
+			os.Remove(archivePath)
+			return fmt.Errorf("Can't archive recording: %v", err)
+		}
+		os.Remove(filePath)
+	}
+	retentionLog.Infof("Archived recording %v to %v, as it exceeded the quota", filePath, archivePath)
+	return nil
+}
+
+// Compacts the recordings of a game that ended longer ago than the compaction age of its quota, see compactRecording.
+// Recordings that are still written or already compacted are skipped, recordings that can't be compacted are logged and kept as they are.
+// Returns the number of compacted recordings.
+func retentionCompactGame(shortName string, settings retentionSettings, stop <-chan struct{}) (int, error) {
+	quota := settings.getQuota(shortName)
+	compactAge, interval := quota.getCompactAge(), quota.getCompactInterval()
+	if compactAge <= 0 {
+		return 0, nil
+	}
+
+	files, err := retentionListRecordings(shortName)
+	if err != nil {
+		return 0, err
+	}
+
+	compacted := 0
+	for _, file := range files {
+		if time.Since(file.ModTime()) <= compactAge {
+			break
+		}
+		select {
+		case <-stop:
+			return compacted, nil
+		default:
+		}
+
+		filePath := dataPath(getPaths().Recordings, shortName, file.Name())
+		if _, err := os.Stat(filePath + recordingUnfinishedExtension); err == nil {
+			continue
+		}
+		if _, ok, err := readRecordingCompactionInfo(filePath); ok || err != nil {
+			continue
+		}
+
+		before, after, err := compactRecording(filePath, interval, stop)
+		if err != nil {
+			// A broken recording shouldn't keep the others from being compacted
+			retentionLog.Warnf("%v", err)
+			continue
+		}
+		retentionLog.Infof("Compacted recording %v to one frame per %v, from %v to %v KiB", filePath, interval, before>>10, after>>10)
+		compacted++
+	}
+
+	return compacted, nil
+}
+
+func retentionCopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Prunes the recordings of all games regularly, and warns about low disk space.
+type retentionManager struct {
+	Closed      bool
+	ClosedMutex sync.RWMutex
+
+	checkChan chan struct{}
+	quitChan  chan struct{}
+	waitGroup sync.WaitGroup
+}
+
+func newRetentionManager() *retentionManager {
+	rm := &retentionManager{
+		checkChan: make(chan struct{}, 1),
+		quitChan:  make(chan struct{}),
+	}
+
+	rm.waitGroup.Add(1)
+	go func() {
+		defer rm.waitGroup.Done()
+
+		ticker := time.NewTicker(retentionCheckInterval)
+		defer ticker.Stop()
+
+		lowSpace := false // Only warn once until there is enough space again
+
+		for {
+			select {
+			case <-rm.checkChan:
+			case <-ticker.C:
+			case <-rm.quitChan:
+				return
+			}
+
+			settings := getRetentionSettings()
+			gameDirs, _ := ioutil.ReadDir(dataPath(getPaths().Recordings))
+			for _, gameDir := range gameDirs {
+				if !gameDir.IsDir() {
+					continue
+				}
+				if _, err := retentionPruneGame(gameDir.Name(), settings); err != nil {
+					retentionLog.Warnf("Can't prune recordings of %v: %v", gameDir.Name(), err)
+				}
+				if _, err := retentionCompactGame(gameDir.Name(), settings, rm.quitChan); err != nil {
+					retentionLog.Warnf("Can't compact recordings of %v: %v", gameDir.Name(), err)
+				}
+			}
+
+			usage := getRetentionDiskUsage()
+			switch {
+			case usage.LowSpace && !lowSpace:
+				retentionLog.Warnf("Only %v MiB of disk space are free for recordings, recorders refuse to start below %v MiB", usage.FreeSpace>>20, settings.MinFreeSpace)
+				lowSpace = true
+			case !usage.LowSpace && lowSpace:
+				retentionLog.Infof("%v MiB of disk space are free for recordings again", usage.FreeSpace>>20)
+				lowSpace = false
+			}
+		}
+	}()
+
+	return rm
+}
+
+// Checks the quotas and the disk space right away, instead of waiting for the next interval
+func (rm *retentionManager) check() {
+	select {
+	case rm.checkChan <- struct{}{}:
+	default: // A check is pending already
+	}
+}
+
+// Stops checking the recordings
+func (rm *retentionManager) Close() {
+	rm.ClosedMutex.Lock()
+	defer rm.ClosedMutex.Unlock()
+	if rm.Closed {
+		return
+	}
+	rm.Closed = true
+
+	close(rm.quitChan)
+	rm.waitGroup.Wait()
+}
@@ -0,0 +1,128 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_retentionPruneGame(t *testing.T) {
+	const shortName = "Test-Retention"
+	dir := dataPath(getPaths().Recordings, shortName)
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := ioutil.TempDir("", "d3pixelbot-test-archive")
+	if err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	defer os.RemoveAll(archive)
+
+	// Recordings of 1 MiB each, one per day. The oldest is still written
+	names := []string{"2019-06-01T120000.pixrec", "2019-06-02T120000.pixrec", "2019-06-03T120000.pixrec", "2019-06-04T120000.pixrec", "2019-06-05T120000.pixrec"}
+	for i, name := range names {
+		filePath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filePath, make([]byte, 1<<20), 0666); err != nil {
+			t.Fatalf("Can't write recording: %v", err)
+		}
+		modTime := time.Now().Add(time.Duration(i-len(names))*24*time.Hour + time.Hour)
+		os.Chtimes(filePath, modTime, modTime)
+	}
+	ioutil.WriteFile(filepath.Join(dir, names[0]+recordingUnfinishedExtension), nil, 0666)
+
+	exists := func() []string {
+		files, _ := retentionListRecordings(shortName)
+		result := []string{}
+		for _, file := range files {
+			result = append(result, file.Name())
+		}
+		return result
+	}
+
+	// Unlimited quotas keep everything
+	if pruned, err := retentionPruneGame(shortName, defaultRetentionSettings); err != nil || pruned != 0 {
+		t.Errorf("Pruned %v recordings without quota: %v", pruned, err)
+	}
+
+	// Recordings older than 3 days are deleted, except the one that is still written
+	settings := retentionSettings{Default: retentionQuota{MaxAge: "72h"}}
+	if pruned, err := retentionPruneGame(shortName, settings); err != nil || pruned != 1 {
+		t.Errorf("Pruned %v recordings older than 3 days, want 1: %v", pruned, err)
+	}
+	if got := exists(); len(got) != 4 || got[0] != names[0] || got[1] != names[2] {
+		t.Errorf("Got recordings %v after pruning by age", got)
+	}
+
+	// The oldest recordings are archived, until the game uses at most 2.5 MiB
+	settings = retentionSettings{Default: retentionQuota{MaxAge: "0"}, Games: map[string]retentionQuota{shortName: {MaxSize: 2.5 / 1024}}, Archive: archive}
+	if err := settings.validate(); err != nil {
+		t.Errorf("Quota without maximum age is invalid: %v", err)
+	}
+	if pruned, err := retentionPruneGame(shortName, settings); err != nil || pruned != 2 {
+		t.Errorf("Pruned %v recordings above the size quota, want 2: %v", pruned, err)
+	}
+	if got := exists(); len(got) != 2 || got[0] != names[0] || got[1] != names[4] {
+		t.Errorf("Got recordings %v after pruning by size", got)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(archive, shortName)); len(files) != 2 {
+		t.Errorf("Archive contains %v recordings, want 2", len(files))
+	}
+
+	usage := getRetentionDiskUsage()
+	if usage.Games[shortName] != 2<<20 {
+		t.Errorf("Game uses %v bytes, want %v", usage.Games[shortName], 2<<20)
+	}
+	if usage.FreeSpace <= 0 {
+		t.Errorf("Free disk space is %v", usage.FreeSpace)
+	}
+}
+
+func Test_retentionCheckFreeSpace(t *testing.T) {
+	defer setRetentionSettings(getRetentionSettings())
+
+	setRetentionSettings(retentionSettings{MinFreeSpace: 1})
+	if err := retentionCheckFreeSpace(); err != nil {
+		t.Errorf("Recorders can't start with 1 MiB of free disk space: %v", err)
+	}
+
+	// No recorder is started if the disk is too full
+	setRetentionSettings(retentionSettings{MinFreeSpace: 1 << 30})
+	if err := retentionCheckFreeSpace(); err == nil {
+		t.Errorf("Recorders can start with less free disk space than the minimum")
+	}
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+	if rec, err := can.newCanvasRecorder("Test-Retention", canvasRecorderSettings{}); err == nil {
+		rec.Close()
+		t.Errorf("Recorder was started with less free disk space than the minimum")
+	}
+
+	if err := (retentionSettings{Default: retentionQuota{MaxAge: "-1h"}}).validate(); err == nil {
+		t.Errorf("Negative maximum age is valid")
+	}
+	if err := defaultRetentionSettings.validate(); err != nil {
+		t.Errorf("Default settings are invalid: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Settings of the object storage for recordings, stored in the configuration at .storage
+type recordingStorageSettings struct {
+	Endpoint        string // e.g. "https://s3.eu-central-1.amazonaws.com". The object storage is disabled if this or Bucket is empty
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Prefix          string // Prepended to the object keys, e.g. "recordings/"
+	KeepLocal       bool   // Keep the local file after it was uploaded
+}
+
+// Location where recordings can be listed and read from.
+//
+// Recordings are identified by their name, which is a file path or an URL.
+// Use openRecordingFile to open a recording by its name.
+type recordingStorage interface {
+	listRecordings(shortName string) ([]string, error) // Returns the names of all recordings of a game, sorted by their start time
+	openRecording(name string, headerOnly bool) (io.ReadCloser, error)
+}
+
+// Opens a recording of any storage.
+// If headerOnly is true, storages may return only the beginning of the recording.
+func openRecordingFile(name string, headerOnly bool) (io.ReadCloser, error) {
+	switch {
+	case strings.HasPrefix(name, "http://"), strings.HasPrefix(name, "https://"):
+		return recordingStorageHTTP{}.openRecording(name, headerOnly)
+	case strings.HasPrefix(name, "s3://"):
+		objectStorage := getRecordingObjectStorage()
+		if objectStorage == nil {
+			return nil, fmt.Errorf("Can't open %v, there is no object storage configured", name)
+		}
+		return objectStorage.openRecording(name, headerOnly)
+	}
+
+	return recordingStorageLocal{}.openRecording(name, headerOnly)
+}
+
+// Recordings in the local recordings directory.
+// Recordings that were moved to the object storage are listed too.
+type recordingStorageLocal struct{}
+
+func (rs recordingStorageLocal) listRecordings(shortName string) ([]string, error) {
+	names := []string{}
+
+	fileDirectory := dataPath(getPaths().Recordings, shortName)
+	files, err := ioutil.ReadDir(fileDirectory)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Can't read from %v", fileDirectory)
+	}
+
+	// Filter pixrec files
+	for _, f := range files {
+		if filepath.Ext(f.Name()) == ".pixrec" {
+			names = append(names, filepath.Join(fileDirectory, f.Name()))
+		}
+	}
+
+	objectStorage := getRecordingObjectStorage()
+	if objectStorage == nil {
+		if err != nil {
+			return nil, fmt.Errorf("Can't read from %v", fileDirectory)
+		}
+		return names, nil
+	}
+
+	objectNames, err := objectStorage.listRecordings(shortName)
+	if err != nil {
+		recordingLog.Warnf("Can't list recordings in object storage: %v", err)
+	}
+
+	// Merge both lists. Local files are preferred, as they are faster to read
+	local := map[string]bool{}
+	for _, name := range names {
+		local[filepath.Base(name)] = true
+	}
+	for _, name := range objectNames {
+		if !local[path.Base(name)] {
+			names = append(names, name)
+		}
+	}
+
+	// The file names start with the time, so sorting them sorts the recordings by time
+	sort.Slice(names, func(i, j int) bool {
+		return path.Base(filepath.ToSlash(names[i])) < path.Base(filepath.ToSlash(names[j]))
+	})
+
+	return names, nil
+}
+
+func (rs recordingStorageLocal) openRecording(name string, headerOnly bool) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Can't open file %v: %v", name, err)
+	}
+	return f, nil
+}
+
+// A single clip file, see exportClip.
+// It's listed as the only recording, independent of the short name.
+type recordingStorageClip struct {
+	FileName string
+	Info     canvasClipInfo
+}
+
+func (rs recordingStorageClip) listRecordings(shortName string) ([]string, error) {
+	return []string{rs.FileName}, nil
+}
+
+func (rs recordingStorageClip) openRecording(name string, headerOnly bool) (io.ReadCloser, error) {
+	return recordingStorageLocal{}.openRecording(name, headerOnly)
+}
+
+// HTTP client for remote recordings. It has no timeout, as recordings are streamed while they are replayed
+var recordingHTTPClient = &http.Client{}
+
+// Recordings served by the API server of another instance.
+type recordingStorageHTTP struct {
+	URL string // e.g. "http://192.168.1.10:8081/api/recordings"
+}
+
+func (rs recordingStorageHTTP) listRecordings(shortName string) ([]string, error) {
+	gameURL := rs.URL + "/" + url.PathEscape(shortName)
+
+	list := []struct {
+		FileName string `json:"fileName"`
+	}{}
+	if err := getJSON(gameURL, &list); err != nil {
+		return nil, fmt.Errorf("Can't get recordings from %v: %v", gameURL, err)
+	}
+
+	names := []string{}
+	for _, rec := range list {
+		names = append(names, gameURL+"/"+url.PathEscape(rec.FileName))
+	}
+	return names, nil
+}
+
+func (rs recordingStorageHTTP) openRecording(name string, headerOnly bool) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if headerOnly {
+		req.Header.Set("Range", "bytes=0-65535") // Much more than the compressed header needs
+	}
+
+	r, err := recordingHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Can't request %v: %v", name, err)
+	}
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusPartialContent {
+		r.Body.Close()
+		return nil, fmt.Errorf("Can't request %v: %v", name, r.Status)
+	}
+
+	return r.Body, nil
+}
+
+// Recordings in S3-compatible object storage.
+// Finished recordings are moved there by recordingStorageUpload.
+type recordingStorageS3 struct {
+	Client    *s3Client
+	Prefix    string
+	KeepLocal bool
+}
+
+func (rs *recordingStorageS3) listRecordings(shortName string) ([]string, error) {
+	keys, err := rs.Client.list(rs.Prefix + shortName + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, key := range keys {
+		if path.Ext(key) == ".pixrec" {
+			names = append(names, "s3://"+rs.Client.Bucket+"/"+key)
+		}
+	}
+	return names, nil
+}
+
+func (rs *recordingStorageS3) openRecording(name string, headerOnly bool) (io.ReadCloser, error) {
+	bucket, key, err := s3ParseURL(name)
+	if err != nil {
+		return nil, err
+	}
+	if bucket != rs.Client.Bucket {
+		return nil, fmt.Errorf("Can't open %v, the configured bucket is %v", name, rs.Client.Bucket)
+	}
+
+	var length int64
+	if headerOnly {
+		length = 65536 // Much more than the compressed header needs
+	}
+
+	return rs.Client.get(key, length)
+}
+
+// Uploads a finished recording, and removes the local file afterwards if KeepLocal isn't set
+func (rs *recordingStorageS3) storeRecording(filePath string) error {
+	shortName := filepath.Base(filepath.Dir(filePath))
+	key := rs.Prefix + shortName + "/" + filepath.Base(filePath)
+
+	if err := rs.Client.putFile(key, filePath); err != nil {
+		return fmt.Errorf("Can't upload %v: %v", filePath, err)
+	}
+
+	if !rs.KeepLocal {
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("Can't remove %v after upload: %v", filePath, err)
+		}
+	}
+
+	return nil
+}
+
+var recordingObjectStorageMutex sync.RWMutex
+var recordingObjectStorage *recordingStorageS3 // Configured object storage, nil if there is none
+var recordingStorageUploads sync.WaitGroup     // Running uploads
+
+// Changes the object storage for recordings. Recordings that are already uploaded stay where they are
+func setRecordingStorageSettings(settings recordingStorageSettings) {
+	recordingObjectStorageMutex.Lock()
+	defer recordingObjectStorageMutex.Unlock()
+
+	if settings.Endpoint == "" || settings.Bucket == "" {
+		recordingObjectStorage = nil
+		return
+	}
+
+	recordingObjectStorage = &recordingStorageS3{
+		Client:    newS3Client(settings.Endpoint, settings.Region, settings.Bucket, settings.AccessKeyID, settings.SecretAccessKey),
+		Prefix:    settings.Prefix,
+		KeepLocal: settings.KeepLocal,
+	}
+}
+
+func getRecordingObjectStorage() *recordingStorageS3 {
+	recordingObjectStorageMutex.RLock()
+	defer recordingObjectStorageMutex.RUnlock()
+
+	return recordingObjectStorage
+}
+
+// Uploads a finished recording in the background, if there is an object storage configured.
+// Use recordingStorageUploads to wait for running uploads.
+func recordingStorageUpload(filePath string) {
+	objectStorage := getRecordingObjectStorage()
+	if objectStorage == nil {
+		return
+	}
+
+	recordingStorageUploads.Add(1)
+	go func() {
+		defer recordingStorageUploads.Done()
+
+		if err := objectStorage.storeRecording(filePath); err != nil {
+			recordingLog.Errorf("%v", err)
+			return
+		}
+		recordingLog.Infof("Uploaded recording %v", filePath)
+	}()
+}
@@ -0,0 +1,126 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts an in-memory server that understands the requests of s3Client
+func startTestS3Server(t *testing.T, bucket string) (*httptest.Server, map[string][]byte) {
+	var mutex sync.Mutex
+	objects := map[string][]byte{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			http.Error(w, "Missing signature", http.StatusForbidden)
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		key := strings.TrimPrefix(r.URL.Path, "/"+bucket)
+		switch {
+		case r.Method == "GET" && key == "" && r.URL.Query().Get("list-type") == "2":
+			result := struct {
+				XMLName  xml.Name `xml:"ListBucketResult"`
+				Contents []struct{ Key string }
+			}{}
+			for k := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					result.Contents = append(result.Contents, struct{ Key string }{k})
+				}
+			}
+			sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+			xml.NewEncoder(w).Encode(result)
+		case r.Method == "GET" && strings.HasPrefix(key, "/"):
+			data, ok := objects[key[1:]]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+		case r.Method == "PUT" && strings.HasPrefix(key, "/"):
+			data, _ := ioutil.ReadAll(r.Body)
+			objects[key[1:]] = data
+		default:
+			http.Error(w, "Unsupported request", http.StatusBadRequest)
+		}
+	}))
+
+	return server, objects
+}
+
+func Test_recordingStorageS3(t *testing.T) {
+	server, objects := startTestS3Server(t, "test-bucket")
+	defer server.Close()
+
+	setRecordingStorageSettings(recordingStorageSettings{
+		Endpoint:        server.URL,
+		Bucket:          "test-bucket",
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+		Prefix:          "archive/",
+	})
+	defer setRecordingStorageSettings(recordingStorageSettings{})
+
+	// Closing the writer moves the recording into the object storage
+	rect, pos, frameTime := writeTestRecording(t, "Test-ObjectStorage")
+	recordingStorageUploads.Wait()
+
+	if len(objects) != 1 {
+		t.Fatalf("Object storage contains %v objects, want 1", len(objects))
+	}
+	for key := range objects {
+		if !strings.HasPrefix(key, "archive/Test-ObjectStorage/") {
+			t.Errorf("Object has key %q, want prefix %q", key, "archive/Test-ObjectStorage/")
+		}
+	}
+	if names, _ := ioutil.ReadDir(dataPath(getPaths().Recordings, "Test-ObjectStorage")); len(names) != 0 {
+		t.Errorf("Local recording wasn't removed after upload")
+	}
+
+	// And it can still be replayed from there
+	cfe, err := newCanvasFrameExtractor("Test-ObjectStorage")
+	if err != nil {
+		t.Fatalf("Can't create frame extractor: %v", err)
+	}
+	defer cfe.Close()
+
+	if !strings.HasPrefix(cfe.Recordings[0].FileName, "s3://test-bucket/") {
+		t.Errorf("Recording has name %q, want it to be in the object storage", cfe.Recordings[0].FileName)
+	}
+
+	img, err := cfe.getFrame(frameTime, rect)
+	if err != nil {
+		t.Fatalf("Can't get frame at %v: %v", frameTime, err)
+	}
+	if got, want := img.At(pos.X, pos.Y), color.RGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+		t.Errorf("Pixel at %v = %v, want %v", pos, got, want)
+	}
+}
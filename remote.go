@@ -0,0 +1,374 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var remoteLog = moduleLog("remote")
+
+// Settings of the remote connection, stored in the configuration at .remote
+type connectionRemoteSettings struct {
+	Address string // Address of the API server of the instance that maintains the game connection, e.g. "http://192.168.1.10:8081"
+	Game    string // Short name of the game on the remote instance, e.g. "pixelcanvasio"
+	Token   string // API token of the remote instance, needs the read permission
+}
+
+// Connection to another D3pixelbot instance, that serves its canvas with the API server.
+//
+// Only the remote instance is connected to the game, which reduces the load on the game servers if several people use the same canvas.
+// Chunk downloads are forwarded as registered rectangles, and all canvas events of the remote instance are replayed on the local canvas.
+type connectionRemote struct {
+	Settings      connectionRemoteSettings
+	OnlinePlayers uint32 // Must be read atomically
+
+	Canvas     *canvas
+	Statistics *canvasStatistics // Counts the activity, independent of recordings
+	Watcher    *canvasWatcher    // Alerts on activity in watched regions, independent of bots
+	Heatmap    *canvasHeatmap    // Counts the changes per pixel or chunk in a sliding window, independent of recordings
+
+	GoroutineQuit     chan struct{} // Closing this channel stops the goroutines
+	QuitWaitgroup     sync.WaitGroup
+	ChunkDownloadChan <-chan *chunk // Receives download requests from the canvas
+}
+
+func init() {
+	connectionTypes["remote"] = connectionType{
+		Name:        "Remote D3pixelbot",
+		FunctionNew: newRemote,
+	}
+}
+
+var remoteSingleton = &refCountingSingleton{}
+
+func newRemote() (connection, *canvas) {
+	settings := connectionRemoteSettings{}
+	if err := conf.Get(".remote", &settings); err != nil {
+		remoteLog.Errorf("Can't read remote settings: %v", err)
+	}
+
+	con := remoteSingleton.get(func() interface{} { return newConnectionRemote(settings) }).(*connectionRemote)
+
+	return con, con.Canvas
+}
+
+func newConnectionRemote(settings connectionRemoteSettings) *connectionRemote {
+	con := &connectionRemote{
+		Settings:      settings,
+		GoroutineQuit: make(chan struct{}),
+	}
+
+	// The chunk layout must be known before the canvas is created
+	info, err := con.getInfo()
+	if err != nil {
+		remoteLog.Errorf("Can't get canvas layout of %v: %v", con.getShortName(), err)
+		info.ChunkSize = pixelSize{64, 64}
+	}
+	con.Canvas, con.ChunkDownloadChan = newCanvas(info.ChunkSize, info.Origin, info.Rect)
+	con.Statistics, _ = con.Canvas.newCanvasStatistics(conf, con.getShortName())
+	con.Watcher, _ = con.Canvas.newCanvasWatcher(conf, con.getShortName())
+	con.Heatmap, _ = con.Canvas.newCanvasHeatmap(conf, con.getShortName())
+	registerConnection(con, con.Canvas)
+	con.Canvas.Palette.setPalette(getConfiguredPalette(conf, con.getShortName())) // The palette of the remote game isn't known otherwise
+	atomic.StoreUint32(&con.OnlinePlayers, uint32(info.OnlinePlayers))
+
+	// Main goroutine that handles the websocket connection (It will always try to reconnect)
+	con.QuitWaitgroup.Add(1)
+	go func() {
+		defer con.QuitWaitgroup.Done()
+
+		rects := map[image.Rectangle]struct{}{} // Chunk rectangles that are requested from the remote instance. Only used in this goroutine
+
+		waitTime := 0 * time.Second
+		for {
+			select {
+			case <-con.GoroutineQuit:
+				return
+			case <-time.After(waitTime):
+			}
+
+			// Any following connection attempt should be delayed a few seconds
+			waitTime = 5 * time.Second
+
+			// A crash closes the connection, it is reopened like after connection errors
+			crashProtect(fmt.Sprintf("Connection to %v", con.getShortName()), true, func() {
+				if err := con.handleConnection(rects); err != nil {
+					remoteLog.Warnf("Connection to %v failed: %v", con.getShortName(), err)
+				}
+			})
+
+			con.Canvas.invalidateAll()
+		}
+	}()
+
+	return con
+}
+
+// Returns the URL of an API endpoint of the remote game
+func (con *connectionRemote) url(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(con.Settings.Address, "/") + "/api/canvas/" + url.PathEscape(con.Settings.Game) + "/" + endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid address %q: %v", con.Settings.Address, err)
+	}
+	return u, nil
+}
+
+func (con *connectionRemote) getInfo() (apiCanvasInfo, error) {
+	info := apiCanvasInfo{}
+	u, err := con.url("info")
+	if err != nil {
+		return info, err
+	}
+	if con.Settings.Token != "" {
+		u.User = url.User(con.Settings.Token) // Sent as basic authentication
+	}
+	return info, getJSON(u.String(), &info)
+}
+
+// Connects to the event stream of the remote instance, and handles it until the connection is closed.
+// The rectangles of the requested chunks are kept in rects, so they can be registered again after reconnecting.
+func (con *connectionRemote) handleConnection(rects map[image.Rectangle]struct{}) error {
+	// Check if the remote canvas still has the same layout
+	info, err := con.getInfo()
+	if err != nil {
+		return err
+	}
+	if info.ChunkSize != con.Canvas.ChunkSize || info.Origin != con.Canvas.Origin {
+		return fmt.Errorf("Remote chunk layout (%v, %v) differs from the local one (%v, %v), reopen the game", info.ChunkSize, info.Origin, con.Canvas.ChunkSize, con.Canvas.Origin)
+	}
+
+	u, err := con.url("events")
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.RawQuery = "format=binary"
+
+	header := http.Header{}
+	if con.Settings.Token != "" {
+		header.Set("Authorization", "Bearer "+con.Settings.Token)
+	}
+
+	sent := time.Now()
+	c, resp, err := websocket.DefaultDialer.Dial(u.String(), header) // TODO: Ping websocket connection and set timeouts
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	con.Canvas.Clock.observeResponse(resp.Header, sent, time.Now()) // Recordings are timed by the clock of the remote instance
+
+	remoteLog.Debugf("Connected to %v", u.String())
+
+	// Forward download requests as registered rectangles.
+	// Only this goroutine writes to the websocket connection
+	quitChannel := make(chan struct{})
+	writerDone := make(chan struct{})
+	go crashRun(fmt.Sprintf("Writer of the connection to %v", con.getShortName()), false, func() {
+		defer close(writerDone)
+		defer c.Close() // Also stops the reading, so the connection is reopened if this returns early
+
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+
+		register := func() error {
+			list := []image.Rectangle{}
+			for rect := range rects {
+				list = append(list, rect)
+			}
+			return c.WriteJSON(map[string]interface{}{"Type": "RegisterRects", "Rects": list})
+		}
+
+		if err := register(); err != nil {
+			return
+		}
+
+		for {
+			select {
+			case chu := <-con.ChunkDownloadChan:
+				// Check if the chunk still needs to be downloaded
+				if chu.getQueryState(false, 0) != chunkDownload {
+					break
+				}
+				if _, ok := rects[chu.Rect]; ok {
+					break
+				}
+				con.Canvas.signalDownload(chu.Rect)
+				rects[chu.Rect] = struct{}{}
+				if err := register(); err != nil {
+					return
+				}
+			case <-ticker.C:
+				// Forget rectangles of deleted chunks
+				changed := false
+				for rect := range rects {
+					if _, err := con.Canvas.getChunk(con.Canvas.ChunkSize.getChunkCoord(rect.Min, con.Canvas.Origin), false); err != nil {
+						delete(rects, rect)
+						changed = true
+					}
+				}
+				if changed {
+					if err := register(); err != nil {
+						return
+					}
+				}
+				if info, err := con.getInfo(); err == nil {
+					atomic.StoreUint32(&con.OnlinePlayers, uint32(info.OnlinePlayers))
+				}
+			case <-con.GoroutineQuit:
+				c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				c.Close()
+				return
+			case <-quitChannel:
+				return
+			}
+		}
+	})
+	defer func() {
+		close(quitChannel)
+		<-writerDone
+	}()
+
+	// Handle events
+	for {
+		event := struct {
+			Type                string
+			X, Y, Width, Height int
+			R, G, B, A          uint8
+			Valid               bool
+			Time                time.Time
+			Error               string
+		}{}
+		if err := c.ReadJSON(&event); err != nil {
+			select {
+			case <-con.GoroutineQuit:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		rect := image.Rect(event.X, event.Y, event.X+event.Width, event.Y+event.Height)
+
+		switch event.Type {
+		case "SetPixel":
+			con.Canvas.setPixel(image.Point{event.X, event.Y}, color.RGBA{event.R, event.G, event.B, event.A})
+		case "SetImage":
+			// The image data follows as binary message
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return err
+			}
+			img, err := remoteDecodeImage(data, rect.Min)
+			if err != nil {
+				return err
+			}
+			if event.Valid {
+				con.Canvas.signalDownload(rect) // Chunks that were invalidated locally, e.g. by reconnecting, need the download flag
+				con.Canvas.setImage(img, false, true)
+			}
+		case "InvalidateRect":
+			con.Canvas.invalidateRect(rect)
+		case "InvalidateAll":
+			con.Canvas.invalidateAll()
+		case "RevalidateRect":
+			con.Canvas.revalidateRect(rect)
+		case "SignalDownload":
+			con.Canvas.signalDownload(rect)
+		case "SetTime":
+			con.Canvas.setTime(event.Time)
+		case "ChunksChange":
+		case "Error":
+			remoteLog.Warnf("%v sent error: %v", con.getShortName(), event.Error)
+		default:
+			remoteLog.Warnf("%v sent unknown event type %q", con.getShortName(), event.Type)
+		}
+	}
+}
+
+// Decodes the BGRA image data of SetImage events, and places it at pos
+func remoteDecodeImage(data []byte, pos image.Point) (*image.RGBA, error) {
+	if len(data) < 12 || string(data[:4]) != "BGRA" {
+		return nil, fmt.Errorf("Invalid image data")
+	}
+	width, height := int(binary.BigEndian.Uint32(data[4:8])), int(binary.BigEndian.Uint32(data[8:12]))
+	data = data[12:]
+	if len(data) != width*height*4 {
+		return nil, fmt.Errorf("Image data has length %v, expected %v", len(data), width*height*4)
+	}
+
+	img := image.NewRGBA(image.Rectangle{pos, pos.Add(image.Point{width, height})})
+	for i := 0; i < len(data); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = data[i+2], data[i+1], data[i], data[i+3]
+	}
+
+	return img, nil
+}
+
+func (con *connectionRemote) getShortName() string {
+	return "remote-" + con.Settings.Game
+}
+
+func (con *connectionRemote) getName() string {
+	return fmt.Sprintf("%v at %v", con.Settings.Game, con.Settings.Address)
+}
+
+func (con *connectionRemote) getOnlinePlayers() int {
+	return int(atomic.LoadUint32(&con.OnlinePlayers))
+}
+
+// Closes connection and canvas
+func (con *connectionRemote) Close() {
+	if remoteSingleton.release(con) {
+		con.close()
+	}
+}
+
+// Stops the goroutines gracefully, and closes the canvas
+func (con *connectionRemote) close() {
+	close(con.GoroutineQuit)
+
+	con.QuitWaitgroup.Wait()
+
+	unregisterConnection(con)
+	if con.Statistics != nil {
+		con.Statistics.Close()
+	}
+	if con.Watcher != nil {
+		con.Watcher.Close()
+	}
+	if con.Heatmap != nil {
+		con.Heatmap.Close()
+	}
+	con.Canvas.Close()
+}
@@ -0,0 +1,82 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_connectionRemote(t *testing.T) {
+	registerAPIServerTestGame()
+	defer delete(connectionTypes, "apitest")
+
+	as := newAPIServer()
+	defer as.Close()
+
+	server := httptest.NewServer(as.handler())
+	defer server.Close()
+
+	con := newConnectionRemote(connectionRemoteSettings{Address: server.URL, Game: "apitest"})
+	defer con.close()
+
+	if con.Canvas.ChunkSize != (pixelSize{64, 64}) {
+		t.Errorf("Canvas has chunk size %v, want %v", con.Canvas.ChunkSize, pixelSize{64, 64})
+	}
+
+	// Let the local canvas download the chunk from the remote instance
+	game := &apiServerGame{Connection: con, Canvas: con.Canvas, rects: map[image.Rectangle]time.Time{}}
+	if err := con.Canvas.subscribeListener(game, false); err != nil {
+		t.Fatalf("Can't subscribe to canvas: %v", err)
+	}
+	defer con.Canvas.unsubscribeListener(game)
+
+	if !game.request(image.Rect(0, 0, 10, 10), nil) {
+		t.Fatalf("Chunk didn't become valid")
+	}
+	col, err := con.Canvas.getPixel(image.Point{3, 4})
+	if err != nil {
+		t.Fatalf("Can't get pixel: %v", err)
+	}
+	if got, want := color.RGBAModel.Convert(col), color.RGBAModel.Convert(pixelcanvasioPalette[5]); got != want {
+		t.Errorf("Got pixel %v, want %v", got, want)
+	}
+}
+
+func Test_remoteDecodeImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(1, 0, color.RGBA{1, 2, 3, 4})
+	data := append([]byte{'B', 'G', 'R', 'A', 0, 0, 0, 2, 0, 0, 0, 1}, imageToBGRAArray(img)...)
+
+	decoded, err := remoteDecodeImage(data, image.Point{10, 20})
+	if err != nil {
+		t.Fatalf("Can't decode image: %v", err)
+	}
+	if want := image.Rect(10, 20, 12, 21); decoded.Rect != want {
+		t.Errorf("Image has bounds %v, want %v", decoded.Rect, want)
+	}
+	if got := decoded.RGBAAt(11, 20); got != (color.RGBA{1, 2, 3, 4}) {
+		t.Errorf("Got pixel %v, want %v", got, color.RGBA{1, 2, 3, 4})
+	}
+
+	if _, err := remoteDecodeImage(data[:14], image.Point{}); err == nil {
+		t.Errorf("Decoding truncated data succeeded, but it should fail")
+	}
+}
@@ -0,0 +1,277 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Payload hash for requests whose body isn't hashed. Allowed by S3 and compatible servers
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Minimal client for S3-compatible object storage, that can only put, get and list objects.
+// Requests are signed with AWS Signature Version 4 and use path-style URLs, which are supported by AWS S3, MinIO and others.
+type s3Client struct {
+	Endpoint        string // e.g. "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000"
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	httpClient *http.Client
+}
+
+func newS3Client(endpoint, region, bucket, accessKeyID, secretAccessKey string) *s3Client {
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Client{
+		Endpoint:        strings.TrimSuffix(endpoint, "/"),
+		Region:          region,
+		Bucket:          bucket,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		httpClient:      &http.Client{}, // No timeout, objects are streamed while recordings are replayed
+	}
+}
+
+// Returns the URL of an object
+func (sc *s3Client) objectURL(key string) string {
+	return sc.Endpoint + "/" + s3URIEncode(sc.Bucket, false) + "/" + s3URIEncode(key, false)
+}
+
+func (sc *s3Client) do(method, rawURL string, body io.Reader, contentLength int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = contentLength
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	s3Sign(req, sc.AccessKeyID, sc.SecretAccessKey, sc.Region, time.Now(), s3UnsignedPayload)
+
+	resp, err := sc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%v %v: %v %s", method, rawURL, resp.Status, message)
+	}
+
+	return resp, nil
+}
+
+// Uploads a local file as object with the given key
+func (sc *s3Client) putFile(key, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	resp, err := sc.do("PUT", sc.objectURL(key), f, stat.Size(), http.Header{"Content-Type": {"application/octet-stream"}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Returns the content of an object. If length is greater than 0, only the first length bytes are requested
+func (sc *s3Client) get(key string, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=0-%d", length-1))
+	}
+
+	resp, err := sc.do("GET", sc.objectURL(key), nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Returns the keys of all objects that start with prefix, sorted alphabetically
+func (sc *s3Client) list(prefix string) ([]string, error) {
+	keys := []string{}
+	continuationToken := ""
+
+	for {
+		query := map[string]string{"list-type": "2", "prefix": prefix}
+		if continuationToken != "" {
+			query["continuation-token"] = continuationToken
+		}
+
+		resp, err := sc.do("GET", sc.Endpoint+"/"+s3URIEncode(sc.Bucket, false)+"?"+s3CanonicalQuery(query), nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		result := struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse object list: %v", err)
+		}
+
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Signs the request with AWS Signature Version 4.
+// The host, range and all x-amz-* headers are signed.
+func s3Sign(req *http.Request, accessKeyID, secretAccessKey, region string, t time.Time, payloadHash string) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if key == "range" || strings.HasPrefix(key, "x-amz-") {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := map[string]string{}
+	for key, values := range req.URL.Query() {
+		query[key] = strings.Join(values, ",")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		s3CanonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = s3HMAC(key, part)
+	}
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", accessKeyID, scope, signedHeaders, signature))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Encodes the parameters sorted by their key, as needed for signing
+func s3CanonicalQuery(query map[string]string) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, key := range keys {
+		parts = append(parts, s3URIEncode(key, true)+"="+s3URIEncode(query[key], true))
+	}
+	return strings.Join(parts, "&")
+}
+
+// Percent-encodes everything except unreserved characters, like S3 expects it.
+// Slashes are kept, unless encodeSlash is true.
+func s3URIEncode(s string, encodeSlash bool) string {
+	result := strings.Builder{}
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '.', b == '_', b == '~':
+			result.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			result.WriteByte(b)
+		default:
+			fmt.Fprintf(&result, "%%%02X", b)
+		}
+	}
+	return result.String()
+}
+
+// Returns bucket and key of an URL in the form "s3://bucket/key"
+func s3ParseURL(rawURL string) (bucket, key string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("%v is not a s3:// URL", rawURL)
+	}
+
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
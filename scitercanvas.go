@@ -1,3 +1,5 @@
+//go:build !headless
+
 /*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
     Copyright (C) 2019  David Vogel
 
@@ -22,70 +24,79 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"image/png"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/Dadido3/go-sciter"
 	gorice "github.com/Dadido3/go-sciter/rice"
 	"github.com/Dadido3/go-sciter/window"
-	"github.com/nfnt/resize"
 )
 
+// Time that saving an image waits for the output region to be downloaded, if requested
+const sciterSaveImageWaitTimeout = 1 * time.Minute
+
 // A sciter window, showing a canvas
 type sciterCanvas struct {
 	connection connection
 	canvas     *canvas
+	filter     *displayFilter // Changes the colors that are shown, see displaySettings
 
-	handlerChan chan *sciter.Value // Queue of event data, so the main logic doesn't stop while sciter is processing it
-	ClosedMutex sync.RWMutex
-	Closed      bool
+	handlerChan        chan *sciter.Value // Queue of event data, so the main logic doesn't stop while sciter is processing it
+	unsubscribeCrashes func()             // Stops forwarding crash reports to the handler
+	ClosedMutex        sync.RWMutex
+	Closed             bool
 }
 
 // Opens a new sciter canvas and attaches itself to the given connection and canvas
 //
 // ONLY CALL FROM MAIN THREAD!
 func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
+	palette := can.Palette.getPalette()
+	if palette == nil {
+		palette = getConfiguredPalette(conf, con.getShortName())
+	}
+	filterSettings := getDisplaySettings()
+
 	sca := &sciterCanvas{
 		connection: con,
 		canvas:     can,
+		filter:     newDisplayFilter(filterSettings, palette),
 		Closed:     true,
 	}
 
+	// Colors that are added to the palette may be ambiguous, their patterns are used from the next image on
+	unsubscribePalette := can.Palette.subscribe(func(change canvasPaletteChange) {
+		sca.filter.setPalette(change.Palette)
+	})
+
 	w, err := window.New(sciter.SW_RESIZEABLE|sciter.SW_TITLEBAR|sciter.SW_CONTROLS|sciter.SW_GLASSY|sciter.SW_ENABLE_DEBUG, sciter.NewRect(50, 300, 800, 800))
 	if err != nil {
-		log.Panic(err)
+		uiLog.Panic(err)
 	}
 
 	gorice.HandleDataLoad(w.Sciter)
 
 	w.DefineFunction("subscribeCanvasEvents", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 2 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 		obj, cbHandler := args[0].Clone(), args[1].Clone() // Always clone, otherwise those are just references to sciter values and will be invalid if used after return
 		if !obj.IsObject() || !cbHandler.IsObjectFunction() {
-			log.Errorf("Wrong type of parameters")
+			uiLog.Errorf("Wrong type of parameters")
 			return sciter.NewValue("Wrong type of parameters")
 		}
 
 		sca.ClosedMutex.Lock()
-		defer sca.ClosedMutex.Unlock()
-
 		if sca.handlerChan != nil {
-			log.Errorf("Already subscribed")
+			sca.ClosedMutex.Unlock()
+			uiLog.Errorf("Already subscribed")
 			return sciter.NewValue("Already subscribed")
 		}
 
-		err := can.subscribeListener(sca, true) // Let the canvas manage virtual chunks for us
-		if err != nil {
-			log.Errorf("Can't subscribe to canvas: %v", err)
-			return sciter.NewValue(fmt.Sprintf("Can't subscribe to canvas: %v", err))
-		}
-
-		sca.handlerChan = make(chan *sciter.Value, 300) // Can be after can.subscribeListener, as the ClosedMutex is still locked here
+		sca.handlerChan = make(chan *sciter.Value, 300)
 		sca.Closed = false
 
 		go func(channel <-chan *sciter.Value) {
@@ -115,39 +126,68 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 					val.Append(event)
 					event.Release()
 				}
-				//log.Tracef("Invoke cbHandler with %v", val)
+				//uiLog.Tracef("Invoke cbHandler with %v", val)
 				cbHandler.Invoke(obj, "[Native Script]", val)
-				//log.Tracef("Invoke cbHandler with %v done", val)
+				//uiLog.Tracef("Invoke cbHandler with %v done", val)
 				val.Release()
-				//log.Tracef("val released")
+				//uiLog.Tracef("val released")
 			}
 		}(sca.handlerChan)
 
+		// Show crashes of any component, so they don't go unnoticed
+		sca.unsubscribeCrashes = crashSubscribe(sca.handleCrash)
+		sca.ClosedMutex.Unlock()
+
+		// Subscribe without holding the lock, as the canvas waits until the handlers got the initial events
+		err := can.subscribeListener(sca, true) // Let the canvas manage virtual chunks for us
+		if err != nil {
+			sca.ClosedMutex.Lock()
+			sca.unsubscribeCrashes()
+			close(sca.handlerChan)
+			sca.handlerChan = nil
+			sca.Closed = true
+			sca.ClosedMutex.Unlock()
+
+			uiLog.Errorf("Can't subscribe to canvas: %v", err)
+			return sciter.NewValue(fmt.Sprintf("Can't subscribe to canvas: %v", err))
+		}
+
 		return nil
 	})
 
 	w.DefineFunction("unsubscribeCanvasEvents", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 0 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 
 		// unsubscribeCanvasEvents is non blocking, but an Unsubscribed event is sent to the callback
 		go func() {
-			sca.ClosedMutex.Lock()
-			defer sca.ClosedMutex.Unlock()
+			sca.ClosedMutex.RLock()
+			subscribed := sca.handlerChan != nil
+			sca.ClosedMutex.RUnlock()
 
-			if sca.handlerChan == nil {
-				log.Errorf("Not subscribed")
+			if !subscribed {
+				uiLog.Errorf("Not subscribed")
 				return
 			}
 
+			// Unsubscribe without holding the lock, as the canvas waits until the handlers got all events
 			err := can.unsubscribeListener(sca)
 			if err != nil {
-				log.Errorf("Can't unsubscribe from canvas: %v", err)
+				uiLog.Errorf("Can't unsubscribe from canvas: %v", err)
 				return
 			}
 
+			sca.ClosedMutex.Lock()
+			defer sca.ClosedMutex.Unlock()
+
+			if sca.handlerChan == nil {
+				return // Already unsubscribed meanwhile
+			}
+
+			sca.unsubscribeCrashes()
+
 			val := sciter.NewValue()
 			val.Set("Type", "Unsubscribed")
 			sca.handlerChan <- val
@@ -169,12 +209,12 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 
 	w.DefineFunction("registerRects", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 1 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 		jsonRect := args[0] // Clone if value is needed after this function returned
 		if !jsonRect.IsObject() {
-			log.Errorf("Wrong type of parameters")
+			uiLog.Errorf("Wrong type of parameters")
 			return sciter.NewValue("Wrong type of parameters")
 		}
 
@@ -182,7 +222,7 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 
 		rects := []image.Rectangle{}
 		if err := json.Unmarshal([]byte(jsonRect.String()), &rects); err != nil {
-			log.Errorf("Error reading json: %v", err)
+			uiLog.Errorf("Error reading json: %v", err)
 			return sciter.NewValue(fmt.Sprintf("Error reading json: %v", err))
 		}
 
@@ -202,33 +242,35 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 
 	w.DefineFunction("setReplayTime", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 1 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 		sciterTime := args[0] // Clone if value is needed after this function returned
 		if !sciterTime.IsDate() {
-			log.Errorf("Wrong type of parameters")
+			uiLog.Errorf("Wrong type of parameters")
 			return sciter.NewValue("Wrong type of parameters")
 		}
 
 		conR, ok := con.(connectionReplay) // Check if connection has replay time methods
 		if !ok {
-			log.Errorf("Can't set replay time on %T", con)
+			uiLog.Errorf("Can't set replay time on %T", con)
 			return sciter.NewValue(fmt.Sprintf("Can't set replay time on %T", con))
 		}
 
 		t, err := sciterTime.Time()
 		if err != nil {
-			log.Errorf("Error getting time: %v", err)
+			uiLog.Errorf("Error getting time: %v", err)
 			return sciter.NewValue(fmt.Sprintf("Error getting time: %v", err))
 		}
 
 		err = conR.setReplayTime(t)
 		if err != nil {
-			log.Errorf("Can't set replay time %T", err)
+			uiLog.Errorf("Can't set replay time %T", err)
 			return sciter.NewValue(err.Error())
 		}
 
+		recordMacroStep("setReplayTime", map[string]interface{}{"replay": con.getShortName(), "time": t})
+
 		return nil
 	})
 
@@ -236,14 +278,14 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 		val = sciter.NewValue()
 
 		if len(args) != 0 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			val.Set("Error", "Wrong number of parameters")
 			return
 		}
 
 		conRep, ok := con.(connectionReplay) // Check if connection has replay time methods
 		if !ok {
-			log.Errorf("%T doesn't support setReplayTime", con)
+			uiLog.Errorf("%T doesn't support setReplayTime", con)
 			val.Set("Error", fmt.Sprintf("%T doesn't support setReplayTime", con))
 			return
 		}
@@ -264,14 +306,44 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 		return val
 	})
 
+	// Returns the pixels per minute of the last hour of each statistics region, see canvasStatistics
+	w.DefineFunction("getStatistics", func(args ...*sciter.Value) *sciter.Value {
+		val := sciter.NewValue()
+		if len(args) != 0 {
+			uiLog.Errorf("Wrong number of parameters")
+			val.Set("Error", "Wrong number of parameters")
+			return val
+		}
+
+		st, err := getCanvasStatistics(con.getShortName())
+		if err != nil {
+			val.Set("Error", err.Error())
+			return val
+		}
+
+		sciterRegions := sciter.NewValue()
+		now := time.Now()
+		series := st.getSeries(now.Add(-time.Hour), now)
+		for _, name := range st.getRegions() { // Sorted, so the order in the UI is stable
+			sciterSamples := sciter.NewValue()
+			for i, sample := range series[name] {
+				sciterSamples.SetIndex(i, sciter.NewValue(sample.Pixels))
+			}
+			sciterRegions.Set(name, sciterSamples)
+		}
+		val.Set("Regions", sciterRegions)
+
+		return val
+	})
+
 	w.DefineFunction("saveImage", func(args ...*sciter.Value) *sciter.Value {
-		if len(args) != 4 {
-			log.Errorf("Wrong number of parameters")
+		if len(args) != 5 {
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
-		sciterRect, sciterSize, sciterPath, cbHandler := args[0], args[1], args[2], args[3].Clone() // Clone if value is needed after this function has returned
-		if !sciterRect.IsObject() || !sciterSize.IsObject() || !sciterPath.IsString() || !cbHandler.IsObjectFunction() {
-			log.Errorf("Wrong type of parameters")
+		sciterRect, sciterSize, sciterPath, sciterWait, cbHandler := args[0], args[1], args[2], args[3], args[4].Clone() // Clone if value is needed after this function has returned
+		if !sciterRect.IsObject() || !sciterSize.IsObject() || !sciterPath.IsString() || !sciterWait.IsBool() || !cbHandler.IsObjectFunction() {
+			uiLog.Errorf("Wrong type of parameters")
 			return sciter.NewValue("Wrong type of parameters")
 		}
 
@@ -285,27 +357,34 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 		size := pixelSize{sciterSize.Get("X").Int(), sciterSize.Get("Y").Int()}
 
 		filename := sciterPath.String()
+		waitValid := sciterWait.Bool()
 
-		log.Tracef("Starting to save image %v at %v with size of %v", filename, rect, size)
+		uiLog.Tracef("Starting to save image %v at %v with size of %v", filename, rect, size)
 
 		file, err := os.Create(filename)
 		if err != nil {
-			log.Errorf("Can't create file %v: %v", filename, err)
+			uiLog.Errorf("Can't create file %v: %v", filename, err)
 			return sciter.NewValue(fmt.Sprintf("Can't create file %v: %v", filename, err))
 		}
 
+		// Macros can only write into the exports directory, so only the name of the file is kept
+		recordMacroStep("saveImage", map[string]interface{}{"game": con.getShortName(), "rect": formatRectangle(rect), "width": size.X, "height": size.Y, "fileName": filepath.Base(filename)})
+
 		go func() {
 			defer file.Close()
 
-			img, err := can.getImageCopy(rect, false, true)
-			if err != nil {
-				log.Errorf("Can't get image at %v: %v", rect, err)
+			// The output region is registered by the window, so it's downloaded
+			if waitValid && !can.waitValid(rect, sciterSaveImageWaitTimeout, nil) {
+				uiLog.Errorf("Can't save image %v: Rectangle %v isn't completely downloaded after %v", filename, rect, sciterSaveImageWaitTimeout)
+				return
+			}
+
+			if err := can.writeImage(file, rect, size); err != nil {
+				uiLog.Errorf("Can't save image %v: %v", filename, err)
 				return
 			}
-			resized := resize.Resize(uint(size.X), uint(size.Y), img, resize.Lanczos3)
-			png.Encode(file, resized)
 
-			log.Tracef("Finished to save image %v", filename)
+			uiLog.Tracef("Finished to save image %v", filename)
 
 			cbHandler.Invoke(sciter.NewValue(), "[Native Script]")
 		}()
@@ -313,21 +392,43 @@ func sciterOpenCanvas(con connection, can *canvas) (closedChan chan struct{}) {
 		return nil
 	})
 
+	// Returns the colors and the scale of the display filters, so the script can draw the grid, the selection and the patterns
+	w.DefineFunction("getDisplaySettings", func(args ...*sciter.Value) *sciter.Value {
+		val := sciter.NewValue()
+		if len(args) != 0 {
+			uiLog.Errorf("Wrong number of parameters")
+			val.Set("Error", "Wrong number of parameters")
+			return val
+		}
+
+		val.Set("HighContrast", filterSettings.HighContrast)
+		val.Set("GridColor", filterSettings.getGridColor())
+		val.Set("SelectionColor", filterSettings.getSelectionColor())
+		val.Set("Scale", sca.filter.getScale())
+
+		return val
+	})
+
 	closedChan = make(chan struct{}) // Signals that the window got closed
 	w.DefineFunction("signalClosed", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 0 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 
 		close(rectsChan)
 		close(closedChan)
+		unsubscribePalette()
+
+		if _, ok := con.(connectionReplay); ok {
+			recordMacroStep("closeReplay", map[string]interface{}{"replay": con.getShortName()})
+		}
 
 		return nil
 	})
 
 	if err := w.LoadFile("rice://ui/canvas.htm"); err != nil {
-		log.Panic(err)
+		uiLog.Panic(err)
 	}
 
 	// Testing pixel events
@@ -415,11 +516,18 @@ func (s *sciterCanvas) handleSetImage(img image.Image, valid bool, vcIDs []int)
 		return fmt.Errorf("Listener is closed")
 	}
 
-	imageArray := imageToBGRAArray(img)
+	// The displayed image may be larger than the canvas image, the script scales it to the canvas coordinates
+	displayImg := img
+	if s.filter.isActive() {
+		displayImg = s.filter.filterImage(img)
+	}
+
+	imageArray := imageToBGRAArray(displayImg)
 	headerArray := [12]byte{'B', 'G', 'R', 'A'}
-	binary.BigEndian.PutUint32(headerArray[4:8], uint32(img.Bounds().Dx()))
-	binary.BigEndian.PutUint32(headerArray[8:12], uint32(img.Bounds().Dy()))
+	binary.BigEndian.PutUint32(headerArray[4:8], uint32(displayImg.Bounds().Dx()))
+	binary.BigEndian.PutUint32(headerArray[8:12], uint32(displayImg.Bounds().Dy()))
 	array := append(headerArray[:], imageArray...)
+	putBuffer(imageArray)
 
 	val := sciter.NewValue()
 	val.Set("Type", "SetImage")
@@ -451,7 +559,11 @@ func (s *sciterCanvas) handleSetPixel(pos image.Point, color color.Color, vcID i
 		return fmt.Errorf("Listener is closed")
 	}
 
-	r, g, b, a := color.RGBA()
+	displayColor := color
+	if s.filter.isActive() {
+		displayColor = s.filter.filterColor(color)
+	}
+	r, g, b, a := displayColor.RGBA()
 
 	val := sciter.NewValue()
 	val.Set("Type", "SetPixel")
@@ -462,12 +574,64 @@ func (s *sciterCanvas) handleSetPixel(pos image.Point, color color.Color, vcID i
 	val.Set("B", b>>8)
 	val.Set("A", a>>8)
 	val.Set("VcID", vcID)
+	if s.filter.getScale() > 1 {
+		cellArray := sciter.NewValue() // Flat array of R, G, B and A of every pixel of the cell, row by row
+		defer cellArray.Release()
+		s.setCellArray(cellArray, 0, pos, color)
+		val.Set("Cell", cellArray)
+	}
 
 	s.handlerChan <- val
 
 	return nil
 }
 
+// Sends all pixels in a single event, as every event costs a call into the script
+func (s *sciterCanvas) handleSetPixels(pixels []canvasListenerPixel) error {
+	s.ClosedMutex.RLock()
+	defer s.ClosedMutex.RUnlock()
+	if s.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	val := sciter.NewValue()
+	val.Set("Type", "SetPixels")
+	valArray := sciter.NewValue() // Flat array of X, Y, R, G, B, A and VcID of each pixel
+	defer valArray.Release()
+	cellArray := sciter.NewValue() // Flat array of the cells of each pixel, if the filter uses a scale
+	defer cellArray.Release()
+	scale := s.filter.getScale()
+	for i, pixel := range pixels {
+		col := pixel.Color
+		if s.filter.isActive() {
+			col = s.filter.filterColor(col)
+		}
+		r, g, b, a := col.RGBA()
+		for j, v := range []int{pixel.Pos.X, pixel.Pos.Y, int(r >> 8), int(g >> 8), int(b >> 8), int(a >> 8), pixel.VCID} {
+			valArray.SetIndex(i*7+j, v)
+		}
+		if scale > 1 {
+			s.setCellArray(cellArray, i*scale*scale*4, pixel.Pos, pixel.Color)
+		}
+	}
+	val.Set("Pixels", valArray)
+	if scale > 1 {
+		val.Set("Cells", cellArray)
+	}
+
+	s.handlerChan <- val
+
+	return nil
+}
+
+// Writes the displayed cell of a pixel into the flat array, starting at the given index
+func (s *sciterCanvas) setCellArray(array *sciter.Value, index int, pos image.Point, col color.Color) {
+	cell := s.filter.filterPixel(pos, col)
+	for i, v := range cell.Pix {
+		array.SetIndex(index+i, int(v))
+	}
+}
+
 func (s *sciterCanvas) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
 	s.ClosedMutex.RLock()
 	defer s.ClosedMutex.RUnlock()
@@ -493,6 +657,30 @@ func (s *sciterCanvas) handleSignalDownload(rect image.Rectangle, vcIDs []int) e
 	return nil
 }
 
+func (s *sciterCanvas) handleDownloadFailed(rect image.Rectangle, failures int, reason string, persistent bool, vcIDs []int) error {
+	s.ClosedMutex.RLock()
+	defer s.ClosedMutex.RUnlock()
+	if s.Closed {
+		return fmt.Errorf("Listener is closed")
+	}
+
+	val := sciter.NewValue()
+	val.Set("Type", "DownloadFailed")
+	val.Set("Failures", failures)
+	val.Set("Reason", reason)
+	val.Set("Persistent", persistent)
+	valArray := sciter.NewValue()
+	defer valArray.Release()
+	for k, v := range vcIDs {
+		valArray.SetIndex(k, v)
+	}
+	val.Set("VcIDs", valArray)
+
+	s.handlerChan <- val
+
+	return nil
+}
+
 func (s *sciterCanvas) handleChunksChange(create, remove map[image.Rectangle]int) error {
 	s.ClosedMutex.RLock()
 	defer s.ClosedMutex.RUnlock()
@@ -559,3 +747,23 @@ func (s *sciterCanvas) handleSetTime(t time.Time) error {
 
 	return nil
 }
+
+// Forwards a crash report to the handler, without blocking the crashed goroutine
+func (s *sciterCanvas) handleCrash(report crashReport) {
+	s.ClosedMutex.RLock()
+	defer s.ClosedMutex.RUnlock()
+	if s.Closed {
+		return
+	}
+
+	val := sciter.NewValue()
+	val.Set("Type", "Crash")
+	val.Set("Component", report.Component)
+	val.Set("Error", report.Error)
+
+	select {
+	case s.handlerChan <- val:
+	default:
+		val.Release()
+	}
+}
@@ -1,3 +1,5 @@
+//go:build !headless
+
 /*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
     Copyright (C) 2019  David Vogel
 
@@ -24,25 +26,29 @@ import (
 	"github.com/Dadido3/go-sciter/window"
 )
 
+var uiLog = moduleLog("ui")
+
+// Macros are run by api, see runMacro.
+//
 // ONLY CALL FROM MAIN THREAD!
-func sciterOpenMain() {
+func sciterOpenMain(api *apiServer) {
 	//sciter.SetOption(sciter.SCITER_SET_DEBUG_MODE, 1)
 	sciter.SetOption(sciter.SCITER_SET_SCRIPT_RUNTIME_FEATURES, sciter.ALLOW_FILE_IO|sciter.ALLOW_SOCKET_IO|sciter.ALLOW_EVAL|sciter.ALLOW_SYSINFO) // Needed for the inspector to work!
 
 	w, err := window.New(sciter.SW_MAIN|sciter.SW_RESIZEABLE|sciter.SW_TITLEBAR|sciter.SW_CONTROLS|sciter.SW_ENABLE_DEBUG|sciter.SW_GLASSY, sciter.NewRect(300, 300, 500, 400)) // TODO: Store/Restore window position or open it in screen center
 	if err != nil {
-		log.Panic(err)
+		uiLog.Panic(err)
 	}
 
 	gorice.HandleDataLoad(w.Sciter)
 
 	w.DefineFunction("openLocal", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 1 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 		if !args[0].IsString() {
-			log.Errorf("Wrong type of parameters")
+			uiLog.Errorf("Wrong type of parameters")
 			return sciter.NewValue("Wrong type of parameters")
 		}
 
@@ -50,7 +56,7 @@ func sciterOpenMain() {
 
 		connectionType, ok := connectionTypes[game]
 		if !ok {
-			log.Errorf("game %v not found", game)
+			uiLog.Errorf("game %v not found", game)
 			return sciter.NewValue(fmt.Sprintf("game %v not found", game))
 		}
 
@@ -58,9 +64,10 @@ func sciterOpenMain() {
 
 		closeSignal := sciterOpenCanvas(con, can)
 
+		id := shutdown.register("Window of "+con.getName(), map[shutdownStage]func(){shutdownConnections: con.Close})
 		go func() {
 			<-closeSignal
-			con.Close()
+			shutdown.close(id)
 		}()
 
 		return nil
@@ -68,11 +75,11 @@ func sciterOpenMain() {
 
 	w.DefineFunction("recordLocal", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 1 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 		if !args[0].IsString() {
-			log.Errorf("Wrong type of parameters")
+			uiLog.Errorf("Wrong type of parameters")
 			return sciter.NewValue("Wrong type of parameters")
 		}
 
@@ -80,29 +87,24 @@ func sciterOpenMain() {
 
 		connectionType, ok := connectionTypes[game]
 		if !ok {
-			log.Errorf("game %v not found", game)
+			uiLog.Errorf("game %v not found", game)
 			return sciter.NewValue(fmt.Sprintf("game %v not found", game))
 		}
 
 		con, can := connectionType.FunctionNew()
 
-		closeSignal := sciterOpenRecorder(con, can)
-
-		go func() {
-			<-closeSignal
-			con.Close()
-		}()
+		sciterOpenRecorder(con, can) // The window closes the connection
 
 		return nil
 	})
 
 	w.DefineFunction("replayLocal", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 1 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 		if !args[0].IsString() {
-			log.Errorf("Wrong type of parameters")
+			uiLog.Errorf("Wrong type of parameters")
 			return sciter.NewValue("Wrong type of parameters")
 		}
 
@@ -110,23 +112,98 @@ func sciterOpenMain() {
 
 		con, can, err := newCanvasDiskReader(game)
 		if err != nil {
-			log.Errorf("Can't open recording of %v: %v", game, err)
+			uiLog.Errorf("Can't open recording of %v: %v", game, err)
 			return sciter.NewValue(fmt.Sprintf("Can't open recording of %v: %v", game, err))
 		}
 
 		closeSignal := sciterOpenCanvas(con, can)
 
+		id := shutdown.register("Window of "+con.getName(), map[shutdownStage]func(){shutdownConnections: con.Close})
 		go func() {
 			<-closeSignal
-			con.Close()
+			shutdown.close(id)
 		}()
 
+		recordMacroStep("openReplay", map[string]interface{}{"game": game})
+
 		return nil
 	})
 
+	w.DefineFunction("startMacro", func(args ...*sciter.Value) *sciter.Value {
+		if len(args) != 1 {
+			uiLog.Errorf("Wrong number of parameters")
+			return sciter.NewValue("Wrong number of parameters")
+		}
+		if !args[0].IsString() {
+			uiLog.Errorf("Wrong type of parameters")
+			return sciter.NewValue("Wrong type of parameters")
+		}
+
+		if err := startMacroRecording(args[0].String()); err != nil {
+			uiLog.Errorf("Can't record macro: %v", err)
+			return sciter.NewValue(err.Error())
+		}
+
+		return nil
+	})
+
+	w.DefineFunction("stopMacro", func(args ...*sciter.Value) *sciter.Value {
+		if len(args) != 0 {
+			uiLog.Errorf("Wrong number of parameters")
+			return sciter.NewValue("Wrong number of parameters")
+		}
+
+		if _, err := stopMacroRecording(); err != nil {
+			uiLog.Errorf("Can't store macro: %v", err)
+			return sciter.NewValue(err.Error())
+		}
+
+		return nil
+	})
+
+	w.DefineFunction("runMacro", func(args ...*sciter.Value) *sciter.Value {
+		if len(args) != 2 {
+			uiLog.Errorf("Wrong number of parameters")
+			return sciter.NewValue("Wrong number of parameters")
+		}
+		if !args[0].IsString() || !args[1].IsBool() {
+			uiLog.Errorf("Wrong type of parameters")
+			return sciter.NewValue("Wrong type of parameters")
+		}
+
+		m, err := loadMacro(args[0].String())
+		if err != nil {
+			uiLog.Errorf("Can't run macro: %v", err)
+			return sciter.NewValue(err.Error())
+		}
+		delays := args[1].Bool()
+
+		// Steps may wait for downloads or delays, so don't block the window
+		go func() {
+			if _, err := runMacro(api, m, delays); err != nil {
+				uiLog.Errorf("Can't run macro: %v", err)
+			}
+		}()
+
+		return nil
+	})
+
+	w.DefineFunction("listMacros", func(args ...*sciter.Value) *sciter.Value {
+		if len(args) != 0 {
+			uiLog.Errorf("Wrong number of parameters")
+			return sciter.NewValue("Wrong number of parameters")
+		}
+
+		val := sciter.NewValue()
+		for i, name := range listMacros() {
+			val.SetIndex(i, sciter.NewValue(name))
+		}
+		return val
+	})
+
 	w.DefineFunction("version", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 0 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 
@@ -134,7 +211,7 @@ func sciterOpenMain() {
 	})
 
 	if err := w.LoadFile("rice://ui/main.htm"); err != nil {
-		log.Panic(err)
+		uiLog.Panic(err)
 	}
 
 	w.Show()
@@ -1,3 +1,5 @@
+//go:build !headless
+
 /*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
     Copyright (C) 2019  David Vogel
 
@@ -22,7 +24,6 @@ import (
 	"image"
 	"sync"
 
-	"github.com/Dadido3/configdb"
 	"github.com/Dadido3/go-sciter"
 	gorice "github.com/Dadido3/go-sciter/rice"
 	"github.com/Dadido3/go-sciter/window"
@@ -33,13 +34,14 @@ type sciterRecorder struct {
 	connection connection
 	canvas     *canvas
 
-	DiskWriter *canvasDiskWriter
+	Recorder *gameRecorder
 
 	ClosedMutex sync.RWMutex
 	Closed      bool
 }
 
-// Opens a new sciter recorder and attaches a diskwriter to the given canvas
+// Opens a new sciter recorder and attaches a diskwriter to the given canvas.
+// The connection is closed together with the window, or by the shutdown.
 //
 // ONLY CALL FROM MAIN THREAD!
 func sciterOpenRecorder(con connection, can *canvas) (closedChan chan struct{}) {
@@ -49,41 +51,41 @@ func sciterOpenRecorder(con connection, can *canvas) (closedChan chan struct{})
 		Closed:     true,
 	}
 
-	cdw, err := can.newCanvasDiskWriter(con.getShortName())
+	gr, err := newGameRecorder(conf, con, can)
 	if err != nil {
-		log.Panic(err)
+		uiLog.Panic(err)
 	}
-	sre.DiskWriter = cdw
+	sre.Recorder = gr
 
-	confCallbackID := conf.RegisterCallback([]string{".recorder." + con.getShortName() + ".rects"}, func(c *configdb.Config, modified, added, removed []string) {
-		rects := []image.Rectangle{}
-		c.Get(".recorder."+con.getShortName()+".rects", &rects)
-		cdw.setListeningRects(rects)
+	// Close the connection first, so the recorder gets all events
+	shutdownID := shutdown.register("Recorder window of "+con.getName(), map[shutdownStage]func(){
+		shutdownConnections: con.Close,
+		shutdownRecorders:   gr.Close,
 	})
 
 	w, err := window.New(sciter.SW_RESIZEABLE|sciter.SW_TITLEBAR|sciter.SW_CONTROLS|sciter.SW_GLASSY|sciter.SW_ENABLE_DEBUG, sciter.NewRect(50, 300, 400, 500))
 	if err != nil {
-		log.Panic(err)
+		uiLog.Panic(err)
 	}
 
 	gorice.HandleDataLoad(w.Sciter)
 
 	w.DefineFunction("getRects", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 0 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 
 		rects := []image.Rectangle{}
 
 		if err := conf.Get(".recorder."+con.getShortName()+".rects", &rects); err != nil {
-			log.Errorf("Error reading configuration: %v", err)
+			uiLog.Errorf("Error reading configuration: %v", err)
 			return sciter.NewValue(fmt.Sprintf("Error reading configuration: %v", err))
 		}
 
 		b, err := json.Marshal(rects)
 		if err != nil {
-			log.Errorf("Error marshalling json: %v", err)
+			uiLog.Errorf("Error marshalling json: %v", err)
 			return sciter.NewValue(fmt.Sprintf("Error marshalling json: %v", err))
 		}
 
@@ -94,12 +96,12 @@ func sciterOpenRecorder(con connection, can *canvas) (closedChan chan struct{})
 
 	w.DefineFunction("registerRects", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 1 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 		jsonRects := args[0] // Clone if value is needed after this function returned
 		if !jsonRects.IsObject() {
-			log.Errorf("Wrong type of parameters")
+			uiLog.Errorf("Wrong type of parameters")
 			return sciter.NewValue("Wrong type of parameters")
 		}
 
@@ -107,36 +109,42 @@ func sciterOpenRecorder(con connection, can *canvas) (closedChan chan struct{})
 
 		rects := []image.Rectangle{}
 		if err := json.Unmarshal([]byte(jsonRects.String()), &rects); err != nil {
-			log.Errorf("Error reading json: %v", err)
+			uiLog.Errorf("Error reading json: %v", err)
 			return sciter.NewValue(fmt.Sprintf("Error reading json: %v", err))
 		}
 
 		if err := conf.Set(".recorder."+con.getShortName()+".rects", rects); err != nil {
-			log.Errorf("Error writing configuration: %v", err)
+			uiLog.Errorf("Error writing configuration: %v", err)
 			return sciter.NewValue(fmt.Sprintf("Error writing configuration: %v", err))
 		}
 
+		macroRects := []string{}
+		for _, rect := range rects {
+			macroRects = append(macroRects, formatRectangle(rect))
+		}
+		recordMacroStep("startRecording", map[string]interface{}{"game": con.getShortName(), "rects": macroRects})
+
 		return nil
 	})
 
 	closedChan = make(chan struct{}) // Signals that the window got closed
 	w.DefineFunction("signalClosed", func(args ...*sciter.Value) *sciter.Value {
 		if len(args) != 0 {
-			log.Errorf("Wrong number of parameters")
+			uiLog.Errorf("Wrong number of parameters")
 			return sciter.NewValue("Wrong number of parameters")
 		}
 
-		conf.UnregisterCallback(confCallbackID)
-
-		sre.DiskWriter.Close()
+		shutdown.close(shutdownID)
 
 		close(closedChan)
 
+		recordMacroStep("stopRecording", map[string]interface{}{"game": con.getShortName()})
+
 		return nil
 	})
 
 	if err := w.LoadFile("rice://ui/recorder.htm"); err != nil {
-		log.Panic(err)
+		uiLog.Panic(err)
 	}
 
 	w.Show()
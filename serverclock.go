@@ -0,0 +1,97 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Samples older than this don't narrow the estimate anymore, so drifting clocks are followed
+const serverClockMaxAge = 1 * time.Hour
+
+// Estimates the offset of the clock of a game server to the local clock, so that events are timed by the game and not by a possibly skewed local clock.
+//
+// Every sample is a time reported by the server, together with the local times when the request was sent and the response was received.
+// The server time lies somewhere in between, so each sample limits the offset to an interval.
+// The intersection of the intervals of recent samples is the estimate.
+// The local clock is only corrected if it's certainly off, that is if the estimate doesn't contain zero. Otherwise the noise of the estimate would just shift events around.
+type serverClock struct {
+	sync.RWMutex
+
+	min, max time.Duration // Interval the offset is in
+	since    time.Time     // Local time of the oldest sample in the interval
+	valid    bool
+}
+
+func newServerClock() *serverClock {
+	return &serverClock{}
+}
+
+// Adds a sample. serverTime is truncated to resolution, sent and received are local times.
+func (sc *serverClock) observe(serverTime time.Time, resolution time.Duration, sent, received time.Time) {
+	if received.Before(sent) {
+		return
+	}
+	min, max := serverTime.Sub(received), serverTime.Add(resolution).Sub(sent)
+
+	sc.Lock()
+	defer sc.Unlock()
+
+	// Start over if the clocks jumped, or if the estimate is too old
+	if !sc.valid || min > sc.max || max < sc.min || received.Sub(sc.since) > serverClockMaxAge {
+		sc.min, sc.max, sc.since, sc.valid = min, max, sent, true
+		return
+	}
+
+	if min > sc.min {
+		sc.min = min
+	}
+	if max < sc.max {
+		sc.max = max
+	}
+}
+
+// Adds the Date header of a HTTP response as sample, if there is one
+func (sc *serverClock) observeResponse(header http.Header, sent, received time.Time) {
+	serverTime, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return
+	}
+	sc.observe(serverTime, time.Second, sent, received)
+}
+
+// Returns the estimated offset of the server clock, and whether there is any estimate yet
+func (sc *serverClock) getOffset() (time.Duration, bool) {
+	sc.RLock()
+	defer sc.RUnlock()
+
+	switch {
+	case !sc.valid:
+		return 0, false
+	case sc.min <= 0 && sc.max >= 0:
+		return 0, true
+	}
+	return sc.min + (sc.max-sc.min)/2, true
+}
+
+// Returns the current time of the server, or the local time if there is no estimate yet
+func (sc *serverClock) now() time.Time {
+	offset, _ := sc.getOffset()
+	return time.Now().Add(offset)
+}
@@ -0,0 +1,65 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_serverClock(t *testing.T) {
+	sc := newServerClock()
+
+	if offset, ok := sc.getOffset(); ok || offset != 0 {
+		t.Errorf("Got offset %v, %v without samples, want 0, false", offset, ok)
+	}
+
+	// The server is 10.3 seconds ahead, and its responses take 200ms
+	local := time.Date(2019, 6, 14, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		sent := local.Add(time.Duration(i) * 1370 * time.Millisecond)
+		received := sent.Add(200 * time.Millisecond)
+		server := sent.Add(10*time.Second + 400*time.Millisecond).Truncate(time.Second)
+		sc.observeResponse(http.Header{"Date": {server.Format(http.TimeFormat)}}, sent, received)
+	}
+
+	offset, ok := sc.getOffset()
+	if !ok || offset < 10100*time.Millisecond || offset > 10500*time.Millisecond {
+		t.Errorf("Got offset %v, %v, want about 10.3s", offset, ok)
+	}
+
+	// Clocks that agree within the precision of the samples aren't corrected
+	synced := newServerClock()
+	synced.observeResponse(http.Header{"Date": {local.Add(300 * time.Millisecond).Format(http.TimeFormat)}}, local.Add(100*time.Millisecond), local.Add(400*time.Millisecond))
+	if offset, ok := synced.getOffset(); !ok || offset != 0 {
+		t.Errorf("Got offset %v, %v for synchronized clocks, want 0, true", offset, ok)
+	}
+
+	// Jumping clocks restart the estimate
+	sent := local.Add(time.Minute)
+	sc.observe(sent.Add(-time.Hour), 0, sent, sent.Add(100*time.Millisecond))
+	if offset, _ := sc.getOffset(); offset > -time.Hour+time.Second || offset < -time.Hour-time.Second {
+		t.Errorf("Got offset %v after the clock jumped, want about -1h", offset)
+	}
+
+	// Responses without date are ignored
+	sc.observeResponse(http.Header{}, sent, sent)
+	if offset, _ := sc.getOffset(); offset > -time.Hour+time.Second || offset < -time.Hour-time.Second {
+		t.Errorf("Got offset %v after a response without date, want about -1h", offset)
+	}
+}
@@ -0,0 +1,176 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var shutdownLog = moduleLog("shutdown")
+
+// Stages of the shutdown, they run one after another in this order
+type shutdownStage int
+
+const (
+	shutdownConnections shutdownStage = iota // Stop game connections, so no events arrive anymore
+	shutdownRecorders                        // Write all received events, and finish the files
+	shutdownCanvases                         // Unsubscribe the remaining listeners, and close canvases
+	shutdownServers                          // API server, control socket, debug server and other services
+	shutdownStageCount
+)
+
+var shutdownStageNames = [shutdownStageCount]string{"connections", "recorders", "canvases", "servers"}
+
+// Time that the modules get for each stage, before the shutdown continues without them
+const shutdownStageTimeout = 30 * time.Second
+
+// Module that is closed by the shutdown, with a function for each stage it's part of
+type shutdownTask struct {
+	Name   string
+	Stages map[shutdownStage]func()
+}
+
+// Runs the stages of the task one after another
+func (task shutdownTask) run() {
+	for stage := shutdownStage(0); stage < shutdownStageCount; stage++ {
+		if fn, ok := task.Stages[stage]; ok {
+			fn()
+		}
+	}
+}
+
+// Closes all registered modules in stages when the program ends.
+//
+// Each module closing on its own would tear down servers and recorders while connections still send events.
+// Instead, all connections are stopped first, then all recorders write what they got, and so on.
+type shutdownCoordinator struct {
+	sync.Mutex
+
+	tasks   map[int]shutdownTask
+	counter int
+}
+
+// Coordinates the shutdown of the whole program, see main()
+var shutdown = newShutdownCoordinator()
+
+func newShutdownCoordinator() *shutdownCoordinator {
+	return &shutdownCoordinator{
+		tasks: map[int]shutdownTask{},
+	}
+}
+
+// Registers a module that is closed by the shutdown.
+// Returns an ID for close() or unregister().
+func (sc *shutdownCoordinator) register(name string, stages map[shutdownStage]func()) int {
+	sc.Lock()
+	defer sc.Unlock()
+
+	sc.counter++
+	sc.tasks[sc.counter] = shutdownTask{Name: name, Stages: stages}
+
+	return sc.counter
+}
+
+// Removes a module from the shutdown.
+// Returns false if the shutdown already took over, then the module must not be closed by anyone else.
+func (sc *shutdownCoordinator) unregister(id int) bool {
+	sc.Lock()
+	defer sc.Unlock()
+
+	if _, ok := sc.tasks[id]; !ok {
+		return false
+	}
+	delete(sc.tasks, id)
+
+	return true
+}
+
+// Closes a module before the shutdown, in the order of the stages.
+// Does nothing if the shutdown closes it already.
+func (sc *shutdownCoordinator) close(id int) {
+	sc.Lock()
+	task, ok := sc.tasks[id]
+	delete(sc.tasks, id)
+	sc.Unlock()
+
+	if ok {
+		task.run()
+	}
+}
+
+// Closes all registered modules stage by stage.
+// The modules of a stage are closed at the same time, modules that don't finish within the timeout are left behind.
+// Modules that are registered afterwards aren't closed by this.
+func (sc *shutdownCoordinator) run(timeout time.Duration) {
+	sc.Lock()
+	ids := make([]int, 0, len(sc.tasks))
+	for id := range sc.tasks {
+		ids = append(ids, id)
+	}
+	tasks := sc.tasks
+	sc.tasks = map[int]shutdownTask{}
+	sc.Unlock()
+
+	// Newer modules may depend on older ones, so they are closed first
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	for stage := shutdownStage(0); stage < shutdownStageCount; stage++ {
+		type result struct {
+			name string
+			done chan struct{}
+		}
+		results := []result{}
+		for _, id := range ids {
+			task := tasks[id]
+			fn, ok := task.Stages[stage]
+			if !ok {
+				continue
+			}
+			r := result{task.Name, make(chan struct{})}
+			results = append(results, r)
+			go func() {
+				defer close(r.done)
+				fn()
+			}()
+		}
+		if len(results) == 0 {
+			continue
+		}
+
+		shutdownLog.Debugf("Closing %v of %v modules", shutdownStageNames[stage], len(results))
+		deadline := time.NewTimer(timeout)
+		expired := false
+		for _, r := range results {
+			if !expired {
+				select {
+				case <-r.done:
+					continue
+				case <-deadline.C:
+					expired = true
+				}
+			}
+			select {
+			case <-r.done:
+			default:
+				shutdownLog.Warnf("%v didn't close its %v within %v, continuing without it", r.name, shutdownStageNames[stage], timeout)
+			}
+		}
+		deadline.Stop()
+	}
+}
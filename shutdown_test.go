@@ -0,0 +1,69 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_shutdownCoordinator(t *testing.T) {
+	sc := newShutdownCoordinator()
+
+	mutex := sync.Mutex{}
+	calls := []string{}
+	record := func(s string) func() {
+		return func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			calls = append(calls, s)
+		}
+	}
+
+	sc.register("A", map[shutdownStage]func(){shutdownServers: record("A servers"), shutdownConnections: record("A connections")})
+	sc.register("B", map[shutdownStage]func(){shutdownRecorders: record("B recorders")})
+	removed := sc.register("C", map[shutdownStage]func(){shutdownConnections: record("C connections")})
+	closed := sc.register("D", map[shutdownStage]func(){shutdownRecorders: record("D recorders"), shutdownConnections: record("D connections")})
+	sc.register("E", map[shutdownStage]func(){shutdownCanvases: func() { time.Sleep(time.Second) }})
+
+	if !sc.unregister(removed) {
+		t.Errorf("Can't unregister module")
+	}
+
+	// Closing a module before the shutdown runs its stages in order
+	sc.close(closed)
+	if got := strings.Join(calls, ", "); got != "D connections, D recorders" {
+		t.Errorf("Closing a module called %v", got)
+	}
+	calls = nil
+
+	// Modules that don't finish in time are left behind
+	start := time.Now()
+	sc.run(100 * time.Millisecond)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Shutdown took %v, it waited for the module that didn't finish", d)
+	}
+	if got := strings.Join(calls, ", "); got != "A connections, B recorders, A servers" {
+		t.Errorf("Shutdown called %v", got)
+	}
+
+	if sc.unregister(1) {
+		t.Errorf("Unregistered a module the shutdown took over")
+	}
+}
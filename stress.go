@@ -0,0 +1,261 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var stressLog = moduleLog("stress")
+
+// Interval in which the memory is sampled and the progress is logged
+const stressSampleInterval = 100 * time.Millisecond
+
+// Settings of a stress run, see runStress
+type stressSettings struct {
+	Rect      image.Rectangle // Virtual canvas that the pixels are spread over
+	Pixels    int             // Number of pixel events
+	Rate      int             // Pixels per second, 0 sets them as fast as possible
+	Listeners int             // Number of listeners that get every event
+	Record    bool            // Also record every event into recordings/stress/
+	Keep      bool            // Keep the recording, instead of deleting it afterwards
+	Seed      int64           // Seed of the random positions and colors
+}
+
+var defaultStressSettings = stressSettings{
+	Rect:      image.Rect(-4096, -4096, 4096, 4096),
+	Pixels:    1000000,
+	Listeners: 4,
+	Record:    false,
+	Seed:      1,
+}
+
+func (s stressSettings) validate() error {
+	if s.Rect.Empty() {
+		return fmt.Errorf("Rectangle %v is empty", s.Rect)
+	}
+	if s.Pixels <= 0 {
+		return fmt.Errorf("Number of pixels must be positive")
+	}
+	if s.Rate < 0 {
+		return fmt.Errorf("Rate must not be negative")
+	}
+	if s.Listeners < 0 {
+		return fmt.Errorf("Number of listeners must not be negative")
+	}
+	return nil
+}
+
+// Result of a stress run, sizes are in MiB
+type stressReport struct {
+	Pixels          int     // Pixel events that were set on the canvas
+	Chunks          int     // Chunks that were created on the way
+	Listeners       int     // Listeners that got every event
+	Seconds         float64 // Time from the first event until all listeners and the recorder got the last one
+	PixelsPerSecond float64 // Pixels that were set on the canvas per second
+	Delivered       int64   // Pixel events that reached the listeners
+	RecordedMiB     float64 `json:",omitempty"` // Size of the recording
+	DroppedEvents   uint64  // Events that the recorder had to drop, as the disk couldn't keep up
+	PeakHeapMiB     float64 // Highest heap usage that was sampled
+	PeakSysMiB      float64 // Highest memory obtained from the OS
+	PeakChunksMiB   float64 // Highest memory of the chunk images, see memoryUsage
+	PeakQueuesMiB   float64 // Highest memory of the listener and recording queues
+}
+
+// Listener that only counts the pixel events it gets
+type stressListener struct {
+	pixels int64
+}
+
+func (l *stressListener) handleSetPixel(pos image.Point, col color.Color, vcID int) error {
+	atomic.AddInt64(&l.pixels, 1)
+	return nil
+}
+
+func (l *stressListener) handleSetPixels(pixels []canvasListenerPixel) error {
+	atomic.AddInt64(&l.pixels, int64(len(pixels)))
+	return nil
+}
+
+func (l *stressListener) handleInvalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (l *stressListener) handleInvalidateAll() error {
+	return nil
+}
+
+func (l *stressListener) handleRevalidateRect(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (l *stressListener) handleSetImage(img image.Image, valid bool, vcIDs []int) error {
+	return nil
+}
+
+func (l *stressListener) handleSignalDownload(rect image.Rectangle, vcIDs []int) error {
+	return nil
+}
+
+func (l *stressListener) handleSetTime(t time.Time) error {
+	return nil
+}
+
+func (l *stressListener) handleChunksChange(create, remove map[image.Rectangle]int) error {
+	return nil
+}
+
+// Sets the given number of random pixels on a synthetic canvas as fast as possible or at the given rate, and measures the throughput and the memory usage.
+//
+// Chunks are "downloaded" empty when they get their first pixel, and again if they were unloaded meanwhile.
+// Every event goes through the broadcaster to all listeners and optionally a recorder, like the events of a real game.
+// The run ends when all listeners got all events, or when stop is closed.
+func runStress(settings stressSettings, stop <-chan struct{}) (stressReport, error) {
+	report := stressReport{Listeners: settings.Listeners}
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, settings.Rect)
+	defer can.Close()
+	can.Palette.setPalette(pixelcanvasioPalette)
+
+	listeners := make([]*stressListener, settings.Listeners)
+	for i := range listeners {
+		listeners[i] = &stressListener{}
+		if err := can.subscribeListener(listeners[i], false); err != nil {
+			return report, err
+		}
+	}
+
+	var recorder *canvasDiskWriter
+	if settings.Record {
+		var err error
+		if recorder, err = can.newCanvasDiskWriter("stress", 0); err != nil {
+			return report, err
+		}
+		defer func() {
+			if recorder != nil {
+				recorder.Close()
+			}
+		}()
+	}
+
+	// Sample the memory in the background
+	sampleQuit, sampleDone := make(chan struct{}), make(chan struct{})
+	var set int64 // Pixels set so far, for the progress
+	go func() {
+		defer close(sampleDone)
+		ticker := time.NewTicker(stressSampleInterval)
+		defer ticker.Stop()
+
+		lastLog := time.Now()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			usage := getMemoryUsage()
+			report.PeakHeapMiB = math.Max(report.PeakHeapMiB, float64(stats.HeapAlloc)/(1<<20))
+			report.PeakSysMiB = math.Max(report.PeakSysMiB, float64(stats.Sys)/(1<<20))
+			report.PeakChunksMiB = math.Max(report.PeakChunksMiB, float64(usage.ChunkImages)/(1<<20))
+			report.PeakQueuesMiB = math.Max(report.PeakQueuesMiB, float64(usage.ListenerQueues+usage.RecordingQueues)/(1<<20))
+
+			if time.Since(lastLog) >= time.Second {
+				lastLog = time.Now()
+				stressLog.Infof("Set %v of %v pixels, heap %.0f MiB, %v", atomic.LoadInt64(&set), settings.Pixels, float64(stats.HeapAlloc)/(1<<20), usage)
+			}
+
+			select {
+			case <-sampleQuit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	rng := rand.New(rand.NewSource(settings.Seed))
+	known := map[chunkCoordinate]struct{}{}
+	download := func(pos image.Point) {
+		rect := can.ChunkSize.getOuterChunkRect(image.Rectangle{pos, pos.Add(image.Point{1, 1})}, can.Origin).getPixelRectangle(can.ChunkSize, can.Origin)
+		can.signalDownload(rect)
+		can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false)
+		known[can.ChunkSize.getChunkCoord(pos, can.Origin)] = struct{}{}
+	}
+
+	started := time.Now()
+	stopped := false
+	for i := 0; i < settings.Pixels && !stopped; i++ {
+		if i%1000 == 0 {
+			select {
+			case <-stop:
+				stopped = true
+				continue
+			default:
+			}
+			if settings.Rate > 0 {
+				time.Sleep(time.Until(started.Add(time.Duration(i) * time.Second / time.Duration(settings.Rate))))
+			}
+		}
+
+		pos := image.Point{settings.Rect.Min.X + rng.Intn(settings.Rect.Dx()), settings.Rect.Min.Y + rng.Intn(settings.Rect.Dy())}
+		col := pixelcanvasioPalette[rng.Intn(len(pixelcanvasioPalette))]
+		if _, ok := known[can.ChunkSize.getChunkCoord(pos, can.Origin)]; !ok {
+			download(pos)
+		}
+		if err := can.setPixel(pos, col); err != nil {
+			// The chunk was unloaded, e.g. by the memory soft limit
+			download(pos)
+			can.setPixel(pos, col)
+		}
+		atomic.AddInt64(&set, 1)
+	}
+	report.Pixels = int(atomic.LoadInt64(&set))
+	report.Chunks = len(known)
+
+	// Wait until every listener got every event
+	for _, l := range listeners {
+		can.unsubscribeListener(l)
+		report.Delivered += atomic.LoadInt64(&l.pixels)
+	}
+	if recorder != nil {
+		recorder.Close()
+		report.DroppedEvents = recorder.getDroppedEvents()
+		fileName := recorder.getFileName()
+		recorder = nil
+		if stat, err := os.Stat(fileName); err == nil {
+			report.RecordedMiB = float64(stat.Size()) / (1 << 20)
+		}
+		if !settings.Keep {
+			os.Remove(fileName)
+		}
+	}
+	report.Seconds = time.Since(started).Seconds()
+	report.PixelsPerSecond = float64(report.Pixels) / report.Seconds
+
+	close(sampleQuit)
+	<-sampleDone
+
+	if stopped {
+		return report, fmt.Errorf("Stress run was interrupted after %v pixels", report.Pixels)
+	}
+
+	return report, nil
+}
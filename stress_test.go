@@ -0,0 +1,49 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"os"
+	"testing"
+)
+
+func Test_runStress(t *testing.T) {
+	settings := stressSettings{Rect: image.Rect(-512, -512, 512, 512), Pixels: 20000, Listeners: 2, Record: true, Seed: 1}
+	if err := settings.validate(); err != nil {
+		t.Fatalf("Settings are invalid: %v", err)
+	}
+	defer os.Remove(dataPath(getPaths().Recordings, "stress")) // Only if it's empty
+
+	report, err := runStress(settings, nil)
+	if err != nil {
+		t.Fatalf("Stress run failed: %v", err)
+	}
+	if report.Pixels != 20000 || report.Delivered != 40000 {
+		t.Errorf("Set %v pixels and delivered %v, want 20000 and 40000", report.Pixels, report.Delivered)
+	}
+	if report.Chunks == 0 || report.Chunks > 256 {
+		t.Errorf("Created %v chunks, want between 1 and 256", report.Chunks)
+	}
+	if report.RecordedMiB <= 0 || report.PeakHeapMiB <= 0 || report.PixelsPerSecond <= 0 {
+		t.Errorf("Got report %+v, want a recording, the heap and the throughput", report)
+	}
+
+	if err := (stressSettings{Rect: settings.Rect}).validate(); err == nil {
+		t.Errorf("Run without pixels is valid")
+	}
+}
@@ -0,0 +1,275 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+
+	_ "image/gif"  // Support for GIF templates
+	_ "image/jpeg" // Support for JPEG templates
+	_ "image/png"  // Support for PNG templates
+)
+
+// A template image, that is placed on the canvas
+type pixelTemplate struct {
+	Name  string
+	Image *image.NRGBA // Bounds are in canvas coordinates
+}
+
+// An entry of the JSON formats of other bots and overlay scripts.
+// The field names of the different formats are matched case insensitively.
+type templateImportEntry struct {
+	Name, Title string
+
+	X, Y   int
+	OX, OY int // Used by pxls style overlays instead of X and Y
+
+	Image, URL, Src, Source, File string // Source of the image: A file path relative to the JSON file, a HTTP URL or a data URI
+
+	Width int // Width of the template in canvas pixels, if the image is scaled up. Also called tw by pxls style overlays
+	TW    int
+}
+
+// Loads all templates from a file.
+//
+// The following formats are supported:
+//   - Images (PNG, GIF, JPEG) are placed at 0, 0
+//   - JSON objects with coordinates and image source: {"name": "Logo", "x": 100, "y": 200, "image": "logo.png"}
+//   - JSON arrays of those objects, or objects with a "templates" array, as used by overlay userscripts
+//   - Text files with overlay links, one per line: https://example.com/#template=https://example.com/logo.png&ox=100&oy=200&tw=50
+func loadTemplates(fileName string) ([]pixelTemplate, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read template %v: %v", fileName, err)
+	}
+	dir := filepath.Dir(fileName)
+
+	// Images are recognized by their content
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		img, err := templateDecodeImage(data, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode template %v: %v", fileName, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+		return []pixelTemplate{{Name: name, Image: img}}, nil
+	}
+
+	var entries []templateImportEntry
+	switch trimmed := bytes.TrimSpace(data); {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("Can't parse template list %v: %v", fileName, err)
+		}
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		object := struct {
+			templateImportEntry
+			Templates []templateImportEntry
+		}{}
+		if err := json.Unmarshal(trimmed, &object); err != nil {
+			return nil, fmt.Errorf("Can't parse template %v: %v", fileName, err)
+		}
+		if len(object.Templates) > 0 {
+			entries = object.Templates
+		} else {
+			entries = []templateImportEntry{object.templateImportEntry}
+		}
+	default:
+		if entries, err = templateParseLinks(string(trimmed)); err != nil {
+			return nil, fmt.Errorf("Can't parse template links in %v: %v", fileName, err)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("Found no templates in %v", fileName)
+	}
+
+	templates := []pixelTemplate{}
+	for i, entry := range entries {
+		tmpl, err := entry.load(dir)
+		if err != nil {
+			return nil, fmt.Errorf("Can't load template %v of %v: %v", i+1, fileName, err)
+		}
+		templates = append(templates, tmpl)
+	}
+
+	return templates, nil
+}
+
+// Parses overlay links, one per line.
+// The parameters can be in the query or the fragment of the link.
+func templateParseLinks(text string) ([]templateImportEntry, error) {
+	entries := []templateImportEntry{}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "#!") {
+			continue
+		}
+
+		u, err := url.Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		params := u.Query()
+		if fragment, err := url.ParseQuery(u.Fragment); err == nil && fragment.Get("template") != "" {
+			params = fragment
+		}
+		if params.Get("template") == "" {
+			return nil, fmt.Errorf("Link %q has no template parameter", line)
+		}
+
+		entry := templateImportEntry{
+			Title: params.Get("title"),
+			URL:   params.Get("template"),
+		}
+		for key, value := range map[string]*int{"ox": &entry.OX, "oy": &entry.OY, "tw": &entry.TW} {
+			if s := params.Get(key); s != "" {
+				if *value, err = strconv.Atoi(s); err != nil {
+					return nil, fmt.Errorf("Link %q has invalid %v parameter", line, key)
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// Loads the image of the entry, and places it at its coordinates.
+// Relative file names are resolved against dir.
+func (entry templateImportEntry) load(dir string) (pixelTemplate, error) {
+	tmpl := pixelTemplate{Name: entry.Name}
+	if tmpl.Name == "" {
+		tmpl.Name = entry.Title
+	}
+
+	source := ""
+	for _, s := range []string{entry.Image, entry.URL, entry.Src, entry.Source, entry.File} {
+		if s != "" {
+			source = s
+			break
+		}
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case source == "":
+		return tmpl, fmt.Errorf("No image given")
+	case strings.HasPrefix(source, "data:"):
+		i := strings.Index(source, ";base64,")
+		if i < 0 {
+			return tmpl, fmt.Errorf("Only base64 data URIs are supported")
+		}
+		if data, err = base64.StdEncoding.DecodeString(source[i+len(";base64,"):]); err != nil {
+			return tmpl, fmt.Errorf("Can't decode data URI: %v", err)
+		}
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		r, err := myClient.Get(source)
+		if err != nil {
+			return tmpl, fmt.Errorf("Can't download %v: %v", source, err)
+		}
+		defer r.Body.Close()
+		if data, err = ioutil.ReadAll(r.Body); err != nil {
+			return tmpl, fmt.Errorf("Can't download %v: %v", source, err)
+		}
+	default:
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(dir, source)
+		}
+		if data, err = ioutil.ReadFile(source); err != nil {
+			return tmpl, err
+		}
+	}
+
+	width := entry.Width
+	if width == 0 {
+		width = entry.TW
+	}
+	if tmpl.Image, err = templateDecodeImage(data, width); err != nil {
+		return tmpl, fmt.Errorf("Can't decode image of %q: %v", source, err)
+	}
+
+	pos := image.Point{entry.X + entry.OX, entry.Y + entry.OY}
+	tmpl.Image.Rect = tmpl.Image.Rect.Add(pos)
+
+	return tmpl, nil
+}
+
+// Decodes an image, and scales it down to the given width if it's not 0.
+// Overlay scripts often use upscaled images, with several image pixels per canvas pixel.
+func templateDecodeImage(data []byte, width int) (*image.NRGBA, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	if width > 0 && width != bounds.Dx() {
+		height := (bounds.Dy()*width + bounds.Dx()/2) / bounds.Dx()
+		img = resize.Resize(uint(width), uint(height), img, resize.NearestNeighbor)
+		bounds = img.Bounds()
+	}
+
+	result := image.NewNRGBA(bounds.Sub(bounds.Min))
+	draw.Draw(result, result.Rect, img, bounds.Min, draw.Src)
+
+	return result, nil
+}
+
+// Combines several templates into one image that contains all of them.
+// Later templates are drawn over earlier ones.
+func mergeTemplates(templates []pixelTemplate) *image.NRGBA {
+	rect := image.Rectangle{}
+	for _, tmpl := range templates {
+		rect = rect.Union(tmpl.Image.Rect)
+	}
+
+	result := image.NewNRGBA(rect)
+	for _, tmpl := range templates {
+		draw.Draw(result, tmpl.Image.Rect, tmpl.Image, tmpl.Image.Rect.Min, draw.Over)
+	}
+
+	return result
+}
+
+// Returns true if the file is a plain image, that has no position of its own
+func isTemplateImageFile(fileName string) bool {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	_, _, err = image.DecodeConfig(f)
+	return err == nil
+}
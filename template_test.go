@@ -0,0 +1,98 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_loadTemplates(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "d3pixelbot-test-templates")
+	os.MkdirAll(dir, 0777)
+	defer os.RemoveAll(dir)
+
+	// 2x1 template, scaled up by a factor of 2
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for iy := 0; iy < 2; iy++ {
+		img.SetNRGBA(0, iy, color.NRGBA{255, 0, 0, 255})
+		img.SetNRGBA(1, iy, color.NRGBA{255, 0, 0, 255})
+	}
+	buf := &bytes.Buffer{}
+	png.Encode(buf, img)
+	ioutil.WriteFile(filepath.Join(dir, "logo.png"), buf.Bytes(), 0666)
+	dataURI := "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	files := map[string]string{
+		"single.json": `{"name": "Logo", "x": 100, "y": -50, "image": "logo.png", "width": 2}`,
+		"list.json":   `[{"title": "Logo", "x": 100, "y": -50, "src": "` + dataURI + `", "width": 2}]`,
+		"faction.json": `{"faction": "Test", "templates": [
+			{"name": "Logo", "x": 100, "y": -50, "url": "logo.png", "width": 2},
+			{"name": "Other", "x": 0, "y": 0, "file": "logo.png"}
+		]}`,
+		"links.txt": "https://example.com/#template=" + filepath.Join(dir, "logo.png") + "&ox=100&oy=-50&tw=2&title=Logo\n",
+	}
+
+	for fileName, content := range files {
+		path := filepath.Join(dir, fileName)
+		ioutil.WriteFile(path, []byte(content), 0666)
+
+		templates, err := loadTemplates(path)
+		if err != nil {
+			t.Errorf("Can't load %v: %v", fileName, err)
+			continue
+		}
+		if templates[0].Name != "Logo" {
+			t.Errorf("%v: Template has name %q, want %q", fileName, templates[0].Name, "Logo")
+		}
+		if want := image.Rect(100, -50, 102, -49); templates[0].Image.Rect != want {
+			t.Errorf("%v: Template has bounds %v, want %v", fileName, templates[0].Image.Rect, want)
+		}
+		if c := templates[0].Image.NRGBAAt(100, -50); c != (color.NRGBA{255, 0, 0, 255}) {
+			t.Errorf("%v: Template has color %v at its origin", fileName, c)
+		}
+	}
+
+	templates, err := loadTemplates(filepath.Join(dir, "faction.json"))
+	if err != nil || len(templates) != 2 {
+		t.Fatalf("Can't load all templates of faction.json: %v", err)
+	}
+	if want := image.Rect(0, -50, 102, 2); mergeTemplates(templates).Rect != want {
+		t.Errorf("Merged template has bounds %v, want %v", mergeTemplates(templates).Rect, want)
+	}
+
+	// Plain images are placed at 0, 0
+	templates, err = loadTemplates(filepath.Join(dir, "logo.png"))
+	if err != nil {
+		t.Fatalf("Can't load image: %v", err)
+	}
+	if want := image.Rect(0, 0, 4, 2); templates[0].Image.Rect != want {
+		t.Errorf("Image template has bounds %v, want %v", templates[0].Image.Rect, want)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "invalid.json"), []byte(`{"x": 1}`), 0666)
+	if _, err := loadTemplates(filepath.Join(dir, "invalid.json")); err == nil {
+		t.Errorf("Loading template without image succeeded, but it should fail")
+	}
+}
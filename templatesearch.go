@@ -0,0 +1,183 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"time"
+)
+
+// Number of matches that are returned, if not given otherwise
+const templateSearchDefaultMatches = 100
+
+// Maximum share of pattern pixels that may differ. More would match almost everywhere
+const templateSearchMaxTolerance = 0.5
+
+// An occurrence of a pattern on the canvas
+type templateMatch struct {
+	Rect       image.Rectangle // Where the pattern was found, in canvas coordinates
+	Mismatches int             // Number of pattern pixels that differ from the canvas
+	Similarity float64         // Share of pattern pixels that match the canvas
+}
+
+// Searches img for occurrences of the pattern, and returns up to maxMatches of them.
+//
+// Transparent pattern pixels match anything, canvas pixels without data match nothing.
+// Up to tolerance (0 to templateSearchMaxTolerance) of the other pattern pixels may differ.
+// Of overlapping matches only the best one is returned. The matches are sorted by their number of mismatches, then by position.
+func searchTemplate(img *image.RGBA, pattern *image.NRGBA, tolerance float64, maxMatches int) ([]templateMatch, error) {
+	if tolerance < 0 || tolerance > templateSearchMaxTolerance {
+		return nil, fmt.Errorf("Tolerance %v must be between 0 and %v", tolerance, templateSearchMaxTolerance)
+	}
+	if maxMatches <= 0 {
+		maxMatches = templateSearchDefaultMatches
+	}
+
+	type patternPixel struct {
+		Offset image.Point
+		Color  color.RGBA
+	}
+	pixels := []patternPixel{}
+	for iy := pattern.Rect.Min.Y; iy < pattern.Rect.Max.Y; iy++ {
+		for ix := pattern.Rect.Min.X; ix < pattern.Rect.Max.X; ix++ {
+			if c := pattern.NRGBAAt(ix, iy); c.A != 0 {
+				pixels = append(pixels, patternPixel{image.Point{ix, iy}.Sub(pattern.Rect.Min), color.RGBA{c.R, c.G, c.B, 255}})
+			}
+		}
+	}
+	if len(pixels) == 0 {
+		return nil, fmt.Errorf("Pattern has no opaque pixels")
+	}
+
+	// Rare colors are compared first, so most positions are ruled out after a few pixels
+	counts := map[color.RGBA]int{}
+	for i := 0; i < len(img.Pix); i += 4 {
+		counts[color.RGBA{img.Pix[i+0], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}]++
+	}
+	sort.SliceStable(pixels, func(i, j int) bool { return counts[pixels[i].Color] < counts[pixels[j].Color] })
+
+	allowed := int(tolerance * float64(len(pixels)))
+	size := pattern.Rect.Size()
+	candidates := []templateMatch{}
+	for iy := img.Rect.Min.Y; iy <= img.Rect.Max.Y-size.Y; iy++ {
+		for ix := img.Rect.Min.X; ix <= img.Rect.Max.X-size.X; ix++ {
+			mismatches := 0
+			for _, pixel := range pixels {
+				i := img.PixOffset(ix+pixel.Offset.X, iy+pixel.Offset.Y)
+				if img.Pix[i+3] == 0 || img.Pix[i+0] != pixel.Color.R || img.Pix[i+1] != pixel.Color.G || img.Pix[i+2] != pixel.Color.B {
+					if mismatches++; mismatches > allowed {
+						break
+					}
+				}
+			}
+			if mismatches <= allowed {
+				candidates = append(candidates, templateMatch{
+					Rect:       image.Rectangle{image.Point{ix, iy}, image.Point{ix, iy}.Add(size)},
+					Mismatches: mismatches,
+					Similarity: 1 - float64(mismatches)/float64(len(pixels)),
+				})
+			}
+		}
+	}
+
+	// Keep the best of overlapping matches
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Mismatches < candidates[j].Mismatches })
+	matches := []templateMatch{}
+	for _, candidate := range candidates {
+		overlaps := false
+		for _, match := range matches {
+			if match.Rect.Overlaps(candidate.Rect) {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			matches = append(matches, candidate)
+		}
+		if len(matches) >= maxMatches {
+			break
+		}
+	}
+
+	return matches, nil
+}
+
+// Loads a pattern for searchTemplate from a template file, see loadTemplates().
+// Its colors are replaced with the closest ones of the palette, if it's not nil.
+func loadTemplateSearchPattern(fileName string, pal color.Palette) (*image.NRGBA, error) {
+	pattern, err := loadExportReportTemplate(fileName, image.Point{})
+	if err != nil {
+		return nil, err
+	}
+	quantizeExportReportTemplate(pattern, pal)
+
+	return pattern, nil
+}
+
+// Searches the canvas of a connected game for the pattern, whose colors are replaced with the closest ones of the game's palette.
+// If rect is empty, all loaded chunks are searched, otherwise rect is downloaded if needed.
+func (as *apiServer) searchTemplate(shortName string, rect image.Rectangle, pattern *image.NRGBA, tolerance float64, maxMatches int, cancel <-chan struct{}) ([]templateMatch, error) {
+	game, err := as.getGame(shortName)
+	if err != nil {
+		return nil, err
+	}
+
+	if rect.Empty() {
+		if rect = game.Canvas.getLoadedRect(); rect.Empty() {
+			return nil, fmt.Errorf("There are no loaded chunks of %v", shortName)
+		}
+	}
+	img, _, err := as.getImage(shortName, rect, cancel)
+	if err != nil {
+		return nil, err
+	}
+
+	quantizeExportReportTemplate(pattern, game.Canvas.Palette.getPalette())
+	return searchTemplate(img, pattern, tolerance, maxMatches)
+}
+
+// Searches the recordings for the pattern in the given template file, at the point in time of the source.
+// The colors of the pattern are replaced with the closest ones of the recorded palette.
+// Returns the matches, and the point in time that was searched.
+func searchTemplateRecordings(src canvasDiffSource, rect image.Rectangle, patternFile string, tolerance float64, maxMatches int) ([]templateMatch, time.Time, error) {
+	cfe, err := newCanvasFrameExtractor(src.Name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer cfe.Close()
+
+	t := src.Time
+	if t.IsZero() {
+		_, t = cfe.getTimeRange()
+		t = t.Add(-time.Nanosecond) // The end time itself isn't part of the recordings
+	}
+
+	img, err := cfe.getFrame(t, rect)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("Can't get image of %v: %v", src, err)
+	}
+	pattern, err := loadTemplateSearchPattern(patternFile, cfe.getPalette())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	matches, err := searchTemplate(img, pattern, tolerance, maxMatches)
+	return matches, t, err
+}
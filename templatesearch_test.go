@@ -0,0 +1,147 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dadido3/D3pixelbot/recording"
+)
+
+// Returns a canvas image with random palette colors, and a pattern with a transparent corner that is drawn onto it twice, and once with a wrong pixel
+func templateSearchTestImages() (*image.Paletted, *image.NRGBA, []image.Point) {
+	random := rand.New(rand.NewSource(1))
+
+	img := image.NewPaletted(image.Rect(-32, -32, 32, 32), pixelcanvasioPalette)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(random.Intn(len(pixelcanvasioPalette)))
+	}
+
+	pattern := image.NewNRGBA(image.Rect(100, 100, 105, 105)) // Its own position doesn't matter
+	for iy := pattern.Rect.Min.Y; iy < pattern.Rect.Max.Y; iy++ {
+		for ix := pattern.Rect.Min.X; ix < pattern.Rect.Max.X; ix++ {
+			pattern.Set(ix, iy, pixelcanvasioPalette[random.Intn(len(pixelcanvasioPalette))])
+		}
+	}
+	pattern.SetNRGBA(100, 100, color.NRGBA{})
+
+	positions := []image.Point{{-20, -10}, {10, 5}, {-5, 20}}
+	for _, pos := range positions {
+		draw.Draw(img, pattern.Rect.Sub(pattern.Rect.Min).Add(pos), pattern, pattern.Rect.Min, draw.Over)
+	}
+	// The last copy has a wrong pixel
+	wrong := positions[2].Add(image.Point{2, 2})
+	img.SetColorIndex(wrong.X, wrong.Y, (img.ColorIndexAt(wrong.X, wrong.Y)+1)%uint8(len(pixelcanvasioPalette)))
+
+	return img, pattern, positions
+}
+
+func Test_searchTemplate(t *testing.T) {
+	paletted, pattern, positions := templateSearchTestImages()
+	img := image.NewRGBA(paletted.Rect)
+	draw.Draw(img, img.Rect, paletted, img.Rect.Min, draw.Src)
+
+	matches, err := searchTemplate(img, pattern, 0, 0)
+	if err != nil {
+		t.Fatalf("searchTemplate() failed: %v", err)
+	}
+	if len(matches) != 2 || matches[0].Rect.Min != positions[0] || matches[1].Rect.Min != positions[1] || matches[0].Similarity != 1 {
+		t.Errorf("Exact search found %+v, want matches at %v", matches, positions[:2])
+	}
+
+	// With tolerance the copy with the wrong pixel is found too, after the exact ones
+	matches, err = searchTemplate(img, pattern, 0.1, 0)
+	if err != nil {
+		t.Fatalf("searchTemplate() failed: %v", err)
+	}
+	if len(matches) != 3 || matches[2].Rect.Min != positions[2] || matches[2].Mismatches != 1 {
+		t.Errorf("Search with tolerance found %+v, want matches at %v", matches, positions)
+	}
+	if matches, _ := searchTemplate(img, pattern, 0.1, 1); len(matches) != 1 {
+		t.Errorf("Search limited to 1 match found %v", len(matches))
+	}
+
+	// Pixels without data don't match
+	draw.Draw(img, image.Rect(-20, -10, -19, -9).Add(image.Point{1, 1}), image.Transparent, image.Point{}, draw.Src)
+	if matches, _ := searchTemplate(img, pattern, 0, 0); len(matches) != 1 {
+		t.Errorf("Search found %v matches, want 1 after removing data of a copy", len(matches))
+	}
+
+	if _, err := searchTemplate(img, pattern, 0.9, 0); err == nil {
+		t.Errorf("Search with a tolerance of 0.9 succeeded")
+	}
+	if _, err := searchTemplate(img, image.NewNRGBA(image.Rect(0, 0, 2, 2)), 0, 0); err == nil {
+		t.Errorf("Search for a transparent pattern succeeded")
+	}
+}
+
+func Test_searchTemplateRecordings(t *testing.T) {
+	dir := t.TempDir()
+	defer setPathSettings(getPaths())
+	settings := getPaths()
+	settings.Recordings = dir
+	setPathSettings(settings)
+
+	img, pattern, positions := templateSearchTestImages()
+
+	if err := os.MkdirAll(filepath.Join(dir, "game"), 0755); err != nil {
+		t.Fatalf("Can't create directory: %v", err)
+	}
+	f, err := os.Create(filepath.Join(dir, "game", "2019-06-14T120000.pixrec"))
+	if err != nil {
+		t.Fatalf("Can't create recording: %v", err)
+	}
+	start := time.Date(2019, 6, 14, 12, 0, 0, 0, time.UTC)
+	w, err := recording.NewWriter(f, "game", recording.Header{Time: start, ChunkSize: image.Point{32, 32}})
+	if err != nil {
+		t.Fatalf("Can't create recording writer: %v", err)
+	}
+	if err := w.WriteEvent(start.Add(time.Second), recording.SetImage{Image: img}); err != nil {
+		t.Errorf("Can't write event: %v", err)
+	}
+	w.Close()
+	f.Close()
+
+	patternFile := filepath.Join(dir, "logo.png")
+	pf, err := os.Create(patternFile)
+	if err != nil {
+		t.Fatalf("Can't create pattern: %v", err)
+	}
+	png.Encode(pf, pattern)
+	pf.Close()
+
+	matches, _, err := searchTemplateRecordings(canvasDiffSource{Name: "game"}, img.Rect, patternFile, 0, 0)
+	if err != nil {
+		t.Fatalf("searchTemplateRecordings() failed: %v", err)
+	}
+	if len(matches) != 2 || matches[0].Rect.Min != positions[0] || matches[1].Rect.Min != positions[1] {
+		t.Errorf("Search found %+v, want matches at %v", matches, positions[:2])
+	}
+
+	// Before the recording there is nothing to find
+	if matches, _, err := searchTemplateRecordings(canvasDiffSource{Name: "game", Time: start}, img.Rect, patternFile, 0, 0); err != nil || len(matches) != 0 {
+		t.Errorf("Search before the recording found %v matches, %v", len(matches), err)
+	}
+}
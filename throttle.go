@@ -0,0 +1,112 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Limits of background work, stored in the configuration at .background.
+// Background work is everything that doesn't need to keep up with the game or the user, like chunk refresh sweeps, exports and the compression of exported clips.
+type backgroundSettings struct {
+	CPULimit float64 // Fraction of the CPU time that background work may use, from 0 (exclusive) to 1
+}
+
+var defaultBackgroundSettings = backgroundSettings{
+	CPULimit: 1,
+}
+
+func (s backgroundSettings) validate() error {
+	if s.CPULimit <= 0 || s.CPULimit > 1 {
+		return fmt.Errorf("Background CPU limit %v is not in the range of 0 (exclusive) to 1", s.CPULimit)
+	}
+	return nil
+}
+
+// Returns the number of goroutines that background work should use for parallel tasks, at least 1
+func (s backgroundSettings) getWorkers() int {
+	workers := int(float64(runtime.NumCPU()) * s.CPULimit)
+	if workers < 1 {
+		return 1
+	}
+	return workers
+}
+
+var backgroundMutex sync.RWMutex
+var background = defaultBackgroundSettings
+
+// Changes the limits of all background work, running work is throttled by them from its next step on
+func setBackgroundSettings(s backgroundSettings) {
+	backgroundMutex.Lock()
+	defer backgroundMutex.Unlock()
+
+	background = s
+}
+
+// Returns the current limits of background work
+func getBackgroundSettings() backgroundSettings {
+	backgroundMutex.RLock()
+	defer backgroundMutex.RUnlock()
+
+	return background
+}
+
+// Number of steps between measurements of a backgroundThrottle.
+// Small enough that the sleeps stay short, large enough that measuring doesn't cost much.
+const backgroundThrottleInterval = 1000
+
+// Throttles a loop of background work to the configured fraction of CPU time.
+//
+// The time of every interval steps is measured, and followed by a sleep that keeps the ratio of work to sleep at the CPU limit.
+// The zero value isn't usable, use newBackgroundThrottle.
+type backgroundThrottle struct {
+	interval int
+	steps    int
+	start    time.Time
+	sleep    func(time.Duration) // Replaced by tests
+}
+
+func newBackgroundThrottle(interval int) *backgroundThrottle {
+	return &backgroundThrottle{
+		interval: interval,
+		start:    time.Now(),
+		sleep:    time.Sleep,
+	}
+}
+
+// Has to be called after every unit of work. Blocks if the work used more than its share of CPU time.
+// Returns the time that it slept.
+func (t *backgroundThrottle) step() time.Duration {
+	if t.steps++; t.steps < t.interval {
+		return 0
+	}
+	t.steps = 0
+
+	limit := getBackgroundSettings().CPULimit
+	var duration time.Duration
+	if limit < 1 {
+		worked := time.Since(t.start)
+		duration = time.Duration(float64(worked) * (1 - limit) / limit)
+		t.sleep(duration)
+	}
+	t.start = time.Now()
+
+	return duration
+}
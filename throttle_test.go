@@ -0,0 +1,77 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test_backgroundSettings(t *testing.T) {
+	for _, limit := range []float64{0, -0.5, 1.5} {
+		if err := (backgroundSettings{CPULimit: limit}).validate(); err == nil {
+			t.Errorf("CPU limit of %v is valid", limit)
+		}
+	}
+	for _, limit := range []float64{0.01, 0.5, 1} {
+		if err := (backgroundSettings{CPULimit: limit}).validate(); err != nil {
+			t.Errorf("CPU limit of %v is invalid: %v", limit, err)
+		}
+	}
+
+	if workers := (backgroundSettings{CPULimit: 0.01}).getWorkers(); workers != 1 {
+		t.Errorf("Got %v workers with a small CPU limit, want 1", workers)
+	}
+	if workers, want := (backgroundSettings{CPULimit: 1}).getWorkers(), runtime.NumCPU(); workers != want {
+		t.Errorf("Got %v workers without CPU limit, want %v", workers, want)
+	}
+}
+
+func Test_backgroundThrottle(t *testing.T) {
+	defer setBackgroundSettings(getBackgroundSettings())
+
+	slept := time.Duration(0)
+	throttle := newBackgroundThrottle(10)
+	throttle.sleep = func(d time.Duration) { slept += d }
+
+	// Without limit nothing is throttled
+	setBackgroundSettings(backgroundSettings{CPULimit: 1})
+	for i := 0; i < 10; i++ {
+		throttle.step()
+	}
+	if slept != 0 {
+		t.Errorf("Slept %v without CPU limit", slept)
+	}
+
+	// With a quarter of the CPU, 3 times the work is spent sleeping
+	setBackgroundSettings(backgroundSettings{CPULimit: 0.25})
+	start := time.Now()
+	for i := 0; i < 9; i++ {
+		if d := throttle.step(); d != 0 {
+			t.Fatalf("Throttle slept %v before the end of the interval", d)
+		}
+	}
+	time.Sleep(20 * time.Millisecond) // Simulated work
+	worked := time.Since(start)
+	if d := throttle.step(); d < 3*20*time.Millisecond || d > 3*worked+10*time.Millisecond {
+		t.Errorf("Throttle slept %v after %v of work, want about %v", d, worked, 3*worked)
+	}
+	if slept == 0 {
+		t.Errorf("Throttle didn't sleep")
+	}
+}
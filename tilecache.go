@@ -0,0 +1,185 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var tileLog = moduleLog("tiles")
+
+const tileCacheIndexFileName = "tilecache.json"
+
+// Persistent cache of PNG encoded tiles.
+//
+// Tiles are stored as <Dir>/<key>.png, a hash of their pixels is kept in <Dir>/tilecache.json.
+// A tile is only encoded again, if its pixels changed since it was stored.
+type tileCache struct {
+	sync.Mutex
+
+	Dir              string
+	CompressionLevel png.CompressionLevel
+
+	hashes   map[string]uint64 // Pixel hash of every stored tile
+	modified bool              // The hashes differ from the ones in the index file
+}
+
+// Opens the tile cache in dir, and loads the hashes of previously stored tiles
+func newTileCache(dir string, compressionLevel png.CompressionLevel) (*tileCache, error) {
+	tc := &tileCache{
+		Dir:              dir,
+		CompressionLevel: compressionLevel,
+		hashes:           map[string]uint64{},
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, tileCacheIndexFileName))
+	if os.IsNotExist(err) {
+		return tc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't read tile cache index: %v", err)
+	}
+	if err := json.Unmarshal(data, &tc.hashes); err != nil {
+		tileLog.Warnf("Tile cache index in %v is damaged, all tiles will be encoded again: %v", dir, err)
+		tc.hashes = map[string]uint64{}
+	}
+
+	return tc, nil
+}
+
+func (tc *tileCache) fileName(key string) string {
+	return filepath.Join(tc.Dir, filepath.FromSlash(key)+".png")
+}
+
+// Stores the tile under the given key, which may contain slashes to form subdirectories.
+//
+// Returns true if the tile was encoded, and false if the stored tile has the same pixels already.
+// Tiles without any non transparent pixel are not stored, previously stored versions of them are removed.
+func (tc *tileCache) put(key string, img *image.NRGBA) (bool, error) {
+	empty, hash := tileCacheHash(img)
+	fileName := tc.fileName(key)
+
+	tc.Lock()
+	defer tc.Unlock()
+
+	oldHash, ok := tc.hashes[key]
+	if empty {
+		if ok {
+			delete(tc.hashes, key)
+			tc.modified = true
+			if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+				return false, fmt.Errorf("Can't remove tile %v: %v", fileName, err)
+			}
+		}
+		return false, nil
+	}
+	if ok && oldHash == hash {
+		if _, err := os.Stat(fileName); err == nil {
+			return false, nil
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	enc := png.Encoder{CompressionLevel: tc.CompressionLevel}
+	if err := enc.Encode(buf, img); err != nil {
+		return false, fmt.Errorf("Can't encode tile %v: %v", fileName, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0777); err != nil {
+		return false, fmt.Errorf("Can't create directory for tile %v: %v", fileName, err)
+	}
+	if err := ioutil.WriteFile(fileName, buf.Bytes(), 0666); err != nil {
+		return false, fmt.Errorf("Can't write tile %v: %v", fileName, err)
+	}
+
+	tc.hashes[key] = hash
+	tc.modified = true
+
+	return true, nil
+}
+
+// Returns the encoded tile, or nil if it isn't stored
+func (tc *tileCache) get(key string) ([]byte, error) {
+	tc.Lock()
+	_, ok := tc.hashes[key]
+	tc.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(tc.fileName(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Writes the hashes into the index file, so that the next instance can reuse the tiles
+func (tc *tileCache) saveIndex() error {
+	tc.Lock()
+	defer tc.Unlock()
+	if !tc.modified {
+		return nil
+	}
+
+	data, err := json.Marshal(tc.hashes)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tc.Dir, 0777); err != nil {
+		return fmt.Errorf("Can't create directory %v: %v", tc.Dir, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tc.Dir, tileCacheIndexFileName), data, 0666); err != nil {
+		return fmt.Errorf("Can't write tile cache index: %v", err)
+	}
+	tc.modified = false
+
+	return nil
+}
+
+// Returns true if all pixels of img are transparent, and a hash of its size and pixels
+func tileCacheHash(img *image.NRGBA) (empty bool, hash uint64) {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, [2]int32{int32(img.Rect.Dx()), int32(img.Rect.Dy())})
+
+	empty = true
+	width := img.Rect.Dx() * 4
+	for iy := 0; iy < img.Rect.Dy(); iy++ {
+		line := img.Pix[iy*img.Stride : iy*img.Stride+width]
+		h.Write(line)
+		if empty {
+			for i := 3; i < len(line); i += 4 {
+				if line[i] != 0 {
+					empty = false
+					break
+				}
+			}
+		}
+	}
+
+	return empty, h.Sum64()
+}
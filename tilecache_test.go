@@ -0,0 +1,153 @@
+/*  D3pixelbot - Custom client, recorder and bot for pixel drawing games
+    Copyright (C) 2019  David Vogel
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.  */
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_tileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "d3pixelbot-tilecache")
+	if err != nil {
+		t.Fatalf("Can't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tc, err := newTileCache(dir, png.DefaultCompression)
+	if err != nil {
+		t.Fatalf("Can't open tile cache: %v", err)
+	}
+
+	tile := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	tile.SetNRGBA(3, 4, color.NRGBA{255, 0, 0, 255})
+
+	if encoded, err := tc.put("1/2/3", tile); err != nil || !encoded {
+		t.Fatalf("put() of a new tile = %v, %v, want true", encoded, err)
+	}
+	if encoded, err := tc.put("1/2/3", tile); err != nil || encoded {
+		t.Errorf("put() of an unchanged tile = %v, %v, want false", encoded, err)
+	}
+	if err := tc.saveIndex(); err != nil {
+		t.Fatalf("Can't save index: %v", err)
+	}
+
+	// Tiles are reused by the next instance
+	tc, err = newTileCache(dir, png.DefaultCompression)
+	if err != nil {
+		t.Fatalf("Can't open tile cache: %v", err)
+	}
+	if encoded, err := tc.put("1/2/3", tile); err != nil || encoded {
+		t.Errorf("put() of an unchanged tile after reopening = %v, %v, want false", encoded, err)
+	}
+	data, err := tc.get("1/2/3")
+	if err != nil || data == nil {
+		t.Fatalf("Can't get tile: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Can't decode tile: %v", err)
+	}
+	if got, want := color.NRGBAModel.Convert(img.At(3, 4)), tile.At(3, 4); got != want {
+		t.Errorf("Pixel at (3, 4) = %v, want %v", got, want)
+	}
+
+	tile.SetNRGBA(5, 5, color.NRGBA{0, 255, 0, 255})
+	if encoded, err := tc.put("1/2/3", tile); err != nil || !encoded {
+		t.Errorf("put() of a changed tile = %v, %v, want true", encoded, err)
+	}
+
+	// Empty tiles are removed
+	if encoded, err := tc.put("1/2/3", image.NewNRGBA(tile.Rect)); err != nil || encoded {
+		t.Errorf("put() of an empty tile = %v, %v, want false", encoded, err)
+	}
+	if _, err := os.Stat(tc.fileName("1/2/3")); !os.IsNotExist(err) {
+		t.Errorf("Empty tile still exists: %v", err)
+	}
+	if data, err := tc.get("1/2/3"); err != nil || data != nil {
+		t.Errorf("get() of an empty tile = %v bytes, %v, want nil", len(data), err)
+	}
+}
+
+func Test_canvasTileCache(t *testing.T) {
+	defer setPathSettings(getPaths())
+	paths := getPaths()
+	paths.Tiles = t.TempDir()
+	setPathSettings(paths)
+
+	can, _ := newCanvas(pixelSize{64, 64}, image.Point{}, pixelcanvasioCanvasRect)
+	defer can.Close()
+
+	rect := image.Rect(0, 0, 64, 64)
+	can.signalDownload(rect)
+	if err := can.setImage(image.NewPaletted(rect, pixelcanvasioPalette), false, false); err != nil {
+		t.Fatalf("Can't set image at %v: %v", rect, err)
+	}
+
+	ctc, err := can.newCanvasTileCache("Test-TileCache")
+	if err != nil {
+		t.Fatalf("Can't create tile cache: %v", err)
+	}
+	defer ctc.Close()
+
+	pixelAt := func(data []byte, pos image.Point) color.Color {
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Can't decode tile: %v", err)
+		}
+		return color.NRGBAModel.Convert(img.At(pos.X, pos.Y))
+	}
+
+	data, err := ctc.getTile(chunkCoordinate{0, 0})
+	if err != nil {
+		t.Fatalf("Can't get tile: %v", err)
+	}
+	pos := image.Point{10, 20}
+	if got, want := pixelAt(data, pos), color.NRGBAModel.Convert(pixelcanvasioPalette[0]); got != want {
+		t.Errorf("Pixel at %v = %v, want %v", pos, got, want)
+	}
+
+	// The tile is rendered again, after the canvas event arrived
+	if err := can.setPixel(pos, pixelcanvasioPalette[5]); err != nil {
+		t.Fatalf("Can't set pixel at %v: %v", pos, err)
+	}
+	want := color.NRGBAModel.Convert(pixelcanvasioPalette[5])
+	for start := time.Now(); pixelAt(data, pos) != want; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Tile wasn't updated after the pixel at %v changed", pos)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if data, err = ctc.getTile(chunkCoordinate{0, 0}); err != nil {
+			t.Fatalf("Can't get tile: %v", err)
+		}
+	}
+
+	// Chunks without data result in transparent tiles
+	data, err = ctc.getTile(chunkCoordinate{1, 0})
+	if err != nil {
+		t.Fatalf("Can't get tile: %v", err)
+	}
+	if _, _, _, a := pixelAt(data, image.Point{}).RGBA(); a != 0 {
+		t.Errorf("Tile without data isn't transparent")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
 	"io/ioutil"
 	"net/http"
 	"time"
@@ -36,6 +37,10 @@ func getJSON(url string, target interface{}) error {
 	}
 	defer r.Body.Close()
 
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("Got status %q", r.Status)
+	}
+
 	return json.NewDecoder(r.Body).Decode(target)
 }
 
@@ -98,12 +103,13 @@ func isPaletteEqual(pal1, pal2 color.Palette) bool {
 	return true
 }
 
-// Creates a copy of an image
+// Creates a copy of an image.
+// The pixel buffer is taken from the pools, see releaseImage.
 func copyImage(img image.Image) (image.Image, error) {
 	switch img := img.(type) {
 	case *image.RGBA:
 		imgCopy := &image.RGBA{
-			Pix:    make([]uint8, len(img.Pix)),
+			Pix:    getBuffer(len(img.Pix)),
 			Stride: img.Stride,
 			Rect:   img.Rect,
 		}
@@ -112,7 +118,7 @@ func copyImage(img image.Image) (image.Image, error) {
 
 	case *image.Paletted:
 		imgCopy := &image.Paletted{
-			Pix:     make([]uint8, len(img.Pix)),
+			Pix:     getBuffer(len(img.Pix)),
 			Stride:  img.Stride,
 			Rect:    img.Rect,
 			Palette: make(color.Palette, len(img.Palette)),
@@ -133,13 +139,14 @@ func copyImage(img image.Image) (image.Image, error) {
 
 // Creates a copy of an image, without copying data outside that image rectangle.
 // This is useful to reduce the memory footprint of subimages.
+// The pixel buffer is taken from the pools, see releaseImage.
 func copyImageReduced(img image.Image) (image.Image, error) {
 	switch img := img.(type) {
 	case *image.RGBA:
 		rect := img.Rect
 		stride := rect.Dx() * 4
 		imgCopy := &image.RGBA{
-			Pix:    make([]uint8, rect.Dx()*stride),
+			Pix:    getBuffer(rect.Dy() * stride),
 			Stride: stride,
 			Rect:   rect,
 		}
@@ -152,7 +159,7 @@ func copyImageReduced(img image.Image) (image.Image, error) {
 		rect := img.Rect
 		stride := rect.Dx()
 		imgCopy := &image.Paletted{
-			Pix:     make([]uint8, rect.Dx()*stride),
+			Pix:     getBuffer(rect.Dy() * stride),
 			Stride:  stride,
 			Rect:    rect,
 			Palette: make(color.Palette, len(img.Palette)),
@@ -167,6 +174,77 @@ func copyImageReduced(img image.Image) (image.Image, error) {
 	return nil, fmt.Errorf("Incompatible image type %T", img)
 }
 
+// Creates a paletted copy of an RGBA image, with a palette of the colors used in the image.
+// This needs a quarter of the memory, and is how chunks are stored.
+//
+// Other images are copied as they are, also RGBA images with more than 256 colors.
+// The pixel buffer is taken from the pools, see releaseImage.
+func copyImagePaletted(img image.Image) (image.Image, error) {
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		return copyImage(img)
+	}
+
+	rect := rgba.Rect
+	paletted := &image.Paletted{
+		Pix:    getBuffer(rect.Dx() * rect.Dy()),
+		Stride: rect.Dx(),
+		Rect:   rect,
+	}
+	indices := map[color.RGBA]uint8{}
+	for iy := 0; iy < rect.Dy(); iy++ {
+		line := rgba.Pix[iy*rgba.Stride : iy*rgba.Stride+rect.Dx()*4]
+		for ix := 0; ix < rect.Dx(); ix++ {
+			col := color.RGBA{line[ix*4], line[ix*4+1], line[ix*4+2], line[ix*4+3]}
+			index, ok := indices[col]
+			if !ok {
+				if len(paletted.Palette) >= 256 {
+					putBuffer(paletted.Pix)
+					return copyImage(img)
+				}
+				index = uint8(len(paletted.Palette))
+				indices[col] = index
+				paletted.Palette = append(paletted.Palette, col)
+			}
+			paletted.Pix[iy*paletted.Stride+ix] = index
+		}
+	}
+
+	return paletted, nil
+}
+
+// Creates a paletted copy of an RGBA image, even if it has more than 256 colors.
+// The palette consists of the first 256 colors of the image, all other colors are replaced by the closest of them.
+// The pixel buffer is taken from the pools, see releaseImage.
+func copyImagePalettedNearest(rgba *image.RGBA) *image.Paletted {
+	rect := rgba.Rect
+	paletted := &image.Paletted{
+		Pix:    getBuffer(rect.Dx() * rect.Dy()),
+		Stride: rect.Dx(),
+		Rect:   rect,
+	}
+	indices := map[color.RGBA]uint8{} // Also caches the closest colors
+	for iy := 0; iy < rect.Dy(); iy++ {
+		line := rgba.Pix[iy*rgba.Stride : iy*rgba.Stride+rect.Dx()*4]
+		for ix := 0; ix < rect.Dx(); ix++ {
+			col := color.RGBA{line[ix*4], line[ix*4+1], line[ix*4+2], line[ix*4+3]}
+			index, ok := indices[col]
+			if !ok {
+				if len(paletted.Palette) < 256 {
+					index = uint8(len(paletted.Palette))
+					paletted.Palette = append(paletted.Palette, col)
+				} else {
+					index = uint8(paletted.Palette.Index(col))
+				}
+				indices[col] = index
+			}
+			paletted.Pix[iy*paletted.Stride+ix] = index
+		}
+	}
+
+	return paletted
+}
+
 // Returns the part of the image that is seen by rect.
 // Pixels are shared between the original and sub image.
 func subImage(img image.Image, rect image.Rectangle) (image.Image, error) {
@@ -236,13 +314,54 @@ func compareImages(a, b image.Image) bool {
 	return false
 }
 
-// Converts any image to an BGRA array
+// Scales an image up by an integer factor, using nearest neighbor sampling.
+// The resulting image starts at (0, 0). Paletted images stay paletted, all other images are converted to RGBA.
+func upscaleNearest(img image.Image, factor int) image.Image {
+	rect := img.Bounds()
+	dstRect := image.Rect(0, 0, rect.Dx()*factor, rect.Dy()*factor)
+
+	var srcPix, dstPix []uint8
+	var srcStride, dstStride, bytesPerPixel int
+	var dst image.Image
+	switch img := img.(type) {
+	case *image.Paletted:
+		dstImg := image.NewPaletted(dstRect, img.Palette)
+		srcPix, srcStride, dstPix, dstStride, bytesPerPixel, dst = img.Pix, img.Stride, dstImg.Pix, dstImg.Stride, 1, dstImg
+	case *image.RGBA:
+		dstImg := image.NewRGBA(dstRect)
+		srcPix, srcStride, dstPix, dstStride, bytesPerPixel, dst = img.Pix, img.Stride, dstImg.Pix, dstImg.Stride, 4, dstImg
+	default:
+		rgba := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+		draw.Draw(rgba, rgba.Rect, img, rect.Min, draw.Src)
+		return upscaleNearest(rgba, factor)
+	}
+
+	// Scale a single line, and copy it factor times
+	for iy := 0; iy < rect.Dy(); iy++ {
+		srcLine := srcPix[iy*srcStride : iy*srcStride+rect.Dx()*bytesPerPixel]
+		dstLine := dstPix[iy*factor*dstStride : iy*factor*dstStride+dstRect.Dx()*bytesPerPixel]
+		for ix := 0; ix < rect.Dx(); ix++ {
+			pixel := srcLine[ix*bytesPerPixel : ix*bytesPerPixel+bytesPerPixel]
+			for i := 0; i < factor; i++ {
+				copy(dstLine[(ix*factor+i)*bytesPerPixel:], pixel)
+			}
+		}
+		for i := 1; i < factor; i++ {
+			copy(dstPix[(iy*factor+i)*dstStride:], dstLine)
+		}
+	}
+
+	return dst
+}
+
+// Converts any image to an BGRA array.
+// The array is taken from the pools, it can be handed back with putBuffer.
 func imageToBGRAArray(img image.Image) []byte {
 	rect := img.Bounds()
 
 	switch img := img.(type) {
 	case *image.RGBA:
-		array := make([]uint8, rect.Dx()*rect.Dy()*4)
+		array := getBuffer(rect.Dx() * rect.Dy() * 4)
 		stride := rect.Dx() * 4
 		for iy := 0; iy < rect.Dy(); iy++ {
 			copy(array[iy*stride:iy*stride+stride], img.Pix[iy*img.Stride:iy*img.Stride+stride])
@@ -253,7 +372,7 @@ func imageToBGRAArray(img image.Image) []byte {
 
 		return array
 	default:
-		array := make([]byte, rect.Dx()*rect.Dy()*4)
+		array := getBuffer(rect.Dx() * rect.Dy() * 4)
 
 		i := 0
 		for iy := rect.Min.Y; iy < rect.Max.Y; iy++ {
@@ -17,6 +17,8 @@
 package main
 
 import (
+	"image"
+	"image/color"
 	"testing"
 )
 
@@ -105,3 +107,89 @@ func Test_divideCeil(t *testing.T) {
 		}
 	}
 }
+
+func Test_upscaleNearest(t *testing.T) {
+	img := image.NewPaletted(image.Rect(10, 20, 13, 22), pixelcanvasioPalette)
+	img.SetColorIndex(11, 21, 5)
+
+	scaled, ok := upscaleNearest(img, 3).(*image.Paletted)
+	if !ok {
+		t.Fatalf("Scaled image isn't paletted")
+	}
+	if got, want := scaled.Rect, image.Rect(0, 0, 9, 6); got != want {
+		t.Fatalf("Bounds = %v, want %v", got, want)
+	}
+	for iy := 0; iy < 6; iy++ {
+		for ix := 0; ix < 9; ix++ {
+			want := uint8(0)
+			if ix >= 3 && ix < 6 && iy >= 3 {
+				want = 5
+			}
+			if got := scaled.ColorIndexAt(ix, iy); got != want {
+				t.Errorf("Color index at %v = %v, want %v", image.Point{ix, iy}, got, want)
+			}
+		}
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	rgba.Set(1, 0, pixelcanvasioPalette[3])
+	if got, want := upscaleNearest(rgba, 2).At(3, 1), rgba.At(1, 0); got != want {
+		t.Errorf("Color at (3,1) = %v, want %v", got, want)
+	}
+}
+
+func Test_copyImagePaletted(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	rgba.Set(5, 2, pixelcanvasioPalette[3])
+	img := rgba.SubImage(image.Rect(4, 1, 7, 3)) // Subimage with a larger stride
+
+	result, err := copyImagePaletted(img)
+	if err != nil {
+		t.Fatalf("copyImagePaletted() failed: %v", err)
+	}
+	paletted, ok := result.(*image.Paletted)
+	if !ok {
+		t.Fatalf("Copy is %T, want *image.Paletted", result)
+	}
+	if paletted.Rect != img.Bounds() || len(paletted.Palette) != 2 {
+		t.Errorf("Copy has bounds %v and %v colors, want %v and 2 colors", paletted.Rect, len(paletted.Palette), img.Bounds())
+	}
+	for iy := 1; iy < 3; iy++ {
+		for ix := 4; ix < 7; ix++ {
+			if got, want := color.RGBAModel.Convert(paletted.At(ix, iy)), img.At(ix, iy); got != want {
+				t.Errorf("Color at %v = %v, want %v", image.Point{ix, iy}, got, want)
+			}
+		}
+	}
+
+	// Images with more than 256 colors stay RGBA
+	colorful := image.NewRGBA(image.Rect(0, 0, 16, 17))
+	for i := 0; i < 16*17; i++ {
+		colorful.Pix[i*4], colorful.Pix[i*4+1], colorful.Pix[i*4+3] = uint8(i), uint8(i>>8), 255
+	}
+	if result, err := copyImagePaletted(colorful); err != nil {
+		t.Errorf("copyImagePaletted() failed: %v", err)
+	} else if _, ok := result.(*image.RGBA); !ok {
+		t.Errorf("Copy of an image with %v colors is %T, want *image.RGBA", 16*17, result)
+	}
+}
+
+func Test_copyImagePalettedNearest(t *testing.T) {
+	colorful := image.NewRGBA(image.Rect(0, 0, 16, 17))
+	for i := 0; i < 16*17; i++ {
+		colorful.Pix[i*4], colorful.Pix[i*4+1], colorful.Pix[i*4+3] = uint8(i), uint8(i>>8), 255
+	}
+
+	paletted := copyImagePalettedNearest(colorful)
+	if paletted.Rect != colorful.Rect || len(paletted.Palette) != 256 {
+		t.Fatalf("Copy has bounds %v and %v colors, want %v and 256 colors", paletted.Rect, len(paletted.Palette), colorful.Rect)
+	}
+	// The first 256 colors are kept, the others are replaced by the closest ones
+	if got, want := color.RGBAModel.Convert(paletted.At(15, 15)), colorful.At(15, 15); got != want {
+		t.Errorf("Color at (15, 15) = %v, want %v", got, want)
+	}
+	// {15, 1, 0, 255} isn't in the palette
+	if got, want := color.RGBAModel.Convert(paletted.At(15, 16)), (color.RGBA{15, 0, 0, 255}); got != want {
+		t.Errorf("Color at (15, 16) = %v, want the closest color %v", got, want)
+	}
+}